@@ -0,0 +1,208 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------
+// This file contains helpers shared by the client commands (eg. shhh udp), which connect to a shhh server
+// themselves instead of going through ssh
+// ----------
+
+// clientOptions are the options of client commands for connecting to a server
+type clientOptions struct {
+	server     string // host[:port] of the server, or a tls://, wss:// or ws:// URL (see dialWrapped)
+	user       string
+	identity   string // private key to authenticate with; the ssh agent / default keys are used if empty
+	knownHosts string
+	insecure   bool // don't verify the server's host key
+}
+
+// register defines the options on [flags]
+func (opts *clientOptions) register(flags *flag.FlagSet) {
+	var username = "shhh"
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+
+	flags.StringVar(&opts.server, "server", "", "address (host[:port]) of the shhh server, or a tls://host, wss://host/path or ws://host/path URL to reach its wrapped ssh listener")
+	flags.StringVar(&opts.user, "user", username, "user to connect as")
+	flags.StringVar(&opts.identity, "i", "", "private key to authenticate with (default: the ssh agent, or ~/.ssh/id_*)")
+	flags.StringVar(&opts.knownHosts, "known-hosts", filepath.Join(homeDir(), ".ssh", "known_hosts"), "file with the server's host key")
+	flags.BoolVar(&opts.insecure, "insecure", false, "don't verify the server's host key")
+}
+
+// dial connects to the server
+func (opts *clientOptions) dial() (*gossh.Client, error) {
+	if opts.server == "" {
+		return nil, errors.New("the server's address must be specified with -server")
+	}
+
+	auth, err := opts.authMethods()
+	if err != nil {
+		return nil, err
+	}
+
+	var hostKeyCallback = gossh.InsecureIgnoreHostKey()
+	if !opts.insecure {
+		if hostKeyCallback, err = knownhosts.New(opts.knownHosts); err != nil {
+			return nil, errors.Wrap(err, "failed to read known hosts (connect with ssh once, or use -insecure)")
+		}
+	}
+
+	var config = &gossh.ClientConfig{User: opts.user, Auth: auth, HostKeyCallback: hostKeyCallback, Timeout: 10 * time.Second}
+	if !strings.Contains(opts.server, "://") {
+		var addr = opts.server
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "2222")
+		}
+
+		client, err := gossh.Dial("tcp", addr, config)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to connect to %s", addr)
+		}
+		return client, nil
+	}
+
+	u, err := url.Parse(opts.server)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid server address")
+	}
+
+	conn, addr, err := dialWrapped(u, config.Timeout, opts.insecure)
+	if err != nil {
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(config.Timeout))
+	c, channels, requests, err := gossh.NewClientConn(conn, addr, config)
+	if err != nil {
+		_ = conn.Close()
+		return nil, errors.Wrapf(err, "failed to connect to %s", addr)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return gossh.NewClient(c, channels, requests), nil
+}
+
+// host returns the host name of the server
+func (opts *clientOptions) host() string {
+	if u, err := url.Parse(opts.server); err == nil && strings.Contains(opts.server, "://") {
+		return u.Hostname()
+	}
+	if host, _, err := net.SplitHostPort(opts.server); err == nil {
+		return host
+	}
+	return opts.server
+}
+
+// authMethods returns the ways of authenticating with the server: the key given with -i, or else the keys of the
+// ssh agent (if running) and the default keys (if not passphrase protected)
+func (opts *clientOptions) authMethods() ([]gossh.AuthMethod, error) {
+	if opts.identity != "" {
+		signer, err := loadSigner(opts.identity)
+		if err != nil {
+			return nil, err
+		}
+		return []gossh.AuthMethod{gossh.PublicKeys(signer)}, nil
+	}
+
+	var methods []gossh.AuthMethod
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			methods = append(methods, gossh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	var signers []gossh.Signer
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		if signer, err := loadSigner(filepath.Join(homeDir(), ".ssh", name)); err == nil {
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) > 0 {
+		methods = append(methods, gossh.PublicKeys(signers...))
+	}
+
+	// the server may not require authentication at all
+	return append(methods, gossh.KeyboardInteractive(func(_, _ string, _ []string, _ []bool) ([]string, error) {
+		return nil, nil
+	})), nil
+}
+
+// loadSigner reads the private key at [path]
+func loadSigner(path string) (gossh.Signer, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read private key")
+	}
+
+	signer, err := gossh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse private key %s (passphrase protected keys need the ssh agent)", path)
+	}
+	return signer, nil
+}
+
+// homeDir returns the home directory of the current user
+func homeDir() string {
+	if home, err := os.UserHomeDir(); err == nil {
+		return home
+	}
+	return "."
+}
+
+// forwardSpec is a forwarding given like ssh -R: [bind_address:]port:host:hostport
+type forwardSpec struct {
+	bindAddr string
+	bindPort uint32
+	target   string // host:hostport
+}
+
+// parseForwardSpec parses [spec], given as [bind_address:]port:host:hostport
+func parseForwardSpec(spec string) (forwardSpec, error) {
+	var parts = strings.Split(spec, ":")
+	if len(parts) == 3 {
+		parts = append([]string{""}, parts...)
+	}
+	if len(parts) != 4 {
+		return forwardSpec{}, errors.Errorf("invalid forwarding %q: must be [bind_address:]port:host:hostport", spec)
+	}
+
+	port, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return forwardSpec{}, errors.Errorf("invalid forwarding %q: invalid port %q", spec, parts[1])
+	}
+	if _, err = strconv.ParseUint(parts[3], 10, 16); err != nil || parts[2] == "" {
+		return forwardSpec{}, errors.Errorf("invalid forwarding %q: invalid target %s:%s", spec, parts[2], parts[3])
+	}
+
+	return forwardSpec{bindAddr: parts[0], bindPort: uint32(port), target: net.JoinHostPort(parts[2], parts[3])}, nil
+}
+
+// forwardSpecs is a flag.Value that collects forwardings from a repeated flag
+type forwardSpecs []forwardSpec
+
+func (specs *forwardSpecs) String() string { return fmt.Sprintf("%d forwardings", len(*specs)) }
+
+func (specs *forwardSpecs) Set(value string) error {
+	spec, err := parseForwardSpec(value)
+	if err != nil {
+		return err
+	}
+	*specs = append(*specs, spec)
+	return nil
+}
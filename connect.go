@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file implements the connect command, a replacement for ssh -R: it keeps a client's tunnels up, reconnecting
+// with exponential backoff whenever the connection is lost, and asking for the same endpoints (ports and names)
+// again each time. TCP (and HTTP / TLS) tunnels are forwarded as with tcpip-forward, UDP ones as with shhh udp.
+// ----------
+
+// delay before the first reconnection attempt, doubled after each failed one
+const initialBackoff = time.Second
+
+// interval of keepalive requests, and how long the server has to answer one before the connection is given up
+const (
+	keepaliveInterval = 15 * time.Second
+	keepaliveTimeout  = 10 * time.Second
+)
+
+// number of times a remembered endpoint is asked for again, after being refused, before falling back to the
+// forwarding as given (eg. when another client took the port in the meantime)
+const maxEndpointRefusals = 3
+
+// connectCommand implements the "connect" command
+func connectCommand(args []string) error {
+	var flags = flag.NewFlagSet("connect", flag.ExitOnError)
+	var opts clientOptions
+	opts.register(flags)
+	var tcp, udp forwardSpecs
+	flags.Var(&tcp, "R", "forward a public port (80 for HTTP, 443 for TLS) to a local one, as [bind_address:]port:host:hostport (can be repeated)")
+	flags.Var(&udp, "U", "forward a public UDP port to a local one, as [bind_address:]port:host:hostport (can be repeated)")
+	var maxBackoff = flags.Duration("max-backoff", time.Minute, "longest delay between reconnection attempts")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: shhh connect -server host[:port] -R spec... [-U spec...] [-- session options]\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if len(tcp)+len(udp) == 0 {
+		return errors.New("nothing to forward; use -R (or -U) [bind_address:]port:host:hostport")
+	}
+
+	var c = &connector{opts: &opts, options: flags.Args()}
+	for _, spec := range tcp {
+		c.tunnels = append(c.tunnels, &connectTunnel{spec: spec, bindAddr: spec.bindAddr, bindPort: spec.bindPort})
+	}
+	for _, spec := range udp {
+		c.tunnels = append(c.tunnels, &connectTunnel{spec: spec, udp: true, bindAddr: spec.bindAddr, bindPort: spec.bindPort})
+	}
+
+	return c.run(*maxBackoff)
+}
+
+// connectTunnel is a tunnel maintained by the connect command
+type connectTunnel struct {
+	spec forwardSpec
+	udp  bool
+
+	// endpoint asked for when (re)connecting; the one the server assigned after the first connection, if the spec
+	// left it up to the server (port 0, or a generated name)
+	bindAddr string
+	bindPort uint32
+	refused  int // number of consecutive refusals of the remembered endpoint
+}
+
+// remembered returns true if the tunnel asks for an endpoint the server assigned, rather than the spec's
+func (t *connectTunnel) remembered() bool {
+	return t.bindAddr != t.spec.bindAddr || t.bindPort != t.spec.bindPort
+}
+
+// named returns true if the tunnel's endpoint is named by its bind address (ie. an HTTP or TLS tunnel)
+func (t *connectTunnel) named() bool {
+	return !t.udp && (t.spec.bindPort == 80 || t.spec.bindPort == 443)
+}
+
+// connector maintains the tunnels of the connect command
+type connector struct {
+	opts    *clientOptions
+	options []string // session options passed on to the server (eg. --subdomain or --basic-auth)
+
+	mu      sync.Mutex
+	tunnels []*connectTunnel
+}
+
+// run connects to the server and forwards the tunnels, reconnecting (after at most [maxBackoff]) whenever the
+// connection is lost. It only returns if the first connection fails, or the server rejects the session options.
+func (c *connector) run(maxBackoff time.Duration) error {
+	var backoff = initialBackoff
+	for attempt := 0; ; attempt++ {
+		established, err := c.connect()
+		if err == nil {
+			err = errors.New("connection closed")
+		}
+
+		if _, fatal := err.(rejectedOptions); fatal || (attempt == 0 && !established) {
+			return err
+		}
+
+		if established {
+			backoff = initialBackoff
+		}
+		log.Printf("connect: %s; reconnecting in %s", err.Error(), backoff)
+		time.Sleep(backoff)
+
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// rejectedOptions is returned when the server rejects the session options, which reconnecting won't fix
+type rejectedOptions struct{ error }
+
+// connect connects to the server, forwards the tunnels and waits until the connection is lost. [established] is
+// true if all the tunnels were forwarded.
+func (c *connector) connect() (established bool, err error) {
+	client, err := c.opts.dial()
+	if err != nil {
+		return false, err
+	}
+	defer client.Close()
+
+	var done = make(chan error, 2)
+	go func() { done <- client.Wait() }()
+	go c.keepalive(client)
+
+	// the session carries the server's messages, including the public address of each tunnel
+	if err = c.session(client, done); err != nil {
+		return false, err
+	}
+
+	if err = c.forward(client); err != nil {
+		return false, err
+	}
+
+	if err = <-done; err != nil {
+		if _, rejected := err.(rejectedOptions); !rejected {
+			err = errors.Wrap(err, "connection lost")
+		}
+	}
+	return true, err
+}
+
+// session starts a session on [client] with the session options, and prints the server's messages. A rejection
+// of the options (which the server answers with exit status 2) is sent on [done].
+func (c *connector) session(client *gossh.Client, done chan<- error) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return errors.Wrap(err, "failed to open session")
+	}
+
+	stderr, err := session.StderrPipe()
+	if err != nil {
+		return errors.Wrap(err, "failed to open session")
+	}
+
+	var command = []string{"--json"}
+	for _, option := range c.options {
+		command = append(command, quote(option))
+	}
+	if err = session.Start(strings.Join(command, " ")); err != nil {
+		return errors.Wrap(err, "failed to start session")
+	}
+
+	go func() {
+		var lines = bufio.NewScanner(stderr)
+		for lines.Scan() {
+			c.message(lines.Text())
+		}
+
+		// the reason was written to the session, and printed already
+		if exit, ok := session.Wait().(*gossh.ExitError); ok && exit.ExitStatus() == 2 {
+			done <- rejectedOptions{errors.New("server rejected the session options")}
+		}
+	}()
+
+	return nil
+}
+
+// message prints a [line] the server wrote to the session: the public address of tunnels to stdout, anything else
+// (including errors which aren't JSON, eg. about invalid options) to stderr
+func (c *connector) message(line string) {
+	var msg struct {
+		Type     string `json:"type"`
+		Message  string `json:"message"`
+		Protocol string `json:"protocol"`
+		Address  string `json:"address"`
+	}
+	if err := json.Unmarshal([]byte(line), &msg); err != nil {
+		fmt.Fprintln(os.Stderr, line)
+		return
+	}
+
+	if msg.Type != "forwarding" {
+		fmt.Fprintln(os.Stderr, msg.Message)
+		return
+	}
+
+	fmt.Println(msg.Address)
+	if msg.Protocol == "http" || msg.Protocol == "tls" {
+		c.rememberName(msg.Protocol, msg.Address)
+	}
+}
+
+// rememberName remembers the name the server generated for an HTTP or TLS tunnel, from its public [address], so
+// that it's asked for again when reconnecting
+func (c *connector) rememberName(protocol, address string) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return
+	}
+	var name = strings.SplitN(u.Hostname(), ".", 2)[0]
+
+	var port uint32 = 80
+	if protocol == "tls" {
+		port = 443
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var unnamed *connectTunnel
+	for _, t := range c.tunnels {
+		if !t.named() || t.spec.bindPort != port {
+			continue
+		}
+		if strings.EqualFold(t.bindAddr, name) {
+			return // a tunnel already asks for it
+		}
+		if unnamed == nil && isWildcard(t.bindAddr) {
+			unnamed = t
+		}
+	}
+
+	if unnamed != nil {
+		unnamed.bindAddr = name
+	}
+}
+
+// forward asks the server on [client] to forward each of the tunnels, and relays the connections it opens
+func (c *connector) forward(client *gossh.Client) error {
+	// channels may arrive as soon as a tunnel is forwarded, so they're handled before requesting any
+	var targets = make(map[string]string) // local target, by the tunnel's bind address and port
+	var targetsMu sync.RWMutex
+
+	var channels = client.HandleChannelOpen("forwarded-tcpip")
+	go func() {
+		for ch := range channels {
+			var payload struct {
+				DestAddr   string
+				DestPort   uint32
+				OriginAddr string
+				OriginPort uint32
+			}
+			if err := gossh.Unmarshal(ch.ExtraData(), &payload); err != nil {
+				_ = ch.Reject(gossh.ConnectionFailed, "malformed request")
+				continue
+			}
+
+			targetsMu.RLock()
+			var target, ok = targets[endpointKey(payload.DestAddr, payload.DestPort)]
+			targetsMu.RUnlock()
+			if !ok {
+				_ = ch.Reject(gossh.Prohibited, "port isn't forwarded")
+				continue
+			}
+			go relayConnection(ch, target)
+		}
+	}()
+
+	c.mu.Lock()
+	var tunnels = append([]*connectTunnel(nil), c.tunnels...)
+	c.mu.Unlock()
+
+	var udp []*connectTunnel
+	for _, t := range tunnels {
+		if t.udp {
+			udp = append(udp, t)
+			continue
+		}
+
+		c.mu.Lock()
+		var payload = struct {
+			BindAddr string
+			BindPort uint32
+		}{t.bindAddr, t.bindPort}
+		c.mu.Unlock()
+
+		ok, reply, err := client.SendRequest("tcpip-forward", true, gossh.Marshal(&payload))
+		if err != nil {
+			return errors.Wrap(err, "failed to request forwarding")
+		}
+		if !ok {
+			return c.refused(t, errors.Errorf("server refused to forward %s:%d: %s", payload.BindAddr, payload.BindPort, string(reply)))
+		}
+
+		var port = payload.BindPort
+		var response struct{ BindPort uint32 }
+		if gossh.Unmarshal(reply, &response) == nil && response.BindPort != 0 {
+			port = response.BindPort
+		}
+
+		targetsMu.Lock()
+		targets[endpointKey(payload.BindAddr, port)] = t.spec.target
+		targetsMu.Unlock()
+
+		c.mu.Lock()
+		t.bindPort, t.refused = port, 0
+		c.mu.Unlock()
+	}
+
+	if len(udp) == 0 {
+		return nil
+	}
+
+	var specs []forwardSpec
+	c.mu.Lock()
+	for _, t := range udp {
+		specs = append(specs, forwardSpec{bindAddr: t.bindAddr, bindPort: t.bindPort, target: t.spec.target})
+	}
+	c.mu.Unlock()
+
+	forwarder, err := forwardUDP(client, specs)
+	if err != nil {
+		if forwarder == nil {
+			return err
+		}
+		// forwardUDP stops at the first refused tunnel
+		return c.refused(udp[len(forwarder.ports)], err)
+	}
+
+	c.mu.Lock()
+	for i, t := range udp {
+		t.bindPort, t.refused = forwarder.ports[i], 0
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// refused handles the refusal ([err]) to forward [t], and returns [err]: a remembered endpoint is asked for again on
+// the next connections, in case the server still holds it for the connection that was lost, but only a few times
+func (c *connector) refused(t *connectTunnel, err error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if t.remembered() {
+		if t.refused++; t.refused >= maxEndpointRefusals {
+			log.Printf("connect: giving up on %s:%d; asking for %s:%d instead", t.bindAddr, t.bindPort, t.spec.bindAddr, t.spec.bindPort)
+			t.bindAddr, t.bindPort, t.refused = t.spec.bindAddr, t.spec.bindPort, 0
+		}
+	}
+	return err
+}
+
+// keepalive sends keepalive requests on [client], and closes it once the server stops answering them
+func (c *connector) keepalive(client *gossh.Client) {
+	var ticker = time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var answered = make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			answered <- err
+		}()
+
+		select {
+		case err := <-answered:
+			if err != nil {
+				return // the connection is closed
+			}
+		case <-time.After(keepaliveTimeout):
+			log.Printf("connect: server didn't answer keepalive within %s", keepaliveTimeout)
+			_ = client.Close()
+			return
+		}
+	}
+}
+
+// relayConnection accepts the forwarded connection on [ch] and relays it to (and back from) [target]
+func relayConnection(ch gossh.NewChannel, target string) {
+	local, err := net.Dial("tcp", target)
+	if err != nil {
+		log.Printf("connect: failed to connect to %s: %s", target, err.Error())
+		_ = ch.Reject(gossh.ConnectionFailed, err.Error())
+		return
+	}
+	defer local.Close()
+
+	channel, requests, err := ch.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	go gossh.DiscardRequests(requests)
+
+	var done = make(chan struct{})
+	go func() {
+		_, _ = io.Copy(channel, local)
+		_ = channel.CloseWrite()
+		close(done)
+	}()
+
+	_, _ = io.Copy(local, channel)
+	if tcp, ok := local.(*net.TCPConn); ok {
+		_ = tcp.CloseWrite()
+	}
+	<-done
+}
+
+// endpointKey identifies a tunnel by its bind address and port, as they appear in forwarded-tcpip channels
+func endpointKey(addr string, port uint32) string {
+	return fmt.Sprintf("%s:%d", addr, port)
+}
+
+// isWildcard returns true if [addr] leaves the name of an HTTP or TLS tunnel up to the server
+func isWildcard(addr string) bool {
+	switch addr {
+	case "", "*", "localhost", "0.0.0.0", "::", "127.0.0.1", "::1":
+		return true
+	}
+	return false
+}
+
+// quote quotes [s] as a single word of a command line
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	"github.com/riyaz-ali/shhh/server"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ----------
+// An example of a custom-branded tunnel service built on the server package: HTTP tunnels are served as
+// <name>.<domain> alongside the service's own landing page at the apex domain, visitors of unknown names get a
+// branded page, and the service keeps its own log of tunnels through events. Run it and try:
+//
+//	go run ./examples/branded -domain localhost -http-addr :8080
+//	ssh -p 2222 -R myapp:80:localhost:3000 localhost
+//	curl -H 'Host: myapp.localhost' localhost:8080
+// ----------
+
+const brand = "Burrow"
+
+var landing = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html><head><title>{{.Brand}}</title></head>
+<body><h1>{{.Brand}}</h1><p>Share your local web app with the world:</p>
+<pre>ssh -p 2222 -R myapp:80:localhost:3000 {{.Domain}}</pre>
+<h2>Live tunnels</h2><ul>{{range .Tunnels}}<li>{{.Address}} ({{.Connections}} connections)</li>{{else}}<li>none yet</li>{{end}}</ul>
+</body></html>
+`))
+
+var notFound = template.Must(template.New("not-found").Parse(`<!DOCTYPE html>
+<html><head><title>{{.Brand}}: nothing here</title></head>
+<body><h1>Nothing here (yet)</h1><p>No one is sharing <b>{{.Host}}</b> on {{.Brand}} right now.</p></body></html>
+`))
+
+func main() {
+	var config = server.DefaultConfig()
+	var flags = flag.NewFlagSet("branded", flag.ExitOnError)
+	flags.StringVar(&config.Addr, "addr", config.Addr, "address to listen for incoming ssh connections on")
+	flags.StringVar(&config.HTTPAddr, "http-addr", ":8080", "address to listen for incoming HTTP requests on")
+	flags.StringVar(&config.Domain, "domain", config.Domain, "domain under which HTTP tunnels are exposed as sub-domains")
+	_ = flags.Parse(os.Args[1:])
+
+	srv, err := server.New(config,
+		// greet clients with the service's name before they authenticate
+		server.WithBannerHandler(func(ctx ssh.Context) string {
+			return fmt.Sprintf("Welcome to %s, %s!\n", brand, ctx.User())
+		}),
+
+		// only HTTP tunnels (which are routed by hostname) are offered; no raw TCP ports
+		server.WithPortPolicy(server.PortPolicyFunc(func(_ ssh.Context, port uint32) bool { return port == 80 })),
+
+		// visitors of names no one is sharing get a branded page instead of a bare 404
+		server.WithFallbackHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusNotFound)
+			_ = notFound.Execute(w, map[string]interface{}{"Brand": brand, "Host": r.Host})
+		})),
+
+		// keep the service's own record of tunnels coming and going
+		server.WithEventHandler(func(e server.TunnelEvent) {
+			log.Printf("%s: %s %s (key %s)", brand, e.Type, e.Address, e.Fingerprint)
+		}),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the apex domain serves the landing page; everything else is routed to tunnels by the edge
+	var edge = srv.HTTPHandler()
+	var web = &http.Server{Addr: config.HTTPAddr, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var host = strings.ToLower(r.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		if host != strings.ToLower(config.Domain) {
+			edge.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_ = landing.Execute(w, map[string]interface{}{"Brand": brand, "Domain": config.Domain, "Tunnels": srv.Tunnels()})
+	})}
+
+	go func() {
+		if err := web.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	go func() {
+		var signals = make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		<-signals
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_ = web.Shutdown(ctx)
+		_ = srv.Shutdown(ctx)
+	}()
+
+	ln, err := net.Listen("tcp", config.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("%s is up: ssh on %s, web on %s", brand, config.Addr, config.HTTPAddr)
+	if err = srv.Serve(ln); err != ssh.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/riyaz-ali/shhh/server"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// ----------
+// An example of middleware loaded from a Go plugin: it tags responses of HTTP tunnels with a header, and logs how
+// many bytes each visitor of a TCP tunnel sent. Build it against the same checkout as the server, and load it:
+//
+//	go build -buildmode=plugin -o middleware.so ./examples/middleware
+//	shhh -middleware-plugin middleware.so
+// ----------
+
+// NewMiddleware is looked up by the server when loading the plugin
+func NewMiddleware() (server.Middleware, error) { return &example{}, nil }
+
+// example is the plugin's server.Middleware
+type example struct{}
+
+func (*example) Conn(conn net.Conn) (net.Conn, error) { return &countingConn{Conn: conn}, nil }
+
+func (*example) HTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Middleware", "example")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// countingConn counts bytes read from the visitor, and logs them once the connection is closed
+type countingConn struct {
+	net.Conn
+	read int64
+	once sync.Once
+}
+
+func (conn *countingConn) Read(p []byte) (int, error) {
+	n, err := conn.Conn.Read(p)
+	atomic.AddInt64(&conn.read, int64(n))
+	return n, err
+}
+
+func (conn *countingConn) Close() error {
+	conn.once.Do(func() {
+		log.Printf("example middleware: %s sent %d bytes", conn.RemoteAddr(), atomic.LoadInt64(&conn.read))
+	})
+	return conn.Conn.Close()
+}
+
+func main() {}
@@ -0,0 +1,300 @@
+package harness
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains the ssh client of the harness: it asks for forwardings as ssh -R does (with tcpip-forward
+// requests), and hands the connections of visitors to each forwarding's Listener
+// ----------
+
+// how long clients wait for the server to accept their connection
+const dialTimeout = 10 * time.Second
+
+// Client is an ssh client of a Server, with a session whose output it reads as messages
+type Client struct {
+	*gossh.Client
+
+	// lines the server writes to the client's session (eg. "server: forwarding TCP traffic from ..."), as JSON with
+	// the --json option; closed once the session ends
+	Messages <-chan string
+
+	session *gossh.Session
+	stdin   io.Closer // kept open, as the server ends the session once its input ends
+
+	mu        sync.Mutex
+	listeners map[string]*Listener // by bind address and port, as they appear in forwarded-tcpip channels
+}
+
+// dial connects to the ssh server at [addr] with [key] (without authenticating if nil), and starts a session with
+// [options]
+func dial(addr string, key gossh.Signer, options []string) (_ *Client, err error) {
+	var auth []gossh.AuthMethod
+	if key != nil {
+		auth = append(auth, gossh.PublicKeys(key))
+	}
+
+	client, err := gossh.Dial("tcp", addr, &gossh.ClientConfig{
+		User:            "harness",
+		Auth:            auth,
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		Timeout:         dialTimeout,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect")
+	}
+	defer func() {
+		if err != nil {
+			_ = client.Close()
+		}
+	}()
+
+	var c = &Client{Client: client, listeners: make(map[string]*Listener)}
+	go c.accept(client.HandleChannelOpen("forwarded-tcpip"))
+
+	if c.session, err = client.NewSession(); err != nil {
+		return nil, errors.Wrap(err, "failed to open session")
+	}
+
+	if c.stdin, err = c.session.StdinPipe(); err != nil {
+		return nil, err
+	}
+	stdout, err := c.session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := c.session.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = c.session.Start(command(options)); err != nil {
+		return nil, errors.Wrap(err, "failed to start session")
+	}
+
+	var messages = make(chan string, 64)
+	c.Messages = messages
+	var wg sync.WaitGroup
+	for _, r := range []io.Reader{stdout, stderr} { // messages are written to stderr, unless asked for on stdout
+		wg.Add(1)
+		go func(r io.Reader) {
+			defer wg.Done()
+			var scanner = bufio.NewScanner(r)
+			for scanner.Scan() {
+				messages <- scanner.Text()
+			}
+		}(r)
+	}
+	go func() {
+		wg.Wait()
+		close(messages)
+	}()
+	return c, nil
+}
+
+// command returns [options] as the exec command of a session, quoting those with spaces
+func command(options []string) string {
+	var quoted = make([]string, len(options))
+	for i, option := range options {
+		if strings.ContainsAny(option, " \t\"'") {
+			option = strconv.Quote(option)
+		}
+		quoted[i] = option
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Listen asks the server to forward [bindPort] (0 for any free port, 80 for an HTTP tunnel etc.) with [bindAddr]
+// (eg. the name of an HTTP tunnel), as ssh -R bindAddr:bindPort:... does. Connections of visitors are accepted from
+// the returned Listener. If the server refuses, the error has its reason.
+func (c *Client) Listen(bindAddr string, bindPort uint32) (*Listener, error) {
+	var payload = struct {
+		BindAddr string
+		BindPort uint32
+	}{bindAddr, bindPort}
+
+	// the listener is registered before asking, as visitors may connect as soon as the server binds the port
+	var ln = newListener(c, bindAddr, bindPort)
+	if bindPort != 0 {
+		c.register(ln)
+	}
+
+	ok, reply, err := c.SendRequest("tcpip-forward", true, gossh.Marshal(&payload))
+	if err != nil || !ok {
+		c.unregister(ln)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to request forwarding")
+		}
+		return nil, errors.Errorf("server refused to forward %s:%d: %s", bindAddr, bindPort, string(reply))
+	}
+
+	var response struct{ BindPort uint32 }
+	if bindPort == 0 && gossh.Unmarshal(reply, &response) == nil {
+		ln.Port = response.BindPort
+		c.register(ln)
+	}
+	return ln, nil
+}
+
+// Wait returns the next message containing [text], or an error if there's none within [timeout] (or the session
+// ends before). Messages before it are skipped.
+func (c *Client) Wait(text string, timeout time.Duration) (string, error) {
+	var timer = time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case msg, ok := <-c.Messages:
+			if !ok {
+				return "", errors.Errorf("session ended before a message with %q", text)
+			}
+			if strings.Contains(msg, text) {
+				return msg, nil
+			}
+		case <-timer.C:
+			return "", errors.Errorf("no message with %q within %s", text, timeout)
+		}
+	}
+}
+
+// Close closes the client's session and connection (and so its tunnels)
+func (c *Client) Close() error {
+	_ = c.stdin.Close()
+	_ = c.session.Close()
+	return c.Client.Close()
+}
+
+func (c *Client) register(ln *Listener) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.listeners[ln.key()] = ln
+}
+
+func (c *Client) unregister(ln *Listener) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.listeners[ln.key()] == ln {
+		delete(c.listeners, ln.key())
+	}
+}
+
+// accept hands the forwarded connections on [channels] to the listeners of their forwardings
+func (c *Client) accept(channels <-chan gossh.NewChannel) {
+	for ch := range channels {
+		var payload struct {
+			DestAddr   string
+			DestPort   uint32
+			OriginAddr string
+			OriginPort uint32
+		}
+		if err := gossh.Unmarshal(ch.ExtraData(), &payload); err != nil {
+			_ = ch.Reject(gossh.ConnectionFailed, "malformed request")
+			continue
+		}
+
+		c.mu.Lock()
+		var ln = c.listeners[endpointKey(payload.DestAddr, payload.DestPort)]
+		c.mu.Unlock()
+		if ln == nil {
+			_ = ch.Reject(gossh.Prohibited, "port isn't forwarded")
+			continue
+		}
+
+		var origin = &net.TCPAddr{IP: net.ParseIP(payload.OriginAddr), Port: int(payload.OriginPort)}
+		go ln.deliver(ch, origin)
+	}
+}
+
+// endpointKey identifies a forwarding by its bind address and port, as they appear in forwarded-tcpip channels
+func endpointKey(addr string, port uint32) string {
+	return fmt.Sprintf("%s:%d", addr, port)
+}
+
+// Listener is a net.Listener of the connections forwarded by the server for a tunnel
+type Listener struct {
+	BindAddr string
+	Port     uint32 // the port forwarded (the one assigned by the server if the client asked for 0)
+
+	client *Client
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newListener(c *Client, bindAddr string, port uint32) *Listener {
+	return &Listener{BindAddr: bindAddr, Port: port, client: c, conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (ln *Listener) key() string { return endpointKey(ln.BindAddr, ln.Port) }
+
+// deliver accepts the channel of a visitor's connection (from [origin]), and hands it to the listener's Accept; it's
+// rejected (or closed) if the listener is closed first
+func (ln *Listener) deliver(ch gossh.NewChannel, origin net.Addr) {
+	select {
+	case <-ln.closed:
+		_ = ch.Reject(gossh.Prohibited, "listener closed")
+		return
+	default:
+	}
+
+	channel, requests, err := ch.Accept()
+	if err != nil {
+		return
+	}
+	go gossh.DiscardRequests(requests)
+
+	select {
+	case ln.conns <- &channelConn{Channel: channel, local: ln.Addr(), remote: origin}:
+	case <-ln.closed:
+		_ = channel.Close()
+	}
+}
+
+func (ln *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.conns:
+		return conn, nil
+	case <-ln.closed:
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: ln.Addr(), Err: errors.New("listener closed")}
+	}
+}
+
+// Close closes the listener; connections to its tunnel are refused from then on, but the server keeps the tunnel
+// open until the client closes (there's no cancel-tcpip-forward)
+func (ln *Listener) Close() error {
+	ln.once.Do(func() {
+		close(ln.closed)
+		ln.client.unregister(ln)
+	})
+	return nil
+}
+
+func (ln *Listener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(ln.Port)}
+}
+
+// channelConn is a net.Conn over the ssh channel of a forwarded connection; it has no deadlines
+type channelConn struct {
+	gossh.Channel
+	local, remote net.Addr
+}
+
+func (c *channelConn) LocalAddr() net.Addr { return c.local }
+
+func (c *channelConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *channelConn) SetDeadline(time.Time) error { return nil }
+
+func (c *channelConn) SetReadDeadline(time.Time) error { return nil }
+
+func (c *channelConn) SetWriteDeadline(time.Time) error { return nil }
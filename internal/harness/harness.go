@@ -0,0 +1,205 @@
+package harness
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/shhh/server"
+	gossh "golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ----------
+// This package runs a real shhh server in-process, on ephemeral loopback ports, and connects to it as an ssh client
+// would (with golang.org/x/crypto/ssh): clients ask for forwardings, serve the connections visitors open through their
+// tunnels, and read the messages the server writes to their sessions. It's meant for end-to-end tests of the server's
+// features (authentication, limits, the HTTP edge etc.) which drive it from the outside, as users do, eg:
+//
+//	srv, err := harness.Start(nil)
+//	...
+//	defer srv.Close()
+//
+//	client, err := srv.Dial("--json")
+//	...
+//	ln, err := client.Listen("", 0) // as ssh -R 0:...
+//	...
+//	go http.Serve(ln, handler)
+//	resp, err := http.Get("http://" + srv.TunnelAddr(ln.Port) + "/")
+// ----------
+
+// how long Close waits for the server to drain its tunnels
+const shutdownTimeout = 5 * time.Second
+
+// Server is a shhh server running in-process, listening on loopback
+type Server struct {
+	*server.Server
+
+	Config   *server.Config
+	Addr     string       // address of the ssh server
+	HTTPAddr string       // address of the HTTP edge; empty unless Config.HTTPAddr is set
+	Key      gossh.Signer // a key the server allows, unless [options] authenticate clients otherwise
+
+	dir      string // temporary directory of the server's files
+	ssh      net.Listener
+	http     net.Listener
+	served   chan error
+	nServing int
+}
+
+// Start starts a server with [config] (DefaultConfig if nil) and [options], as server.New does. Its ssh server (and
+// HTTP edge, if Config.HTTPAddr is set) listens on ephemeral loopback ports, whatever [config] says, and tunnels are
+// bound on loopback. Unless [config] names authorized keys, they're the generated Server.Key.
+func Start(config *server.Config, options ...server.Option) (*Server, error) {
+	return start(config, false, options)
+}
+
+// StartAnonymous starts a server as Start does, but letting clients connect without authenticating (unless [config]
+// or [options] authenticate them), eg. to test what anonymous clients (see DialAnonymous) can do
+func StartAnonymous(config *server.Config, options ...server.Option) (*Server, error) {
+	return start(config, true, options)
+}
+
+// start starts a server with [config] and [options]; clients must authenticate unless it's [anonymous]
+func start(config *server.Config, anonymous bool, options []server.Option) (_ *Server, err error) {
+	if config == nil {
+		config = server.DefaultConfig()
+	}
+	config.BindAddr = "127.0.0.1"
+
+	var s = &Server{Config: config, served: make(chan error, 2)}
+	defer func() {
+		if err != nil {
+			s.cleanup()
+		}
+	}()
+
+	if s.dir, err = ioutil.TempDir("", "shhh-harness"); err != nil {
+		return nil, errors.Wrap(err, "failed to create temporary directory")
+	}
+
+	if s.Key, err = NewKey(); err != nil {
+		return nil, err
+	}
+	if config.AuthorizedKeys == "" && !anonymous {
+		config.AuthorizedKeys = filepath.Join(s.dir, "authorized_keys")
+		if err = ioutil.WriteFile(config.AuthorizedKeys, gossh.MarshalAuthorizedKey(s.Key.PublicKey()), 0600); err != nil {
+			return nil, errors.Wrap(err, "failed to write authorized keys")
+		}
+	}
+
+	if s.ssh, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		return nil, errors.Wrap(err, "failed to listen for ssh connections")
+	}
+	s.Addr, config.Addr = s.ssh.Addr().String(), s.ssh.Addr().String()
+
+	if config.HTTPAddr != "" {
+		if s.http, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			return nil, errors.Wrap(err, "failed to listen for http requests")
+		}
+		s.HTTPAddr, config.HTTPAddr = s.http.Addr().String(), s.http.Addr().String()
+	}
+
+	if s.Server, err = server.New(config, options...); err != nil {
+		return nil, err
+	}
+
+	s.serve(func() error { return s.Server.Serve(s.ssh) })
+	if s.http != nil {
+		s.serve(func() error { return s.Server.ServeHTTPEdge(s.http) })
+	}
+	return s, nil
+}
+
+// serve runs [fn] until the server is closed
+func (s *Server) serve(fn func() error) {
+	s.nServing++
+	go func() { s.served <- fn() }()
+}
+
+// Dial connects to the server with Server.Key, and starts a session with [options] (the session options of
+// clients, eg. "--json")
+func (s *Server) Dial(options ...string) (*Client, error) {
+	return s.DialKey(s.Key, options...)
+}
+
+// DialKey connects to the server with [key], and starts a session with [options] (as Dial)
+func (s *Server) DialKey(key gossh.Signer, options ...string) (*Client, error) {
+	return dial(s.Addr, key, options)
+}
+
+// DialAnonymous connects to the server without authenticating, and starts a session with [options] (as Dial)
+func (s *Server) DialAnonymous(options ...string) (*Client, error) {
+	return dial(s.Addr, nil, options)
+}
+
+// TunnelAddr returns the address visitors connect to for the TCP tunnel on [port]
+func (s *Server) TunnelAddr(port uint32) string {
+	return net.JoinHostPort(s.Config.BindAddr, fmt.Sprint(port))
+}
+
+// Get requests [path] of the HTTP tunnel named [name], through the HTTP edge
+func (s *Server) Get(name, path string) (*http.Response, error) {
+	if s.HTTPAddr == "" {
+		return nil, errors.New("http edge is not enabled")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+s.HTTPAddr+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = name + "." + s.Config.Domain
+	return http.DefaultClient.Do(req)
+}
+
+// Close shuts the server down (draining its tunnels for a little while), and removes its files
+func (s *Server) Close() error {
+	var ctx, cancel = context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	var err = s.Server.Shutdown(ctx)
+	if err != nil {
+		_ = s.Server.Close()
+	}
+
+	// listeners the server didn't start serving before it was shut down are left to us to close
+	if s.ssh != nil {
+		_ = s.ssh.Close()
+	}
+	if s.http != nil {
+		_ = s.http.Close()
+	}
+	for i := 0; i < s.nServing; i++ {
+		<-s.served
+	}
+	s.cleanup()
+	return err
+}
+
+// cleanup closes the listeners of the server and removes its files
+func (s *Server) cleanup() {
+	if s.ssh != nil {
+		_ = s.ssh.Close()
+	}
+	if s.http != nil {
+		_ = s.http.Close()
+	}
+	if s.dir != "" {
+		_ = os.RemoveAll(s.dir)
+	}
+}
+
+// NewKey returns a new ed25519 key, eg. for a client the server doesn't know about
+func NewKey() (gossh.Signer, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate key")
+	}
+	return gossh.NewSignerFromKey(private)
+}
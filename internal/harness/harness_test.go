@@ -0,0 +1,201 @@
+package harness_test
+
+import (
+	"bufio"
+	"github.com/riyaz-ali/shhh/internal/harness"
+	"github.com/riyaz-ali/shhh/server"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echo serves the connections of [ln], echoing what visitors send until they're done sending
+func echo(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			_, _ = io.Copy(conn, conn)
+		}()
+	}
+}
+
+func start(t *testing.T, config *server.Config) *harness.Server {
+	srv, err := harness.Start(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func dial(t *testing.T, srv *harness.Server) *harness.Client {
+	client, err := srv.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestTCPEcho(t *testing.T) {
+	var srv = start(t, nil)
+	defer srv.Close()
+
+	var client = dial(t, srv)
+	defer client.Close()
+
+	ln, err := client.Listen("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go echo(ln)
+
+	if _, err = client.Wait("forwarding TCP traffic", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("both ways", func(t *testing.T) {
+		visitor, err := net.Dial("tcp", srv.TunnelAddr(ln.Port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer visitor.Close()
+
+		var r = bufio.NewReader(visitor)
+		for _, msg := range []string{"ping\n", "pong\n"} {
+			if _, err = io.WriteString(visitor, msg); err != nil {
+				t.Fatal(err)
+			}
+			if line, err := r.ReadString('\n'); err != nil || line != msg {
+				t.Fatalf("got %q back, want %q (err: %v)", line, msg, err)
+			}
+		}
+	})
+
+	// a visitor which is done sending still gets its answer
+	t.Run("half-closed", func(t *testing.T) {
+		visitor, err := net.Dial("tcp", srv.TunnelAddr(ln.Port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer visitor.Close()
+
+		if _, err = io.WriteString(visitor, "request"); err != nil {
+			t.Fatal(err)
+		}
+		if err = visitor.(*net.TCPConn).CloseWrite(); err != nil {
+			t.Fatal(err)
+		}
+
+		_ = visitor.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if answer, err := ioutil.ReadAll(visitor); err != nil || string(answer) != "request" {
+			t.Fatalf("got %q back, want %q (err: %v)", answer, "request", err)
+		}
+	})
+}
+
+func TestHTTPEdgeRouting(t *testing.T) {
+	var config = server.DefaultConfig()
+	config.HTTPAddr, config.Domain = ":0", "example.test"
+	var srv = start(t, config)
+	defer srv.Close()
+
+	for _, name := range []string{"alpha", "beta"} {
+		var client = dial(t, srv)
+		defer client.Close()
+
+		ln, err := client.Listen(name, 80)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+
+		var name = name
+		go func() {
+			_ = http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, name+" "+r.URL.Path)
+			}))
+		}()
+	}
+
+	for _, name := range []string{"alpha", "beta"} {
+		resp, err := srv.Get(name, "/hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != name+" /hello" {
+			t.Fatalf("%s: got %d %q", name, resp.StatusCode, body)
+		}
+	}
+
+	resp, err := srv.Get("gamma", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Fatal("request for a name without a tunnel succeeded")
+	}
+}
+
+func TestDenials(t *testing.T) {
+	var srv = start(t, nil)
+	defer srv.Close()
+
+	t.Run("unknown key", func(t *testing.T) {
+		key, err := harness.NewKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if client, err := srv.DialKey(key); err == nil {
+			_ = client.Close()
+			t.Fatal("client with an unknown key was let in")
+		}
+	})
+
+	var client = dial(t, srv)
+	defer client.Close()
+
+	for _, test := range []struct {
+		name     string
+		bindAddr string
+		port     uint32
+		reason   string
+	}{
+		{"privileged port", "", 22, "privileged ports can't be forwarded"},
+		{"http disabled", "app", 80, "HTTP tunnels are not enabled"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := client.Listen(test.bindAddr, test.port); err == nil || !strings.Contains(err.Error(), test.reason) {
+				t.Fatalf("got %v, want a denial with %q", err, test.reason)
+			}
+		})
+	}
+
+	t.Run("name taken", func(t *testing.T) {
+		var config = server.DefaultConfig()
+		config.HTTPAddr, config.Domain = ":0", "example.test"
+		var srv = start(t, config)
+		defer srv.Close()
+
+		var first, second = dial(t, srv), dial(t, srv)
+		defer first.Close()
+		defer second.Close()
+
+		if _, err := first.Listen("app", 80); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := second.Listen("app", 80); err == nil || !strings.Contains(err.Error(), "already in use") {
+			t.Fatalf("got %v, want a denial as the name is in use", err)
+		}
+	})
+}
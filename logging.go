@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains the targets the server's log can be written to (with -log): stdout / stderr, syslog (RFC 5424,
+// over UDP, TCP or a Unix socket) and systemd-journald (over its native protocol), so that shhh fits into standard
+// log pipelines. Lines are sent to syslog / journald with a priority guessed from their text.
+// ----------
+
+const (
+	// identifies the server's lines in syslog / journald
+	logIdentifier = "shhh"
+
+	// socket the local syslog daemon listens on
+	localSyslogSocket = "/dev/log"
+
+	// socket journald accepts entries on (see systemd-journald.service(8))
+	journaldSocket = "/run/systemd/journal/socket"
+
+	// facility of lines sent to syslog (see RFC 5424 § 6.2.1)
+	syslogFacilityDaemon = 3
+)
+
+// syslog severities (see RFC 5424 § 6.2.1), also used as journald priorities
+const (
+	severityError   = 3
+	severityWarning = 4
+	severityNotice  = 5
+	severityInfo    = 6
+)
+
+// logTarget receives the server's log lines, one at a time (without the trailing newline)
+type logTarget interface {
+	writeLine(t time.Time, line string) error
+}
+
+// setupLogging has the standard logger write to the [targets] (stderr if there are none): stdout, stderr, journald,
+// syslog (the local daemon), or a syslog daemon at udp://host:port, tcp://host:port or unix:///path
+func setupLogging(targets []string) error {
+	if len(targets) == 0 {
+		return nil // the standard logger writes to stderr already
+	}
+
+	var writer = &logWriter{}
+	for _, target := range targets {
+		t, err := newLogTarget(target)
+		if err != nil {
+			return errors.Wrapf(err, "invalid log target %q", target)
+		}
+		writer.targets = append(writer.targets, t)
+	}
+
+	log.SetFlags(0) // targets add a timestamp of their own
+	log.SetOutput(writer)
+	return nil
+}
+
+// newLogTarget returns the logTarget for [target]; see setupLogging
+func newLogTarget(target string) (logTarget, error) {
+	switch target {
+	case "stdout":
+		return &streamTarget{w: os.Stdout}, nil
+	case "stderr":
+		return &streamTarget{w: os.Stderr}, nil
+	case "journald":
+		return newJournaldTarget(journaldSocket)
+	case "syslog":
+		return newSyslogTarget("unixgram", localSyslogSocket)
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp":
+		return newSyslogTarget(u.Scheme, u.Host)
+	case "unix":
+		return newSyslogTarget("unixgram", u.Path)
+	}
+	return nil, errors.New("must be stdout, stderr, journald, syslog, or a udp://, tcp:// or unix:// syslog address")
+}
+
+// logWriter is the standard logger's output, passing each line it writes on to the targets
+type logWriter struct {
+	mu      sync.Mutex
+	targets []logTarget
+}
+
+func (w *logWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// each entry of the standard logger comes in a single write, and may span more than one line
+	var now, line = time.Now(), strings.TrimRight(string(b), "\n")
+	for _, target := range w.targets {
+		if err := target.writeLine(now, line); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s failed to write log line: %s\n", now.Format("2006/01/02 15:04:05"), err)
+		}
+	}
+	return len(b), nil
+}
+
+// logSeverity guesses the severity of [line] from its text
+func logSeverity(line string) int {
+	var lower = strings.ToLower(line)
+	switch {
+	case strings.Contains(lower, "fail") || strings.Contains(lower, "error") || strings.Contains(lower, "panic"):
+		return severityError
+	case strings.Contains(lower, "quarantined") || strings.Contains(lower, "terminated") || strings.Contains(lower, "denied") ||
+		strings.Contains(lower, "rejected") || strings.Contains(lower, "dropped"):
+		return severityWarning
+	case strings.Contains(lower, "shutting down") || strings.Contains(lower, "restart"):
+		return severityNotice
+	}
+	return severityInfo
+}
+
+// streamTarget writes lines to stdout / stderr, in the standard logger's format
+type streamTarget struct{ w io.Writer }
+
+func (s *streamTarget) writeLine(t time.Time, line string) error {
+	_, err := fmt.Fprintf(s.w, "%s %s\n", t.Format("2006/01/02 15:04:05"), line)
+	return err
+}
+
+// syslogTarget sends lines to a syslog daemon, formatted as per RFC 5424
+type syslogTarget struct {
+	network, addr string
+	hostname      string
+
+	conn net.Conn // nil until (re-)connected
+}
+
+// newSyslogTarget returns a new syslogTarget sending lines to the daemon at [addr] over [network]
+func newSyslogTarget(network, addr string) (*syslogTarget, error) {
+	var hostname, _ = os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+
+	var target = &syslogTarget{network: network, addr: addr, hostname: hostname}
+	if err := target.connect(); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+func (s *syslogTarget) connect() (err error) {
+	s.conn, err = net.DialTimeout(s.network, s.addr, 5*time.Second)
+	return errors.Wrap(err, "failed to connect to syslog")
+}
+
+func (s *syslogTarget) writeLine(t time.Time, line string) error {
+	var msg = fmt.Sprintf("<%d>1 %s %s %s %d - - %s", syslogFacilityDaemon*8+logSeverity(line),
+		t.UTC().Format(time.RFC3339Nano), s.hostname, logIdentifier, os.Getpid(), line)
+
+	// messages over TCP are framed with their length (see RFC 6587 § 3.4.1); datagrams need no framing
+	if s.network == "tcp" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+
+	// reconnect once, in case the daemon restarted
+	for attempt := 0; ; attempt++ {
+		if s.conn == nil {
+			if err := s.connect(); err != nil {
+				return err
+			}
+		}
+
+		_, err := io.WriteString(s.conn, msg)
+		if err == nil || attempt > 0 {
+			return err
+		}
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// journaldTarget sends lines to systemd-journald, over its native protocol (see
+// https://systemd.io/JOURNAL_NATIVE_PROTOCOL/)
+type journaldTarget struct {
+	conn net.Conn
+}
+
+// newJournaldTarget returns a new journaldTarget sending lines to journald's [socket]
+func newJournaldTarget(socket string) (*journaldTarget, error) {
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to journald")
+	}
+	return &journaldTarget{conn: conn}, nil
+}
+
+func (j *journaldTarget) writeLine(_ time.Time, line string) error {
+	var entry bytes.Buffer
+	journaldField(&entry, "MESSAGE", line)
+	journaldField(&entry, "PRIORITY", fmt.Sprint(logSeverity(line)))
+	journaldField(&entry, "SYSLOG_IDENTIFIER", logIdentifier)
+	journaldField(&entry, "SYSLOG_PID", fmt.Sprint(os.Getpid()))
+
+	_, err := j.conn.Write(entry.Bytes())
+	return err
+}
+
+// journaldField appends the field [name] with [value] to the journal [entry]; values with newlines are written
+// with their length (in binary) instead
+func journaldField(entry *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(entry, "%s=%s\n", name, value)
+		return
+	}
+
+	entry.WriteString(name + "\n")
+	_ = binary.Write(entry, binary.LittleEndian, uint64(len(value)))
+	entry.WriteString(value + "\n")
+}
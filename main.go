@@ -1,8 +1,496 @@
 package main
 
-import "log"
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	"github.com/riyaz-ali/shhh/server"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// ----------
+// shhh command line interface; a thin wrapper that configures and runs server.Server
+// ----------
 
 func main() {
-	server, _ := NewSSHServer(":2222")
-	log.Fatal(server.ListenAndServe())
+	if len(os.Args) > 1 && os.Args[1] == "self-update" {
+		if err := selfUpdate(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "connect" {
+		if err := connectCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "udp" {
+		if err := udpCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var config = server.DefaultConfig()
+	var opts cliOptions
+	parseFlags(os.Args[1:], config, &opts)
+
+	// start over from the config file / profile (if any), so that flags override it field by field
+	if opts.configFile != "" || opts.profile != "" {
+		var err error
+		switch {
+		case opts.configFile != "" && opts.profile != "":
+			log.Fatal("-profile can't be used with -config; set \"profile\" in the config file instead")
+		case opts.configFile != "":
+			config, err = server.LoadConfig(opts.configFile)
+		default:
+			config, err = server.Profile(opts.profile)
+		}
+
+		if err != nil {
+			log.Fatal(err)
+		}
+		parseFlags(os.Args[1:], config, &opts)
+	}
+
+	if err := setupLogging(opts.logTargets); err != nil {
+		log.Fatal(err)
+	}
+
+	srv, err := server.New(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// users and their permission profiles apply as the config file changes
+	if opts.configFile != "" {
+		srv.WatchConfig(opts.configFile)
+	}
+
+	// use sockets passed by systemd (if socket activated) or by the previous instance (if restarted)
+	var parent = handoffParent()
+	activated, err := systemdListeners(parent != 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var listeners = make(map[string]net.Listener)
+	if listeners[systemdSSHSocketName], err = listen(config.Addr, activated[systemdSSHSocketName]); err != nil {
+		log.Fatal(err)
+	}
+
+	// additional ssh listeners, each with a policy of its own
+	for _, lc := range config.Listeners {
+		var name, socket = lc.Name, systemdListenerSocketPrefix + lc.Name
+		if listeners[socket], err = listen(lc.Addr, activated[socket]); err != nil {
+			log.Fatal(err)
+		}
+
+		var ln = listeners[socket]
+		go func() {
+			if err := srv.ServeListener(name, ln); err != ssh.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	if config.HTTPAddr != "" {
+		if listeners[systemdHTTPSocketName], err = listen(config.HTTPAddr, activated[systemdHTTPSocketName]); err != nil {
+			log.Fatal(err)
+		}
+
+		go func() {
+			if err := srv.ServeHTTPEdge(listeners[systemdHTTPSocketName]); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	if config.TLSAddr != "" {
+		if listeners[systemdTLSSocketName], err = listen(config.TLSAddr, activated[systemdTLSSocketName]); err != nil {
+			log.Fatal(err)
+		}
+
+		go func() {
+			if err := srv.ServeTLSEdge(listeners[systemdTLSSocketName]); err != server.ErrTLSEdgeClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	if config.SSHTLSAddr != "" {
+		if listeners[systemdSSHTLSSocketName], err = listen(config.SSHTLSAddr, activated[systemdSSHTLSSocketName]); err != nil {
+			log.Fatal(err)
+		}
+
+		go func() {
+			if err := srv.ServeSSHOverTLS(listeners[systemdSSHTLSSocketName]); err != server.ErrSSHOverTLSClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	if config.ClusterRelayAddr != "" {
+		if listeners[systemdRelaySocketName], err = listen(config.ClusterRelayAddr, activated[systemdRelaySocketName]); err != nil {
+			log.Fatal(err)
+		}
+
+		go func() {
+			if err := srv.ServeClusterRelay(listeners[systemdRelaySocketName]); err != server.ErrClusterRelayClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	if config.MetricsAddr != "" {
+		if listeners[systemdMetricsSocketName], err = listen(config.MetricsAddr, activated[systemdMetricsSocketName]); err != nil {
+			log.Fatal(err)
+		}
+
+		var mux = http.NewServeMux()
+		mux.Handle("/metrics", srv.MetricsHandler())
+		go func() { log.Fatal(http.Serve(listeners[systemdMetricsSocketName], mux)) }()
+	}
+
+	if config.DebugAddr != "" {
+		if listeners[systemdDebugSocketName], err = listen(config.DebugAddr, activated[systemdDebugSocketName]); err != nil {
+			log.Fatal(err)
+		}
+		go func() { log.Fatal(http.Serve(listeners[systemdDebugSocketName], srv.DebugHandler())) }()
+	}
+
+	if config.AdminAddr != "" {
+		if listeners[systemdAdminSocketName], err = listen(config.AdminAddr, activated[systemdAdminSocketName]); err != nil {
+			log.Fatal(err)
+		}
+		go func() { log.Fatal(http.Serve(listeners[systemdAdminSocketName], srv.AdminHandler())) }()
+	}
+
+	// we don't need root anymore now that the (privileged) listeners are bound
+	if err = dropPrivileges(opts.username, opts.group); err != nil {
+		log.Fatal(err)
+	}
+
+	// gracefully shutdown on SIGTERM / SIGINT, and restart (handing listeners over to a new instance) on SIGUSR2 (where
+	// supported; see restartSignal)
+	var stopped = make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		var signals = make(chan os.Signal, 1)
+		var notify = []os.Signal{syscall.SIGTERM, syscall.SIGINT}
+		if restartSignal != nil {
+			notify = append(notify, restartSignal)
+		}
+		signal.Notify(signals, notify...)
+
+		var err error
+		var child *os.Process // new instance we're handing over to, if restarting
+		var state *os.File    // through which the endpoints of tunnels are handed over to the new instance
+		var exited = make(chan struct{}, 1)
+
+	wait:
+		for {
+			select {
+			case sig := <-signals:
+				if sig != restartSignal {
+					break wait
+				}
+
+				if child != nil {
+					log.Printf("restart already in progress")
+					continue
+				}
+
+				log.Printf("restarting; handing listeners over to a new instance")
+				if child, state, err = restart(listeners); err != nil {
+					log.Printf("failed to restart: %s", err.Error())
+					continue
+				}
+
+				go func(p *os.Process) {
+					_, _ = p.Wait()
+					exited <- struct{}{}
+				}(child)
+
+			case <-exited:
+				log.Printf("failed to restart: new instance exited before taking over")
+				_ = state.Close()
+				child, state = nil, nil
+			}
+		}
+
+		if child == nil { // the service manager shouldn't consider us stopping if we've handed over
+			_ = sdNotify("STOPPING=1")
+		} else if err = handOver(state, srv.Endpoints(), srv.HandOverUsage()); err != nil {
+			log.Printf("failed to restart: %s", err.Error())
+		}
+
+		log.Printf("shutting down; waiting up to %s for connections to drain", config.DrainTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), config.DrainTimeout)
+		defer cancel()
+
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("failed to drain connections: %s", err.Error())
+		}
+	}()
+
+	if parent != 0 {
+		if err = takeOver(parent); err != nil {
+			log.Printf("failed to take over from previous instance: %s", err.Error())
+		}
+
+		// clients of the previous instance's tunnels regain their endpoints as they reconnect, and keys' transfer caps hold
+		endpoints, usage, err := handedOver()
+		if err != nil {
+			log.Printf("failed to take over from previous instance: %s", err.Error())
+		}
+		srv.Hold(endpoints)
+		srv.TakeOverUsage(usage)
+	}
+
+	if err = sdNotify("READY=1"); err != nil {
+		log.Printf("failed to notify systemd: %s", err.Error())
+	}
+
+	if err = srv.Serve(listeners[systemdSSHSocketName]); err != ssh.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
+}
+
+// cliOptions are the command line options which aren't part of server.Config
+type cliOptions struct {
+	configFile, profile string
+	username, group     string
+	logTargets          []string
+}
+
+// parseFlags parses the command line [args] into [config] and [opts]. Flags override values already in [config].
+func parseFlags(args []string, config *server.Config, opts *cliOptions) {
+	var flags = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	var webhooks = len(config.Webhooks) // webhooks from the config file keep their own secret
+	var webhookSecret string
+
+	flags.StringVar(&opts.configFile, "config", "", "path to JSON config file (flags override values in the file)")
+	flags.StringVar(&opts.profile, "profile", "", fmt.Sprintf("built-in profile to use defaults of (one of %s)", strings.Join(server.Profiles(), ", ")))
+	flags.StringVar(&config.Addr, "addr", config.Addr, "address to listen for incoming ssh connections on")
+	flags.StringVar(&config.BindAddr, "bind-addr", config.BindAddr, "address (or network interface, eg. eth0) to bind public listeners for forwarded ports on")
+	flags.StringVar(&config.GatewayPorts, "gateway-ports", config.GatewayPorts, "whether the bind address clients ask for is honoured: yes (use -bind-addr), no (loopback only) or clientspecified (default yes)")
+	flags.BoolVar(&config.SSHProxyProtocol, "ssh-proxy-protocol", config.SSHProxyProtocol, "expect PROXY protocol header on incoming ssh connections")
+	flags.BoolVar(&config.TunnelProxyProtocol, "tunnel-proxy-protocol", config.TunnelProxyProtocol, "expect PROXY protocol header on incoming connections to forwarded ports")
+	flags.StringVar(&config.UnixSocketDir, "unix-socket-dir", config.UnixSocketDir, "directory to additionally expose tunnels as <port>.sock unix sockets in")
+	flags.DurationVar(&config.DrainTimeout, "drain-timeout", config.DrainTimeout, "maximum time to wait for in-flight connections when shutting down")
+	flags.DurationVar(&config.IdleTimeout, "idle-timeout", config.IdleTimeout, "terminate connections without any activity for this duration (0 to disable)")
+	flags.DurationVar(&config.TunnelIdleTimeout, "tunnel-idle-timeout", config.TunnelIdleTimeout, "close tunnels without any connections (or traffic) for this duration, whatever their clients' keepalives (0 to disable)")
+	flags.StringVar(&config.ServerVersion, "server-version", config.ServerVersion, "software version advertised to ssh clients after SSH-2.0- (eg. OpenSSH_9.6), or random to pick a common one for each connection")
+	flags.StringVar(&config.Algorithms, "algorithms", config.Algorithms, fmt.Sprintf("preset of ciphers, MACs and key exchanges ssh clients may negotiate (one of %s)", strings.Join(server.AlgorithmPresets(), ", ")))
+	flags.Var((*stringList)(&config.Ciphers), "cipher", "cipher ssh clients may negotiate, in place of the preset's (can be repeated)")
+	flags.Var((*stringList)(&config.MACs), "mac", "MAC ssh clients may negotiate, in place of the preset's (can be repeated)")
+	flags.Var((*stringList)(&config.KeyExchanges), "kex", "key exchange ssh clients may negotiate, in place of the preset's (can be repeated)")
+	flags.Var((*stringList)(&config.AllowedSources), "allow-source", "only allow visitors from this CIDR to connect to tunnels (can be repeated)")
+	flags.Var((*stringList)(&config.DeniedSources), "deny-source", "deny visitors from this CIDR from connecting to tunnels (can be repeated)")
+	flags.StringVar(&config.GeoIPDatabase, "geoip-db", config.GeoIPDatabase, "MaxMind DB (eg. GeoLite2-Country.mmdb) to look up the country of visitors in")
+	flags.Var((*stringList)(&config.AllowedCountries), "allow-country", "only allow visitors from this country (ISO code) to connect to tunnels (can be repeated)")
+	flags.Var((*stringList)(&config.DeniedCountries), "deny-country", "deny visitors from this country (ISO code) from connecting to tunnels (can be repeated)")
+	flags.Var((*feedList)(&config.ReputationFeeds), "reputation-feed", "blocklist (as name=url, or name=path) of visitors denied from connecting to tunnels (can be repeated)")
+	flags.DurationVar(&config.ReputationRefresh, "reputation-refresh", config.ReputationRefresh, "how often -reputation-feed blocklists are refreshed")
+	flags.StringVar(&config.IPVersion, "ip-version", config.IPVersion, "IP versions public listeners on wildcard addresses are bound on: dual, 4 or 6 (default dual)")
+	flags.DurationVar(&config.TCPKeepAlive, "tcp-keepalive", config.TCPKeepAlive, "interval of TCP keep-alive probes on visitors' connections (0 for the system default, negative to disable)")
+	flags.BoolVar(&config.TCPNoDelay, "tcp-nodelay", config.TCPNoDelay, "disable Nagle's algorithm on visitors' connections (-tcp-nodelay=false to keep it)")
+	flags.BoolVar(&config.TCPFastOpen, "tcp-fast-open", config.TCPFastOpen, "accept TCP Fast Open connections on public listeners of tunnels (where supported)")
+	flags.BoolVar(&config.AccessLog, "access-log", config.AccessLog, "log every forwarded connection once it ends, along with why it ended")
+	flags.DurationVar(&config.StatsInterval, "stats-interval", config.StatsInterval, "send clients statistics of their tunnels, and update metrics, at this interval (0 to only do so when tunnels close)")
+	flags.StringVar(&config.MetricsAddr, "metrics-addr", config.MetricsAddr, "address to serve Prometheus metrics on, at /metrics (empty to disable)")
+	flags.StringVar(&config.DebugAddr, "debug-addr", config.DebugAddr, "address to serve pprof profiles and expvar counters on, at /debug/pprof/ and /debug/vars (empty to disable; keep it private)")
+	flags.StringVar(&config.AdminAddr, "admin-addr", config.AdminAddr, "address to serve the admin API on (empty to disable)")
+	flags.StringVar(&config.AdminToken, "admin-token", config.AdminToken, "bearer token required by the admin API")
+	flags.BoolVar(&config.APITokens, "api-tokens", config.APITokens, "let clients authenticate with short-lived tokens issued through the admin API, given as their ssh username")
+	flags.DurationVar(&config.MaxAPITokenTTL, "max-api-token-ttl", config.MaxAPITokenTTL, "longest an API token may be valid for")
+	flags.DurationVar(&config.FlowControlInterval, "flow-control-interval", config.FlowControlInterval, "measure RTT and the throughput of each connection through tunnels at this interval, warning clients limited by the channel window (0 to disable)")
+	flags.DurationVar(&config.ChannelOpenTimeout, "channel-open-timeout", config.ChannelOpenTimeout, "fail new connections if the client doesn't respond to their channel within this duration (0 to wait indefinitely)")
+	flags.DurationVar(&config.ConnectionSetupTimeout, "connection-setup-timeout", config.ConnectionSetupTimeout, "close connections to TCP tunnels that can't be set up within this duration (0 to wait indefinitely)")
+	flags.DurationVar(&config.StallTimeoutIn, "stall-timeout-in", config.StallTimeoutIn, "close connections to TCP / TLS tunnels when no bytes come from the visitor for this duration (0 to never)")
+	flags.DurationVar(&config.StallTimeoutOut, "stall-timeout-out", config.StallTimeoutOut, "close connections to TCP / TLS tunnels when no bytes come from the client for this duration (0 to never)")
+	flags.IntVar(&config.MaxPendingOpens, "max-pending-opens", config.MaxPendingOpens, "maximum number of channels a tunnel opens with its client at once (0 for unlimited)")
+	flags.DurationVar(&config.PendingOpenWait, "pending-open-wait", config.PendingOpenWait, "how long connections wait once -max-pending-opens channels are being opened, before they're rejected")
+	flags.DurationVar(&config.ForwardTimeout, "forward-timeout", config.ForwardTimeout, "terminate connections that don't request port forwarding within this duration (0 to disable)")
+	flags.IntVar(&config.SSHRateLimit, "ssh-rate-limit", config.SSHRateLimit, "maximum ssh handshakes per minute from a single IP (0 for unlimited)")
+	flags.IntVar(&config.MaxAuthFailures, "max-auth-failures", config.MaxAuthFailures, "ban IPs after this many connections fail to authenticate (0 to never ban)")
+	flags.DurationVar(&config.BanDuration, "ban-duration", config.BanDuration, "how long IPs are banned for")
+	flags.Var((*stringList)(&config.SSHGuardExempt), "ssh-guard-exempt", "CIDR of clients which are never rate limited or banned (can be repeated)")
+	flags.StringVar(&config.MaxStartups, "max-startups", config.MaxStartups, "limit on ssh connections which haven't authenticated yet, as start:rate:full (see sshd_config(5); empty for no limit)")
+	flags.BoolVar(&config.Tarpit, "tarpit", config.Tarpit, "slow down ssh clients from IPs with repeated authentication failures, and log what they try")
+	flags.IntVar(&config.TarpitThreshold, "tarpit-threshold", config.TarpitThreshold, "authentication failures after which an IP is tarpitted")
+	flags.DurationVar(&config.TarpitDelay, "tarpit-delay", config.TarpitDelay, "how long tarpitted clients wait for the server's version, and for the answer to each attempt to authenticate")
+	flags.StringVar(&config.TarpitLog, "tarpit-log", config.TarpitLog, "path to the file to log what tarpitted clients try to (default the server's log)")
+	flags.StringVar(&config.TunnelBanner, "tunnel-banner", config.TunnelBanner, "text sent to visitors of TCP tunnels which enable it with --banner (empty to disable)")
+	flags.BoolVar(&config.AuthLog, "auth-log", config.AuthLog, "log authentication failures and policy denials in a stable format (eg. for fail2ban)")
+	flags.StringVar(&config.AuthLogFile, "auth-log-file", config.AuthLogFile, "append the auth log to this file instead of the server's log (implies -auth-log)")
+	flags.StringVar(&config.AuditLog, "audit-log", config.AuditLog, "append the audit log (security-relevant events, as JSON lines) to this file")
+	flags.IntVar(&config.AuditLogMaxSize, "audit-log-max-size", config.AuditLogMaxSize, "rotate the audit log once it grows past this size, in MB (0 to never rotate it)")
+	flags.IntVar(&config.AuditLogBackups, "audit-log-backups", config.AuditLogBackups, "number of rotated audit logs to keep (5 if unset)")
+	flags.StringVar(&config.MirrorDir, "mirror-dir", config.MirrorDir, "directory the admin API may have the traffic of tunnels mirrored to, as pcap files")
+	flags.Var((*stringList)(&config.MirrorEndpoints), "mirror-endpoint", "TCP endpoint (tcp://host:port) the admin API may have the traffic of tunnels mirrored to, as a pcap stream (can be repeated)")
+	flags.StringVar(&config.ClusterRedis, "cluster-redis", config.ClusterRedis, "URL of a Redis server (redis://host:port) to share tunnel endpoints, reservations and quota usage with other nodes through")
+	flags.StringVar(&config.ClusterNode, "cluster-node", config.ClusterNode, "ID of this node in the cluster (defaults to the hostname)")
+	flags.StringVar(&config.ClusterAddr, "cluster-addr", config.ClusterAddr, "address other nodes and load balancers reach this node at")
+	flags.StringVar(&config.ClusterRelayAddr, "cluster-relay-addr", config.ClusterRelayAddr, "address to accept connections relayed by other nodes on, so that any node can accept traffic for any tunnel (empty to disable)")
+	flags.StringVar(&config.ClusterRelayCert, "cluster-relay-cert", config.ClusterRelayCert, "certificate nodes authenticate each other with on relayed connections")
+	flags.StringVar(&config.ClusterRelayKey, "cluster-relay-key", config.ClusterRelayKey, "key of the cluster relay certificate")
+	flags.StringVar(&config.ClusterRelayCA, "cluster-relay-ca", config.ClusterRelayCA, "CA the certificates of other nodes are verified against")
+	flags.StringVar(&config.ServiceRegistry, "service-registry", config.ServiceRegistry, "register active tunnels as services in Consul (consul://[token@]host:8500) or etcd (etcd://host:2379)")
+	flags.StringVar(&config.ServiceRegistryPrefix, "service-registry-prefix", config.ServiceRegistryPrefix, "prefix of the keys tunnels are registered under in etcd (default /shhh/services/)")
+	flags.Var((*stringList)(&config.ServiceTags), "service-tag", "tag added to every tunnel registered in the service registry (can be repeated)")
+	flags.Var((*stringList)(&config.KubernetesNamespaces), "kubernetes-namespace", "Kubernetes namespace clients may expose their tunnels in as Services, with --kubernetes (can be repeated)")
+	flags.StringVar(&config.KubernetesAPI, "kubernetes-api", config.KubernetesAPI, "URL of the Kubernetes API (defaults to the cluster the server runs in)")
+	flags.StringVar(&config.KubernetesAddress, "kubernetes-address", config.KubernetesAddress, "IP pods reach the server at (defaults to $POD_IP)")
+	flags.StringVar(&config.KubernetesTokenFile, "kubernetes-token-file", config.KubernetesTokenFile, "file with the bearer token for the Kubernetes API (defaults to the pod's service account)")
+	flags.StringVar(&config.KubernetesCA, "kubernetes-ca", config.KubernetesCA, "CA the Kubernetes API's certificate is verified against (defaults to the pod's service account)")
+	flags.StringVar(&config.RecordingsDir, "recordings-dir", config.RecordingsDir, "record each session's messages (including its tunnels opening and closing) to a file of its own in this directory")
+	flags.StringVar(&config.RecordingFormat, "recording-format", config.RecordingFormat, "format of session recordings: log (default) or asciicast")
+	flags.DurationVar(&config.RecordingRetention, "recording-retention", config.RecordingRetention, "how long session recordings are kept (0 to keep them)")
+	flags.IntVar(&config.RecordingsMaxSize, "recordings-max-size", config.RecordingsMaxSize, "remove the oldest session recordings once they take more than this, in MB (0 for no limit)")
+	flags.StringVar(&config.AuditSyslog, "audit-syslog", config.AuditSyslog, "ship the audit log to syslog: local, or a udp://, tcp:// or unix:// URL")
+	flags.StringVar(&config.OTLPEndpoint, "otlp-endpoint", config.OTLPEndpoint, "trace tunnels to the OTLP/HTTP collector at this base URL (eg. http://localhost:4318)")
+	flags.Float64Var(&config.TraceSampleRatio, "trace-sample-ratio", config.TraceSampleRatio, "fraction of tunnels traced, between 0 and 1 (1 if unset)")
+	flags.StringVar(&config.UsageExport, "usage-export", config.UsageExport, "export the usage of each key to this file (as JSON lines), http(s):// endpoint or kafka://broker:port/topic")
+	flags.DurationVar(&config.UsageInterval, "usage-interval", config.UsageInterval, "how often usage is exported (an hour if unset)")
+	flags.StringVar(&config.ServerName, "server-name", config.ServerName, "name of the deployment, available to the MOTD template")
+	flags.StringVar(&config.BannerFile, "banner", config.BannerFile, "path to a text file sent to clients before they authenticate")
+	flags.StringVar(&config.MOTDFile, "motd", config.MOTDFile, "path to a template of the message of the day, shown to clients when their session opens")
+	flags.DurationVar(&config.ReconnectGrace, "reconnect-grace", config.ReconnectGrace, "hold the name / port of a tunnel for its key this long after the client goes away (0 to disable)")
+	flags.DurationVar(&config.MaxTunnelTTL, "max-tunnel-ttl", config.MaxTunnelTTL, "close tunnels once they've been open this long, whatever their clients ask for with --ttl (0 for unlimited)")
+	flags.StringVar(&config.StablePorts, "stable-ports", config.StablePorts, "range of ports (eg. 20000-29999) to assign clients requesting port 0 a port derived from their key (empty for random ports)")
+	flags.StringVar(&config.HTTPAddr, "http-addr", config.HTTPAddr, "address to listen for incoming HTTP requests on (empty to disable HTTP tunnels)")
+	flags.StringVar(&config.TunnelWords, "tunnel-words", config.TunnelWords, "JSON file with adjectives and nouns used to generate names of HTTP tunnels (empty for built-in words)")
+	flags.StringVar(&config.Domain, "domain", config.Domain, "domain under which HTTP tunnels are exposed as sub-domains")
+	flags.BoolVar(&config.HTTPProxyProtocol, "http-proxy-protocol", config.HTTPProxyProtocol, "expect PROXY protocol header on incoming HTTP connections")
+	flags.StringVar(&config.TLSAddr, "tls-addr", config.TLSAddr, "address to listen for incoming TLS connections, routed to tunnels by SNI, on (empty to disable TLS tunnels)")
+	flags.BoolVar(&config.TLSProxyProtocol, "tls-proxy-protocol", config.TLSProxyProtocol, "expect PROXY protocol header on incoming TLS connections")
+	flags.StringVar(&config.SSHTLSAddr, "ssh-tls-addr", config.SSHTLSAddr, "address to accept ssh connections wrapped in TLS or WebSocket on, eg. :443 (empty to disable)")
+	flags.StringVar(&config.SSHTLSCert, "ssh-tls-cert", config.SSHTLSCert, "certificate for wrapped ssh connections (without it, they aren't expected to be TLS)")
+	flags.StringVar(&config.SSHTLSKey, "ssh-tls-key", config.SSHTLSKey, "private key of the certificate for wrapped ssh connections")
+	flags.StringVar(&config.SSHTLSHost, "ssh-tls-host", config.SSHTLSHost, "server name for which the TLS edge passes connections on as wrapped ssh connections, sharing its port")
+	flags.StringVar(&config.ErrorPages, "error-pages", config.ErrorPages, "directory with templates replacing the HTTP edge's error pages (not-found.html, offline.html, unavailable.html, on-hold.html)")
+	flags.StringVar(&config.ErrorFormat, "error-format", config.ErrorFormat, "format of the HTTP edge's error pages: html, json or auto (JSON for clients which accept it but not HTML)")
+	flags.StringVar(&config.OIDCIssuer, "oidc-issuer", config.OIDCIssuer, "issuer URL of the OpenID Connect provider visitors of HTTP tunnels log in with (see the --login session option)")
+	flags.StringVar(&config.OIDCClientID, "oidc-client-id", config.OIDCClientID, "client ID registered with the OpenID Connect provider")
+	flags.StringVar(&config.OIDCClientSecret, "oidc-client-secret", config.OIDCClientSecret, "client secret registered with the OpenID Connect provider")
+	flags.BoolVar(&config.HTTP2, "http2", config.HTTP2, "also accept cleartext HTTP/2 (h2c) on the HTTP listener")
+	flags.IntVar(&config.MaxChannelPool, "max-channel-pool", config.MaxChannelPool, "maximum number of channels an HTTP tunnel can keep open ahead of time")
+	flags.IntVar(&config.InspectRequests, "inspect-requests", config.InspectRequests, "number of recent requests each HTTP tunnel keeps for inspection and replay via the admin API (0 to disable)")
+	flags.IntVar(&config.InspectBodyLimit, "inspect-body-limit", config.InspectBodyLimit, "maximum bytes of each request / response body kept by the inspector")
+	flags.Var((*stringList)(&config.TrustedProxies), "trusted-proxy", "CIDR of a proxy / CDN whose forwarded headers carry the visitor's address (can be repeated)")
+	flags.Var((*stringList)(&config.DeniedHosts), "deny-host", "hostname pattern which can't be registered by HTTP tunnels (can be repeated)")
+	flags.StringVar(&config.HoneypotAddr, "honeypot", config.HoneypotAddr, "URL of a local service to receive requests for denied or unknown hostnames")
+	opts.logTargets = nil // flags are parsed again after loading the config file
+	flags.Var((*stringList)(&opts.logTargets), "log", "where to write the log: stdout, stderr (default), journald, syslog (the local daemon), or a udp://, tcp:// or unix:// syslog address (can be repeated)")
+	flags.StringVar(&opts.username, "user", "", "user to switch to once listeners are bound (eg. to bind privileged ports as root)")
+	flags.StringVar(&opts.group, "group", "", "group to switch to once listeners are bound (defaults to user's primary group)")
+	flags.StringVar(&config.AuthorizedKeys, "authorized-keys", config.AuthorizedKeys, "path to authorized_keys file listing keys allowed to connect (empty to allow anyone)")
+	flags.BoolVar(&config.TerminateRemovedKeys, "terminate-removed-keys", config.TerminateRemovedKeys, "close connections of keys removed from the authorized_keys file (which is reloaded when it changes)")
+	flags.StringVar(&config.PasswordFile, "password-file", config.PasswordFile, "path to a file of users allowed to authenticate with a password, as user:bcrypt-hash[:totp-secret] lines")
+	flags.Var((*stringList)(&config.ForgeUsers), "forge-user", "GitHub / GitLab user (eg. github:octocat, gitlab:someone) allowed to connect using their published keys (can be repeated)")
+	flags.DurationVar(&config.ForgeRefresh, "forge-refresh", config.ForgeRefresh, "how often published keys of -forge-user users are refreshed")
+	flags.StringVar(&config.CertificateAuthorities, "cert-authorities", config.CertificateAuthorities, "path to file listing keys of CAs whose user certificates are allowed to connect")
+	flags.StringVar(&config.VaultAddr, "vault-addr", config.VaultAddr, "address of a HashiCorp Vault whose SSH CA signs user certificates allowed to connect")
+	flags.StringVar(&config.VaultSSHMount, "vault-ssh-mount", config.VaultSSHMount, "path at which Vault's SSH CA is mounted")
+	flags.Var((*stringList)(&config.VaultExtensions), "vault-extension", "extension Vault-signed certificates must have, besides permit-port-forwarding (can be repeated)")
+	flags.DurationVar(&config.VaultRefresh, "vault-refresh", config.VaultRefresh, "how often the key of Vault's SSH CA is refreshed")
+	flags.StringVar(&config.LDAPURL, "ldap-url", config.LDAPURL, "url of an LDAP directory (ldap:// or ldaps://) whose users are allowed to connect with their sshPublicKey")
+	flags.StringVar(&config.LDAPBindDN, "ldap-bind-dn", config.LDAPBindDN, "DN of the account searching the LDAP directory for users (empty for anonymous searches)")
+	flags.StringVar(&config.LDAPBindPassword, "ldap-bind-password", config.LDAPBindPassword, "password of -ldap-bind-dn")
+	flags.StringVar(&config.LDAPBaseDN, "ldap-base-dn", config.LDAPBaseDN, "where in the LDAP directory users are searched for")
+	flags.StringVar(&config.LDAPUserFilter, "ldap-user-filter", config.LDAPUserFilter, "LDAP filter matching a user; %s is replaced with the username")
+	flags.StringVar(&config.LDAPKeyAttribute, "ldap-key-attribute", config.LDAPKeyAttribute, "LDAP attribute listing a user's public keys")
+	flags.StringVar(&config.LDAPGroupAttribute, "ldap-group-attribute", config.LDAPGroupAttribute, "LDAP attribute listing the DNs of a user's groups")
+	flags.BoolVar(&config.LDAPPasswords, "ldap-passwords", config.LDAPPasswords, "let LDAP users authenticate with their directory password too")
+	flags.DurationVar(&config.LDAPCacheTTL, "ldap-cache-ttl", config.LDAPCacheTTL, "how long what the LDAP directory has on a user is cached for")
+	flags.BoolVar(&config.RequireAuthentication, "require-authentication", config.RequireAuthentication, "refuse to start unless clients are authenticated")
+	flags.StringVar(&config.ReservationsFile, "reservations", config.ReservationsFile, "path to JSON file tracking names and ports reserved for keys")
+	flags.StringVar(&config.DomainsFile, "domains-file", config.DomainsFile, "path to JSON file tracking custom domains verified by keys (enables the domain command)")
+	flags.StringVar(&config.AuthorizationRules, "authorization-rules", config.AuthorizationRules, "path to JSON file with rules granting keys the right to bind addresses / ports")
+	flags.StringVar(&config.Hooks, "hooks", config.Hooks, "path to a script of hooks (on_auth, on_forward_request, on_connection) enforcing custom policies")
+	flags.Var((*stringList)(&config.MiddlewarePlugins), "middleware-plugin", "path to a Go plugin providing middleware applied to tunnels' traffic (repeatable)")
+	flags.StringVar(&config.AuthorizationWebhook, "authorization-webhook", config.AuthorizationWebhook, "URL of a webhook consulted to authorize every forwarding request")
+	flags.IntVar(&config.Quota.MaxTunnels, "max-tunnels", config.Quota.MaxTunnels, "maximum tunnels per key at the same time (0 for unlimited)")
+	flags.IntVar(&config.Quota.MaxConnections, "max-connections", config.Quota.MaxConnections, "maximum public connections per key at the same time (0 for unlimited)")
+	flags.Int64Var(&config.Quota.MaxBytesPerDay, "max-bytes-per-day", config.Quota.MaxBytesPerDay, "maximum bytes transferred per key per day (0 for unlimited)")
+	flags.Int64Var(&config.Quota.MaxBytesPerMonth, "max-bytes-per-month", config.Quota.MaxBytesPerMonth, "maximum bytes transferred per key per month (0 for unlimited)")
+	flags.StringVar(&config.Quota.OverCap, "over-cap", config.Quota.OverCap, "what happens to the tunnels of keys over a transfer cap: suspend or throttle (suspend if unset)")
+	flags.Int64Var(&config.Quota.OverCapRate, "over-cap-rate", config.Quota.OverCapRate, "bytes per second keys over a transfer cap are throttled to, with -over-cap throttle (64 KiB if unset)")
+	flags.StringVar(&config.UsageFile, "usage-file", config.UsageFile, "path to JSON file persisting the bytes each key transferred today and this month, so that transfer caps hold across restarts")
+	flags.Var((*webhookList)(&config.Webhooks), "webhook", "URL of a webhook to notify of tunnel lifecycle events (can be repeated)")
+	flags.StringVar(&webhookSecret, "webhook-secret", "", "secret to sign requests to webhooks given with -webhook using HMAC-SHA256")
+	flags.Var((*stringList)(&config.AdminKeys), "admin-key", "fingerprint of a key with administrative privileges (can be repeated)")
+	_ = flags.Parse(args)
+
+	for i := webhooks; i < len(config.Webhooks); i++ {
+		config.Webhooks[i].Secret = webhookSecret
+	}
+}
+
+// listen returns a listener on [addr] (see server.Listen), unless an [activated] listener (eg. by systemd) is provided
+func listen(addr string, activated net.Listener) (net.Listener, error) {
+	if activated != nil {
+		return activated, nil
+	}
+	return server.Listen(addr)
+}
+
+// stringList is a flag.Value that collects values of a repeated flag
+type stringList []string
+
+func (list *stringList) String() string { return strings.Join(*list, ",") }
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+// webhookList is a flag.Value that collects webhooks from a repeated flag
+type webhookList []server.WebhookConfig
+
+func (list *webhookList) String() string {
+	var urls []string
+	for _, hook := range *list {
+		urls = append(urls, hook.URL)
+	}
+	return strings.Join(urls, ",")
+}
+
+func (list *webhookList) Set(value string) error {
+	*list = append(*list, server.WebhookConfig{URL: value})
+	return nil
+}
+
+// feedList is a flag.Value that collects reputation feeds (as name=url) from a repeated flag
+type feedList []server.ReputationFeed
+
+func (list *feedList) String() string {
+	var feeds []string
+	for _, feed := range *list {
+		feeds = append(feeds, feed.Name+"="+feed.URL)
+	}
+	return strings.Join(feeds, ",")
+}
+
+func (list *feedList) Set(value string) error {
+	var parts = strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("invalid reputation feed %q: must be name=url", value)
+	}
+	*list = append(*list, server.ReputationFeed{Name: parts[0], URL: parts[1]})
+	return nil
 }
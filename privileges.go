@@ -0,0 +1,67 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"github.com/pkg/errors"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// ----------
+// This file contains helpers to drop root privileges once the server has bound its (privileged) listeners
+// ----------
+
+// dropPrivileges switches the process to run as the given [username] and [group]. If [group] is empty,
+// the user's primary group is used. If [username] is empty, only the group is changed.
+//
+// Note: changing credentials of a multi-threaded process requires Go 1.16+ on Linux; older
+// runtimes report an error (which is returned as-is) rather than leaving threads with mixed privileges.
+func dropPrivileges(username, group string) (err error) {
+	if username == "" && group == "" {
+		return nil
+	}
+
+	var uid, gid = -1, -1
+	if username != "" {
+		var u *user.User
+		if u, err = user.Lookup(username); err != nil {
+			return errors.Wrapf(err, "failed to lookup user %q", username)
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+
+	if group != "" {
+		var g *user.Group
+		if g, err = user.LookupGroup(group); err != nil {
+			return errors.Wrapf(err, "failed to lookup group %q", group)
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	// nothing to do if we're already running with the requested credentials (eg. after a restart)
+	if (uid == -1 || uid == os.Getuid()) && gid == os.Getgid() && os.Getuid() != 0 {
+		return nil
+	}
+
+	// order matters here: supplementary groups and gid can only be changed while we're still root
+	if err = syscall.Setgroups([]int{gid}); err != nil {
+		return errors.Wrap(err, "failed to drop supplementary groups")
+	}
+
+	if err = syscall.Setgid(gid); err != nil {
+		return errors.Wrapf(err, "failed to change group to %d", gid)
+	}
+
+	if uid != -1 {
+		if err = syscall.Setuid(uid); err != nil {
+			return errors.Wrapf(err, "failed to change user to %d", uid)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ----------
+// Windows has no user and group ids to switch to, so privileges can't be dropped there
+// ----------
+
+// dropPrivileges fails if [username] or [group] is set, as privileges can't be dropped on this platform
+func dropPrivileges(username, group string) error {
+	if username == "" && group == "" {
+		return nil
+	}
+	return errors.New("dropping privileges (-user / -group) isn't supported on this platform")
+}
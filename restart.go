@@ -0,0 +1,185 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/shhh/server"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ----------
+// This file contains helpers to gracefully restart the server (eg. after an update) by handing its listeners over
+// to a new instance of the executable. Listeners are passed the same way systemd passes activated sockets
+// (see systemdListeners). Once the new instance is ready, it asks the old one to drain and exit; the old one hands
+// the endpoints of its tunnels over (through a pipe) before closing them, so that clients regain their names and
+// ports as they reconnect to the new one, followed by the bytes each key transferred, so that transfer caps hold.
+// ----------
+
+// signal asking the server to restart gracefully (see restart)
+var restartSignal os.Signal = syscall.SIGUSR2
+
+// handoffParentEnv names the environment variable carrying the pid of the instance handing its listeners over
+const handoffParentEnv = "SHHH_HANDOFF_PID"
+
+// handoffStateEnv names the environment variable carrying the file descriptor of the pipe the instance handing its
+// listeners over writes the endpoints of its tunnels to
+const handoffStateEnv = "SHHH_HANDOFF_STATE_FD"
+
+// how long the instances wait on each other to hand the endpoints of tunnels over
+const handoffStateTimeout = 5 * time.Second
+
+// handoffParent returns the pid of the instance which handed its listeners over to us, or 0 if there's none
+func handoffParent() int {
+	pid, err := strconv.Atoi(os.Getenv(handoffParentEnv))
+	_ = os.Unsetenv(handoffParentEnv)
+	if err != nil || pid != os.Getppid() {
+		return 0
+	}
+	return pid
+}
+
+// restart starts a new instance of the executable with the same arguments, which inherits the given [listeners]
+// and the read end of the returned pipe (see handOver)
+// (keyed by systemdSSHSocketName / systemdHTTPSocketName / systemdTLSSocketName / systemdSSHTLSSocketName / systemdMetricsSocketName / systemdAdminSocketName / systemdDebugSocketName / systemdRelaySocketName, or systemdListenerSocketPrefix followed by a listener's name). The caller must keep serving until it's asked to stop
+// (with SIGTERM) by the new instance; if the new instance exits before that, the restart has failed.
+func restart(listeners map[string]net.Listener) (*os.Process, *os.File, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to locate executable")
+	}
+
+	var files []*os.File
+	var names []string
+	defer func() {
+		for _, file := range files {
+			_ = file.Close()
+		}
+	}()
+
+	var handed = []string{systemdSSHSocketName, systemdHTTPSocketName, systemdTLSSocketName, systemdSSHTLSSocketName, systemdMetricsSocketName, systemdAdminSocketName, systemdDebugSocketName, systemdRelaySocketName}
+	var additional []string
+	for name := range listeners {
+		if strings.HasPrefix(name, systemdListenerSocketPrefix) {
+			additional = append(additional, name)
+		}
+	}
+	sort.Strings(additional)
+
+	for _, name := range append(handed, additional...) {
+		ln, ok := listeners[name].(interface{ File() (*os.File, error) })
+		if !ok {
+			continue
+		}
+
+		// the new instance serves the Unix socket from now on, so it mustn't be removed as we stop
+		if unix, ok := listeners[name].(*net.UnixListener); ok {
+			unix.SetUnlinkOnClose(false)
+		}
+
+		var file *os.File
+		if file, err = ln.File(); err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to hand %q listener over", name)
+		}
+		files = append(files, file)
+		names = append(names, name)
+	}
+
+	// the pipe comes after the listeners, so that it isn't taken for one
+	state, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to create pipe")
+	}
+	var listenFDs = len(files)
+	files = append(files, state)
+
+	var cmd = exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		handoffParentEnv+"="+strconv.Itoa(os.Getpid()),
+		handoffStateEnv+"="+strconv.Itoa(systemdListenFdsStart+listenFDs),
+		"LISTEN_FDS="+strconv.Itoa(listenFDs),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+	)
+
+	if err = cmd.Start(); err != nil {
+		_ = w.Close()
+		return nil, nil, errors.Wrap(err, "failed to start new instance")
+	}
+
+	return cmd.Process, w, nil
+}
+
+// handOver writes the [endpoints] of our tunnels, and then the [usage] of keys, to the new instance through [state]
+// (see restart), and closes it
+func handOver(state *os.File, endpoints []server.HeldEndpoint, usage []server.KeyUsage) error {
+	defer func() { _ = state.Close() }()
+
+	// the new instance may not read them (eg. if it's an older version)
+	_ = state.SetWriteDeadline(time.Now().Add(handoffStateTimeout))
+
+	var encoder = json.NewEncoder(state)
+	if err := encoder.Encode(endpoints); err != nil {
+		return errors.Wrap(err, "failed to hand endpoints over")
+	}
+	return errors.Wrap(encoder.Encode(usage), "failed to hand usage over")
+}
+
+// handedOver returns the endpoints of tunnels, and the usage of keys, handed over by the previous instance (see
+// handOver), waiting for them up to handoffStateTimeout; there are none if it didn't hand its listeners over (and no
+// usage if it's an older version, which only hands endpoints over)
+func handedOver() ([]server.HeldEndpoint, []server.KeyUsage, error) {
+	fd, err := strconv.Atoi(os.Getenv(handoffStateEnv))
+	_ = os.Unsetenv(handoffStateEnv)
+	if err != nil {
+		return nil, nil, nil
+	}
+
+	var state = os.NewFile(uintptr(fd), "handoff-state")
+	var result = make(chan error, 1)
+	var endpoints []server.HeldEndpoint
+	var usage []server.KeyUsage
+	go func() {
+		var decoder = json.NewDecoder(state)
+		if err := decoder.Decode(&endpoints); err != nil {
+			result <- errors.Wrap(err, "failed to read endpoints handed over")
+		} else if err = decoder.Decode(&usage); err != nil && err != io.EOF {
+			result <- errors.Wrap(err, "failed to read usage handed over")
+		} else {
+			result <- nil
+		}
+	}()
+
+	select {
+	case err = <-result:
+		_ = state.Close()
+		return endpoints, usage, err
+	case <-time.After(handoffStateTimeout):
+		_ = state.Close()
+		return nil, nil, errors.New("timed out waiting for endpoints to be handed over")
+	}
+}
+
+// takeOver asks the instance with [pid] that handed its listeners over to drain and exit, now that we're ready
+func takeOver(pid int) error {
+	if err := sdNotify("MAINPID=" + strconv.Itoa(os.Getpid())); err != nil {
+		return err
+	}
+	return errors.Wrap(syscall.Kill(pid, syscall.SIGTERM), "failed to stop previous instance")
+}
+
+// signalRestart asks the server running as [pid] to restart gracefully
+func signalRestart(pid int) error {
+	return errors.Wrap(syscall.Kill(pid, syscall.SIGUSR2), "failed to restart server")
+}
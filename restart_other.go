@@ -0,0 +1,44 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/shhh/server"
+	"net"
+	"os"
+)
+
+// ----------
+// Graceful restarts hand listeners over to the new instance as inherited file descriptors, and are asked for with a
+// signal (SIGUSR2), neither of which Windows supports; the server is restarted by stopping and starting it there
+// ----------
+
+// no signal asks the server to restart gracefully on this platform
+var restartSignal os.Signal
+
+// returned by what graceful restarts need
+var errRestartUnsupported = errors.New("graceful restarts aren't supported on this platform")
+
+// handoffParent always returns 0, as no instance hands its listeners over on this platform
+func handoffParent() int { return 0 }
+
+// restart always fails, as graceful restarts aren't supported on this platform
+func restart(_ map[string]net.Listener) (*os.Process, *os.File, error) {
+	return nil, nil, errRestartUnsupported
+}
+
+// handOver always fails, as graceful restarts aren't supported on this platform
+func handOver(_ *os.File, _ []server.HeldEndpoint, _ []server.KeyUsage) error {
+	return errRestartUnsupported
+}
+
+// handedOver returns nothing, as no instance hands its listeners over on this platform
+func handedOver() ([]server.HeldEndpoint, []server.KeyUsage, error) { return nil, nil, nil }
+
+// takeOver always fails, as graceful restarts aren't supported on this platform
+func takeOver(_ int) error { return errRestartUnsupported }
+
+// signalRestart always fails, as graceful restarts aren't supported on this platform
+func signalRestart(_ int) error { return errRestartUnsupported }
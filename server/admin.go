@@ -0,0 +1,320 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------
+// This file contains the admin API: a small HTTP API (see Server.AdminHandler) through which operators, or their
+// anomaly / abuse detection systems, manage open tunnels
+// ----------
+
+// AdminHandler returns an http.Handler serving the admin API. Requests (to any of these, including those of the
+// cluster) must carry Config.AdminToken as a bearer token, or get 401, and use the method given, or get 405.
+//
+//	GET  /tunnels             lists open tunnels (see TunnelInfo), only those with the "tag"s given (as key=value, or
+//	                          a key for any value) if any
+//	POST /tunnels/quarantine  quarantines the tunnel named by the "tunnel" parameter, for "reason" (see Server.Quarantine)
+//	POST /tunnels/release     releases the quarantined tunnel named by the "tunnel" parameter
+//	POST /tunnels/terminate   closes the tunnel named by the "tunnel" parameter
+//	GET  /tunnels/requests    lists requests captured by the HTTP tunnel named by the "tunnel" parameter (see CapturedRequest)
+//	POST /tunnels/replay      replays the captured request with ID "request" to the tunnel named by the "tunnel" parameter
+//	POST /tunnels/mirror      mirrors the traffic of the tunnel named by the "tunnel" parameter to the "sink" given, up
+//	                          to "max_bytes", for a "sample" of its connections (see MirrorOptions); it responds with
+//	                          the name of the sink, as "sink"
+//	POST /tunnels/unmirror    stops mirroring the traffic of the tunnel named by the "tunnel" parameter
+//	GET  /tokens              lists API tokens (see APIToken)
+//	POST /tokens              issues an API token named "name", valid for "ttl", which may bind the "addr" / "port" given
+//	                          (both can be repeated); it responds with the token, as "token"
+//	POST /tokens/revoke       revokes the API token with ID "id"
+//	GET  /cluster             lists the nodes of the cluster (see ClusterNode); 404 unless clustered (with
+//	                          Config.ClusterRedis)
+//	GET  /cluster/route       the node holding the tunnel serving "endpoint" (as http:<name>, tls:<name> or tcp:<port>,
+//	                          see Server.Route), for load balancers to route public connections to; 404 if none does
+//	GET  /recordings          lists session recordings (see RecordingInfo)
+//	GET  /recordings/fetch    downloads the session recording with ID "id"
+//
+// Tunnels are named by their public address (eg. "[::]:4000" or "http://myapp.example.com"); clients which joined a
+// balanced endpoint are named <address>#<n> (see balancer.go). Tunnels named by their client (with --name) can also
+// be named by that.
+func (srv *Server) AdminHandler() http.Handler {
+	var actions = map[string]func(address string, r *http.Request) error{
+		"/tunnels/quarantine": func(address string, r *http.Request) error {
+			return srv.Quarantine(address, r.FormValue("reason"))
+		},
+		"/tunnels/release":   func(address string, _ *http.Request) error { return srv.Release(address) },
+		"/tunnels/terminate": func(address string, _ *http.Request) error { return srv.Terminate(address) },
+		"/tunnels/unmirror":  func(address string, _ *http.Request) error { return srv.Unmirror(address) },
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if srv.config.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(srv.config.AdminToken)) != 1 {
+			srv.audit.record(AuditEvent{Type: AuditAdminDenied, Client: r.RemoteAddr, Action: r.URL.Path})
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/tunnels":
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			var tunnels = []TunnelInfo{}
+			for _, tunnel := range srv.Tunnels() {
+				if matchTags(tunnel.Tags, r.URL.Query()["tag"]) {
+					tunnels = append(tunnels, tunnel)
+				}
+			}
+			writeJSON(w, tunnels)
+			return
+
+		case "/tunnels/requests":
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			requests, err := srv.Requests(r.FormValue("tunnel"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			writeJSON(w, requests)
+			return
+
+		case "/tokens":
+			switch r.Method {
+			case http.MethodGet:
+				var tokens = srv.Tokens()
+				if tokens == nil {
+					tokens = []APIToken{}
+				}
+				writeJSON(w, tokens)
+			case http.MethodPost:
+				var ttl time.Duration
+				if s := r.FormValue("ttl"); s != "" {
+					var err error
+					if ttl, err = time.ParseDuration(s); err != nil {
+						http.Error(w, "invalid ttl", http.StatusBadRequest)
+						return
+					}
+				}
+
+				token, info, err := srv.IssueToken(r.FormValue("name"), ttl, r.Form["addr"], r.Form["port"])
+				srv.auditToken(r, info.ID, err)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				writeJSON(w, struct {
+					Token string `json:"token"`
+					APIToken
+				}{token, info})
+			default:
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			}
+			return
+
+		case "/tokens/revoke":
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			var err = srv.RevokeToken(r.FormValue("id"))
+			srv.auditToken(r, r.FormValue("id"), err)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+
+		case "/tunnels/mirror":
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			var options = MirrorOptions{Sink: r.FormValue("sink")}
+			var err error
+			if s := r.FormValue("max_bytes"); s != "" {
+				if options.MaxBytes, err = strconv.ParseInt(s, 10, 64); err != nil {
+					http.Error(w, "invalid max_bytes", http.StatusBadRequest)
+					return
+				}
+			}
+			if s := r.FormValue("sample"); s != "" {
+				if options.Sample, err = strconv.ParseFloat(s, 64); err != nil {
+					http.Error(w, "invalid sample", http.StatusBadRequest)
+					return
+				}
+			}
+
+			if _, err = srv.tunnels.get(r.FormValue("tunnel")); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+
+			sink, err := srv.Mirror(r.FormValue("tunnel"), options)
+			if srv.auditAdmin(r, err); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			writeJSON(w, map[string]string{"sink": sink})
+			return
+
+		case "/cluster":
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			nodes, err := srv.ClusterNodes()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if nodes == nil {
+				nodes = []ClusterNode{}
+			}
+			writeJSON(w, nodes)
+			return
+
+		case "/cluster/route":
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			node, err := srv.Route(r.FormValue("endpoint"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			writeJSON(w, node)
+			return
+
+		case "/recordings":
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			recordings, err := srv.Recordings()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if recordings == nil {
+				recordings = []RecordingInfo{}
+			}
+			writeJSON(w, recordings)
+			return
+
+		case "/recordings/fetch":
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			file, info, err := srv.OpenRecording(r.FormValue("id"))
+			srv.auditAdmin(r, err)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			defer file.Close()
+
+			var name = info.ID + recordingExtensions[info.Format]
+			if info.Format == recordingAsciicast {
+				w.Header().Set("Content-Type", "application/x-asciicast")
+			}
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+			http.ServeContent(w, r, name, info.Modified, file)
+			return
+
+		case "/tunnels/replay":
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			id, err := strconv.ParseInt(r.FormValue("request"), 10, 64)
+			if err != nil {
+				http.Error(w, "invalid request ID", http.StatusBadRequest)
+				return
+			}
+
+			replayed, err := srv.Replay(r.FormValue("tunnel"), id)
+			srv.auditAdmin(r, err)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			writeJSON(w, replayed)
+			return
+		}
+
+		var action, ok = actions[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var address = r.FormValue("tunnel")
+		if _, err := srv.tunnels.get(address); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		var err = action(address, r)
+		if srv.auditAdmin(r, err); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// auditAdmin records the action requested by [r] in the audit log, along with the [err] it failed with (if any)
+func (srv *Server) auditAdmin(r *http.Request, err error) {
+	var event = AuditEvent{Type: AuditAdminAction, Client: r.RemoteAddr, Action: r.URL.Path, Address: r.FormValue("tunnel"), Reason: r.FormValue("reason")}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	srv.audit.record(event)
+}
+
+// auditToken records the action on the API token with [id] requested by [r] in the audit log, along with the [err]
+// it failed with (if any)
+func (srv *Server) auditToken(r *http.Request, id string, err error) {
+	var event = AuditEvent{Type: AuditAdminAction, Client: r.RemoteAddr, Action: r.URL.Path}
+	if id != "" {
+		event.Fingerprint = "token:" + id
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	srv.audit.record(event)
+}
+
+// writeJSON responds with [v] as JSON
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
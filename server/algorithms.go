@@ -0,0 +1,114 @@
+package server
+
+import (
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"sort"
+)
+
+// ----------
+// This file contains the policy of ciphers, MACs and key exchanges ssh clients may negotiate: one of the built-in
+// presets (see Config.Algorithms), or lists of the operator's own. By default, golang.org/x/crypto/ssh's are used.
+// ----------
+
+// algorithms supported by golang.org/x/crypto/ssh on the server side, which don't have exported names
+var (
+	supportedCiphers = []string{
+		"aes128-gcm@openssh.com", "chacha20-poly1305@openssh.com", "aes128-ctr", "aes192-ctr", "aes256-ctr",
+		"aes128-cbc", "3des-cbc", "arcfour256", "arcfour128", "arcfour",
+	}
+
+	supportedMACs = []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha1", "hmac-sha1-96"}
+
+	supportedKeyExchanges = []string{
+		"curve25519-sha256@libssh.org", "ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1",
+	}
+)
+
+// algorithmPresets maps the name of each built-in preset to its algorithms, in order of preference
+var algorithmPresets = map[string]gossh.Config{
+	// only authenticated encryption / encrypt-then-MAC, and elliptic curve key exchanges
+	"modern": {
+		Ciphers:      []string{"chacha20-poly1305@openssh.com", "aes128-gcm@openssh.com", "aes256-ctr", "aes192-ctr", "aes128-ctr"},
+		MACs:         []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256"},
+		KeyExchanges: []string{"curve25519-sha256@libssh.org", "ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521"},
+	},
+
+	// everything supported, for old clients (and devices) which can't negotiate anything better
+	"compat": {
+		Ciphers:      supportedCiphers,
+		MACs:         supportedMACs,
+		KeyExchanges: supportedKeyExchanges,
+	},
+
+	// only AES, SHA-2 and NIST curves, as FIPS 140 permits; the implementations themselves aren't validated
+	"fips-ish": {
+		Ciphers:      []string{"aes128-gcm@openssh.com", "aes256-ctr", "aes192-ctr", "aes128-ctr"},
+		MACs:         []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256"},
+		KeyExchanges: []string{"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521"},
+	},
+}
+
+// AlgorithmPresets returns the names of the built-in algorithm presets
+func AlgorithmPresets() []string {
+	var names = make([]string, 0, len(algorithmPresets))
+	for name := range algorithmPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// algorithmPolicy returns the algorithms clients may negotiate as per [config], or nil to leave the defaults of
+// golang.org/x/crypto/ssh. The lists in [config] override those of its preset.
+func algorithmPolicy(config *Config) (*gossh.Config, error) {
+	if config.Algorithms == "" && config.Ciphers == nil && config.MACs == nil && config.KeyExchanges == nil {
+		return nil, nil
+	}
+
+	var policy gossh.Config
+	if config.Algorithms != "" {
+		preset, ok := algorithmPresets[config.Algorithms]
+		if !ok {
+			return nil, errors.Errorf("unknown algorithm preset %q (available: %v)", config.Algorithms, AlgorithmPresets())
+		}
+		policy = preset
+	}
+
+	for _, list := range []struct {
+		kind       string
+		configured []string
+		supported  []string
+		policy     *[]string
+	}{
+		{"cipher", config.Ciphers, supportedCiphers, &policy.Ciphers},
+		{"MAC", config.MACs, supportedMACs, &policy.MACs},
+		{"key exchange", config.KeyExchanges, supportedKeyExchanges, &policy.KeyExchanges},
+	} {
+		if list.configured == nil {
+			continue
+		}
+		for _, name := range list.configured {
+			if !contains(list.supported, name) {
+				return nil, errors.Errorf("unsupported %s %q (supported: %v)", list.kind, name, list.supported)
+			}
+		}
+		*list.policy = list.configured
+	}
+	return &policy, nil
+}
+
+// algorithmsConfig returns an ssh.ServerConfigCallback restricting the algorithms clients may negotiate to those
+// of [policy], on top of [next] (if set)
+func algorithmsConfig(policy *gossh.Config, next ssh.ServerConfigCallback) ssh.ServerConfigCallback {
+	return func(ctx ssh.Context) *gossh.ServerConfig {
+		var config = &gossh.ServerConfig{}
+		if next != nil {
+			config = next(ctx)
+		}
+		config.Ciphers, config.MACs, config.KeyExchanges = policy.Ciphers, policy.MACs, policy.KeyExchanges
+		return config
+	}
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ----------
+// This file contains the registry of tunnel names clients claim with --name (eg. --name api-dev). A name belongs to
+// the key that first claimed it; its tunnels are known by it (in the admin API, metrics, logs and messages), and a
+// client reconnecting with it regains the endpoints and options its tunnels last had.
+// ----------
+
+// tunnelAlias is a name claimed by a key, and what its tunnels were last opened with
+type tunnelAlias struct {
+	fingerprint string
+	args        []string          // session options the client last passed
+	endpoints   map[string]string // HTTP names / TCP ports the tunnels last had, by tunnel name
+}
+
+// tunnelAliases is the registry of claimed tunnel names
+type tunnelAliases struct {
+	mu      sync.Mutex
+	aliases map[string]*tunnelAlias
+}
+
+// newTunnelAliases returns a new, empty tunnelAliases
+func newTunnelAliases() *tunnelAliases { return &tunnelAliases{aliases: make(map[string]*tunnelAlias)} }
+
+// claim claims [name] for the key with [fingerprint], unless it belongs to another key already
+func (ta *tunnelAliases) claim(name, fingerprint string) error {
+	if fingerprint == "" {
+		return errors.New("--name needs the client to authenticate with a key")
+	}
+
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+
+	if alias, ok := ta.aliases[name]; ok {
+		if alias.fingerprint != fingerprint {
+			return errors.Errorf("tunnel name %q belongs to another key", name)
+		}
+		return nil
+	}
+
+	ta.aliases[name] = &tunnelAlias{fingerprint: fingerprint, endpoints: make(map[string]string)}
+	return nil
+}
+
+// get returns the alias [name], if it's claimed by the key with [fingerprint]; ta.mu must be held
+func (ta *tunnelAliases) get(name, fingerprint string) *tunnelAlias {
+	if alias, ok := ta.aliases[name]; ok && fingerprint != "" && alias.fingerprint == fingerprint {
+		return alias
+	}
+	return nil
+}
+
+// recall returns the session options to use for the client with [fingerprint] passing [command]: the options it
+// last passed, if [command] is just --name with a name it claimed, or [command] itself otherwise
+func (ta *tunnelAliases) recall(fingerprint string, command []string) []string {
+	var name string
+	switch {
+	case len(command) == 2 && (command[0] == "--name" || command[0] == "-name"):
+		name = command[1]
+	case len(command) == 1 && (strings.HasPrefix(command[0], "--name=") || strings.HasPrefix(command[0], "-name=")):
+		name = command[0][strings.Index(command[0], "=")+1:]
+	default:
+		return command
+	}
+
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+
+	if alias := ta.get(strings.ToLower(name), fingerprint); alias != nil && alias.args != nil {
+		return alias.args
+	}
+	return command
+}
+
+// rememberOptions remembers [args] as the session options the tunnels named [name] were last opened with
+func (ta *tunnelAliases) rememberOptions(name, fingerprint string, args []string) {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+
+	if alias := ta.get(name, fingerprint); alias != nil {
+		alias.args = append([]string{}, args...)
+	}
+}
+
+// endpoint returns the endpoint the tunnel [tunnelName] of [name] last had (eg. http:myapp or tcp:4000), if any
+func (ta *tunnelAliases) endpoint(name, fingerprint, tunnelName string) string {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+
+	if alias := ta.get(name, fingerprint); alias != nil {
+		return alias.endpoints[tunnelName]
+	}
+	return ""
+}
+
+// heldName returns the HTTP name the tunnel [tunnelName] of [name] last had, if any
+func (ta *tunnelAliases) heldName(name, fingerprint, tunnelName string) string {
+	var endpoint = ta.endpoint(name, fingerprint, tunnelName)
+	if !strings.HasPrefix(endpoint, "http:") {
+		return ""
+	}
+	return strings.TrimPrefix(endpoint, "http:")
+}
+
+// heldPort returns the TCP port the tunnel [tunnelName] of [name] last had, or 0 if it had none
+func (ta *tunnelAliases) heldPort(name, fingerprint, tunnelName string) uint32 {
+	var endpoint = ta.endpoint(name, fingerprint, tunnelName)
+	if !strings.HasPrefix(endpoint, "tcp:") {
+		return 0
+	}
+	port, _ := strconv.ParseUint(strings.TrimPrefix(endpoint, "tcp:"), 10, 32)
+	return uint32(port)
+}
+
+// rememberEndpoint remembers [endpoint] (see endpoint) as the one the tunnel [tunnelName] of [name] last had
+func (ta *tunnelAliases) rememberEndpoint(name, fingerprint, tunnelName, endpoint string) {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+
+	if alias := ta.get(name, fingerprint); alias != nil {
+		alias.endpoints[tunnelName] = endpoint
+	}
+}
+
+// aliasedTunnelName returns the name of the [n]th tunnel (counting from 1) opened by a client with --name [name]:
+// the first is known by the name itself, and the others as <name>-2, <name>-3 etc.
+func aliasedTunnelName(name string, n int) string {
+	if n <= 1 {
+		return name
+	}
+	return fmt.Sprintf("%s-%d", name, n)
+}
+
+// namedNotifier returns a notifyFn sending messages through [notify], tagged with the name of the tunnel they're about
+func namedNotifier(notify notifyFn, tunnelName string) notifyFn {
+	return func(msg string, fields ...field) {
+		notify(tunnelName+": "+msg, append(fields, kv("tunnel", tunnelName))...)
+	}
+}
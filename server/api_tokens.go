@@ -0,0 +1,158 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains the short-lived API tokens with which automation (eg. CI jobs) authenticates instead of with a
+// long-lived key: a token is issued through the admin API (see Server.IssueToken), and given as the ssh username
+// (ssh shhh_...@host). Any key is accepted along with a valid token, so jobs can use a throwaway one.
+// ----------
+
+// API tokens start with this, which tells them apart from usernames
+const apiTokenPrefix = "shhh_"
+
+// apiTokenContextKey is the key under which the ID of the API token a client authenticated with is stored
+const apiTokenContextKey = "shhh-api-token"
+
+// ttl of tokens issued without one
+const defaultAPITokenTTL = 15 * time.Minute
+
+// APIToken describes an API token. The token itself is only known to whoever it was issued to.
+type APIToken struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name,omitempty"`  // eg. the job it was issued for
+	Addrs   []string  `json:"addrs,omitempty"` // address / name patterns the token may bind (see path.Match)
+	Ports   []string  `json:"ports,omitempty"` // ports (eg. "8080") or inclusive port ranges (eg. "8000-8100")
+	Expires time.Time `json:"expires"`
+}
+
+// apiTokens is the store of issued API tokens. A nil *apiTokens has no tokens, and issues none.
+type apiTokens struct {
+	maxTTL time.Duration
+
+	mu     sync.Mutex
+	tokens map[string]*APIToken // sha256 of the token -> what it's for
+}
+
+// newAPITokens returns the token store, or nil if API tokens are disabled
+func newAPITokens(config *Config) *apiTokens {
+	if !config.APITokens {
+		return nil
+	}
+	return &apiTokens{maxTTL: config.MaxAPITokenTTL, tokens: make(map[string]*APIToken)}
+}
+
+// IssueToken issues an API token named [name], valid for [ttl] (15 minutes if zero, capped at
+// Config.MaxAPITokenTTL), which may bind the [addrs] and [ports] given (or anything, if both are empty). It returns
+// the token, along with its description.
+func (srv *Server) IssueToken(name string, ttl time.Duration, addrs, ports []string) (string, APIToken, error) {
+	var store = srv.tokens
+	if store == nil {
+		return "", APIToken{}, errors.New("API tokens are disabled")
+	}
+
+	if err := validateRules([]AuthorizationRule{{Key: "*", Addrs: addrs, Ports: ports}}); err != nil {
+		return "", APIToken{}, err
+	}
+
+	if ttl <= 0 {
+		ttl = defaultAPITokenTTL
+	}
+	if store.maxTTL > 0 && ttl > store.maxTTL {
+		ttl = store.maxTTL
+	}
+
+	var token = apiTokenPrefix + randomHex(24)
+	var info = APIToken{ID: randomHex(6), Name: name, Addrs: addrs, Ports: ports, Expires: time.Now().Add(ttl).UTC()}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.prune()
+	store.tokens[hashAPIToken(token)] = &info
+	return token, info, nil
+}
+
+// Tokens lists the API tokens which haven't expired, by expiry
+func (srv *Server) Tokens() []APIToken {
+	var store = srv.tokens
+	if store == nil {
+		return nil
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.prune()
+
+	var tokens = make([]APIToken, 0, len(store.tokens))
+	for _, info := range store.tokens {
+		tokens = append(tokens, *info)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Expires.Before(tokens[j].Expires) })
+	return tokens
+}
+
+// RevokeToken revokes the API token with [id]. Clients which authenticated with it stay connected.
+func (srv *Server) RevokeToken(id string) error {
+	var store = srv.tokens
+	if store == nil {
+		return errors.New("API tokens are disabled")
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for hash, info := range store.tokens {
+		if info.ID == id {
+			delete(store.tokens, hash)
+			return nil
+		}
+	}
+	return errors.Errorf("no such token %q", id)
+}
+
+// authenticate checks the token given as the username of the client with [ctx], if it's given one. It returns
+// whether the client gave a token, and whether that token is valid; clients who did are granted its permissions.
+func (store *apiTokens) authenticate(ctx ssh.Context) (given, ok bool) {
+	if store == nil || !strings.HasPrefix(ctx.User(), apiTokenPrefix) {
+		return false, false
+	}
+
+	store.mu.Lock()
+	var info, found = store.tokens[hashAPIToken(ctx.User())]
+	store.mu.Unlock()
+	if !found || time.Now().After(info.Expires) {
+		return true, false
+	}
+
+	var permissions = certPermissions{fingerprint: "token:" + info.ID}
+	if len(info.Addrs) > 0 || len(info.Ports) > 0 {
+		permissions.rules = staticAuthorizer{{Key: "*", Addrs: info.Addrs, Ports: info.Ports}}
+	}
+	ctx.SetValue(apiTokenContextKey, info.ID)
+	ctx.SetValue(certPermissionsContextKey, permissions)
+	return true, true
+}
+
+// prune drops expired tokens. It must be called with the lock held.
+func (store *apiTokens) prune() {
+	var now = time.Now()
+	for hash, info := range store.tokens {
+		if now.After(info.Expires) {
+			delete(store.tokens, hash)
+		}
+	}
+}
+
+// hashAPIToken returns the hash under which [token] is stored, so that tokens aren't kept around in the clear
+func hashAPIToken(token string) string {
+	var sum = sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,164 @@
+package server_test
+
+import (
+	"github.com/riyaz-ali/shhh/internal/harness"
+	"github.com/riyaz-ali/shhh/server"
+	gossh "golang.org/x/crypto/ssh"
+	"testing"
+	"time"
+)
+
+// dialToken connects to [srv] with [token] as the username, and a throwaway key
+func dialToken(t *testing.T, srv *harness.Server, token string) (*gossh.Client, error) {
+	return gossh.Dial("tcp", srv.Addr, &gossh.ClientConfig{
+		User:            token,
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(mustKey(t))},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+}
+
+// startTokens starts a server issuing API tokens (if [enabled]) valid for up to an hour
+func startTokens(t *testing.T, enabled bool) *harness.Server {
+	var config = server.DefaultConfig()
+	config.APITokens, config.MaxAPITokenTTL = enabled, time.Hour
+	srv, err := harness.Start(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func TestAPITokens(t *testing.T) {
+	var srv = startTokens(t, true)
+	defer srv.Close()
+
+	t.Run("valid", func(t *testing.T) {
+		token, info, err := srv.IssueToken("ci", 0, nil, []string{"8000-8100"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ttl := time.Until(info.Expires); ttl <= 14*time.Minute || ttl > 15*time.Minute {
+			t.Fatalf("token issued without a ttl expires in %s, want 15m", ttl)
+		}
+
+		client, err := dialToken(t, srv, token)
+		if err != nil {
+			t.Fatalf("client with a valid token wasn't let in: %v", err)
+		}
+		defer client.Close()
+
+		// the token's permissions apply
+		if ln, err := client.Listen("tcp", "127.0.0.1:8080"); err != nil {
+			t.Fatalf("client couldn't bind a port its token allows: %v", err)
+		} else {
+			_ = ln.Close()
+		}
+		if ln, err := client.Listen("tcp", "127.0.0.1:9090"); err == nil {
+			_ = ln.Close()
+			t.Fatal("client bound a port its token doesn't allow")
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		if client, err := dialToken(t, srv, "shhh_0123456789abcdef0123456789abcdef0123456789abcdef"); err == nil {
+			_ = client.Close()
+			t.Fatal("client with an unknown token was let in")
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		token, _, err := srv.IssueToken("ci", 50*time.Millisecond, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+
+		if client, err := dialToken(t, srv, token); err == nil {
+			_ = client.Close()
+			t.Fatal("client with an expired token was let in")
+		}
+		for _, info := range srv.Tokens() {
+			if info.Expires.Before(time.Now()) {
+				t.Fatalf("expired token %s still listed", info.ID)
+			}
+		}
+	})
+
+	t.Run("max ttl", func(t *testing.T) {
+		_, info, err := srv.IssueToken("ci", 24*time.Hour, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ttl := time.Until(info.Expires); ttl > time.Hour {
+			t.Fatalf("token asked for a day expires in %s, past -max-api-token-ttl (1h)", ttl)
+		}
+	})
+
+	t.Run("revoked", func(t *testing.T) {
+		token, info, err := srv.IssueToken("ci", 0, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = srv.RevokeToken(info.ID); err != nil {
+			t.Fatal(err)
+		}
+
+		if client, err := dialToken(t, srv, token); err == nil {
+			_ = client.Close()
+			t.Fatal("client with a revoked token was let in")
+		}
+		for _, listed := range srv.Tokens() {
+			if listed.ID == info.ID {
+				t.Fatal("revoked token still listed")
+			}
+		}
+		if err = srv.RevokeToken(info.ID); err == nil {
+			t.Fatal("no error revoking a token twice")
+		}
+	})
+
+	t.Run("invalid permissions", func(t *testing.T) {
+		if _, _, err := srv.IssueToken("ci", 0, nil, []string{"http"}); err == nil {
+			t.Fatal("token issued with an invalid port")
+		}
+	})
+}
+
+// with -api-tokens off, no tokens are issued, and a username which looks like one lets no one in
+func TestAPITokensDisabled(t *testing.T) {
+	var srv = startTokens(t, false)
+	defer srv.Close()
+
+	if _, _, err := srv.IssueToken("ci", 0, nil, nil); err == nil {
+		t.Fatal("token issued with API tokens disabled")
+	}
+	if err := srv.RevokeToken("0123456789ab"); err == nil {
+		t.Fatal("no error revoking a token with API tokens disabled")
+	}
+
+	// a token issued elsewhere (eg. before a restart with them disabled)
+	var other = startTokens(t, true)
+	token, _, err := other.IssueToken("ci", 0, nil, nil)
+	_ = other.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if client, err := dialToken(t, srv, token); err == nil {
+		_ = client.Close()
+		t.Fatal("client with a token was let in with API tokens disabled")
+	}
+
+	// clients with an allowed key still get in, whatever their username
+	client, err := gossh.Dial("tcp", srv.Addr, &gossh.ClientConfig{
+		User:            token,
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(srv.Key)},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("client with an allowed key wasn't let in: %v", err)
+	}
+	_ = client.Close()
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains the audit log: an append-only record of security-relevant events (authentication, forwarding
+// requests, admin actions and tunnels opening / closing), written as JSON lines (see AuditEvent) to a file which
+// is rotated once it grows past a size, and / or shipped to syslog.
+// ----------
+
+// types of audit events
+const (
+	AuditAuthSuccess    = "auth.success"
+	AuditAuthFailure    = "auth.failure"
+	AuditAuthOffer      = "auth.offer"
+	AuditForwardGranted = "forward.granted"
+	AuditForwardDenied  = "forward.denied"
+	AuditAdminAction    = "admin.action"
+	AuditAdminDenied    = "admin.denied"
+	AuditTunnelOpened   = "tunnel.opened"
+	AuditTunnelClosed   = "tunnel.closed"
+)
+
+// number of rotated audit logs kept by default
+const defaultAuditLogBackups = 5
+
+// AuditEvent is a line of the audit log
+type AuditEvent struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+
+	// remote address of the client's ssh connection (or of the admin API's caller, for admin events)
+	Client string `json:"client,omitempty"`
+
+	// fingerprint of the key the client offered / authenticated with
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	// what the client asked to forward (eg. "0.0.0.0:80"), for forward events
+	Request string `json:"request,omitempty"`
+
+	// public address (and name) of the tunnel
+	Address string `json:"address,omitempty"`
+	Name    string `json:"name,omitempty"`
+
+	// what an administrator did (eg. "/tunnels/terminate"), for admin events
+	Action string `json:"action,omitempty"`
+
+	// why the event happened (eg. why authentication failed, why forwarding was denied, or why an administrator
+	// quarantined a tunnel)
+	Reason string `json:"reason,omitempty"`
+
+	// what went wrong, for admin actions that failed
+	Error string `json:"error,omitempty"`
+
+	// traffic through the tunnel, for tunnel.closed
+	Connections int64 `json:"connections,omitempty"`
+	BytesIn     int64 `json:"bytes_in,omitempty"`
+	BytesOut    int64 `json:"bytes_out,omitempty"`
+
+	// tags of the tunnel, for tunnel events (see tags.go)
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// auditLog writes AuditEvents. A nil *auditLog discards everything.
+type auditLog struct {
+	mu sync.Mutex
+
+	path    string   // empty unless written to a file
+	file    *os.File // the file being appended to
+	size    int64    // of the file
+	maxSize int64    // the file is rotated past this size (0 to never rotate it)
+	backups int      // number of rotated files kept
+
+	syslog io.Writer // nil unless shipped to syslog
+
+	// puts events on the event bus; nil unless there are notifiers (see event_bus.go)
+	published func(event AuditEvent)
+}
+
+// newAuditLog returns a new auditLog as configured, or nil if the audit log is disabled (and there are no notifiers
+// of security events)
+func newAuditLog(config *Config) (*auditLog, error) {
+	if config.AuditLog == "" && config.AuditSyslog == "" && len(config.EventNotifiers) == 0 {
+		return nil, nil
+	}
+
+	var audit = &auditLog{path: config.AuditLog, maxSize: int64(config.AuditLogMaxSize) << 20, backups: config.AuditLogBackups}
+	if audit.backups <= 0 {
+		audit.backups = defaultAuditLogBackups
+	}
+
+	if audit.path != "" {
+		if err := audit.open(); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.AuditSyslog != "" {
+		var err error
+		if audit.syslog, err = dialSyslog(config.AuditSyslog); err != nil {
+			return nil, errors.Wrap(err, "failed to connect to syslog")
+		}
+	}
+	return audit, nil
+}
+
+// open opens the audit log's file for appending
+func (audit *auditLog) open() error {
+	file, err := os.OpenFile(audit.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to open audit log")
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return errors.Wrap(err, "failed to open audit log")
+	}
+	audit.file, audit.size = file, info.Size()
+	return nil
+}
+
+// rotate moves the audit log's file to <path>.1 (and older ones to <path>.2 etc, dropping the oldest), and opens
+// a new one
+func (audit *auditLog) rotate() error {
+	_ = audit.file.Close()
+	for i := audit.backups - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", audit.path, i), fmt.Sprintf("%s.%d", audit.path, i+1))
+	}
+	if err := os.Rename(audit.path, audit.path+".1"); err != nil {
+		return errors.Wrap(err, "failed to rotate audit log")
+	}
+	return audit.open()
+}
+
+// record writes [event] to the audit log
+func (audit *auditLog) record(event AuditEvent) {
+	if audit == nil {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	line, _ := json.Marshal(event)
+
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+
+	if audit.file != nil {
+		if audit.maxSize > 0 && audit.size > 0 && audit.size+int64(len(line))+1 > audit.maxSize {
+			if err := audit.rotate(); err != nil {
+				log.Printf("audit log: %s", err)
+			}
+		}
+
+		if audit.file != nil {
+			n, err := audit.file.Write(append(line, '\n'))
+			if audit.size += int64(n); err != nil {
+				log.Printf("audit log: failed to write event: %s", err)
+			}
+		}
+	}
+
+	if audit.syslog != nil {
+		if _, err := audit.syslog.Write(line); err != nil {
+			log.Printf("audit log: failed to ship event to syslog: %s", err)
+		}
+	}
+
+	if audit.published != nil {
+		audit.published(event)
+	}
+}
+
+// authFailure records that the client at [addr], offering the key with [fingerprint] (if any), failed to
+// authenticate (or was denied) for [reason]
+func (audit *auditLog) authFailure(reason string, addr net.Addr, fingerprint string) {
+	audit.record(AuditEvent{Type: AuditAuthFailure, Client: addr.String(), Fingerprint: fingerprint, Reason: reason})
+}
+
+// authenticate wraps [handler] to record the keys it rejects, as offers: clients may offer several keys, or only ask
+// whether one would be accepted, so it's not a failure (see Server.handshakeFailed). Successes are recorded once
+// clients have signed with a key (see Server.authenticated).
+func (audit *auditLog) authenticate(handler ssh.PublicKeyHandler) ssh.PublicKeyHandler {
+	if audit == nil {
+		return handler
+	}
+
+	return func(ctx ssh.Context, key ssh.PublicKey) bool {
+		if handler(ctx, key) {
+			return true
+		}
+		audit.record(AuditEvent{Type: AuditAuthOffer, Client: ctx.RemoteAddr().String(), Fingerprint: gossh.FingerprintSHA256(key), Reason: authUnknownKey})
+		return false
+	}
+}
+
+// tunnel records the opening / closing of a tunnel, described by [event]
+func (audit *auditLog) tunnel(event TunnelEvent) {
+	var typ string
+	switch event.Type {
+	case TunnelOpened:
+		typ = AuditTunnelOpened
+	case TunnelClosed:
+		typ = AuditTunnelClosed
+	default:
+		return
+	}
+
+	var e = AuditEvent{Time: event.Time, Type: typ, Client: event.Client, Fingerprint: event.Fingerprint, Address: event.Address, Name: event.Name, Tags: event.Tags}
+	if typ == AuditTunnelClosed {
+		e.Connections, e.BytesIn, e.BytesOut = event.Connections, event.BytesIn, event.BytesOut
+	}
+	audit.record(e)
+}
+
+// authFailure reports that the client at [addr], offering the key with [fingerprint] (if any), failed for [reason]
+// to the auth log and the audit log
+func (srv *Server) authFailure(reason string, addr net.Addr, fingerprint string) {
+	srv.authLog.failure(reason, addr, fingerprint)
+	srv.audit.authFailure(reason, addr, fingerprint)
+}
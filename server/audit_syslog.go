@@ -0,0 +1,40 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package server
+
+import (
+	"github.com/pkg/errors"
+	"io"
+	"log/syslog"
+	"net/url"
+)
+
+// ----------
+// This file contains the helper to ship the audit log to syslog, where it's available (ie. not on Windows / Plan 9)
+// ----------
+
+// tag of audit log messages in syslog
+const auditSyslogTag = "shhh-audit"
+
+// dialSyslog connects to the syslog daemon at [addr]: "local" for the local one, or udp://host:port, tcp://host:port
+// or unix:///path for another. Audit events are sent with the auth facility, at the info level.
+func dialSyslog(addr string) (io.Writer, error) {
+	var priority = syslog.LOG_AUTH | syslog.LOG_INFO
+	if addr == "local" {
+		return syslog.New(priority, auditSyslogTag)
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid syslog address %q", addr)
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp":
+		return syslog.Dial(u.Scheme, u.Host, priority, auditSyslogTag)
+	case "unix":
+		return syslog.Dial("unixgram", u.Path, priority, auditSyslogTag)
+	}
+	return nil, errors.Errorf("invalid syslog address %q: must be local, or a udp://, tcp:// or unix:// URL", addr)
+}
@@ -0,0 +1,18 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package server
+
+import (
+	"github.com/pkg/errors"
+	"io"
+)
+
+// ----------
+// log/syslog isn't available on Windows / Plan 9, so the audit log can't be shipped to syslog there
+// ----------
+
+// dialSyslog always fails, as syslog isn't supported on this platform
+func dialSyslog(addr string) (io.Writer, error) {
+	return nil, errors.New("syslog isn't supported on this platform")
+}
@@ -0,0 +1,130 @@
+package server_test
+
+import (
+	"encoding/json"
+	"github.com/riyaz-ali/shhh/internal/harness"
+	"github.com/riyaz-ali/shhh/server"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startAudited starts a server writing its audit log to [dir], with the hooks of [script] (if any)
+func startAudited(t *testing.T, dir, script string) (*harness.Server, string) {
+	var config = server.DefaultConfig()
+	config.AuditLog = filepath.Join(dir, "audit.log")
+	if script != "" {
+		config.Hooks = filepath.Join(dir, "hooks.py")
+		if err := ioutil.WriteFile(config.Hooks, []byte(script), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv, err := harness.Start(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, config.AuditLog
+}
+
+// auditEvents returns the types (and reasons) of the events in the audit log at [path], eg. "auth.failure:unknown-key"
+func auditEvents(t *testing.T, path string) []string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	var events []string
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		var event server.AuditEvent
+		if line == "" || json.Unmarshal([]byte(line), &event) != nil {
+			continue
+		}
+		if event.Reason != "" {
+			event.Type += ":" + event.Reason
+		}
+		events = append(events, event.Type)
+	}
+	return events
+}
+
+// waitForAuditEvents returns the events of the audit log at [path] once it has [n] of them (or after a while)
+func waitForAuditEvents(t *testing.T, path string, n int) []string {
+	var deadline = time.Now().Add(2 * time.Second)
+	for {
+		var events = auditEvents(t, path)
+		if len(events) >= n || time.Now().After(deadline) {
+			return events
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAuditRecordsAuthenticationOnceSigned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shhh-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var srv, path = startAudited(t, dir, "")
+	defer srv.Close()
+
+	// a known key being offered, without the client signing with it, isn't a success
+	if _, ok := handshake(srv, publicHalf{srv.Key}); ok {
+		t.Fatal("client was let in without signing")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if events := auditEvents(t, path); len(events) != 0 {
+		t.Fatalf("client offering a key it couldn't sign with was recorded as %v", events)
+	}
+
+	// an unknown key is an offer, and the connection ending without authenticating a failure
+	if _, ok := handshake(srv, mustKey(t)); ok {
+		t.Fatal("unknown key was let in")
+	}
+	var want = []string{"auth.offer:unknown-key", "auth.failure:unknown-key"}
+	if events := waitForAuditEvents(t, path, 2); strings.Join(events, " ") != strings.Join(want, " ") {
+		t.Fatalf("got %v, want %v", events, want)
+	}
+
+	if _, ok := handshake(srv, srv.Key); !ok {
+		t.Fatal("known key was denied")
+	}
+	want = append(want, "auth.success")
+	if events := waitForAuditEvents(t, path, 3); strings.Join(events, " ") != strings.Join(want, " ") {
+		t.Fatalf("got %v, want %v", events, want)
+	}
+}
+
+func TestOnAuthCalledOnceSigned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shhh-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var srv, path = startAudited(t, dir, "def on_auth(auth):\n    return False\n")
+	defer srv.Close()
+
+	// the hook isn't asked about keys clients only offer
+	if _, ok := handshake(srv, publicHalf{srv.Key}); ok {
+		t.Fatal("client was let in without signing")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if events := auditEvents(t, path); len(events) != 0 {
+		t.Fatalf("client offering a key it couldn't sign with was recorded as %v", events)
+	}
+
+	// it denies those which sign with them
+	if _, ok := handshake(srv, srv.Key); ok {
+		t.Fatal("client denied by on_auth was let in")
+	}
+	var want = []string{"auth.failure:hook-denied"}
+	if events := waitForAuditEvents(t, path, 1); strings.Join(events, " ") != strings.Join(want, " ") {
+		t.Fatalf("got %v, want %v", events, want)
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// ----------
+// This file defines the Authenticator interface and helpers to authenticate clients
+// and identify them by their public key's fingerprint
+// ----------
+
+// Authenticator decides whether a client is allowed to connect using the given public key
+type Authenticator interface {
+	Authenticate(ctx ssh.Context, key ssh.PublicKey) bool
+}
+
+// AuthenticatorFunc is an adapter to allow the use of ordinary functions as Authenticator
+type AuthenticatorFunc func(ctx ssh.Context, key ssh.PublicKey) bool
+
+// Authenticate calls fn(ctx, key)
+func (fn AuthenticatorFunc) Authenticate(ctx ssh.Context, key ssh.PublicKey) bool {
+	return fn(ctx, key)
+}
+
+// anyAuthenticator is an Authenticator which allows keys allowed by any of its members
+type anyAuthenticator []Authenticator
+
+func (authenticators anyAuthenticator) Authenticate(ctx ssh.Context, key ssh.PublicKey) bool {
+	for _, auth := range authenticators {
+		if auth.Authenticate(ctx, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthorizedKeysFile is an Authenticator which only allows keys listed in an authorized_keys file.
+// Keys can be rotated at runtime, in which case the changes are persisted back to the file.
+type AuthorizedKeysFile struct {
+	path string
+
+	mu    sync.RWMutex
+	lines []string            // lines of the file, preserved as-is (including comments and key options)
+	keys  map[string]struct{} // fingerprints of keys in the file
+}
+
+// AuthorizedKeys returns an AuthorizedKeysFile backed by the authorized_keys file at [path]
+func AuthorizedKeys(path string) (*AuthorizedKeysFile, error) {
+	var file = &AuthorizedKeysFile{path: path}
+	if _, err := file.Reload(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Reload re-reads the file, eg. after it's been edited, so that keys added to it are allowed right away. It returns
+// the fingerprints of the keys which were removed from it. If the file can't be read (or parsed), the keys it listed
+// until then are kept.
+func (file *AuthorizedKeysFile) Reload() (removed []string, _ error) {
+	content, err := ioutil.ReadFile(file.path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read authorized keys")
+	}
+
+	var lines []string
+	var keys = make(map[string]struct{})
+	for _, line := range strings.Split(string(content), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		lines = append(lines, line)
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse authorized keys")
+		}
+		keys[gossh.FingerprintSHA256(key)] = struct{}{}
+	}
+
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	for fp := range file.keys {
+		if _, ok := keys[fp]; !ok {
+			removed = append(removed, fp)
+		}
+	}
+	file.lines, file.keys = lines, keys
+	return removed, nil
+}
+
+// Authenticate returns true if the [key] is listed in the file
+func (file *AuthorizedKeysFile) Authenticate(_ ssh.Context, key ssh.PublicKey) bool {
+	file.mu.RLock()
+	defer file.mu.RUnlock()
+
+	_, ok := file.keys[gossh.FingerprintSHA256(key)]
+	return ok
+}
+
+// Rotate replaces the key with fingerprint [old] with the [replacement] key (annotated with [comment]), and persists the change.
+// Connections already authenticated using the old key are left untouched.
+func (file *AuthorizedKeysFile) Rotate(old string, replacement ssh.PublicKey, comment string) error {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+
+	if _, ok := file.keys[old]; !ok {
+		return errors.Errorf("key %s is not authorized", old)
+	}
+
+	var fp = gossh.FingerprintSHA256(replacement)
+	var lines []string
+	for _, line := range file.lines {
+		if key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(line)); err == nil && gossh.FingerprintSHA256(key) == old {
+			continue // drop the old key
+		}
+		lines = append(lines, line)
+	}
+
+	if _, exists := file.keys[fp]; !exists {
+		lines = append(lines, strings.TrimSpace(strings.TrimSpace(string(gossh.MarshalAuthorizedKey(replacement)))+" "+comment))
+	}
+
+	if err := writeFileAtomic(file.path, []byte(strings.Join(lines, "\n")+"\n")); err != nil {
+		return err
+	}
+
+	file.lines = lines
+	delete(file.keys, old)
+	file.keys[fp] = struct{}{}
+	return nil
+}
+
+// Fingerprint returns the SHA256 fingerprint of the key the client authenticated with, "user:<name>" if it
+// authenticated with a password (see Config.PasswordFile), "token:<id>" if it authenticated with an API token (see
+// Server.IssueToken), or an empty string if it didn't authenticate
+func Fingerprint(ctx ssh.Context) string {
+	if id, ok := ctx.Value(apiTokenContextKey).(string); ok {
+		return "token:" + id
+	}
+	if key, ok := ctx.Value(ssh.ContextKeyPublicKey).(ssh.PublicKey); ok && key != nil {
+		return gossh.FingerprintSHA256(key)
+	}
+	if user, ok := ctx.Value(passwordUserContextKey).(string); ok {
+		return "user:" + user
+	}
+	return ""
+}
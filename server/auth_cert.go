@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+)
+
+// ----------
+// This file contains an Authenticator which allows OpenSSH user certificates signed by trusted authorities,
+// and the permissions granted to the certificates' principals
+// ----------
+
+// certPermissionsContextKey is the key under which the permissions of an authenticated certificate are stored
+const certPermissionsContextKey = "shhh-cert-permissions"
+
+// extension certificates must have to be used for port forwarding (and so, with shhh), as with OpenSSH
+const permitPortForwarding = "permit-port-forwarding"
+
+// PrincipalPermissions grants clients certified for Principal ("*" for any principal) the right to bind
+// matching addresses and ports. Empty Addrs / Ports match everything.
+type PrincipalPermissions struct {
+	Principal string   `json:"principal"`
+	Addrs     []string `json:"addrs,omitempty"` // address / name patterns (see path.Match)
+	Ports     []string `json:"ports,omitempty"` // ports (eg. "8080") or inclusive port ranges (eg. "8000-8100")
+}
+
+// certPermissions are the permissions granted to the client which authenticated using the certificate with fingerprint
+type certPermissions struct {
+	fingerprint string
+	rules       staticAuthorizer // nil if unrestricted
+}
+
+// certAuthority is an Authenticator which allows user certificates signed by any of the authorities
+type certAuthority struct {
+	authorities map[string]struct{}          // fingerprints of trusted CA keys
+	permissions map[string]AuthorizationRule // principal -> permissions; nil if unrestricted
+	checker     *gossh.CertChecker
+}
+
+// CertificateAuthorities returns an Authenticator which allows OpenSSH user certificates signed by any of the
+// CA keys listed (in authorized_keys format) in the file at [path]. The certificate must be valid at the time,
+// list the requested username among its principals, permit port forwarding, and the client must connect from an
+// address allowed by its source-address critical option (other critical options aren't supported, and such
+// certificates are rejected).
+// If [permissions] are given, a certificate's principal may only bind what its permissions allow.
+func CertificateAuthorities(path string, permissions []PrincipalPermissions) (Authenticator, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read certificate authorities")
+	}
+	return newCertAuthority(content, permissions)
+}
+
+// newCertAuthority returns a certAuthority trusting the CA keys listed in [content] (in authorized_keys format)
+func newCertAuthority(content []byte, permissions []PrincipalPermissions) (*certAuthority, error) {
+	var err error
+	var auth = &certAuthority{
+		authorities: make(map[string]struct{}),
+		checker:     &gossh.CertChecker{SupportedCriticalOptions: []string{"source-address"}},
+	}
+
+	for len(bytes.TrimSpace(content)) > 0 {
+		var key gossh.PublicKey
+		if key, _, _, content, err = gossh.ParseAuthorizedKey(content); err != nil {
+			return nil, errors.Wrap(err, "failed to parse certificate authorities")
+		}
+		auth.authorities[gossh.FingerprintSHA256(key)] = struct{}{}
+	}
+
+	if len(permissions) > 0 {
+		auth.permissions = make(map[string]AuthorizationRule)
+		for _, p := range permissions {
+			var rule = AuthorizationRule{Key: p.Principal, Addrs: p.Addrs, Ports: p.Ports}
+			if err = validateRules([]AuthorizationRule{rule}); err != nil {
+				return nil, errors.Wrapf(err, "invalid permissions for principal %q", p.Principal)
+			}
+			auth.permissions[p.Principal] = rule
+		}
+	}
+
+	return auth, nil
+}
+
+// Authenticate returns true if [key] is a valid user certificate signed by a trusted authority for the requested user
+func (auth *certAuthority) Authenticate(ctx ssh.Context, key ssh.PublicKey) bool {
+	cert, ok := key.(*gossh.Certificate)
+	if !ok || cert.CertType != gossh.UserCert {
+		return false
+	}
+
+	if _, ok = auth.authorities[gossh.FingerprintSHA256(cert.SignatureKey)]; !ok {
+		return false
+	}
+
+	// golang.org/x/crypto/ssh takes a certificate without principals to be valid for any; OpenSSH doesn't
+	var principal = ctx.User()
+	if len(cert.ValidPrincipals) == 0 {
+		log.Printf("rejected certificate %q from %s: no principals", cert.KeyId, ctx.RemoteAddr())
+		return false
+	}
+	if err := auth.checker.CheckCert(principal, cert); err != nil {
+		log.Printf("rejected certificate %q from %s: %s", cert.KeyId, ctx.RemoteAddr(), err.Error())
+		return false
+	}
+
+	if _, ok = cert.Extensions[permitPortForwarding]; !ok {
+		log.Printf("rejected certificate %q from %s: missing extension %q", cert.KeyId, ctx.RemoteAddr(), permitPortForwarding)
+		return false
+	}
+
+	if err := checkSourceAddress(ctx.RemoteAddr(), cert.CriticalOptions["source-address"]); err != nil {
+		log.Printf("rejected certificate %q from %s: %s", cert.KeyId, ctx.RemoteAddr(), err.Error())
+		return false
+	}
+
+	var permissions = certPermissions{fingerprint: gossh.FingerprintSHA256(key)}
+	if auth.permissions != nil {
+		rule, ok := auth.permissions[principal]
+		if !ok {
+			if rule, ok = auth.permissions["*"]; !ok {
+				log.Printf("rejected certificate %q from %s: no permissions for principal %q", cert.KeyId, ctx.RemoteAddr(), principal)
+				return false
+			}
+		}
+		rule.Key = "*" // already matched
+		permissions.rules = staticAuthorizer{rule}
+	}
+
+	ctx.SetValue(certPermissionsContextKey, permissions)
+	return true
+}
+
+// checkSourceAddress returns an error unless [addr] matches the comma-separated list of CIDRs / addresses in
+// [allowed] (from a certificate's source-address critical option). An empty list allows any address.
+func checkSourceAddress(addr net.Addr, allowed string) error {
+	if allowed == "" {
+		return nil
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return errors.New("source-address requires a TCP connection")
+	}
+
+	networks, err := parseIPNetworks(strings.Split(allowed, ","))
+	if err != nil {
+		return errors.Wrap(err, "invalid source-address")
+	}
+
+	if !networks.contains(tcpAddr.IP) {
+		return errors.Errorf("source address %s is not allowed", tcpAddr.IP)
+	}
+	return nil
+}
+
+// checkCertPermissions returns an error unless the client (if it authenticated using a certificate)
+// is permitted to bind [port] on [addr]
+func checkCertPermissions(ctx ssh.Context, addr string, port uint32) error {
+	permissions, ok := ctx.Value(certPermissionsContextKey).(certPermissions)
+	if !ok || permissions.rules == nil || permissions.fingerprint != Fingerprint(ctx) {
+		return nil // not authenticated using a certificate, or unrestricted
+	}
+	return permissions.rules.CanBind(permissions.fingerprint, addr, port)
+}
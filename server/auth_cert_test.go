@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testContext is an ssh.Context of a client connecting as user from remote, for authenticators to be called with
+type testContext struct {
+	context.Context
+	sync.Mutex
+	user   string
+	remote net.Addr
+}
+
+// newTestContext returns a testContext of [user] connecting from [ip]
+func newTestContext(user, ip string) *testContext {
+	return &testContext{Context: context.Background(), user: user, remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}}
+}
+
+func (ctx *testContext) User() string          { return ctx.user }
+func (ctx *testContext) SessionID() string     { return "" }
+func (ctx *testContext) ClientVersion() string { return "" }
+func (ctx *testContext) ServerVersion() string { return "" }
+func (ctx *testContext) RemoteAddr() net.Addr  { return ctx.remote }
+func (ctx *testContext) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222}
+}
+func (ctx *testContext) Permissions() *ssh.Permissions {
+	return &ssh.Permissions{Permissions: &gossh.Permissions{}}
+}
+func (ctx *testContext) SetValue(key, value interface{}) {
+	ctx.Context = context.WithValue(ctx.Context, key, value)
+}
+
+// newTestSigner returns a new ed25519 signer (of a CA, or a user)
+func newTestSigner(t *testing.T) gossh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// newTestCert returns a user certificate for [principals], signed by [ca] and valid for an hour from now, with the
+// permit-port-forwarding extension; [modify] may change it before it's signed
+func newTestCert(t *testing.T, ca gossh.Signer, principals []string, modify func(cert *gossh.Certificate)) *gossh.Certificate {
+	var now = time.Now()
+	var cert = &gossh.Certificate{
+		Key:             newTestSigner(t).PublicKey(),
+		KeyId:           "test",
+		CertType:        gossh.UserCert,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+		Permissions:     gossh.Permissions{CriticalOptions: map[string]string{}, Extensions: map[string]string{permitPortForwarding: ""}},
+	}
+	if modify != nil {
+		modify(cert)
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestCertAuthorityAuthenticate(t *testing.T) {
+	var ca, other = newTestSigner(t), newTestSigner(t)
+	auth, err := newCertAuthority(gossh.MarshalAuthorizedKey(ca.PublicKey()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name   string
+		signer gossh.Signer // of the certificate
+		user   string       // requested
+		ip     string       // connecting from
+		modify func(cert *gossh.Certificate)
+		want   bool
+	}{
+		{"valid", ca, "alice", "192.0.2.1", nil, true},
+		{"untrusted authority", other, "alice", "192.0.2.1", nil, false},
+		{"not a principal", ca, "bob", "192.0.2.1", nil, false},
+		{"no principals", ca, "alice", "192.0.2.1", func(cert *gossh.Certificate) { cert.ValidPrincipals = nil }, false},
+		{"expired", ca, "alice", "192.0.2.1", func(cert *gossh.Certificate) {
+			cert.ValidAfter, cert.ValidBefore = uint64(time.Now().Add(-2*time.Hour).Unix()), uint64(time.Now().Add(-time.Hour).Unix())
+		}, false},
+		{"not yet valid", ca, "alice", "192.0.2.1", func(cert *gossh.Certificate) {
+			cert.ValidAfter = uint64(time.Now().Add(time.Hour).Unix())
+		}, false},
+		{"host certificate", ca, "alice", "192.0.2.1", func(cert *gossh.Certificate) { cert.CertType = gossh.HostCert }, false},
+		{"no permit-port-forwarding", ca, "alice", "192.0.2.1", func(cert *gossh.Certificate) {
+			cert.Extensions = map[string]string{"permit-pty": ""}
+		}, false},
+		{"source-address allowed", ca, "alice", "192.0.2.1", func(cert *gossh.Certificate) {
+			cert.CriticalOptions["source-address"] = "10.0.0.0/8,192.0.2.0/24"
+		}, true},
+		{"source-address denied", ca, "alice", "198.51.100.1", func(cert *gossh.Certificate) {
+			cert.CriticalOptions["source-address"] = "10.0.0.0/8,192.0.2.0/24"
+		}, false},
+		{"invalid source-address", ca, "alice", "192.0.2.1", func(cert *gossh.Certificate) {
+			cert.CriticalOptions["source-address"] = "not-an-address"
+		}, false},
+		{"unsupported critical option", ca, "alice", "192.0.2.1", func(cert *gossh.Certificate) {
+			cert.CriticalOptions["force-command"] = "/bin/true"
+		}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var cert = newTestCert(t, test.signer, []string{"alice"}, test.modify)
+			if got := auth.Authenticate(newTestContext(test.user, test.ip), cert); got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	// plain keys aren't certificates
+	if auth.Authenticate(newTestContext("alice", "192.0.2.1"), ca.PublicKey()) {
+		t.Error("plain key let in")
+	}
+}
+
+func TestCertAuthorityPermissions(t *testing.T) {
+	var ca = newTestSigner(t)
+	auth, err := newCertAuthority(gossh.MarshalAuthorizedKey(ca.PublicKey()), []PrincipalPermissions{
+		{Principal: "alice", Addrs: []string{"alice-*"}, Ports: []string{"80", "9000-9010"}},
+		{Principal: "*", Ports: []string{"8080"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		principal string
+		addr      string
+		port      uint32
+		want      bool
+	}{
+		{"alice", "alice-web", 80, true},
+		{"alice", "alice-api", 9005, true},
+		{"alice", "alice-api", 8080, false}, // alice's own permissions apply, not those of any principal
+		{"alice", "bob-web", 80, false},
+		{"bob", "bob-web", 8080, true},
+		{"bob", "bob-web", 80, false},
+	}
+	for _, test := range tests {
+		var ctx = newTestContext(test.principal, "192.0.2.1")
+		var cert = newTestCert(t, ca, []string{test.principal}, nil)
+		if !auth.Authenticate(ctx, cert) {
+			t.Fatalf("%s: certificate rejected", test.principal)
+		}
+		ctx.SetValue(ssh.ContextKeyPublicKey, ssh.PublicKey(cert))
+
+		if got := checkCertPermissions(ctx, test.addr, test.port) == nil; got != test.want {
+			t.Errorf("%s binding %s:%d: got %v, want %v", test.principal, test.addr, test.port, got, test.want)
+		}
+	}
+
+	// principals without permissions (when there's no "*") aren't let in
+	auth, err = newCertAuthority(gossh.MarshalAuthorizedKey(ca.PublicKey()), []PrincipalPermissions{{Principal: "alice"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.Authenticate(newTestContext("bob", "192.0.2.1"), newTestCert(t, ca, []string{"bob"}, nil)) {
+		t.Error("principal without permissions let in")
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bufio"
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ----------
+// This file contains an Authenticator which allows the public keys users publish on GitHub / GitLab
+// ----------
+
+// maximum size of a user's published keys we're willing to read
+const maxPublishedKeysSize = 1 << 20
+
+// forgeKeys is an Authenticator which allows the keys users publish on GitHub / GitLab. Keys are cached,
+// and refreshed in the background once stale; if a refresh fails, the user's previous keys remain in effect.
+type forgeKeys struct {
+	sources map[string]string // user -> url of their published keys
+	client  *http.Client
+	refresh time.Duration
+
+	mu         sync.RWMutex
+	keys       map[string]map[string]struct{} // user -> fingerprints of their keys
+	fetched    time.Time
+	refreshing int32 // set while a refresh is in progress
+}
+
+// ForgeKeys returns an Authenticator which allows the public keys published by the given [users], which are
+// written as github:<username> (or just <username>), gitlab:<username>, or the URL of an authorized_keys-style
+// list of keys. Keys are fetched right away, and refreshed every [refresh].
+func ForgeKeys(users []string, refresh time.Duration) (Authenticator, error) {
+	var auth = &forgeKeys{
+		sources: make(map[string]string),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		refresh: refresh,
+		keys:    make(map[string]map[string]struct{}),
+	}
+
+	for _, user := range users {
+		var source string
+		switch {
+		case strings.HasPrefix(user, "https://") || strings.HasPrefix(user, "http://"):
+			source = user
+		case strings.HasPrefix(user, "gitlab:"):
+			source = "https://gitlab.com/" + strings.TrimPrefix(user, "gitlab:") + ".keys"
+		default:
+			source = "https://github.com/" + strings.TrimPrefix(user, "github:") + ".keys"
+		}
+
+		if strings.HasSuffix(source, "/.keys") {
+			return nil, errors.Errorf("invalid user %q", user)
+		}
+		auth.sources[user] = source
+	}
+
+	auth.refreshAll()
+	return auth, nil
+}
+
+// Authenticate returns true if [key] is published by any of the users
+func (auth *forgeKeys) Authenticate(_ ssh.Context, key ssh.PublicKey) bool {
+	auth.mu.RLock()
+	defer auth.mu.RUnlock()
+
+	if time.Since(auth.fetched) > auth.refresh && atomic.CompareAndSwapInt32(&auth.refreshing, 0, 1) {
+		go auth.refreshAll()
+	}
+
+	var fp = gossh.FingerprintSHA256(key)
+	for _, keys := range auth.keys {
+		if _, ok := keys[fp]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshAll re-fetches the keys of every user
+func (auth *forgeKeys) refreshAll() {
+	defer atomic.StoreInt32(&auth.refreshing, 0)
+
+	for user, source := range auth.sources {
+		keys, err := auth.fetch(source)
+		if err != nil {
+			log.Printf("failed to refresh keys of %s: %s", user, err.Error())
+			continue
+		}
+
+		auth.mu.Lock()
+		auth.keys[user] = keys
+		auth.mu.Unlock()
+	}
+
+	auth.mu.Lock()
+	auth.fetched = time.Now()
+	auth.mu.Unlock()
+}
+
+// fetch downloads the list of keys at [source] and returns their fingerprints. Unparseable lines are skipped.
+func (auth *forgeKeys) fetch(source string) (map[string]struct{}, error) {
+	resp, err := auth.client.Get(source)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch keys")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to fetch keys: %s", resp.Status)
+	}
+
+	var keys = make(map[string]struct{})
+	var scanner = bufio.NewScanner(io.LimitReader(resp.Body, maxPublishedKeysSize))
+	for scanner.Scan() {
+		if key, _, _, _, err := gossh.ParseAuthorizedKey(scanner.Bytes()); err == nil {
+			keys[gossh.FingerprintSHA256(key)] = struct{}{}
+		}
+	}
+
+	return keys, errors.Wrap(scanner.Err(), "failed to read keys")
+}
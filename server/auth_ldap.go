@@ -0,0 +1,257 @@
+package server
+
+import (
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains an Authenticator which verifies users against an LDAP directory (or Active Directory): clients
+// are let in with any of the keys in their entry's sshPublicKey attribute, or (see Config.LDAPPasswords) with their
+// directory password. The groups users are members of may be mapped to what they're allowed to bind.
+// ----------
+
+// at most this many users are cached; expired ones are dropped once it's reached
+const maxLDAPCacheSize = 10000
+
+// LDAPGroupPermissions grants members of Group (the group's DN, or just its name, eg. "developers"; "*" for any user)
+// the right to bind matching addresses and ports. Empty Addrs / Ports match everything.
+type LDAPGroupPermissions struct {
+	Group string   `json:"group"`
+	Addrs []string `json:"addrs,omitempty"` // address / name patterns (see path.Match)
+	Ports []string `json:"ports,omitempty"` // ports (eg. "8080") or inclusive port ranges (eg. "8000-8100")
+}
+
+// ldapUser is what's known of a user of the directory
+type ldapUser struct {
+	dn      string              // empty if there's no such user
+	keys    map[string]struct{} // fingerprints of the user's keys
+	groups  []string            // DNs of the user's groups
+	fetched time.Time
+}
+
+// ldapDirectory is an Authenticator which allows the keys of users of an LDAP directory
+type ldapDirectory struct {
+	url                  string
+	bindDN, bindPassword string // service account searching for users; anonymous if empty
+	baseDN, userFilter   string
+	keyAttribute         string
+	groupAttribute       string
+	passwords            bool
+	permissions          []LDAPGroupPermissions // nil if unrestricted
+	ttl                  time.Duration
+
+	mu    sync.Mutex
+	users map[string]*ldapUser
+}
+
+// newLDAPDirectory returns an ldapDirectory verifying users against the directory at [config].LDAPURL, or nil if
+// there's none
+func newLDAPDirectory(config *Config) (*ldapDirectory, error) {
+	if config.LDAPURL == "" {
+		return nil, nil
+	}
+
+	if !strings.HasPrefix(config.LDAPURL, "ldap://") && !strings.HasPrefix(config.LDAPURL, "ldaps://") {
+		return nil, errors.Errorf("invalid LDAP url %q: must be ldap:// or ldaps://", config.LDAPURL)
+	}
+
+	if !strings.Contains(config.LDAPUserFilter, "%s") {
+		return nil, errors.Errorf("invalid LDAP user filter %q: must contain %%s, where the username goes", config.LDAPUserFilter)
+	}
+	if _, err := berFilter(strings.Replace(config.LDAPUserFilter, "%s", "user", -1)); err != nil {
+		return nil, err
+	}
+
+	for _, p := range config.LDAPGroups {
+		if p.Group == "" {
+			return nil, errors.New("LDAP group permissions must specify a group")
+		}
+		if err := validateRules([]AuthorizationRule{{Key: p.Group, Addrs: p.Addrs, Ports: p.Ports}}); err != nil {
+			return nil, errors.Wrapf(err, "invalid permissions for LDAP group %q", p.Group)
+		}
+	}
+
+	return &ldapDirectory{
+		url:            config.LDAPURL,
+		bindDN:         config.LDAPBindDN,
+		bindPassword:   config.LDAPBindPassword,
+		baseDN:         config.LDAPBaseDN,
+		userFilter:     config.LDAPUserFilter,
+		keyAttribute:   config.LDAPKeyAttribute,
+		groupAttribute: config.LDAPGroupAttribute,
+		passwords:      config.LDAPPasswords,
+		permissions:    config.LDAPGroups,
+		ttl:            config.LDAPCacheTTL,
+		users:          make(map[string]*ldapUser),
+	}, nil
+}
+
+// Authenticate returns true if [key] is among the keys of the requested user
+func (dir *ldapDirectory) Authenticate(ctx ssh.Context, key ssh.PublicKey) bool {
+	user, err := dir.lookup(ctx.User())
+	if err != nil {
+		log.Printf("ldap: failed to look up %q: %s", ctx.User(), err.Error())
+		return false
+	}
+
+	var fp = gossh.FingerprintSHA256(key)
+	if _, ok := user.keys[fp]; !ok {
+		return false
+	}
+	return dir.grant(ctx, user, fp)
+}
+
+// checkPassword returns true if [password] is the directory password of the requested user (and password
+// authentication is enabled)
+func (dir *ldapDirectory) checkPassword(ctx ssh.Context, password string) bool {
+	if dir == nil || !dir.passwords || password == "" { // an empty password would make for an unauthenticated bind
+		return false
+	}
+
+	user, err := dir.lookup(ctx.User())
+	if err != nil {
+		log.Printf("ldap: failed to look up %q: %s", ctx.User(), err.Error())
+		return false
+	}
+	if user.dn == "" {
+		return false
+	}
+
+	conn, err := dialLDAP(dir.url)
+	if err != nil {
+		log.Printf("ldap: failed to check password of %q: %s", ctx.User(), err.Error())
+		return false
+	}
+	defer conn.Close()
+
+	if err = conn.bind(user.dn, password); err != nil {
+		if e, ok := err.(*ldapError); !ok || e.code != ldapInvalidCredential {
+			log.Printf("ldap: failed to check password of %q: %s", ctx.User(), err.Error())
+		}
+		return false
+	}
+	return dir.grant(ctx, user, "user:"+ctx.User())
+}
+
+// grant stores the permissions of [user]'s groups in [ctx], for the client identified by [fingerprint]. It returns
+// false if none of the user's groups has any.
+func (dir *ldapDirectory) grant(ctx ssh.Context, user *ldapUser, fingerprint string) bool {
+	var permissions = certPermissions{fingerprint: fingerprint}
+	if dir.permissions != nil {
+		for _, p := range dir.permissions {
+			if p.Group == "*" || user.memberOf(p.Group) {
+				permissions.rules = append(permissions.rules, AuthorizationRule{Key: "*", Addrs: p.Addrs, Ports: p.Ports})
+			}
+		}
+		if permissions.rules == nil {
+			log.Printf("ldap: rejected %q from %s: no permissions for any of the user's groups", ctx.User(), ctx.RemoteAddr())
+			return false
+		}
+	}
+
+	ctx.SetValue(certPermissionsContextKey, permissions)
+	return true
+}
+
+// memberOf returns true if the user is a member of [group], given as its DN or the value of its DN's first
+// component (eg. "developers" for cn=developers,ou=groups,dc=example,dc=com)
+func (user *ldapUser) memberOf(group string) bool {
+	for _, dn := range user.groups {
+		if strings.EqualFold(dn, group) {
+			return true
+		}
+
+		var rdn = strings.SplitN(dn, ",", 2)[0]
+		if i := strings.IndexByte(rdn, '='); i >= 0 && strings.EqualFold(strings.TrimSpace(rdn[i+1:]), group) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns what the directory has on user [name], as cached for up to the directory's TTL. If the directory
+// can't be reached, what was cached before remains in effect.
+func (dir *ldapDirectory) lookup(name string) (*ldapUser, error) {
+	dir.mu.Lock()
+	var cached = dir.users[name]
+	dir.mu.Unlock()
+
+	if cached != nil && time.Since(cached.fetched) < dir.ttl {
+		return cached, nil
+	}
+
+	user, err := dir.fetch(name)
+	if err != nil {
+		if cached != nil {
+			log.Printf("ldap: failed to refresh %q, using what's cached: %s", name, err.Error())
+			return cached, nil
+		}
+		return nil, err
+	}
+
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	if len(dir.users) >= maxLDAPCacheSize {
+		for n, u := range dir.users {
+			if time.Since(u.fetched) >= dir.ttl {
+				delete(dir.users, n)
+			}
+		}
+		if len(dir.users) >= maxLDAPCacheSize {
+			dir.users = make(map[string]*ldapUser)
+		}
+	}
+	dir.users[name] = user
+	return user, nil
+}
+
+// filterFor returns the filter matching the entry of user [name]: the user filter, with [name] in place of %s. The
+// name is escaped (see RFC 4515), so that it's matched as is, rather than as a pattern or a filter of its own.
+func (dir *ldapDirectory) filterFor(name string) string {
+	return strings.Replace(dir.userFilter, "%s", escapeFilterValue(name), -1)
+}
+
+// fetch searches the directory for user [name]
+func (dir *ldapDirectory) fetch(name string) (*ldapUser, error) {
+	conn, err := dialLDAP(dir.url)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if dir.bindDN != "" {
+		if err = conn.bind(dir.bindDN, dir.bindPassword); err != nil {
+			return nil, errors.Wrap(err, "failed to bind")
+		}
+	}
+
+	var filter = dir.filterFor(name)
+	entries, err := conn.search(dir.baseDN, filter, []string{dir.keyAttribute, dir.groupAttribute})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to search")
+	}
+
+	var user = &ldapUser{keys: make(map[string]struct{}), fetched: time.Now()}
+	switch len(entries) {
+	case 0:
+		return user, nil // no such user; remembered as well, so unknown users don't each cost a search
+	case 1:
+	default:
+		return nil, errors.Errorf("%d entries match %s", len(entries), filter)
+	}
+
+	user.dn = entries[0].dn
+	user.groups = entries[0].attributes[strings.ToLower(dir.groupAttribute)]
+	for _, value := range entries[0].attributes[strings.ToLower(dir.keyAttribute)] {
+		if key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(value)); err == nil {
+			user.keys[gossh.FingerprintSHA256(key)] = struct{}{}
+		}
+	}
+	return user, nil
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"log"
+	"net"
+	"os"
+)
+
+// ----------
+// This file contains the auth log: a stream of authentication failures and policy denials in a stable format,
+// so that tools like fail2ban or CrowdSec can act on them. Every line looks like:
+//
+//   2006/01/02 15:04:05 shhh auth failure: reason=unknown-key ip=203.0.113.7 port=51234 fingerprint=SHA256:...
+//
+// fingerprint is "-" when the client hasn't offered a key (yet). A fail2ban filter could use:
+//
+//   failregex = ^ shhh auth failure: reason=\S+ ip=<HOST> port=\d+ fingerprint=\S+$
+// ----------
+
+// reasons logged to the auth log
+const (
+	authUnknownKey   = "unknown-key"  // the key isn't allowed to connect
+	authBanned       = "banned"       // the IP is banned after too many failures (see sshGuard)
+	authRateLimited  = "rate-limited" // the IP is over the handshake rate limit (see sshGuard)
+	authMaxStartups  = "max-startups" // too many connections haven't authenticated yet (see startupLimiter)
+	authUnauthorized = "unauthorized" // the key isn't allowed to use the server (see Authorizer)
+	authBindDenied   = "bind-denied"  // the key isn't allowed to bind the requested address / port
+)
+
+// authLog writes authentication failures and policy denials. A nil *authLog discards everything.
+type authLog struct {
+	logger *log.Logger
+}
+
+// newAuthLog returns a new authLog writing to the file at [path] (appending to it), or to the server's log if
+// [path] is empty. It returns nil if [enabled] isn't set and [path] is empty.
+func newAuthLog(enabled bool, path string) (*authLog, error) {
+	if path == "" {
+		if !enabled {
+			return nil, nil
+		}
+		return &authLog{logger: log.New(log.Writer(), "", log.LstdFlags)}, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open auth log")
+	}
+	return &authLog{logger: log.New(file, "", log.LstdFlags)}, nil
+}
+
+// failure logs that the client at [addr], offering the key with [fingerprint] (if any), failed for [reason]
+func (auth *authLog) failure(reason string, addr net.Addr, fingerprint string) {
+	if auth == nil {
+		return
+	}
+
+	var ip, port = "-", "0"
+	if host, p, err := net.SplitHostPort(addr.String()); err == nil {
+		ip, port = host, p
+	}
+	if fingerprint == "" {
+		fingerprint = "-"
+	}
+	auth.logger.Printf("shhh auth failure: reason=%s ip=%s port=%s fingerprint=%s", reason, ip, port, fingerprint)
+}
+
+// authenticate wraps [handler] to log keys it rejects
+func (auth *authLog) authenticate(handler ssh.PublicKeyHandler) ssh.PublicKeyHandler {
+	if auth == nil {
+		return handler
+	}
+
+	return func(ctx ssh.Context, key ssh.PublicKey) bool {
+		if handler(ctx, key) {
+			return true
+		}
+		auth.failure(authUnknownKey, ctx.RemoteAddr(), gossh.FingerprintSHA256(key))
+		return false
+	}
+}
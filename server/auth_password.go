@@ -0,0 +1,245 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+	gossh "golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains password authentication, for teams that can't distribute keys to every device. Users are
+// listed in a password file (see Config.PasswordFile), one per line:
+//
+//   alice:$2y$10$...                      # bcrypt hash of the password (eg. from htpasswd -nB alice)
+//   bob:$2y$10$...:JBSWY3DPEHPK3PXP       # and the base32 secret of a TOTP authenticator (see RFC 6238)
+//
+// Users with a TOTP secret must authenticate with keyboard-interactive, giving a verification code along with their
+// password; the others may use password authentication too. Users who aren't in the file may be checked against an
+// LDAP directory instead (see auth_ldap.go). Clients authenticated with a password are identified as "user:<name>"
+// in place of a key's fingerprint.
+// ----------
+
+// passwordUserContextKey is the key under which the name of a user authenticated with a password is stored
+const passwordUserContextKey = "shhh-password-user"
+
+// reason logged to the auth log for wrong passwords (or verification codes)
+const authBadPassword = "bad-password"
+
+const (
+	// TOTP parameters, as used by common authenticator apps
+	totpStep   = 30 * time.Second
+	totpDigits = 6
+
+	// steps before and after the current one whose codes are accepted too, to allow for clock drift
+	totpSkew = 1
+)
+
+// dummyHash is compared against for unknown users, so that they take as long to reject as known ones
+var dummyHash = []byte("$2a$10$8ZVimgrMZ5RcFXICtw9nu.SHY7zkHbAM7OCActtNRgWms6ttGzk8y")
+
+// passwordUser is a user of the password file
+type passwordUser struct {
+	hash []byte
+	totp []byte // decoded TOTP secret; nil if the user doesn't use one
+}
+
+// passwordFile holds the users allowed to authenticate with a password
+type passwordFile struct {
+	users map[string]passwordUser
+
+	mu       sync.Mutex
+	lastStep map[string]int64 // TOTP step of each user's last accepted code, so that a code can't be used twice
+}
+
+// loadPasswordFile reads the password file at [path]. It returns nil if [path] is empty.
+func loadPasswordFile(path string) (*passwordFile, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read password file")
+	}
+
+	var file = &passwordFile{users: make(map[string]passwordUser), lastStep: make(map[string]int64)}
+	for n, line := range strings.Split(string(content), "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var fields = strings.Split(line, ":")
+		if len(fields) < 2 || len(fields) > 3 || fields[0] == "" {
+			return nil, errors.Errorf("invalid password file: line %d: want user:hash[:totp-secret]", n+1)
+		}
+
+		if _, err = bcrypt.Cost([]byte(fields[1])); err != nil {
+			return nil, errors.Wrapf(err, "invalid password file: line %d: not a bcrypt hash", n+1)
+		}
+
+		var user = passwordUser{hash: []byte(fields[1])}
+		if len(fields) == 3 {
+			var secret = strings.ToUpper(strings.Replace(fields[2], " ", "", -1))
+			if user.totp, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "=")); err != nil || len(user.totp) == 0 {
+				return nil, errors.Errorf("invalid password file: line %d: TOTP secret must be base32", n+1)
+			}
+		}
+		file.users[fields[0]] = user
+	}
+	return file, nil
+}
+
+// check returns true if [password] (and [code], if the user has a TOTP secret) are right for [name]. Users with a
+// TOTP secret are never let in without a code.
+func (file *passwordFile) check(name, password string, code *string) bool {
+	if file == nil {
+		return false
+	}
+
+	user, ok := file.users[name]
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+
+	if bcrypt.CompareHashAndPassword(user.hash, []byte(password)) != nil {
+		return false
+	}
+
+	if user.totp == nil {
+		return true
+	}
+	return code != nil && file.checkCode(name, user.totp, *code, time.Now())
+}
+
+// needsCode returns true if [name] has a TOTP secret
+func (file *passwordFile) needsCode(name string) bool {
+	return file != nil && file.users[name].totp != nil
+}
+
+// has returns true if [name] is a user of the password file
+func (file *passwordFile) has(name string) bool {
+	if file == nil {
+		return false
+	}
+	_, ok := file.users[name]
+	return ok
+}
+
+// checkCode returns true if [code] is the TOTP code of [secret] at [now] (give or take totpSkew steps), and
+// wasn't accepted for [name] before
+func (file *passwordFile) checkCode(name string, secret []byte, code string, now time.Time) bool {
+	var current = now.Unix() / int64(totpStep/time.Second)
+
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > file.lastStep[name] && hmac.Equal([]byte(totpCode(secret, step)), []byte(strings.TrimSpace(code))) {
+			file.lastStep[name] = step
+			return true
+		}
+	}
+	return false
+}
+
+// totpCode returns the TOTP code of [secret] for the time [step] (see RFC 4226, section 5.3)
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	var mac = hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	var sum = mac.Sum(nil)
+
+	var offset = sum[len(sum)-1] & 0x0f
+	var value = binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// checkPassword returns true if [password] (and [code]) are right for the requested user, as per the password file
+// or, for users who aren't in it, the LDAP directory
+func (srv *Server) checkPassword(ctx ssh.Context, password string, code *string) bool {
+	if srv.ldap == nil || srv.passwords.has(ctx.User()) {
+		return srv.passwords.check(ctx.User(), password, code)
+	}
+	return srv.ldap.checkPassword(ctx, password)
+}
+
+// passwordHandler returns an ssh.PasswordHandler letting in users of the password file who don't have a TOTP secret
+// (and those of the LDAP directory)
+func passwordHandler(srv *Server) ssh.PasswordHandler {
+	return func(ctx ssh.Context, password string) bool {
+		var ok = !srv.passwords.needsCode(ctx.User()) && srv.checkPassword(ctx, password, nil)
+		if !ok {
+			srv.tarpitPassword(ctx, password)
+		}
+		return srv.passwordAuthenticated(ctx, ok)
+	}
+}
+
+// keyboardInteractiveHandler returns an ssh.KeyboardInteractiveHandler asking users of the password file (or the
+// LDAP directory) for their password, and a verification code if they have a TOTP secret
+func keyboardInteractiveHandler(srv *Server) ssh.KeyboardInteractiveHandler {
+	return func(ctx ssh.Context, challenger gossh.KeyboardInteractiveChallenge) bool {
+		answers, err := challenger(ctx.User(), "", []string{"Password: "}, []bool{false})
+		if err != nil || len(answers) != 1 {
+			return false
+		}
+
+		var code *string
+		if srv.passwords.needsCode(ctx.User()) {
+			codes, err := challenger("", "", []string{"Verification code: "}, []bool{true})
+			if err != nil || len(codes) != 1 {
+				return false
+			}
+			code = &codes[0]
+		}
+
+		var ok = srv.checkPassword(ctx, answers[0], code)
+		if !ok {
+			srv.tarpitPassword(ctx, answers[0])
+		}
+		return srv.passwordAuthenticated(ctx, ok)
+	}
+}
+
+// tarpitPassword logs the failed attempt of the client with [ctx] to authenticate with [password], and holds back
+// its answer, if it's tarpitted. Credentials are checked first, so that users behind a tarpitted IP can still log
+// in; and the passwords of users who may exist are never logged, as they may be mistyped ones of theirs.
+func (srv *Server) tarpitPassword(ctx ssh.Context, password string) {
+	if !tarpitted(ctx) {
+		return
+	}
+	if srv.passwords.has(ctx.User()) || srv.ldap != nil {
+		password = tarpitRedacted
+	}
+	srv.tarpit.attempt(ctx, ctx.RemoteAddr(), ctx.User(), "", password)
+}
+
+// passwordAuthenticated records the outcome of a password authentication of the client with [ctx], and returns [ok]
+func (srv *Server) passwordAuthenticated(ctx ssh.Context, ok bool) bool {
+	var identity = "user:" + ctx.User()
+	if !ok {
+		srv.tarpit.failed(ctx.RemoteAddr())
+		srv.authFailure(authBadPassword, ctx.RemoteAddr(), identity)
+		return false
+	}
+
+	if !srv.hooks.authenticated(ctx, "password", identity, "") {
+		srv.authFailure(authHookDenied, ctx.RemoteAddr(), identity)
+		return false
+	}
+
+	ctx.SetValue(passwordUserContextKey, ctx.User())
+	return true
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"encoding/base32"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writePasswordFile writes [content] to a password file in [dir], and loads it
+func writePasswordFile(t *testing.T, dir, content string) (*passwordFile, error) {
+	var path = filepath.Join(dir, "passwords")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return loadPasswordFile(path)
+}
+
+func TestLoadPasswordFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shhh-passwords")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var secret = []byte("12345678901234567890")
+	var encoded = base32.StdEncoding.EncodeToString(secret) // padded, as some tools write it
+
+	var tests = []struct {
+		name    string
+		content string
+		users   map[string]bool // user, and whether they have a TOTP secret
+		err     string
+	}{
+		{"empty", "", map[string]bool{}, ""},
+		{"comments and blank lines", "# users\n\n  \nalice:" + string(hash) + "\n", map[string]bool{"alice": false}, ""},
+		{"totp", "alice:" + string(hash) + "\nbob:" + string(hash) + ":" + encoded + "\n", map[string]bool{"alice": false, "bob": true}, ""},
+		{"totp in lower case, with spaces", "bob:" + string(hash) + ":" + strings.ToLower(encoded[:8]+" "+strings.TrimRight(encoded[8:], "=")), map[string]bool{"bob": true}, ""},
+		{"no hash", "alice\n", nil, "line 1: want user:hash[:totp-secret]"},
+		{"no user", ":" + string(hash), nil, "line 1: want user:hash[:totp-secret]"},
+		{"too many fields", "alice:" + string(hash) + ":" + encoded + ":extra", nil, "line 1: want user:hash[:totp-secret]"},
+		{"not bcrypt", "# users\nalice:5f4dcc3b5aa765d61d8327deb882cf99", nil, "line 2: not a bcrypt hash"},
+		{"bad totp secret", "bob:" + string(hash) + ":not-base32!", nil, "line 1: TOTP secret must be base32"},
+		{"empty totp secret", "bob:" + string(hash) + ":", nil, "line 1: TOTP secret must be base32"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file, err := writePasswordFile(t, dir, test.content)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(file.users) != len(test.users) {
+				t.Fatalf("got %d users, want %d", len(file.users), len(test.users))
+			}
+			for name, totp := range test.users {
+				if !file.has(name) || file.needsCode(name) != totp {
+					t.Errorf("user %q: got has = %v, needsCode = %v; want needsCode = %v", name, file.has(name), file.needsCode(name), totp)
+				}
+				if totp && string(file.users[name].totp) != string(secret) {
+					t.Errorf("user %q: got TOTP secret %q, want %q", name, file.users[name].totp, secret)
+				}
+			}
+		})
+	}
+
+	if file, err := loadPasswordFile(""); file != nil || err != nil {
+		t.Errorf("got %v, %v without a password file, want nil, nil", file, err)
+	}
+}
+
+// the RFC 6238 test vector (truncated to 6 digits) at 59s
+func TestTOTPCode(t *testing.T) {
+	if code := totpCode([]byte("12345678901234567890"), 59/30); code != "287082" {
+		t.Fatalf("got code %s, want 287082", code)
+	}
+}
+
+func TestCheckCode(t *testing.T) {
+	var secret = []byte("12345678901234567890")
+	var now = time.Unix(1111111109, 0)
+	var step = now.Unix() / int64(totpStep/time.Second)
+
+	var tests = []struct {
+		name  string
+		steps []int64 // steps (relative to now) whose codes are given, in order
+		want  []bool
+	}{
+		{"current", []int64{0}, []bool{true}},
+		{"previous step", []int64{-1}, []bool{true}},
+		{"next step", []int64{+1}, []bool{true}},
+		{"too old", []int64{-totpSkew - 1}, []bool{false}},
+		{"too new", []int64{+totpSkew + 1}, []bool{false}},
+		{"replayed", []int64{0, 0}, []bool{true, false}},
+		{"older than the last accepted", []int64{+1, 0}, []bool{true, false}},
+		{"newer than the last accepted", []int64{-1, 0}, []bool{true, true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var file = &passwordFile{lastStep: make(map[string]int64)}
+			for i, s := range test.steps {
+				if got := file.checkCode("bob", secret, totpCode(secret, step+s), now); got != test.want[i] {
+					t.Fatalf("code %d (step %+d): got %v, want %v", i, s, got, test.want[i])
+				}
+			}
+		})
+	}
+
+	// codes are accepted with surrounding spaces
+	var file = &passwordFile{lastStep: make(map[string]int64)}
+	if !file.checkCode("bob", secret, " "+totpCode(secret, step)+"\n", now) {
+		t.Error("code with surrounding spaces rejected")
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var secret = []byte("12345678901234567890")
+	var code = func() *string {
+		var c = totpCode(secret, time.Now().Unix()/int64(totpStep/time.Second))
+		return &c
+	}
+	var wrong = func() *string {
+		var c = totpCode(secret, time.Now().Unix()/int64(totpStep/time.Second)+10)
+		return &c
+	}
+
+	var tests = []struct {
+		name     string
+		user     string
+		password string
+		code     func() *string
+		want     bool
+	}{
+		{"right password", "alice", "secret", nil, true},
+		{"wrong password", "alice", "guess", nil, false},
+		{"unknown user", "mallory", "secret", nil, false},
+		{"right password and code", "bob", "secret", code, true},
+		{"right password, wrong code", "bob", "secret", wrong, false},
+		{"right password, no code", "bob", "secret", nil, false},
+		{"wrong password, right code", "bob", "guess", code, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var file = &passwordFile{
+				users: map[string]passwordUser{
+					"alice": {hash: hash},
+					"bob":   {hash: hash, totp: secret},
+				},
+				lastStep: make(map[string]int64),
+			}
+
+			var c *string
+			if test.code != nil {
+				c = test.code()
+			}
+			if got := file.check(test.user, test.password, c); got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	if (*passwordFile)(nil).check("alice", "secret", nil) {
+		t.Error("user let in without a password file")
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ----------
+// This file contains an Authenticator which allows user certificates signed by a HashiCorp Vault SSH CA (see
+// https://developer.hashicorp.com/vault/docs/secrets/ssh/signed-ssh-certificates). The CA's public key is fetched
+// from Vault, and refreshed so that rotating it needs no restart. The extensions Vault's roles put on certificates
+// decide who may tunnel, and what they may bind.
+// ----------
+
+// extensions of Vault-signed certificates which restrict what they may bind, as comma-separated lists of address
+// patterns and ports / port ranges (see AuthorizationRule)
+const (
+	vaultAddrsExtension = "shhh-addrs"
+	vaultPortsExtension = "shhh-ports"
+)
+
+// vaultCA is an Authenticator which allows user certificates signed by a Vault SSH CA
+type vaultCA struct {
+	url        string // of the CA's public key
+	client     *http.Client
+	refresh    time.Duration
+	extensions []string // extensions certificates must have
+
+	mu         sync.RWMutex
+	ca         *certAuthority
+	fetched    time.Time
+	refreshing int32 // set while a refresh is in progress
+}
+
+// VaultCA returns an Authenticator which allows user certificates signed by the SSH CA mounted at [mount] (eg.
+// "ssh-client-signer") in the Vault at [addr], if they have all of the [extensions] (eg. "permit-port-forwarding").
+// Certificates must be valid as per CertificateAuthorities, and may only bind what their shhh-addrs / shhh-ports
+// extensions allow, if they have any. The CA's key is fetched right away, and refreshed every [refresh].
+func VaultCA(addr, mount string, extensions []string, refresh time.Duration) (Authenticator, error) {
+	if !strings.HasPrefix(addr, "https://") && !strings.HasPrefix(addr, "http://") {
+		return nil, errors.Errorf("invalid Vault address %q: must be an http:// or https:// URL", addr)
+	}
+
+	var auth = &vaultCA{
+		url:        strings.TrimSuffix(addr, "/") + "/v1/" + strings.Trim(mount, "/") + "/public_key",
+		client:     &http.Client{Timeout: 10 * time.Second},
+		refresh:    refresh,
+		extensions: extensions,
+	}
+
+	if err := auth.fetch(); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// Authenticate returns true if [key] is a valid user certificate signed by the Vault CA for the requested user, with
+// the required extensions
+func (auth *vaultCA) Authenticate(ctx ssh.Context, key ssh.PublicKey) bool {
+	auth.mu.RLock()
+	var ca = auth.ca
+	if time.Since(auth.fetched) > auth.refresh && atomic.CompareAndSwapInt32(&auth.refreshing, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&auth.refreshing, 0)
+			if err := auth.fetch(); err != nil {
+				log.Printf("failed to refresh Vault CA key, keeping the previous one: %s", err.Error())
+			}
+		}()
+	}
+	auth.mu.RUnlock()
+
+	if !ca.Authenticate(ctx, key) {
+		return false
+	}
+
+	var cert = key.(*gossh.Certificate)
+	for _, extension := range auth.extensions {
+		if _, ok := cert.Extensions[extension]; !ok {
+			log.Printf("rejected certificate %q from %s: missing extension %q", cert.KeyId, ctx.RemoteAddr(), extension)
+			return false
+		}
+	}
+
+	addrs, hasAddrs := cert.Extensions[vaultAddrsExtension]
+	ports, hasPorts := cert.Extensions[vaultPortsExtension]
+	if hasAddrs || hasPorts {
+		var rule = AuthorizationRule{Key: "*", Addrs: splitList(addrs), Ports: splitList(ports)}
+		if err := validateRules([]AuthorizationRule{rule}); err != nil {
+			log.Printf("rejected certificate %q from %s: invalid permissions: %s", cert.KeyId, ctx.RemoteAddr(), err.Error())
+			return false
+		}
+		ctx.SetValue(certPermissionsContextKey, certPermissions{fingerprint: gossh.FingerprintSHA256(key), rules: staticAuthorizer{rule}})
+	}
+	return true
+}
+
+// fetch downloads the CA's public key from Vault
+func (auth *vaultCA) fetch() error {
+	resp, err := auth.client.Get(auth.url)
+	if err != nil {
+		return errors.Wrap(err, "failed to fetch Vault CA key")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("failed to fetch Vault CA key: %s", resp.Status)
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxPublishedKeysSize))
+	if err != nil {
+		return errors.Wrap(err, "failed to fetch Vault CA key")
+	}
+
+	ca, err := newCertAuthority(content, nil)
+	if err != nil {
+		return errors.Wrap(err, "invalid Vault CA key")
+	}
+	if len(ca.authorities) == 0 {
+		return errors.New("invalid Vault CA key: none configured")
+	}
+
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	auth.ca, auth.fetched = ca, time.Now()
+	return nil
+}
+
+// splitList splits the comma-separated [list], dropping empty items
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
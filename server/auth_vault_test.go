@@ -0,0 +1,168 @@
+package server
+
+import (
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testVault is a Vault serving the public key of an SSH CA, which may be rotated, or fail to be fetched
+type testVault struct {
+	fetches int32 // number of times the key was fetched
+
+	mu     sync.Mutex
+	key    gossh.PublicKey
+	failed bool
+}
+
+func (v *testVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&v.fetches, 1)
+	if r.URL.Path != "/v1/ssh-client-signer/public_key" {
+		http.NotFound(w, r)
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.failed {
+		http.Error(w, "sealed", http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write(gossh.MarshalAuthorizedKey(v.key))
+}
+
+// set makes the vault serve [key], or fail if [failed]
+func (v *testVault) set(key gossh.PublicKey, failed bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.key, v.failed = key, failed
+}
+
+// refreshed waits for the key to have been fetched more than [n] times, and for the refresh to be over
+func refreshed(t *testing.T, auth *vaultCA, v *testVault, n int32) {
+	var deadline = time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&v.fetches) <= n || atomic.LoadInt32(&auth.refreshing) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("CA key wasn't refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestVaultCARefresh(t *testing.T) {
+	var ca, rotated = newTestSigner(t), newTestSigner(t)
+	var vault = &testVault{key: ca.PublicKey()}
+	var srv = httptest.NewServer(vault)
+	defer srv.Close()
+
+	authenticator, err := VaultCA(srv.URL, "ssh-client-signer", []string{permitPortForwarding}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var auth = authenticator.(*vaultCA)
+	var authenticate = func(signer gossh.Signer) bool {
+		return auth.Authenticate(newTestContext("alice", "192.0.2.1"), newTestCert(t, signer, []string{"alice"}, nil))
+	}
+
+	if !authenticate(ca) {
+		t.Fatal("certificate of the Vault CA rejected")
+	}
+
+	// while Vault can't be reached, the key fetched last is kept in use
+	vault.set(rotated.PublicKey(), true)
+	auth.refresh = 0
+	var fetches = atomic.LoadInt32(&vault.fetches)
+	if !authenticate(ca) {
+		t.Fatal("certificate rejected while the CA key was refreshed")
+	}
+	refreshed(t, auth, vault, fetches)
+	if !authenticate(ca) || authenticate(rotated) {
+		t.Fatal("CA key fetched last wasn't kept once refreshing it failed")
+	}
+
+	// once it's back, the rotated key is used
+	vault.set(rotated.PublicKey(), false)
+	fetches = atomic.LoadInt32(&vault.fetches)
+	_ = authenticate(ca)
+	refreshed(t, auth, vault, fetches)
+	if !authenticate(rotated) {
+		t.Fatal("certificate of the rotated CA key rejected")
+	}
+	auth.refresh = time.Hour
+	if authenticate(ca) {
+		t.Fatal("certificate of the previous CA key accepted once rotated")
+	}
+
+	// a Vault which can't be reached at startup is an error
+	vault.set(nil, true)
+	if _, err = VaultCA(srv.URL, "ssh-client-signer", nil, time.Hour); err == nil {
+		t.Fatal("no error when the CA key couldn't be fetched")
+	}
+	if _, err = VaultCA("vault.example.com:8200", "ssh-client-signer", nil, time.Hour); err == nil {
+		t.Fatal("no error with an address which isn't a URL")
+	}
+}
+
+func TestVaultCAExtensions(t *testing.T) {
+	var ca = newTestSigner(t)
+	var srv = httptest.NewServer(&testVault{key: ca.PublicKey()})
+	defer srv.Close()
+
+	authenticator, err := VaultCA(srv.URL, "/ssh-client-signer/", []string{permitPortForwarding, "shhh-tunnels"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name       string
+		extensions map[string]string
+		want       bool
+		bind       map[string]bool // address:port, and whether the certificate may bind it
+	}{
+		{"all required", map[string]string{permitPortForwarding: "", "shhh-tunnels": ""}, true, map[string]bool{"anything:80": true}},
+		{"missing one", map[string]string{permitPortForwarding: ""}, false, nil},
+		{"missing permit-port-forwarding", map[string]string{"shhh-tunnels": ""}, false, nil},
+		{"restricted", map[string]string{permitPortForwarding: "", "shhh-tunnels": "", vaultAddrsExtension: "alice-*", vaultPortsExtension: "80, 9000-9010"},
+			true, map[string]bool{"alice-web:80": true, "alice-web:9005": true, "alice-web:8080": false, "bob-web:80": false}},
+		{"restricted to ports", map[string]string{permitPortForwarding: "", "shhh-tunnels": "", vaultPortsExtension: "8080"},
+			true, map[string]bool{"anything:8080": true, "anything:80": false}},
+		{"invalid restriction", map[string]string{permitPortForwarding: "", "shhh-tunnels": "", vaultPortsExtension: "http"}, false, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var ctx = newTestContext("alice", "192.0.2.1")
+			var cert = newTestCert(t, ca, []string{"alice"}, func(cert *gossh.Certificate) { cert.Extensions = test.extensions })
+			if got := authenticator.Authenticate(ctx, cert); got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+			ctx.SetValue(ssh.ContextKeyPublicKey, ssh.PublicKey(cert))
+
+			for endpoint, want := range test.bind {
+				var addr, port = splitEndpoint(t, endpoint)
+				if got := checkCertPermissions(ctx, addr, port) == nil; got != want {
+					t.Errorf("binding %s: got %v, want %v", endpoint, got, want)
+				}
+			}
+		})
+	}
+}
+
+// splitEndpoint splits [endpoint] (eg. "example:80") into its address and port
+func splitEndpoint(t *testing.T, endpoint string) (string, uint32) {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := strconv.ParseUint(port, 10, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, uint32(n)
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file defines the Authorizer interface which decides what authenticated clients are allowed to do,
+// along with the built-in static and file-based implementations
+// ----------
+
+// Authorizer decides whether the client (identified by the [fingerprint] of the key it authenticated with,
+// or an empty string if authentication is disabled) may use the server, and which addresses it may bind.
+// A non-nil error denies the request; its message is sent back to the client.
+type Authorizer interface {
+	// CanConnect decides whether the client may use the server at all
+	CanConnect(fingerprint string) error
+
+	// CanBind decides whether the client may forward [port] on [addr]. For HTTP tunnels, [addr] is the requested name.
+	CanBind(fingerprint, addr string, port uint32) error
+}
+
+// AuthorizationRule grants the key with the given fingerprint ("*" for any key) the right to bind
+// matching addresses and ports. Empty Addrs / Ports match everything.
+type AuthorizationRule struct {
+	Key   string   `json:"key"`
+	Addrs []string `json:"addrs,omitempty"` // address / name patterns (see path.Match)
+	Ports []string `json:"ports,omitempty"` // ports (eg. "8080") or inclusive port ranges (eg. "8000-8100")
+}
+
+// matchesKey returns true if the rule applies to the key with [fingerprint]
+func (rule *AuthorizationRule) matchesKey(fingerprint string) bool {
+	return rule.Key == "*" || rule.Key == fingerprint
+}
+
+// matches returns true if the rule allows binding [port] on [addr]
+func (rule *AuthorizationRule) matches(addr string, port uint32) bool {
+	var addrOk = len(rule.Addrs) == 0
+	for _, pattern := range rule.Addrs {
+		if ok, _ := path.Match(pattern, addr); ok {
+			addrOk = true
+			break
+		}
+	}
+
+	var portOk = len(rule.Ports) == 0
+	for _, r := range rule.Ports {
+		if low, high, err := parsePortRange(r); err == nil && port >= low && port <= high {
+			portOk = true
+			break
+		}
+	}
+
+	return addrOk && portOk
+}
+
+// parsePortRange parses a single port or an inclusive port range (eg. "8000-8100")
+func parsePortRange(s string) (low, high uint32, err error) {
+	var parts = strings.SplitN(s, "-", 2)
+
+	var p uint64
+	if p, err = strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 16); err != nil {
+		return 0, 0, errors.Errorf("invalid port range %q", s)
+	}
+	low, high = uint32(p), uint32(p)
+
+	if len(parts) == 2 {
+		if p, err = strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 16); err != nil || uint32(p) < low {
+			return 0, 0, errors.Errorf("invalid port range %q", s)
+		}
+		high = uint32(p)
+	}
+
+	return low, high, nil
+}
+
+// validateRules returns an error if any of the [rules] is malformed
+func validateRules(rules []AuthorizationRule) error {
+	for _, rule := range rules {
+		if rule.Key == "" {
+			return errors.New("authorization rule must specify a key")
+		}
+		for _, pattern := range rule.Addrs {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Errorf("invalid address pattern %q", pattern)
+			}
+		}
+		for _, r := range rule.Ports {
+			if _, _, err := parsePortRange(r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// StaticAuthorizer returns an Authorizer which allows only what's granted by the given [rules].
+// Keys not matched by any rule can't use the server at all.
+func StaticAuthorizer(rules ...AuthorizationRule) (Authorizer, error) {
+	if err := validateRules(rules); err != nil {
+		return nil, err
+	}
+	return staticAuthorizer(rules), nil
+}
+
+// staticAuthorizer implements Authorizer over a fixed set of rules
+type staticAuthorizer []AuthorizationRule
+
+func (rules staticAuthorizer) CanConnect(fingerprint string) error {
+	for i := range rules {
+		if rules[i].matchesKey(fingerprint) {
+			return nil
+		}
+	}
+	return errors.New("not authorized to use this server")
+}
+
+func (rules staticAuthorizer) CanBind(fingerprint, addr string, port uint32) error {
+	for i := range rules {
+		if rules[i].matchesKey(fingerprint) && rules[i].matches(addr, port) {
+			return nil
+		}
+	}
+	return errors.Errorf("not authorized to forward %s:%d", addr, port)
+}
+
+// fileAuthorizer is an Authorizer backed by a JSON file of rules, which is re-read whenever it changes
+type fileAuthorizer struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	rules   staticAuthorizer
+}
+
+// FileAuthorizer returns an Authorizer which allows only what's granted by the JSON list of AuthorizationRule
+// in the file at [path]. The file is re-read when modified; if it becomes invalid, the last good rules remain in effect.
+func FileAuthorizer(path string) (Authorizer, error) {
+	var auth = &fileAuthorizer{path: path}
+	if err := auth.reload(); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// reload re-reads the rules file if it was modified since it was last read. Must be called with lock held (or during init).
+func (auth *fileAuthorizer) reload() error {
+	info, err := os.Stat(auth.path)
+	if err != nil {
+		return errors.Wrap(err, "failed to read authorization rules")
+	}
+
+	if info.ModTime().Equal(auth.modTime) {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(auth.path)
+	if err != nil {
+		return errors.Wrap(err, "failed to read authorization rules")
+	}
+
+	var rules []AuthorizationRule
+	if err = json.Unmarshal(content, &rules); err != nil {
+		return errors.Wrap(err, "failed to parse authorization rules")
+	}
+
+	if err = validateRules(rules); err != nil {
+		return err
+	}
+
+	auth.rules, auth.modTime = rules, info.ModTime()
+	return nil
+}
+
+// current returns the latest set of rules
+func (auth *fileAuthorizer) current() staticAuthorizer {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+
+	_ = auth.reload() // keep using the last good rules if the file is broken
+	return auth.rules
+}
+
+func (auth *fileAuthorizer) CanConnect(fingerprint string) error {
+	return auth.current().CanConnect(fingerprint)
+}
+
+func (auth *fileAuthorizer) CanBind(fingerprint, addr string, port uint32) error {
+	return auth.current().CanBind(fingerprint, addr, port)
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ----------
+// This file contains an Authorizer which delegates decisions to an external HTTP service
+// ----------
+
+// webhookTimeout is the maximum time to wait for the webhook to respond; requests are denied on timeout
+const webhookTimeout = 5 * time.Second
+
+// webhookAuthorizer is an Authorizer which POSTs each decision to a webhook
+type webhookAuthorizer struct {
+	url    string
+	client *http.Client
+}
+
+// WebhookAuthorizer returns an Authorizer which POSTs a JSON document describing each decision to [url], like:
+//
+//	{"action": "bind", "fingerprint": "SHA256:...", "addr": "myapp", "port": 80}
+//
+// The request is allowed if the webhook responds with a 2xx status; otherwise the response body
+// (if any) is sent back to the client as the reason. Requests are denied if the webhook can't be reached.
+func WebhookAuthorizer(url string) Authorizer {
+	return &webhookAuthorizer{url: url, client: &http.Client{Timeout: webhookTimeout}}
+}
+
+func (auth *webhookAuthorizer) CanConnect(fingerprint string) error {
+	return auth.ask(map[string]interface{}{"action": "connect", "fingerprint": fingerprint})
+}
+
+func (auth *webhookAuthorizer) CanBind(fingerprint, addr string, port uint32) error {
+	return auth.ask(map[string]interface{}{"action": "bind", "fingerprint": fingerprint, "addr": addr, "port": port})
+}
+
+// ask sends the [decision] to the webhook and interprets its response
+func (auth *webhookAuthorizer) ask(decision map[string]interface{}) error {
+	body, _ := json.Marshal(decision)
+
+	resp, err := auth.client.Post(auth.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.New("authorization service unavailable")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	reason, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if msg := strings.TrimSpace(string(reason)); msg != "" {
+		return errors.New(msg)
+	}
+	return errors.Errorf("not authorized (%s)", resp.Status)
+}
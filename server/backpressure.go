@@ -0,0 +1,99 @@
+package server
+
+import (
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains the backpressure on channel opens: a tunnel only has so many channels being opened with its
+// client at once (see Config.MaxPendingOpens and the --max-pending session option), so that a flood of visitors
+// to a slow client doesn't pile up. Further connections wait a while for one of those to complete, and are rejected
+// if none does.
+// ----------
+
+// errTooManyPendingOpens is returned when opening a channel to a client already busy opening as many as allowed
+var errTooManyPendingOpens = errors.New("too many connections waiting for the client")
+
+// pendingOpens limits the channels being opened with a tunnel's client
+type pendingOpens struct {
+	mu      sync.Mutex
+	pending int
+	waiters []chan struct{} // closed to hand a waiter the slot of a completed open, in order of arrival
+}
+
+// acquire takes a slot for opening a channel, if fewer than [limit] (0 for unlimited) are taken; otherwise, it
+// waits up to [wait] for one to be released. It returns false if no slot could be taken.
+func (p *pendingOpens) acquire(limit int, wait time.Duration) bool {
+	p.mu.Lock()
+	if limit <= 0 || p.pending < limit {
+		p.pending++
+		p.mu.Unlock()
+		return true
+	}
+
+	if wait <= 0 {
+		p.mu.Unlock()
+		return false
+	}
+
+	var ready = make(chan struct{})
+	p.waiters = append(p.waiters, ready)
+	p.mu.Unlock()
+
+	var timer = time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-ready:
+		return true
+	case <-timer.C:
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, waiter := range p.waiters {
+		if waiter == ready {
+			p.waiters = append(p.waiters[:i:i], p.waiters[i+1:]...)
+			return false
+		}
+	}
+	return true // handed a slot just as the wait ran out
+}
+
+// release releases a slot, handing it to the longest waiting open (if any)
+func (p *pendingOpens) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.waiters) > 0 {
+		close(p.waiters[0])
+		p.waiters = p.waiters[1:]
+		return
+	}
+	p.pending--
+}
+
+// limit wraps [newChannel] so that at most [options]' --max-pending (capped at [max]) channels are being opened at
+// once; further ones wait up to --pending-wait (capped at [wait]) for one of those to complete
+func (p *pendingOpens) limit(max int, wait time.Duration, options *sessionOptions, newChannel newChannelFn) newChannelFn {
+	return func(host, port string) (gossh.Channel, <-chan *gossh.Request, error) {
+		var limit, timeout = max, wait
+		if options != nil {
+			if n := options.MaxPending(); n > 0 && (limit <= 0 || n < limit) {
+				limit = n
+			}
+			if d, ok := options.PendingWait(); ok && d < timeout {
+				timeout = d
+			}
+		}
+
+		if !p.acquire(limit, timeout) {
+			return nil, nil, errTooManyPendingOpens
+		}
+		defer p.release()
+		return newChannel(host, port)
+	}
+}
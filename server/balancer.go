@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ----------
+// This file contains the balancer behind HTTP and TCP endpoints, which lets several clients (with the same key, and
+// asking for it with --balance) serve the same name / port, eg. a few replicas of a service. Incoming connections
+// are spread across the clients, skipping those whose channels fail to open; the endpoint stays up for as long as
+// any of them is connected.
+// ----------
+
+// balancing strategies (see --balance)
+const (
+	balanceRoundRobin = "round-robin"
+	balanceLeastConns = "least-conns"
+)
+
+// how long a client whose channel failed to open is passed over by the balancer
+const balancerCooldown = 10 * time.Second
+
+// errNoBalancedClients is returned by a balancedEndpoint once its last client left
+var errNoBalancedClients = errors.New("no clients are serving the endpoint")
+
+// balancedMember is a client serving a balancedEndpoint
+type balancedMember struct {
+	id         int // 1 for the client that opened the endpoint
+	newChannel newChannelFn
+	notify     notifyFn
+
+	conns     int32     // number of open channels
+	downUntil time.Time // guarded by the endpoint's mu
+}
+
+// balancedEndpoint is a public endpoint (an HTTP name or a TCP port) served by one or more clients
+type balancedEndpoint struct {
+	key         string          // in balancedEndpoints (eg. http:myapp or tcp:[::]:4000)
+	address     string          // public address of the endpoint
+	fingerprint string          // of the key the clients serving the endpoint connect with
+	options     *sessionOptions // of the client that opened the endpoint
+	http        *httpTunnel     // nil unless it's an HTTP endpoint
+
+	group *group // runs the endpoint (eg. its listener) until the last client leaves
+
+	mu      sync.Mutex
+	members []*balancedMember
+	next    int // round-robin position
+	lastID  int
+	closed  bool
+}
+
+// newBalancedEndpoint returns a new balancedEndpoint opened by the client with [fingerprint] and [options]
+func newBalancedEndpoint(fingerprint string, options *sessionOptions) *balancedEndpoint {
+	return &balancedEndpoint{fingerprint: fingerprint, options: options, group: newGroup(context.Background())}
+}
+
+// join adds a client serving the endpoint through [newChannel], which is sent the endpoint's messages through
+// [notify]. It returns nil if the endpoint has closed already.
+func (endpoint *balancedEndpoint) join(newChannel newChannelFn, notify notifyFn) *balancedMember {
+	endpoint.mu.Lock()
+	defer endpoint.mu.Unlock()
+
+	if endpoint.closed {
+		return nil
+	}
+
+	endpoint.lastID++
+	var member = &balancedMember{id: endpoint.lastID, newChannel: newChannel, notify: notify}
+	endpoint.members = append(endpoint.members, member)
+	return member
+}
+
+// leave removes [member] from the endpoint. Once the last client left, the endpoint is closed (and its in-flight
+// connections drained) before leave returns.
+func (endpoint *balancedEndpoint) leave(member *balancedMember) {
+	endpoint.mu.Lock()
+	for i, m := range endpoint.members {
+		if m == member {
+			endpoint.members = append(endpoint.members[:i:i], endpoint.members[i+1:]...)
+			break
+		}
+	}
+	var last = len(endpoint.members) == 0
+	endpoint.closed = endpoint.closed || last
+	endpoint.mu.Unlock()
+
+	if last {
+		endpoint.group.Cancel()
+		_ = endpoint.group.Wait()
+	}
+}
+
+// size returns the number of clients serving the endpoint
+func (endpoint *balancedEndpoint) size() int {
+	endpoint.mu.Lock()
+	defer endpoint.mu.Unlock()
+	return len(endpoint.members)
+}
+
+// isClosed returns true once the last client serving the endpoint left
+func (endpoint *balancedEndpoint) isClosed() bool {
+	endpoint.mu.Lock()
+	defer endpoint.mu.Unlock()
+	return endpoint.closed
+}
+
+// serve runs [fn] as part of the endpoint, until the last client leaves
+func (endpoint *balancedEndpoint) serve(fn func(ctx context.Context)) {
+	endpoint.group.Go(func(ctx context.Context) error {
+		fn(ctx)
+		return nil
+	})
+}
+
+// strategy returns how the endpoint spreads connections, as asked for by the client that opened it (or an empty
+// string if it isn't balanced)
+func (endpoint *balancedEndpoint) strategy() string { return endpoint.options.Balance() }
+
+// candidates returns the clients to open a channel with, in order of preference: those that are up (per the
+// endpoint's strategy), then those that recently failed
+func (endpoint *balancedEndpoint) candidates() []*balancedMember {
+	var strategy = endpoint.strategy()
+
+	endpoint.mu.Lock()
+	defer endpoint.mu.Unlock()
+
+	var n = len(endpoint.members)
+	if n == 0 {
+		return nil
+	}
+
+	var now = time.Now()
+	var up, down []*balancedMember
+	var start = endpoint.next % n
+	endpoint.next = start + 1
+	for i := 0; i < n; i++ {
+		var member = endpoint.members[(start+i)%n]
+		if now.Before(member.downUntil) {
+			down = append(down, member)
+		} else {
+			up = append(up, member)
+		}
+	}
+
+	if strategy == balanceLeastConns {
+		sort.SliceStable(up, func(i, j int) bool {
+			return atomic.LoadInt32(&up[i].conns) < atomic.LoadInt32(&up[j].conns)
+		})
+	}
+	return append(up, down...)
+}
+
+// markDown has the balancer pass over [member] for a while, after it failed to open a channel
+func (endpoint *balancedEndpoint) markDown(member *balancedMember) {
+	endpoint.mu.Lock()
+	defer endpoint.mu.Unlock()
+	member.downUntil = time.Now().Add(balancerCooldown)
+}
+
+// newChannel opens a channel with one of the clients serving the endpoint, failing over to the next one if it can't
+func (endpoint *balancedEndpoint) newChannel(host, port string) (gossh.Channel, <-chan *gossh.Request, error) {
+	var err = errNoBalancedClients
+	for _, member := range endpoint.candidates() {
+		channel, requests, cerr := member.newChannel(host, port)
+		if cerr == nil {
+			atomic.AddInt32(&member.conns, 1)
+			return &balancedChannel{Channel: channel, member: member}, requests, nil
+		}
+
+		if err = cerr; cerr != errQuarantined && cerr != errTooManyPendingOpens { // quarantined / busy clients are fine
+			endpoint.markDown(member)
+		}
+	}
+	return nil, nil, err
+}
+
+// notify sends [msg] to all clients serving the endpoint
+func (endpoint *balancedEndpoint) notify(msg string, fields ...field) {
+	endpoint.mu.Lock()
+	var members = append([]*balancedMember(nil), endpoint.members...)
+	endpoint.mu.Unlock()
+
+	for _, member := range members {
+		member.notify(msg, fields...)
+	}
+}
+
+// balancedChannel is a channel opened with a client serving a balancedEndpoint, counted until it's closed
+type balancedChannel struct {
+	gossh.Channel
+	member *balancedMember
+	once   sync.Once
+}
+
+func (c *balancedChannel) Close() error {
+	c.once.Do(func() { atomic.AddInt32(&c.member.conns, -1) })
+	return c.Channel.Close()
+}
+
+// balancedEndpoints is the registry of open HTTP and TCP endpoints, keyed by name / bind address
+type balancedEndpoints struct {
+	mu        sync.Mutex
+	endpoints map[string]*balancedEndpoint
+}
+
+// newBalancedEndpoints returns a new, empty balancedEndpoints
+func newBalancedEndpoints() *balancedEndpoints {
+	return &balancedEndpoints{endpoints: make(map[string]*balancedEndpoint)}
+}
+
+func (be *balancedEndpoints) add(endpoint *balancedEndpoint) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	be.endpoints[endpoint.key] = endpoint
+}
+
+func (be *balancedEndpoints) remove(endpoint *balancedEndpoint) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	if be.endpoints[endpoint.key] == endpoint {
+		delete(be.endpoints, endpoint.key)
+	}
+}
+
+// byPort returns the TCP endpoint on [port] (whatever its bind address), or nil if there's none
+func (be *balancedEndpoints) byPort(port string) *balancedEndpoint {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	for key, endpoint := range be.endpoints {
+		if strings.HasPrefix(key, "tcp:") && strings.HasSuffix(key, ":"+port) {
+			return endpoint
+		}
+	}
+	return nil
+}
+
+// joinable returns the endpoint at [key] if the client with [fingerprint] and [options] may join it: both it and
+// the client that opened it asked for --balance, with the same key. It returns nil otherwise (in which case the
+// endpoint, if any, is simply in use).
+func (be *balancedEndpoints) joinable(key, fingerprint string, options *sessionOptions) *balancedEndpoint {
+	be.mu.Lock()
+	var endpoint = be.endpoints[key]
+	be.mu.Unlock()
+
+	if endpoint == nil || fingerprint == "" || endpoint.fingerprint != fingerprint || endpoint.strategy() == "" {
+		return nil
+	}
+
+	options.awaitParsed(optionsSettleTime)
+	if options.Balance() == "" {
+		return nil
+	}
+	return endpoint
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"net"
+	"syscall"
+)
+
+// ----------
+// This file contains the diagnosis of failures to bind the public port of a tunnel, so that clients are told which
+// of the usual causes it was (the port being taken, the server not being permitted to bind it, or the bind address
+// not being valid on the server) and what to try instead, rather than getting the same refusal for all of them
+// ----------
+
+// hint suggested to clients which can do without a specific port
+const anyPortHint = "ask for port 0 to get any free port"
+
+// bindFailure returns the reason binding [port] (of [protocol], "TCP" or "UDP") on [host] failed with [err], for the
+// client with [fingerprint]
+func (srv *Server) bindFailure(protocol, host string, port uint32, fingerprint string, err error) string {
+	switch {
+	case isAddrInUse(err):
+		var holder = "another process on the server"
+		if tunnel := srv.tunnels.onPort(protocol, port); tunnel != nil && tunnel.fingerprint == fingerprint {
+			holder = fmt.Sprintf("your tunnel %s", tunnel.address)
+		} else if tunnel != nil {
+			holder = "another client's tunnel"
+		}
+
+		var hint = anyPortHint
+		if protocol == "TCP" {
+			hint += ", or wait for it with --wait-for-port"
+		}
+		return fmt.Sprintf("%s port %d is already in use by %s (%s)", protocol, port, holder, hint)
+
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		return fmt.Sprintf("%s port %d can't be bound: the server isn't permitted to bind it (%s)", protocol, port, anyPortHint)
+
+	case isInvalidBindAddr(err):
+		return fmt.Sprintf("bind address %q is not valid on the server (leave it out to bind the default address)", host)
+
+	default:
+		return fmt.Sprintf("failed to bind %s port %d: %s", protocol, port, err.Error())
+	}
+}
+
+// isInvalidBindAddr returns true if [err] is the failure to bind an address that isn't one of the server's, or isn't
+// an address at all
+func isInvalidBindAddr(err error) bool {
+	var dnsErr *net.DNSError
+	var addrErr *net.AddrError
+	return errors.Is(err, syscall.EADDRNOTAVAIL) || errors.As(err, &dnsErr) || errors.As(err, &addrErr)
+}
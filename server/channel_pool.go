@@ -0,0 +1,150 @@
+package server
+
+import (
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"sync"
+)
+
+// ----------
+// This file contains a pool of pre-opened ssh channels to the client, which lets busy HTTP tunnels
+// serve bursts of requests without waiting for a new channel to be opened for each
+// ----------
+
+// channelPool keeps up to size() channels opened using newChannel ready for use. Idle channels that
+// are closed by the client (eg. as the local service times out idle connections) are dropped from the pool.
+type channelPool struct {
+	newChannel newChannelFn
+	size       func() int
+
+	mu      sync.Mutex
+	idle    []*pooledConn
+	opening int
+	closed  bool
+}
+
+// newChannelPool returns a new channelPool which opens channels using [newChannel] and keeps up to [size] of them ready
+func newChannelPool(newChannel newChannelFn, size func() int) *channelPool {
+	return &channelPool{newChannel: newChannel, size: size}
+}
+
+// Get returns a pre-opened channel if one is ready, or opens a new one otherwise. Either way, the pool is refilled.
+func (pool *channelPool) Get() (net.Conn, error) {
+	pool.mu.Lock()
+	var conn *pooledConn
+	if len(pool.idle) > 0 { // oldest first, as servers handling one connection at a time accept in that order too
+		conn, pool.idle = pool.idle[0], pool.idle[1:]
+	}
+	pool.mu.Unlock()
+
+	pool.fill()
+	if conn != nil {
+		return conn, nil
+	}
+	return pool.open()
+}
+
+// Close closes idle channels; no more channels are pooled afterwards
+func (pool *channelPool) Close() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pool.closed = true
+	for _, conn := range pool.idle {
+		_ = conn.Close()
+	}
+	pool.idle = nil
+}
+
+// open opens a new (unpooled) channel
+func (pool *channelPool) open() (net.Conn, error) {
+	channel, requests, err := pool.newChannel("127.0.0.1", "0")
+	if err != nil {
+		return nil, err
+	}
+	go gossh.DiscardRequests(requests)
+	return &channelConn{Channel: channel}, nil
+}
+
+// fill opens channels in the background until the pool is full. Channels which fail to open are simply not pooled.
+func (pool *channelPool) fill() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	for !pool.closed && len(pool.idle)+pool.opening < pool.size() {
+		pool.opening++
+		go func() {
+			var conn *pooledConn
+			channel, requests, err := pool.newChannel("127.0.0.1", "0")
+			if err == nil {
+				go gossh.DiscardRequests(requests)
+				conn = newPooledConn(channel, pool.drop)
+			}
+
+			pool.mu.Lock()
+			defer pool.mu.Unlock()
+			pool.opening--
+
+			if conn != nil {
+				if pool.closed {
+					_ = conn.Close()
+				} else {
+					pool.idle = append(pool.idle, conn)
+				}
+			}
+		}()
+	}
+}
+
+// drop removes [conn] from the pool (if it's still idle) and closes it
+func (pool *channelPool) drop(conn *pooledConn) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	for i, c := range pool.idle {
+		if c == conn {
+			pool.idle = append(pool.idle[:i], pool.idle[i+1:]...)
+			_ = conn.Close()
+			return
+		}
+	}
+}
+
+// pooledConn is a channelConn which watches for the channel being closed (or data arriving) while it's idle in the
+// pool. To do so, it reads from the channel in the background; the result is returned by the first call to Read.
+type pooledConn struct {
+	channelConn
+
+	ready   chan struct{} // closed once the background read completes
+	pending []byte
+	err     error
+	done    bool // set once pending data / error is consumed
+}
+
+// newPooledConn returns a new pooledConn for [channel]; [dead] is called if it becomes unusable while idle
+func newPooledConn(channel gossh.Channel, dead func(*pooledConn)) *pooledConn {
+	var conn = &pooledConn{channelConn: channelConn{Channel: channel}, ready: make(chan struct{})}
+	go func() {
+		var buf = make([]byte, 512)
+		n, err := channel.Read(buf)
+		conn.pending, conn.err = buf[:n], err
+		close(conn.ready)
+		dead(conn) // a request / response exchange can't start with the server talking; no-op if already in use
+	}()
+	return conn
+}
+
+func (conn *pooledConn) Read(b []byte) (int, error) {
+	if conn.done {
+		return conn.channelConn.Read(b)
+	}
+
+	<-conn.ready
+	var n = copy(b, conn.pending)
+	if conn.pending = conn.pending[n:]; len(conn.pending) > 0 {
+		return n, nil
+	}
+
+	conn.done = true
+	return n, conn.err
+}
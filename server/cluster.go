@@ -0,0 +1,401 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains the clustering mode, in which several nodes behind a load balancer share their state through
+// Redis (see Config.ClusterRedis):
+//
+//   - each node registers itself, with the address it's reachable at (see Config.ClusterAddr)
+//   - the endpoints of tunnels (HTTP / TLS names, and TCP ports) are claimed by the node holding the client, so that
+//     no two nodes serve the same one, and so that public connections can be routed to it (see Server.Route)
+//   - reservations are shared by all nodes, seeded from their files
+//   - quotas count what keys use on all nodes, which publish their usage
+//   - public connections landing on a node which doesn't hold their tunnel are relayed to the one that does, if
+//     nodes relay connections (see relay.go)
+//
+// Nodes refresh what they hold every clusterHeartbeat; what a node which went away held expires after clusterTTL.
+// ----------
+
+// how often nodes refresh what they hold in Redis, and pick up what other nodes published
+const clusterHeartbeat = 5 * time.Second
+
+// how long what a node holds outlives it
+const clusterTTL = 3 * clusterHeartbeat
+
+// prefix of the keys the cluster's state is kept under
+const clusterPrefix = "shhh:"
+
+// scripts which refresh / delete a key only if it still holds the node's ID
+const (
+	redisExpireIfOwned = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) else return 0 end`
+	redisDeleteIfOwned = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`
+)
+
+// ClusterNode describes a node of the cluster
+type ClusterNode struct {
+	ID    string `json:"id"`
+	Addr  string `json:"addr,omitempty"`  // where the node is reachable (see Config.ClusterAddr)
+	Relay string `json:"relay,omitempty"` // where the node accepts relayed connections (see Config.ClusterRelayAddr)
+}
+
+// cluster is this node's part in the cluster. A nil *cluster is a single node, which holds everything.
+type cluster struct {
+	node  string
+	addr  string
+	redis *redisClient
+	relay *clusterRelay // nil if nodes don't relay connections
+
+	store  *reservations
+	quotas *quotas
+
+	mu     sync.Mutex
+	claims map[string]int // endpoints claimed by this node, with the number of tunnels serving them
+}
+
+// newCluster joins the cluster as configured, sharing [store] and [quotas] with other nodes, or returns nil if
+// clustering is disabled
+func newCluster(config *Config, store *reservations, quotas *quotas) (*cluster, error) {
+	if config.ClusterRedis == "" {
+		return nil, nil
+	}
+
+	redis, err := newRedisClient(config.ClusterRedis)
+	if err != nil {
+		return nil, err
+	}
+
+	var c = &cluster{node: config.ClusterNode, addr: config.ClusterAddr, redis: redis, store: store, quotas: quotas, claims: make(map[string]int)}
+	if c.node == "" {
+		if c.node, err = os.Hostname(); err != nil {
+			return nil, errors.Wrap(err, "failed to name cluster node")
+		}
+	}
+
+	if c.relay, err = newClusterRelay(config); err != nil {
+		return nil, err
+	}
+
+	// another node may be running with the same ID (eg. a misconfigured one, or the previous instance of this one)
+	if node, err := c.lookup(c.node); err != nil {
+		return nil, err
+	} else if node != nil && node.Addr != c.addr {
+		log.Printf("cluster node %s was last seen at %q; taking over", c.node, node.Addr)
+	}
+
+	// reservations are shared by all nodes; what the node's file lists is only added
+	if store != nil {
+		store.mu.RLock()
+		for name, owner := range store.Names {
+			_, err = redis.do("HSETNX", clusterPrefix+"reservations:names", name, owner)
+		}
+		for port, owner := range store.Ports {
+			_, err = redis.do("HSETNX", clusterPrefix+"reservations:ports", strconv.Itoa(int(port)), owner)
+		}
+		store.mu.RUnlock()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to share reservations")
+		}
+		store.published = c.publishReservations
+	}
+
+	c.sync()
+	return c, nil
+}
+
+// run keeps the node's part in the cluster up to date, until [stop] is closed. It then leaves the cluster.
+func (c *cluster) run(stop <-chan struct{}) {
+	var ticker = time.NewTicker(clusterHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			c.leave()
+			return
+		case <-ticker.C:
+			c.sync()
+		}
+	}
+}
+
+// sync refreshes what the node holds, publishes its usage, and picks up the reservations and usage of other nodes
+func (c *cluster) sync() {
+	var ttl = strconv.FormatInt(clusterTTL.Milliseconds(), 10)
+	var self, _ = json.Marshal(ClusterNode{ID: c.node, Addr: c.addr, Relay: c.relay.advertised()})
+	if _, err := c.redis.do("SET", clusterPrefix+"node:"+c.node, string(self), "PX", ttl); err != nil {
+		log.Printf("failed to sync with the cluster: %s", err.Error())
+		return
+	}
+
+	c.mu.Lock()
+	var claims = make([]string, 0, len(c.claims))
+	for endpoint := range c.claims {
+		claims = append(claims, endpoint)
+	}
+	c.mu.Unlock()
+
+	for _, endpoint := range claims {
+		var key = clusterPrefix + "endpoint:" + endpoint
+		reply, err := c.redis.do("EVAL", redisExpireIfOwned, "1", key, c.node, ttl)
+		if err == nil && reply == int64(0) { // it expired (eg. as Redis was unreachable for a while); claim it again
+			reply, err = c.redis.do("SET", key, c.node, "NX", "PX", ttl)
+			if err == nil && reply == nil {
+				owner, _ := c.redis.do("GET", key)
+				log.Printf("endpoint %s was claimed by node %s in the meantime", endpoint, redisString(owner))
+			}
+		}
+	}
+
+	if c.quotas != nil {
+		c.syncUsage(ttl)
+	}
+
+	if c.relay != nil {
+		c.followPorts()
+	}
+
+	if c.store != nil {
+		names, err := c.redis.do("HGETALL", clusterPrefix+"reservations:names")
+		if err != nil {
+			return
+		}
+		ports, err := c.redis.do("HGETALL", clusterPrefix+"reservations:ports")
+		if err != nil {
+			return
+		}
+		c.store.replace(redisHash(names), redisHash(ports))
+	}
+}
+
+// syncUsage publishes the node's usage of quotas, and sums up that of other nodes
+func (c *cluster) syncUsage(ttl string) {
+	content, _ := json.Marshal(c.quotas.local())
+	if _, err := c.redis.do("SET", clusterPrefix+"usage:"+c.node, string(content), "PX", ttl); err != nil {
+		return
+	}
+
+	keys, err := c.redis.scan(clusterPrefix + "usage:*")
+	if err != nil {
+		return
+	}
+
+	var others = make(map[string]publishedUsage)
+	for _, key := range keys {
+		if key == clusterPrefix+"usage:"+c.node {
+			continue
+		}
+
+		reply, err := c.redis.do("GET", key)
+		if err != nil || reply == nil {
+			continue
+		}
+
+		var published map[string]publishedUsage
+		if json.Unmarshal([]byte(redisString(reply)), &published) != nil {
+			continue
+		}
+		for fingerprint, u := range published {
+			var total = others[fingerprint]
+			total.Tunnels += u.Tunnels
+			total.Connections += u.Connections
+			if u.Day == time.Now().UTC().Format("2006-01-02") {
+				total.Bytes, total.Day = total.Bytes+u.Bytes, u.Day
+			}
+			others[fingerprint] = total
+		}
+	}
+	c.quotas.setOthers(others)
+}
+
+// followPorts has the relay listen on the TCP ports of tunnels held by other nodes, so that their visitors can
+// connect to any node
+func (c *cluster) followPorts() {
+	keys, err := c.redis.scan(clusterPrefix + "endpoint:tcp:*")
+	if err != nil {
+		return
+	}
+
+	var ports = make(map[uint32]*ClusterNode)
+	for _, key := range keys {
+		var endpoint = strings.TrimPrefix(key, clusterPrefix+"endpoint:")
+		port, err := strconv.Atoi(strings.TrimPrefix(endpoint, "tcp:"))
+		if err != nil {
+			continue
+		}
+		if node := c.elsewhere(endpoint); node != nil && node.Relay != "" {
+			ports[uint32(port)] = node
+		}
+	}
+	c.relay.follow(ports)
+}
+
+// publishReservations shares the reservations changed on this node: [names] and [ports], by owner
+func (c *cluster) publishReservations(names map[string]string, ports map[uint32]string) error {
+	for name, owner := range names {
+		if _, err := c.redis.do("HSET", clusterPrefix+"reservations:names", name, owner); err != nil {
+			return errors.Wrap(err, "failed to share reservations")
+		}
+	}
+	for port, owner := range ports {
+		if _, err := c.redis.do("HSET", clusterPrefix+"reservations:ports", strconv.Itoa(int(port)), owner); err != nil {
+			return errors.Wrap(err, "failed to share reservations")
+		}
+	}
+	return nil
+}
+
+// claim claims [endpoint] (eg. "http:myapp" or "tcp:4000") for this node, unless another node holds it. If Redis is
+// unreachable, the endpoint is claimed once it's back.
+func (c *cluster) claim(endpoint string) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.claims[endpoint] > 0 { // eg. by another client of a balanced endpoint
+		c.claims[endpoint]++
+		return nil
+	}
+
+	var key = clusterPrefix + "endpoint:" + endpoint
+	reply, err := c.redis.do("SET", key, c.node, "NX", "PX", strconv.FormatInt(clusterTTL.Milliseconds(), 10))
+	if err == nil && reply == nil {
+		owner, _ := c.redis.do("GET", key)
+		if node := redisString(owner); node != c.node {
+			return errors.Errorf("%s is in use on node %s", strings.SplitN(endpoint, ":", 2)[1], node)
+		}
+	} else if err != nil {
+		log.Printf("failed to claim %s in the cluster: %s", endpoint, err.Error())
+	}
+
+	c.claims[endpoint] = 1
+	return nil
+}
+
+// release releases a claim on [endpoint]; the endpoint is free for other nodes once all of them are
+func (c *cluster) release(endpoint string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.claims[endpoint]--; c.claims[endpoint] > 0 {
+		return
+	}
+	delete(c.claims, endpoint)
+
+	if _, err := c.redis.do("EVAL", redisDeleteIfOwned, "1", clusterPrefix+"endpoint:"+endpoint, c.node); err != nil {
+		log.Printf("failed to release %s in the cluster: %s", endpoint, err.Error())
+	}
+}
+
+// owner returns the node holding [endpoint], or nil if none does
+func (c *cluster) owner(endpoint string) *ClusterNode {
+	if c == nil {
+		return nil
+	}
+
+	reply, err := c.redis.do("GET", clusterPrefix+"endpoint:"+endpoint)
+	if err != nil || reply == nil {
+		return nil
+	}
+
+	var id = redisString(reply)
+	if node, err := c.lookup(id); err == nil && node != nil {
+		return node
+	}
+	return &ClusterNode{ID: id} // it went away, or Redis is unreachable
+}
+
+// elsewhere returns the node holding [endpoint] if it's another one, or nil
+func (c *cluster) elsewhere(endpoint string) *ClusterNode {
+	if node := c.owner(endpoint); node != nil && node.ID != c.node {
+		return node
+	}
+	return nil
+}
+
+// lookup returns the node with [id], or nil if it isn't part of the cluster
+func (c *cluster) lookup(id string) (*ClusterNode, error) {
+	reply, err := c.redis.do("GET", clusterPrefix+"node:"+id)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	var node ClusterNode
+	if json.Unmarshal([]byte(redisString(reply)), &node) != nil {
+		return nil, errors.Errorf("malformed record of cluster node %s", id)
+	}
+	node.ID = id
+	return &node, nil
+}
+
+// leave releases everything this node holds, so that other nodes needn't wait for it to expire
+func (c *cluster) leave() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for endpoint := range c.claims {
+		_, _ = c.redis.do("EVAL", redisDeleteIfOwned, "1", clusterPrefix+"endpoint:"+endpoint, c.node)
+	}
+	c.claims = make(map[string]int)
+	c.relay.follow(nil)
+	_, _ = c.redis.do("DEL", clusterPrefix+"node:"+c.node, clusterPrefix+"usage:"+c.node)
+}
+
+// redisHash returns the reply of HGETALL as a map
+func redisHash(reply interface{}) map[string]string {
+	var items = redisStrings(reply)
+	var hash = make(map[string]string, len(items)/2)
+	for i := 0; i+1 < len(items); i += 2 {
+		hash[items[i]] = items[i+1]
+	}
+	return hash
+}
+
+// ClusterNodes lists the nodes of the cluster, by ID
+func (srv *Server) ClusterNodes() ([]ClusterNode, error) {
+	var c = srv.cluster
+	if c == nil {
+		return nil, errors.New("clustering is disabled")
+	}
+
+	keys, err := c.redis.scan(clusterPrefix + "node:*")
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes []ClusterNode
+	for _, key := range keys {
+		if node, err := c.lookup(strings.TrimPrefix(key, clusterPrefix+"node:")); err == nil && node != nil {
+			nodes = append(nodes, *node)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes, nil
+}
+
+// Route returns the node holding the tunnel serving [endpoint]: an HTTP or TLS name (as http:<name> / tls:<name>),
+// or a TCP port (as tcp:<port>). Load balancers can use it to route public connections to that node.
+func (srv *Server) Route(endpoint string) (ClusterNode, error) {
+	if srv.cluster == nil {
+		return ClusterNode{}, errors.New("clustering is disabled")
+	}
+
+	if node := srv.cluster.owner(endpoint); node != nil {
+		return *node, nil
+	}
+	return ClusterNode{}, errors.Errorf("no node holds %s", endpoint)
+}
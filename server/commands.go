@@ -0,0 +1,189 @@
+package server
+
+import (
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"strings"
+	"time"
+)
+
+// ----------
+// This file contains the commands that clients can run on the server
+// using the session's exec command (eg. ssh host transfer myapp SHA256:...)
+// ----------
+
+// command is a server-side command invoked with the remaining command line [args];
+// output meant for the client is written to [out]
+type command func(ctx ssh.Context, args []string, out io.Writer) error
+
+// commands returns the set of commands available to clients of [srv], keyed by name
+func commands(srv *Server) map[string]command {
+	return map[string]command{
+		"transfer":   transferCommand(srv.store, srv.admins),
+		"rotate-key": rotateKeyCommand(srv.keys, srv.store),
+		"quota":      quotaCommand(srv.quotas),
+		"public":     publicCommand(srv),
+		"private":    privateCommand(srv),
+		"domain":     domainCommand(srv.domains, srv.config.Domain),
+	}
+}
+
+// quotaCommand returns a command which reports the caller's usage and quota
+//
+// Usage: quota
+func quotaCommand(quotas *quotas) command {
+	return func(ctx ssh.Context, args []string, out io.Writer) error {
+		if len(args) != 0 {
+			return errors.New("usage: quota")
+		}
+
+		_, _ = io.WriteString(out, quotas.Describe(Fingerprint(ctx))+"\n")
+		return nil
+	}
+}
+
+// transferCommand returns a command which transfers a reserved name / port to another key.
+// Only the current owner of the reservation, or an admin, can transfer it.
+//
+// Usage: transfer <name|port> <fingerprint>
+func transferCommand(store *reservations, admins map[string]struct{}) command {
+	return func(ctx ssh.Context, args []string, out io.Writer) error {
+		if store == nil {
+			return errors.New("reservations are not enabled on this server")
+		}
+
+		if len(args) != 2 {
+			return errors.New("usage: transfer <name|port> <fingerprint>")
+		}
+
+		var caller = Fingerprint(ctx)
+		if caller == "" {
+			return errors.New("you must authenticate using a public key to transfer reservations")
+		}
+
+		var target, to = args[0], args[1]
+		if !strings.HasPrefix(to, "SHA256:") {
+			return errors.Errorf("invalid fingerprint %q: must be a SHA256 key fingerprint (see ssh-keygen -lf)", to)
+		}
+
+		_, admin := admins[caller]
+		if err := store.Transfer(target, caller, to, admin); err != nil {
+			return err
+		}
+
+		_, _ = io.WriteString(out, fmt.Sprintf("transferred %s to %s\n", target, to))
+		return nil
+	}
+}
+
+// rotateKeyCommand returns a command which replaces the caller's key with a new one. Any names / ports
+// reserved for the caller's key are transferred to the new key as well. The caller's current connection
+// is left untouched, but future connections must use the new key.
+//
+// Usage: rotate-key <public key>
+func rotateKeyCommand(keys *AuthorizedKeysFile, store *reservations) command {
+	return func(ctx ssh.Context, args []string, out io.Writer) error {
+		if keys == nil {
+			return errors.New("key rotation is not enabled on this server")
+		}
+
+		if len(args) == 0 {
+			return errors.New("usage: rotate-key <public key>")
+		}
+
+		var caller = Fingerprint(ctx)
+		if caller == "" {
+			return errors.New("you must authenticate using a public key to rotate it")
+		}
+
+		replacement, comment, _, _, err := gossh.ParseAuthorizedKey([]byte(strings.Join(args, " ")))
+		if err != nil {
+			return errors.Wrap(err, "invalid public key")
+		}
+
+		var fp = gossh.FingerprintSHA256(replacement)
+		if fp == caller {
+			return errors.New("new key must be different from the current one")
+		}
+
+		if store != nil {
+			if err = store.TransferAll(caller, fp); err != nil {
+				return err
+			}
+		}
+
+		if err = keys.Rotate(caller, replacement, comment); err != nil {
+			if store != nil {
+				_ = store.TransferAll(fp, caller) // undo, so reservations don't end up with a key that can't connect
+			}
+			return err
+		}
+
+		_, _ = io.WriteString(out, fmt.Sprintf("replaced %s with %s\n", caller, fp))
+		return nil
+	}
+}
+
+// domainCommand returns a command which manages the custom domains of the caller's key: add generates the TXT
+// challenge proving ownership of a domain, verify checks for it, and remove forgets the domain.
+//
+// Usage: domain add|verify|remove <domain>, or domain list
+func domainCommand(store *customDomains, own string) command {
+	return func(ctx ssh.Context, args []string, out io.Writer) error {
+		if store == nil {
+			return errors.New("custom domains are not enabled on this server")
+		}
+
+		var caller = Fingerprint(ctx)
+		if caller == "" {
+			return errors.New("you must authenticate using a public key to bring your own domains")
+		}
+
+		if len(args) == 1 && args[0] == "list" {
+			var verified, pending = store.Owned(caller)
+			for _, domain := range verified {
+				_, _ = io.WriteString(out, fmt.Sprintf("%s\tverified\n", domain))
+			}
+			for _, domain := range pending {
+				_, _ = io.WriteString(out, fmt.Sprintf("%s\tpending\n", domain))
+			}
+			return nil
+		}
+
+		if len(args) != 2 {
+			return errors.New("usage: domain add|verify|remove <domain>, or domain list")
+		}
+
+		domain, err := parseCustomDomain(args[1], own)
+		if err != nil {
+			return err
+		}
+
+		switch args[0] {
+		case "add":
+			challenge, err := store.Challenge(domain, caller)
+			if err != nil {
+				return err
+			}
+			_, _ = io.WriteString(out, fmt.Sprintf("publish this TXT record, then run: domain verify %s\n\n  %s.%s. TXT %q\n\n"+
+				"and point %s at this server (eg. with a CNAME record); the challenge expires on %s\n",
+				domain, domainChallengeLabel, domain, challenge.Token, domain, challenge.Expires.Format(time.RFC1123)))
+		case "verify":
+			if err = store.Verify(domain, caller); err != nil {
+				return err
+			}
+			_, _ = io.WriteString(out, fmt.Sprintf("verified %s; forward to it with -R %s:80:<local address>\n", domain, domain))
+		case "remove":
+			if err = store.Remove(domain, caller); err != nil {
+				return err
+			}
+			_, _ = io.WriteString(out, fmt.Sprintf("removed %s\n", domain))
+		default:
+			return errors.New("usage: domain add|verify|remove <domain>, or domain list")
+		}
+		return nil
+	}
+}
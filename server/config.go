@@ -0,0 +1,590 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// ----------
+// This file defines the configuration parameters accepted by the shhh server, and how they're loaded from a file
+// ----------
+
+// Config defines the configurable parameters for the shhh server
+type Config struct {
+	// name of the built-in profile the config is based on, if any (see Profile)
+	Profile string `json:"profile,omitempty"`
+
+	// name of the deployment, available to the MOTD template as {{.ServerName}}
+	ServerName string `json:"server_name,omitempty"`
+
+	// software version advertised to ssh clients, after "SSH-2.0-" (eg. "OpenSSH_9.6"), or "random" to advertise
+	// that of a common ssh server, picked at random for each connection. If empty, "Go" is advertised.
+	ServerVersion string `json:"server_version,omitempty"`
+
+	// path to a text file sent to clients before they authenticate (empty to send no banner)
+	BannerFile string `json:"banner,omitempty"`
+
+	// path to a template (see text/template) of the message of the day, shown to clients when their session opens;
+	// it's rendered with {{.ServerName}}, {{.Fingerprint}}, {{.Endpoints}} (the client's tunnels) and {{.Quota}}
+	MOTDFile string `json:"motd,omitempty"`
+
+	// address to listen for incoming ssh connections on
+	Addr string `json:"addr,omitempty"`
+
+	// additional ssh listeners, each with a policy of its own (see ListenerConfig)
+	Listeners []ListenerConfig `json:"listeners,omitempty"`
+
+	// address (or network interface, eg. eth0) on which public listeners for forwarded ports are bound
+	BindAddr string `json:"bind_addr,omitempty"`
+
+	// whether the bind address clients ask for is honoured, as with OpenSSH's GatewayPorts: yes (the default) binds
+	// public listeners on BindAddr whatever clients ask for, no binds them on loopback only, and clientspecified
+	// binds them where clients ask ("" or "*" for BindAddr, "localhost" for loopback only)
+	GatewayPorts string `json:"gateway_ports,omitempty"`
+
+	// addresses on which public listeners of specific keys (by fingerprint) are always bound, in place of BindAddr
+	// (eg. 127.0.0.1 for untrusted keys, whose tunnels are then only reachable through a local reverse proxy)
+	BindAddrs map[string]string `json:"bind_addrs,omitempty"`
+
+	// IP versions public listeners on wildcard addresses are bound on: dual (IPv4 and IPv6, the default), 4 or 6
+	IPVersion string `json:"ip_version,omitempty"`
+
+	// if set, public listeners for forwarded ports accept TCP Fast Open connections (where supported), saving
+	// visitors a round trip when connecting
+	TCPFastOpen bool `json:"tcp_fast_open,omitempty"`
+
+	// interval of TCP keep-alive probes on visitors' connections to TCP and TLS tunnels, so that idle ones survive NAT
+	// timeouts (0 for the system default of 15 seconds, negative to disable keep-alives)
+	TCPKeepAlive time.Duration `json:"tcp_keepalive,omitempty"`
+
+	// if set, Nagle's algorithm is disabled (TCP_NODELAY) on visitors' connections to TCP and TLS tunnels, so that
+	// small writes of latency-sensitive traffic aren't delayed
+	TCPNoDelay bool `json:"tcp_nodelay,omitempty"`
+
+	// if set, the ssh listener expects a PROXY protocol header on every incoming connection
+	SSHProxyProtocol bool `json:"ssh_proxy_protocol,omitempty"`
+
+	// if set, public listeners for forwarded ports expect a PROXY protocol header on every incoming connection
+	TunnelProxyProtocol bool `json:"tunnel_proxy_protocol,omitempty"`
+
+	// path to authorized_keys file listing keys allowed to connect (empty to allow anyone)
+	AuthorizedKeys string `json:"authorized_keys,omitempty"`
+
+	// if set, connections of keys removed from AuthorizedKeys (which is reloaded when it changes) are closed
+	TerminateRemovedKeys bool `json:"terminate_removed_keys,omitempty"`
+
+	// GitHub / GitLab users (eg. github:octocat or gitlab:someone) allowed to connect using the keys they publish
+	ForgeUsers []string `json:"forge_users,omitempty"`
+
+	// how often keys of ForgeUsers are refreshed
+	ForgeRefresh time.Duration `json:"forge_refresh,omitempty"`
+
+	// path to file listing (in authorized_keys format) keys of CAs whose user certificates are allowed to connect
+	CertificateAuthorities string `json:"certificate_authorities,omitempty"`
+
+	// what certificates' principals may bind (empty to allow everything); see PrincipalPermissions
+	PrincipalPermissions []PrincipalPermissions `json:"principal_permissions,omitempty"`
+
+	// address of a HashiCorp Vault (eg. https://vault.example.com:8200) whose SSH CA, mounted at VaultSSHMount, signs
+	// user certificates allowed to connect. Certificates must have all of VaultExtensions, and may only bind what
+	// their shhh-addrs / shhh-ports extensions allow.
+	VaultAddr       string   `json:"vault_addr,omitempty"`
+	VaultSSHMount   string   `json:"vault_ssh_mount,omitempty"`
+	VaultExtensions []string `json:"vault_extensions,omitempty"`
+
+	// how often the key of Vault's SSH CA is refreshed
+	VaultRefresh time.Duration `json:"vault_refresh,omitempty"`
+
+	// path to a file of users allowed to authenticate with a password (and a TOTP verification code, for those with
+	// a secret), as lines of user:bcrypt-hash[:totp-secret]. Such clients are identified as "user:<name>".
+	PasswordFile string `json:"password_file,omitempty"`
+
+	// url of an LDAP directory (ldap:// or ldaps://) whose users are allowed to connect with the keys listed in their
+	// entry (see LDAPKeyAttribute), or their directory password if LDAPPasswords is set
+	LDAPURL string `json:"ldap_url,omitempty"`
+
+	// DN and password of the account searching the directory for users; searches are anonymous if empty
+	LDAPBindDN       string `json:"ldap_bind_dn,omitempty"`
+	LDAPBindPassword string `json:"ldap_bind_password,omitempty"`
+
+	// where in the directory users are searched for, and the filter matching a user; %s is replaced with the username
+	// (eg. "(sAMAccountName=%s)" for Active Directory)
+	LDAPBaseDN     string `json:"ldap_base_dn,omitempty"`
+	LDAPUserFilter string `json:"ldap_user_filter,omitempty"`
+
+	// attributes of a user's entry listing their public keys, and the DNs of the groups they're a member of
+	LDAPKeyAttribute   string `json:"ldap_key_attribute,omitempty"`
+	LDAPGroupAttribute string `json:"ldap_group_attribute,omitempty"`
+
+	// if set, users may authenticate with their directory password too. Such clients are identified as "user:<name>".
+	LDAPPasswords bool `json:"ldap_passwords,omitempty"`
+
+	// what members of the directory's groups may bind (empty to allow everything); see LDAPGroupPermissions
+	LDAPGroups []LDAPGroupPermissions `json:"ldap_groups,omitempty"`
+
+	// how long what the directory has on a user is cached for
+	LDAPCacheTTL time.Duration `json:"ldap_cache_ttl,omitempty"`
+
+	// if set, the server refuses to start unless clients are authenticated (eg. using AuthorizedKeys)
+	RequireAuthentication bool `json:"require_authentication,omitempty"`
+
+	// how long the name / port of a tunnel is held for its key after the client goes away, so that it regains
+	// the same endpoint when it reconnects (0 to release endpoints right away)
+	ReconnectGrace time.Duration `json:"reconnect_grace,omitempty"`
+
+	// longest tunnels may stay open for, whatever their clients ask for with --ttl (0 for unlimited); see ttl.go
+	MaxTunnelTTL time.Duration `json:"max_tunnel_ttl,omitempty"`
+
+	// maximum number of ssh handshakes per minute from a single IP (0 for unlimited)
+	SSHRateLimit int `json:"ssh_rate_limit,omitempty"`
+
+	// number of connections failing to authenticate after which an IP is banned for BanDuration (0 to never ban); a
+	// successful login clears the count
+	MaxAuthFailures int `json:"max_auth_failures,omitempty"`
+
+	// how long IPs are banned for
+	BanDuration time.Duration `json:"ban_duration,omitempty"`
+
+	// CIDRs of clients which are never rate limited or banned
+	SSHGuardExempt []string `json:"ssh_guard_exempt,omitempty"`
+
+	// limit on ssh connections which haven't authenticated yet, as start:rate:full (see OpenSSH's MaxStartups):
+	// past start of them, new connections are dropped with a probability of rate%, growing linearly to 100% at full.
+	// A single number is both start and full. If empty, there's no limit.
+	MaxStartups string `json:"max_startups,omitempty"`
+
+	// if set, ssh clients from IPs with TarpitThreshold authentication failures (and from which no known key has
+	// authenticated) get the server's version, and the answer to each attempt to authenticate, only after TarpitDelay.
+	// Their attempts, including passwords (which they may try, and never succeed with), are logged to TarpitLog (or
+	// the server's log, if empty). IPs in SSHGuardExempt are never tarpitted.
+	Tarpit          bool          `json:"tarpit,omitempty"`
+	TarpitThreshold int           `json:"tarpit_threshold,omitempty"`
+	TarpitDelay     time.Duration `json:"tarpit_delay,omitempty"`
+	TarpitLog       string        `json:"tarpit_log,omitempty"`
+
+	// if set, authentication failures and policy denials are logged in a stable format (eg. for fail2ban)
+	AuthLog bool `json:"auth_log,omitempty"`
+
+	// path to a file the auth log is appended to, instead of the server's log (implies AuthLog)
+	AuthLogFile string `json:"auth_log_file,omitempty"`
+
+	// path to a file the audit log (see AuditEvent) is appended to, as JSON lines (empty to disable)
+	AuditLog string `json:"audit_log,omitempty"`
+
+	// size (in MB) past which the audit log is rotated (0 to never rotate it)
+	AuditLogMaxSize int `json:"audit_log_max_size,omitempty"`
+
+	// number of rotated audit logs kept (5 by default)
+	AuditLogBackups int `json:"audit_log_backups,omitempty"`
+
+	// syslog daemon the audit log is shipped to: "local", or a udp://, tcp:// or unix:// URL (empty to disable)
+	AuditSyslog string `json:"audit_syslog,omitempty"`
+
+	// directory each session's message stream (including its tunnels opening and closing) is recorded to, in a
+	// file of its own (empty to disable)
+	RecordingsDir string `json:"recordings_dir,omitempty"`
+
+	// format of the recordings: log (plain text, the default) or asciicast (to replay them with asciinema)
+	RecordingFormat string `json:"recording_format,omitempty"`
+
+	// how long recordings are kept (0 to keep them)
+	RecordingRetention time.Duration `json:"recording_retention,omitempty"`
+
+	// total size (in MB) past which the oldest recordings are removed (0 for no limit)
+	RecordingsMaxSize int `json:"recordings_max_size,omitempty"`
+
+	// directory the admin API may have the traffic of tunnels mirrored to, as pcap files (empty to disable); see
+	// Server.Mirror
+	MirrorDir string `json:"mirror_dir,omitempty"`
+
+	// TCP endpoints (as tcp://host:port) the admin API may have the traffic of tunnels mirrored to, as pcap streams
+	MirrorEndpoints []string `json:"mirror_endpoints,omitempty"`
+
+	// URL of the Redis server (redis://[user:password@]host:port[/db], or rediss://) nodes behind a load balancer
+	// share tunnel endpoints, reservations and quota usage through (empty to run as a single node); see cluster.go
+	ClusterRedis string `json:"cluster_redis,omitempty"`
+
+	// ID of this node in the cluster (the hostname if unset)
+	ClusterNode string `json:"cluster_node,omitempty"`
+
+	// address (eg. host:port of the HTTP edge) other nodes and load balancers reach this node at
+	ClusterAddr string `json:"cluster_addr,omitempty"`
+
+	// address to accept connections relayed by other nodes on (empty to disable relaying); public connections for
+	// tunnels held by another node are relayed to it, so that any node can accept traffic for any tunnel. A wildcard
+	// address is advertised with the host of ClusterAddr.
+	ClusterRelayAddr string `json:"cluster_relay_addr,omitempty"`
+
+	// certificate and key nodes authenticate each other with on relayed connections, both as servers and clients
+	ClusterRelayCert string `json:"cluster_relay_cert,omitempty"`
+	ClusterRelayKey  string `json:"cluster_relay_key,omitempty"`
+
+	// CA the certificates of nodes are verified against
+	ClusterRelayCA string `json:"cluster_relay_ca,omitempty"`
+
+	// service registry each active tunnel is registered in, as an instance of a service named after it (empty to
+	// disable): consul://[token@]host:8500 for a Consul agent, or etcd://host:2379 for etcd's v3 JSON gateway
+	// (consul+https:// and etcd+https:// over HTTPS)
+	ServiceRegistry string `json:"service_registry,omitempty"`
+
+	// prefix of the keys tunnels are registered under in etcd (/shhh/services/ if unset)
+	ServiceRegistryPrefix string `json:"service_registry_prefix,omitempty"`
+
+	// tags added to every tunnel registered in the service registry
+	ServiceTags []string `json:"service_tags,omitempty"`
+
+	// Kubernetes namespaces the tunnels of clients which ask for it (with --kubernetes) may be exposed in, as Services
+	// reaching the server (empty to disable); see kubernetes.go
+	KubernetesNamespaces []string `json:"kubernetes_namespaces,omitempty"`
+
+	// URL of the Kubernetes API (the cluster the server runs in if unset)
+	KubernetesAPI string `json:"kubernetes_api,omitempty"`
+
+	// IP pods reach the server at, which EndpointSlices of TCP / UDP tunnels point to (the POD_IP environment
+	// variable if unset)
+	KubernetesAddress string `json:"kubernetes_address,omitempty"`
+
+	// files with the bearer token for the Kubernetes API, and the CA its certificate is verified against (the
+	// pod's service account's if unset)
+	KubernetesTokenFile string `json:"kubernetes_token_file,omitempty"`
+	KubernetesCA        string `json:"kubernetes_ca,omitempty"`
+
+	// base URL of an OTLP/HTTP collector (eg. http://localhost:4318) tunnels are traced to (empty to disable tracing)
+	OTLPEndpoint string `json:"otlp_endpoint,omitempty"`
+
+	// fraction of tunnels traced, between 0 and 1 (1 if unset)
+	TraceSampleRatio float64 `json:"trace_sample_ratio,omitempty"`
+
+	// sink the usage of each key is exported to, for chargeback (empty to disable): a file (of JSON lines), an
+	// http(s):// endpoint, or kafka://broker:port/topic[?partition=n]; see usage_export.go
+	UsageExport string `json:"usage_export,omitempty"`
+
+	// how often usage is exported (an hour if unset)
+	UsageInterval time.Duration `json:"usage_interval,omitempty"`
+
+	// path to JSON file tracking names and ports reserved for keys (empty to disable reservations)
+	ReservationsFile string `json:"reservations,omitempty"`
+
+	// path to JSON file tracking custom domains clients proved they own (with a TXT challenge) for their HTTP tunnels
+	// (empty to disable custom domains); see domains.go
+	DomainsFile string `json:"domains_file,omitempty"`
+
+	// path to JSON file with rules granting keys the right to use the server and bind addresses / ports (see AuthorizationRule)
+	AuthorizationRules string `json:"authorization_rules,omitempty"`
+
+	// path to a script (in a subset of Starlark) defining hooks consulted on authentication, forwarding requests and
+	// visitors' connections, which may deny them, rewrite bind addresses or tag clients; reloaded when it changes.
+	// See hooks.go.
+	Hooks string `json:"hooks,omitempty"`
+
+	// paths to Go plugins providing Middleware applied to the traffic of tunnels (see middleware.go)
+	MiddlewarePlugins []string `json:"middleware_plugins,omitempty"`
+
+	// URL of a webhook consulted to authorize every forwarding request (see WebhookAuthorizer)
+	AuthorizationWebhook string `json:"authorization_webhook,omitempty"`
+
+	// webhooks notified of tunnel lifecycle events
+	Webhooks []WebhookConfig `json:"webhooks,omitempty"`
+
+	// notifiers (Slack, Discord, email or webhooks) of tunnel lifecycle and security events; see event_bus.go
+	EventNotifiers []EventNotifierConfig `json:"event_notifiers,omitempty"`
+
+	// limits on what each key can use of the server (zero values for unlimited)
+	Quota Quota `json:"quota,omitempty"`
+
+	// quotas for specific keys (by fingerprint), in place of Quota
+	Quotas map[string]Quota `json:"quotas,omitempty"`
+
+	// path to JSON file the bytes each key transferred today and this month are persisted to, so that transfer caps
+	// hold across restarts (empty to keep them in memory only); see quota.go
+	UsageFile string `json:"usage_file,omitempty"`
+
+	// permission profiles (see PermissionProfile) of users, by fingerprint ("*" for keys not listed); the profiles
+	// are declared in PermissionProfiles, by name
+	Users              map[string]string            `json:"users,omitempty"`
+	PermissionProfiles map[string]PermissionProfile `json:"permission_profiles,omitempty"`
+
+	// tags (key => value) attached to the tunnels of keys, by fingerprint ("*" for all keys); see tags.go
+	Tags map[string]map[string]string `json:"tags,omitempty"`
+
+	// fingerprints of keys with administrative privileges (eg. to transfer any reservation)
+	AdminKeys []string `json:"admin_keys,omitempty"`
+
+	// maximum time to wait for in-flight connections to finish when shutting down
+	DrainTimeout time.Duration `json:"drain_timeout,omitempty"`
+
+	// if non-zero, connections that don't request any port forwarding within this duration are terminated
+	ForwardTimeout time.Duration `json:"forward_timeout,omitempty"`
+
+	// opening a channel with the client for a new connection fails if it doesn't respond within this duration (eg. as
+	// it's wedged), rather than holding up the visitor (0 to wait indefinitely)
+	ChannelOpenTimeout time.Duration `json:"channel_open_timeout,omitempty"`
+
+	// maximum number of channels a tunnel may be opening with its client at once (see the --max-pending session
+	// option), so that a flood of visitors doesn't pile up; further connections wait up to PendingOpenWait for one of
+	// them to complete, and are rejected otherwise (0 for unlimited)
+	MaxPendingOpens int           `json:"max_pending_opens,omitempty"`
+	PendingOpenWait time.Duration `json:"pending_open_wait,omitempty"`
+
+	// connections to TCP / TLS tunnels are closed if they can't be set up (ie. admitted, their channel opened and
+	// headers written) within this duration (0 to wait indefinitely)
+	ConnectionSetupTimeout time.Duration `json:"connection_setup_timeout,omitempty"`
+
+	// connections to TCP / TLS tunnels are closed (and their clients told) if no bytes move from the visitor to the
+	// client within StallTimeoutIn, or back within StallTimeoutOut, so that dead ones don't pin listener slots and
+	// goroutines (0 to never close them)
+	StallTimeoutIn  time.Duration `json:"stall_timeout_in,omitempty"`
+	StallTimeoutOut time.Duration `json:"stall_timeout_out,omitempty"`
+
+	// connections without any activity for this duration are terminated (0 to never terminate idle connections)
+	IdleTimeout time.Duration `json:"idle_timeout,omitempty"`
+
+	// tunnels which haven't had any connections (nor traffic through those they had) for this duration are closed,
+	// however active their client's ssh connection is (0 to never close idle tunnels)
+	TunnelIdleTimeout time.Duration `json:"tunnel_idle_timeout,omitempty"`
+
+	// preset of ciphers, MACs and key exchanges ssh clients may negotiate (see AlgorithmPresets): modern, compat or
+	// fips-ish. If empty, golang.org/x/crypto/ssh's defaults are used.
+	Algorithms string `json:"algorithms,omitempty"`
+
+	// if set, ssh clients may only negotiate these ciphers, MACs and key exchanges (in order of preference), in place
+	// of those of the Algorithms preset
+	Ciphers      []string `json:"ciphers,omitempty"`
+	MACs         []string `json:"macs,omitempty"`
+	KeyExchanges []string `json:"key_exchanges,omitempty"`
+
+	// if non-empty, only visitors from these CIDRs may connect to tunnels' public listeners
+	AllowedSources []string `json:"allowed_sources,omitempty"`
+
+	// visitors from these CIDRs may not connect to tunnels' public listeners
+	DeniedSources []string `json:"denied_sources,omitempty"`
+
+	// path to a MaxMind DB (eg. GeoLite2-Country.mmdb) used to look up the country of visitors
+	GeoIPDatabase string `json:"geoip_database,omitempty"`
+
+	// if non-empty, only visitors from these countries (ISO codes; requires GeoIPDatabase) may connect to tunnels
+	AllowedCountries []string `json:"allowed_countries,omitempty"`
+
+	// visitors from these countries (ISO codes; requires GeoIPDatabase) may not connect to tunnels
+	DeniedCountries []string `json:"denied_countries,omitempty"`
+
+	// text (eg. a legal notice) sent to visitors of TCP tunnels whose clients enable it with --banner, before
+	// their traffic is forwarded (empty to disable)
+	TunnelBanner string `json:"tunnel_banner,omitempty"`
+
+	// blocklists (eg. Spamhaus DROP) whose addresses may not connect to tunnels' public listeners
+	ReputationFeeds []ReputationFeed `json:"reputation_feeds,omitempty"`
+
+	// how often ReputationFeeds are refreshed
+	ReputationRefresh time.Duration `json:"reputation_refresh,omitempty"`
+
+	// if set, every forwarded connection is logged once it ends, along with why it ended
+	AccessLog bool `json:"access_log,omitempty"`
+
+	// how often clients are sent statistics of their tunnels, and metrics are updated (0 to only do so when tunnels close)
+	StatsInterval time.Duration `json:"stats_interval,omitempty"`
+
+	// address to serve metrics (in the Prometheus text format) on, at /metrics (empty to disable)
+	MetricsAddr string `json:"metrics_addr,omitempty"`
+
+	// address to serve pprof profiles and expvar counters on (empty to disable); see Server.DebugHandler
+	DebugAddr string `json:"debug_addr,omitempty"`
+
+	// address to serve the admin API on (empty to disable); see Server.AdminHandler
+	AdminAddr string `json:"admin_addr,omitempty"`
+
+	// bearer token required by the admin API
+	AdminToken string `json:"admin_token,omitempty"`
+
+	// if set, clients may authenticate with short-lived API tokens issued through the admin API (see
+	// Server.IssueToken), given as their ssh username. Such clients are identified as "token:<id>".
+	APITokens bool `json:"api_tokens,omitempty"`
+
+	// longest an API token may be valid for
+	MaxAPITokenTTL time.Duration `json:"max_api_token_ttl,omitempty"`
+
+	// if non-zero, the round-trip time to clients and the throughput of each connection through their tunnels are
+	// measured every interval, and clients are notified when a connection is limited by the (fixed) ssh channel window
+	FlowControlInterval time.Duration `json:"flow_control_interval,omitempty"`
+
+	// range of ports (eg. "20000-29999") from which clients requesting a random port are assigned one derived from
+	// their key's fingerprint, so they get the same port every time (empty to assign random ports)
+	StablePorts string `json:"stable_ports,omitempty"`
+
+	// address to listen for incoming HTTP requests on (empty to disable HTTP tunnels)
+	HTTPAddr string `json:"http_addr,omitempty"`
+
+	// domain under which HTTP tunnels are exposed as sub-domains (eg. <name>.<domain>)
+	Domain string `json:"domain,omitempty"`
+
+	// if set, the HTTP listener expects a PROXY protocol header on every incoming connection
+	HTTPProxyProtocol bool `json:"http_proxy_protocol,omitempty"`
+
+	// address to listen for incoming TLS connections on, which are forwarded (without being terminated) to tunnels
+	// based on their server name (eg. <name>.<domain>); empty to disable TLS tunnels
+	TLSAddr string `json:"tls_addr,omitempty"`
+
+	// if set, the TLS listener expects a PROXY protocol header on every incoming connection
+	TLSProxyProtocol bool `json:"tls_proxy_protocol,omitempty"`
+
+	// address to accept ssh connections wrapped in TLS or WebSocket on (eg. :443, for clients behind restrictive
+	// proxies); empty to disable
+	SSHTLSAddr string `json:"ssh_tls_addr,omitempty"`
+
+	// certificate and key terminating TLS for wrapped ssh connections; without them, connections aren't expected to
+	// be TLS (eg. behind a reverse proxy which terminates it)
+	SSHTLSCert string `json:"ssh_tls_cert,omitempty"`
+	SSHTLSKey  string `json:"ssh_tls_key,omitempty"`
+
+	// server name for which the TLS edge passes connections on as wrapped ssh connections, so that both can share
+	// port 443 (eg. ssh.example.com); needs the certificate
+	SSHTLSHost string `json:"ssh_tls_host,omitempty"`
+
+	// directory with templates (html/template) replacing the edge's built-in error pages: not-found.html, offline.html
+	// (the tunnel's client is disconnected), unavailable.html (its local service isn't responding) and on-hold.html
+	// (it's quarantined). Templates are executed with the page's .Status, .Title, .Message and .Host.
+	ErrorPages string `json:"error_pages,omitempty"`
+
+	// format of the edge's error pages: html, json, or auto (JSON for clients which accept it but not HTML)
+	ErrorFormat string `json:"error_format,omitempty"`
+
+	// OpenID Connect provider (its issuer URL, and the client registered with it) visitors of HTTP tunnels log in with,
+	// when the tunnels' clients ask for it with --login. The provider must allow redirects to
+	// <scheme>://<name>.<domain>/.shhh/oidc/callback (eg. using a wildcard).
+	OIDCIssuer       string `json:"oidc_issuer,omitempty"`
+	OIDCClientID     string `json:"oidc_client_id,omitempty"`
+	OIDCClientSecret string `json:"oidc_client_secret,omitempty"`
+
+	// if set, the HTTP listener also accepts cleartext HTTP/2 (h2c, with prior knowledge), eg. from gRPC-web
+	// proxies or CDNs which talk HTTP/2 to their origin; requests are forwarded to tunnels as HTTP/1.1
+	HTTP2 bool `json:"http2,omitempty"`
+
+	// maximum number of channels an HTTP tunnel can keep open ahead of time (see the --pool session option)
+	MaxChannelPool int `json:"max_channel_pool,omitempty"`
+
+	// number of recent requests (and their responses) each HTTP tunnel keeps for inspection and replay through the
+	// admin API (0 to not capture requests)
+	InspectRequests int `json:"inspect_requests,omitempty"`
+
+	// maximum bytes of each request / response body kept by the inspector
+	InspectBodyLimit int `json:"inspect_body_limit,omitempty"`
+
+	// CIDRs of proxies / CDNs (eg. Cloudflare) in front of the HTTP listener, whose CF-Connecting-IP / X-Forwarded-For
+	// headers are trusted to carry the visitor's address. These headers are removed from requests by anyone else.
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+
+	// path to JSON file ({"adjectives": [...], "nouns": [...]}) with words used to generate names (eg. brave-otter-123)
+	// for HTTP tunnels that didn't request one (empty to use the built-in words)
+	TunnelWords string `json:"tunnel_words,omitempty"`
+
+	// hostname patterns (see path.Match) which can't be registered by tunnels
+	DeniedHosts []string `json:"denied_hosts,omitempty"`
+
+	// URL of a local service which receives requests for denied or unknown hostnames (empty to respond with 404)
+	HoneypotAddr string `json:"honeypot,omitempty"`
+
+	// if set, every tunnel is additionally exposed on a server-local unix socket (named <port>.sock) in this directory
+	UnixSocketDir string `json:"unix_socket_dir,omitempty"`
+}
+
+// DefaultConfig returns a new Config populated with defaults
+func DefaultConfig() *Config {
+	return &Config{
+		Addr:                   ":2222",
+		BindAddr:               "0.0.0.0",
+		TCPNoDelay:             true,
+		DrainTimeout:           30 * time.Second,
+		IdleTimeout:            1 * time.Minute,
+		ChannelOpenTimeout:     10 * time.Second,
+		ConnectionSetupTimeout: 30 * time.Second,
+		MaxPendingOpens:        64,
+		PendingOpenWait:        5 * time.Second,
+		ForgeRefresh:           15 * time.Minute,
+		VaultSSHMount:          "ssh-client-signer",
+		VaultExtensions:        []string{"permit-port-forwarding"},
+		VaultRefresh:           1 * time.Hour,
+		LDAPUserFilter:         "(uid=%s)",
+		MaxAPITokenTTL:         1 * time.Hour,
+		LDAPKeyAttribute:       "sshPublicKey",
+		LDAPGroupAttribute:     "memberOf",
+		LDAPCacheTTL:           5 * time.Minute,
+		ReputationRefresh:      1 * time.Hour,
+		StatsInterval:          1 * time.Minute,
+		BanDuration:            10 * time.Minute,
+		TarpitThreshold:        3,
+		TarpitDelay:            10 * time.Second,
+		MaxChannelPool:         8,
+		InspectBodyLimit:       64 << 10,
+		Domain:                 "localhost",
+	}
+}
+
+// LoadConfig reads the JSON config file at [path]. Keys are named after the fields' json tags, and durations
+// are written as strings (eg. "30s"). If the file names a profile, the profile's settings are used as defaults
+// (otherwise DefaultConfig is); any other key in the file overrides the respective default.
+func LoadConfig(path string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read config")
+	}
+
+	var doc map[string]json.RawMessage
+	if err = json.Unmarshal(content, &doc); err != nil {
+		return nil, errors.Wrap(err, "failed to parse config")
+	}
+
+	var config = DefaultConfig()
+	if raw, ok := doc["profile"]; ok {
+		var name string
+		if err = json.Unmarshal(raw, &name); err != nil {
+			return nil, errors.Wrap(err, "failed to parse config: invalid profile")
+		}
+
+		if config, err = Profile(name); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = durationsAsNanoseconds(doc); err != nil {
+		return nil, errors.Wrap(err, "failed to parse config")
+	}
+
+	content, _ = json.Marshal(doc)
+	var decoder = json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(config); err != nil {
+		return nil, errors.Wrap(err, "failed to parse config")
+	}
+
+	return config, nil
+}
+
+// durationsAsNanoseconds rewrites the string values (eg. "30s") of time.Duration fields of Config in [doc]
+// into the number of nanoseconds, which is how encoding/json expects them
+func durationsAsNanoseconds(doc map[string]json.RawMessage) error {
+	var t = reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		var field = t.Field(i)
+		if field.Type != reflect.TypeOf(time.Duration(0)) {
+			continue
+		}
+
+		var key = strings.Split(field.Tag.Get("json"), ",")[0]
+		var s string
+		if raw, ok := doc[key]; !ok || json.Unmarshal(raw, &s) != nil {
+			continue // missing, or already a number
+		}
+
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return errors.Wrapf(err, "invalid %s", key)
+		}
+		doc[key], _ = json.Marshal(d)
+	}
+	return nil
+}
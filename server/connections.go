@@ -0,0 +1,222 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ----------
+// This file contains helpers to keep track of the connections forwarded through tunnels, and why each of them ended
+// ----------
+
+// reasons why a forwarded connection ended
+const (
+	closeClientEOF  = "client_eof"  // the client's local service closed the connection
+	closeVisitorEOF = "visitor_eof" // the visitor closed the connection
+	closeTimeout    = "timeout"     // reading from / writing to either side timed out
+	closeStalled    = "stalled"     // no bytes moved in a direction for longer than allowed
+	closeAdmin      = "admin_close" // the server closed the connection (eg. it didn't drain in time on shutdown)
+	closeError      = "error"       // any other failure
+)
+
+// closeReasonText describes each reason in notifications to clients
+var closeReasonText = map[string]string{
+	closeClientEOF:  "closed by the local service",
+	closeVisitorEOF: "closed by the visitor",
+	closeTimeout:    "timed out",
+	closeStalled:    "closed as stalled",
+	closeAdmin:      "closed by the server",
+	closeError:      "failed",
+}
+
+// forwardedConn is a connection forwarded through a tunnel, to the client over an ssh channel
+type forwardedConn struct {
+	visitor net.Conn
+	channel interface{ Close() error }
+	started time.Time
+	country string // of the visitor, if known
+
+	// set if the server closed the connection
+	closedByServer int32
+}
+
+// close closes the connection on behalf of the server. Only the visitor's side is closed here,
+// as the channel is closed along with the client's ssh connection.
+func (fc *forwardedConn) close() {
+	atomic.StoreInt32(&fc.closedByServer, 1)
+	_ = fc.visitor.Close()
+}
+
+// forwardedConns tracks the connections being forwarded by the server, and reports them once they end
+type forwardedConns struct {
+	// goroutines copying traffic, and channels being opened with clients, for all tunnels (see DebugVars); first, to
+	// be 64-bit aligned for atomic operations
+	copies, opening int64
+
+	mu    sync.Mutex
+	conns map[*forwardedConn]struct{}
+	empty *sync.Cond // signalled when the last connection is done
+
+	metrics   *metrics
+	accessLog bool
+
+	// visitors the operator allows to connect to any tunnel, by source network and country (if enabled)
+	sources    sourceFilter
+	geoip      *geoIPPolicy
+	reputation *reputationFeeds
+
+	// operator's hooks, which may deny visitors too (nil if there are none)
+	hooks *scriptHooks
+
+	// applied to each connection once it's admitted
+	middleware middlewareChain
+
+	// sent to visitors of TCP tunnels whose clients enabled it (nil if the operator hasn't configured one)
+	banner []byte
+
+	// connections which aren't set up within this duration are closed (0 to wait indefinitely)
+	setupTimeout time.Duration
+
+	// connections through which no bytes move from / to the visitor within these durations are closed (0 to never
+	// close them)
+	stallIn, stallOut time.Duration
+}
+
+// newForwardedConns returns a new, empty forwardedConns. If [accessLog] is set, each connection is logged once it ends.
+// Only visitors permitted by [sources] and [geoip], and not listed in [reputation] feeds, are admitted; [banner] is
+// what's sent to visitors of tunnels with the banner enabled. Connections not set up within [setupTimeout] are closed,
+// as are those through which no bytes move from / to the visitor within [stallIn] / [stallOut].
+func newForwardedConns(metrics *metrics, accessLog bool, sources sourceFilter, geoip *geoIPPolicy, reputation *reputationFeeds, banner []byte,
+	setupTimeout, stallIn, stallOut time.Duration) *forwardedConns {
+	var fcs = &forwardedConns{
+		conns:      make(map[*forwardedConn]struct{}),
+		metrics:    metrics,
+		accessLog:  accessLog,
+		sources:    sources,
+		geoip:      geoip,
+		reputation: reputation,
+		banner:     banner,
+
+		setupTimeout: setupTimeout,
+		stallIn:      stallIn,
+		stallOut:     stallOut,
+	}
+	fcs.empty = sync.NewCond(&fcs.mu)
+	return fcs
+}
+
+// admit returns true if the visitor connecting from [addr] to the tunnel listening on [local] is allowed by the
+// operator (and its hooks) and the client's [options] (if any; they're ignored while the client's tunnels are public),
+// along with the visitor's country (if known). Denied connections are counted in metrics.
+func (fcs *forwardedConns) admit(addr, local net.Addr, options *sessionOptions) (country string, ok bool) {
+	if !fcs.sources.permits(addr) || (options != nil && !options.Public() && !options.Sources().permits(addr)) {
+		fcs.metrics.connectionDenied("source")
+		return "", false
+	}
+
+	if country = fcs.geoip.Country(addr); !fcs.geoip.permits(country) {
+		fcs.metrics.connectionDenied("country")
+		return country, false
+	}
+
+	if feed := fcs.reputation.listedIn(addr); feed != "" {
+		fcs.metrics.connectionDenied("reputation")
+		fcs.metrics.reputationBlocked(feed)
+		return country, false
+	}
+
+	if !fcs.hooks.connection(addr, local, country, options) {
+		fcs.metrics.connectionDenied("hook")
+		return country, false
+	}
+	return country, true
+}
+
+// add starts tracking the connection between [visitor] (from [country], if known) and [channel]
+func (fcs *forwardedConns) add(visitor net.Conn, country string, channel interface{ Close() error }) *forwardedConn {
+	var fc = &forwardedConn{visitor: visitor, channel: channel, started: time.Now(), country: country}
+	fcs.mu.Lock()
+	defer fcs.mu.Unlock()
+	fcs.conns[fc] = struct{}{}
+	return fc
+}
+
+// done stops tracking [fc], which ended with [reason] after transferring [in] bytes from the visitor to the client
+// and [out] bytes back. The reason is overridden if the server closed the connection. It returns the final reason.
+func (fcs *forwardedConns) done(fc *forwardedConn, reason string, in, out int64) string {
+	if atomic.LoadInt32(&fc.closedByServer) == 1 {
+		reason = closeAdmin
+	}
+
+	fcs.metrics.connectionClosed(reason)
+	if fcs.accessLog {
+		log.Printf("connection from %s to %s ended after %s (%s): %d bytes in, %d bytes out", describeVisitor(fc.visitor.RemoteAddr(), fc.country),
+			fc.visitor.LocalAddr(), time.Since(fc.started).Round(time.Millisecond), reason, in, out)
+	}
+
+	fcs.mu.Lock()
+	defer fcs.mu.Unlock()
+	if delete(fcs.conns, fc); len(fcs.conns) == 0 {
+		fcs.empty.Broadcast()
+	}
+	return reason
+}
+
+// count returns the number of tracked connections
+func (fcs *forwardedConns) count() int {
+	fcs.mu.Lock()
+	defer fcs.mu.Unlock()
+	return len(fcs.conns)
+}
+
+// closeAll closes every tracked connection on behalf of the server
+func (fcs *forwardedConns) closeAll() {
+	fcs.mu.Lock()
+	defer fcs.mu.Unlock()
+	for fc := range fcs.conns {
+		fc.close()
+	}
+}
+
+// wait blocks until every tracked connection is done (see closeAll)
+func (fcs *forwardedConns) wait() {
+	fcs.mu.Lock()
+	defer fcs.mu.Unlock()
+	for len(fcs.conns) > 0 {
+		fcs.empty.Wait()
+	}
+}
+
+// closeReason returns why a connection ended, given the error returned by whichever direction finished copying
+// first. [fromVisitor] tells whether that direction was reading from the visitor (or the client otherwise).
+func closeReason(fromVisitor bool, err error) string {
+	if err == nil {
+		if fromVisitor {
+			return closeVisitorEOF
+		}
+		return closeClientEOF
+	}
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return closeTimeout
+	}
+	return closeError
+}
+
+// describeClose describes a connection that ended with [reason], for notifications to clients
+func describeClose(reason string, in, out int64, duration time.Duration) string {
+	return fmt.Sprintf("%s after %s (%s in, %s out)", closeReasonText[reason],
+		duration.Round(time.Millisecond), formatBytes(in), formatBytes(out))
+}
+
+// describeVisitor describes the visitor at [addr], along with its [country] if known (eg. "203.0.113.7:51234 [DE]")
+func describeVisitor(addr net.Addr, country string) string {
+	if country == "" {
+		return addr.String()
+	}
+	return fmt.Sprintf("%s [%s]", addr.String(), country)
+}
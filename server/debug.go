@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync/atomic"
+)
+
+// ----------
+// This file contains the debug endpoint: the runtime's profiles (see net/http/pprof) and expvar counters, including
+// the server's own (goroutines, copies and channel opens in flight), to diagnose leaks. It's opt-in, and meant to be
+// served on a private address only.
+// ----------
+
+// DebugVars are the server's own expvar counters, served as "shhh" at /debug/vars
+type DebugVars struct {
+	Goroutines   int   `json:"goroutines"`    // running in the process
+	Tasks        int64 `json:"tasks"`         // of those, running as part of a connection, tunnel or forwarded connection
+	Tunnels      int   `json:"tunnels"`       // open
+	Connections  int   `json:"connections"`   // being forwarded through TCP / TLS tunnels
+	Copies       int64 `json:"copies"`        // goroutines copying traffic of those connections
+	ChannelOpens int64 `json:"channel_opens"` // channels being opened with clients (ie. awaiting their response)
+}
+
+// DebugHandler returns an http.Handler serving the runtime's profiles at /debug/pprof/ and expvar counters at
+// /debug/vars (see DebugVars). It exposes the process' internals, so it should only be served on a private address.
+func (srv *Server) DebugHandler() http.Handler {
+	var mux = http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/vars", srv.serveDebugVars)
+	return mux
+}
+
+// DebugVars returns the server's own expvar counters
+func (srv *Server) DebugVars() DebugVars {
+	return DebugVars{
+		Goroutines:   runtime.NumGoroutine(),
+		Tasks:        atomic.LoadInt64(&groupTasks),
+		Tunnels:      len(srv.tunnels.list()),
+		Connections:  srv.forwarded.count(),
+		Copies:       atomic.LoadInt64(&srv.forwarded.copies),
+		ChannelOpens: atomic.LoadInt64(&srv.forwarded.opening),
+	}
+}
+
+// serveDebugVars serves the published expvar variables (as expvar.Handler does), along with the server's own. The
+// latter aren't published, so that more than one server can run in a process.
+func (srv *Server) serveDebugVars(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n")
+	expvar.Do(func(kv expvar.KeyValue) {
+		fmt.Fprintf(w, "%q: %s,\n", kv.Key, kv.Value)
+	})
+
+	vars, _ := json.Marshal(srv.DebugVars())
+	fmt.Fprintf(w, "%q: %s\n}\n", "shhh", vars)
+}
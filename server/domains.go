@@ -0,0 +1,254 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains the custom domain store, which tracks domains clients brought for their HTTP tunnels (eg.
+// ssh -R app.example.com:80:localhost:3000 host). A client proves it owns a domain with a TXT challenge: the server
+// generates a token (ssh host domain add app.example.com), which the client publishes as a TXT record of
+// _shhh-challenge.<domain>, and checks for it (ssh host domain verify app.example.com). Verified domains are then
+// reserved for the key which verified them. Domains are persisted as JSON.
+// ----------
+
+const (
+	// label prefixed to a domain to get the name of its challenge's TXT record
+	domainChallengeLabel = "_shhh-challenge"
+
+	// how long a challenge can be verified for after it's generated
+	domainChallengeTTL = 7 * 24 * time.Hour
+)
+
+// domainChallenge is a pending proof of ownership of a domain
+type domainChallenge struct {
+	Owner   string    `json:"owner"` // key fingerprint
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// customDomains tracks domains verified by keys, and the challenges pending verification, persisted to a JSON file
+type customDomains struct {
+	path string
+
+	// resolves TXT records
+	lookupTXT func(name string) ([]string, error)
+
+	mu       sync.RWMutex
+	Verified map[string]string           `json:"verified"` // domain => owner's key fingerprint
+	Pending  map[string]*domainChallenge `json:"pending"`  // domain => challenge
+}
+
+// loadCustomDomains loads the custom domains from the JSON file at [path]. A missing file is treated as empty.
+func loadCustomDomains(path string) (*customDomains, error) {
+	var store = &customDomains{path: path, lookupTXT: net.LookupTXT, Verified: make(map[string]string), Pending: make(map[string]*domainChallenge)}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to read custom domains")
+	}
+
+	if err = json.Unmarshal(content, store); err != nil {
+		return nil, errors.Wrap(err, "failed to parse custom domains")
+	}
+
+	if store.Verified == nil {
+		store.Verified = make(map[string]string)
+	}
+	if store.Pending == nil {
+		store.Pending = make(map[string]*domainChallenge)
+	}
+
+	return store, nil
+}
+
+// Owner returns fingerprint of the key that has verified [domain] (or empty if it's not verified).
+// It is safe to call on a nil store, in which case no domain is verified.
+func (store *customDomains) Owner(domain string) string {
+	if store == nil {
+		return ""
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return store.Verified[domain]
+}
+
+// VerifiedBy returns true if [domain] has been verified by the key with [fingerprint]. Anonymous clients (with an
+// empty fingerprint) never own a domain, and none is owned on a nil store (when custom domains are disabled).
+func (store *customDomains) VerifiedBy(domain, fingerprint string) bool {
+	if fingerprint == "" {
+		return false
+	}
+	var owner = store.Owner(domain)
+	return owner != "" && owner == fingerprint
+}
+
+// Owned returns the domains verified by the key with fingerprint [owner], and those it has yet to verify
+func (store *customDomains) Owned(owner string) (verified, pending []string) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	for domain, o := range store.Verified {
+		if o == owner {
+			verified = append(verified, domain)
+		}
+	}
+	for domain, challenge := range store.Pending {
+		if challenge.Owner == owner && time.Now().Before(challenge.Expires) {
+			pending = append(pending, domain)
+		}
+	}
+
+	sort.Strings(verified)
+	sort.Strings(pending)
+	return verified, pending
+}
+
+// Challenge returns the challenge the key with fingerprint [owner] must publish to verify [domain], generating it
+// unless it has one pending already
+func (store *customDomains) Challenge(domain, owner string) (*domainChallenge, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if o := store.Verified[domain]; o == owner {
+		return nil, errors.Errorf("%s is already verified", domain)
+	} else if o != "" {
+		return nil, errors.Errorf("%s is verified by another key", domain)
+	}
+
+	if challenge := store.Pending[domain]; challenge != nil && challenge.Owner == owner && time.Now().Before(challenge.Expires) {
+		return challenge, nil
+	}
+
+	// another key's challenge is replaced; whoever publishes their token gets the domain
+	var previous = store.Pending[domain]
+	var challenge = &domainChallenge{Owner: owner, Token: "shhh-verify=" + randomHex(16), Expires: time.Now().Add(domainChallengeTTL)}
+	store.Pending[domain] = challenge
+	if err := store.save(); err != nil {
+		store.restorePending(domain, previous) // rollback so in-memory state stays consistent with what's on disk
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// Verify looks up the TXT records of [domain]'s challenge, and marks it verified by the key with fingerprint [owner]
+// if one of them is its token
+func (store *customDomains) Verify(domain, owner string) error {
+	store.mu.RLock()
+	var challenge = store.Pending[domain]
+	store.mu.RUnlock()
+
+	if challenge == nil || challenge.Owner != owner || time.Now().After(challenge.Expires) {
+		return errors.Errorf("no challenge pending for %s (see domain add)", domain)
+	}
+
+	// the lookup is done without holding the lock, as it can take a while
+	records, err := store.lookupTXT(domainChallengeLabel + "." + domain)
+	if err != nil {
+		return errors.Wrapf(err, "failed to look up TXT records of %s.%s", domainChallengeLabel, domain)
+	}
+
+	if !contains(records, challenge.Token) {
+		return errors.Errorf("TXT record %q not found at %s.%s (DNS changes can take a while to propagate)", challenge.Token, domainChallengeLabel, domain)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.Pending[domain] != challenge {
+		return errors.Errorf("challenge for %s was replaced", domain)
+	}
+
+	delete(store.Pending, domain)
+	store.Verified[domain] = owner
+	if err = store.save(); err != nil {
+		delete(store.Verified, domain)
+		store.Pending[domain] = challenge
+		return err
+	}
+	return nil
+}
+
+// Remove forgets [domain], verified or pending, of the key with fingerprint [owner]. Any active tunnel using the
+// domain is left untouched.
+func (store *customDomains) Remove(domain, owner string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var verified, challenge = store.Verified[domain], store.Pending[domain]
+	if verified != owner && (challenge == nil || challenge.Owner != owner) {
+		return errors.Errorf("%s is not yours", domain)
+	}
+
+	if verified == owner {
+		delete(store.Verified, domain)
+	}
+	if challenge != nil && challenge.Owner == owner {
+		delete(store.Pending, domain)
+	}
+
+	if err := store.save(); err != nil {
+		if verified != "" {
+			store.Verified[domain] = verified
+		}
+		store.restorePending(domain, challenge)
+		return err
+	}
+	return nil
+}
+
+// restorePending puts back the [challenge] pending for [domain] (if any). Must be called with lock held.
+func (store *customDomains) restorePending(domain string, challenge *domainChallenge) {
+	if challenge != nil {
+		store.Pending[domain] = challenge
+	} else {
+		delete(store.Pending, domain)
+	}
+}
+
+// save persists the domains to disk, dropping expired challenges. Must be called with lock held.
+func (store *customDomains) save() error {
+	for domain, challenge := range store.Pending {
+		if time.Now().After(challenge.Expires) {
+			delete(store.Pending, domain)
+		}
+	}
+
+	content, err := json.MarshalIndent(store, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal custom domains")
+	}
+	return writeFileAtomic(store.path, content)
+}
+
+// parseCustomDomain returns [domain] in its canonical form, or an error if it isn't a domain clients can bring:
+// a valid DNS name with at least two labels, outside of the server's own [own] domain (where tunnels get sub-domains)
+func parseCustomDomain(domain, own string) (string, error) {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+
+	var labels = strings.Split(domain, ".")
+	if len(labels) < 2 || len(domain) > 253 {
+		return "", errors.Errorf("invalid domain %q", domain)
+	}
+	for _, label := range labels {
+		if !tunnelNamePattern.MatchString(label) {
+			return "", errors.Errorf("invalid domain %q", domain)
+		}
+	}
+
+	if own = strings.ToLower(own); domain == own || strings.HasSuffix(domain, "."+own) {
+		return "", errors.Errorf("%s is the server's own domain; ask for a sub-domain instead", domain)
+	}
+	return domain, nil
+}
@@ -0,0 +1,116 @@
+package server_test
+
+import (
+	"encoding/json"
+	"github.com/riyaz-ali/shhh/internal/harness"
+	"github.com/riyaz-ali/shhh/server"
+	gossh "golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeDomains writes a custom domains file, with [verified] domains (by owner's fingerprint), to [dir]
+func writeDomains(t *testing.T, dir string, verified map[string]string) string {
+	content, _ := json.Marshal(map[string]interface{}{"verified": verified})
+	var path = filepath.Join(dir, "domains.json")
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// startAnonymous starts an anonymous server with the HTTP edge, and custom domains kept at [domainsFile] (disabled
+// if empty)
+func startAnonymous(t *testing.T, domainsFile string) *harness.Server {
+	var config = server.DefaultConfig()
+	config.HTTPAddr, config.Domain, config.DomainsFile = ":0", "example.test", domainsFile
+
+	srv, err := harness.StartAnonymous(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func TestCustomDomainDeniedToAnonymousClients(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shhh-domains")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, domainsFile := range map[string]string{
+		"unverified": writeDomains(t, dir, map[string]string{"other.example.org": "SHA256:someone"}),
+		"disabled":   "",
+	} {
+		t.Run(name, func(t *testing.T) {
+			var srv = startAnonymous(t, domainsFile)
+			defer srv.Close()
+
+			client, err := srv.DialAnonymous()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			for _, domain := range []string{"app.example.org", "other.example.org"} {
+				if _, err = client.Listen(domain, 80); err == nil || !strings.Contains(err.Error(), "not verified") {
+					t.Fatalf("anonymous client was given %s (err: %v)", domain, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCustomDomainGrantedToItsOwner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shhh-domains")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var owner, other = mustKey(t), mustKey(t)
+	var config = server.DefaultConfig()
+	config.HTTPAddr, config.Domain = ":0", "example.test"
+	config.DomainsFile = writeDomains(t, dir, map[string]string{"app.example.org": gossh.FingerprintSHA256(owner.PublicKey())})
+	config.AuthorizedKeys = filepath.Join(dir, "authorized_keys")
+	var keys = append(gossh.MarshalAuthorizedKey(owner.PublicKey()), gossh.MarshalAuthorizedKey(other.PublicKey())...)
+	if err = ioutil.WriteFile(config.AuthorizedKeys, keys, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := harness.Start(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	intruder, err := srv.DialKey(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer intruder.Close()
+	if _, err = intruder.Listen("app.example.org", 80); err == nil {
+		t.Fatal("client was given a domain verified by another key")
+	}
+
+	client, err := srv.DialKey(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err = client.Listen("app.example.org", 80); err != nil {
+		t.Fatalf("owner was denied its verified domain: %v", err)
+	}
+}
+
+func mustKey(t *testing.T) gossh.Signer {
+	key, err := harness.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ----------
+// This file contains the error pages the HTTP edge serves in place of a tunnel (eg. when no tunnel matches the
+// Host header, or its client is disconnected). Operators can replace them with their own templates, and API
+// consumers are served JSON instead.
+// ----------
+
+// kinds of error pages, which name their templates (eg. not-found.html)
+const (
+	pageNotFound    = "not-found"   // no tunnel matches the Host header
+	pageOffline     = "offline"     // the tunnel's client is disconnected (its name is reserved or held for it)
+	pageUnavailable = "unavailable" // the tunnel's local service can't be reached
+	pageOnHold      = "on-hold"     // the tunnel is quarantined
+)
+
+// errorPage describes an error page, and is what its template is executed with
+type errorPage struct {
+	Kind    string `json:"error"`
+	Status  int    `json:"status"`
+	Title   string `json:"title"`
+	Message string `json:"message"`
+	Host    string `json:"host"`
+}
+
+// built-in error pages
+var defaultErrorPages = map[string]errorPage{
+	pageNotFound:    {Status: http.StatusNotFound, Title: "Tunnel not found", Message: "There's no tunnel at this address."},
+	pageOffline:     {Status: http.StatusServiceUnavailable, Title: "Tunnel offline", Message: "The owner of this tunnel is disconnected right now. Please try again later."},
+	pageUnavailable: {Status: http.StatusBadGateway, Title: "Tunnel unavailable", Message: "The service behind this tunnel isn't responding."},
+	pageOnHold:      {Status: http.StatusServiceUnavailable, Title: "On hold", Message: "This site is under review by the operators of this service. Please try again later."},
+}
+
+// template of the built-in error pages
+var defaultErrorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html><head><title>{{.Title}}</title></head>
+<body><h1>{{.Title}}</h1><p>{{.Message}}</p></body>
+</html>
+`))
+
+// error formats served to visitors
+const (
+	errorFormatAuto = "auto" // JSON for clients which accept it but not HTML, HTML otherwise
+	errorFormatHTML = "html"
+	errorFormatJSON = "json"
+)
+
+// errorPages serves the edge's error pages
+type errorPages struct {
+	format    string
+	templates map[string]*template.Template // operator's templates, by kind
+}
+
+// newErrorPages returns errorPages using the templates named after their kind (eg. offline.html) in [dir], if set,
+// or the built-in ones otherwise, and served in [format] (one of auto, html or json; auto if empty)
+func newErrorPages(dir, format string) (*errorPages, error) {
+	if format == "" {
+		format = errorFormatAuto
+	}
+	if format != errorFormatAuto && format != errorFormatHTML && format != errorFormatJSON {
+		return nil, errors.Errorf("invalid error format %q: must be one of auto, html or json", format)
+	}
+
+	var pages = &errorPages{format: format, templates: make(map[string]*template.Template)}
+	if dir == "" {
+		return pages, nil
+	}
+
+	for kind := range defaultErrorPages {
+		var path = filepath.Join(dir, kind+".html")
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue // the built-in page is used
+		}
+
+		tmpl, err := template.ParseFiles(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load error page %q", path)
+		}
+		pages.templates[kind] = tmpl
+	}
+	return pages, nil
+}
+
+// serve responds to [r] with the error page of [kind]
+func (pages *errorPages) serve(w http.ResponseWriter, r *http.Request, kind string) {
+	var page = defaultErrorPages[kind]
+	page.Kind, page.Host = kind, r.Host
+
+	w.Header().Set("Cache-Control", "no-store")
+	if pages.wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(page.Status)
+		_ = json.NewEncoder(w).Encode(page)
+		return
+	}
+
+	var tmpl, ok = pages.templates[kind]
+	if !ok {
+		tmpl = defaultErrorTemplate
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(page.Status)
+	_ = tmpl.Execute(w, page)
+}
+
+// wantsJSON returns true if [r] is to be answered with JSON
+func (pages *errorPages) wantsJSON(r *http.Request) bool {
+	switch pages.format {
+	case errorFormatJSON:
+		return true
+	case errorFormatHTML:
+		return false
+	}
+
+	var accept = r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
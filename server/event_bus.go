@@ -0,0 +1,428 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains the event bus, which carries tunnel lifecycle events (see TunnelEvent) and security events
+// (those of the audit log, like failed authentications and denied forwarding requests) to notifiers: Slack and
+// Discord channels, email recipients, and generic webhooks. Each notifier is configured with the types of events
+// it's interested in (see EventNotifierConfig), and delivers them in the background, in order, retrying failed
+// deliveries like webhooks do.
+// ----------
+
+// types of EventNotifierConfig
+const (
+	NotifySlack   = "slack"
+	NotifyDiscord = "discord"
+	NotifyEmail   = "email"
+	NotifyWebhook = "webhook"
+)
+
+// EventNotifierConfig configures a notifier of events on the bus
+type EventNotifierConfig struct {
+	// slack, discord, email or webhook
+	Type string `json:"type"`
+
+	// incoming webhook of the Slack / Discord channel, endpoint of the webhook, or SMTP server emails are sent
+	// through, as smtp://[user:password@]host:port (smtps:// for implicit TLS)
+	URL string `json:"url"`
+
+	// if set, each request to a webhook is signed using HMAC-SHA256 with the secret as key (see WebhookConfig)
+	Secret string `json:"secret,omitempty"`
+
+	// sender and recipients of emails
+	From string   `json:"from,omitempty"`
+	To   []string `json:"to,omitempty"`
+
+	// types of events to deliver, as patterns (eg. "tunnel.*" or "auth.failure"); empty for all
+	Events []string `json:"events,omitempty"`
+}
+
+// BusEvent is an event carried by the bus, as posted to webhook notifiers
+type BusEvent struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+
+	// describes the event in a sentence, for humans
+	Summary string `json:"summary"`
+
+	// the event itself: one of a tunnel lifecycle event, or a security event
+	Tunnel   *TunnelEvent `json:"tunnel,omitempty"`
+	Security *AuditEvent  `json:"security,omitempty"`
+}
+
+// notifierBackend delivers events to wherever a notifier sends them
+type notifierBackend interface {
+	deliver(event BusEvent) error
+}
+
+// eventNotifier delivers events it's interested in to its backend in the background, in order, retrying failed
+// deliveries
+type eventNotifier struct {
+	config  *EventNotifierConfig
+	backend notifierBackend
+	name    string // for logs
+
+	queue   chan BusEvent
+	pending sync.WaitGroup // events queued but not yet delivered (or given up on)
+}
+
+// eventBus delivers events to its notifiers. A nil *eventBus delivers nothing.
+type eventBus struct {
+	notifiers []*eventNotifier
+}
+
+// newEventBus returns the event bus with the configured notifiers, and starts delivering events to them (or nil if
+// there are none)
+func newEventBus(config *Config) (*eventBus, error) {
+	if len(config.EventNotifiers) == 0 {
+		return nil, nil
+	}
+
+	var bus = &eventBus{}
+	for i := range config.EventNotifiers {
+		var nc = &config.EventNotifiers[i]
+		for _, pattern := range nc.Events {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, errors.Wrapf(err, "invalid event pattern %q", pattern)
+			}
+		}
+
+		backend, err := newNotifierBackend(nc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s notifier", nc.Type)
+		}
+
+		var n = &eventNotifier{config: nc, backend: backend, name: nc.Type, queue: make(chan BusEvent, webhookQueueSize)}
+		if u, err := url.Parse(nc.URL); err == nil {
+			n.name += " " + u.Host // keeps tokens in the URL out of logs
+		}
+		bus.notifiers = append(bus.notifiers, n)
+	}
+
+	for _, n := range bus.notifiers {
+		go n.run()
+	}
+	return bus, nil
+}
+
+// newNotifierBackend returns the backend of [config]
+func newNotifierBackend(config *EventNotifierConfig) (notifierBackend, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil || u.Host == "" {
+		return nil, errors.Errorf("invalid url %q", config.URL)
+	}
+
+	var client = &http.Client{Timeout: 10 * time.Second}
+	switch config.Type {
+	case NotifySlack:
+		return &chatNotifier{client: client, url: config.URL, field: "text"}, nil
+	case NotifyDiscord:
+		return &chatNotifier{client: client, url: config.URL, field: "content"}, nil
+	case NotifyWebhook:
+		return &webhookNotifier{client: client, url: config.URL, secret: config.Secret}, nil
+	case NotifyEmail:
+		if u.Scheme != "smtp" && u.Scheme != "smtps" {
+			return nil, errors.Errorf("invalid url %q: must be smtp:// or smtps://", config.URL)
+		}
+		if config.From == "" || len(config.To) == 0 {
+			return nil, errors.New("sender and recipients are required")
+		}
+		return &emailNotifier{server: u, from: config.From, to: config.To}, nil
+	default:
+		return nil, errors.Errorf("unknown notifier type (%s, %s, %s or %s)", NotifySlack, NotifyDiscord, NotifyEmail, NotifyWebhook)
+	}
+}
+
+// publishTunnel puts the tunnel lifecycle [event] on the bus
+func (bus *eventBus) publishTunnel(event TunnelEvent) {
+	if bus == nil {
+		return
+	}
+	bus.publish(BusEvent{Type: event.Type, Time: event.Time, Summary: summarizeTunnelEvent(event), Tunnel: &event})
+}
+
+// publishSecurity puts the security [event] on the bus. Tunnels opening / closing are published by publishTunnel.
+func (bus *eventBus) publishSecurity(event AuditEvent) {
+	if bus == nil || event.Type == AuditTunnelOpened || event.Type == AuditTunnelClosed {
+		return
+	}
+	bus.publish(BusEvent{Type: event.Type, Time: event.Time, Summary: summarizeSecurityEvent(event), Security: &event})
+}
+
+// publish queues [event] for delivery by the notifiers interested in it. It never blocks.
+func (bus *eventBus) publish(event BusEvent) {
+	for _, n := range bus.notifiers {
+		if !n.wants(event.Type) {
+			continue
+		}
+
+		n.pending.Add(1)
+		select {
+		case n.queue <- event:
+		default:
+			n.pending.Done()
+			log.Printf("%s notifier: queue is full; dropped %s event", n.name, event.Type)
+		}
+	}
+}
+
+// Flush waits until all queued events are delivered (or given up on), or [ctx] is done
+func (bus *eventBus) Flush(ctx context.Context) error {
+	if bus == nil {
+		return nil
+	}
+
+	var done = make(chan struct{})
+	go func() {
+		for _, n := range bus.notifiers {
+			n.pending.Wait()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// wants returns true if the notifier is interested in events of type [typ]
+func (n *eventNotifier) wants(typ string) bool {
+	if len(n.config.Events) == 0 {
+		return true
+	}
+
+	for _, pattern := range n.config.Events {
+		if ok, _ := path.Match(pattern, typ); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// run delivers queued events for as long as the process runs
+func (n *eventNotifier) run() {
+	for event := range n.queue {
+		var backoff = webhookInitialBackoff
+		for attempt := 1; ; attempt++ {
+			var err = n.backend.deliver(event)
+			if err == nil {
+				break
+			}
+
+			if attempt == webhookAttempts {
+				log.Printf("%s notifier: giving up on %s event after %d attempts: %s", n.name, event.Type, attempt, err.Error())
+				break
+			}
+
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > webhookMaxBackoff {
+				backoff = webhookMaxBackoff
+			}
+		}
+		n.pending.Done()
+	}
+}
+
+// chatNotifier posts the summary of events to the incoming webhook of a Slack or Discord channel
+type chatNotifier struct {
+	client *http.Client
+	url    string
+	field  string // of the message's text in the payload
+}
+
+func (chat *chatNotifier) deliver(event BusEvent) error {
+	body, _ := json.Marshal(map[string]string{chat.field: "[shhh] " + event.Summary})
+	return postJSON(chat.client, chat.url, body, nil)
+}
+
+// webhookNotifier posts events, as JSON, to a webhook
+type webhookNotifier struct {
+	client *http.Client
+	url    string
+	secret string
+}
+
+func (hook *webhookNotifier) deliver(event BusEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal event")
+	}
+
+	var header = make(http.Header)
+	if hook.secret != "" {
+		var mac = hmac.New(sha256.New, []byte(hook.secret))
+		_, _ = mac.Write(body)
+		header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return postJSON(hook.client, hook.url, body, header)
+}
+
+// emailNotifier sends events by email through an SMTP server
+type emailNotifier struct {
+	server *url.URL
+	from   string
+	to     []string
+}
+
+func (email *emailNotifier) deliver(event BusEvent) error {
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\nTo: %s\r\nSubject: [shhh] %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n",
+		email.from, strings.Join(email.to, ", "), event.Type, event.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&body, "%s\r\n\r\n", event.Summary)
+
+	details, _ := json.MarshalIndent(event, "", "  ")
+	body.Write(bytes.ReplaceAll(details, []byte("\n"), []byte("\r\n")))
+	body.WriteString("\r\n")
+
+	var host = email.server.Hostname()
+	var auth smtp.Auth
+	if user := email.server.User; user != nil {
+		password, _ := user.Password()
+		auth = smtp.PlainAuth("", user.Username(), password, host)
+	}
+
+	if email.server.Scheme == "smtp" {
+		return smtp.SendMail(email.server.Host, auth, email.from, email.to, body.Bytes())
+	}
+
+	// smtps: the connection is TLS from the start
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", email.server.Host, &tls.Config{ServerName: host})
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if auth != nil {
+		if err = client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err = client.Mail(email.from); err != nil {
+		return err
+	}
+	for _, to := range email.to {
+		if err = client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(body.Bytes()); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// postJSON POSTs the JSON [body] to [endpoint], with [header] (if any)
+func postJSON(client *http.Client, endpoint string, body []byte, header http.Header) error {
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("unexpected response: %s", resp.Status)
+	}
+	return nil
+}
+
+// summarizeTunnelEvent describes [event] in a sentence
+func summarizeTunnelEvent(event TunnelEvent) string {
+	var who = event.Fingerprint
+	if who == "" {
+		who = "anonymous client"
+	}
+
+	switch event.Type {
+	case TunnelOpened:
+		return fmt.Sprintf("tunnel %s opened by %s (%s)", event.Address, who, event.Client)
+	case TunnelClosed:
+		return fmt.Sprintf("tunnel %s of %s closed: %d connections, %s in, %s out", event.Address, who, event.Connections,
+			formatBytes(event.BytesIn), formatBytes(event.BytesOut))
+	case TunnelError:
+		return fmt.Sprintf("tunnel %s of %s failed: %s", event.Address, who, event.Error)
+	case TunnelQuarantined:
+		return fmt.Sprintf("tunnel %s of %s quarantined: %s", event.Address, who, event.Reason)
+	case TunnelReleased:
+		return fmt.Sprintf("tunnel %s of %s released from quarantine", event.Address, who)
+	default:
+		return fmt.Sprintf("%s: tunnel %s of %s", event.Type, event.Address, who)
+	}
+}
+
+// summarizeSecurityEvent describes [event] in a sentence
+func summarizeSecurityEvent(event AuditEvent) string {
+	var who = event.Fingerprint
+	if who == "" {
+		who = "unknown key"
+	}
+
+	var summary string
+	switch event.Type {
+	case AuditAuthSuccess:
+		summary = fmt.Sprintf("%s authenticated from %s", who, event.Client)
+	case AuditAuthFailure:
+		summary = fmt.Sprintf("authentication of %s from %s failed: %s", who, event.Client, event.Reason)
+	case AuditAuthOffer:
+		summary = fmt.Sprintf("%s offered from %s was rejected: %s", who, event.Client, event.Reason)
+	case AuditForwardGranted:
+		summary = fmt.Sprintf("%s (%s) granted forwarding of %s", who, event.Client, event.Request)
+	case AuditForwardDenied:
+		summary = fmt.Sprintf("%s (%s) denied forwarding of %s: %s", who, event.Client, event.Request, event.Reason)
+	case AuditAdminAction:
+		summary = fmt.Sprintf("administrator at %s requested %s", event.Client, event.Action)
+	case AuditAdminDenied:
+		summary = fmt.Sprintf("administrator at %s denied %s", event.Client, event.Action)
+	default:
+		summary = fmt.Sprintf("%s: %s (%s)", event.Type, who, event.Client)
+	}
+
+	if event.Error != "" {
+		summary += " (failed: " + event.Error + ")"
+	}
+	return summary
+}
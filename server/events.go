@@ -0,0 +1,84 @@
+package server
+
+import (
+	"time"
+)
+
+// ----------
+// This file defines the events emitted over a tunnel's lifecycle
+// ----------
+
+// types of TunnelEvent
+const (
+	TunnelOpened = "tunnel.opened"
+	TunnelClosed = "tunnel.closed"
+	TunnelError  = "tunnel.error"
+
+	TunnelQuarantined = "tunnel.quarantined"
+	TunnelReleased    = "tunnel.released"
+)
+
+// TunnelEvent describes a change in a tunnel's lifecycle
+type TunnelEvent struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+
+	// fingerprint of the key the client authenticated with (empty if authentication is disabled)
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	// remote address of the client's ssh connection
+	Client string `json:"client"`
+
+	// public address of the tunnel (eg. "[::]:4000" or "http://myapp.example.com")
+	Address string `json:"address"`
+
+	// name the tunnel is known by, if the client named it (with --name)
+	Name string `json:"name,omitempty"`
+
+	// traffic through the tunnel so far
+	Connections int64 `json:"connections"`
+	BytesIn     int64 `json:"bytes_in"`
+	BytesOut    int64 `json:"bytes_out"`
+
+	// describes what went wrong (for TunnelError)
+	Error string `json:"error,omitempty"`
+
+	// why the tunnel was quarantined (for TunnelQuarantined)
+	Reason string `json:"reason,omitempty"`
+
+	// labels attached to the client by hooks (see Config.Hooks)
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// newTunnelEvent returns a new TunnelEvent of type [typ] for the tunnel at [address], with traffic totals from [stats]
+func newTunnelEvent(typ, fingerprint, client, address string, stats *tunnelStats) TunnelEvent {
+	var s = stats.snapshot()
+	return TunnelEvent{
+		Type:        typ,
+		Time:        time.Now().UTC(),
+		Fingerprint: fingerprint,
+		Client:      client,
+		Address:     address,
+		Connections: s.connections,
+		BytesIn:     s.bytesIn,
+		BytesOut:    s.bytesOut,
+	}
+}
+
+// emit delivers the [event] to every configured webhook, event handler and notifier, and to the service registry and
+// Kubernetes controller
+func (srv *Server) emit(event TunnelEvent) {
+	srv.audit.tunnel(event)
+
+	for _, handler := range srv.eventHandlers {
+		handler(event)
+	}
+
+	for _, hook := range srv.webhooks {
+		hook.Send(event)
+	}
+	srv.bus.publishTunnel(event)
+
+	srv.registry.send(event)
+	srv.kubernetes.send(event)
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"syscall"
+)
+
+// ----------
+// This file contains helpers to enable TCP Fast Open (see RFC 7413) on Linux
+// ----------
+
+const (
+	// TCP_FASTOPEN socket option (see tcp(7)); not defined in package syscall
+	tcpFastOpen = 0x17
+
+	// maximum number of pending TCP Fast Open requests on a listener
+	tcpFastOpenQueueLen = 256
+)
+
+// enableFastOpen is a net.ListenConfig Control function which enables TCP Fast Open on the listening socket
+func enableFastOpen(_, _ string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpen, tcpFastOpenQueueLen)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
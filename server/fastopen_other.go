@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"syscall"
+)
+
+// ----------
+// TCP Fast Open is only supported on Linux; elsewhere, listeners are created as usual
+// ----------
+
+// enableFastOpen is a no-op net.ListenConfig Control function
+func enableFastOpen(_, _ string, _ syscall.RawConn) error { return nil }
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ----------
+// This file contains helpers to work with files persisted by the server
+// ----------
+
+// writeFileAtomic writes [content] to the file at [path]. It writes to a temporary file first and then
+// renames it over the original, so that the file is never left half-written.
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return errors.Wrapf(err, "failed to write %s", path)
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if _, err = tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		return errors.Wrapf(err, "failed to write %s", path)
+	}
+
+	if err = tmp.Close(); err != nil {
+		return errors.Wrapf(err, "failed to write %s", path)
+	}
+
+	return errors.Wrapf(os.Rename(tmp.Name(), path), "failed to write %s", path)
+}
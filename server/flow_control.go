@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	gossh "golang.org/x/crypto/ssh"
+	"sync/atomic"
+	"time"
+)
+
+// ----------
+// This file contains helpers to observe flow control of tunnels. The receive window of each ssh channel is fixed
+// by golang.org/x/crypto/ssh, which caps the throughput of a single forwarded connection at window / RTT. We measure
+// the RTT to the client and the throughput of each of a tunnel's channels, and let the client know once one of them
+// hits that cap. Both, and the window, are exposed with each tunnel (see TunnelInfo) and in metrics. Windows can't be
+// tuned (to grow them on long links, say) without forking golang.org/x/crypto/ssh, so the server doesn't try to:
+// clients are told to spread transfers over parallel connections instead.
+// ----------
+
+const (
+	// receive window of channels opened by golang.org/x/crypto/ssh (not configurable)
+	sshChannelWindow = 64 << 15
+
+	// request sent to measure the round-trip time to the client; OpenSSH replies to unknown requests with a failure
+	keepaliveRequest = "keepalive@openssh.com"
+
+	// fraction of the window-limited throughput above which the client is warned
+	windowLimitedThreshold = 0.8
+)
+
+// measureRTT returns the round-trip time of a request / reply exchange with the client over [conn]
+func measureRTT(conn gossh.Conn) (time.Duration, error) {
+	var start = time.Now()
+	if _, _, err := conn.SendRequest(keepaliveRequest, true, nil); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// windowLimit returns the maximum throughput (in bytes per second) of a single channel at the given [rtt]
+func windowLimit(rtt time.Duration) float64 {
+	if rtt <= 0 {
+		return 0
+	}
+	return float64(sshChannelWindow) / rtt.Seconds()
+}
+
+// fastestChannel returns the throughput of the fastest of [channels] over the last [interval], given the bytes through
+// each as of its start ([last]; channels opened since are missing), and the bytes through each now
+func fastestChannel(channels []*countingChannel, last map[*countingChannel]int64, interval time.Duration) (float64, map[*countingChannel]int64) {
+	var throughput float64
+	var current = make(map[*countingChannel]int64, len(channels))
+	for _, channel := range channels {
+		var total = atomic.LoadInt64(&channel.bytes)
+		current[channel] = total
+		if t := float64(total-last[channel]) / interval.Seconds(); t > throughput {
+			throughput = t
+		}
+	}
+	return throughput, current
+}
+
+// monitorFlow measures the RTT over [conn] and the throughput of each of the tunnel's channels (from [stats]) every
+// [interval] until [ctx] is done, and notifies the client when the fastest is limited by the channel window. The
+// window is per channel: a tunnel with many connections, each well below the limit, isn't held back.
+func monitorFlow(ctx context.Context, conn gossh.Conn, stats *tunnelStats, notify notifyFn, interval time.Duration) {
+	var ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last = make(map[*countingChannel]int64) // bytes through each channel, as of the previous measurement
+	var warned bool
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var throughput float64
+		throughput, last = fastestChannel(stats.open.list(), last, interval)
+
+		rtt, err := measureRTT(conn)
+		if err != nil {
+			return // connection is gone
+		}
+
+		atomic.StoreInt64(&stats.rtt, int64(rtt))
+		atomic.StoreInt64(&stats.throughput, int64(throughput))
+
+		var limit = windowLimit(rtt)
+		if limited := throughput >= windowLimitedThreshold*limit; limited && !warned {
+			notify(fmt.Sprintf("throughput of a connection (%s/s) is close to the limit of a single connection (%s/s at %s round-trip time); "+
+				"use parallel connections for faster transfers", formatBytes(int64(throughput)), formatBytes(int64(limit)), rtt.Round(time.Millisecond)),
+				kv("type", "flow_control"), kv("throughput", int64(throughput)), kv("limit", int64(limit)), kv("rtt_ms", rtt.Milliseconds()))
+			warned = true
+		} else if !limited {
+			warned = false
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	gossh "golang.org/x/crypto/ssh"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFastestChannel(t *testing.T) {
+	const mb = 1 << 20
+	var stats = newTunnelStats()
+
+	// many channels, each well below the limit of one, aren't held back by the window, however much they move
+	// together
+	var slow []*countingChannel
+	for i := 0; i < 10; i++ {
+		var channel = &countingChannel{stats: stats}
+		stats.open.add(channel)
+		slow = append(slow, channel)
+	}
+
+	var last map[*countingChannel]int64
+	_, last = fastestChannel(stats.open.list(), last, time.Second)
+	for _, channel := range slow {
+		channel.bytes += 1 * mb
+	}
+	throughput, last := fastestChannel(stats.open.list(), last, time.Second)
+	if throughput != 1*mb {
+		t.Fatalf("got %.0f B/s, want the throughput of the fastest channel (%d B/s)", throughput, 1*mb)
+	}
+	if limit := windowLimit(100 * time.Millisecond); throughput >= windowLimitedThreshold*limit {
+		t.Fatalf("channels each moving %d B/s are taken to be limited by the window (%.0f B/s)", 1*mb, limit)
+	}
+
+	// a channel opened since the last measurement counts all it moved
+	var fast = &countingChannel{stats: stats}
+	stats.open.add(fast)
+	fast.bytes = 18 * mb
+	if throughput, last = fastestChannel(stats.open.list(), last, time.Second); throughput != 18*mb {
+		t.Fatalf("got %.0f B/s, want %d B/s", throughput, 18*mb)
+	}
+	if limit := windowLimit(100 * time.Millisecond); throughput < windowLimitedThreshold*limit {
+		t.Fatalf("a channel moving %d B/s isn't taken to be limited by the window (%.0f B/s)", 18*mb, limit)
+	}
+
+	// closed channels are forgotten
+	stats.open.remove(fast)
+	if _, last = fastestChannel(stats.open.list(), last, time.Second); len(last) != len(slow) {
+		t.Fatalf("got %d channels measured, want %d", len(last), len(slow))
+	}
+}
+
+// slowConn is a gossh.Conn whose requests take rtt to be answered
+type slowConn struct {
+	gossh.Conn
+	rtt time.Duration
+}
+
+func (c slowConn) SendRequest(string, bool, []byte) (bool, []byte, error) {
+	time.Sleep(c.rtt)
+	return false, nil, nil
+}
+
+// what's measured is exposed with the tunnel, and in its metrics
+func TestMonitorFlowExposesMeasurements(t *testing.T) {
+	var stats = newTunnelStats()
+	var channel = &countingChannel{stats: stats}
+	stats.open.add(channel)
+	atomic.StoreInt64(&channel.bytes, 1<<20)
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	var done = make(chan struct{})
+	go func() {
+		defer close(done)
+		monitorFlow(ctx, slowConn{rtt: 20 * time.Millisecond}, stats, func(string, ...field) {}, 50*time.Millisecond)
+	}()
+	var deadline = time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&stats.rtt) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	var info = (&openTunnel{address: "example.com:8080", stats: stats, quarantine: newQuarantine()}).info()
+	if info.RTTMillis < 20 || info.ChannelWindow != sshChannelWindow || info.WindowLimit <= 0 || info.Throughput <= 0 {
+		t.Fatalf("got flow control of the tunnel %+v, want its measured RTT, window, limit and throughput", info)
+	}
+
+	var m = newMetrics()
+	m.observe(info.Address, stats)
+	var buf bytes.Buffer
+	m.tunnelRTT.write(&buf)
+	m.tunnelThroughput.write(&buf)
+	if !strings.Contains(buf.String(), `shhh_tunnel_rtt_seconds{tunnel="example.com:8080"}`) ||
+		!strings.Contains(buf.String(), `shhh_tunnel_channel_throughput_bytes{tunnel="example.com:8080"}`) {
+		t.Fatalf("measurements missing from metrics:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,1185 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ----------
+// This file contains the handlers for port forwarding requests, and the accept / forward loops for tunnels
+// ----------
+
+const (
+	// SSH request type constant for TCP/IP port forward
+	tcpipForwardRequest = "tcpip-forward"
+
+	// SSH request type constant for opening new channel
+	// for incoming request on a forwarded port
+	tcpipForwardIncomingConnectionRequest = "forwarded-tcpip"
+)
+
+// newChannelFn defines signature for a helper function which opens a new ssh channel for incoming requests on forwarded port
+type newChannelFn func(host, port string) (gossh.Channel, <-chan *gossh.Request, error)
+
+// openWithin wraps [newChannel] so that opening a channel fails if the client doesn't respond within [timeout] (eg. as
+// it's wedged), rather than holding up the visitor indefinitely. Channels the client opens after all are closed.
+func openWithin(timeout time.Duration, newChannel newChannelFn) newChannelFn {
+	if timeout <= 0 {
+		return newChannel
+	}
+
+	return func(host, port string) (gossh.Channel, <-chan *gossh.Request, error) {
+		type opened struct {
+			channel  gossh.Channel
+			requests <-chan *gossh.Request
+			err      error
+		}
+
+		var result = make(chan opened)
+		var abandoned = make(chan struct{})
+		go func() {
+			channel, requests, err := newChannel(host, port)
+			select {
+			case result <- opened{channel, requests, err}:
+			case <-abandoned:
+				if err == nil {
+					go gossh.DiscardRequests(requests)
+					_ = channel.Close()
+				}
+			}
+		}()
+
+		var timer = time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case r := <-result:
+			return r.channel, r.requests, r.err
+		case <-timer.C:
+			close(abandoned)
+			return nil, nil, errors.Errorf("client didn't respond to a new channel within %s", timeout)
+		}
+	}
+}
+
+// tcpipForwardRequestHandler returns an ssh.RequestHandler which handles SSH request of type "tcpip-forward" (and
+// "udp-forward@shhh", for which a public UDP port is bound instead; see UDPForwardRequest). Requests for port 80 create HTTP tunnels served by the server's router (if enabled), and requests for port 443
+// create TLS tunnels served by its SNI router (if enabled). Otherwise, public listeners
+// are bound as defined by the server's config; if configured, the tunnel is also exposed on a server-local unix socket.
+// Names and ports reserved for other keys, or denied by the server's Authorizer, are rejected. Tunnels are closed (and in-flight connections drained)
+// when the connection goes away or the server shuts down.
+func tcpipForwardRequestHandler(srv *Server) ssh.RequestHandler {
+	var config = srv.config
+	return func(ctx ssh.Context, _ *ssh.Server, req *gossh.Request) (ok bool, payload []byte) {
+		var err error
+
+		var conn *connection
+		if conn, ok = connectionFromContext(ctx); !ok {
+			return false, []byte("internal server error")
+		}
+		defer func() {
+			if !ok { // end the session if response is !ok (and there's nothing else going on)
+				conn.endIfIdle()
+			}
+		}()
+
+		// get the underlying ssh connection
+		sshConnection := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
+
+		// parse the request
+		var request struct {
+			BindAddr string
+			BindPort uint32
+		}
+
+		if err = gossh.Unmarshal(req.Payload, &request); err != nil {
+			return false, []byte("malformed forwarding request")
+		}
+
+		// requests are recorded in the audit log: denied ones here, granted ones once the tunnel is open
+		var audit = AuditEvent{Type: AuditForwardGranted, Client: sshConnection.RemoteAddr().String(), Fingerprint: Fingerprint(ctx),
+			Request: net.JoinHostPort(request.BindAddr, strconv.Itoa(int(request.BindPort)))}
+		if req.Type == UDPForwardRequest {
+			audit.Request = "udp:" + audit.Request
+		}
+		defer func() {
+			if !ok {
+				audit.Type, audit.Reason = AuditForwardDenied, string(payload)
+				srv.audit.record(audit)
+
+				// plain ssh clients don't show the reason a request failed, so it's also sent as a message
+				conn.Notify(fmt.Sprintf("forwarding %s denied: %s", audit.Request, payload),
+					kv("type", "forward.denied"), kv("request", audit.Request), kv("reason", string(payload)))
+			}
+		}()
+
+		// the tunnel is traced from its request until it closes, with the handling of the request as a span of its own
+		var trace = srv.tracer.trace("tunnel", spanKindServer)
+		trace.set("shhh.request", audit.Request)
+		trace.set("shhh.client", audit.Client)
+		trace.set("shhh.fingerprint", audit.Fingerprint)
+		var handling = trace.child(req.Type, spanKindInternal)
+		defer func() {
+			if !ok {
+				handling.fail(string(payload))
+				trace.fail(string(payload))
+				trace.finish()
+			}
+			handling.finish()
+		}()
+
+		// the operator's hooks may deny the request, or rewrite what's bound; the client is still sent connections as
+		// for the address and port it requested
+		var requested = request
+		var protocol = "tcp"
+		if req.Type == UDPForwardRequest {
+			protocol = "udp"
+		}
+		conn.options.setConfigTags(config.tagsFor(Fingerprint(ctx)))
+		var decision = srv.hooks.forwardRequest(ctx, conn.options, protocol, request.BindAddr, request.BindPort)
+		if decision.denied {
+			srv.authLog.failure(authHookDenied, sshConnection.RemoteAddr(), Fingerprint(ctx))
+			return false, []byte(decision.reason)
+		}
+		if decision.bindAddrSet {
+			request.BindAddr = decision.bindAddr
+		}
+		if decision.bindPortSet {
+			request.BindPort = decision.bindPort
+		}
+
+		// certificates may only bind what's permitted for their principal
+		if err = checkCertPermissions(ctx, request.BindAddr, request.BindPort); err != nil {
+			srv.authLog.failure(authBindDenied, sshConnection.RemoteAddr(), Fingerprint(ctx))
+			return false, []byte(err.Error())
+		}
+
+		// the listener the client connected on may restrict the ports it forwards (but not the edges' virtual ones)
+		var listener = listenerOf(ctx)
+		var edge = req.Type != UDPForwardRequest &&
+			((request.BindPort == httpPort && srv.router != nil) || (request.BindPort == tlsPort && srv.sni != nil))
+		if !edge && !listener.allowsPort(request.BindPort) {
+			srv.authLog.failure(authBindDenied, sshConnection.RemoteAddr(), Fingerprint(ctx))
+			return false, []byte(fmt.Sprintf("port %d is outside the range allowed on this listener (%s)", request.BindPort, listener.config.Ports))
+		}
+
+		// the user's permission profile may restrict the kinds of tunnels, and the ports, it forwards
+		var profile = srv.profiles.of(Fingerprint(ctx))
+		var kind = forwardTCP
+		switch {
+		case req.Type == UDPForwardRequest:
+			kind = forwardUDP
+		case request.BindPort == httpPort && srv.router != nil:
+			kind = forwardHTTP
+		case request.BindPort == tlsPort && srv.sni != nil:
+			kind = forwardTLS
+		}
+		if err = profile.allows(kind); err == nil && !edge && !profile.allowsPort(request.BindPort) {
+			err = errors.Errorf("port %d is not allowed (profile %q)", request.BindPort, profile.name)
+		}
+		if err != nil {
+			srv.authLog.failure(authBindDenied, sshConnection.RemoteAddr(), Fingerprint(ctx))
+			return false, []byte(err.Error())
+		}
+
+		// consult the authorizer (if any) before binding anything
+		if srv.authorizer != nil {
+			var fp = Fingerprint(ctx)
+			if err = srv.authorizer.CanConnect(fp); err != nil {
+				srv.authLog.failure(authUnauthorized, sshConnection.RemoteAddr(), fp)
+				return false, []byte(err.Error())
+			}
+
+			if err = srv.authorizer.CanBind(fp, request.BindAddr, request.BindPort); err != nil {
+				srv.authLog.failure(authBindDenied, sshConnection.RemoteAddr(), fp)
+				return false, []byte(err.Error())
+			}
+		}
+
+		// account for the tunnel in the key's quota
+		var fingerprint = Fingerprint(ctx)
+		if err = srv.quotas.AcquireTunnel(fingerprint); err != nil {
+			return false, []byte(err.Error())
+		}
+		defer func() {
+			if !ok {
+				srv.quotas.ReleaseTunnel(fingerprint)
+			}
+		}()
+
+		// and in what its profile allows
+		var limiter *bandwidthLimiter
+		if limiter, err = srv.profiles.acquireTunnel(fingerprint); err != nil {
+			return false, []byte(err.Error())
+		}
+		defer func() {
+			if !ok {
+				srv.profiles.releaseTunnel(fingerprint)
+			}
+		}()
+
+		// tunnels of clients which named them (with --name) are known by their name, and regain the endpoints they had
+		var alias, aliasName string
+		if conn.options.awaitParsed(optionsSettleTime); conn.options.Name() != "" {
+			alias = conn.options.Name()
+			if err = srv.aliases.claim(alias, fingerprint); err != nil {
+				return false, []byte(err.Error())
+			}
+			aliasName = aliasedTunnelName(alias, int(atomic.AddInt32(&conn.named, 1)))
+		}
+
+		// the tunnel's tags, as they are once it's requested (see tags.go)
+		var tags = conn.options.Tags()
+
+		// traffic through the tunnel, and helper to describe it in lifecycle events
+		var stats = newTunnelStats()
+		var event = func(typ, address string) TunnelEvent {
+			var e = newTunnelEvent(typ, Fingerprint(ctx), sshConnection.RemoteAddr().String(), address, stats)
+			e.Name, e.Tags = aliasName, tags
+			return e
+		}
+
+		// pauses the tunnel's traffic while it's quarantined
+		var q = newQuarantine()
+
+		// UDP tunnels carry each flow of datagrams over channels of their own type (whose traffic isn't mirrored)
+		var udp = req.Type == UDPForwardRequest
+		var channelType = tcpipForwardIncomingConnectionRequest
+		var mirror = &tunnelMirror{}
+		if udp {
+			channelType, mirror = UDPForwardChannel, nil
+		}
+
+		// bounds the channels being opened with the client at once
+		var pending = &pendingOpens{}
+
+		// helper to open a new ssh channel to handle new incoming connection on [destPort]
+		var channelOpener = func(destPort uint32) newChannelFn {
+			return q.gate(mirror.tapping(destPort, stats.counting(limiter.throttled(srv.quotas.limited(fingerprint, trace.tracing(pending.limit(config.MaxPendingOpens, config.PendingOpenWait, conn.options, openWithin(config.ChannelOpenTimeout, func(addr, port string) (gossh.Channel, <-chan *gossh.Request, error) {
+				p, _ := strconv.Atoi(port)
+				var requestedPort = destPort
+				if requested.BindPort != 0 {
+					requestedPort = requested.BindPort
+				}
+				var forward = struct {
+					DestAddr   string
+					DestPort   uint32
+					OriginAddr string
+					OriginPort uint32
+				}{
+					DestAddr: requested.BindAddr, DestPort: requestedPort, // as requested by the client (see RFC 4254 § 7.2)
+					OriginAddr: addr, OriginPort: uint32(p),
+				}
+
+				atomic.AddInt64(&srv.forwarded.opening, 1)
+				defer atomic.AddInt64(&srv.forwarded.opening, -1)
+				return sshConnection.OpenChannel(channelType, gossh.Marshal(&forward))
+			}))))))))
+		}
+
+		// helper to send notification messages to client
+		var notifier notifyFn = conn.Notify
+		if aliasName != "" {
+			notifier = namedNotifier(notifier, aliasName)
+		}
+
+		// serve functions run the tunnel until the given context is done
+		var serves []func(ctx context.Context)
+
+		// destination port could be different in case request.BindPort was '0' (zero)
+		var destPort uint32
+
+		// public address of the tunnel
+		var address string
+
+		// the tunnel registered with the HTTP edge; nil for TCP tunnels
+		var edgeTunnel *httpTunnel
+
+		// holds the tunnel's endpoint for the client in [g], in case it reconnects after going away
+		var holdEndpoint func(g *graceHolds)
+
+		// the HTTP or TCP endpoint the tunnel serves, and the tunnel's part in it (see balancer.go). [joined] is set
+		// if the endpoint was opened by another client.
+		var endpoint *balancedEndpoint
+		var member *balancedMember
+		var joined bool
+
+		switch {
+		case udp && srv.portPolicy.AllowPort(ctx, request.BindPort):
+			if owner := srv.store.PortOwner(request.BindPort); request.BindPort != 0 && owner != "" && owner != fingerprint {
+				return false, []byte(fmt.Sprintf("port %d is reserved", request.BindPort))
+			}
+
+			var host string
+			if host, err = config.bindAddrFor(fingerprint, request.BindAddr); err != nil {
+				return false, []byte(err.Error())
+			}
+
+			var pc net.PacketConn
+			var bind = func(port uint32) (err error) {
+				pc, err = udpListen(config, host, port)
+				return err
+			}
+
+			// random ports are picked in the listener's range, or in the ranges the user's profile allows, as for TCP
+			switch {
+			case request.BindPort == 0 && listener.restrictsPorts():
+				if !bindCandidate(ctx, srv, request.BindAddr, listener.ports.candidates(listener.seed(fingerprint)), bind) {
+					return false, []byte(fmt.Sprintf("no free port in the range allowed on this listener (%s)", listener.config.Ports))
+				}
+			case request.BindPort == 0 && profile.restrictsPorts():
+				if !bindCandidate(ctx, srv, request.BindAddr, profile.candidates(fingerprint), bind) {
+					return false, []byte(fmt.Sprintf("no free port in the ranges allowed by profile %q (%s)", profile.name, strings.Join(profile.Ports, ", ")))
+				}
+			default:
+				if err = bind(request.BindPort); err != nil {
+					return false, []byte(srv.bindFailure("UDP", host, request.BindPort, fingerprint, err))
+				}
+			}
+			address = "udp://" + publicAddress(config, pc.LocalAddr())
+			notifier(fmt.Sprintf("forwarding UDP traffic from %s", address), kv("type", "forwarding"), kv("protocol", "udp"), kv("address", address))
+
+			destPort = uint32(pc.LocalAddr().(*net.UDPAddr).Port)
+			holdEndpoint = func(*graceHolds) {} // UDP ports aren't held for reconnecting clients
+
+			var newChannel = channelOpener(destPort)
+			serves = append(serves, func(ctx context.Context) {
+				if err := udpForwardHandler(ctx, pc, notifier, newChannel, conn.options, srv.forwarded); err != nil {
+					notifier(fmt.Sprintf("error occurred while processing: %s", err.Error()), kv("type", "error"), kv("error", err.Error()))
+
+					var e = event(TunnelError, address)
+					e.Error = err.Error()
+					srv.emit(e)
+				}
+			})
+
+		case udp:
+			return false, []byte(portNotAllowed("UDP", request.BindPort))
+
+		case request.BindPort == httpPort && srv.router != nil:
+			var name = strings.ToLower(request.BindAddr)
+			if isWildcardBindAddr(name) { // use the name asked for with --subdomain, if any
+				conn.options.awaitParsed(optionsSettleTime)
+				name = conn.options.Subdomain()
+			}
+
+			// names with dots are custom domains, which must have been verified by the key (see domains.go)
+			var custom = strings.Contains(name, ".")
+			if custom {
+				if domain, err := parseCustomDomain(name, srv.router.domain); err != nil {
+					return false, []byte(err.Error())
+				} else if name = domain; !srv.domains.VerifiedBy(name, fingerprint) || srv.router.isDenied(name) {
+					return false, []byte(fmt.Sprintf("domain %s is not verified for your key (see domain add)", name))
+				}
+			}
+
+			if owner := srv.store.NameOwner(name); name != "" && owner != "" && owner != Fingerprint(ctx) {
+				return false, []byte(fmt.Sprintf("name %q is reserved", name))
+			}
+
+			// a reconnecting client regains the name it had
+			var reclaimed bool
+			if name == "" {
+				name = srv.aliases.heldName(alias, fingerprint, aliasName)
+				if reclaimed = name != ""; !reclaimed {
+					name = srv.grace.HeldName(fingerprint)
+				}
+			} else if holder := srv.grace.NameHolder(name); holder != "" && holder != fingerprint {
+				return false, []byte(fmt.Sprintf("name %q is held for a reconnecting client", name))
+			}
+
+			if !custom { // custom domains are the client's own
+				if err = profile.allowsName(name); err != nil {
+					return false, []byte(err.Error())
+				}
+			}
+
+			// clients asking for --balance share the name with the other clients using the same key
+			if endpoint = srv.balancers.joinable("http:"+name, fingerprint, conn.options); name != "" && endpoint != nil {
+				if member = endpoint.join(channelOpener(httpPort), notifier); member != nil {
+					address, edgeTunnel, destPort, joined = endpoint.address, endpoint.http, httpPort, true
+					holdEndpoint = func(g *graceHolds) { g.HoldName(name, fingerprint) }
+					break
+				}
+			}
+
+			endpoint = newBalancedEndpoint(fingerprint, conn.options)
+			member = endpoint.join(channelOpener(httpPort), notifier)
+
+			var tunnel *httpTunnel
+			if custom {
+				tunnel, err = srv.router.RegisterHost(name, endpoint.newChannel, endpoint.notify, conn.options, q)
+			} else if tunnel, err = srv.router.Register(name, endpoint.newChannel, endpoint.notify, conn.options, q); err != nil && reclaimed {
+				tunnel, err = srv.router.Register("", endpoint.newChannel, endpoint.notify, conn.options, q) // taken since
+			}
+			if err != nil {
+				return false, []byte(err.Error())
+			}
+
+			// the name is the node's, in a cluster
+			var tunnelName = strings.TrimSuffix(tunnel.host, "."+srv.router.domain)
+			if err = srv.cluster.claim("http:" + tunnelName); err != nil {
+				srv.router.Deregister(tunnel)
+				return false, []byte(err.Error())
+			}
+			address, edgeTunnel = "http://"+tunnel.host, tunnel
+
+			endpoint.key, endpoint.address, endpoint.http = "http:"+tunnelName, address, tunnel
+			srv.aliases.rememberEndpoint(alias, fingerprint, aliasName, "http:"+tunnelName)
+			srv.grace.ReleaseName(tunnelName)
+			holdEndpoint = func(g *graceHolds) { g.HoldName(tunnelName, fingerprint) }
+			notifier(fmt.Sprintf("forwarding HTTP traffic from %s", address), kv("type", "forwarding"), kv("protocol", "http"), kv("address", address))
+
+			destPort = httpPort
+			serves = append(serves, func(ctx context.Context) {
+				<-ctx.Done()
+				srv.router.Deregister(tunnel)
+				srv.cluster.release("http:" + tunnelName)
+				tunnel.Close()
+			})
+
+		case request.BindPort == tlsPort && srv.sni != nil:
+			var name = strings.ToLower(request.BindAddr)
+			if isWildcardBindAddr(name) { // use the name asked for with --subdomain, if any
+				conn.options.awaitParsed(optionsSettleTime)
+				name = conn.options.Subdomain()
+			}
+
+			if owner := srv.store.NameOwner(name); name != "" && owner != "" && owner != fingerprint {
+				return false, []byte(fmt.Sprintf("name %q is reserved", name))
+			}
+
+			if holder := srv.grace.NameHolder(name); name != "" && holder != "" && holder != fingerprint {
+				return false, []byte(fmt.Sprintf("name %q is held for a reconnecting client", name))
+			}
+
+			if err = profile.allowsName(name); err != nil {
+				return false, []byte(err.Error())
+			}
+
+			var tunnel *sniTunnel
+			if tunnel, err = srv.sni.Register(name, channelOpener(tlsPort), notifier, conn.options); err != nil {
+				return false, []byte(err.Error())
+			}
+			var tunnelName = strings.TrimSuffix(tunnel.host, "."+srv.sni.domain)
+			if err = srv.cluster.claim("tls:" + tunnelName); err != nil {
+				srv.sni.Deregister(tunnel)
+				return false, []byte(err.Error())
+			}
+			address = "tls://" + tunnel.host
+
+			srv.grace.ReleaseName(tunnelName)
+			holdEndpoint = func(g *graceHolds) { g.HoldName(tunnelName, fingerprint) }
+			notifier(fmt.Sprintf("forwarding TLS traffic for %s", address), kv("type", "forwarding"), kv("protocol", "tls"), kv("address", address))
+
+			destPort = tlsPort
+			serves = append(serves, func(ctx context.Context) {
+				<-ctx.Done()
+				srv.sni.Deregister(tunnel)
+				srv.cluster.release("tls:" + tunnelName)
+				tunnel.active.Wait()
+			})
+
+		case srv.portPolicy.AllowPort(ctx, request.BindPort):
+			if owner := srv.store.PortOwner(request.BindPort); request.BindPort != 0 && owner != "" && owner != Fingerprint(ctx) {
+				return false, []byte(fmt.Sprintf("port %d is reserved", request.BindPort))
+			}
+
+			if holder := srv.grace.PortHolder(request.BindPort); request.BindPort != 0 && holder != "" && holder != fingerprint {
+				return false, []byte(fmt.Sprintf("port %d is held for a reconnecting client", request.BindPort))
+			}
+
+			var host string
+			if host, err = config.bindAddrFor(fingerprint, request.BindAddr); err != nil {
+				return false, []byte(err.Error())
+			}
+
+			// clients asking for --balance share the port with the other clients using the same key
+			var key = "tcp:" + net.JoinHostPort(host, strconv.Itoa(int(request.BindPort)))
+			if endpoint = srv.balancers.joinable(key, fingerprint, conn.options); request.BindPort != 0 && endpoint != nil {
+				if member = endpoint.join(channelOpener(request.BindPort), notifier); member != nil {
+					address, destPort, joined = endpoint.address, request.BindPort, true
+					holdEndpoint = func(g *graceHolds) { g.HoldPort(destPort, fingerprint) }
+					break
+				}
+			}
+
+			// a reconnecting client regains the port it had
+			var ln net.Listener
+			if held := srv.aliases.heldPort(alias, fingerprint, aliasName); request.BindPort == 0 && held != 0 &&
+				listener.allowsPort(held) && canBind(ctx, srv, request.BindAddr, held) {
+				ln, _ = tcpListen(config, host, held)
+			}
+			if held := srv.grace.HeldPort(fingerprint); ln == nil && request.BindPort == 0 && held != 0 && listener.allowsPort(held) {
+				ln, _ = tcpListen(config, host, held)
+			}
+
+			var bind = func(port uint32) (err error) {
+				ln, err = tcpListen(config, host, port)
+				return err
+			}
+
+			// random ports are picked in the listener's range, if it has one
+			if ln == nil && request.BindPort == 0 && listener.restrictsPorts() {
+				if !bindCandidate(ctx, srv, request.BindAddr, listener.ports.candidates(listener.seed(fingerprint)), bind) {
+					return false, []byte(fmt.Sprintf("no free port in the range allowed on this listener (%s)", listener.config.Ports))
+				}
+			}
+
+			// or in the ranges the user's profile allows
+			if ln == nil && request.BindPort == 0 && profile.restrictsPorts() {
+				if !bindCandidate(ctx, srv, request.BindAddr, profile.candidates(fingerprint), bind) {
+					return false, []byte(fmt.Sprintf("no free port in the ranges allowed by profile %q (%s)", profile.name, strings.Join(profile.Ports, ", ")))
+				}
+			}
+
+			if ln == nil && request.BindPort == 0 && srv.stablePorts != nil && fingerprint != "" {
+				_ = bindCandidate(ctx, srv, request.BindAddr, srv.stablePorts.candidates(fingerprint), bind)
+			}
+
+			if ln == nil {
+				var listen = func() (net.Listener, error) { return tcpListen(config, host, request.BindPort) }
+				if ln, err = listenAvoidingHolds(srv.grace, fingerprint, listen); err != nil {
+					// clients asking for it wait for a taken port to free up
+					if request.BindPort == 0 || !conn.options.WaitForPort() || !isAddrInUse(err) {
+						return false, []byte(srv.bindFailure("TCP", host, request.BindPort, fingerprint, err))
+					}
+
+					var addr, _ = net.ResolveTCPAddr("tcp", net.JoinHostPort(host, strconv.Itoa(int(request.BindPort))))
+					if addr == nil {
+						addr = &net.TCPAddr{Port: int(request.BindPort)}
+					}
+					if ln, err = srv.portQueues.enqueue(request.BindPort, addr, fingerprint, srv.grace, notifier, listen); err != nil {
+						return false, []byte(err.Error())
+					}
+				}
+			}
+			_, destPortStr, _ := net.SplitHostPort(ln.Addr().String())
+			p, _ := strconv.Atoi(destPortStr)
+			destPort = uint32(p)
+
+			// the port is the node's, in a cluster
+			if err = srv.cluster.claim("tcp:" + destPortStr); err != nil {
+				_ = ln.Close()
+				return false, []byte(err.Error())
+			}
+
+			address = publicAddress(config, ln.Addr())
+			var forwarding = func() {
+				notifier(fmt.Sprintf("forwarding TCP traffic from %s", address), kv("type", "forwarding"), kv("protocol", "tcp"), kv("address", address))
+			}
+			if queued, ok := ln.(*queuedListener); ok {
+				queued.whenGranted(func() {
+					stats.active() // a tunnel isn't idle while it waits for its port
+					forwarding()
+				})
+			} else {
+				forwarding()
+			}
+
+			srv.grace.ReleasePort(destPort)
+			holdEndpoint = func(g *graceHolds) { g.HoldPort(destPort, fingerprint) }
+			srv.aliases.rememberEndpoint(alias, fingerprint, aliasName, "tcp:"+strconv.Itoa(int(destPort)))
+
+			endpoint = newBalancedEndpoint(fingerprint, conn.options)
+			member = endpoint.join(channelOpener(destPort), notifier)
+			endpoint.key, endpoint.address = "tcp:"+net.JoinHostPort(host, strconv.Itoa(int(destPort))), address
+
+			var serve = func(ln net.Listener, listen func() (net.Listener, error)) func(ctx context.Context) {
+				return func(ctx context.Context) {
+					if err := tcpipForwardConnectionHandler(ctx, ln, listen, endpoint.notify, endpoint.newChannel, conn.options, srv.forwarded); err != nil {
+						endpoint.notify(fmt.Sprintf("error occurred while processing: %s", err.Error()), kv("type", "error"), kv("error", err.Error()))
+
+						var e = event(TunnelError, address)
+						e.Error = err.Error()
+						srv.emit(e)
+					}
+				}
+			}
+
+			// helper to re-create the listener on the same address in case it fails
+			serves = append(serves, serve(ln, func() (net.Listener, error) {
+				return tcpListen(config, host, destPort)
+			}))
+			serves = append(serves, func(ctx context.Context) {
+				<-ctx.Done()
+				srv.cluster.release("tcp:" + destPortStr)
+			})
+
+			// additionally expose the tunnel on a server-local unix socket, for sidecars on the same host
+			if config.UnixSocketDir != "" && profile.allows(forwardUnix) == nil {
+				var socketPath = unixSocketPath(config.UnixSocketDir, destPort)
+				var unixLn net.Listener
+				if unixLn, err = unixListen(socketPath); err != nil {
+					_ = ln.Close()
+					srv.cluster.release("tcp:" + destPortStr)
+					return false, []byte(fmt.Sprintf("failed to create unix socket: %s", err.Error()))
+				}
+				notifier(fmt.Sprintf("forwarding unix socket traffic from %s", socketPath), kv("type", "forwarding"), kv("protocol", "unix"), kv("address", socketPath))
+
+				serves = append(serves, serve(unixLn, func() (net.Listener, error) {
+					return unixListen(socketPath)
+				}))
+			}
+
+		default:
+			return false, []byte(portNotAllowed("TCP", request.BindPort))
+		}
+
+		// the endpoint runs for as long as any of the clients serving it is connected; each of them leaves it when
+		// its tunnel closes (the last one closing it)
+		if endpoint != nil {
+			if joined {
+				var protocol = "tcp"
+				if edgeTunnel != nil {
+					protocol = "http"
+				}
+				notifier(fmt.Sprintf("forwarding %s traffic from %s (shared by %d clients)", strings.ToUpper(protocol), address, endpoint.size()),
+					kv("type", "forwarding"), kv("protocol", protocol), kv("address", address), kv("clients", endpoint.size()))
+
+				// the tunnel is listed (eg. in the admin API and metrics) under an address (and name) of its own
+				address = fmt.Sprintf("%s#%d", address, member.id)
+				if aliasName != "" {
+					aliasName = fmt.Sprintf("%s#%d", aliasName, member.id)
+				}
+			} else {
+				for _, serve := range serves {
+					endpoint.serve(serve)
+				}
+				srv.balancers.add(endpoint)
+			}
+
+			var hold = holdEndpoint
+			holdEndpoint = func(g *graceHolds) {
+				if g != srv.grace || endpoint.isClosed() { // only the last client to leave holds the endpoint
+					hold(g)
+				}
+			}
+
+			serves = []func(ctx context.Context){func(ctx context.Context) {
+				<-ctx.Done()
+				if endpoint.leave(member); endpoint.isClosed() {
+					srv.balancers.remove(endpoint)
+				}
+			}}
+		}
+
+		// keep an eye on whether the tunnel is held back by flow control
+		if config.FlowControlInterval > 0 {
+			serves = append(serves, func(ctx context.Context) {
+				monitorFlow(ctx, sshConnection, stats, notifier, config.FlowControlInterval)
+			})
+		}
+
+		// tunnels are labelled with their name in metrics, if the client named them
+		var label = address
+		if aliasName != "" {
+			label = aliasName
+		}
+
+		// periodically report the traffic through the tunnel
+		if config.StatsInterval > 0 {
+			serves = append(serves, func(ctx context.Context) {
+				stats.report(ctx, address, label, srv.metrics, notifier, config.StatsInterval)
+			})
+		}
+
+		// the tunnel runs (as part of the connection) until the client goes away or the server begins shutting down
+		var tunnel = newGroup(conn.group.ctx)
+		tunnel.Go(func(ctx context.Context) error {
+			select {
+			case <-srv.shutdown:
+				tunnel.Cancel()
+				notifier("server is shutting down; no new connections will be accepted", kv("type", "shutdown"))
+			case <-ctx.Done():
+			}
+			return nil
+		})
+
+		// close the tunnel once it expires, if it does
+		var ttl = tunnelTTL(conn.options.TTL(), config.MaxTunnelTTL)
+		if ttl > 0 {
+			tunnel.Go(func(ctx context.Context) error {
+				expire(ctx, address, stats.started, ttl, notifier, tunnel.Cancel)
+				return nil
+			})
+		}
+
+		// close the tunnel once it's had no visitors for a while, if the operator asked for it
+		if config.TunnelIdleTimeout > 0 {
+			tunnel.Go(func(ctx context.Context) error {
+				stats.reap(ctx, address, config.TunnelIdleTimeout, notifier, tunnel.Cancel)
+				return nil
+			})
+		}
+
+		// fail traffic paused by a quarantine once the tunnel is closing, so that it needn't wait for it, and stop
+		// mirroring it
+		tunnel.Go(func(ctx context.Context) error {
+			<-ctx.Done()
+			q.Close()
+			mirror.stop()
+			return nil
+		})
+
+		for _, serve := range serves {
+			var serve = serve
+			tunnel.Go(func(ctx context.Context) error {
+				serve(ctx)
+				return nil
+			})
+		}
+
+		var open = &openTunnel{
+			address: address, name: aliasName, fingerprint: fingerprint, client: sshConnection.RemoteAddr().String(),
+			stats: stats, quarantine: q, mirror: mirror, options: conn.options, http: edgeTunnel, notify: notifier, terminate: tunnel.Cancel,
+			hold: holdEndpoint, tags: tags, ttl: ttl,
+			event: func(typ string) TunnelEvent { return event(typ, address) },
+		}
+		srv.tunnels.add(open)
+
+		audit.Address, audit.Name = address, aliasName
+		srv.audit.record(audit)
+
+		trace.set("shhh.address", address)
+		if aliasName != "" {
+			trace.set("shhh.name", aliasName)
+		}
+
+		conn.tunnelStarted(address)
+		srv.emit(event(TunnelOpened, address))
+		srv.metrics.opened(label, stats, tags)
+		if srv.quotas.enabled() {
+			notifier("quota: "+srv.quotas.Describe(fingerprint), kv("type", "quota"))
+		}
+		if profile != nil {
+			notifier("profile: "+profile.String(), kv("type", "profile"))
+		}
+		if len(tags) > 0 {
+			notifier("tags: "+formatTags(tags), kv("type", "tags"), kv("tags", tags))
+		}
+		if ttl > 0 {
+			var expires = stats.started.Add(ttl).UTC()
+			notifier(fmt.Sprintf("ttl: %s expires at %s (in %s)", address, expires.Format(time.RFC3339), ttl), kv("type", "ttl"),
+				kv("address", address), kv("expires_at", expires))
+		}
+		conn.group.Go(func(context.Context) error {
+			_ = tunnel.Wait()
+			srv.tunnels.remove(open)
+			srv.emit(event(TunnelClosed, address))
+			srv.metrics.closed(label, stats, tags)
+			srv.usage.closed(fingerprint, tags, stats)
+			var s = stats.snapshot()
+			trace.set("shhh.connections", s.connections)
+			trace.set("shhh.bytes_in", s.bytesIn)
+			trace.set("shhh.bytes_out", s.bytesOut)
+			trace.finish()
+			notifier(fmt.Sprintf("tunnel %s closed: %s", address, stats), kv("type", "tunnel.closed"), kv("address", address),
+				kv("connections", s.connections), kv("bytes_in", s.bytesIn), kv("bytes_out", s.bytesOut))
+			srv.quotas.ReleaseTunnel(fingerprint)
+			srv.profiles.releaseTunnel(fingerprint)
+			conn.tunnelDone(address) // to close the session as well (if it's the last tunnel)
+
+			// disconnect drained clients (eg. ones without a session, like ssh -N) so that shutdown needn't wait for them
+			select {
+			case <-srv.shutdown:
+				if conn.idle() {
+					time.Sleep(100 * time.Millisecond) // give the session a moment to flush remaining messages
+					_ = sshConnection.Close()
+				}
+			default: // the client went away
+				holdEndpoint(srv.grace)
+			}
+			return nil
+		})
+
+		var response = struct{ BindPort uint32 }{destPort}
+		return true, gossh.Marshal(&response)
+	}
+}
+
+// tcpipForwardConnectionHandler handles request cycle for a port forwarded connection.
+// It listens for, accepts and handles connection processing until [ctx] is done, after which
+// it waits for in-flight connections to finish before returning. If the listener fails
+// unexpectedly, it is re-created using [listen] and the client is notified of the gap. If the client
+// requested so in [options], a PROXY protocol header is prepended on each new channel, and connections over its
+// --max-conns are closed right away. Connections are tracked in [forwarded].
+func tcpipForwardConnectionHandler(ctx context.Context, ln net.Listener, listen func() (net.Listener, error),
+	notify notifyFn, newChannel newChannelFn, options *sessionOptions, forwarded *forwardedConns) error {
+
+	// the accept loop, the closing of the listener and in-flight connections make up a group;
+	// it's waited on (ie. connections are drained) before returning
+	var g = newGroup(ctx)
+
+	// number of connections being forwarded, limited by --max-conns
+	var active int32
+
+	// close (current) listener once the ssh connection is closed (or the tunnel is shutting down)
+	var mu sync.Mutex
+	g.Go(func(ctx context.Context) error {
+		<-ctx.Done()
+		mu.Lock()
+		defer mu.Unlock()
+		_ = ln.Close()
+		return nil
+	})
+
+	g.Go(func(ctx context.Context) error {
+		for { // process connections for eternity...
+			var err error
+
+			// accept a new connection
+			var conn net.Conn
+			if conn, err = ln.Accept(); err != nil {
+				if ctx.Err() != nil {
+					return nil // listener was closed as the ssh connection went away or the server is shutting down
+				}
+
+				if oe, ok := err.(*net.OpError); ok {
+					if oe.Timeout() || oe.Temporary() {
+						continue
+					}
+				}
+
+				var addr = ln.Addr().String()
+				notify(fmt.Sprintf("listener on %s failed (%s); attempting to rebind", addr, err.Error()),
+					kv("type", "listener.failed"), kv("address", addr), kv("error", err.Error()))
+				_ = ln.Close()
+
+				var start = time.Now()
+				var newLn net.Listener
+				if newLn, err = rebindListener(ctx, listen); err != nil {
+					if ctx.Err() != nil {
+						return nil
+					}
+					return errors.Wrap(err, "failed to accept new connection")
+				}
+
+				mu.Lock()
+				ln = newLn
+				mu.Unlock()
+
+				if ctx.Err() != nil { // connection went away while we were rebinding
+					_ = ln.Close()
+					return nil
+				}
+
+				notify(fmt.Sprintf("listener on %s restored after %s; connections during this time were lost",
+					addr, time.Since(start).Round(time.Millisecond)), kv("type", "listener.restored"), kv("address", addr))
+				continue
+			}
+
+			if max := maxConns(options); max > 0 && atomic.LoadInt32(&active) >= int32(max) {
+				forwarded.metrics.connectionDenied("max_conns")
+				if options.Verbose() {
+					notify(fmt.Sprintf("denied connection from %s: over the limit of %d connections", conn.RemoteAddr().String(), max),
+						kv("type", "connection.denied"), kv("visitor", conn.RemoteAddr().String()), kv("reason", "max_conns"))
+				}
+				_ = conn.Close()
+				continue
+			}
+
+			atomic.AddInt32(&active, 1)
+			g.Go(func(context.Context) error {
+				defer atomic.AddInt32(&active, -1)
+				forwardConnection(conn, notify, newChannel, options, forwarded)
+				return nil
+			})
+		}
+	})
+
+	return g.Wait()
+}
+
+// maxConns returns the --max-conns of [options], or 0 (unlimited) if there are no options
+func maxConns(options *sessionOptions) int {
+	if options == nil {
+		return 0
+	}
+	return options.MaxConns()
+}
+
+// forwardConnection opens a new ssh channel using [newChannel] and forwards traffic between it and [conn].
+// It blocks until the traffic in both directions has been forwarded, and reports why the connection ended to [forwarded]
+// (and to the client, if it asked for verbose notifications).
+func forwardConnection(conn net.Conn, notify notifyFn, newChannel newChannelFn, options *sessionOptions, forwarded *forwardedConns) {
+	var err error
+
+	// connections which can't be set up in time (eg. as the visitor or the client stalls) are closed
+	var setup = startSetup(forwarded.setupTimeout, conn)
+	defer setup.done()
+	var setupFailed = func() {
+		notify(fmt.Sprintf("connection from %s failed: not set up within %s", conn.RemoteAddr().String(), forwarded.setupTimeout),
+			kv("type", "error"), kv("visitor", conn.RemoteAddr().String()), kv("error", "setup timed out"))
+	}
+
+	// reject connections with a missing / malformed PROXY protocol header
+	if pc, ok := conn.(*proxyProtocolConn); ok {
+		if err = pc.Err(); err != nil {
+			notify(fmt.Sprintf("rejected connection from %s: %s", conn.RemoteAddr().String(), err.Error()),
+				kv("type", "connection.rejected"), kv("visitor", conn.RemoteAddr().String()), kv("error", err.Error()))
+			_ = conn.Close()
+			return
+		}
+	}
+
+	var country, admitted = forwarded.admit(conn.RemoteAddr(), conn.LocalAddr(), options)
+	if !admitted {
+		if options != nil && options.Verbose() {
+			notify(fmt.Sprintf("denied connection from %s", describeVisitor(conn.RemoteAddr(), country)),
+				kv("type", "connection.denied"), kv("visitor", conn.RemoteAddr().String()), kv("country", country))
+		}
+		_ = conn.Close()
+		return
+	}
+
+	var addr, port string
+	if _, unix := conn.LocalAddr().(*net.UnixAddr); unix {
+		notify(fmt.Sprintf("accepted connection on unix socket %s", conn.LocalAddr().String()),
+			kv("type", "connection.accepted"), kv("socket", conn.LocalAddr().String()))
+	} else {
+		addr, port, _ = net.SplitHostPort(conn.RemoteAddr().String())
+		notify(fmt.Sprintf("accepted connection from %s", describeVisitor(conn.RemoteAddr(), country)),
+			kv("type", "connection.accepted"), kv("visitor", conn.RemoteAddr().String()), kv("country", country))
+
+		// the banner would corrupt TLS connections forwarded by the TLS edge
+		if _, tls := conn.(*peekedConn); !tls && forwarded.banner != nil && options != nil && options.Banner() {
+			if err = writeBanner(conn, forwarded.banner); err != nil {
+				if !setup.done() {
+					setupFailed()
+				}
+				_ = conn.Close()
+				return
+			}
+		}
+	}
+
+	// the operator's middleware may filter (or just watch) the traffic
+	var filtered net.Conn
+	if filtered, err = forwarded.middleware.conn(conn); err != nil {
+		forwarded.metrics.connectionDenied("middleware")
+		if options != nil && options.Verbose() {
+			notify(fmt.Sprintf("denied connection from %s: %s", conn.RemoteAddr().String(), err.Error()),
+				kv("type", "connection.denied"), kv("visitor", conn.RemoteAddr().String()), kv("reason", "middleware"))
+		}
+		_ = conn.Close()
+		return
+	}
+	conn = filtered
+
+	// open new channel to forward traffic
+	var channel gossh.Channel
+	var requests <-chan *gossh.Request
+	if channel, requests, err = newChannel(addr, port); err != nil {
+		if err == errQuarantined {
+			forwarded.metrics.connectionDenied("quarantine")
+		} else if err == errTooManyPendingOpens {
+			forwarded.metrics.connectionDenied("pending_opens")
+			if options != nil && options.Verbose() {
+				notify(fmt.Sprintf("denied connection from %s: too many connections waiting for a channel", conn.RemoteAddr().String()),
+					kv("type", "connection.denied"), kv("visitor", conn.RemoteAddr().String()), kv("reason", "pending_opens"))
+			}
+		} else {
+			notify(fmt.Sprintf("error occurred while processing: %s", err.Error()), kv("type", "error"), kv("error", err.Error()))
+		}
+		_ = conn.Close()
+		return
+	}
+
+	// we don't need to serve any request on the new channel
+	go gossh.DiscardRequests(requests)
+	setup.track(channel)
+
+	// let the client's local service know about the real source of the connection
+	if options != nil {
+		if err = writeProxyHeader(channel, options.ProxyProtocol(), conn.RemoteAddr(), conn.LocalAddr()); err != nil {
+			notify(fmt.Sprintf("error occurred while processing: %s", err.Error()), kv("type", "error"), kv("error", err.Error()))
+			_ = channel.Close()
+			_ = conn.Close()
+			return
+		}
+	}
+
+	if !setup.done() {
+		setupFailed()
+		_ = channel.Close()
+		_ = conn.Close()
+		return
+	}
+
+	var fc = forwarded.add(conn, country, channel)
+
+	// copy in both directions; whichever finishes first decides why the connection ended, and has both ends closed
+	// so that the other one returns as well. A visitor which is only done sending (ie. which half-closed its
+	// connection) still gets its answer though: the client is told there's nothing more to read, and the connection
+	// ends once the other direction does.
+	type result struct {
+		fromVisitor bool
+		err         error
+	}
+	var results = make(chan result, 2)
+	var in, out int64
+
+	var copies = newGroup(context.Background())
+	var stalls = watchStalls(forwarded.stallIn, forwarded.stallOut)
+	var start = func(n *int64, dst io.Writer, src io.Reader, fromVisitor bool) {
+		atomic.AddInt64(&forwarded.copies, 1)
+		copies.Go(func(context.Context) error {
+			defer atomic.AddInt64(&forwarded.copies, -1)
+			var err error
+			*n, err = pipelinedCopy(dst, stalls.reader(src, fromVisitor))
+			results <- result{fromVisitor: fromVisitor, err: err}
+			return nil
+		})
+	}
+	start(&in, channel, conn, true)
+	start(&out, conn, channel, false)
+	if stalls != nil {
+		copies.Go(func(ctx context.Context) error { stalls.run(ctx, channel, conn); return nil })
+	}
+
+	var first = <-results
+	if first.fromVisitor && first.err == nil && channel.CloseWrite() == nil {
+		stalls.finishedIn()
+		<-results
+	}
+	_ = channel.Close()
+	_ = conn.Close()
+	copies.Cancel()
+	_ = copies.Wait()
+
+	var reason = closeReason(first.fromVisitor, first.err)
+	var stalled = stalls.stalledDirection()
+	if stalled != "" {
+		reason = closeStalled
+	}
+
+	reason = forwarded.done(fc, reason, in, out)
+	if reason == closeStalled {
+		notify(fmt.Sprintf("connection from %s closed: %s", conn.RemoteAddr().String(), stalled),
+			kv("type", "connection.closed"), kv("visitor", conn.RemoteAddr().String()), kv("reason", reason),
+			kv("bytes_in", in), kv("bytes_out", out), kv("duration_ms", time.Since(fc.started).Milliseconds()))
+	} else if options != nil && options.Verbose() {
+		notify(fmt.Sprintf("connection from %s %s", conn.RemoteAddr().String(), describeClose(reason, in, out, time.Since(fc.started))),
+			kv("type", "connection.closed"), kv("visitor", conn.RemoteAddr().String()), kv("reason", reason),
+			kv("bytes_in", in), kv("bytes_out", out), kv("duration_ms", time.Since(fc.started).Milliseconds()))
+	}
+}
+
+// setupDeadline closes both ends of a forwarded connection (the visitor's connection, and the channel with the
+// client) if it isn't set up in time. A nil *setupDeadline never expires.
+type setupDeadline struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	ends    []io.Closer
+	expired bool
+}
+
+// startSetup starts the setup of the connection with [visitor], which has to be done within [timeout] (or returns
+// nil if [timeout] is 0)
+func startSetup(timeout time.Duration, visitor net.Conn) *setupDeadline {
+	if timeout <= 0 {
+		return nil
+	}
+
+	var sd = &setupDeadline{ends: []io.Closer{visitor}}
+	sd.timer = time.AfterFunc(timeout, func() {
+		sd.mu.Lock()
+		defer sd.mu.Unlock()
+		sd.expired = true
+		for _, end := range sd.ends {
+			_ = end.Close()
+		}
+	})
+	return sd
+}
+
+// track has [end] closed as well if the setup expires (or closes it right away if it has already)
+func (sd *setupDeadline) track(end io.Closer) {
+	if sd == nil {
+		return
+	}
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	if sd.expired {
+		_ = end.Close()
+		return
+	}
+	sd.ends = append(sd.ends, end)
+}
+
+// done marks the setup as done. It returns false if it had expired already.
+func (sd *setupDeadline) done() bool {
+	if sd == nil {
+		return true
+	}
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	sd.timer.Stop()
+	return !sd.expired
+}
+
+// canBind returns true if the client with [ctx] is allowed to bind the specific [port] on [addr], as decided by
+// the server's port policy, its listener's port range, reservations, grace holds, certificate permissions, the user's
+// permission profile and Authorizer
+func canBind(ctx ssh.Context, srv *Server, addr string, port uint32) bool {
+	var fingerprint = Fingerprint(ctx)
+	if !srv.portPolicy.AllowPort(ctx, port) || !listenerOf(ctx).allowsPort(port) {
+		return false
+	}
+
+	if owner := srv.store.PortOwner(port); owner != "" && owner != fingerprint {
+		return false
+	}
+
+	if holder := srv.grace.PortHolder(port); holder != "" && holder != fingerprint {
+		return false
+	}
+
+	if checkCertPermissions(ctx, addr, port) != nil || !srv.profiles.of(fingerprint).allowsPort(port) {
+		return false
+	}
+
+	return srv.authorizer == nil || srv.authorizer.CanBind(fingerprint, addr, port) == nil
+}
+
+// bindCandidate binds the first of the [candidates] ports the client with [ctx] may bind on [addr] (see canBind),
+// using [bind]. It returns false if none of them could be bound.
+func bindCandidate(ctx ssh.Context, srv *Server, addr string, candidates []uint32, bind func(port uint32) error) bool {
+	for _, port := range candidates {
+		if canBind(ctx, srv, addr, port) && bind(port) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// listenAvoidingHolds invokes [listen] until the listener it returns isn't on a port held for a key other than
+// the one with [fingerprint] (which can happen when listening on a random port)
+func listenAvoidingHolds(holds *graceHolds, fingerprint string, listen func() (net.Listener, error)) (net.Listener, error) {
+	for attempt := 1; ; attempt++ {
+		ln, err := listen()
+		if err != nil {
+			return nil, err
+		}
+
+		_, port, _ := net.SplitHostPort(ln.Addr().String())
+		p, _ := strconv.Atoi(port)
+		if holder := holds.PortHolder(uint32(p)); holder == "" || holder == fingerprint || attempt >= listenAttempts {
+			return ln, nil
+		}
+		_ = ln.Close()
+	}
+}
@@ -0,0 +1,365 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"math"
+	"net"
+	"strings"
+)
+
+// ----------
+// This file contains a minimal reader of MaxMind DB files (eg. GeoLite2-Country.mmdb), used to look up the country
+// of visitors. See https://maxmind.github.io/MaxMind-DB/ for the format.
+// ----------
+
+// marks the beginning of the metadata section, near the end of the file
+var geoIPMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// geoIPDB is a MaxMind DB loaded in memory
+type geoIPDB struct {
+	buf []byte
+
+	nodeCount  uint64
+	recordSize uint64
+	ipVersion  uint64
+
+	dataStart int    // offset of the data section in buf
+	ipv4Start uint64 // node at which IPv4 addresses start in an IPv6 tree
+}
+
+// openGeoIPDB reads the MaxMind DB file at [path]
+func openGeoIPDB(path string) (*geoIPDB, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read geoip database")
+	}
+
+	var i = bytes.LastIndex(buf, geoIPMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("invalid geoip database: metadata not found")
+	}
+
+	var db = &geoIPDB{buf: buf}
+	metadata, _, err := db.decode(buf[i+len(geoIPMetadataMarker):], 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid geoip database metadata")
+	}
+
+	var fields, _ = metadata.(map[string]interface{})
+	db.nodeCount, _ = fields["node_count"].(uint64)
+	db.recordSize, _ = fields["record_size"].(uint64)
+	db.ipVersion, _ = fields["ip_version"].(uint64)
+
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, errors.Errorf("invalid geoip database: unsupported record size %d", db.recordSize)
+	}
+
+	var treeSize = db.nodeCount * db.recordSize / 4
+	if treeSize+16 > uint64(i) {
+		return nil, errors.New("invalid geoip database: search tree is truncated")
+	}
+	db.dataStart = int(treeSize) + 16 // the tree is followed by 16 zero bytes
+
+	// IPv4 addresses live at ::a.b.c.d in IPv6 trees
+	if db.ipVersion == 6 {
+		for i := 0; i < 96 && db.ipv4Start < db.nodeCount; i++ {
+			db.ipv4Start, _ = db.record(db.ipv4Start, 0)
+		}
+	}
+
+	return db, nil
+}
+
+// Country returns the ISO code of the country [ip] is located in (or registered to), or empty if it isn't known
+func (db *geoIPDB) Country(ip net.IP) string {
+	var record, err = db.lookup(ip)
+	if err != nil || record == nil {
+		return ""
+	}
+
+	for _, key := range []string{"country", "registered_country"} {
+		if country, ok := record[key].(map[string]interface{}); ok {
+			if code, ok := country["iso_code"].(string); ok && code != "" {
+				return strings.ToUpper(code)
+			}
+		}
+	}
+	return ""
+}
+
+// lookup returns the data record for [ip], or nil if there's none
+func (db *geoIPDB) lookup(ip net.IP) (map[string]interface{}, error) {
+	var node uint64
+	var bits []byte
+	if v4 := ip.To4(); v4 != nil {
+		node, bits = db.ipv4Start, v4
+		if db.ipVersion == 4 {
+			node = 0
+		}
+	} else if db.ipVersion == 6 {
+		bits = ip.To16()
+	} else {
+		return nil, nil // IPv6 address in an IPv4-only database
+	}
+
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		var bit = (bits[i/8] >> (7 - uint(i%8))) & 1
+		var err error
+		if node, err = db.record(node, bit); err != nil {
+			return nil, err
+		}
+	}
+
+	if node <= db.nodeCount { // either not found, or the tree is malformed
+		return nil, nil
+	}
+
+	var offset = node - db.nodeCount - 16
+	if offset >= uint64(len(db.buf)-db.dataStart) {
+		return nil, errors.New("invalid geoip database: record points outside the data section")
+	}
+
+	value, _, err := db.decode(db.buf[db.dataStart:], int(offset))
+	if err != nil {
+		return nil, err
+	}
+
+	var record, _ = value.(map[string]interface{})
+	return record, nil
+}
+
+// record returns the left (if [bit] is 0) or right record of [node] in the search tree
+func (db *geoIPDB) record(node uint64, bit byte) (uint64, error) {
+	var size = db.recordSize / 4 // bytes per node
+	var start = node * size
+	if start+size > uint64(db.dataStart) {
+		return 0, errors.New("invalid geoip database: node outside the search tree")
+	}
+	var b = db.buf[start : start+size]
+
+	switch db.recordSize {
+	case 24:
+		if bit == 0 {
+			return uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2]), nil
+		}
+		return uint64(b[3])<<16 | uint64(b[4])<<8 | uint64(b[5]), nil
+	case 28:
+		if bit == 0 {
+			return uint64(b[3]&0xf0)<<20 | uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2]), nil
+		}
+		return uint64(b[3]&0x0f)<<24 | uint64(b[4])<<16 | uint64(b[5])<<8 | uint64(b[6]), nil
+	default:
+		if bit == 0 {
+			return uint64(binary.BigEndian.Uint32(b[0:4])), nil
+		}
+		return uint64(binary.BigEndian.Uint32(b[4:8])), nil
+	}
+}
+
+// types of values in the data section
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+// decode decodes the value at [offset] in the data section [data], returning it along with the offset after it.
+// Maps are decoded as map[string]interface{}, arrays as []interface{} and unsigned integers as uint64.
+func (db *geoIPDB) decode(data []byte, offset int) (interface{}, int, error) {
+	var truncated = errors.New("invalid geoip database: truncated data")
+	var next = func(n int) ([]byte, error) {
+		if n < 0 || offset+n > len(data) {
+			return nil, truncated
+		}
+		var b = data[offset : offset+n]
+		offset += n
+		return b, nil
+	}
+
+	ctrl, err := next(1)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var typ = int(ctrl[0] >> 5)
+	if typ == mmdbPointer {
+		var ss, vvv = int(ctrl[0]>>3) & 3, uint64(ctrl[0] & 7)
+		b, err := next(ss + 1)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		var pointer uint64
+		switch ss {
+		case 0:
+			pointer = vvv<<8 | uint64(b[0])
+		case 1:
+			pointer = (vvv<<16 | uint64(b[0])<<8 | uint64(b[1])) + 2048
+		case 2:
+			pointer = (vvv<<24 | uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])) + 526336
+		default:
+			pointer = uint64(binary.BigEndian.Uint32(b))
+		}
+
+		if pointer >= uint64(len(data)) {
+			return nil, 0, truncated
+		}
+		value, _, err := db.decode(data, int(pointer))
+		return value, offset, err
+	}
+
+	if typ == mmdbExtended {
+		b, err := next(1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + int(b[0])
+	}
+
+	var size = int(ctrl[0] & 0x1f)
+	if size >= 29 {
+		b, err := next(size - 28)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		switch size {
+		case 29:
+			size = 29 + int(b[0])
+		case 30:
+			size = 285 + (int(b[0])<<8 | int(b[1]))
+		default:
+			size = 65821 + (int(b[0])<<16 | int(b[1])<<8 | int(b[2]))
+		}
+	}
+
+	switch typ {
+	case mmdbMap:
+		var m = make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			var key, value interface{}
+			if key, offset, err = db.decode(data, offset); err != nil {
+				return nil, 0, err
+			}
+			if value, offset, err = db.decode(data, offset); err != nil {
+				return nil, 0, err
+			}
+
+			var k, _ = key.(string)
+			m[k] = value
+		}
+		return m, offset, nil
+
+	case mmdbArray:
+		var a = make([]interface{}, 0, size)
+		for i := 0; i < size; i++ {
+			var value interface{}
+			if value, offset, err = db.decode(data, offset); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+		}
+		return a, offset, nil
+
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+
+	b, err := next(size)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch typ {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errors.New("invalid geoip database: bad double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errors.New("invalid geoip database: bad float")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbInt32:
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	default: // bytes, uint128 and anything we don't need
+		return b, offset, nil
+	}
+}
+
+// geoIPPolicy allows or denies visitors based on the country they're in
+type geoIPPolicy struct {
+	db *geoIPDB
+
+	allow map[string]bool // if non-empty, only visitors from these countries are allowed
+	deny  map[string]bool // visitors from these countries are denied
+}
+
+// newGeoIPPolicy returns a new geoIPPolicy using the database at [path] and the [allow] / [deny] lists of ISO country
+// codes. It returns nil if [path] is empty.
+func newGeoIPPolicy(path string, allow, deny []string) (*geoIPPolicy, error) {
+	if path == "" {
+		if len(allow) > 0 || len(deny) > 0 {
+			return nil, errors.New("allowing / denying countries requires a geoip database")
+		}
+		return nil, nil
+	}
+
+	db, err := openGeoIPDB(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var policy = &geoIPPolicy{db: db, allow: make(map[string]bool), deny: make(map[string]bool)}
+	for _, code := range allow {
+		policy.allow[strings.ToUpper(code)] = true
+	}
+	for _, code := range deny {
+		policy.deny[strings.ToUpper(code)] = true
+	}
+	return policy, nil
+}
+
+// Country returns the ISO code of the country of the visitor at [addr] (or empty if it isn't known)
+func (policy *geoIPPolicy) Country(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok && policy != nil {
+		return policy.db.Country(tcp.IP)
+	}
+	return ""
+}
+
+// permits returns true if visitors from [country] are allowed. Visitors from unknown countries are only
+// denied if there's an allow list.
+func (policy *geoIPPolicy) permits(country string) bool {
+	if policy == nil {
+		return true
+	}
+
+	if policy.deny[country] {
+		return false
+	}
+	return len(policy.allow) == 0 || policy.allow[country]
+}
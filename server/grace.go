@@ -0,0 +1,219 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains helpers to hold the endpoints (names / ports) of disconnected clients for a grace period,
+// so that a client reconnecting (eg. after a network blip) regains the same endpoint
+// ----------
+
+// number of random ports tried before giving up on finding one that isn't held (see listenAvoidingHolds)
+const listenAttempts = 10
+
+// hold is an endpoint held for the key with fingerprint until it expires
+type hold struct {
+	fingerprint string
+	expires     time.Time
+}
+
+// graceHolds tracks the endpoints held for disconnected clients. A nil *graceHolds holds nothing.
+type graceHolds struct {
+	window time.Duration
+
+	mu    sync.Mutex
+	names map[string]hold
+	ports map[uint32]hold
+}
+
+// newGraceHolds returns a new graceHolds holding endpoints for [window], or nil if [window] is zero
+func newGraceHolds(window time.Duration) *graceHolds {
+	if window <= 0 {
+		return nil
+	}
+	return &graceHolds{window: window, names: make(map[string]hold), ports: make(map[uint32]hold)}
+}
+
+// HoldName holds the HTTP tunnel [name] for the key with [fingerprint]
+func (g *graceHolds) HoldName(name, fingerprint string) {
+	if g == nil || fingerprint == "" {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.names[name] = hold{fingerprint: fingerprint, expires: time.Now().Add(g.window)}
+}
+
+// HoldPort holds the TCP [port] for the key with [fingerprint]
+func (g *graceHolds) HoldPort(port uint32, fingerprint string) {
+	if g == nil || fingerprint == "" {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.ports[port] = hold{fingerprint: fingerprint, expires: time.Now().Add(g.window)}
+}
+
+// NameHolder returns the fingerprint of the key [name] is held for (or empty if it isn't held)
+func (g *graceHolds) NameHolder(name string) string {
+	if g == nil {
+		return ""
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.expire()
+	return g.names[name].fingerprint
+}
+
+// PortHolder returns the fingerprint of the key [port] is held for (or empty if it isn't held)
+func (g *graceHolds) PortHolder(port uint32) string {
+	if g == nil {
+		return ""
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.expire()
+	return g.ports[port].fingerprint
+}
+
+// HeldName returns the name held for the key with [fingerprint] the longest (or empty if there's none)
+func (g *graceHolds) HeldName(fingerprint string) string {
+	if g == nil || fingerprint == "" {
+		return ""
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.expire()
+
+	var name string
+	var oldest time.Time
+	for n, h := range g.names {
+		if h.fingerprint == fingerprint && (name == "" || h.expires.Before(oldest)) {
+			name, oldest = n, h.expires
+		}
+	}
+	return name
+}
+
+// HeldPort returns the port held for the key with [fingerprint] the longest (or 0 if there's none)
+func (g *graceHolds) HeldPort(fingerprint string) uint32 {
+	if g == nil || fingerprint == "" {
+		return 0
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.expire()
+
+	var port uint32
+	var oldest time.Time
+	for p, h := range g.ports {
+		if h.fingerprint == fingerprint && (port == 0 || h.expires.Before(oldest)) {
+			port, oldest = p, h.expires
+		}
+	}
+	return port
+}
+
+// ReleaseName stops holding [name] (eg. once its holder has reclaimed it)
+func (g *graceHolds) ReleaseName(name string) {
+	if g == nil {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.names, name)
+}
+
+// ReleasePort stops holding [port] (eg. once its holder has reclaimed it)
+func (g *graceHolds) ReleasePort(port uint32) {
+	if g == nil {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.ports, port)
+}
+
+// expire removes holds past their grace period; must be called with g.mu held
+func (g *graceHolds) expire() {
+	var now = time.Now()
+	for name, h := range g.names {
+		if now.After(h.expires) {
+			delete(g.names, name)
+		}
+	}
+
+	for port, h := range g.ports {
+		if now.After(h.expires) {
+			delete(g.ports, port)
+		}
+	}
+}
+
+// HeldEndpoint is the endpoint (an HTTP / TLS tunnel's name, or a TCP tunnel's port) of a client's tunnel, handed
+// over to a new instance of the server so that the client regains it as it reconnects (see Server.Endpoints)
+type HeldEndpoint struct {
+	Fingerprint string `json:"fingerprint"`
+	Name        string `json:"name,omitempty"`
+	Port        uint32 `json:"port,omitempty"`
+}
+
+// list returns the endpoints held
+func (g *graceHolds) list() []HeldEndpoint {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.expire()
+
+	var endpoints []HeldEndpoint
+	for name, h := range g.names {
+		endpoints = append(endpoints, HeldEndpoint{Fingerprint: h.fingerprint, Name: name})
+	}
+	for port, h := range g.ports {
+		endpoints = append(endpoints, HeldEndpoint{Fingerprint: h.fingerprint, Port: port})
+	}
+	return endpoints
+}
+
+// Endpoints returns the endpoints of the tunnels open right now, and those held for clients which went away, eg. to
+// hand them over to a new instance of the server taking over from this one (see Server.Hold) before shutting down
+func (srv *Server) Endpoints() []HeldEndpoint {
+	var g = newGraceHolds(time.Minute)
+	if srv.grace != nil {
+		g.window = srv.grace.window
+		for _, e := range srv.grace.list() {
+			g.hold(e)
+		}
+	}
+
+	for _, tunnel := range srv.tunnels.list() {
+		tunnel.hold(g)
+	}
+	return g.list()
+}
+
+// Hold holds [endpoints] for their clients for the reconnect grace period (see Config.ReconnectGrace), eg. those
+// handed over by the instance of the server this one takes over from. It does nothing if the grace period is zero.
+func (srv *Server) Hold(endpoints []HeldEndpoint) {
+	for _, e := range endpoints {
+		srv.grace.hold(e)
+	}
+}
+
+// hold holds the endpoint [e] for its client
+func (g *graceHolds) hold(e HeldEndpoint) {
+	if e.Name != "" {
+		g.HoldName(e.Name, e.Fingerprint)
+	} else if e.Port != 0 {
+		g.HoldPort(e.Port, e.Fingerprint)
+	}
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// ----------
+// This file contains the group type, which ties the lifecycle of goroutines to the task they're part of
+// (eg. a tunnel, or a listener and the connections it accepted), in the spirit of golang.org/x/sync/errgroup
+// ----------
+
+// number of goroutines running as part of a group, across the server (see metrics)
+var groupTasks int64
+
+// group is a set of goroutines working on subtasks of a common task. The group's context is cancelled once any
+// of them fails, the group is cancelled, or the parent context is done. Wait waits for all of them to return.
+type group struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	once sync.Once
+	err  error
+}
+
+// newGroup returns a new group whose context is derived from [parent]
+func newGroup(parent context.Context) *group {
+	ctx, cancel := context.WithCancel(parent)
+	return &group{ctx: ctx, cancel: cancel}
+}
+
+// Go runs [fn] on a new goroutine with the group's context. If it returns an error, the group is cancelled.
+// Go may be called from within the group's goroutines (eg. to handle connections accepted by one of them).
+func (g *group) Go(fn func(ctx context.Context) error) {
+	g.wg.Add(1)
+	atomic.AddInt64(&groupTasks, 1)
+	go func() {
+		defer g.wg.Done()
+		defer atomic.AddInt64(&groupTasks, -1)
+
+		if err := fn(g.ctx); err != nil {
+			g.once.Do(func() {
+				g.err = err
+				g.cancel()
+			})
+		}
+	}()
+}
+
+// Cancel cancels the group's context, asking its goroutines to return
+func (g *group) Cancel() { g.cancel() }
+
+// Wait blocks until all goroutines of the group have returned, and returns the first error (if any) they returned
+func (g *group) Wait() error {
+	g.wg.Wait()
+	g.cancel()
+	return g.err
+}
@@ -0,0 +1,22 @@
+//go:build go1.24
+// +build go1.24
+
+package server
+
+import (
+	"net/http"
+)
+
+// ----------
+// This file contains helpers to accept cleartext HTTP/2 (h2c) on the HTTP listener, which net/http supports
+// natively since Go 1.24
+// ----------
+
+// enableCleartextHTTP2 makes [srv] accept HTTP/2 with prior knowledge (RFC 9113, section 3.3) alongside HTTP/1.x
+func enableCleartextHTTP2(srv *http.Server) error {
+	var protocols = new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	srv.Protocols = protocols
+	return nil
+}
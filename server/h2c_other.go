@@ -0,0 +1,18 @@
+//go:build !go1.24
+// +build !go1.24
+
+package server
+
+import (
+	"github.com/pkg/errors"
+	"net/http"
+)
+
+// ----------
+// net/http only supports cleartext HTTP/2 (h2c) since Go 1.24; servers built with older versions serve HTTP/1.x only
+// ----------
+
+// enableCleartextHTTP2 returns an error, as cleartext HTTP/2 isn't supported by this build
+func enableCleartextHTTP2(_ *http.Server) error {
+	return errors.New("cleartext HTTP/2 requires shhh to be built with Go 1.24 or newer")
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"log"
+	"net"
+	"sync"
+)
+
+// ----------
+// This file contains what's done once a client has authenticated. ssh clients ask whether the server would accept a
+// key before signing with it, and the server's PublicKeyHandler answers those queries too: accepting a key there
+// doesn't mean the client holds its private key. So nothing is recorded as authenticated there; it's done once ssh
+// reports the client's authentication as complete (see gossh.ServerConfig.AuthLogCallback), right before the
+// handshake succeeds.
+// ----------
+
+// handshakeContextKey is the key under which the *handshake of a connection is stored
+const handshakeContextKey = "shhh-handshake"
+
+// handshake is what's known of a connection's attempts to authenticate
+type handshake struct {
+	mu            sync.Mutex
+	accepted      map[string]struct{} // fingerprints of the keys accepted, whether the client signed with them or not
+	rejected      map[string]bool     // methods (other than "none") of the attempts rejected
+	authenticated bool
+}
+
+// handshakeFromContext returns the *handshake of the connection with [ctx]
+func handshakeFromContext(ctx ssh.Context) *handshake {
+	if hs, ok := ctx.Value(handshakeContextKey).(*handshake); ok {
+		return hs
+	}
+	var hs = &handshake{accepted: make(map[string]struct{}), rejected: make(map[string]bool)}
+	ctx.SetValue(handshakeContextKey, hs)
+	return hs
+}
+
+// recordAcceptedKeys wraps [handler] to record the keys it accepts
+func recordAcceptedKeys(handler ssh.PublicKeyHandler) ssh.PublicKeyHandler {
+	return func(ctx ssh.Context, key ssh.PublicKey) bool {
+		if !handler(ctx, key) {
+			return false
+		}
+
+		var hs = handshakeFromContext(ctx)
+		hs.mu.Lock()
+		hs.accepted[gossh.FingerprintSHA256(key)] = struct{}{}
+		hs.mu.Unlock()
+		return true
+	}
+}
+
+// ambiguousKey returns true if more than one key was accepted for the connection with [ctx]. The key it was then
+// identified by is the last one accepted, which needn't be the one it signed with (ssh doesn't say which it was),
+// so the client could pass for a key it only knows the public half of.
+func ambiguousKey(ctx ssh.Context) bool {
+	var hs = handshakeFromContext(ctx)
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	return len(hs.accepted) > 1
+}
+
+// authConfig returns an ssh.ServerConfigCallback calling Server.authenticated once clients have authenticated, on top
+// of [next] (if set). Those which never do are recorded as their connection closes (see Server.handshakeFailed).
+func authConfig(srv *Server, next ssh.ServerConfigCallback) ssh.ServerConfigCallback {
+	return func(ctx ssh.Context) *gossh.ServerConfig {
+		var config = &gossh.ServerConfig{}
+		if next != nil {
+			config = next(ctx)
+		}
+
+		var hs = handshakeFromContext(ctx)
+		config.AuthLogCallback = func(_ gossh.ConnMetadata, method string, err error) {
+			if err == nil {
+				srv.authenticated(ctx, method)
+			} else if method != "none" { // clients try "none" first, to learn which methods they may use
+				hs.mu.Lock()
+				hs.rejected[method] = true
+				hs.mu.Unlock()
+			}
+		}
+
+		return config
+	}
+}
+
+// authenticated records that the client with [ctx] authenticated with [method] ("none" for anonymous clients). It's
+// called before the handshake completes; clients which mustn't be let in after all have their connection closed.
+func (srv *Server) authenticated(ctx ssh.Context, method string) {
+	if method == "publickey" && ctx.Value(apiTokenContextKey) == nil && ambiguousKey(ctx) {
+		log.Printf("closing connection from %s: more than one key accepted, so it's unknown which it signed with", ctx.RemoteAddr())
+		srv.deny(ctx)
+		return
+	}
+
+	if method == "none" {
+		srv.handshakeDone(ctx)
+		return
+	}
+
+	var fingerprint = Fingerprint(ctx)
+	if method == "publickey" {
+		// the on_auth hook of clients authenticating with a password is called as it's checked
+		var keyType string
+		if key, ok := ctx.Value(ssh.ContextKeyPublicKey).(ssh.PublicKey); ok && key != nil {
+			keyType = key.Type()
+		}
+		if !srv.hooks.authenticated(ctx, method, fingerprint, keyType) {
+			srv.authFailure(authHookDenied, ctx.RemoteAddr(), fingerprint)
+			srv.deny(ctx)
+			return
+		}
+	}
+
+	srv.audit.record(AuditEvent{Type: AuditAuthSuccess, Client: ctx.RemoteAddr().String(), Fingerprint: fingerprint})
+	srv.guard.authenticated(ctx.RemoteAddr())
+	srv.tarpit.authenticated(ctx.RemoteAddr())
+	srv.handshakeDone(ctx)
+}
+
+// handshakeDone records that the handshake of the client with [ctx] is done, which lets it in
+func (srv *Server) handshakeDone(ctx ssh.Context) {
+	var hs = handshakeFromContext(ctx)
+	hs.mu.Lock()
+	hs.authenticated = true
+	hs.mu.Unlock()
+	startupDone(ctx)
+}
+
+// handshakeFailed is called as the connection from [addr] closes. If it went away without authenticating, after
+// attempts which were rejected (see [hs]), it's recorded as an authentication failure (and counted by the sshGuard);
+// the keys offered were recorded as such (see auditLog.authenticate), as clients may offer several, or only ask
+// whether one would be accepted, and wrong passwords were each recorded already. It's passed [hs] rather than the
+// connection's context, which ssh may still be changing as the connection closes.
+func (srv *Server) handshakeFailed(addr net.Addr, hs *handshake) {
+	hs.mu.Lock()
+	var failed = !hs.authenticated && len(hs.rejected) > 0
+	var keysRejected = hs.rejected["publickey"]
+	hs.mu.Unlock()
+
+	if !failed {
+		return
+	}
+	srv.guard.authFailed(addr)
+	if keysRejected {
+		srv.audit.authFailure(authUnknownKey, addr, "")
+	}
+}
+
+// deny closes the connection with [ctx] while it's authenticating, so that the handshake fails
+func (srv *Server) deny(ctx ssh.Context) {
+	if conn, ok := connectionFromContext(ctx); ok {
+		srv.conns.close(conn)
+	}
+}
@@ -0,0 +1,115 @@
+package server_test
+
+import (
+	"errors"
+	"github.com/riyaz-ali/shhh/internal/harness"
+	"github.com/riyaz-ali/shhh/server"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// publicHalf is a key whose private half isn't known: clients can ask whether the server would accept it, but can't
+// sign with it
+type publicHalf struct{ gossh.Signer }
+
+func (publicHalf) Sign(io.Reader, []byte) (*gossh.Signature, error) {
+	return nil, errors.New("private key isn't known")
+}
+
+// handshake returns how long connecting to [srv] with [key] takes, and whether it succeeded
+func handshake(srv *harness.Server, key gossh.Signer) (time.Duration, bool) {
+	var start = time.Now()
+	client, err := srv.DialKey(key)
+	if err == nil {
+		_ = client.Close()
+	}
+	return time.Since(start), err == nil
+}
+
+func TestTarpitNotSkippedWithPublicKey(t *testing.T) {
+	const delay = 500 * time.Millisecond
+
+	var config = server.DefaultConfig()
+	config.Tarpit, config.TarpitThreshold, config.TarpitDelay = true, 1, delay
+	srv, err := harness.Start(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	// a failure gets the IP tarpitted
+	if _, ok := handshake(srv, mustKey(t)); ok {
+		t.Fatal("unknown key was let in")
+	}
+	if took, _ := handshake(srv, mustKey(t)); took < delay {
+		t.Fatalf("tarpitted client got through in %s", took)
+	}
+
+	// offering a known key without signing with it doesn't get the IP out of the tarpit
+	if _, ok := handshake(srv, publicHalf{srv.Key}); ok {
+		t.Fatal("client was let in without signing")
+	}
+	if took, _ := handshake(srv, mustKey(t)); took < delay {
+		t.Fatalf("client skipped the tarpit by offering a known public key (got through in %s)", took)
+	}
+
+	// authenticating with it does
+	if _, ok := handshake(srv, srv.Key); !ok {
+		t.Fatal("known key was denied")
+	}
+	if took, _ := handshake(srv, mustKey(t)); took >= delay {
+		t.Fatalf("client was still tarpitted after authenticating with a known key (took %s)", took)
+	}
+}
+
+// badlySigned is a key whose signatures are in a format servers don't accept, so that clients go on with their next
+// key after signing with it
+type badlySigned struct{ gossh.Signer }
+
+func (badlySigned) Sign(io.Reader, []byte) (*gossh.Signature, error) {
+	return &gossh.Signature{Format: "unsupported"}, nil
+}
+
+func TestAmbiguousKeyDenied(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shhh-handshake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var victim, own = mustKey(t), mustKey(t)
+	var config = server.DefaultConfig()
+	config.AuthorizedKeys = filepath.Join(dir, "authorized_keys")
+	var keys = append(gossh.MarshalAuthorizedKey(victim.PublicKey()), gossh.MarshalAuthorizedKey(own.PublicKey())...)
+	if err = ioutil.WriteFile(config.AuthorizedKeys, keys, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := harness.Start(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	// the client has both keys accepted, but only signs with its own
+	client, err := gossh.Dial("tcp", srv.Addr, &gossh.ClientConfig{
+		User:            "harness",
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(badlySigned{victim}, own)},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err == nil {
+		_ = client.Close()
+		t.Fatal("client which had more than one key accepted was let in")
+	}
+
+	// clients with one key accepted are let in
+	if _, ok := handshake(srv, own); !ok {
+		t.Fatal("known key was denied")
+	}
+}
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// ----------
+// This file contains the hooks: functions of a script written by the operator (in a subset of Starlark, see
+// script.go) which the server calls to decide on clients and visitors, for policies too custom for its static
+// configuration. A script may define any of:
+//
+//   on_auth(auth)               once a client has authenticated (with a key or a password)
+//   on_forward_request(request) when a client asks to forward a port, before any other check
+//   on_connection(conn)         when a visitor connects to a TCP / UDP tunnel
+//
+// Each returns None or True to allow, False to deny, or a dict with any of:
+//
+//   allow      bool, False to deny
+//   reason     str, sent to the client when denied
+//   bind_addr  str, to bind in place of the requested address (on_forward_request only)
+//   bind_port  int, to bind in place of the requested port (on_forward_request only)
+//   tags       dict of str, tags attached to the client's tunnels (see tags.go)
+//
+// A hook that fails (eg. raises an error, or runs for too long) denies. The script is reloaded when it changes;
+// if it doesn't load, the hooks loaded before are kept.
+// ----------
+
+// auth reason logged when a hook denies a client (see authLog)
+const authHookDenied = "hook-denied"
+
+// scriptHooks calls the hooks defined by the operator's script. A nil *scriptHooks allows everything.
+type scriptHooks struct {
+	path string
+
+	mu     sync.RWMutex
+	module *scriptModule
+}
+
+// hookDecision is what a hook decided. The zero value allows, changing nothing.
+type hookDecision struct {
+	denied bool
+	reason string
+
+	// rewritten bind address / port (if set)
+	bindAddr                 string
+	bindPort                 uint32
+	bindAddrSet, bindPortSet bool
+
+	tags map[string]string
+}
+
+// newScriptHooks returns the hooks of the script at [path]. It returns nil if [path] is empty.
+func newScriptHooks(path string) (*scriptHooks, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	var hooks = &scriptHooks{path: path}
+	if err := hooks.load(); err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+// load (re-)loads the script
+func (hooks *scriptHooks) load() error {
+	content, err := ioutil.ReadFile(hooks.path)
+	if err != nil {
+		return errors.Wrap(err, "failed to read hooks")
+	}
+
+	module, err := loadScript(hooks.path, string(content))
+	if err != nil {
+		return errors.Wrap(err, "failed to load hooks")
+	}
+
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	hooks.module = module
+	return nil
+}
+
+// reload re-loads the script, keeping the hooks loaded before if it fails
+func (hooks *scriptHooks) reload() {
+	if err := hooks.load(); err != nil {
+		log.Printf("%s; keeping the hooks loaded before", err.Error())
+		return
+	}
+	log.Printf("reloaded %s", hooks.path)
+}
+
+// run calls the hook [name] with [input], and returns its decision. Hooks the script doesn't define allow.
+func (hooks *scriptHooks) run(name string, input *scriptStruct) (decision hookDecision) {
+	if hooks == nil {
+		return hookDecision{}
+	}
+
+	// a hook panicking (past what scriptModule.call recovers from, eg. in parsing its decision) denies, as failing does
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("hooks: %s panicked: %v\n%s", name, r, debug.Stack())
+			decision = hookDecision{denied: true, reason: fmt.Sprintf("denied by %s hook", name)}
+		}
+	}()
+
+	hooks.mu.RLock()
+	var module = hooks.module
+	hooks.mu.RUnlock()
+
+	var fn = module.function(name)
+	if fn == nil {
+		return hookDecision{}
+	}
+
+	value, err := module.call(fn, input)
+	if err == nil {
+		decision, err = parseHookDecision(value)
+	}
+	if err != nil {
+		log.Printf("hooks: %s failed: %s", name, err.Error())
+		return hookDecision{denied: true, reason: fmt.Sprintf("denied by %s hook", name)}
+	}
+
+	if decision.denied && decision.reason == "" {
+		decision.reason = fmt.Sprintf("denied by %s hook", name)
+	}
+	return decision
+}
+
+// parseHookDecision returns the decision a hook returned as [value]
+func parseHookDecision(value interface{}) (decision hookDecision, err error) {
+	switch value := value.(type) {
+	case nil:
+		return decision, nil
+	case bool:
+		decision.denied = !value
+		return decision, nil
+	case *scriptDict:
+		for _, key := range value.keys {
+			var v = value.values[key]
+			switch key {
+			case "allow":
+				allow, ok := v.(bool)
+				if !ok {
+					return decision, errors.Errorf("allow must be a bool, not %s", scriptType(v))
+				}
+				decision.denied = !allow
+			case "reason":
+				if decision.reason, err = hookString("reason", v); err != nil {
+					return decision, err
+				}
+			case "bind_addr":
+				if decision.bindAddr, err = hookString("bind_addr", v); err != nil {
+					return decision, err
+				}
+				decision.bindAddrSet = true
+			case "bind_port":
+				port, ok := v.(int64)
+				if !ok || port < 0 || port > 65535 {
+					return decision, errors.Errorf("bind_port must be an int between 0 and 65535, not %s", scriptRepr(v))
+				}
+				decision.bindPort, decision.bindPortSet = uint32(port), true
+			case "tags":
+				tags, ok := v.(*scriptDict)
+				if !ok {
+					return decision, errors.Errorf("tags must be a dict, not %s", scriptType(v))
+				}
+				decision.tags = make(map[string]string, len(tags.keys))
+				for _, k := range tags.keys {
+					name, ok := k.(string)
+					if !ok {
+						return decision, errors.Errorf("tags must have str keys, not %s", scriptType(k))
+					}
+					var value = scriptString(tags.values[k])
+					if err = validateTag(name, value); err != nil {
+						return decision, err
+					}
+					decision.tags[name] = value
+				}
+			default:
+				return decision, errors.Errorf("unexpected key %s in decision", scriptRepr(key))
+			}
+		}
+		return decision, nil
+	}
+	return decision, errors.Errorf("hooks must return None, a bool or a dict, not %s", scriptType(value))
+}
+
+// hookString returns the value [v] of the decision's [key], which must be a str
+func hookString(key string, v interface{}) (string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", errors.Errorf("%s must be a str, not %s", key, scriptType(v))
+	}
+	return s, nil
+}
+
+// scriptTags returns [tags] as a (frozen) dict for scripts
+func scriptTags(tags map[string]string) *scriptDict {
+	var keys = make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var dict = newScriptDict()
+	for _, k := range keys {
+		_ = dict.set(k, tags[k])
+	}
+	dict.frozen = true
+	return dict
+}
+
+// authenticated calls the on_auth hook for the client with [ctx], which authenticated with [method] as [fingerprint]
+// (using a key of [keyType], if any). It returns false if the hook denies the client; otherwise the tags it returned
+// are attached to the client's connection.
+func (hooks *scriptHooks) authenticated(ctx ssh.Context, method, fingerprint, keyType string) bool {
+	if hooks == nil {
+		return true
+	}
+
+	var decision = hooks.run("on_auth", &scriptStruct{name: "auth", fields: map[string]interface{}{
+		"user": ctx.User(), "fingerprint": fingerprint, "client": ctx.RemoteAddr().String(), "method": method, "key_type": keyType,
+	}})
+	if decision.denied {
+		return false
+	}
+
+	if conn, ok := connectionFromContext(ctx); ok {
+		conn.options.addTags(decision.tags)
+	}
+	return true
+}
+
+// forwardRequest calls the on_forward_request hook for the client with [ctx] (and [options]) asking to forward
+// [bindAddr]:[bindPort] over [protocol], and returns its decision. Tags it returned are attached to the client.
+func (hooks *scriptHooks) forwardRequest(ctx ssh.Context, options *sessionOptions, protocol, bindAddr string, bindPort uint32) hookDecision {
+	if hooks == nil {
+		return hookDecision{}
+	}
+
+	var decision = hooks.run("on_forward_request", &scriptStruct{name: "request", fields: map[string]interface{}{
+		"user": ctx.User(), "fingerprint": Fingerprint(ctx), "client": ctx.RemoteAddr().String(), "protocol": protocol,
+		"bind_addr": bindAddr, "bind_port": int64(bindPort), "tags": scriptTags(options.Tags()),
+	}})
+	if !decision.denied {
+		options.addTags(decision.tags)
+	}
+	return decision
+}
+
+// connection calls the on_connection hook for the visitor connecting from [addr] (in [country], if known) to the
+// tunnel listening on [local], of the client with [options]; it returns false if the hook denies the visitor
+func (hooks *scriptHooks) connection(addr, local net.Addr, country string, options *sessionOptions) bool {
+	if hooks == nil {
+		return true
+	}
+
+	var visitor, visitorPort = splitHostPort(addr)
+	var address, port = splitHostPort(local)
+	var tags map[string]string
+	if options != nil {
+		tags = options.Tags()
+	}
+
+	var decision = hooks.run("on_connection", &scriptStruct{name: "conn", fields: map[string]interface{}{
+		"visitor": visitor, "visitor_port": visitorPort, "country": country, "address": address, "port": port,
+		"protocol": local.Network(), "tags": scriptTags(tags),
+	}})
+	return !decision.denied
+}
+
+// splitHostPort returns the host and port of [addr] (the whole address, and 0, if it has no port, eg. unix sockets)
+func splitHostPort(addr net.Addr) (string, int64) {
+	host, p, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String(), 0
+	}
+	port, _ := strconv.ParseInt(p, 10, 64)
+	return host, port
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadHooks writes [src] to a file in [dir], and loads it as hooks
+func loadHooks(t *testing.T, dir, src string) (*scriptHooks, error) {
+	var path = filepath.Join(dir, "hooks.py")
+	if err := ioutil.WriteFile(path, []byte(src), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return newScriptHooks(path)
+}
+
+// chainedHooks returns a script whose on_connection calls f0, which calls f1, and so on up to f[n]
+func chainedHooks(n int) string {
+	var b strings.Builder
+	b.WriteString("def on_connection(conn):\n    return f0()\n")
+	for i := 0; i < n; i++ {
+		_, _ = fmt.Fprintf(&b, "def f%d():\n    return f%d()\n", i, i+1)
+	}
+	_, _ = fmt.Fprintf(&b, "def f%d():\n    return True\n", n)
+	return b.String()
+}
+
+// hooks which run away (looping, recursing or nesting too deeply) deny, rather than hang or crash the server
+func TestHooksRunaway(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shhh-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tests = []struct {
+		name string
+		src  string
+		deny bool
+	}{
+		{"allowed", "def on_connection(conn):\n    return conn.port == 8080\n", false},
+		{"runaway loop", "def on_connection(conn):\n    for i in range(100000):\n        for j in range(100000):\n            pass\n", true},
+		{"recursion", "def on_connection(conn):\n    return on_connection(conn)\n", true},
+		{"mutual recursion", "def on_connection(conn):\n    return ping(3)\ndef ping(n):\n    return pong(n)\ndef pong(n):\n    return n == 0 or ping(n - 1)\n", true},
+		{"recursion through an argument", "def on_connection(conn):\n    return g(on_connection)\ndef g(fn):\n    return fn(None)\n", true},
+		{"long chain of calls", chainedHooks(50), false},
+		{"too long a chain of calls", chainedHooks(2 * scriptMaxDepth), true},
+		{"deep expression", "def on_connection(conn):\n    return 0" + strings.Repeat(" + 1", 10*scriptMaxDepth) + " > 0\n", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hooks, err := loadHooks(t, dir, test.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var start = time.Now()
+			var allowed = hooks.connection(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000},
+				&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8080}, "", nil)
+			if allowed == test.deny {
+				t.Fatalf("got allowed %v, want %v", allowed, !test.deny)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Fatalf("hook ran for %s", elapsed)
+			}
+		})
+	}
+
+	// scripts which run away at their top level, or nest too deeply, don't load
+	for _, src := range []string{
+		"for i in range(100000):\n    for j in range(100000):\n        pass\n",
+		"x = " + strings.Repeat("[", 10*scriptMaxNesting) + strings.Repeat("]", 10*scriptMaxNesting) + "\n",
+		"x = " + strings.Repeat("-", 1000000) + "1\n",
+		"if True:\n" + func() string {
+			var b strings.Builder
+			for i := 1; i <= 10*scriptMaxNesting; i++ {
+				_, _ = fmt.Fprintf(&b, "%sif True:\n", strings.Repeat(" ", i))
+			}
+			return b.String() + strings.Repeat(" ", 10*scriptMaxNesting+1) + "pass\n"
+		}(),
+	} {
+		if _, err := loadHooks(t, dir, src); err == nil {
+			t.Errorf("script loaded:\n%.200s", src)
+		}
+	}
+}
@@ -0,0 +1,674 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512" // for ID tokens signed with SHA-384 / SHA-512
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains the protection of HTTP tunnels by their clients: visitors must give HTTP Basic credentials
+// (--basic-auth) or log in with the server's OpenID Connect provider (--login) before their requests are forwarded
+// ----------
+
+// header carrying the authenticated visitor (their user name, or email) to the local service
+const userHeader = "X-Shhh-User"
+
+// paths on tunnels' hosts served by the edge itself, for logging in and out
+const (
+	oidcCallbackPath = "/.shhh/oidc/callback"
+	logoutPath       = "/.shhh/logout"
+)
+
+// cookies set by the edge; they're not passed on to local services
+const (
+	sessionCookie = "shhh_session" // the logged in visitor
+	loginCookie   = "shhh_login"   // state of a login in progress
+)
+
+const (
+	// how long visitors stay logged in
+	loginSessionDuration = 12 * time.Hour
+
+	// how long visitors have to complete a login with the provider
+	loginStateDuration = 10 * time.Minute
+
+	// how long a failure to discover the provider is remembered for, and how often its keys are fetched at most (to
+	// find one an ID token is signed with)
+	oidcDiscoveryRetry = 10 * time.Second
+
+	// largest set of keys we're willing to read from the provider
+	maxOIDCKeysSize = 1 << 20
+)
+
+// idTokenAlgorithm is an algorithm ID tokens may be signed with (see RFC 7518, section 3.1)
+type idTokenAlgorithm struct {
+	hash  crypto.Hash
+	curve elliptic.Curve // of ECDSA keys; nil for RSA
+}
+
+// algorithms ID tokens may be signed with
+var idTokenAlgorithms = map[string]idTokenAlgorithm{
+	"RS256": {hash: crypto.SHA256},
+	"RS384": {hash: crypto.SHA384},
+	"RS512": {hash: crypto.SHA512},
+	"ES256": {hash: crypto.SHA256, curve: elliptic.P256()},
+	"ES384": {hash: crypto.SHA384, curve: elliptic.P384()},
+	"ES512": {hash: crypto.SHA512, curve: elliptic.P521()},
+}
+
+// tunnelAccess describes who may visit a client's HTTP tunnels
+type tunnelAccess struct {
+	credentials []string // user:password pairs accepted with HTTP Basic authentication
+	logins      []string // emails (or @domains, or *) of visitors allowed to log in with the server's OIDC provider
+}
+
+// restricted returns true if visitors must authenticate
+func (access tunnelAccess) restricted() bool {
+	return len(access.credentials) > 0 || len(access.logins) > 0
+}
+
+// allowsCredentials returns true if [user] and [password] match any of the credentials
+func (access tunnelAccess) allowsCredentials(user, password string) bool {
+	var given = []byte(user + ":" + password)
+	var ok = false
+	for _, c := range access.credentials {
+		if subtle.ConstantTimeCompare(given, []byte(c)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// allowsLogin returns true if the visitor logged in as [email] is allowed
+func (access tunnelAccess) allowsLogin(email string) bool {
+	email = strings.ToLower(email)
+	for _, login := range access.logins {
+		if login = strings.ToLower(login); login == "*" || login == email ||
+			(strings.HasPrefix(login, "@") && strings.HasSuffix(email, login)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCredentials checks that each of [credentials] is of the form user:password
+func parseCredentials(credentials []string) error {
+	for _, c := range credentials {
+		if i := strings.Index(c, ":"); i <= 0 || i == len(c)-1 {
+			return errors.Errorf("invalid value %q for --basic-auth: must be of the form user:password", c)
+		}
+	}
+	return nil
+}
+
+// parseLogins checks that each of [logins] is an email, @domain or *
+func parseLogins(logins []string) error {
+	for _, login := range logins {
+		if login != "*" && (!strings.Contains(login, "@") || strings.HasSuffix(login, "@")) {
+			return errors.Errorf("invalid value %q for --login: must be an email, @domain or *", login)
+		}
+	}
+	return nil
+}
+
+// authorize checks that the visitor making [r] to [tunnel] may, as decided by its client, and rewrites [r] to tell
+// the local service who they are (removing the credentials / cookies used). Otherwise, it responds with a challenge
+// (or a redirect to the login page) and returns false. [scheme] is the one visitors use (see requestScheme).
+func (router *httpRouter) authorize(w http.ResponseWriter, r *http.Request, tunnel *httpTunnel, scheme string) bool {
+	var access = tunnel.options.Access()
+	if !access.restricted() {
+		return true
+	}
+	r.Header.Del(userHeader)
+
+	if user, password, ok := r.BasicAuth(); ok && access.allowsCredentials(user, password) {
+		r.Header.Del("Authorization")
+		r.Header.Set(userHeader, user)
+		return true
+	}
+
+	if len(access.logins) > 0 {
+		if router.oidc == nil { // the client was told at start up; don't let visitors in regardless
+			http.Error(w, "login isn't available on this server", http.StatusServiceUnavailable)
+			return false
+		}
+
+		switch r.URL.Path {
+		case oidcCallbackPath:
+			router.oidc.callback(w, r, tunnel, scheme)
+			return false
+		case logoutPath:
+			http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+			_, _ = fmt.Fprintln(w, "logged out")
+			return false
+		}
+
+		if email, ok := router.oidc.session(r, tunnel.host); ok && access.allowsLogin(email) {
+			removeCookies(r, sessionCookie, loginCookie)
+			r.Header.Set(userHeader, email)
+			return true
+		}
+
+		// browsers are sent to log in; API clients can still use credentials, if any
+		if len(access.credentials) == 0 || strings.Contains(r.Header.Get("Accept"), "text/html") {
+			router.oidc.login(w, r, tunnel, scheme)
+			return false
+		}
+	}
+
+	w.Header().Set("WWW-Authenticate", `Basic realm="shhh", charset="UTF-8"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// requestScheme returns the scheme (http or https) visitors use to reach the edge; it's https if the edge is
+// serving TLS itself, or if a trusted proxy in front of it says so in X-Forwarded-Proto
+func requestScheme(r *http.Request, proxies ipNetworks) string {
+	if r.TLS != nil {
+		return "https"
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil && proxies.contains(ip) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+		return "https"
+	}
+	return "http"
+}
+
+// removeCookies removes the cookies with any of [names] from [r]
+func removeCookies(r *http.Request, names ...string) {
+	var kept []string
+	for _, cookie := range r.Cookies() {
+		var drop = false
+		for _, name := range names {
+			drop = drop || cookie.Name == name
+		}
+		if !drop {
+			kept = append(kept, cookie.String())
+		}
+	}
+
+	if r.Header.Del("Cookie"); len(kept) > 0 {
+		r.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
+
+// oidcProvider logs visitors in with an OpenID Connect provider, using the authorization code flow
+type oidcProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+
+	// signs the cookies set by the edge; generated at start up, so visitors log in again after a restart
+	key []byte
+
+	client *http.Client
+
+	// endpoints of the provider, discovered on first use
+	mu                         sync.Mutex
+	authURL, tokenURL, keysURL string
+	discoveredAt               time.Time
+	discoveryErr               error
+
+	// keys ID tokens are signed with, by ID; fetched when a token is signed with one that isn't known
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// newOIDCProvider returns an oidcProvider configured by [config], or nil if none is configured
+func newOIDCProvider(config *Config) (*oidcProvider, error) {
+	if config.OIDCIssuer == "" {
+		return nil, nil
+	}
+
+	if config.OIDCClientID == "" {
+		return nil, errors.New("an OpenID Connect client ID is required along with the issuer")
+	}
+
+	var provider = &oidcProvider{
+		issuer:       strings.TrimSuffix(config.OIDCIssuer, "/"),
+		clientID:     config.OIDCClientID,
+		clientSecret: config.OIDCClientSecret,
+		key:          make([]byte, 32),
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+
+	if _, err := rand.Read(provider.key); err != nil {
+		return nil, errors.Wrap(err, "failed to generate cookie key")
+	}
+	return provider, nil
+}
+
+// endpoints returns the authorization and token endpoints of the provider, from its discovery document. Failures
+// are remembered for a while, so that visitors don't hammer a provider that's down.
+func (p *oidcProvider) endpoints() (string, string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.authURL != "" {
+		return p.authURL, p.tokenURL, nil
+	}
+	if p.discoveryErr != nil && time.Since(p.discoveredAt) < oidcDiscoveryRetry {
+		return "", "", p.discoveryErr
+	}
+
+	var doc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		KeysURI               string `json:"jwks_uri"`
+	}
+
+	p.discoveredAt = time.Now()
+	p.discoveryErr = func() error {
+		resp, err := p.client.Get(p.issuer + "/.well-known/openid-configuration")
+		if err != nil {
+			return errors.Wrap(err, "failed to discover OpenID Connect provider")
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return errors.Errorf("failed to discover OpenID Connect provider: %s", resp.Status)
+		}
+		if err = json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+			return errors.Wrap(err, "failed to parse OpenID Connect discovery document")
+		}
+		if strings.TrimSuffix(doc.Issuer, "/") != p.issuer || doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.KeysURI == "" {
+			return errors.New("invalid OpenID Connect discovery document")
+		}
+		return nil
+	}()
+
+	if p.discoveryErr != nil {
+		return "", "", p.discoveryErr
+	}
+	p.authURL, p.tokenURL, p.keysURL = doc.AuthorizationEndpoint, doc.TokenEndpoint, doc.KeysURI
+	return p.authURL, p.tokenURL, nil
+}
+
+// signingKeys returns the provider's keys with ID [kid] (all of them if empty), fetching them again if there's none
+// (eg. as they were rotated). Keys are fetched at most every oidcDiscoveryRetry.
+func (p *oidcProvider) signingKeys(kid string) ([]crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var matching = func() []crypto.PublicKey {
+		var keys []crypto.PublicKey
+		for id, key := range p.keys {
+			if kid == "" || id == kid {
+				keys = append(keys, key)
+			}
+		}
+		return keys
+	}
+
+	if keys := matching(); len(keys) > 0 || time.Since(p.fetchedAt) < oidcDiscoveryRetry {
+		return keys, nil
+	}
+
+	p.fetchedAt = time.Now()
+	keys, err := fetchOIDCKeys(p.client, p.keysURL)
+	if err != nil {
+		return nil, err
+	}
+	p.keys = keys
+	return matching(), nil
+}
+
+// fetchOIDCKeys fetches the set of keys (see RFC 7517) at [keysURL], and returns the RSA / ECDSA signing keys in it
+// by their ID. Keys of other types (or uses) are skipped.
+func fetchOIDCKeys(client *http.Client, keysURL string) (map[string]crypto.PublicKey, error) {
+	resp, err := client.Get(keysURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch OpenID Connect provider's keys")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to fetch OpenID Connect provider's keys: %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []struct {
+			Type  string `json:"kty"`
+			ID    string `json:"kid"`
+			Use   string `json:"use"`
+			N     string `json:"n"`
+			E     string `json:"e"`
+			Curve string `json:"crv"`
+			X     string `json:"x"`
+			Y     string `json:"y"`
+		} `json:"keys"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxOIDCKeysSize)).Decode(&set); err != nil {
+		return nil, errors.Wrap(err, "failed to parse OpenID Connect provider's keys")
+	}
+
+	var keys = make(map[string]crypto.PublicKey)
+	var curves = map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		var n, e, x, y = decodeBigInt(k.N), decodeBigInt(k.E), decodeBigInt(k.X), decodeBigInt(k.Y)
+		switch curve := curves[k.Curve]; {
+		case k.Type == "RSA" && n != nil && e != nil && e.IsInt64() && e.Int64() > 1 && e.Int64() < 1<<31:
+			keys[k.ID] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case k.Type == "EC" && curve != nil && x != nil && y != nil && curve.IsOnCurve(x, y):
+			keys[k.ID] = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		}
+	}
+	return keys, nil
+}
+
+// decodeBigInt decodes the base64url-encoded, big-endian integer [s], or returns nil if it can't be
+func decodeBigInt(s string) *big.Int {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil
+	}
+	return new(big.Int).SetBytes(b)
+}
+
+// verifySignature returns true if [signature] of [signed], with algorithm [alg] (see idTokenAlgorithms), is
+// valid for [key]
+func verifySignature(key crypto.PublicKey, alg string, signed, signature []byte) bool {
+	algorithm, ok := idTokenAlgorithms[alg]
+	if !ok {
+		return false
+	}
+	var h = algorithm.hash.New()
+	_, _ = h.Write(signed)
+	var digest = h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return algorithm.curve == nil && rsa.VerifyPKCS1v15(key, algorithm.hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		var size = (key.Curve.Params().BitSize + 7) / 8
+		if key.Curve != algorithm.curve || len(signature) != 2*size {
+			return false
+		}
+		var r, s = new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+// loginState is kept in a cookie while the visitor logs in with the provider
+type loginState struct {
+	State   string `json:"state"`
+	Nonce   string `json:"nonce"`
+	Return  string `json:"return"` // path to return to once logged in
+	Expires int64  `json:"exp"`
+}
+
+// loginSession is kept in a cookie once the visitor has logged in
+type loginSession struct {
+	Host    string `json:"host"`
+	Email   string `json:"email"`
+	Expires int64  `json:"exp"`
+}
+
+// login redirects the visitor to log in with the provider, to come back to [r] on [tunnel] afterwards
+func (p *oidcProvider) login(w http.ResponseWriter, r *http.Request, tunnel *httpTunnel, scheme string) {
+	authURL, _, err := p.endpoints()
+	if err != nil {
+		tunnel.notify(fmt.Sprintf("login unavailable: %s", err.Error()), kv("type", "error"), kv("error", err.Error()))
+		http.Error(w, "login is unavailable right now", http.StatusServiceUnavailable)
+		return
+	}
+
+	var state = loginState{State: randomToken(), Nonce: randomToken(), Return: r.URL.RequestURI(),
+		Expires: time.Now().Add(loginStateDuration).Unix()}
+	http.SetCookie(w, &http.Cookie{Name: loginCookie, Value: p.sign(state), Path: oidcCallbackPath,
+		MaxAge: int(loginStateDuration.Seconds()), HttpOnly: true, Secure: scheme == "https", SameSite: http.SameSiteLaxMode})
+
+	var query = url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.clientID},
+		"redirect_uri":  {scheme + "://" + r.Host + oidcCallbackPath},
+		"scope":         {"openid email"},
+		"state":         {state.State},
+		"nonce":         {state.Nonce},
+	}
+
+	var sep = "?"
+	if strings.Contains(authURL, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, authURL+sep+query.Encode(), http.StatusFound)
+}
+
+// callback completes a login on [tunnel]: it exchanges the code the provider sent the visitor back with for their
+// identity, and (if they're allowed in) sets the session cookie and returns them to where they started
+func (p *oidcProvider) callback(w http.ResponseWriter, r *http.Request, tunnel *httpTunnel, scheme string) {
+	var state loginState
+	cookie, err := r.Cookie(loginCookie)
+	if err != nil || !p.verify(cookie.Value, &state) || time.Now().Unix() > state.Expires ||
+		subtle.ConstantTimeCompare([]byte(state.State), []byte(r.URL.Query().Get("state"))) != 1 {
+		http.Error(w, "login expired; please try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: loginCookie, Path: oidcCallbackPath, MaxAge: -1})
+
+	if e := r.URL.Query().Get("error"); e != "" {
+		http.Error(w, "login failed: "+e, http.StatusForbidden)
+		return
+	}
+
+	email, err := p.exchange(r.URL.Query().Get("code"), scheme+"://"+r.Host+oidcCallbackPath, state.Nonce)
+	if err != nil {
+		tunnel.notify(fmt.Sprintf("login failed: %s", err.Error()), kv("type", "error"), kv("error", err.Error()))
+		http.Error(w, "login failed", http.StatusBadGateway)
+		return
+	}
+
+	if !tunnel.options.Access().allowsLogin(email) {
+		tunnel.notify(fmt.Sprintf("denied login from %s as %s", r.RemoteAddr, email),
+			kv("type", "login.denied"), kv("visitor", r.RemoteAddr), kv("email", email))
+		http.Error(w, fmt.Sprintf("%s isn't allowed to visit this site", email), http.StatusForbidden)
+		return
+	}
+
+	var session = loginSession{Host: tunnel.host, Email: email, Expires: time.Now().Add(loginSessionDuration).Unix()}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: p.sign(session), Path: "/",
+		MaxAge: int(loginSessionDuration.Seconds()), HttpOnly: true, Secure: scheme == "https", SameSite: http.SameSiteLaxMode})
+	tunnel.notify(fmt.Sprintf("%s logged in as %s", r.RemoteAddr, email),
+		kv("type", "login"), kv("visitor", r.RemoteAddr), kv("email", email))
+
+	// only ever back to the tunnel: browsers take //host (and /\host) to be another site
+	var back = state.Return
+	if !strings.HasPrefix(back, "/") || strings.HasPrefix(back, "//") || strings.HasPrefix(back, "/\\") {
+		back = "/"
+	}
+	http.Redirect(w, r, back, http.StatusFound)
+}
+
+// exchange redeems [code] at the provider's token endpoint, and returns the (verified) email of the visitor. The ID
+// token is validated as per OpenID Connect Core, section 3.1.3.7: its signature (with one of the provider's keys, see
+// idTokenAlgorithms), issuer, audience, expiry and nonce are checked.
+func (p *oidcProvider) exchange(code, redirectURI, nonce string) (string, error) {
+	_, tokenURL, err := p.endpoints()
+	if err != nil {
+		return "", err
+	}
+
+	var form = url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {redirectURI}}
+	req, err := http.NewRequest(http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to redeem code")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to redeem code")
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("failed to redeem code: %s", resp.Status)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", errors.Wrap(err, "failed to parse token response")
+	}
+
+	payload, err := p.verifyIDToken(token.IDToken)
+	if err != nil {
+		return "", err
+	}
+
+	var claims struct {
+		Issuer        string          `json:"iss"`
+		Audience      json.RawMessage `json:"aud"`
+		Expires       int64           `json:"exp"`
+		Nonce         string          `json:"nonce"`
+		Email         string          `json:"email"`
+		EmailVerified *bool           `json:"email_verified"`
+	}
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return "", errors.Wrap(err, "malformed ID token")
+	}
+
+	var audience []string
+	if json.Unmarshal(claims.Audience, &audience) != nil {
+		audience = []string{""}
+		_ = json.Unmarshal(claims.Audience, &audience[0])
+	}
+
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != p.issuer:
+		return "", errors.Errorf("ID token issued by %q", claims.Issuer)
+	case !contains(audience, p.clientID):
+		return "", errors.New("ID token isn't meant for this server")
+	case time.Now().Unix() > claims.Expires:
+		return "", errors.New("ID token expired")
+	case claims.Nonce != nonce:
+		return "", errors.New("ID token nonce mismatch")
+	case claims.Email == "" || (claims.EmailVerified != nil && !*claims.EmailVerified):
+		return "", errors.New("ID token has no verified email")
+	}
+	return claims.Email, nil
+}
+
+// verifyIDToken checks the signature of the ID token [token] (a JWS, in compact serialization), and returns its payload
+func (p *oidcProvider) verifyIDToken(token string) ([]byte, error) {
+	var parts = strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	encoded, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err == nil {
+		err = json.Unmarshal(encoded, &header)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed ID token")
+	}
+	if _, ok := idTokenAlgorithms[header.Algorithm]; !ok {
+		return nil, errors.Errorf("ID token signed with unsupported algorithm %q", header.Algorithm)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed ID token")
+	}
+	keys, err := p.signingKeys(header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	var verified = false
+	for _, key := range keys {
+		verified = verified || verifySignature(key, header.Algorithm, []byte(parts[0]+"."+parts[1]), signature)
+	}
+	if !verified {
+		return nil, errors.New("ID token signature is invalid")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	return payload, errors.Wrap(err, "malformed ID token")
+}
+
+// session returns the email of the visitor logged in to [host] with [r], if any
+func (p *oidcProvider) session(r *http.Request, host string) (string, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", false
+	}
+
+	var session loginSession
+	if !p.verify(cookie.Value, &session) || session.Host != host || time.Now().Unix() > session.Expires {
+		return "", false
+	}
+	return session.Email, true
+}
+
+// sign returns [v] encoded as JSON, along with its signature, for use as a cookie value
+func (p *oidcProvider) sign(v interface{}) string {
+	var payload, _ = json.Marshal(v)
+	var mac = hmac.New(sha256.New, p.key)
+	_, _ = mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks the signature of [value] (see sign), and decodes it into [v]
+func (p *oidcProvider) verify(value string, v interface{}) bool {
+	var parts = strings.Split(value, ".")
+	if len(parts) != 2 {
+		return false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+
+	var mac = hmac.New(sha256.New, p.key)
+	_, _ = mac.Write(payload)
+	return hmac.Equal(signature, mac.Sum(nil)) && json.Unmarshal(payload, v) == nil
+}
+
+// randomToken returns a random, URL-safe token
+func randomToken() string {
+	var b = make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,422 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testProvider is an OpenID Connect provider, with an RSA key ("rsa") and an ECDSA key ("ec"), issuing the ID token set
+type testProvider struct {
+	*httptest.Server
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+
+	mu      sync.Mutex // guards the keys too, which may be rotated
+	idToken string
+}
+
+func (tp *testProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	var encode = func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.Bytes()) }
+
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		_ = json.NewEncoder(w).Encode(map[string]string{"issuer": tp.URL, "authorization_endpoint": tp.URL + "/authorize",
+			"token_endpoint": tp.URL + "/token", "jwks_uri": tp.URL + "/jwks"})
+	case "/jwks":
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": encode(tp.rsa.N), "e": encode(big.NewInt(int64(tp.rsa.E)))},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(tp.ec.X), "y": encode(tp.ec.Y)},
+			{"kty": "RSA", "kid": "enc", "use": "enc", "n": encode(tp.rsa.N), "e": "AQAB"}, // not for signatures
+			{"kty": "OKP", "kid": "okp", "crv": "Ed25519", "x": "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"},
+		}})
+	case "/token":
+		if id, secret, ok := r.BasicAuth(); r.Method != http.MethodPost || !ok || id != "shhh" || secret != "secret" {
+			http.Error(w, "invalid client", http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": tp.idToken})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// issue makes the provider issue [idToken]
+func (tp *testProvider) issue(idToken string) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	tp.idToken = idToken
+}
+
+// newTestProvider starts a testProvider, and returns it along with an oidcProvider (with client ID "shhh") using it
+func newTestProvider(t *testing.T) (*testProvider, *oidcProvider) {
+	var tp = &testProvider{}
+	var err error
+	if tp.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if tp.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	tp.Server = httptest.NewServer(tp)
+
+	p, err := newOIDCProvider(&Config{OIDCIssuer: tp.URL, OIDCClientID: "shhh", OIDCClientSecret: "secret"})
+	if err != nil {
+		tp.Close()
+		t.Fatal(err)
+	}
+	return tp, p
+}
+
+// signIDToken returns an ID token with [claims], signed with [key] (nil for none) as [alg], with key ID [kid]
+func signIDToken(t *testing.T, key crypto.Signer, alg, kid string, claims map[string]interface{}) string {
+	var header, _ = json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	var payload, _ = json.Marshal(claims)
+	var signed = base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	if key == nil {
+		return signed + "."
+	}
+
+	var hash = idTokenAlgorithms[alg].hash
+	if hash == 0 {
+		hash = crypto.SHA256
+	}
+	var h = hash.New()
+	_, _ = h.Write([]byte(signed))
+
+	var signature []byte
+	var err error
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, hash, h.Sum(nil))
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+		if err == nil {
+			var size = (key.Curve.Params().BitSize + 7) / 8
+			signature = make([]byte, 2*size)
+			copy(signature[size-len(r.Bytes()):size], r.Bytes())
+			copy(signature[2*size-len(s.Bytes()):], s.Bytes())
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// testClaims returns the claims of a valid ID token issued by [tp] for alice@example.com, with nonce "n0nce"
+func testClaims(tp *testProvider) map[string]interface{} {
+	return map[string]interface{}{"iss": tp.URL, "aud": "shhh", "exp": time.Now().Add(time.Hour).Unix(),
+		"nonce": "n0nce", "email": "alice@example.com", "email_verified": true}
+}
+
+func TestOIDCExchange(t *testing.T) {
+	var tp, p = newTestProvider(t)
+	defer tp.Close()
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// claims returns the valid claims, with [key] set to [value] (or removed, if nil)
+	var claims = func(key string, value interface{}) map[string]interface{} {
+		var c = testClaims(tp)
+		if value == nil {
+			delete(c, key)
+		} else {
+			c[key] = value
+		}
+		return c
+	}
+
+	var tests = []struct {
+		name  string
+		token string
+		err   string // expected error, if any
+	}{
+		{"RS256", signIDToken(t, tp.rsa, "RS256", "rsa", testClaims(tp)), ""},
+		{"RS512", signIDToken(t, tp.rsa, "RS512", "rsa", testClaims(tp)), ""},
+		{"ES256", signIDToken(t, tp.ec, "ES256", "ec", testClaims(tp)), ""},
+		{"without key ID", signIDToken(t, tp.ec, "ES256", "", testClaims(tp)), ""},
+		{"audiences", signIDToken(t, tp.rsa, "RS256", "rsa", claims("aud", []string{"other", "shhh"})), ""},
+		{"email not said to be verified", signIDToken(t, tp.rsa, "RS256", "rsa", claims("email_verified", nil)), ""},
+
+		{"another issuer", signIDToken(t, tp.rsa, "RS256", "rsa", claims("iss", "https://evil.example.com")), "issued by"},
+		{"another audience", signIDToken(t, tp.rsa, "RS256", "rsa", claims("aud", "other")), "isn't meant for this server"},
+		{"other audiences", signIDToken(t, tp.rsa, "RS256", "rsa", claims("aud", []string{"other"})), "isn't meant for this server"},
+		{"no audience", signIDToken(t, tp.rsa, "RS256", "rsa", claims("aud", nil)), "isn't meant for this server"},
+		{"expired", signIDToken(t, tp.rsa, "RS256", "rsa", claims("exp", time.Now().Add(-time.Minute).Unix())), "expired"},
+		{"no expiry", signIDToken(t, tp.rsa, "RS256", "rsa", claims("exp", nil)), "expired"},
+		{"another nonce", signIDToken(t, tp.rsa, "RS256", "rsa", claims("nonce", "replayed")), "nonce mismatch"},
+		{"no nonce", signIDToken(t, tp.rsa, "RS256", "rsa", claims("nonce", nil)), "nonce mismatch"},
+		{"unverified email", signIDToken(t, tp.rsa, "RS256", "rsa", claims("email_verified", false)), "no verified email"},
+		{"no email", signIDToken(t, tp.rsa, "RS256", "rsa", claims("email", nil)), "no verified email"},
+
+		{"unsigned", signIDToken(t, nil, "none", "", testClaims(tp)), "unsupported algorithm"},
+		{"HMAC", signIDToken(t, tp.rsa, "HS256", "rsa", testClaims(tp)), "unsupported algorithm"},
+		{"another key", signIDToken(t, other, "RS256", "rsa", testClaims(tp)), "signature is invalid"},
+		{"unknown key ID", signIDToken(t, other, "RS256", "other", testClaims(tp)), "signature is invalid"},
+		{"encryption key", signIDToken(t, tp.rsa, "RS256", "enc", testClaims(tp)), "signature is invalid"},
+		{"algorithm of another key", signIDToken(t, tp.ec, "RS256", "ec", testClaims(tp)), "signature is invalid"},
+		{"curve of another algorithm", signIDToken(t, tp.ec, "ES384", "ec", testClaims(tp)), "signature is invalid"},
+		{"tampered", func() string {
+			var parts = strings.Split(signIDToken(t, tp.rsa, "RS256", "rsa", testClaims(tp)), ".")
+			var payload, _ = json.Marshal(claims("email", "mallory@example.com"))
+			return parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+		}(), "signature is invalid"},
+		{"malformed", "not.a-token", "malformed"},
+		{"none", "", "malformed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tp.issue(test.token)
+			email, err := p.exchange("code", "http://alice.example.com"+oidcCallbackPath, "n0nce")
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got %q (err: %v), want error %q", email, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if email != "alice@example.com" {
+				t.Fatalf("got %q, want alice@example.com", email)
+			}
+		})
+	}
+}
+
+// the provider's keys are fetched again for a key ID which isn't known (eg. once rotated), but not more than every
+// oidcDiscoveryRetry
+func TestOIDCKeyRotation(t *testing.T) {
+	var tp, p = newTestProvider(t)
+	defer tp.Close()
+	if _, _, err := p.endpoints(); err != nil {
+		t.Fatal(err)
+	}
+
+	var before = tp.ec
+	if keys, err := p.signingKeys("ec"); err != nil || len(keys) != 1 {
+		t.Fatalf("got %d keys (err: %v), want the ECDSA key", len(keys), err)
+	}
+
+	rotated, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.mu.Lock()
+	tp.ec = rotated
+	tp.mu.Unlock()
+
+	// the cached key is used, until another is asked for after a while
+	if keys, _ := p.signingKeys("ec"); len(keys) != 1 || keys[0].(*ecdsa.PublicKey).X.Cmp(before.X) != 0 {
+		t.Fatal("keys fetched again, while the one asked for was known")
+	}
+	if keys, _ := p.signingKeys("rotated"); len(keys) != 0 {
+		t.Fatal("keys fetched again right after they were")
+	}
+	p.fetchedAt = time.Now().Add(-oidcDiscoveryRetry)
+	_, _ = p.signingKeys("rotated")
+	if keys, _ := p.signingKeys("ec"); len(keys) != 1 || keys[0].(*ecdsa.PublicKey).X.Cmp(rotated.X) != 0 {
+		t.Fatal("keys weren't fetched again for an unknown key ID")
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	var opts = newSessionOptions()
+	if _, err := opts.Parse([]string{"--basic-auth", "alice:s3cret", "--basic-auth", "bob:hunter2"}, nil, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	var router = &httpRouter{}
+	var tunnel = &httpTunnel{host: "web.example.com", options: opts}
+
+	var tests = []struct {
+		name           string
+		user, password string // no credentials, if empty
+		want           bool
+	}{
+		{"alice", "alice", "s3cret", true},
+		{"bob", "bob", "hunter2", true},
+		{"no credentials", "", "", false},
+		{"wrong password", "alice", "hunter2", false},
+		{"unknown user", "mallory", "s3cret", false},
+		{"in the password", "alice:s3cret", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var r = httptest.NewRequest(http.MethodGet, "http://web.example.com/", nil)
+			r.Header.Set(userHeader, "admin") // visitors can't say who they are
+			if test.user != "" {
+				r.SetBasicAuth(test.user, test.password)
+			}
+
+			var w = httptest.NewRecorder()
+			if got := router.authorize(w, r, tunnel, "http"); got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+			if !test.want {
+				if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+					t.Fatalf("got status %d (challenge %q), want a challenge", w.Code, w.Header().Get("WWW-Authenticate"))
+				}
+				return
+			}
+			if r.Header.Get(userHeader) != test.user || r.Header.Get("Authorization") != "" {
+				t.Fatalf("local service told the visitor is %q (with Authorization %q), want %q",
+					r.Header.Get(userHeader), r.Header.Get("Authorization"), test.user)
+			}
+		})
+	}
+
+	// a tunnel requiring logins isn't let into on a server without a provider
+	if _, err := opts.Parse([]string{"--login", "*"}, nil, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	var w = httptest.NewRecorder()
+	if router.authorize(w, httptest.NewRequest(http.MethodGet, "http://web.example.com/", nil), tunnel, "http") ||
+		w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want the tunnel unavailable without a provider", w.Code)
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	var tp, p = newTestProvider(t)
+	defer tp.Close()
+	tp.issue(signIDToken(t, tp.rsa, "RS256", "rsa", testClaims(tp)))
+
+	var opts = newSessionOptions()
+	if _, err := opts.Parse([]string{"--login", "@example.com"}, nil, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	var router = &httpRouter{oidc: p}
+	var tunnel = &httpTunnel{host: "web.example.com", options: opts, notify: func(string, ...field) {}}
+
+	// visitors are sent to log in with the provider
+	var w = httptest.NewRecorder()
+	if router.authorize(w, httptest.NewRequest(http.MethodGet, "http://web.example.com/app?tab=1", nil), tunnel, "http") {
+		t.Fatal("visitor let in without logging in")
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || w.Code != http.StatusFound || !strings.HasPrefix(location.String(), tp.URL+"/authorize?") ||
+		location.Query().Get("redirect_uri") != "http://web.example.com"+oidcCallbackPath || location.Query().Get("nonce") == "" {
+		t.Fatalf("got status %d to %q, want a redirect to the provider", w.Code, w.Header().Get("Location"))
+	}
+	var state loginState
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || !p.verify(cookies[0].Value, &state) || state.Return != "/app?tab=1" ||
+		state.State != location.Query().Get("state") {
+		t.Fatalf("got cookies %v, want the state of the login", cookies)
+	}
+
+	// callback completes the login started with [state], and returns the response
+	var callback = func(state loginState, query string) *httptest.ResponseRecorder {
+		var r = httptest.NewRequest(http.MethodGet, "http://web.example.com"+oidcCallbackPath+"?"+query, nil)
+		r.AddCookie(&http.Cookie{Name: loginCookie, Value: p.sign(state)})
+		var w = httptest.NewRecorder()
+		if router.authorize(w, r, tunnel, "http") {
+			t.Fatal("callback passed on to the local service")
+		}
+		return w
+	}
+	var started = func(back string) loginState {
+		return loginState{State: "st4te", Nonce: "n0nce", Return: back, Expires: time.Now().Add(time.Minute).Unix()}
+	}
+
+	t.Run("logged in", func(t *testing.T) {
+		var w = callback(started("/app?tab=1"), "state=st4te&code=c0de")
+		if w.Code != http.StatusFound || w.Header().Get("Location") != "/app?tab=1" {
+			t.Fatalf("got status %d to %q, want a redirect to where the login started", w.Code, w.Header().Get("Location"))
+		}
+
+		var session *http.Cookie
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.Name == sessionCookie {
+				session = cookie
+			}
+		}
+		if session == nil {
+			t.Fatal("no session cookie set")
+		}
+
+		var r = httptest.NewRequest(http.MethodGet, "http://web.example.com/app", nil)
+		r.AddCookie(session)
+		r.AddCookie(&http.Cookie{Name: "theirs", Value: "kept"})
+		if !router.authorize(httptest.NewRecorder(), r, tunnel, "http") {
+			t.Fatal("visitor logged in not let in")
+		}
+		if r.Header.Get(userHeader) != "alice@example.com" || r.Header.Get("Cookie") != "theirs=kept" {
+			t.Fatalf("local service told the visitor is %q (with cookies %q)", r.Header.Get(userHeader), r.Header.Get("Cookie"))
+		}
+
+		// the session is only valid on the tunnel it was started on
+		r = httptest.NewRequest(http.MethodGet, "http://other.example.com/app", nil)
+		r.AddCookie(session)
+		if _, ok := p.session(r, "other.example.com"); ok {
+			t.Fatal("visitor logged in to another tunnel")
+		}
+	})
+
+	// visitors are only ever returned to the tunnel
+	for _, back := range []string{"//evil.example.com/", "https://evil.example.com/", "/\\evil.example.com", "evil.example.com", ""} {
+		t.Run("return to "+back, func(t *testing.T) {
+			var w = callback(started(back), "state=st4te&code=c0de")
+			if w.Code != http.StatusFound || w.Header().Get("Location") != "/" {
+				t.Fatalf("got status %d to %q, want a redirect to /", w.Code, w.Header().Get("Location"))
+			}
+		})
+	}
+
+	var failures = []struct {
+		name   string
+		state  loginState
+		query  string
+		status int
+	}{
+		{"another state", started("/"), "state=other&code=c0de", http.StatusBadRequest},
+		{"expired", loginState{State: "st4te", Nonce: "n0nce", Return: "/", Expires: time.Now().Add(-time.Second).Unix()}, "state=st4te&code=c0de", http.StatusBadRequest},
+		{"another nonce", loginState{State: "st4te", Nonce: "other", Return: "/", Expires: time.Now().Add(time.Minute).Unix()}, "state=st4te&code=c0de", http.StatusBadGateway},
+		{"refused", started("/"), "state=st4te&error=access_denied", http.StatusForbidden},
+	}
+	for _, test := range failures {
+		t.Run(test.name, func(t *testing.T) {
+			if w := callback(test.state, test.query); w.Code != test.status {
+				t.Fatalf("got status %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+
+	t.Run("not allowed", func(t *testing.T) {
+		var claims = testClaims(tp)
+		claims["email"] = "mallory@example.org"
+		tp.issue(signIDToken(t, tp.rsa, "RS256", "rsa", claims))
+		if w := callback(started("/"), "state=st4te&code=c0de"); w.Code != http.StatusForbidden {
+			t.Fatalf("got status %d, want %d", w.Code, http.StatusForbidden)
+		}
+	})
+
+	t.Run("forged cookie", func(t *testing.T) {
+		var r = httptest.NewRequest(http.MethodGet, "http://web.example.com/", nil)
+		var forged, _ = json.Marshal(loginSession{Host: "web.example.com", Email: "alice@example.com", Expires: time.Now().Add(time.Hour).Unix()})
+		r.AddCookie(&http.Cookie{Name: sessionCookie, Value: base64.RawURLEncoding.EncodeToString(forged) + ".c2lnbmF0dXJl"})
+		if router.authorize(httptest.NewRecorder(), r, tunnel, "http") {
+			t.Fatal("visitor with a forged session let in")
+		}
+	})
+}
@@ -0,0 +1,427 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains types and methods for the HTTP edge, which routes incoming HTTP requests
+// to tunnels based on the Host header (eg. ssh -R myapp:80:localhost:3000 exposes http://myapp.<domain>)
+// ----------
+
+// port requested by clients (in tcpip-forward) to create an HTTP tunnel
+const httpPort = 80
+
+// edgeDialer dials the upstreams of the edge (eg. the honeypot). Dual-stack hosts are dialed happy eyeballs style
+// (see RFC 8305): if the first address family doesn't connect within FallbackDelay, the other one is raced against it.
+var edgeDialer = &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second, FallbackDelay: 100 * time.Millisecond}
+
+// edgeTransport returns a new http.Transport dialing with edgeDialer
+func edgeTransport() *http.Transport {
+	var transport = http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = edgeDialer.DialContext
+	return transport
+}
+
+// valid tunnel names are DNS labels
+var tunnelNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// httpTunnel represents a tunnel registered with the HTTP edge
+type httpTunnel struct {
+	host       string
+	notify     notifyFn
+	proxy      *httputil.ReverseProxy
+	pool       *channelPool
+	quarantine *quarantine
+	options    *sessionOptions
+	inspector  *inspector // nil unless requests are captured
+
+	// serves requests: the proxy (or the inspector), wrapped in the router's middleware
+	handler http.Handler
+
+	// tracks in-flight requests
+	active sync.WaitGroup
+}
+
+// newHTTPTunnel returns a new httpTunnel for [host] which forwards requests over channels opened using [newChannel].
+// Responses are rewritten as requested by the client in [options], and up to the number of channels requested
+// (but at most [maxPool]) are kept open ahead of time. Visitors are shown a hold page while [q] is held, and the
+// unavailable page of [pages] if the local service can't be reached.
+func newHTTPTunnel(host string, newChannel newChannelFn, notify notifyFn, options *sessionOptions, maxPool int, q *quarantine, pages *errorPages) *httpTunnel {
+	var pool = newChannelPool(newChannel, func() int {
+		var size = 0
+		if options != nil {
+			size = options.PoolSize()
+		}
+
+		if size > maxPool {
+			size = maxPool
+		}
+		return size
+	})
+
+	var transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return pool.Get()
+		},
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     30 * time.Second,
+	}
+
+	var proxy = httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: host})
+	proxy.Transport = transport
+	// responses are passed on as they're written, so that streams (eg. server-sent events of live-reload dev servers,
+	// or gRPC-web) reach visitors right away; upgraded connections (eg. WebSockets) are spliced by the proxy itself
+	proxy.FlushInterval = -1
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if options != nil {
+			options.RewriteResponseHeaders(resp.Header)
+		}
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		notify(fmt.Sprintf("error occurred while processing %s %s: %s", r.Method, r.URL.RequestURI(), err.Error()),
+			kv("type", "error"), kv("method", r.Method), kv("path", r.URL.RequestURI()), kv("error", err.Error()))
+		pages.serve(w, r, pageUnavailable)
+	}
+
+	return &httpTunnel{host: host, notify: notify, proxy: proxy, pool: pool, quarantine: q, options: options}
+}
+
+// Close waits for in-flight requests to finish and releases idle (and pooled) channels
+func (tunnel *httpTunnel) Close() {
+	tunnel.active.Wait()
+	tunnel.pool.Close()
+	tunnel.proxy.Transport.(*http.Transport).CloseIdleConnections()
+}
+
+// httpRouter is an http.Handler that routes incoming requests to registered tunnels based on the Host header
+type httpRouter struct {
+	domain string
+
+	mu      sync.RWMutex
+	tunnels map[string]*httpTunnel
+
+	// hostnames matching any of these patterns can't be registered
+	denied []string
+
+	// if set, requests for denied / unknown hostnames are forwarded here
+	honeypot http.Handler
+
+	// served in place of tunnels (eg. to visitors of unknown hostnames, if there's no honeypot)
+	pages *errorPages
+
+	// proxies / CDNs in front of the edge, whose forwarded headers are trusted
+	proxies ipNetworks
+
+	// maximum number of channels a tunnel can keep open ahead of time
+	maxPool int
+
+	// number of requests (and bytes of their bodies) captured by each tunnel's inspector
+	inspectSize, inspectBodyLimit int
+
+	// provider visitors of tunnels protected with --login log in with; nil if none is configured
+	oidc *oidcProvider
+
+	// generates names for tunnels that didn't request one
+	names *nameGenerator
+
+	// returns true if the name is reserved for, or held for, some key and mustn't be generated for other tunnels
+	reserved func(name string) bool
+
+	// returns the node of the cluster serving the tunnel with the name, if another one does; nil if not clustered
+	elsewhere func(name string) *ClusterNode
+
+	// relays requests for the tunnel with the name to the node serving it; nil if nodes don't relay connections
+	relay func(node *ClusterNode, name string) http.Handler
+
+	// applied to the requests of every tunnel
+	middleware middlewareChain
+}
+
+// newHTTPRouter returns a new httpRouter serving tunnels as sub-domains of [domain]. Generated names
+// are never ones for which [reserved] returns true.
+func newHTTPRouter(config *Config, reserved func(name string) bool) (*httpRouter, error) {
+	var router = &httpRouter{
+		domain:   strings.ToLower(config.Domain),
+		tunnels:  make(map[string]*httpTunnel),
+		denied:   config.DeniedHosts,
+		maxPool:  config.MaxChannelPool,
+		reserved: reserved,
+
+		inspectSize:      config.InspectRequests,
+		inspectBodyLimit: config.InspectBodyLimit,
+	}
+
+	for _, pattern := range router.denied {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid denied host pattern %q", pattern)
+		}
+	}
+
+	var err error
+	if router.proxies, err = parseIPNetworks(config.TrustedProxies); err != nil {
+		return nil, err
+	}
+
+	if router.names, err = newNameGenerator(config.TunnelWords); err != nil {
+		return nil, err
+	}
+
+	if router.oidc, err = newOIDCProvider(config); err != nil {
+		return nil, err
+	}
+
+	if router.pages, err = newErrorPages(config.ErrorPages, config.ErrorFormat); err != nil {
+		return nil, err
+	}
+
+	if config.HoneypotAddr != "" {
+		target, err := url.Parse(config.HoneypotAddr)
+		if err != nil || target.Host == "" {
+			return nil, errors.Errorf("invalid honeypot address %q", config.HoneypotAddr)
+		}
+		var proxy = httputil.NewSingleHostReverseProxy(target)
+		proxy.Transport = edgeTransport()
+		router.honeypot = proxy
+	}
+
+	return router, nil
+}
+
+// Register registers a new tunnel using the requested [name] (or a generated one, like brave-otter-123, if empty).
+// The tunnel is reachable at <name>.<domain>
+func (router *httpRouter) Register(name string, newChannel newChannelFn, notify notifyFn, options *sessionOptions, q *quarantine) (*httpTunnel, error) {
+	if name = strings.ToLower(name); name != "" {
+		return router.register(name, newChannel, notify, options, q)
+	}
+
+	// try a few generated names, in case of a collision
+	for attempt := 1; ; attempt++ {
+		var tunnel *httpTunnel
+		var err error
+		if name = router.names.generate(); router.reserved(name) {
+			err = errors.Errorf("name %q is reserved", name)
+		} else if tunnel, err = router.register(name, newChannel, notify, options, q); err == nil {
+			return tunnel, nil
+		}
+
+		if attempt >= nameAttempts {
+			return nil, errors.Wrap(err, "failed to generate an available name")
+		}
+	}
+}
+
+// register registers a new tunnel using [name]; see Register
+func (router *httpRouter) register(name string, newChannel newChannelFn, notify notifyFn, options *sessionOptions, q *quarantine) (*httpTunnel, error) {
+	if !tunnelNamePattern.MatchString(name) {
+		return nil, errors.Errorf("invalid name %q: must be a valid DNS label", name)
+	}
+
+	var host = name + "." + router.domain
+	if router.isDenied(host) {
+		return nil, errors.Errorf("name %q is not allowed", name)
+	}
+
+	tunnel, err := router.RegisterHost(host, newChannel, notify, options, q)
+	if err != nil {
+		return nil, errors.Errorf("name %q is already in use", name)
+	}
+	return tunnel, nil
+}
+
+// RegisterHost registers a new tunnel reachable at [host], a custom domain (or a sub-domain, see register)
+func (router *httpRouter) RegisterHost(host string, newChannel newChannelFn, notify notifyFn, options *sessionOptions, q *quarantine) (*httpTunnel, error) {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+
+	if _, exists := router.tunnels[host]; exists {
+		return nil, errors.Errorf("%s is already in use", host)
+	}
+
+	var tunnel = newHTTPTunnel(host, newChannel, notify, options, router.maxPool, q, router.pages)
+	tunnel.inspector = newInspector(router.inspectSize, router.inspectBodyLimit)
+	tunnel.handler = router.middleware.http(http.HandlerFunc(tunnel.serve))
+	router.tunnels[host] = tunnel
+	return tunnel, nil
+}
+
+// Deregister removes the [tunnel] from the router; no new requests are routed to it afterwards
+func (router *httpRouter) Deregister(tunnel *httpTunnel) {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+
+	if router.tunnels[tunnel.host] == tunnel {
+		delete(router.tunnels, tunnel.host)
+	}
+}
+
+// isDenied returns true if [host] matches any of the denied host patterns
+func (router *httpRouter) isDenied(host string) bool {
+	for _, pattern := range router.denied {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the tunnel registered for [host] (if any), taking care of the in-flight request accounting
+func (router *httpRouter) lookup(host string) *httpTunnel {
+	router.mu.RLock()
+	defer router.mu.RUnlock()
+
+	var tunnel, ok = router.tunnels[host]
+	if ok {
+		tunnel.active.Add(1)
+	}
+	return tunnel
+}
+
+func (router *httpRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var scheme = requestScheme(r, router.proxies)
+	router.proxies.restoreVisitorAddr(r)
+
+	var host = strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if router.isDenied(host) {
+		router.serveHoneypot(w, r, "denied")
+		return
+	}
+
+	var tunnel = router.lookup(host)
+	if tunnel == nil {
+		// the tunnel is served by another node of the cluster; the load balancer can retry there
+		if name := strings.TrimSuffix(host, "."+router.domain); name != host && router.elsewhere != nil {
+			if node := router.elsewhere(name); node != nil && router.relay != nil && node.Relay != "" {
+				router.relay(node, name).ServeHTTP(w, r)
+				return
+			} else if node != nil {
+				w.Header().Set("X-Shhh-Node", node.Addr)
+				http.Error(w, fmt.Sprintf("%s is served by node %s", host, node.ID), http.StatusMisdirectedRequest)
+				return
+			}
+		}
+
+		// the name belongs to a client that isn't connected right now
+		if name := strings.TrimSuffix(host, "."+router.domain); name != host && router.reserved(name) {
+			w.Header().Set("Retry-After", "60")
+			router.pages.serve(w, r, pageOffline)
+			return
+		}
+
+		router.serveHoneypot(w, r, "unknown")
+		return
+	}
+	defer tunnel.active.Done()
+
+	if held, _ := tunnel.quarantine.Held(); held {
+		w.Header().Set("Retry-After", "300")
+		router.pages.serve(w, r, pageOnHold)
+		return
+	}
+
+	if !router.authorize(w, r, tunnel, scheme) {
+		return
+	}
+
+	var fields = []field{kv("type", "request"), kv("method", r.Method), kv("path", r.URL.RequestURI()),
+		kv("visitor", r.RemoteAddr), kv("protocol", r.Proto)}
+	var text = fmt.Sprintf("%s %s from %s", r.Method, r.URL.RequestURI(), r.RemoteAddr)
+	if upgrade := upgradeType(r); upgrade != "" {
+		text, fields = text+" (upgrade to "+upgrade+")", append(fields, kv("upgrade", upgrade))
+	}
+	tunnel.notify(text, fields...)
+	tunnel.handler.ServeHTTP(w, r)
+}
+
+// serve forwards [r] to the client, capturing it if the inspector is enabled
+func (tunnel *httpTunnel) serve(w http.ResponseWriter, r *http.Request) {
+	if tunnel.inspector != nil {
+		tunnel.inspector.serve(tunnel.proxy, w, r, 0)
+	} else {
+		tunnel.proxy.ServeHTTP(w, r)
+	}
+}
+
+// upgradeType returns the protocol [r] asks to switch to (eg. websocket), if any
+func upgradeType(r *http.Request) string {
+	for _, value := range r.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return strings.ToLower(r.Header.Get("Upgrade"))
+			}
+		}
+	}
+	return ""
+}
+
+// replay sends the captured request with [id] to the tunnel again (see inspector.replay)
+func (tunnel *httpTunnel) replay(id int64) (CapturedRequest, error) {
+	if tunnel.inspector == nil {
+		return CapturedRequest{}, errors.New("requests aren't captured on this server")
+	}
+
+	if held, _ := tunnel.quarantine.Held(); held {
+		return CapturedRequest{}, errors.Errorf("tunnel %s is quarantined", tunnel.host)
+	}
+
+	tunnel.active.Add(1)
+	defer tunnel.active.Done()
+	return tunnel.inspector.replay(tunnel.proxy, id)
+}
+
+// serveHoneypot forwards request for a denied / unknown host to the honeypot (if configured), or serves the
+// not found page
+func (router *httpRouter) serveHoneypot(w http.ResponseWriter, r *http.Request, reason string) {
+	if router.honeypot == nil {
+		router.pages.serve(w, r, pageNotFound)
+		return
+	}
+
+	log.Printf("honeypot: %s host for %q from %s: %s %s", reason, r.Host, r.RemoteAddr, r.Method, r.URL.RequestURI())
+	r.Header.Set("X-Shhh-Honeypot-Reason", reason)
+	router.honeypot.ServeHTTP(w, r)
+}
+
+// isWildcardBindAddr returns true if [addr] (as sent by ssh clients in tcpip-forward) doesn't name a tunnel
+func isWildcardBindAddr(addr string) bool {
+	switch addr {
+	case "", "*", "localhost", "0.0.0.0", "::", "127.0.0.1", "::1":
+		return true
+	}
+	return false
+}
+
+// channelConn adapts a gossh.Channel into a net.Conn
+type channelConn struct {
+	gossh.Channel
+}
+
+func (conn *channelConn) LocalAddr() net.Addr                { return channelAddr{} }
+func (conn *channelConn) RemoteAddr() net.Addr               { return channelAddr{} }
+func (conn *channelConn) SetDeadline(_ time.Time) error      { return nil }
+func (conn *channelConn) SetReadDeadline(_ time.Time) error  { return nil }
+func (conn *channelConn) SetWriteDeadline(_ time.Time) error { return nil }
+
+// channelAddr is the net.Addr of an ssh channel
+type channelAddr struct{}
+
+func (channelAddr) Network() string { return "ssh" }
+func (channelAddr) String() string  { return "ssh-channel" }
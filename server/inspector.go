@@ -0,0 +1,267 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ----------
+// This file contains the request inspector of HTTP tunnels: it captures their recent requests and responses (with
+// bodies up to a limit) so that operators can look at them, and replay them, through the admin API
+// ----------
+
+// header set on replayed requests, with the ID of the request being replayed
+const replayHeader = "X-Shhh-Replay"
+
+// exchange is a request to an HTTP tunnel, along with its response
+type exchange struct {
+	id      int64
+	time    time.Time
+	visitor string // the request's RemoteAddr
+	replay  int64  // ID of the replayed request, if this is a replay
+
+	method string
+	uri    string
+	host   string
+	header http.Header
+	body   []byte
+	cut    bool // set if body was truncated
+
+	status       int
+	respHeader   http.Header
+	respBody     []byte
+	respCut      bool
+	duration     time.Duration
+	bytesWritten int64
+}
+
+// CapturedRequest is a request to an HTTP tunnel captured by the inspector, along with its response. Bodies are
+// included up to Config.InspectBodyLimit; bodies which aren't valid UTF-8 are base64-encoded.
+type CapturedRequest struct {
+	ID      int64     `json:"id"`
+	Time    time.Time `json:"time"`
+	Visitor string    `json:"visitor"`
+	Replay  int64     `json:"replay_of,omitempty"` // ID of the replayed request, if this is a replay
+
+	Method              string      `json:"method"`
+	URI                 string      `json:"uri"`
+	Host                string      `json:"host"`
+	Header              http.Header `json:"header"`
+	Body                string      `json:"body,omitempty"`
+	BodyEncoding        string      `json:"body_encoding,omitempty"`
+	BodyTruncated       bool        `json:"body_truncated,omitempty"`
+	Status              int         `json:"status"`
+	ResponseHeader      http.Header `json:"response_header"`
+	ResponseBody        string      `json:"response_body,omitempty"`
+	ResponseEncoding    string      `json:"response_body_encoding,omitempty"`
+	ResponseTruncated   bool        `json:"response_body_truncated,omitempty"`
+	ResponseBytes       int64       `json:"response_bytes"`
+	DurationMillisecond int64       `json:"duration_ms"`
+}
+
+// encodeBody returns [body] as a string, base64-encoding it (as told by the returned encoding) if it isn't valid UTF-8
+func encodeBody(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+// captured describes the exchange
+func (ex *exchange) captured() CapturedRequest {
+	var c = CapturedRequest{
+		ID: ex.id, Time: ex.time, Visitor: ex.visitor, Replay: ex.replay,
+		Method: ex.method, URI: ex.uri, Host: ex.host, Header: ex.header, BodyTruncated: ex.cut,
+		Status: ex.status, ResponseHeader: ex.respHeader, ResponseTruncated: ex.respCut, ResponseBytes: ex.bytesWritten,
+		DurationMillisecond: ex.duration.Milliseconds(),
+	}
+	c.Body, c.BodyEncoding = encodeBody(ex.body)
+	c.ResponseBody, c.ResponseEncoding = encodeBody(ex.respBody)
+	return c
+}
+
+// inspector keeps the most recent exchanges of an HTTP tunnel in a ring buffer
+type inspector struct {
+	size      int // number of exchanges kept
+	bodyLimit int // bytes of each body kept
+
+	mu   sync.Mutex
+	next int64       // ID of the next exchange
+	ring []*exchange // oldest first
+}
+
+// newInspector returns an inspector keeping [size] exchanges, with up to [bodyLimit] bytes of each body.
+// It returns nil if [size] is zero.
+func newInspector(size, bodyLimit int) *inspector {
+	if size <= 0 {
+		return nil
+	}
+	return &inspector{size: size, bodyLimit: bodyLimit, next: 1}
+}
+
+// add records [ex], assigning it an ID
+func (in *inspector) add(ex *exchange) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	ex.id, in.next = in.next, in.next+1
+	if in.ring = append(in.ring, ex); len(in.ring) > in.size {
+		in.ring = in.ring[1:]
+	}
+}
+
+// Requests returns the captured exchanges, newest first
+func (in *inspector) Requests() []CapturedRequest {
+	var captured = []CapturedRequest{}
+	if in == nil {
+		return captured
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for i := len(in.ring) - 1; i >= 0; i-- {
+		captured = append(captured, in.ring[i].captured())
+	}
+	return captured
+}
+
+// get returns the exchange with [id], if it's still kept
+func (in *inspector) get(id int64) (*exchange, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for _, ex := range in.ring {
+		if ex.id == id {
+			return ex, nil
+		}
+	}
+	return nil, errors.Errorf("request %d isn't captured (anymore)", id)
+}
+
+// serve serves [r] (a replay of the request with ID [replayOf], if non-zero) using [handler], capturing the request
+// and its response. It returns the captured exchange.
+func (in *inspector) serve(handler http.Handler, w http.ResponseWriter, r *http.Request, replayOf int64) *exchange {
+	var ex = &exchange{
+		time: time.Now(), visitor: r.RemoteAddr, replay: replayOf,
+		method: r.Method, uri: r.URL.RequestURI(), host: r.Host, header: r.Header.Clone(),
+	}
+
+	// read (up to the limit of) the body ahead, and pass the rest of it on as it streams
+	if r.Body != nil && r.Body != http.NoBody {
+		var head, _ = ioutil.ReadAll(io.LimitReader(r.Body, int64(in.bodyLimit)+1))
+		if ex.body, ex.cut = head, len(head) > in.bodyLimit; ex.cut {
+			ex.body = head[:in.bodyLimit]
+		}
+		r.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(head), r.Body), Closer: r.Body}
+	}
+
+	var cw = &capturingWriter{ResponseWriter: w, ex: ex, limit: in.bodyLimit}
+	handler.ServeHTTP(cw, r)
+
+	if ex.status == 0 {
+		ex.status = http.StatusOK
+	}
+	if ex.respHeader == nil {
+		ex.respHeader = w.Header().Clone()
+	}
+	ex.duration = time.Since(ex.time)
+	in.add(ex)
+	return ex
+}
+
+// readCloser combines a Reader with a separate Closer
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// capturingWriter is an http.ResponseWriter which captures the response (up to the limit of its body).
+// It can be hijacked (eg. for WebSockets) and flushed, if the underlying ResponseWriter can.
+type capturingWriter struct {
+	http.ResponseWriter
+	ex    *exchange
+	limit int
+}
+
+func (cw *capturingWriter) WriteHeader(status int) {
+	if cw.ex.status == 0 {
+		cw.ex.status = status
+		cw.ex.respHeader = cw.Header().Clone()
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *capturingWriter) Write(b []byte) (int, error) {
+	if cw.ex.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if room := cw.limit - len(cw.ex.respBody); room > 0 {
+		var n = len(b)
+		if n > room {
+			n = room
+		}
+		cw.ex.respBody = append(cw.ex.respBody, b[:n]...)
+	}
+	if cw.ex.bytesWritten+int64(len(b)) > int64(cw.limit) {
+		cw.ex.respCut = true
+	}
+
+	n, err := cw.ResponseWriter.Write(b)
+	cw.ex.bytesWritten += int64(n)
+	return n, err
+}
+
+func (cw *capturingWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *capturingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := cw.ResponseWriter.(http.Hijacker); ok {
+		if cw.ex.status == 0 {
+			cw.ex.status = http.StatusSwitchingProtocols
+		}
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("response can't be hijacked")
+}
+
+// replay sends the captured request with [id] to [handler] again, and returns the new exchange
+func (in *inspector) replay(handler http.Handler, id int64) (CapturedRequest, error) {
+	original, err := in.get(id)
+	if err != nil {
+		return CapturedRequest{}, err
+	}
+
+	if original.cut {
+		return CapturedRequest{}, errors.Errorf("request %d can't be replayed: its body was truncated", id)
+	}
+
+	r, err := http.NewRequest(original.method, original.uri, bytes.NewReader(original.body))
+	if err != nil {
+		return CapturedRequest{}, errors.Wrap(err, "failed to replay request")
+	}
+	r.Host, r.RemoteAddr, r.RequestURI = original.host, original.visitor, original.uri
+	r.Header = original.header.Clone()
+	r.Header.Set(replayHeader, strconv.FormatInt(id, 10))
+
+	return in.serve(handler, &discardingWriter{header: make(http.Header)}, r, id).captured(), nil
+}
+
+// discardingWriter is an http.ResponseWriter for replayed requests, whose responses are only captured
+type discardingWriter struct{ header http.Header }
+
+func (w *discardingWriter) Header() http.Header         { return w.header }
+func (w *discardingWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardingWriter) WriteHeader(int)             {}
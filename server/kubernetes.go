@@ -0,0 +1,386 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ----------
+// This file contains the Kubernetes controller mode: tunnels of clients which ask for it (with --kubernetes <namespace>)
+// are exposed in that namespace (if the operator allows it, see Config.KubernetesNamespaces) as Services, so that
+// in-cluster workloads can reach developer machines through the server. TCP and UDP tunnels get a Service without a
+// selector, and an EndpointSlice pointing at the server (see Config.KubernetesAddress); HTTP and TLS tunnels, which
+// are routed by name, get an ExternalName Service resolving to their public host.
+//
+// Objects are applied server-side (as the "shhh" field manager, so that objects managed by anyone else aren't taken
+// over), and deleted once their tunnel closes. Objects left over by a previous run of the server are deleted when it
+// starts.
+// ----------
+
+const (
+	// field manager, and value of the app.kubernetes.io/managed-by label, of objects the server manages
+	kubernetesManager = "shhh"
+
+	// label identifying the server which manages an object
+	kubernetesServerLabel = "shhh.dev/server"
+
+	// where the credentials of the pod's service account are mounted
+	kubernetesServiceAccount = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	// maximum number of events waiting to be applied; newer events are dropped once full
+	kubernetesQueueSize = 256
+)
+
+// characters which aren't allowed in label values
+var invalidLabelChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// kubernetesController exposes tunnels as Services, in the background and in order. A nil *kubernetesController
+// exposes nothing.
+type kubernetesController struct {
+	api        string
+	tokenFile  string
+	client     *http.Client
+	namespaces []string // tunnels may be exposed in
+	address    string   // of the server, as reached by pods
+	server     string   // value of kubernetesServerLabel
+
+	// returns the open tunnel at the address (nil if there's none)
+	lookup func(address string) *openTunnel
+
+	queue   chan kubernetesEvent
+	exposed map[string]kubernetesObjects // by tunnel address; only used by run
+	done    chan struct{}                // closed once the objects are deleted (see run)
+}
+
+// kubernetesEvent is a tunnel lifecycle event, along with the tunnel (if it's open)
+type kubernetesEvent struct {
+	TunnelEvent
+	tunnel *openTunnel
+}
+
+// kubernetesObjects are the objects a tunnel is exposed as
+type kubernetesObjects struct {
+	namespace string
+	service   string
+	slice     bool // set if the Service has an EndpointSlice (named <service>-shhh)
+}
+
+// newKubernetesController returns the controller as configured, or nil if tunnels can't be exposed in Kubernetes
+func newKubernetesController(config *Config, lookup func(address string) *openTunnel) (*kubernetesController, error) {
+	if len(config.KubernetesNamespaces) == 0 {
+		return nil, nil
+	}
+
+	var kc = &kubernetesController{api: strings.TrimSuffix(config.KubernetesAPI, "/"), tokenFile: config.KubernetesTokenFile,
+		namespaces: config.KubernetesNamespaces, address: config.KubernetesAddress, lookup: lookup,
+		queue: make(chan kubernetesEvent, kubernetesQueueSize), exposed: make(map[string]kubernetesObjects), done: make(chan struct{})}
+
+	// in a pod, the API and its credentials are found where Kubernetes puts them
+	if kc.api == "" {
+		var host, port = os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("not running in a Kubernetes cluster (set kubernetes api)")
+		}
+		kc.api = "https://" + net.JoinHostPort(host, port)
+	}
+	if kc.tokenFile == "" {
+		kc.tokenFile = filepath.Join(kubernetesServiceAccount, "token")
+	}
+	if kc.address == "" {
+		kc.address = os.Getenv("POD_IP")
+	}
+	if net.ParseIP(kc.address) == nil {
+		return nil, errors.Errorf("invalid kubernetes address %q: must be the IP pods reach the server at", kc.address)
+	}
+
+	var ca = config.KubernetesCA
+	if ca == "" {
+		ca = filepath.Join(kubernetesServiceAccount, "ca.crt")
+	}
+	var transport = http.DefaultTransport.(*http.Transport).Clone()
+	if content, err := ioutil.ReadFile(ca); err == nil {
+		var pool = x509.NewCertPool()
+		pool.AppendCertsFromPEM(content)
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	} else if config.KubernetesCA != "" {
+		return nil, errors.Wrap(err, "failed to read kubernetes ca")
+	}
+	kc.client = &http.Client{Timeout: 10 * time.Second, Transport: transport}
+
+	kc.server = config.ClusterNode
+	if kc.server == "" {
+		kc.server, _ = os.Hostname()
+	}
+	if kc.server = strings.Trim(invalidLabelChars.ReplaceAllString(kc.server, "-"), "-._"); len(kc.server) > 63 {
+		kc.server = kc.server[:63]
+	}
+	return kc, nil
+}
+
+// send queues [event] to be applied. It never blocks.
+func (kc *kubernetesController) send(event TunnelEvent) {
+	if kc == nil || (event.Type != TunnelOpened && event.Type != TunnelClosed) {
+		return
+	}
+
+	var ke = kubernetesEvent{TunnelEvent: event}
+	if event.Type == TunnelOpened {
+		if ke.tunnel = kc.lookup(event.Address); ke.tunnel == nil {
+			return
+		}
+	}
+
+	select {
+	case kc.queue <- ke:
+	default:
+		log.Printf("kubernetes: queue is full; dropped %s event", event.Type)
+	}
+}
+
+// run deletes objects left over by a previous run, then applies queued events until [stop] is closed. It then deletes
+// the objects of all tunnels (as the server is shutting down).
+func (kc *kubernetesController) run(stop <-chan struct{}) {
+	defer close(kc.done)
+	kc.sweep()
+
+	for {
+		select {
+		case <-stop:
+			for _, objects := range kc.exposed {
+				kc.delete(objects)
+			}
+			return
+		case event := <-kc.queue:
+			kc.apply(event)
+		}
+	}
+}
+
+// apply exposes the tunnel of [event] if it opened, or deletes its objects if it closed
+func (kc *kubernetesController) apply(event kubernetesEvent) {
+	if event.Type == TunnelClosed {
+		if objects, ok := kc.exposed[event.Address]; ok {
+			delete(kc.exposed, event.Address)
+			kc.delete(objects)
+		}
+		return
+	}
+
+	// members of balanced endpoints (<address>#<id>) are served by the first client's objects
+	if strings.Contains(event.Address, "#") {
+		return
+	}
+
+	var options = event.tunnel.options
+	options.awaitParsed(optionsSettleTime)
+	var namespace = options.Kubernetes()
+	if namespace == "" {
+		return
+	}
+	if !contains(kc.namespaces, namespace) {
+		event.tunnel.notify(fmt.Sprintf("kubernetes: tunnels can't be exposed in namespace %s", namespace), kv("type", "kubernetes"), kv("error", "namespace not allowed"))
+		return
+	}
+
+	service, err := describeService(event.TunnelEvent, nil)
+	if err != nil {
+		return
+	}
+
+	var objects = kubernetesObjects{namespace: namespace, service: kubernetesName(service.Name)}
+	if err = kc.expose(event.TunnelEvent, service, &objects); err != nil {
+		log.Printf("kubernetes: failed to expose %s: %s", event.Address, err.Error())
+		event.tunnel.notify(fmt.Sprintf("kubernetes: failed to expose tunnel in namespace %s: %s", namespace, err.Error()), kv("type", "kubernetes"), kv("error", err.Error()))
+		return
+	}
+
+	kc.exposed[event.Address] = objects
+	var host = objects.service + "." + namespace + ".svc"
+	event.tunnel.notify(fmt.Sprintf("kubernetes: exposed as %s", host), kv("type", "kubernetes"), kv("service", host))
+}
+
+// expose applies the Service (and EndpointSlice) of [service], recording them in [objects]
+func (kc *kubernetesController) expose(event TunnelEvent, service *registeredService, objects *kubernetesObjects) error {
+	var metadata = map[string]interface{}{
+		"name":        objects.service,
+		"namespace":   objects.namespace,
+		"labels":      map[string]string{"app.kubernetes.io/managed-by": kubernetesManager, kubernetesServerLabel: kc.server},
+		"annotations": map[string]string{"shhh.dev/tunnel": event.Address, "shhh.dev/fingerprint": event.Fingerprint},
+	}
+
+	var protocol = "TCP"
+	if service.Protocol == "udp" {
+		protocol = "UDP"
+	}
+	var port = map[string]interface{}{"name": service.Protocol, "protocol": protocol, "port": service.Port}
+
+	// HTTP and TLS tunnels are routed by name; pods must reach them at their public host
+	if service.Protocol == "http" || service.Protocol == "tls" {
+		var spec = map[string]interface{}{"type": "ExternalName", "externalName": service.Address, "ports": []interface{}{port}}
+		return kc.applyObject("/api/v1/namespaces/"+objects.namespace+"/services/"+objects.service,
+			map[string]interface{}{"apiVersion": "v1", "kind": "Service", "metadata": metadata, "spec": spec})
+	}
+
+	var spec = map[string]interface{}{"ports": []interface{}{map[string]interface{}{"name": service.Protocol, "protocol": protocol, "port": service.Port, "targetPort": service.Port}}}
+	if err := kc.applyObject("/api/v1/namespaces/"+objects.namespace+"/services/"+objects.service,
+		map[string]interface{}{"apiVersion": "v1", "kind": "Service", "metadata": metadata, "spec": spec}); err != nil {
+		return err
+	}
+
+	var addressType = "IPv4"
+	if net.ParseIP(kc.address).To4() == nil {
+		addressType = "IPv6"
+	}
+
+	var sliceMetadata = make(map[string]interface{}, len(metadata))
+	for k, v := range metadata {
+		sliceMetadata[k] = v
+	}
+	sliceMetadata["name"] = objects.service + "-shhh"
+	sliceMetadata["labels"] = map[string]string{"app.kubernetes.io/managed-by": kubernetesManager, kubernetesServerLabel: kc.server,
+		"kubernetes.io/service-name": objects.service, "endpointslice.kubernetes.io/managed-by": "shhh.dev"}
+
+	objects.slice = true
+	return kc.applyObject("/apis/discovery.k8s.io/v1/namespaces/"+objects.namespace+"/endpointslices/"+objects.service+"-shhh", map[string]interface{}{
+		"apiVersion":  "discovery.k8s.io/v1",
+		"kind":        "EndpointSlice",
+		"metadata":    sliceMetadata,
+		"addressType": addressType,
+		"endpoints":   []interface{}{map[string]interface{}{"addresses": []string{kc.address}, "conditions": map[string]bool{"ready": true}}},
+		"ports":       []interface{}{port},
+	})
+}
+
+// delete deletes [objects]
+func (kc *kubernetesController) delete(objects kubernetesObjects) {
+	if objects.slice {
+		if _, err := kc.call(http.MethodDelete, "/apis/discovery.k8s.io/v1/namespaces/"+objects.namespace+"/endpointslices/"+objects.service+"-shhh", "", nil, nil); err != nil {
+			log.Printf("kubernetes: failed to delete endpoint slice %s/%s-shhh: %s", objects.namespace, objects.service, err.Error())
+		}
+	}
+	if _, err := kc.call(http.MethodDelete, "/api/v1/namespaces/"+objects.namespace+"/services/"+objects.service, "", nil, nil); err != nil {
+		log.Printf("kubernetes: failed to delete service %s/%s: %s", objects.namespace, objects.service, err.Error())
+	}
+}
+
+// sweep deletes the objects the server left over (eg. as it crashed) in the namespaces tunnels may be exposed in
+func (kc *kubernetesController) sweep() {
+	var selector = url.Values{"labelSelector": {"app.kubernetes.io/managed-by=" + kubernetesManager + "," + kubernetesServerLabel + "=" + kc.server}}
+	for _, namespace := range kc.namespaces {
+		for _, collection := range []string{"/apis/discovery.k8s.io/v1/namespaces/" + namespace + "/endpointslices", "/api/v1/namespaces/" + namespace + "/services"} {
+			var list struct {
+				Items []struct {
+					Metadata struct {
+						Name string `json:"name"`
+					} `json:"metadata"`
+				} `json:"items"`
+			}
+			if _, err := kc.call(http.MethodGet, collection+"?"+selector.Encode(), "", nil, &list); err != nil {
+				log.Printf("kubernetes: failed to list leftover objects in namespace %s: %s", namespace, err.Error())
+				continue
+			}
+
+			for _, item := range list.Items {
+				if _, err := kc.call(http.MethodDelete, collection+"/"+item.Metadata.Name, "", nil, nil); err != nil {
+					log.Printf("kubernetes: failed to delete leftover %s in namespace %s: %s", item.Metadata.Name, namespace, err.Error())
+				}
+			}
+		}
+	}
+}
+
+// applyObject applies [object] at [path], server-side
+func (kc *kubernetesController) applyObject(path string, object interface{}) error {
+	var query = url.Values{"fieldManager": {kubernetesManager}}
+	_, err := kc.call(http.MethodPatch, path+"?"+query.Encode(), "application/apply-patch+yaml", object, nil) // JSON is YAML
+	return err
+}
+
+// call sends [body] (as JSON, unless nil) to the API at [path], and decodes the response into [out] (unless nil).
+// Objects already gone are not an error when deleting them.
+func (kc *kubernetesController) call(method, path, contentType string, body, out interface{}) (int, error) {
+	var content []byte
+	if body != nil {
+		content, _ = json.Marshal(body)
+	}
+
+	req, err := http.NewRequest(method, kc.api+path, bytes.NewReader(content))
+	if err != nil {
+		return 0, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	// tokens of service accounts are rotated; the file is read every time
+	if token, err := ioutil.ReadFile(kc.tokenFile); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := kc.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if method == http.MethodDelete && resp.StatusCode == http.StatusNotFound {
+		return resp.StatusCode, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		var status struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(respBody, &status) != nil || status.Message == "" {
+			status.Message = resp.Status
+		}
+		return resp.StatusCode, errors.New(status.Message)
+	}
+	if out != nil {
+		if err = json.Unmarshal(respBody, out); err != nil {
+			return resp.StatusCode, errors.Wrap(err, "malformed response")
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// Flush waits until the objects of tunnels are deleted once the server is shutting down, or [ctx] is done
+func (kc *kubernetesController) Flush(ctx context.Context) error {
+	if kc == nil {
+		return nil
+	}
+
+	select {
+	case <-kc.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// kubernetesName returns [name] as a valid name of a Service (a DNS label starting with a letter)
+func kubernetesName(name string) string {
+	if name == "" || name[0] < 'a' || name[0] > 'z' {
+		name = "t-" + name
+	}
+	if len(name) > 63 {
+		name = strings.TrimRight(name[:63], "-")
+	}
+	return name
+}
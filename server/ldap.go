@@ -0,0 +1,489 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------
+// This file contains a minimal LDAPv3 client (see RFC 4511): just enough to bind with a password, and search for
+// entries matching a filter. Messages are BER-encoded by hand, as only a few of them are needed.
+// ----------
+
+const (
+	// timeout of each connection to the directory, including all requests made over it
+	ldapTimeout = 10 * time.Second
+
+	// largest message we're willing to read from the directory
+	maxLDAPMessageSize = 1 << 20
+)
+
+// BER tags of the LDAP messages / elements we use
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berBoolean     = 0x01
+	berSequence    = 0x30
+
+	ldapBindRequest       = 0x60
+	ldapBindResponse      = 0x61
+	ldapUnbindRequest     = 0x42
+	ldapSearchRequest     = 0x63
+	ldapSearchEntry       = 0x64
+	ldapSearchDone        = 0x65
+	ldapSearchReference   = 0x73
+	ldapSimpleAuth        = 0x80
+	ldapResultSuccess     = 0
+	ldapInvalidCredential = 49
+)
+
+// ldapConn is a connection to an LDAP directory
+type ldapConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	nextID int
+}
+
+// ldapEntry is an entry returned by a search
+type ldapEntry struct {
+	dn         string
+	attributes map[string][]string // lower-cased name -> values
+}
+
+// ldapError is the result of a failed request
+type ldapError struct {
+	code    int
+	message string
+}
+
+func (e *ldapError) Error() string {
+	if e.message != "" {
+		return "ldap: result code " + strconv.Itoa(e.code) + ": " + e.message
+	}
+	return "ldap: result code " + strconv.Itoa(e.code)
+}
+
+// dialLDAP connects to the directory at [rawURL] (ldap:// or ldaps://)
+func dialLDAP(rawURL string) (*ldapConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid LDAP url")
+	}
+
+	var conn net.Conn
+	var dialer = &net.Dialer{Timeout: ldapTimeout}
+	switch u.Scheme {
+	case "ldap":
+		conn, err = dialer.Dial("tcp", withDefaultPort(u.Host, "389"))
+	case "ldaps":
+		conn, err = tls.DialWithDialer(dialer, "tcp", withDefaultPort(u.Host, "636"), &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, errors.Errorf("invalid LDAP url %q: must be ldap:// or ldaps://", rawURL)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to LDAP server")
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(ldapTimeout))
+	return &ldapConn{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// withDefaultPort returns [host] with [port] added, unless it has one already
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// Close unbinds, and closes the connection
+func (c *ldapConn) Close() error {
+	_, _ = c.request(berTLV(ldapUnbindRequest))
+	return c.conn.Close()
+}
+
+// bind authenticates as [dn] with [password] (simple authentication)
+func (c *ldapConn) bind(dn, password string) error {
+	var id, err = c.request(berTLV(ldapBindRequest, berInt(berInteger, 3), berString(berOctetString, dn), berString(ldapSimpleAuth, password)))
+	if err != nil {
+		return err
+	}
+
+	tag, op, err := c.response(id)
+	if err != nil {
+		return err
+	}
+	if tag != ldapBindResponse {
+		return errors.Errorf("ldap: unexpected response %#x to bind", tag)
+	}
+	return ldapResult(op)
+}
+
+// search returns the entries under [base] matching [filter], with their [attributes]
+func (c *ldapConn) search(base, filter string, attributes []string) ([]ldapEntry, error) {
+	encodedFilter, err := berFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var attrs [][]byte
+	for _, attr := range attributes {
+		attrs = append(attrs, berString(berOctetString, attr))
+	}
+
+	id, err := c.request(berTLV(ldapSearchRequest,
+		berString(berOctetString, base),
+		berInt(berEnumerated, 2), // wholeSubtree
+		berInt(berEnumerated, 0), // neverDerefAliases
+		berInt(berInteger, 2),    // size limit; we only ever expect one entry, and want to know if there's more
+		berInt(berInteger, int(ldapTimeout/time.Second)),
+		[]byte{berBoolean, 1, 0}, // typesOnly: false
+		encodedFilter,
+		berTLV(berSequence, attrs...),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []ldapEntry
+	for {
+		tag, op, err := c.response(id)
+		if err != nil {
+			return nil, err
+		}
+
+		switch tag {
+		case ldapSearchEntry:
+			entry, err := parseLDAPEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case ldapSearchReference:
+			// referrals to other servers aren't followed
+		case ldapSearchDone:
+			return entries, ldapResult(op)
+		default:
+			return nil, errors.Errorf("ldap: unexpected response %#x to search", tag)
+		}
+	}
+}
+
+// request sends [op] in a new message, and returns the message's id
+func (c *ldapConn) request(op []byte) (int, error) {
+	c.nextID++
+	return c.nextID, c.send(berTLV(berSequence, berInt(berInteger, c.nextID), op))
+}
+
+func (c *ldapConn) send(message []byte) error {
+	_, err := c.conn.Write(message)
+	return errors.Wrap(err, "ldap: failed to send request")
+}
+
+// response reads the next message, which must be a response to the request with [id], and returns its
+// operation's tag and contents
+func (c *ldapConn) response(id int) (byte, []byte, error) {
+	tag, message, err := readBER(c.reader)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "ldap: failed to read response")
+	}
+	if tag != berSequence {
+		return 0, nil, errors.New("ldap: malformed response")
+	}
+
+	_, messageID, rest, err := parseBER(message)
+	if err != nil {
+		return 0, nil, err
+	}
+	if berToInt(messageID) != id {
+		return 0, nil, errors.New("ldap: response to an unexpected request")
+	}
+
+	tag, op, _, err := parseBER(rest)
+	return tag, op, err
+}
+
+// ldapResult returns an error unless the LDAPResult [op] is a success
+func ldapResult(op []byte) error {
+	_, code, rest, err := parseBER(op)
+	if err != nil {
+		return err
+	}
+
+	var e = &ldapError{code: berToInt(code)}
+	if e.code == ldapResultSuccess {
+		return nil
+	}
+
+	if _, _, rest, err = parseBER(rest); err == nil { // matchedDN
+		if _, message, _, err := parseBER(rest); err == nil {
+			e.message = string(message)
+		}
+	}
+	return e
+}
+
+// parseLDAPEntry parses the SearchResultEntry [op]
+func parseLDAPEntry(op []byte) (ldapEntry, error) {
+	var entry = ldapEntry{attributes: make(map[string][]string)}
+
+	_, dn, rest, err := parseBER(op)
+	if err != nil {
+		return entry, err
+	}
+	entry.dn = string(dn)
+
+	_, attributes, _, err := parseBER(rest)
+	if err != nil {
+		return entry, err
+	}
+
+	for len(attributes) > 0 {
+		var attribute, name, values []byte
+		if _, attribute, attributes, err = parseBER(attributes); err != nil {
+			return entry, err
+		}
+		if _, name, attribute, err = parseBER(attribute); err != nil {
+			return entry, err
+		}
+		if _, values, _, err = parseBER(attribute); err != nil {
+			return entry, err
+		}
+
+		var key = strings.ToLower(string(name))
+		for len(values) > 0 {
+			var value []byte
+			if _, value, values, err = parseBER(values); err != nil {
+				return entry, err
+			}
+			entry.attributes[key] = append(entry.attributes[key], string(value))
+		}
+	}
+	return entry, nil
+}
+
+// berFilter encodes the string representation of a search filter (see RFC 4515). Equality, presence and
+// substring matches are supported, combined with &, | and !.
+func berFilter(filter string) ([]byte, error) {
+	encoded, rest, err := parseFilter(strings.TrimSpace(filter))
+	if err == nil && rest != "" {
+		err = errors.New("trailing characters")
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid LDAP filter %q", filter)
+	}
+	return encoded, nil
+}
+
+func parseFilter(s string) ([]byte, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, "", errors.New("missing (")
+	}
+	s = s[1:]
+
+	if s != "" && (s[0] == '&' || s[0] == '|' || s[0] == '!') {
+		var tag = map[byte]byte{'&': 0xa0, '|': 0xa1, '!': 0xa2}[s[0]]
+		var filters [][]byte
+		for s = s[1:]; !strings.HasPrefix(s, ")"); {
+			filter, rest, err := parseFilter(s)
+			if err != nil {
+				return nil, "", err
+			}
+			filters, s = append(filters, filter), rest
+		}
+		if tag == 0xa2 && len(filters) != 1 {
+			return nil, "", errors.New("! takes exactly one filter")
+		}
+		return berTLV(tag, filters...), s[1:], nil
+	}
+
+	var end = strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, "", errors.New("missing )")
+	}
+	var item, rest = s[:end], s[end+1:]
+
+	var eq = strings.IndexByte(item, '=')
+	if eq <= 0 {
+		return nil, "", errors.Errorf("invalid item %q", item)
+	}
+	var attr, value = item[:eq], item[eq+1:]
+	if strings.ContainsAny(attr[len(attr)-1:], "<>~:") {
+		return nil, "", errors.Errorf("unsupported item %q", item)
+	}
+
+	if value == "*" {
+		return berString(0x87, attr), rest, nil // present
+	}
+
+	var parts = strings.Split(value, "*")
+	if len(parts) == 1 {
+		unescaped, err := unescapeFilterValue(value)
+		if err != nil {
+			return nil, "", err
+		}
+		return berTLV(0xa3, berString(berOctetString, attr), berString(berOctetString, unescaped)), rest, nil
+	}
+
+	var substrings [][]byte
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		unescaped, err := unescapeFilterValue(part)
+		if err != nil {
+			return nil, "", err
+		}
+		var tag byte = 0x81 // any
+		switch i {
+		case 0:
+			tag = 0x80 // initial
+		case len(parts) - 1:
+			tag = 0x82 // final
+		}
+		substrings = append(substrings, berString(tag, unescaped))
+	}
+	return berTLV(0xa4, berString(berOctetString, attr), berTLV(berSequence, substrings...)), rest, nil
+}
+
+// unescapeFilterValue decodes the \XX escapes of a filter's assertion value
+func unescapeFilterValue(value string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+		if i+2 >= len(value) {
+			return "", errors.Errorf("invalid escape in %q", value)
+		}
+		decoded, err := hex.DecodeString(value[i+1 : i+3])
+		if err != nil {
+			return "", errors.Errorf("invalid escape in %q", value)
+		}
+		b.Write(decoded)
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// escapeFilterValue escapes [value] for use as an assertion value in a filter (see RFC 4515, section 3)
+func escapeFilterValue(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '*', '(', ')', '\\', 0:
+			b.WriteString("\\" + hex.EncodeToString([]byte{c}))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// berTLV encodes an element with [tag], made of [contents]
+func berTLV(tag byte, contents ...[]byte) []byte {
+	var length int
+	for _, c := range contents {
+		length += len(c)
+	}
+
+	var b = append([]byte{tag}, berLength(length)...)
+	for _, c := range contents {
+		b = append(b, c...)
+	}
+	return b
+}
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func berString(tag byte, s string) []byte { return berTLV(tag, []byte(s)) }
+
+// berInt encodes the non-negative integer [n]
+func berInt(tag byte, n int) []byte {
+	var b = []byte{byte(n)}
+	for n >>= 8; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return berTLV(tag, b)
+}
+
+func berToInt(b []byte) int {
+	var n int
+	for _, c := range b {
+		n = n<<8 | int(c)
+	}
+	return n
+}
+
+// parseBER splits the first element off [b], returning its tag, contents, and what follows it
+func parseBER(b []byte) (tag byte, contents, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errors.New("ldap: truncated message")
+	}
+	tag = b[0]
+
+	var length, offset = int(b[1]), 2
+	if length&0x80 != 0 {
+		var n = length & 0x7f
+		if n == 0 || n > 4 || len(b) < 2+n {
+			return 0, nil, nil, errors.New("ldap: malformed length")
+		}
+		length, offset = berToInt(b[2:2+n]), 2+n
+	}
+
+	if length < 0 || length > len(b)-offset { // lengths of 4 bytes overflow an int on 32-bit platforms
+		return 0, nil, nil, errors.New("ldap: truncated message")
+	}
+	return tag, b[offset : offset+length], b[offset+length:], nil
+}
+
+// readBER reads an element from [r], returning its tag and contents
+func readBER(r *bufio.Reader) (byte, []byte, error) {
+	var header = make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+
+	var length = int(header[1])
+	if length&0x80 != 0 {
+		var n = length & 0x7f
+		if n == 0 || n > 4 {
+			return 0, nil, errors.New("malformed length")
+		}
+		var b = make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return 0, nil, err
+		}
+		length = berToInt(b)
+	}
+
+	if length < 0 || length > maxLDAPMessageSize {
+		return 0, nil, errors.New("message too large")
+	}
+
+	var contents = make([]byte, length)
+	_, err := io.ReadFull(r, contents)
+	return header[0], contents, err
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestBERRoundTrip(t *testing.T) {
+	for _, length := range []int{0, 1, 0x7f, 0x80, 0xff, 0x100, 0xffff, 0x10000} {
+		var contents = bytes.Repeat([]byte{'x'}, length)
+		var encoded = append(berTLV(berOctetString, contents), 0xff) // followed by the next element
+
+		tag, decoded, rest, err := parseBER(encoded)
+		if err != nil {
+			t.Fatalf("length %d: %v", length, err)
+		}
+		if tag != berOctetString || !bytes.Equal(decoded, contents) || !bytes.Equal(rest, []byte{0xff}) {
+			t.Fatalf("length %d: got tag %#x, %d bytes of contents and %d following, want %#x, %d and 1",
+				length, tag, len(decoded), len(rest), berOctetString, length)
+		}
+
+		tag, decoded, err = readBER(bufio.NewReader(bytes.NewReader(encoded)))
+		if err != nil || tag != berOctetString || !bytes.Equal(decoded, contents) {
+			t.Fatalf("length %d: read tag %#x, %d bytes of contents (err: %v)", length, tag, len(decoded), err)
+		}
+	}
+
+	for _, n := range []int{0, 1, 0x7f, 0x80, 0xff, 0x100, 0x7fffffff} {
+		tag, contents, _, err := parseBER(berInt(berInteger, n))
+		if err != nil || tag != berInteger || berToInt(contents) != n {
+			t.Fatalf("%d: got tag %#x, value %d (err: %v)", n, tag, berToInt(contents), err)
+		}
+		if contents[0]&0x80 != 0 {
+			t.Fatalf("%d: encoded as a negative integer (%x)", n, contents)
+		}
+	}
+}
+
+func TestBERMalformed(t *testing.T) {
+	var tests = []struct {
+		name    string
+		encoded []byte
+	}{
+		{"empty", nil},
+		{"tag only", []byte{berSequence}},
+		{"short contents", []byte{berOctetString, 3, 'a', 'b'}},
+		{"indefinite length", []byte{berSequence, 0x80, 0, 0}},
+		{"length of 5 bytes", []byte{berOctetString, 0x85, 0, 0, 0, 0, 1, 'a'}},
+		{"truncated length", []byte{berOctetString, 0x82, 1}},
+		{"long length past the end", []byte{berOctetString, 0x82, 0x01, 0x00, 'a'}},
+		{"largest length", []byte{berOctetString, 0x84, 0xff, 0xff, 0xff, 0xff, 'a'}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, _, err := parseBER(test.encoded); err == nil {
+				t.Error("parsed")
+			}
+			if _, _, err := readBER(bufio.NewReader(bytes.NewReader(test.encoded))); err == nil {
+				t.Error("read")
+			}
+		})
+	}
+
+	// a message's header may claim more than we're willing to read, however much follows
+	if _, _, err := readBER(bufio.NewReader(bytes.NewReader([]byte{berSequence, 0x84, 0x7f, 0xff, 0xff, 0xff}))); err == nil ||
+		!strings.Contains(err.Error(), "too large") {
+		t.Errorf("got %v reading an oversized message, want it refused", err)
+	}
+}
+
+// ldapMessage encodes the message with [id] carrying [op]
+func ldapMessage(id int, op []byte) []byte {
+	return berTLV(berSequence, berInt(berInteger, id), op)
+}
+
+// ldapDone encodes a SearchResultDone with [code]
+func ldapDone(code int) []byte {
+	return berTLV(ldapSearchDone, berInt(berEnumerated, code), berString(berOctetString, ""), berString(berOctetString, "no"))
+}
+
+// ldapTestEntry is a SearchResultEntry for uid=alice, with a key and a group
+var ldapTestEntry = berTLV(ldapSearchEntry,
+	berString(berOctetString, "uid=alice,ou=people,dc=example,dc=com"),
+	berTLV(berSequence,
+		berTLV(berSequence, berString(berOctetString, "sshPublicKey"), berTLV(0x31, berString(berOctetString, "ssh-ed25519 AAAA"))),
+		berTLV(berSequence, berString(berOctetString, "memberOf"),
+			berTLV(0x31, berString(berOctetString, "cn=developers,ou=groups"), berString(berOctetString, "cn=ops,ou=groups"))),
+	))
+
+// a directory's responses to a search, however hostile, are parsed or refused (without panicking)
+func TestLDAPSearchResponses(t *testing.T) {
+	var tests = []struct {
+		name     string
+		response []byte // to the search, which is the first request (with id 1)
+		entries  int
+		err      string
+	}{
+		{"entry", append(ldapMessage(1, ldapTestEntry), ldapMessage(1, ldapDone(0))...), 1, ""},
+		{"no entries", ldapMessage(1, ldapDone(0)), 0, ""},
+		{"referral", append(ldapMessage(1, berTLV(ldapSearchReference, berString(berOctetString, "ldap://other/"))), ldapMessage(1, ldapDone(0))...), 0, ""},
+		{"failed", ldapMessage(1, ldapDone(32)), 0, "result code 32: no"},
+		{"another request's", ldapMessage(2, ldapDone(0)), 0, "unexpected request"},
+		{"unexpected operation", ldapMessage(1, berTLV(ldapBindResponse, berInt(berEnumerated, 0))), 0, "unexpected response"},
+		{"not a sequence", berString(berOctetString, "hello"), 0, "malformed response"},
+		{"no operation", berTLV(berSequence, berInt(berInteger, 1)), 0, "truncated"},
+		{"truncated entry", ldapMessage(1, []byte{ldapSearchEntry, 0x10, berOctetString, 0x20}), 0, "truncated"},
+		{"entry without attributes", ldapMessage(1, berTLV(ldapSearchEntry, berString(berOctetString, "uid=alice"))), 0, "truncated"},
+		{"attribute without values", ldapMessage(1, berTLV(ldapSearchEntry, berString(berOctetString, "uid=alice"),
+			berTLV(berSequence, berTLV(berSequence, berString(berOctetString, "memberOf"))))), 0, "truncated"},
+		{"oversized", []byte{berSequence, 0x84, 0x7f, 0xff, 0xff, 0xff}, 0, "too large"},
+		{"cut off", ldapMessage(1, ldapTestEntry)[:20], 0, "failed to read response"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var client, directory = net.Pipe()
+			defer client.Close()
+			go func() {
+				defer directory.Close()
+				if _, _, err := readBER(bufio.NewReader(directory)); err == nil {
+					_, _ = directory.Write(test.response)
+				}
+			}()
+
+			var conn = &ldapConn{conn: client, reader: bufio.NewReader(client)}
+			entries, err := conn.search("dc=example,dc=com", "(uid=alice)", []string{"sshPublicKey", "memberOf"})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != test.entries {
+				t.Fatalf("got %d entries, want %d", len(entries), test.entries)
+			}
+			if test.entries > 0 {
+				var entry = entries[0]
+				if entry.dn != "uid=alice,ou=people,dc=example,dc=com" || len(entry.attributes["sshpublickey"]) != 1 || len(entry.attributes["memberof"]) != 2 {
+					t.Fatalf("got entry %+v", entry)
+				}
+			}
+		})
+	}
+}
+
+func TestBERFilter(t *testing.T) {
+	var equal = func(attr, value string) []byte {
+		return berTLV(0xa3, berString(berOctetString, attr), berString(berOctetString, value))
+	}
+
+	var tests = []struct {
+		filter string
+		want   []byte // nil if invalid
+	}{
+		{"(uid=alice)", equal("uid", "alice")},
+		{"(&(objectClass=person)(uid=alice))", berTLV(0xa0, equal("objectClass", "person"), equal("uid", "alice"))},
+		{"(|(uid=alice)(!(mail=*)))", berTLV(0xa1, equal("uid", "alice"), berTLV(0xa2, berString(0x87, "mail")))},
+		{"(cn=a*b*c)", berTLV(0xa4, berString(berOctetString, "cn"),
+			berTLV(berSequence, berString(0x80, "a"), berString(0x81, "b"), berString(0x82, "c")))},
+		{`(cn=\2a\28\29\5c)`, equal("cn", `*()\`)},
+		{"uid=alice", nil},
+		{"(uid=alice", nil},
+		{"(uid=alice))", nil},
+		{"(!(uid=a)(uid=b))", nil},
+		{"(uid>=5)", nil},
+		{`(uid=\zz)`, nil},
+		{`(uid=\2)`, nil},
+	}
+	for _, test := range tests {
+		got, err := berFilter(test.filter)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: invalid filter encoded", test.filter)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got %x (err: %v), want %x", test.filter, got, err, test.want)
+		}
+	}
+}
+
+// usernames are matched as they are, whatever they contain
+func TestLDAPUserFilterEscapesUsername(t *testing.T) {
+	var dir = &ldapDirectory{userFilter: "(&(objectClass=person)(|(uid=%s)(mail=%s)))"}
+
+	for _, name := range []string{"alice", "*", "alice)(uid=*", "*)(|(objectClass=*", `al\ice`, "al\x00ice", "ali*e"} {
+		encoded, err := berFilter(dir.filterFor(name))
+		if err != nil {
+			t.Fatalf("%q: %v", name, err)
+		}
+
+		var want = berTLV(0xa0,
+			berTLV(0xa3, berString(berOctetString, "objectClass"), berString(berOctetString, "person")),
+			berTLV(0xa1,
+				berTLV(0xa3, berString(berOctetString, "uid"), berString(berOctetString, name)),
+				berTLV(0xa3, berString(berOctetString, "mail"), berString(berOctetString, name))))
+		if !bytes.Equal(encoded, want) {
+			t.Errorf("%q: got filter %s, which doesn't match the username as is", name, dir.filterFor(name))
+		}
+	}
+}
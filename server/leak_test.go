@@ -0,0 +1,132 @@
+package server_test
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/riyaz-ali/shhh/internal/harness"
+	"github.com/riyaz-ali/shhh/server"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// how many clients TestNoGoroutinesLeaked connects, each with a TCP and an HTTP tunnel and their visitors
+const leakCycles = 20
+
+// echo serves the connections of [ln], echoing what visitors send
+func echo(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			_, _ = io.Copy(conn, conn)
+		}()
+	}
+}
+
+// cycle connects a client to [srv], opens a TCP and an HTTP tunnel (named [name]), has visitors go through both, and
+// tears it all down
+func cycle(srv *harness.Server, name string) error {
+	client, err := srv.Dial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	tcp, err := client.Listen("", 0)
+	if err != nil {
+		return err
+	}
+	defer tcp.Close()
+	go echo(tcp)
+
+	web, err := client.Listen(name, 80)
+	if err != nil {
+		return err
+	}
+	defer web.Close()
+	go func() {
+		_ = http.Serve(web, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, "hello from "+name)
+		}))
+	}()
+
+	visitor, err := net.DialTimeout("tcp", srv.TunnelAddr(tcp.Port), 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer visitor.Close()
+	if _, err = io.WriteString(visitor, "ping\n"); err != nil {
+		return err
+	}
+	if line, err := bufio.NewReader(visitor).ReadString('\n'); err != nil || line != "ping\n" {
+		return fmt.Errorf("visitor got %q back (err: %v)", line, err)
+	}
+
+	resp, err := srv.Get(name, "/")
+	if err != nil {
+		return err
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != "hello from "+name {
+		return fmt.Errorf("visitor got %q through the http edge", body)
+	}
+	return nil
+}
+
+// settle returns the number of goroutines once it's at most [want] (or no longer changes, if [want] is negative),
+// or after a while
+func settle(want int) int {
+	var deadline = time.Now().Add(10 * time.Second)
+	var last, same = -1, 0
+	for {
+		http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+		var n = runtime.NumGoroutine()
+		if n == last {
+			same++
+		} else {
+			last, same = n, 0
+		}
+
+		if (want >= 0 && n <= want) || (want < 0 && same >= 5) || time.Now().After(deadline) {
+			return n
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestNoGoroutinesLeaked(t *testing.T) {
+	var config = server.DefaultConfig()
+	config.HTTPAddr, config.Domain = ":0", "example.test"
+	srv, err := harness.Start(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	// a first cycle starts what the server only starts once needed (eg. its caches' janitors)
+	if err = cycle(srv, "warmup"); err != nil {
+		t.Fatal(err)
+	}
+	var before = settle(-1)
+
+	for i := 0; i < leakCycles; i++ {
+		if err = cycle(srv, fmt.Sprintf("app%d", i)); err != nil {
+			t.Fatalf("cycle %d: %v", i+1, err)
+		}
+	}
+
+	if after := settle(before); after > before {
+		var stacks = make([]byte, 1<<20)
+		stacks = stacks[:runtime.Stack(stacks, true)]
+		t.Fatalf("%d goroutines leaked after %d clients came and went:\n%s", after-before, leakCycles, stacks)
+	}
+}
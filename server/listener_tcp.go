@@ -0,0 +1,293 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// initial delay between attempts to rebind a failed listener
+	rebindInitialBackoff = 100 * time.Millisecond
+
+	// maximum delay between attempts to rebind a failed listener
+	rebindMaxBackoff = 10 * time.Second
+
+	// duration after which we give up rebinding a failed listener
+	rebindTimeout = 2 * time.Minute
+)
+
+// ----------
+// This file contains mostly helper methods that allow the SSH server to create listeners for TCP sockets
+// ----------
+
+// allowTCPForwarding returns true if the given [port] is eligible for TCP forwarding
+func allowTCPForwarding(port uint32) bool {
+	return (port != 22 && port != 80 && port != 443) && port > 1024 || port == 0
+}
+
+// portNotAllowed returns the reason a forwarding request for [port] (of [protocol]) is denied by the port policy
+func portNotAllowed(protocol string, port uint32) string {
+	switch {
+	case port == httpPort:
+		return fmt.Sprintf("%s port %d is not allowed: HTTP tunnels are not enabled on this server", protocol, port)
+	case port == tlsPort:
+		return fmt.Sprintf("%s port %d is not allowed: TLS tunnels are not enabled on this server", protocol, port)
+	case port <= 1024:
+		return fmt.Sprintf("%s port %d is not allowed: privileged ports can't be forwarded (ask for one above 1024, or 0 for any)", protocol, port)
+	default:
+		return fmt.Sprintf("%s port %d is not allowed by the server's port policy", protocol, port)
+	}
+}
+
+// IP versions public listeners are bound on (see Config.IPVersion)
+const (
+	ipVersionDual = "dual" // IPv4 and IPv6, on a single dual-stack socket where the address is a wildcard
+	ipVersion4    = "4"
+	ipVersion6    = "6"
+)
+
+// validateIPVersion returns an error if Config.IPVersion isn't valid, or doesn't match the bind addresses
+func (config *Config) validateIPVersion() error {
+	switch config.IPVersion {
+	case "", ipVersionDual, ipVersion4, ipVersion6:
+	default:
+		return errors.Errorf("invalid ip version %q: must be one of dual, 4 or 6", config.IPVersion)
+	}
+
+	var addrs = []string{config.BindAddr}
+	for _, addr := range config.BindAddrs {
+		addrs = append(addrs, addr)
+	}
+
+	for _, addr := range addrs {
+		var ip = net.ParseIP(addr)
+		if ip == nil || ip.IsUnspecified() {
+			continue // a wildcard, or a host name
+		}
+		if (config.IPVersion == ipVersion4 && ip.To4() == nil) || (config.IPVersion == ipVersion6 && ip.To4() != nil) {
+			return errors.Errorf("bind address %s isn't an IPv%s address", addr, config.IPVersion)
+		}
+	}
+	return nil
+}
+
+// listenNetwork returns the network (based on [proto], ie. tcp or udp) and the address to bind a public listener
+// on [host] with, per Config.IPVersion. Wildcard addresses are bound on both IPv4 and IPv6 unless restricted to
+// either; specific ones are bound as they are.
+func (config *Config) listenNetwork(proto, host string) (network, addr string) {
+	var wildcard = host == "" || host == "*" || net.ParseIP(host) != nil && net.ParseIP(host).IsUnspecified()
+
+	switch {
+	case config.IPVersion == ipVersion4 && wildcard:
+		return proto + "4", "0.0.0.0"
+	case config.IPVersion == ipVersion4:
+		return proto + "4", host
+	case config.IPVersion == ipVersion6 && wildcard:
+		return proto + "6", "::"
+	case config.IPVersion == ipVersion6:
+		return proto + "6", host
+	case wildcard:
+		return proto, "" // a dual-stack socket, where the system supports it
+	}
+	return proto, host
+}
+
+// publicAddress renders [addr], the local address of a tunnel's public listener, for clients: as the domain (with
+// the port) if the listener is on a wildcard address and the domain is configured, or as the IP (IPv6 in brackets,
+// IPv4-mapped IPv6 as IPv4) otherwise
+func publicAddress(config *Config, addr net.Addr) string {
+	var ip net.IP
+	var port int
+	var zone string
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port, zone = a.IP, a.Port, a.Zone
+	case *net.UDPAddr:
+		ip, port, zone = a.IP, a.Port, a.Zone
+	default:
+		return addr.String()
+	}
+
+	if (ip == nil || ip.IsUnspecified()) && config.Domain != "" {
+		return net.JoinHostPort(config.Domain, strconv.Itoa(port))
+	}
+
+	var host = ip.String()
+	if ip == nil {
+		host = "::"
+	}
+	if ip4 := ip.To4(); ip4 != nil && !ip.IsUnspecified() {
+		host = ip4.String()
+	}
+	if zone != "" {
+		host += "%" + zone
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// how the address public listeners are bound on is decided (see Config.GatewayPorts), after OpenSSH's option
+const (
+	gatewayPortsYes             = "yes"             // the operator's bind address, whatever the client asks for
+	gatewayPortsNo              = "no"              // loopback only
+	gatewayPortsClientSpecified = "clientspecified" // the address the client asks for
+)
+
+// validateGatewayPorts returns an error if Config.GatewayPorts isn't valid
+func (config *Config) validateGatewayPorts() error {
+	switch config.GatewayPorts {
+	case "", gatewayPortsYes, gatewayPortsNo, gatewayPortsClientSpecified:
+		return nil
+	}
+	return errors.Errorf("invalid gateway ports %q: must be one of yes, no or clientspecified", config.GatewayPorts)
+}
+
+// bindAddrFor returns the address public listeners of the key with [fingerprint] are bound on, when the client
+// asks for [requested] (the bind address of its tcpip-forward request). Keys with a bind address of their own are
+// always bound on it; for others, it depends on Config.GatewayPorts. As with OpenSSH, clients ask for all
+// interfaces with "" (or "*") and for loopback only with "localhost".
+func (config *Config) bindAddrFor(fingerprint, requested string) (string, error) {
+	if addr, ok := config.BindAddrs[fingerprint]; ok {
+		return interfaceAddr(config, addr)
+	}
+
+	switch config.GatewayPorts {
+	case gatewayPortsNo:
+		return loopbackAddr(config), nil
+	case gatewayPortsClientSpecified:
+		switch requested {
+		case "", "*", "0.0.0.0", "::":
+		case "localhost":
+			return loopbackAddr(config), nil
+		default:
+			return requested, nil
+		}
+	}
+	return interfaceAddr(config, config.BindAddr)
+}
+
+// loopbackAddr returns the loopback address, on the configured IP version
+func loopbackAddr(config *Config) string {
+	if config.IPVersion == ipVersion6 {
+		return "::1"
+	}
+	return "127.0.0.1"
+}
+
+// interfaceAddr returns [addr], or the address of the network interface it names (eg. eth0) on the configured IP
+// version, so that operators can bind public listeners on an interface whose address may change
+func interfaceAddr(config *Config, addr string) (string, error) {
+	iface, err := net.InterfaceByName(addr)
+	if err != nil {
+		return addr, nil // not an interface
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read the addresses of %s", addr)
+	}
+
+	var fallback string
+	for _, a := range addrs {
+		var ipNet, ok = a.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		var v4 = ipNet.IP.To4() != nil
+		switch {
+		case config.IPVersion == ipVersion6 && !v4, config.IPVersion != ipVersion6 && v4:
+			return ipNet.IP.String(), nil
+		case config.IPVersion != ipVersion4 && config.IPVersion != ipVersion6 && fallback == "":
+			fallback = ipNet.IP.String() // an IPv6 address, if the interface has no IPv4 one
+		}
+	}
+
+	if fallback == "" {
+		return "", errors.Errorf("interface %s has no usable address", addr)
+	}
+	return fallback, nil
+}
+
+// tcpListen returns a public listener for a tunnel, which listens on the given [host] and [port] (on the configured
+// IP versions) for incoming TCP connections. If configured, the listener expects a PROXY protocol header on every connection,
+// and accepts TCP Fast Open connections.
+func tcpListen(config *Config, host string, port uint32) (net.Listener, error) {
+	var lc net.ListenConfig
+	if config.TCPFastOpen {
+		lc.Control = enableFastOpen
+	}
+
+	var network, addr = config.listenNetwork("tcp", host)
+	ln, err := lc.Listen(context.Background(), network, net.JoinHostPort(addr, strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, err
+	}
+	return withProxyProtocol(tuneListener(config, ln), config.TunnelProxyProtocol), nil
+}
+
+// tunedListener is a listener for visitors, which applies the operator's TCP options (see Config.TCPKeepAlive and
+// Config.TCPNoDelay) to the connections it accepts
+type tunedListener struct {
+	net.Listener
+	keepAlive time.Duration // 0 to leave the default, negative to disable keep-alives
+	noDelay   bool
+}
+
+// tuneListener wraps [ln] to apply the TCP options of [config] to the connections it accepts
+func tuneListener(config *Config, ln net.Listener) net.Listener {
+	return &tunedListener{Listener: ln, keepAlive: config.TCPKeepAlive, noDelay: config.TCPNoDelay}
+}
+
+func (ln *tunedListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if tc, ok := conn.(*net.TCPConn); ok {
+		_ = tc.SetNoDelay(ln.noDelay)
+		switch {
+		case ln.keepAlive < 0:
+			_ = tc.SetKeepAlive(false)
+		case ln.keepAlive > 0:
+			_ = tc.SetKeepAlive(true)
+			_ = tc.SetKeepAlivePeriod(ln.keepAlive)
+		}
+	}
+	return conn, err
+}
+
+// withProxyProtocol wraps [ln] to expect a PROXY protocol header on every connection if [proxyProtocol] is set
+func withProxyProtocol(ln net.Listener, proxyProtocol bool) net.Listener {
+	if !proxyProtocol {
+		return ln
+	}
+	return &proxyProtocolListener{Listener: ln}
+}
+
+// rebindListener repeatedly invokes [listen] with exponential backoff until it succeeds, [ctx] is done
+// or [rebindTimeout] elapses. It is used to recover a listener that died unexpectedly (eg. interface flap)
+func rebindListener(ctx context.Context, listen func() (net.Listener, error)) (net.Listener, error) {
+	var deadline = time.Now().Add(rebindTimeout)
+	var backoff = rebindInitialBackoff
+	for {
+		ln, err := listen()
+		if err == nil {
+			return ln, nil
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			return nil, errors.Wrap(err, "failed to rebind listener")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > rebindMaxBackoff {
+			backoff = rebindMaxBackoff
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"github.com/pkg/errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// ----------
+// This file contains helper methods that allow the SSH server to create listeners for Unix sockets
+// ----------
+
+// unixSocketPath returns path to the server-local unix socket for tunnel forwarding the given [port]
+func unixSocketPath(dir string, port uint32) string {
+	return filepath.Join(dir, strconv.Itoa(int(port))+".sock")
+}
+
+// unixListen returns a listener which listens on the unix socket at [path] for incoming connections.
+// Any stale socket file left behind at [path] (eg. by a crashed process) is removed first.
+func unixListen(path string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err = os.Remove(path); err != nil {
+			return nil, errors.Wrap(err, "failed to remove stale socket")
+		}
+	}
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"strings"
+)
+
+// ----------
+// This file contains the additional ssh listeners (Config.Listeners), each with a policy of its own: which keys are
+// accepted (or whether clients may connect without authenticating), and which ports clients may forward. The
+// policy of the listener a connection came in on is kept in its context.
+// ----------
+
+// ListenerConfig configures an additional ssh listener, and the policy of connections accepted on it
+type ListenerConfig struct {
+	// names the listener (eg. in logs, and its systemd socket: ssh-<name>)
+	Name string `json:"name"`
+
+	// address to listen on: host:port (tcp4:host:port or tcp6:host:port to use a single IP version), or
+	// unix:<path> for a Unix socket
+	Addr string `json:"addr"`
+
+	// keys accepted on this listener, instead of the server's (authorized_keys format)
+	AuthorizedKeys string `json:"authorized_keys,omitempty"`
+
+	// if set, clients may connect without authenticating (eg. on a Unix socket only local users can reach)
+	Anonymous bool `json:"anonymous,omitempty"`
+
+	// range of ports (eg. 20000-29999) clients may forward as TCP or UDP tunnels; random ports are picked in it.
+	// HTTP and TLS tunnels aren't affected.
+	Ports string `json:"ports,omitempty"`
+
+	// if set, the listener expects a PROXY protocol header on every incoming connection
+	ProxyProtocol bool `json:"proxy_protocol,omitempty"`
+}
+
+// key name for tracking the *sshListener a connection came in on in ssh.Context
+const listenerContextKey = "shhh-listener"
+
+// sshListener is the policy of an additional ssh listener
+type sshListener struct {
+	config *ListenerConfig
+	keys   *AuthorizedKeysFile // nil unless the listener has keys of its own
+	ports  *stablePorts        // nil unless the listener restricts ports
+}
+
+// newSSHListeners returns the policies of the configured listeners, by name
+func newSSHListeners(config *Config) (map[string]*sshListener, error) {
+	var listeners = make(map[string]*sshListener)
+	for i := range config.Listeners {
+		var lc = &config.Listeners[i]
+		if lc.Name == "" || lc.Addr == "" {
+			return nil, errors.New("listeners need a name and an address")
+		}
+		if _, exists := listeners[lc.Name]; exists {
+			return nil, errors.Errorf("listener %q is configured more than once", lc.Name)
+		}
+		if lc.Anonymous && config.RequireAuthentication {
+			return nil, errors.Errorf("listener %q can't be anonymous, as authentication is required", lc.Name)
+		}
+
+		var l = &sshListener{config: lc}
+		if lc.AuthorizedKeys != "" {
+			var err error
+			if l.keys, err = AuthorizedKeys(lc.AuthorizedKeys); err != nil {
+				return nil, errors.Wrapf(err, "listener %q", lc.Name)
+			}
+		}
+
+		if lc.Ports != "" {
+			low, high, err := parsePortRange(lc.Ports)
+			if err != nil {
+				return nil, errors.Wrapf(err, "listener %q", lc.Name)
+			}
+			l.ports = &stablePorts{low: low, high: high}
+		}
+
+		listeners[lc.Name] = l
+	}
+	return listeners, nil
+}
+
+// listenerOf returns the policy of the listener the connection with [ctx] came in on, or nil if it came in on the
+// main listener (Config.Addr)
+func listenerOf(ctx ssh.Context) *sshListener {
+	var l, _ = ctx.Value(listenerContextKey).(*sshListener)
+	return l
+}
+
+// allowsPort returns true if clients on the listener may forward [port] (0 requests a random one)
+func (l *sshListener) allowsPort(port uint32) bool {
+	return l == nil || l.ports == nil || port == 0 || (port >= l.ports.low && port <= l.ports.high)
+}
+
+// restrictsPorts returns true if random ports are to be picked in the listener's range
+func (l *sshListener) restrictsPorts() bool { return l != nil && l.ports != nil }
+
+// seed returns what the candidates for a random port in the listener's range are derived from: the fingerprint of
+// the client's key, so that it gets the same port every time, or something random for anonymous clients
+func (l *sshListener) seed(fingerprint string) string {
+	if fingerprint == "" {
+		return randomToken()
+	}
+	return fingerprint
+}
+
+// authenticate returns true if [key] is accepted on the listener the connection with [ctx] came in on: by its keys
+// if it has any, or by the API token given as the username, or the server's Authenticator (if there's one) otherwise.
+// Without either, any key is accepted, unless clients authenticate with passwords or API tokens.
+func (srv *Server) authenticate(ctx ssh.Context, key ssh.PublicKey) bool {
+	if l := listenerOf(ctx); l != nil && l.keys != nil {
+		return l.keys.Authenticate(ctx, key)
+	}
+	if given, ok := srv.tokens.authenticate(ctx); given {
+		return ok
+	}
+	if srv.authenticator == nil {
+		return srv.passwords == nil && srv.tokens == nil
+	}
+	return srv.authenticator.Authenticate(ctx, key)
+}
+
+// anonymous returns true if clients connecting with [ctx] needn't authenticate
+func (srv *Server) anonymous(ctx ssh.Context) bool {
+	var l = listenerOf(ctx)
+	if l != nil && l.config.Anonymous {
+		return true
+	}
+	return srv.authenticator == nil && srv.passwords == nil && srv.tokens == nil && (l == nil || l.keys == nil)
+}
+
+// listenersConfig returns an ssh.ServerConfigCallback letting clients connect without authenticating on the
+// listeners allowing it, on top of [next] (if set)
+func listenersConfig(srv *Server, next ssh.ServerConfigCallback) ssh.ServerConfigCallback {
+	return func(ctx ssh.Context) *gossh.ServerConfig {
+		var config = &gossh.ServerConfig{}
+		if next != nil {
+			config = next(ctx)
+		}
+		config.NoClientAuth = srv.anonymous(ctx)
+		return config
+	}
+}
+
+// ServeListener accepts incoming ssh connections on [ln], applying the policy of the configured listener [name]
+// (see Config.Listeners). It always returns a non-nil error; after Shutdown or Close, the returned error is
+// ssh.ErrServerClosed.
+func (srv *Server) ServeListener(name string, ln net.Listener) error {
+	var l, ok = srv.listeners[name]
+	if !ok {
+		return errors.Errorf("no listener named %q is configured", name)
+	}
+	return srv.ssh.Serve(&policyListener{Listener: withProxyProtocol(ln, l.config.ProxyProtocol), policy: l})
+}
+
+// Listen returns a listener on [addr], given as for ListenerConfig.Addr. A stale Unix socket left behind at its
+// path (eg. by a crashed process) is removed first.
+func Listen(addr string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		return unixListen(strings.TrimPrefix(addr, "unix:"))
+	case strings.HasPrefix(addr, "tcp4:"):
+		return net.Listen("tcp4", strings.TrimPrefix(addr, "tcp4:"))
+	case strings.HasPrefix(addr, "tcp6:"):
+		return net.Listen("tcp6", strings.TrimPrefix(addr, "tcp6:"))
+	}
+	return net.Listen("tcp", addr)
+}
+
+// policyListener tags connections accepted on it with the policy of their listener
+type policyListener struct {
+	net.Listener
+	policy *sshListener
+}
+
+func (ln *policyListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &policyConn{Conn: conn, policy: ln.policy}, nil
+}
+
+// policyConn is a connection accepted on an additional listener
+type policyConn struct {
+	net.Conn
+	policy *sshListener
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// ----------
+// This file contains the messages sent to clients, which are written either as prose (eg. "server: forwarding TCP
+// traffic from [::]:4000") or, if the client asked for it, as JSON lines for scripts to parse
+// ----------
+
+// name of the environment variable (eg. ssh -o SetEnv=SHHH_OUTPUT=json) clients can use to ask for JSON messages
+const outputEnv = "SHHH_OUTPUT"
+
+// field is a machine-readable detail of a message, included in its JSON form
+type field struct {
+	key   string
+	value interface{}
+}
+
+// kv returns a field with [key] and [value]
+func kv(key string, value interface{}) field { return field{key: key, value: value} }
+
+// notifyFn sends [msg] to a client, along with [fields] describing it; a "type" field names what the message
+// is about (eg. "forwarding" or "connection.closed")
+type notifyFn func(msg string, fields ...field)
+
+// message is a message for a client, queued until its session writes it
+type message struct {
+	time   time.Time
+	text   string
+	fields []field
+}
+
+// types of messages which aren't sent to clients that asked for --quiet
+var routineMessages = map[string]bool{"connection.accepted": true, "request": true, "stats": true}
+
+// kind returns the type of the message (see notifyFn), or empty if it has none
+func (m message) kind() string {
+	var s, _ = m.value("type").(string)
+	return s
+}
+
+// value returns the value of the message's field named [key], or nil if it has none
+func (m message) value(key string) interface{} {
+	for _, f := range m.fields {
+		if f.key == key {
+			return f.value
+		}
+	}
+	return nil
+}
+
+// String returns the message as prose
+func (m message) String() string { return "server: " + m.text + "\n" }
+
+// JSON returns the message as a JSON line, eg:
+//
+//	{"time":"2006-01-02T15:04:05Z","type":"forwarding","message":"forwarding TCP traffic from [::]:4000","address":"[::]:4000"}
+//
+// Messages without a type are of type "message".
+func (m message) JSON() string {
+	var doc = map[string]interface{}{"time": m.time.UTC().Format(time.RFC3339), "type": "message", "message": m.text}
+	for _, f := range m.fields {
+		doc[f.key] = f.value
+	}
+
+	content, err := json.Marshal(doc)
+	if err != nil {
+		content, _ = json.Marshal(map[string]string{"type": "error", "message": m.text, "error": err.Error()})
+	}
+	return string(content) + "\n"
+}
+
+// hasEnv returns true if [environ] (as KEY=value pairs) sets [key] to [value] (ignoring case)
+func hasEnv(environ []string, key, value string) bool {
+	for _, pair := range environ {
+		if strings.HasPrefix(pair, key+"=") && strings.EqualFold(strings.TrimPrefix(pair, key+"="), value) {
+			return true
+		}
+	}
+	return false
+}
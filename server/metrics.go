@@ -0,0 +1,232 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ----------
+// This file contains a minimal metrics registry, exposed in the Prometheus text format (see Server.MetricsHandler)
+// ----------
+
+// kinds of metric
+const (
+	counter = "counter"
+	gauge   = "gauge"
+)
+
+// metric is a named family of samples, one for each combination of label values
+type metric struct {
+	name, help, kind string
+	labels           []string
+
+	mu      sync.Mutex
+	samples map[string]*sample // keyed by the joined label values
+}
+
+// sample is a single value of a metric
+type sample struct {
+	labels []string
+	value  float64
+}
+
+// key returns the key of the sample with the given label [values]
+func (m *metric) key(values []string) string {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", m.name, len(m.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// Add adds [delta] to the sample with the given label [values]
+func (m *metric) Add(delta float64, values ...string) {
+	var key = m.key(values)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s, ok := m.samples[key]; ok {
+		s.value += delta
+	} else {
+		m.samples[key] = &sample{labels: values, value: delta}
+	}
+}
+
+// Set sets the sample with the given label [values] to [value]
+func (m *metric) Set(value float64, values ...string) {
+	var key = m.key(values)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.samples[key] = &sample{labels: values, value: value}
+}
+
+// Delete removes the sample with the given label [values] (eg. once the tunnel it describes is closed)
+func (m *metric) Delete(values ...string) {
+	var key = m.key(values)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.samples, key)
+}
+
+// write writes the metric to [w] in the Prometheus text format
+func (m *metric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	if len(m.labels) == 0 && len(m.samples) == 0 {
+		_, _ = fmt.Fprintf(w, "%s 0\n", m.name)
+		return
+	}
+
+	var keys = make([]string, 0, len(m.samples))
+	for key := range m.samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		var s = m.samples[key]
+		var pairs = make([]string, len(m.labels))
+		for i, label := range m.labels {
+			pairs[i] = fmt.Sprintf("%s=\"%s\"", label, labelEscaper.Replace(s.labels[i]))
+		}
+
+		var name = m.name
+		if len(pairs) > 0 {
+			name += "{" + strings.Join(pairs, ",") + "}"
+		}
+		_, _ = fmt.Fprintf(w, "%s %s\n", name, strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+}
+
+// escapes label values as per the Prometheus text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metrics is the registry of the server's metrics
+type metrics struct {
+	all []*metric
+
+	// server-wide totals
+	tunnels     *metric
+	connections *metric
+	bytes       *metric
+	closes      *metric
+	tasks       *metric
+	denied      *metric
+	reputation  *metric
+
+	// per-tunnel values, labelled by the tunnel's public address
+	tunnelConnections *metric
+	tunnelBytes       *metric
+	tunnelUptime      *metric
+	tunnelTags        *metric
+	tunnelRTT         *metric
+	tunnelThroughput  *metric
+
+	// traffic of each open tunnel already added to the totals, keyed by the tunnel's address
+	mu       sync.Mutex
+	reported map[string]tunnelStats
+}
+
+// newMetrics returns a new registry with the server's metrics
+func newMetrics() *metrics {
+	var m = &metrics{reported: make(map[string]tunnelStats)}
+	var register = func(name, help, kind string, labels ...string) *metric {
+		var mt = &metric{name: name, help: help, kind: kind, labels: labels, samples: make(map[string]*sample)}
+		m.all = append(m.all, mt)
+		return mt
+	}
+
+	m.tunnels = register("shhh_tunnels", "Number of open tunnels.", gauge)
+	m.connections = register("shhh_connections_total", "Connections served by all tunnels.", counter)
+	m.bytes = register("shhh_bytes_total", "Bytes transferred by all tunnels.", counter, "direction")
+	m.closes = register("shhh_connections_closed_total", "Forwarded connections that ended, by reason.", counter, "reason")
+	m.denied = register("shhh_connections_denied_total", "Connections to tunnels denied before being forwarded, by reason.", counter, "reason")
+	m.reputation = register("shhh_reputation_blocks_total", "Connections to tunnels denied as the visitor is listed in a reputation feed, by feed.", counter, "feed")
+	m.tasks = register("shhh_tasks", "Goroutines running as part of a tunnel's lifecycle (tunnels, listeners and connections).", gauge)
+	m.tunnelConnections = register("shhh_tunnel_connections", "Connections served by an open tunnel.", gauge, "tunnel")
+	m.tunnelBytes = register("shhh_tunnel_bytes", "Bytes transferred by an open tunnel.", gauge, "tunnel", "direction")
+	m.tunnelUptime = register("shhh_tunnel_uptime_seconds", "Time since an open tunnel was created.", gauge, "tunnel")
+	m.tunnelRTT = register("shhh_tunnel_rtt_seconds", "Round-trip time to the client of an open tunnel, as last measured (see -flow-control-interval).", gauge, "tunnel")
+	m.tunnelThroughput = register("shhh_tunnel_channel_throughput_bytes", "Bytes per second through the fastest connection of an open tunnel, as last measured (see -flow-control-interval).", gauge, "tunnel")
+	m.tunnelTags = register("shhh_tunnel_tag", "Tags of an open tunnel, one series (of value 1) for each.", gauge, "tunnel", "tag", "value")
+	return m
+}
+
+// opened records that the tunnel at [address], with traffic tracked by [stats] and [tags], has been opened
+func (m *metrics) opened(address string, stats *tunnelStats, tags map[string]string) {
+	m.tunnels.Add(1)
+	m.observe(address, stats)
+	for key, value := range tags {
+		m.tunnelTags.Set(1, address, key, value)
+	}
+}
+
+// observe updates the metrics with the traffic [stats] of the open tunnel at [address]
+func (m *metrics) observe(address string, stats *tunnelStats) {
+	var current = stats.snapshot()
+
+	m.mu.Lock()
+	var last = m.reported[address]
+	m.reported[address] = current
+	m.mu.Unlock()
+
+	m.connections.Add(float64(current.connections - last.connections))
+	m.bytes.Add(float64(current.bytesIn-last.bytesIn), "in")
+	m.bytes.Add(float64(current.bytesOut-last.bytesOut), "out")
+
+	m.tunnelConnections.Set(float64(current.connections), address)
+	m.tunnelBytes.Set(float64(current.bytesIn), address, "in")
+	m.tunnelBytes.Set(float64(current.bytesOut), address, "out")
+	m.tunnelUptime.Set(stats.uptime().Seconds(), address)
+	if current.rtt > 0 {
+		m.tunnelRTT.Set(time.Duration(current.rtt).Seconds(), address)
+		m.tunnelThroughput.Set(float64(current.throughput), address)
+	}
+}
+
+// closed records the final [stats] of the tunnel at [address] (with [tags]), and removes its per-tunnel values
+func (m *metrics) closed(address string, stats *tunnelStats, tags map[string]string) {
+	m.observe(address, stats)
+	m.tunnels.Add(-1)
+
+	m.mu.Lock()
+	delete(m.reported, address)
+	m.mu.Unlock()
+
+	m.tunnelConnections.Delete(address)
+	m.tunnelBytes.Delete(address, "in")
+	m.tunnelBytes.Delete(address, "out")
+	m.tunnelUptime.Delete(address)
+	m.tunnelRTT.Delete(address)
+	m.tunnelThroughput.Delete(address)
+	for key, value := range tags {
+		m.tunnelTags.Delete(address, key, value)
+	}
+}
+
+// connectionClosed records that a forwarded connection ended with [reason]
+func (m *metrics) connectionClosed(reason string) { m.closes.Add(1, reason) }
+
+// connectionDenied records that a connection to a tunnel was denied for [reason]
+func (m *metrics) connectionDenied(reason string) { m.denied.Add(1, reason) }
+
+// reputationBlocked records that a connection was denied as the visitor is listed in [feed]
+func (m *metrics) reputationBlocked(feed string) { m.reputation.Add(1, feed) }
+
+// ServeHTTP writes all metrics in the Prometheus text format
+func (m *metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	m.tasks.Set(float64(atomic.LoadInt64(&groupTasks)))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, mt := range m.all {
+		mt.write(w)
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+	"plugin"
+)
+
+// ----------
+// This file contains the middleware interface applied to the traffic of tunnels: each connection forwarded through
+// a TCP / TLS tunnel, and each request to an HTTP tunnel, passes through the middleware (in order) before reaching
+// the client. Embedders plug middleware in with WithMiddleware; operators can load it from Go plugins
+// (see Config.MiddlewarePlugins), each of which exports a constructor:
+//
+//   func NewMiddleware() (server.Middleware, error)
+//
+// Plugins must be built (with go build -buildmode=plugin) against the same version of this package as the server.
+// ----------
+
+// Middleware processes the traffic of tunnels, eg. to rewrite headers, filter content or keep metrics of its own
+type Middleware interface {
+	// Conn returns the connection to forward in place of the visitor's [conn] to a TCP / TLS tunnel (eg. one counting
+	// or filtering what's read and written; or [conn] itself), or an error to close it
+	Conn(conn net.Conn) (net.Conn, error)
+
+	// HTTP returns the handler serving requests to HTTP tunnels in place of [next] (or [next] itself)
+	HTTP(next http.Handler) http.Handler
+}
+
+// middlewareConstructor is the name of the constructor middleware plugins export
+const middlewareConstructor = "NewMiddleware"
+
+// middlewareChain is the middleware applied to the traffic of tunnels, in order. An empty chain passes it on as-is.
+type middlewareChain []Middleware
+
+// loadMiddlewarePlugins returns the middleware constructed by the Go plugins at [paths]
+func loadMiddlewarePlugins(paths []string) (middlewareChain, error) {
+	var chain middlewareChain
+	for _, path := range paths {
+		p, err := plugin.Open(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to open middleware plugin %s", path)
+		}
+
+		symbol, err := p.Lookup(middlewareConstructor)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid middleware plugin %s", path)
+		}
+
+		constructor, ok := symbol.(func() (Middleware, error))
+		if !ok {
+			return nil, errors.Errorf("invalid middleware plugin %s: %s must be a func() (server.Middleware, error), not %T", path, middlewareConstructor, symbol)
+		}
+
+		mw, err := constructor()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to set up middleware plugin %s", path)
+		}
+		chain = append(chain, mw)
+	}
+	return chain, nil
+}
+
+// conn passes the visitor's [conn] through the middleware, the first of it seeing the visitor's connection as-is
+func (chain middlewareChain) conn(conn net.Conn) (net.Conn, error) {
+	for _, mw := range chain {
+		var err error
+		if conn, err = mw.Conn(conn); err != nil {
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// http returns [next] wrapped in the middleware, the first of it seeing requests first
+func (chain middlewareChain) http(next http.Handler) http.Handler {
+	for i := len(chain) - 1; i >= 0; i-- {
+		next = chain[i].HTTP(next)
+	}
+	return next
+}
@@ -0,0 +1,486 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ----------
+// This file contains traffic mirroring, to debug protocol issues: an administrator (see Server.Mirror) has the
+// traffic forwarded through a tunnel teed to a capture sink, as a pcap stream that Wireshark / tcpdump can read. The
+// sink is a file in Config.MirrorDir, or a TCP endpoint listed in Config.MirrorEndpoints (eg. `nc -l 9999 |
+// wireshark -k -i -`). Each forwarded connection shows up as a TCP stream between the visitor and the tunnel's port.
+// Captured packets are queued for the sink, rather than written as traffic flows, so that a slow sink doesn't slow the
+// tunnel down: they're dropped (and counted) while the queue is full.
+// ----------
+
+const (
+	// largest payload of a captured packet (so that its IP length fits)
+	mirrorMaxPayload = 65000
+
+	// packets queued for a sink, after which further ones are dropped
+	mirrorQueueSize = 1024
+
+	// how long writing a packet to a TCP sink may take, after which the sink is considered dead and closed
+	mirrorWriteTimeout = 10 * time.Second
+)
+
+// MirrorOptions describes how a tunnel's traffic is mirrored
+type MirrorOptions struct {
+	// where the traffic is mirrored to: "file" (a new pcap file in Config.MirrorDir), or a tcp://host:port endpoint
+	// listed in Config.MirrorEndpoints
+	Sink string `json:"sink"`
+
+	// bytes of traffic mirrored, after which mirroring stops (0 for no limit)
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+
+	// fraction of the tunnel's connections mirrored, between 0 and 1 (0 for all of them)
+	Sample float64 `json:"sample,omitempty"`
+}
+
+// tunnelMirror is the mirroring of a tunnel's traffic, which is off until started. A nil *tunnelMirror never mirrors.
+type tunnelMirror struct {
+	mu   sync.Mutex
+	sink *mirrorSink // nil unless mirroring
+}
+
+// tapping wraps [newChannel], which opens the channels of connections to [port], so that the traffic over them is
+// mirrored while the tunnel is
+func (m *tunnelMirror) tapping(port uint32, newChannel newChannelFn) newChannelFn {
+	if m == nil {
+		return newChannel
+	}
+
+	return func(host, visitorPort string) (gossh.Channel, <-chan *gossh.Request, error) {
+		channel, requests, err := newChannel(host, visitorPort)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		m.mu.Lock()
+		var sink = m.sink
+		m.mu.Unlock()
+		if sink == nil || (sink.options.Sample > 0 && rand.Float64() >= sink.options.Sample) {
+			return channel, requests, nil
+		}
+
+		var p, _ = strconv.Atoi(visitorPort)
+		var flow = sink.newFlow(net.ParseIP(host), uint16(p), uint16(port))
+		return &mirroredChannel{Channel: channel, flow: flow}, requests, nil
+	}
+}
+
+// start starts mirroring to [sink], instead of to the sink it mirrored to until then (if any)
+func (m *tunnelMirror) start(sink *mirrorSink) {
+	sink.done = func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.sink == sink {
+			m.sink = nil
+		}
+	}
+
+	m.mu.Lock()
+	var previous = m.sink
+	m.sink = sink
+	m.mu.Unlock()
+	previous.close()
+}
+
+// stop stops mirroring; it returns false if the tunnel wasn't being mirrored
+func (m *tunnelMirror) stop() bool {
+	if m == nil {
+		return false
+	}
+
+	m.mu.Lock()
+	var sink = m.sink
+	m.sink = nil
+	m.mu.Unlock()
+
+	sink.close()
+	return sink != nil
+}
+
+// describe returns where the tunnel is mirrored to, or an empty string if it isn't
+func (m *tunnelMirror) describe() string {
+	if m == nil {
+		return ""
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sink == nil {
+		return ""
+	}
+	return m.sink.name
+}
+
+// mirrorSink is where mirrored traffic is written to, as a pcap stream. A nil *mirrorSink is closed.
+type mirrorSink struct {
+	dropped int64 // packets dropped as the queue was full (accessed atomically)
+
+	name    string // what the sink is known by (eg. the file's name)
+	options MirrorOptions
+	done    func()        // called once the sink is closed
+	timeout time.Duration // how long writing a packet to a net.Conn sink may take
+
+	w       io.WriteCloser // written to by run only
+	packets chan []byte    // pcap records queued for w; closed once the sink is
+
+	mu      sync.Mutex
+	written int64 // bytes of traffic mirrored so far
+	closed  bool
+}
+
+// openMirrorSink opens the sink described by [options], with [config] telling where sinks may be. [label] names
+// the mirrored tunnel.
+func openMirrorSink(config *Config, label string, options MirrorOptions) (*mirrorSink, error) {
+	if options.Sample < 0 || options.Sample > 1 {
+		return nil, errors.New("sample must be between 0 and 1")
+	}
+
+	switch {
+	case options.Sink == "file":
+		if config.MirrorDir == "" {
+			return nil, errors.New("mirroring to files is disabled")
+		}
+
+		var clean = strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' {
+				return r
+			}
+			return '_'
+		}, label)
+		var name = fmt.Sprintf("%s-%s.pcap", clean, time.Now().UTC().Format("20060102T150405Z"))
+
+		file, err := os.OpenFile(filepath.Join(config.MirrorDir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create capture file")
+		}
+		return newMirrorSink(name, options, file), nil
+
+	case strings.HasPrefix(options.Sink, "tcp://"):
+		if !contains(config.MirrorEndpoints, options.Sink) {
+			return nil, errors.Errorf("mirror endpoint %s isn't allowed", options.Sink)
+		}
+
+		conn, err := net.DialTimeout("tcp", strings.TrimPrefix(options.Sink, "tcp://"), 10*time.Second)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to connect to mirror endpoint")
+		}
+		return newMirrorSink(options.Sink, options, conn), nil
+
+	default:
+		return nil, errors.Errorf("invalid sink %q (file or tcp://host:port)", options.Sink)
+	}
+}
+
+// newMirrorSink returns a sink known as [name] writing to [w], starting with the pcap file header
+func newMirrorSink(name string, options MirrorOptions, w io.WriteCloser) *mirrorSink {
+	var sink = &mirrorSink{name: name, options: options, done: func() {}, timeout: mirrorWriteTimeout, w: w,
+		packets: make(chan []byte, mirrorQueueSize)}
+
+	// the pcap file header: version 2.4, microsecond timestamps, and raw IP packets (LINKTYPE_RAW)
+	var header = make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 65535)
+	binary.LittleEndian.PutUint32(header[20:], 101)
+	sink.packets <- header
+
+	go sink.run()
+	return sink
+}
+
+// run writes the packets queued for the sink until it's closed. If writing fails (or, for TCP sinks, times out), the
+// sink is closed, and what's left of the queue dropped.
+func (sink *mirrorSink) run() {
+	var conn, _ = sink.w.(net.Conn)
+	var failed bool
+	for record := range sink.packets {
+		if failed {
+			continue
+		}
+
+		if conn != nil {
+			_ = conn.SetWriteDeadline(time.Now().Add(sink.timeout))
+		}
+		if _, err := sink.w.Write(record); err != nil {
+			log.Printf("failed to mirror to %s: %s", sink.name, err.Error())
+			failed = true
+			sink.close()
+		}
+	}
+	_ = sink.w.Close()
+
+	sink.mu.Lock()
+	var written = sink.written
+	sink.mu.Unlock()
+	log.Printf("stopped mirroring to %s after %s (%d packets dropped as it fell behind)", sink.name, formatBytes(written), atomic.LoadInt64(&sink.dropped))
+}
+
+// close closes the sink, if it isn't already. Packets queued until then are still written.
+func (sink *mirrorSink) close() {
+	if sink == nil {
+		return
+	}
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.closeLocked()
+}
+
+func (sink *mirrorSink) closeLocked() {
+	if sink.closed {
+		return
+	}
+	sink.closed = true
+	close(sink.packets)
+	sink.done()
+}
+
+// write queues a captured packet, carrying [payload] bytes of traffic, for the sink. It never blocks: the packet is
+// dropped if the queue is full. Once the sink's limit is reached, it's closed.
+func (sink *mirrorSink) write(packet []byte, payload int) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.closed {
+		return
+	}
+
+	if sink.options.MaxBytes > 0 && sink.written+int64(payload) > sink.options.MaxBytes {
+		sink.closeLocked()
+		return
+	}
+
+	var now = time.Now()
+	var record = make([]byte, 16, 16+len(packet))
+	binary.LittleEndian.PutUint32(record[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+
+	select {
+	case sink.packets <- append(record, packet...):
+		sink.written += int64(payload)
+	default:
+		atomic.AddInt64(&sink.dropped, 1)
+	}
+}
+
+// mirrorFlow is a forwarded connection, as captured in a sink: a TCP stream between the visitor and the tunnel's port
+type mirrorFlow struct {
+	sink                   *mirrorSink
+	visitor, local         net.IP
+	visitorPort, localPort uint16
+
+	mu                   sync.Mutex
+	visitorSeq, localSeq uint32 // next sequence numbers of each side
+	closed               bool
+}
+
+// TCP flags of captured packets
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// newFlow returns a new flow between the visitor at [visitor]:[visitorPort] and the tunnel's [localPort], starting
+// with a handshake
+func (sink *mirrorSink) newFlow(visitor net.IP, visitorPort, localPort uint16) *mirrorFlow {
+	var flow = &mirrorFlow{sink: sink, visitor: visitor, visitorPort: visitorPort, localPort: localPort}
+	if visitor == nil { // eg. visitors of unix sockets
+		flow.visitor = net.IPv4(127, 0, 0, 1)
+	}
+	if flow.visitor.To4() != nil {
+		flow.local = net.IPv4zero
+	} else {
+		flow.local = net.IPv6unspecified
+	}
+
+	flow.packet(true, tcpSYN, nil)
+	flow.packet(false, tcpSYN|tcpACK, nil)
+	flow.packet(true, tcpACK, nil)
+	return flow
+}
+
+// packet captures a packet with [flags], carrying [payload], from the visitor (if [fromVisitor]) or to it
+func (flow *mirrorFlow) packet(fromVisitor bool, flags byte, payload []byte) {
+	flow.mu.Lock()
+	defer flow.mu.Unlock()
+
+	var src, dst, srcPort, dstPort, seq, ack = flow.visitor, flow.local, flow.visitorPort, flow.localPort, &flow.visitorSeq, flow.localSeq
+	if !fromVisitor {
+		src, dst, srcPort, dstPort, seq, ack = flow.local, flow.visitor, flow.localPort, flow.visitorPort, &flow.localSeq, flow.visitorSeq
+	}
+
+	var segment = make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(segment[0:], srcPort)
+	binary.BigEndian.PutUint16(segment[2:], dstPort)
+	binary.BigEndian.PutUint32(segment[4:], *seq)
+	if flags&tcpACK != 0 {
+		binary.BigEndian.PutUint32(segment[8:], ack)
+	}
+	segment[12] = 5 << 4 // header length, in 32-bit words
+	segment[13] = flags
+	binary.BigEndian.PutUint16(segment[14:], 65535) // window
+	copy(segment[20:], payload)
+
+	*seq += uint32(len(payload))
+	if flags&(tcpSYN|tcpFIN) != 0 {
+		*seq++ // SYN and FIN take a sequence number of their own
+	}
+
+	var packet []byte
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		packet = make([]byte, 20, 20+len(segment))
+		packet[0] = 0x45 // version 4, header length 5
+		binary.BigEndian.PutUint16(packet[2:], uint16(20+len(segment)))
+		packet[8] = 64 // ttl
+		packet[9] = 6  // tcp
+		copy(packet[12:], src4)
+		copy(packet[16:], dst4)
+		binary.BigEndian.PutUint16(packet[10:], checksum(packet, 0))
+		binary.BigEndian.PutUint16(segment[16:], checksum(segment, pseudoHeaderSum(src4, dst4, len(segment))))
+	} else {
+		packet = make([]byte, 40, 40+len(segment))
+		packet[0] = 0x60 // version 6
+		binary.BigEndian.PutUint16(packet[4:], uint16(len(segment)))
+		packet[6] = 6 // tcp
+		packet[7] = 64
+		copy(packet[8:], src.To16())
+		copy(packet[24:], dst.To16())
+		binary.BigEndian.PutUint16(segment[16:], checksum(segment, pseudoHeaderSum(src.To16(), dst.To16(), len(segment))))
+	}
+	flow.sink.write(append(packet, segment...), len(payload))
+}
+
+// data captures [b], sent from the visitor (if [fromVisitor]) or to it
+func (flow *mirrorFlow) data(fromVisitor bool, b []byte) {
+	for len(b) > 0 {
+		var n = len(b)
+		if n > mirrorMaxPayload {
+			n = mirrorMaxPayload
+		}
+		flow.packet(fromVisitor, tcpPSH|tcpACK, b[:n])
+		b = b[n:]
+	}
+}
+
+// close captures the end of the flow
+func (flow *mirrorFlow) close() {
+	flow.mu.Lock()
+	var closed = flow.closed
+	flow.closed = true
+	flow.mu.Unlock()
+
+	if !closed {
+		flow.packet(true, tcpFIN|tcpACK, nil)
+		flow.packet(false, tcpFIN|tcpACK, nil)
+	}
+}
+
+// pseudoHeaderSum returns the sum of the pseudo header of a TCP [length] bytes long, from [src] to [dst]
+func pseudoHeaderSum(src, dst net.IP, length int) uint32 {
+	var sum uint32
+	for _, ip := range []net.IP{src, dst} {
+		for i := 0; i < len(ip); i += 2 {
+			sum += uint32(ip[i])<<8 | uint32(ip[i+1])
+		}
+	}
+	return sum + 6 + uint32(length)
+}
+
+// checksum returns the internet checksum (see RFC 1071) of [b], added to [sum]
+func checksum(b []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// mirroredChannel is a gossh.Channel whose traffic is mirrored. Reads carry what's sent to the visitor, and writes
+// what the visitor sent.
+type mirroredChannel struct {
+	gossh.Channel
+	flow *mirrorFlow
+}
+
+func (c *mirroredChannel) Read(b []byte) (n int, err error) {
+	n, err = c.Channel.Read(b)
+	c.flow.data(false, b[:n])
+	return n, err
+}
+
+func (c *mirroredChannel) Write(b []byte) (n int, err error) {
+	n, err = c.Channel.Write(b)
+	c.flow.data(true, b[:n])
+	return n, err
+}
+
+func (c *mirroredChannel) Close() error {
+	c.flow.close()
+	return c.Channel.Close()
+}
+
+// Mirror starts mirroring the traffic of the tunnel at [address] as [options] describe, instead of as it's mirrored
+// until then (if it is). It returns the name of the sink (eg. the capture file's).
+func (srv *Server) Mirror(address string, options MirrorOptions) (string, error) {
+	tunnel, err := srv.tunnels.get(address)
+	if err != nil {
+		return "", err
+	}
+
+	if tunnel.mirror == nil {
+		return "", errors.Errorf("traffic of tunnel %s can't be mirrored", tunnel.address)
+	}
+
+	if srv.config.MirrorDir == "" && len(srv.config.MirrorEndpoints) == 0 {
+		return "", errors.New("mirroring is disabled")
+	}
+
+	sink, err := openMirrorSink(srv.config, tunnel.label(), options)
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("mirroring traffic of tunnel %s to %s", tunnel.label(), sink.name)
+	tunnel.mirror.start(sink)
+	return sink.name, nil
+}
+
+// Unmirror stops mirroring the traffic of the tunnel at [address]
+func (srv *Server) Unmirror(address string) error {
+	tunnel, err := srv.tunnels.get(address)
+	if err != nil {
+		return err
+	}
+
+	if !tunnel.mirror.stop() {
+		return errors.Errorf("traffic of tunnel %s isn't mirrored", tunnel.address)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a sink which doesn't keep up neither slows down the traffic mirrored to it, nor is kept open once it's stuck
+func TestMirrorSinkStuck(t *testing.T) {
+	var conn, peer = net.Pipe() // nothing reads from peer
+	defer peer.Close()
+
+	var sink = newMirrorSink("stuck", MirrorOptions{}, conn)
+	sink.timeout = 100 * time.Millisecond
+	var closed = make(chan struct{})
+	sink.done = func() { close(closed) }
+
+	var flow = sink.newFlow(net.IPv4(192, 0, 2, 1), 40000, 8080)
+	var started = time.Now()
+	for i := 0; i < 2*mirrorQueueSize; i++ {
+		flow.data(i%2 == 0, []byte("hello"))
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Fatalf("mirroring to a stuck sink took %s", elapsed)
+	}
+	if atomic.LoadInt64(&sink.dropped) == 0 {
+		t.Fatal("no packets dropped, although the sink's queue was full")
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stuck sink wasn't closed")
+	}
+}
+
+// packets queued for a sink are all written, in order, as it keeps up
+func TestMirrorSinkWrites(t *testing.T) {
+	var conn, peer = net.Pipe()
+	defer peer.Close()
+
+	var received = make(chan int, 1)
+	go func() {
+		var total int
+		var buf = make([]byte, 4096)
+		for {
+			n, err := peer.Read(buf)
+			total += n
+			if err != nil {
+				received <- total
+				return
+			}
+		}
+	}()
+
+	var sink = newMirrorSink("test", MirrorOptions{}, conn)
+	var flow = sink.newFlow(net.IPv4(192, 0, 2, 1), 40000, 8080)
+	flow.data(true, []byte("ping"))
+	flow.close()
+	sink.close()
+
+	// the pcap header, and 6 packets (handshake, data and FINs) of 16 + 20 + 20 bytes, plus the data
+	const want = 24 + 6*(16+20+20) + len("ping")
+	select {
+	case got := <-received:
+		if got != want {
+			t.Fatalf("sink got %d bytes, want %d", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sink wasn't closed")
+	}
+}
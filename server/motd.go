@@ -0,0 +1,113 @@
+package server
+
+import (
+	"bytes"
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// ----------
+// This file contains the pre-authentication banner, and the message of the day (MOTD) shown to clients
+// once their session opens, so that operators can brand their deployment and communicate policies
+// ----------
+
+// how long the MOTD waits for the client's first tunnel, so that its endpoints can be shown
+const motdSettleTime = 500 * time.Millisecond
+
+// BannerHandler returns the banner sent to a client before it authenticates (empty to send none)
+type BannerHandler func(ctx ssh.Context) string
+
+// fileBanner returns a BannerHandler which sends the content of the file at [path]
+func fileBanner(path string) (BannerHandler, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read banner")
+	}
+
+	var banner = string(content)
+	return func(ssh.Context) string { return banner }, nil
+}
+
+// bannerConfig returns an ssh.ServerConfigCallback which sends the banner returned by [handler]. The banner is sent
+// before gliderlabs/ssh fills in the connection's metadata, so the user and addresses are put in the context here.
+func bannerConfig(handler BannerHandler) ssh.ServerConfigCallback {
+	return func(ctx ssh.Context) *gossh.ServerConfig {
+		return &gossh.ServerConfig{
+			BannerCallback: func(meta gossh.ConnMetadata) string {
+				ctx.SetValue(ssh.ContextKeyUser, meta.User())
+				ctx.SetValue(ssh.ContextKeyClientVersion, string(meta.ClientVersion()))
+				ctx.SetValue(ssh.ContextKeyLocalAddr, meta.LocalAddr())
+				ctx.SetValue(ssh.ContextKeyRemoteAddr, meta.RemoteAddr())
+				return handler(ctx)
+			},
+		}
+	}
+}
+
+// motdData is what the MOTD template is rendered with
+type motdData struct {
+	ServerName  string   // see Config.ServerName
+	Fingerprint string   // of the client's key (empty if authentication is disabled)
+	Endpoints   []string // public addresses of the client's tunnels
+	Quota       string   // the client's usage and quota (empty if quotas are disabled)
+}
+
+// loadMOTD parses the MOTD template (see text/template) in the file at [path]. It returns nil if [path] is empty.
+func loadMOTD(path string) (*template.Template, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read motd")
+	}
+
+	tmpl, err := template.New("motd").Parse(string(content))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse motd")
+	}
+	return tmpl, nil
+}
+
+// motd renders the server's MOTD for the client on [conn]. It returns an empty string if there's no MOTD.
+func motd(srv *Server, conn *connection) string {
+	if srv.motd == nil {
+		return ""
+	}
+
+	// tunnels are usually requested alongside the session; give them a moment
+	var deadline = time.Now().Add(motdSettleTime)
+	for atomic.LoadInt32(&conn.forwards) == 0 && time.Now().Before(deadline) {
+		select {
+		case <-conn.ctx.Done():
+			return ""
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	var fingerprint = Fingerprint(conn.ctx)
+	var data = motdData{ServerName: srv.config.ServerName, Fingerprint: fingerprint, Endpoints: conn.Endpoints()}
+	if srv.quotas.enabled() {
+		data.Quota = srv.quotas.Describe(fingerprint)
+	}
+
+	var buf bytes.Buffer
+	if err := srv.motd.Execute(&buf, data); err != nil {
+		log.Printf("failed to render motd: %s", err)
+		return ""
+	}
+
+	var text = buf.String()
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	return text
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"math/big"
+)
+
+// ----------
+// This file contains the generator of memorable names (eg. brave-otter-123) for HTTP tunnels that didn't request one
+// ----------
+
+// number of generated names tried before giving up on finding one that's available
+const nameAttempts = 10
+
+// default words used to generate names
+var (
+	defaultAdjectives = []string{
+		"amber", "bold", "brave", "bright", "calm", "clever", "cosmic", "crisp", "curious", "dapper",
+		"eager", "fancy", "fluffy", "gentle", "giddy", "golden", "happy", "hidden", "humble", "jolly",
+		"keen", "kind", "lively", "lucky", "mellow", "merry", "mighty", "misty", "nimble", "noble",
+		"odd", "plucky", "polite", "proud", "quick", "quiet", "rapid", "rosy", "rusty", "shiny",
+		"silent", "silly", "sleepy", "smooth", "snappy", "sunny", "swift", "tidy", "witty", "zesty",
+	}
+
+	defaultNouns = []string{
+		"badger", "beaver", "bison", "cactus", "comet", "coral", "cricket", "falcon", "ferret", "fox",
+		"gecko", "glacier", "heron", "island", "koala", "lagoon", "lemur", "lynx", "maple", "meadow",
+		"meteor", "moose", "narwhal", "nebula", "otter", "owl", "panda", "pebble", "pelican", "penguin",
+		"pine", "planet", "puffin", "quokka", "raven", "reef", "river", "salmon", "sparrow", "squid",
+		"tiger", "toucan", "tulip", "turtle", "valley", "walrus", "willow", "wombat", "yak", "zebra",
+	}
+)
+
+// nameGenerator generates names of the form <adjective>-<noun>-<number>
+type nameGenerator struct {
+	Adjectives []string `json:"adjectives"`
+	Nouns      []string `json:"nouns"`
+}
+
+// newNameGenerator returns a nameGenerator using the words in the JSON file at [path]
+// ({"adjectives": [...], "nouns": [...]}), or the default words if [path] is empty
+func newNameGenerator(path string) (*nameGenerator, error) {
+	if path == "" {
+		return &nameGenerator{Adjectives: defaultAdjectives, Nouns: defaultNouns}, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read tunnel words")
+	}
+
+	var gen nameGenerator
+	if err = json.Unmarshal(content, &gen); err != nil {
+		return nil, errors.Wrap(err, "failed to parse tunnel words")
+	}
+
+	if len(gen.Adjectives) == 0 || len(gen.Nouns) == 0 {
+		return nil, errors.New("tunnel words must list at least one adjective and one noun")
+	}
+
+	for _, word := range append(gen.Adjectives, gen.Nouns...) {
+		if !tunnelNamePattern.MatchString(word) {
+			return nil, errors.Errorf("invalid tunnel word %q: must be a valid DNS label", word)
+		}
+	}
+
+	return &gen, nil
+}
+
+// generate returns a new random name
+func (gen *nameGenerator) generate() string {
+	return fmt.Sprintf("%s-%s-%d", gen.Adjectives[randomInt(len(gen.Adjectives))],
+		gen.Nouns[randomInt(len(gen.Nouns))], 100+randomInt(900))
+}
+
+// randomInt returns a uniformly random integer in [0, n)
+func randomInt(n int) int {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		panic(err) // the system's source of randomness is broken
+	}
+	return int(i.Int64())
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"github.com/pkg/errors"
+	"net"
+	"strings"
+)
+
+// ----------
+// This file contains helpers to work with sets of IP networks (eg. CIDRs given in the config)
+// ----------
+
+// ipNetworks is a set of IP networks
+type ipNetworks []*net.IPNet
+
+// parseIPNetworks parses the given CIDRs (or bare IP addresses) into ipNetworks
+func parseIPNetworks(cidrs []string) (networks ipNetworks, err error) {
+	for _, cidr := range cidrs {
+		if cidr = strings.TrimSpace(cidr); !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+
+		var network *net.IPNet
+		if _, network, err = net.ParseCIDR(cidr); err != nil {
+			return nil, errors.Wrapf(err, "invalid network %q", cidr)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// contains returns true if [ip] belongs to any of the networks
+func (networks ipNetworks) contains(ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,21 @@
+package server
+
+import (
+	"github.com/gliderlabs/ssh"
+)
+
+// ----------
+// This file defines the Notifier interface which allows observing notifications sent to clients
+// ----------
+
+// Notifier receives every notification sent to a client (eg. to log them or forward them elsewhere).
+// It is invoked synchronously and must not block.
+type Notifier interface {
+	Notify(ctx ssh.Context, message string)
+}
+
+// NotifierFunc is an adapter to allow the use of ordinary functions as Notifier
+type NotifierFunc func(ctx ssh.Context, message string)
+
+// Notify calls fn(ctx, message)
+func (fn NotifierFunc) Notify(ctx ssh.Context, message string) { fn(ctx, message) }
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"github.com/gliderlabs/ssh"
+	"net/http"
+)
+
+// ----------
+// This file defines the functional options used to plug optional components into the Server
+// ----------
+
+// Option configures an optional component of the Server
+type Option func(srv *Server) error
+
+// WithAuthenticator sets the Authenticator used to authenticate clients. It takes precedence over Config.AuthorizedKeys.
+func WithAuthenticator(auth Authenticator) Option {
+	return func(srv *Server) error {
+		srv.authenticator = auth
+		return nil
+	}
+}
+
+// WithPortPolicy sets the PortPolicy which decides the ports clients can forward (defaults to DefaultPortPolicy)
+func WithPortPolicy(policy PortPolicy) Option {
+	return func(srv *Server) error {
+		srv.portPolicy = policy
+		return nil
+	}
+}
+
+// WithAuthorizer sets the Authorizer consulted for every forwarding request.
+// It takes precedence over Config.AuthorizationRules and Config.AuthorizationWebhook.
+func WithAuthorizer(authorizer Authorizer) Option {
+	return func(srv *Server) error {
+		srv.authorizer = authorizer
+		return nil
+	}
+}
+
+// WithBannerHandler sets the BannerHandler which decides the banner sent to clients before they authenticate.
+// It takes precedence over Config.BannerFile.
+func WithBannerHandler(handler BannerHandler) Option {
+	return func(srv *Server) error {
+		srv.banner = handler
+		return nil
+	}
+}
+
+// WithNotifier sets a Notifier which receives every notification sent to clients
+func WithNotifier(notifier Notifier) Option {
+	return func(srv *Server) error {
+		srv.notifier = notifier
+		return nil
+	}
+}
+
+// WithFallbackHandler sets the http.Handler serving requests to the HTTP edge for hostnames without a tunnel (or
+// denied ones), eg. a branded landing page. It takes precedence over Config.HoneypotAddr. The reason the request
+// wasn't routed to a tunnel ("unknown" or "denied") is passed in the X-Shhh-Honeypot-Reason header.
+func WithFallbackHandler(handler http.Handler) Option {
+	return func(srv *Server) error {
+		srv.fallback = handler
+		return nil
+	}
+}
+
+// WithEventHandler adds a function called with every TunnelEvent (eg. to keep a custom frontend's list of tunnels
+// up to date), along with any configured webhooks. It's called synchronously, so it mustn't block.
+func WithEventHandler(handler func(TunnelEvent)) Option {
+	return func(srv *Server) error {
+		srv.eventHandlers = append(srv.eventHandlers, handler)
+		return nil
+	}
+}
+
+// WithMiddleware adds Middleware applied to the traffic of tunnels, ahead of any loaded from Config.MiddlewarePlugins
+func WithMiddleware(middleware ...Middleware) Option {
+	return func(srv *Server) error {
+		srv.middleware = append(srv.middleware, middleware...)
+		return nil
+	}
+}
+
+// WithUsageSink sets the UsageSink usage records are exported to (see usage_export.go), every Config.UsageInterval.
+// It takes precedence over Config.UsageExport.
+func WithUsageSink(sink UsageSink) Option {
+	return func(srv *Server) error {
+		srv.usageSink = sink
+		return nil
+	}
+}
+
+// WithSSHOptions applies the given options to the underlying ssh.Server (eg. ssh.HostKeyFile)
+func WithSSHOptions(options ...ssh.Option) Option {
+	return func(srv *Server) error {
+		srv.sshOptions = append(srv.sshOptions, options...)
+		return nil
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"io"
+)
+
+// ----------
+// This file contains a pipelined alternative to io.Copy, used to forward traffic between connections and channels.
+// Reading the next chunk doesn't have to wait for the previous one to be written, which keeps several chunks
+// in flight on high-latency links (where each write to an ssh channel may wait for the client's window adjustment).
+// Between two kernel sockets on Linux, copying is left to the kernel instead (see spliceable).
+// ----------
+
+const (
+	// size of each chunk; matches the maximum packet size of channels opened by golang.org/x/crypto/ssh
+	pipelineChunkSize = 32 << 10
+
+	// maximum number of chunks read ahead of the writer
+	pipelineDepth = 4
+)
+
+// chunk is a buffer holding data read from the source, pending to be written
+type chunk struct {
+	buf []byte
+	n   int
+}
+
+// pipelinedCopy copies from [src] to [dst] until either EOF is reached on [src] or an error occurs, like io.Copy.
+// Reads happen on a separate goroutine, up to pipelineDepth chunks ahead of the writes. If writing fails,
+// the reading goroutine exits once its pending Read returns (ie. the caller should close [src]).
+func pipelinedCopy(dst io.Writer, src io.Reader) (written int64, err error) {
+	if spliceable(dst, src) {
+		return io.Copy(dst, src) // zero-copy, and there's nothing to pipeline
+	}
+
+	var free = make(chan []byte, pipelineDepth)  // buffers that have been written, and can be reused
+	var filled = make(chan chunk, pipelineDepth) // buffers that have been read, pending to be written
+	var stop = make(chan struct{})               // closed if writing fails
+	var readErr error
+
+	go func() {
+		defer close(filled)
+
+		var allocated int
+		for {
+			var buf []byte
+			select {
+			case buf = <-free:
+			default: // allocate buffers lazily, as most connections never have more than one chunk in flight
+				if allocated < pipelineDepth {
+					buf, allocated = make([]byte, pipelineChunkSize), allocated+1
+				} else {
+					select {
+					case buf = <-free:
+					case <-stop:
+						return
+					}
+				}
+			}
+
+			n, err := src.Read(buf)
+			if n > 0 {
+				filled <- chunk{buf: buf, n: n} // never blocks, as there are at most pipelineDepth buffers
+			}
+
+			if err != nil {
+				if err != io.EOF {
+					readErr = err
+				}
+				return
+			}
+		}
+	}()
+
+	for c := range filled {
+		n, err := dst.Write(c.buf[:c.n])
+		written += int64(n)
+		if err == nil && n < c.n {
+			err = io.ErrShortWrite
+		}
+
+		if err != nil {
+			close(stop)
+			return written, err
+		}
+		free <- c.buf
+	}
+
+	return written, readErr
+}
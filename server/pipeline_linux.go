@@ -0,0 +1,26 @@
+package server
+
+import (
+	"io"
+	"net"
+)
+
+// ----------
+// This file contains the zero-copy fast path of pipelinedCopy on Linux
+// ----------
+
+// spliceable reports whether copying from [src] to [dst] is better left to io.Copy: on Linux, a TCP connection
+// reading from another TCP (or a unix) socket uses splice(2), so the data never passes through user space.
+// Channels never qualify, as their traffic is framed and encrypted in user space by golang.org/x/crypto/ssh.
+func spliceable(dst io.Writer, src io.Reader) bool {
+	if _, ok := dst.(*net.TCPConn); !ok {
+		return false
+	}
+
+	switch src.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+
+	var accepted = make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var conn = <-accepted
+	if conn == nil {
+		tb.Fatal("failed to accept connection")
+	}
+	return dialed.(*net.TCPConn), conn.(*net.TCPConn)
+}
+
+func TestSpliceable(t *testing.T) {
+	var a, b = tcpPair(t)
+	defer a.Close()
+	defer b.Close()
+
+	for _, test := range []struct {
+		name string
+		dst  io.Writer
+		src  io.Reader
+		want bool
+	}{
+		{"tcp to tcp", a, b, true},
+		{"wrapped source", a, struct{ io.Reader }{b}, false},
+		{"buffer", &bytes.Buffer{}, b, false},
+	} {
+		if got := spliceable(test.dst, test.src); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// benchmarkSocketCopy benchmarks [copy] between two loopback TCP connections, from [wrap] of the source
+func benchmarkSocketCopy(b *testing.B, wrap func(*net.TCPConn) io.Reader) {
+	const size = 16 << 20
+	var data = make([]byte, 1<<20)
+
+	b.SetBytes(size)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		var srcW, srcR = tcpPair(b)
+		var dstW, dstR = tcpPair(b)
+		var drained = make(chan struct{})
+		go func() {
+			for written := 0; written < size; written += len(data) {
+				if _, err := srcW.Write(data); err != nil {
+					break
+				}
+			}
+			_ = srcW.Close()
+		}()
+		go func() {
+			_, _ = io.Copy(ioutil.Discard, dstR)
+			close(drained)
+		}()
+		b.StartTimer()
+
+		n, err := pipelinedCopy(dstW, wrap(srcR))
+		_ = dstW.Close()
+		<-drained
+		if err != nil || n != size {
+			b.Fatalf("copied %d bytes (err: %v)", n, err)
+		}
+
+		b.StopTimer()
+		_ = srcR.Close()
+		_ = dstR.Close()
+		b.StartTimer()
+	}
+}
+
+// BenchmarkSocketCopy compares copying between two sockets with splice(2) (see spliceable) to copying through the
+// buffers of pipelinedCopy, as it did before
+func BenchmarkSocketCopy(b *testing.B) {
+	b.Run("splice", func(b *testing.B) {
+		benchmarkSocketCopy(b, func(c *net.TCPConn) io.Reader { return c })
+	})
+	b.Run("buffers", func(b *testing.B) {
+		benchmarkSocketCopy(b, func(c *net.TCPConn) io.Reader { return struct{ io.Reader }{c} })
+	})
+}
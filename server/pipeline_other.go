@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"io"
+)
+
+// ----------
+// splice(2) is only available on Linux; elsewhere, pipelinedCopy always copies through its own buffers
+// ----------
+
+// spliceable always reports false
+func spliceable(_ io.Writer, _ io.Reader) bool { return false }
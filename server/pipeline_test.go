@@ -0,0 +1,94 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// delayed is a reader and writer whose every call takes [delay], as with a link where each write to an ssh channel
+// waits for the client's window adjustment, and each read for the next packet
+type delayed struct {
+	io.Reader // nil for a writer
+	io.Writer // nil for a reader
+	delay     time.Duration
+}
+
+func (d *delayed) Read(p []byte) (int, error) {
+	time.Sleep(d.delay)
+	return d.Reader.Read(p)
+}
+
+func (d *delayed) Write(p []byte) (int, error) {
+	time.Sleep(d.delay)
+	return d.Writer.Write(p)
+}
+
+// chunked hides the io.WriterTo / io.ReaderFrom of [r], and returns at most a chunk per Read, as channels do
+type chunked struct{ r io.Reader }
+
+func (c chunked) Read(p []byte) (int, error) {
+	if len(p) > pipelineChunkSize {
+		p = p[:pipelineChunkSize]
+	}
+	return c.r.Read(p)
+}
+
+func TestPipelinedCopy(t *testing.T) {
+	var data = make([]byte, 10*pipelineChunkSize+123)
+	_, _ = rand.Read(data)
+
+	var dst bytes.Buffer
+	n, err := pipelinedCopy(&dst, chunked{bytes.NewReader(data)})
+	if err != nil || n != int64(len(data)) || !bytes.Equal(dst.Bytes(), data) {
+		t.Fatalf("copied %d of %d bytes (err: %v), equal: %v", n, len(data), err, bytes.Equal(dst.Bytes(), data))
+	}
+}
+
+// failingWriter fails after accepting [n] bytes
+type failingWriter struct{ n int }
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		var n = w.n
+		w.n = 0
+		return n, io.ErrClosedPipe
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestPipelinedCopyWriteError(t *testing.T) {
+	var data = make([]byte, 10*pipelineChunkSize)
+	n, err := pipelinedCopy(&failingWriter{n: 3*pipelineChunkSize + 5}, chunked{bytes.NewReader(data)})
+	if err != io.ErrClosedPipe || n != 3*pipelineChunkSize+5 {
+		t.Fatalf("copied %d bytes (err: %v), want %d (and %v)", n, err, 3*pipelineChunkSize+5, io.ErrClosedPipe)
+	}
+}
+
+// benchmarkCopy benchmarks [copy] from a source to a destination which both take [latency] per call
+func benchmarkCopy(b *testing.B, latency time.Duration, copy func(io.Writer, io.Reader) (int64, error)) {
+	const size = 64 * pipelineChunkSize
+	var data = make([]byte, size)
+
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var src = &delayed{Reader: chunked{bytes.NewReader(data)}, delay: latency}
+		var dst = &delayed{Writer: ioutil.Discard, delay: latency}
+		if n, err := copy(dst, src); err != nil || n != size {
+			b.Fatalf("copied %d bytes (err: %v)", n, err)
+		}
+	}
+}
+
+func BenchmarkCopy(b *testing.B) {
+	for _, latency := range []time.Duration{0, time.Millisecond} {
+		b.Run("io.Copy/latency="+latency.String(), func(b *testing.B) { benchmarkCopy(b, latency, io.Copy) })
+		b.Run("pipelined/latency="+latency.String(), func(b *testing.B) { benchmarkCopy(b, latency, pipelinedCopy) })
+	}
+}
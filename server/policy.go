@@ -0,0 +1,25 @@
+package server
+
+import (
+	"github.com/gliderlabs/ssh"
+)
+
+// ----------
+// This file defines the PortPolicy interface which decides the ports clients are allowed to forward
+// ----------
+
+// PortPolicy decides whether a client may forward the given TCP port. Port 0 requests a random port.
+type PortPolicy interface {
+	AllowPort(ctx ssh.Context, port uint32) bool
+}
+
+// PortPolicyFunc is an adapter to allow the use of ordinary functions as PortPolicy
+type PortPolicyFunc func(ctx ssh.Context, port uint32) bool
+
+// AllowPort calls fn(ctx, port)
+func (fn PortPolicyFunc) AllowPort(ctx ssh.Context, port uint32) bool { return fn(ctx, port) }
+
+// DefaultPortPolicy allows random and unprivileged ports, except the well-known ssh / http(s) ports
+var DefaultPortPolicy PortPolicy = PortPolicyFunc(func(_ ssh.Context, port uint32) bool {
+	return allowTCPForwarding(port)
+})
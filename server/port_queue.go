@@ -0,0 +1,205 @@
+package server
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ----------
+// This file contains the wait-queue of contended ports: a client asking for a specific port that's taken can ask
+// (with --wait-for-port) to wait for it rather than fail. Its forwarding request succeeds right away, with a listener
+// that binds the port once it frees, in the order clients asked for it; meanwhile the client is told its position
+// in the queue.
+// ----------
+
+const (
+	// maximum number of clients waiting for a port
+	maxPortQueue = 16
+
+	// how often the client first in a port's queue tries to bind it
+	portQueueRetry = time.Second
+)
+
+// portQueues are the queues of clients waiting for ports, by port
+type portQueues struct {
+	mu     sync.Mutex
+	queues map[uint32][]*queuedListener
+}
+
+// newPortQueues returns new, empty portQueues
+func newPortQueues() *portQueues { return &portQueues{queues: make(map[uint32][]*queuedListener)} }
+
+// isAddrInUse returns true if [err] is the failure to bind an address that's taken
+func isAddrInUse(err error) bool { return errors.Is(err, syscall.EADDRINUSE) }
+
+// enqueue queues the client with [fingerprint] (notified with [notify]) for [port], and returns a listener at [addr]
+// which binds it with [listen] once it's the client's turn and the port is free (and not held for another key in
+// [holds])
+func (pq *portQueues) enqueue(port uint32, addr net.Addr, fingerprint string, holds *graceHolds, notify notifyFn,
+	listen func() (net.Listener, error)) (*queuedListener, error) {
+
+	var l = &queuedListener{queues: pq, port: port, addr: addr, fingerprint: fingerprint, holds: holds, notify: notify,
+		listen: listen, granted: make(chan struct{}), closed: make(chan struct{})}
+
+	pq.mu.Lock()
+	if len(pq.queues[port]) >= maxPortQueue {
+		pq.mu.Unlock()
+		return nil, errors.Errorf("port %d is taken, and %d clients are already waiting for it", port, maxPortQueue)
+	}
+	pq.queues[port] = append(pq.queues[port], l)
+	var position = len(pq.queues[port])
+	pq.mu.Unlock()
+
+	l.notifyPosition(position)
+	go l.wait()
+	return l, nil
+}
+
+// position returns the position of [l] in its port's queue (from 1), or 0 if it's not queued
+func (pq *portQueues) position(l *queuedListener) int {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	for i, queued := range pq.queues[l.port] {
+		if queued == l {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// leave removes [l] from its port's queue, and tells the clients behind it their new positions
+func (pq *portQueues) leave(l *queuedListener) {
+	pq.mu.Lock()
+	var queue, behind, left = pq.queues[l.port], []*queuedListener(nil), 0
+	for i, queued := range queue {
+		if queued == l {
+			queue = append(queue[:i:i], queue[i+1:]...)
+			behind, left = queue[i:], i
+			break
+		}
+	}
+	if len(queue) == 0 {
+		delete(pq.queues, l.port)
+	} else {
+		pq.queues[l.port] = queue
+	}
+	pq.mu.Unlock()
+
+	for i, queued := range behind {
+		queued.notifyPosition(left + i + 1)
+	}
+}
+
+// queuedListener is a net.Listener for a port a client is waiting for. Accept blocks until the port is bound.
+type queuedListener struct {
+	queues      *portQueues
+	port        uint32
+	addr        net.Addr
+	fingerprint string
+	holds       *graceHolds
+	notify      notifyFn
+	listen      func() (net.Listener, error)
+
+	granted chan struct{} // closed once the port is bound
+	closed  chan struct{} // closed once the listener is closed
+	once    sync.Once
+
+	mu        sync.Mutex
+	ln        net.Listener // once the port is bound
+	onGranted func()
+}
+
+// wait tries to bind the port whenever it's the client's turn, until it does or the listener is closed
+func (l *queuedListener) wait() {
+	var ticker = time.NewTicker(portQueueRetry)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.closed:
+			return
+		case <-ticker.C:
+		}
+
+		if l.queues.position(l) != 1 {
+			continue
+		}
+		if holder := l.holds.PortHolder(l.port); holder != "" && holder != l.fingerprint {
+			continue
+		}
+
+		ln, err := l.listen()
+		if err != nil {
+			continue
+		}
+
+		l.mu.Lock()
+		select {
+		case <-l.closed:
+			l.mu.Unlock()
+			_ = ln.Close()
+			return
+		default:
+		}
+		l.ln = ln
+		close(l.granted)
+		var granted = l.onGranted
+		l.mu.Unlock()
+
+		l.queues.leave(l)
+		if granted != nil {
+			granted()
+		}
+		return
+	}
+}
+
+// whenGranted sets [fn] to be called once the port is bound (right away if it already is)
+func (l *queuedListener) whenGranted(fn func()) {
+	l.mu.Lock()
+	if l.ln == nil {
+		l.onGranted = fn
+		l.mu.Unlock()
+		return
+	}
+	l.mu.Unlock()
+	fn()
+}
+
+// notifyPosition tells the client it's at [position] in the port's queue
+func (l *queuedListener) notifyPosition(position int) {
+	l.notify(fmt.Sprintf("port %d is taken; waiting for it to free up (position %d in queue)", l.port, position),
+		kv("type", "port.queued"), kv("port", l.port), kv("position", position))
+}
+
+func (l *queuedListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.granted:
+		return l.ln.Accept()
+	case <-l.closed:
+		return nil, &net.OpError{Op: "accept", Net: l.addr.Network(), Addr: l.addr, Err: errors.New("listener closed")}
+	}
+}
+
+func (l *queuedListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		l.mu.Lock()
+		close(l.closed)
+		var ln = l.ln
+		l.mu.Unlock()
+
+		if ln == nil {
+			l.queues.leave(l)
+			return
+		}
+		err = ln.Close()
+	})
+	return err
+}
+
+func (l *queuedListener) Addr() net.Addr { return l.addr }
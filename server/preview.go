@@ -0,0 +1,191 @@
+package server
+
+import (
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains the public preview of a client's tunnels: for a limited time, its own ACL (--allow-source /
+// --deny-source) is lifted so that anyone can connect (eg. to quickly show something to a colleague), after which
+// the tunnels are private again. Visitors denied by the operator are never let in.
+// ----------
+
+// longest a preview can last, so that tunnels aren't left public by accident
+const maxPreviewDuration = 24 * time.Hour
+
+// time left in a preview at which the client is reminded that its tunnels are about to turn private again
+var previewReminders = []time.Duration{10 * time.Minute, 5 * time.Minute, time.Minute, 10 * time.Second}
+
+// publicPreview tracks whether (and until when) a client's tunnels are public
+type publicPreview struct {
+	mu    sync.Mutex
+	until time.Time     // zero if the tunnels are private
+	stop  chan struct{} // closed to stop the countdown of the current preview
+}
+
+// active returns true if the tunnels are public right now
+func (p *publicPreview) active() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return time.Now().Before(p.until)
+}
+
+// start makes the tunnels public for [d] (replacing any preview in progress), and counts down to their re-lock
+// by sending reminders using [notify]
+func (p *publicPreview) start(d time.Duration, notify notifyFn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stop != nil {
+		close(p.stop)
+	}
+	p.until, p.stop = time.Now().Add(d), make(chan struct{})
+	go p.countdown(p.until, p.stop, notify)
+}
+
+// end makes the tunnels private right away. It returns false if they weren't public.
+func (p *publicPreview) end() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stop == nil {
+		return false
+	}
+	close(p.stop)
+	p.until, p.stop = time.Time{}, nil
+	return true
+}
+
+// countdown sends a reminder before each of previewReminders, and a message once the preview ends at [until]
+// (unless [stop] is closed before that)
+func (p *publicPreview) countdown(until time.Time, stop chan struct{}, notify notifyFn) {
+	for _, left := range previewReminders {
+		var wait = time.Until(until.Add(-left))
+		if wait <= 0 {
+			continue
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+			notify(fmt.Sprintf("preview: tunnels go private again in %s", left),
+				kv("type", "preview.countdown"), kv("remaining_seconds", int64(left.Seconds())))
+		}
+	}
+
+	select {
+	case <-stop:
+		return
+	case <-time.After(time.Until(until)):
+	}
+
+	p.mu.Lock()
+	if p.stop == stop {
+		p.until, p.stop = time.Time{}, nil
+	}
+	p.mu.Unlock()
+	notify("preview: ended; tunnels are private again", kv("type", "preview.ended"))
+}
+
+// previewTarget is a connection whose tunnels are made public by the preview commands
+type previewTarget struct {
+	options *sessionOptions
+	notify  notifyFn
+}
+
+// previewTargets returns the connections whose tunnels the caller (identified by [ctx]) can make public: the
+// caller's own connection, and every other connection authenticated with the same key (eg. when the command is
+// run from another terminal)
+func previewTargets(srv *Server, ctx ssh.Context) []previewTarget {
+	var caller = Fingerprint(ctx)
+	var own, _ = connectionFromContext(ctx)
+
+	var seen = make(map[*sessionOptions]bool)
+	var targets []previewTarget
+	for _, tunnel := range srv.tunnels.list() {
+		if own == nil || tunnel.options != own.options {
+			if caller == "" || tunnel.fingerprint != caller {
+				continue
+			}
+		}
+
+		if !seen[tunnel.options] {
+			seen[tunnel.options] = true
+			targets = append(targets, previewTarget{options: tunnel.options, notify: tunnel.notify})
+		}
+	}
+	return targets
+}
+
+// publicCommand returns a command which makes the caller's tunnels public for a while, lifting their
+// --allow-source / --deny-source. They're made private again once the duration has passed.
+//
+// Usage: public <duration>
+func publicCommand(srv *Server) command {
+	return func(ctx ssh.Context, args []string, out io.Writer) error {
+		if len(args) != 1 {
+			return errors.New("usage: public <duration> (eg. public 10m)")
+		}
+
+		d, err := time.ParseDuration(args[0])
+		if err != nil || d <= 0 || d > maxPreviewDuration {
+			return errors.Errorf("invalid duration %q: must be between 1s and %s (eg. 10m)", args[0], maxPreviewDuration)
+		}
+
+		var targets = previewTargets(srv, ctx)
+		if len(targets) == 0 {
+			return errors.New("you have no open tunnels")
+		}
+
+		var private = 0
+		for _, target := range targets {
+			if target.options.Sources().restricts() {
+				private++
+			}
+		}
+		if private == 0 {
+			return errors.New("your tunnels are already public; restrict them with --allow-source / --deny-source first")
+		}
+
+		for _, target := range targets {
+			target.options.preview.start(d, target.notify)
+			target.notify(fmt.Sprintf("preview: tunnels are public for %s, until %s", d, time.Now().Add(d).Format("15:04:05")),
+				kv("type", "preview.started"), kv("duration_seconds", int64(d.Seconds())))
+		}
+
+		_, _ = io.WriteString(out, fmt.Sprintf("tunnels are public for %s\n", d))
+		return nil
+	}
+}
+
+// privateCommand returns a command which ends the preview of the caller's tunnels right away
+//
+// Usage: private
+func privateCommand(srv *Server) command {
+	return func(ctx ssh.Context, args []string, out io.Writer) error {
+		if len(args) != 0 {
+			return errors.New("usage: private")
+		}
+
+		var ended = false
+		for _, target := range previewTargets(srv, ctx) {
+			if target.options.preview.end() {
+				ended = true
+				target.notify("preview: ended; tunnels are private again", kv("type", "preview.ended"))
+			}
+		}
+
+		if !ended {
+			return errors.New("your tunnels aren't public")
+		}
+
+		_, _ = io.WriteString(out, "tunnels are private again\n")
+		return nil
+	}
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"github.com/pkg/errors"
+	"sort"
+	"time"
+)
+
+// ----------
+// This file defines the built-in configuration profiles, which bundle sensible defaults for common deployment shapes
+// ----------
+
+// profiles maps the name of each built-in profile to a function which applies it on top of DefaultConfig
+var profiles = map[string]func(config *Config){
+	// a single user exposing their own services; lenient limits and no authentication requirements
+	"personal": func(config *Config) {
+		config.IdleTimeout = 10 * time.Minute
+		config.DrainTimeout = 5 * time.Second
+		config.HTTPAddr = ":8080"
+	},
+
+	// a team sharing a server; every member must be authenticated, and idle clients are let go of
+	"team": func(config *Config) {
+		config.RequireAuthentication = true
+		config.ForwardTimeout = 1 * time.Minute
+		config.IdleTimeout = 5 * time.Minute
+		config.ReconnectGrace = 2 * time.Minute
+		config.HTTPAddr = ":80"
+	},
+
+	// a service open to the public; strict limits, and well-known names are kept from being impersonated
+	"public-service": func(config *Config) {
+		config.RequireAuthentication = true
+		config.ForwardTimeout = 30 * time.Second
+		config.IdleTimeout = 1 * time.Minute
+		config.DrainTimeout = 1 * time.Minute
+		config.ReconnectGrace = 2 * time.Minute
+		config.SSHRateLimit = 30
+		config.MaxAuthFailures = 20
+		config.MaxStartups = "10:30:100"
+		config.HTTPAddr = ":80"
+		config.DeniedHosts = []string{"www", "api", "admin*", "mail", "smtp", "ftp", "ns[0-9]", "status", "login*", "secure*"}
+	},
+}
+
+// Profile returns a new Config populated with the defaults of the built-in profile with the given [name]
+func Profile(name string) (*Config, error) {
+	apply, ok := profiles[name]
+	if !ok {
+		return nil, errors.Errorf("unknown profile %q (available: %v)", name, Profiles())
+	}
+
+	var config = DefaultConfig()
+	config.Profile = name
+	apply(config)
+	return config, nil
+}
+
+// Profiles returns the names of the built-in profiles
+func Profiles() []string {
+	var names = make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
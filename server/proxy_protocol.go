@@ -0,0 +1,275 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains helpers to generate and parse PROXY protocol headers (see https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt)
+// Headers are prepended to forwarded channels so that the client's local service can learn the real source of the connection,
+// and parsed on incoming connections when shhh runs behind an L4 load balancer.
+// ----------
+
+const (
+	// PROXY protocol version 1 (human-readable header)
+	proxyProtocolV1 = "v1"
+
+	// PROXY protocol version 2 (binary header)
+	proxyProtocolV2 = "v2"
+)
+
+// signature that every PROXY protocol v2 header starts with
+var proxyProtocolV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// isValidProxyProtocolVersion returns true if [version] is a supported PROXY protocol version (or empty, meaning disabled)
+func isValidProxyProtocolVersion(version string) bool {
+	return version == "" || version == proxyProtocolV1 || version == proxyProtocolV2
+}
+
+// writeProxyHeader writes a PROXY protocol header of the given [version] to [w] describing a connection
+// from [src] to [dst]. It is a no-op if [version] is empty.
+func writeProxyHeader(w io.Writer, version string, src, dst net.Addr) (err error) {
+	var header []byte
+	switch version {
+	case "":
+		return nil
+	case proxyProtocolV1:
+		header = proxyHeaderV1(src, dst)
+	case proxyProtocolV2:
+		header = proxyHeaderV2(src, dst)
+	default:
+		return errors.Errorf("unsupported PROXY protocol version %q", version)
+	}
+
+	_, err = w.Write(header)
+	return errors.Wrap(err, "failed to write PROXY protocol header")
+}
+
+// proxyHeaderV1 returns a version 1 (text) PROXY protocol header
+func proxyHeaderV1(src, dst net.Addr) []byte {
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	if !sok || !dok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	var proto = "TCP6"
+	if s.IP.To4() != nil && d.IP.To4() != nil {
+		proto = "TCP4"
+	}
+
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, s.IP.String(), d.IP.String(), s.Port, d.Port))
+}
+
+// proxyHeaderV2 returns a version 2 (binary) PROXY protocol header
+func proxyHeaderV2(src, dst net.Addr) []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyProtocolV2Signature)
+
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	if !sok || !dok {
+		// LOCAL command with UNSPEC family; receiver must use real connection endpoints
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+
+	var srcIP, dstIP = s.IP.To4(), d.IP.To4()
+	var family byte = 0x11 // TCP over IPv4
+	if srcIP == nil || dstIP == nil {
+		srcIP, dstIP = s.IP.To16(), d.IP.To16()
+		family = 0x21 // TCP over IPv6
+	}
+
+	buf.WriteByte(0x21) // version 2, PROXY command
+	buf.WriteByte(family)
+	_ = binary.Write(&buf, binary.BigEndian, uint16(2*len(srcIP)+4))
+	buf.Write(srcIP)
+	buf.Write(dstIP)
+	_ = binary.Write(&buf, binary.BigEndian, uint16(s.Port))
+	_ = binary.Write(&buf, binary.BigEndian, uint16(d.Port))
+
+	return buf.Bytes()
+}
+
+// maximum length of a PROXY protocol v1 header line (including CRLF)
+const proxyProtocolV1MaxLength = 107
+
+// maximum length of what follows a PROXY protocol v2 header's first 16 bytes: the addresses, and TLVs (which are
+// ignored) of up to a few KB, as sent by load balancers
+const proxyProtocolV2MaxLength = 4096
+
+// time allowed for the peer to send the PROXY protocol header after connecting
+const proxyProtocolHeaderTimeout = 5 * time.Second
+
+// readProxyHeader reads and parses a PROXY protocol (v1 or v2) header from [r]. It returns the source and
+// destination addresses conveyed in the header, or nil addresses if the header doesn't carry any (eg. LOCAL command)
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	if sig, _ := r.Peek(len(proxyProtocolV2Signature)); bytes.Equal(sig, proxyProtocolV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+
+	if prefix, _ := r.Peek(6); string(prefix) == "PROXY " {
+		return readProxyHeaderV1(r)
+	}
+
+	return nil, nil, errors.New("missing PROXY protocol header")
+}
+
+// readProxyHeaderV1 reads and parses a version 1 (text) PROXY protocol header
+func readProxyHeaderV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for len(line) < proxyProtocolV1MaxLength {
+		var b byte
+		if b, err = r.ReadByte(); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to read PROXY protocol header")
+		}
+		if line = append(line, b); bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("PROXY protocol header too long")
+	}
+
+	var fields = strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errors.Errorf("malformed PROXY protocol header %q", string(line))
+	}
+
+	var srcIP, dstIP = net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, srcErr := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, dstErr := strconv.ParseUint(fields[5], 10, 16)
+	var v6 = fields[1] == "TCP6" // addresses must be of the family given
+	if srcIP == nil || dstIP == nil || srcErr != nil || dstErr != nil ||
+		strings.Contains(fields[2], ":") != v6 || strings.Contains(fields[3], ":") != v6 {
+		return nil, nil, errors.Errorf("malformed PROXY protocol header %q", string(line))
+	}
+
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+// readProxyHeaderV2 reads and parses a version 2 (binary) PROXY protocol header
+func readProxyHeaderV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var header [16]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read PROXY protocol header")
+	}
+
+	if header[12]>>4 != 0x2 {
+		return nil, nil, errors.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+
+	var command = header[12] & 0x0F
+	if command > 0x1 {
+		return nil, nil, errors.Errorf("unsupported PROXY protocol command %d", command)
+	}
+
+	var length = binary.BigEndian.Uint16(header[14:16])
+	if length > proxyProtocolV2MaxLength {
+		return nil, nil, errors.Errorf("PROXY protocol header too long (%d bytes)", length)
+	}
+
+	var payload = make([]byte, length)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read PROXY protocol header")
+	}
+
+	if command == 0x0 { // LOCAL command; use real connection endpoints
+		return nil, nil, nil
+	}
+
+	var size int
+	switch header[13] >> 4 {
+	case 0x1: // AF_INET
+		size = net.IPv4len
+	case 0x2: // AF_INET6
+		size = net.IPv6len
+	default: // AF_UNSPEC / AF_UNIX; nothing useful for us
+		return nil, nil, nil
+	}
+
+	if len(payload) < 2*size+4 {
+		return nil, nil, errors.New("malformed PROXY protocol header")
+	}
+
+	var srcIP, dstIP = net.IP(payload[:size]), net.IP(payload[size : 2*size])
+	var srcPort = binary.BigEndian.Uint16(payload[2*size:])
+	var dstPort = binary.BigEndian.Uint16(payload[2*size+2:])
+
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+// proxyProtocolListener is a net.Listener which expects a PROXY protocol header on every accepted connection
+type proxyProtocolListener struct{ net.Listener }
+
+// Accept waits for and returns the next connection to the listener. The PROXY protocol header is parsed
+// lazily on first use of the connection, so that a slow peer doesn't block the accept loop.
+func (ln *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtocolConn is a net.Conn which reports the source and destination addresses read from the PROXY protocol header
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once     sync.Once
+	src, dst net.Addr
+	err      error
+}
+
+// init reads the PROXY protocol header (exactly once)
+func (conn *proxyProtocolConn) init() {
+	conn.once.Do(func() {
+		_ = conn.Conn.SetReadDeadline(time.Now().Add(proxyProtocolHeaderTimeout))
+		defer func() { _ = conn.Conn.SetReadDeadline(time.Time{}) }()
+		conn.src, conn.dst, conn.err = readProxyHeader(conn.reader)
+	})
+}
+
+// Err returns the error encountered while reading the PROXY protocol header (if any)
+func (conn *proxyProtocolConn) Err() error {
+	conn.init()
+	return conn.err
+}
+
+func (conn *proxyProtocolConn) Read(b []byte) (int, error) {
+	if conn.init(); conn.err != nil {
+		return 0, conn.err
+	}
+	return conn.reader.Read(b)
+}
+
+func (conn *proxyProtocolConn) RemoteAddr() net.Addr {
+	if conn.init(); conn.src != nil {
+		return conn.src
+	}
+	return conn.Conn.RemoteAddr()
+}
+
+func (conn *proxyProtocolConn) LocalAddr() net.Addr {
+	if conn.init(); conn.dst != nil {
+		return conn.dst
+	}
+	return conn.Conn.LocalAddr()
+}
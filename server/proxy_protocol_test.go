@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyV2 returns a v2 header with [command] (the version and command byte), [family] and [payload]
+func proxyV2(command, family byte, payload []byte) []byte {
+	var header = append(append([]byte{}, proxyProtocolV2Signature...), command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	var v4 = func(ip string, port int) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip).To4(), Port: port} }
+	var v6 = func(ip string, port int) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: port} }
+	var addresses = proxyHeaderV2(v4("192.0.2.1", 40000), v4("198.51.100.1", 443))[16:]
+
+	var tests = []struct {
+		name     string
+		input    string
+		src, dst net.Addr // nil if the header carries no addresses
+		err      string   // expected error, if any
+	}{
+		// version 1
+		{"v1 TCP4", "PROXY TCP4 192.0.2.1 198.51.100.1 40000 443\r\n", v4("192.0.2.1", 40000), v4("198.51.100.1", 443), ""},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::1 2001:db8::2 40000 443\r\n", v6("2001:db8::1", 40000), v6("2001:db8::2", 443), ""},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", nil, nil, ""},
+		{"v1 UNKNOWN with addresses", "PROXY UNKNOWN 192.0.2.1 198.51.100.1 40000 443\r\n", nil, nil, ""},
+		{"v1 without CRLF", "PROXY TCP4 192.0.2.1 198.51.100.1 40000 443", nil, nil, "failed to read"},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", nil, nil, "too long"},
+		{"v1 missing port", "PROXY TCP4 192.0.2.1 198.51.100.1 40000\r\n", nil, nil, "malformed"},
+		{"v1 unknown protocol", "PROXY UDP4 192.0.2.1 198.51.100.1 40000 443\r\n", nil, nil, "malformed"},
+		{"v1 bad address", "PROXY TCP4 192.0.2 198.51.100.1 40000 443\r\n", nil, nil, "malformed"},
+		{"v1 port out of range", "PROXY TCP4 192.0.2.1 198.51.100.1 40000 65536\r\n", nil, nil, "malformed"},
+		{"v1 TCP4 with IPv6", "PROXY TCP4 2001:db8::1 198.51.100.1 40000 443\r\n", nil, nil, "malformed"},
+		{"v1 TCP6 with IPv4", "PROXY TCP6 192.0.2.1 198.51.100.1 40000 443\r\n", nil, nil, "malformed"},
+
+		// version 2
+		{"v2 TCP4", string(proxyV2(0x21, 0x11, addresses)), v4("192.0.2.1", 40000), v4("198.51.100.1", 443), ""},
+		{"v2 TCP6", string(proxyHeaderV2(v6("2001:db8::1", 40000), v6("2001:db8::2", 443))), v6("2001:db8::1", 40000), v6("2001:db8::2", 443), ""},
+		{"v2 with TLVs", string(proxyV2(0x21, 0x11, append(addresses, 0x04, 0x00, 0x02, 'h', 'i'))), v4("192.0.2.1", 40000), v4("198.51.100.1", 443), ""},
+		{"v2 LOCAL", string(proxyV2(0x20, 0x00, nil)), nil, nil, ""},
+		{"v2 LOCAL with addresses", string(proxyV2(0x20, 0x11, addresses)), nil, nil, ""},
+		{"v2 UNSPEC", string(proxyV2(0x21, 0x00, nil)), nil, nil, ""},
+		{"v2 UNIX", string(proxyV2(0x21, 0x31, make([]byte, 216))), nil, nil, ""},
+		{"v2 truncated header", string(proxyV2(0x21, 0x11, addresses)[:14]), nil, nil, "failed to read"},
+		{"v2 truncated addresses", string(proxyV2(0x21, 0x11, addresses)[:20]), nil, nil, "failed to read"},
+		{"v2 addresses too short", string(proxyV2(0x21, 0x21, addresses)), nil, nil, "malformed"},
+		{"v2 oversized", string(proxyV2(0x21, 0x11, make([]byte, proxyProtocolV2MaxLength+1))), nil, nil, "too long"},
+		{"v2 largest length", string(proxyV2(0x21, 0x11, nil)[:14]) + "\xff\xff", nil, nil, "too long"},
+		{"v2 unknown version", string(proxyV2(0x11, 0x11, addresses)), nil, nil, "unsupported PROXY protocol version"},
+		{"v2 unknown command", string(proxyV2(0x22, 0x11, addresses)), nil, nil, "unsupported PROXY protocol command"},
+
+		// anything else
+		{"empty", "", nil, nil, "missing PROXY protocol header"},
+		{"ssh", "SSH-2.0-OpenSSH_9.6\r\n", nil, nil, "missing PROXY protocol header"},
+		{"http", "GET / HTTP/1.1\r\n\r\n", nil, nil, "missing PROXY protocol header"},
+		{"lower case", "proxy TCP4 192.0.2.1 198.51.100.1 40000 443\r\n", nil, nil, "missing PROXY protocol header"},
+		{"partial v2 signature", string(proxyProtocolV2Signature[:8]), nil, nil, "missing PROXY protocol header"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var input = test.input
+			if test.err == "" {
+				input += "SSH-2.0-client\r\n" // the connection goes on after a valid header
+			}
+			var r = bufio.NewReader(strings.NewReader(input))
+			src, dst, err := readProxyHeader(r)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if (src == nil) != (test.src == nil) || (src != nil && src.String() != test.src.String()) ||
+				(dst == nil) != (test.dst == nil) || (dst != nil && dst.String() != test.dst.String()) {
+				t.Fatalf("got %v -> %v, want %v -> %v", src, dst, test.src, test.dst)
+			}
+
+			// what follows the header is left to be read
+			if rest, _ := ioutil.ReadAll(r); string(rest) != "SSH-2.0-client\r\n" {
+				t.Fatalf("got %q following the header", rest)
+			}
+		})
+	}
+}
+
+// headers written are read back as they were
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	var pairs = [][2]net.Addr{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}},
+		{&net.UnixAddr{Name: "/tmp/a", Net: "unix"}, &net.UnixAddr{Name: "/tmp/b", Net: "unix"}}, // carried as UNKNOWN / LOCAL
+	}
+	for _, version := range []string{proxyProtocolV1, proxyProtocolV2} {
+		for _, pair := range pairs {
+			var buf bytes.Buffer
+			if err := writeProxyHeader(&buf, version, pair[0], pair[1]); err != nil {
+				t.Fatal(err)
+			}
+
+			src, dst, err := readProxyHeader(bufio.NewReader(&buf))
+			if err != nil {
+				t.Fatalf("%s, %v -> %v: %v", version, pair[0], pair[1], err)
+			}
+			if _, ok := pair[0].(*net.TCPAddr); !ok {
+				if src != nil || dst != nil {
+					t.Errorf("%s: got %v -> %v, want no addresses", version, src, dst)
+				}
+				continue
+			}
+			if src.String() != pair[0].String() || dst.String() != pair[1].String() {
+				t.Errorf("%s: got %v -> %v, want %v -> %v", version, src, dst, pair[0], pair[1])
+			}
+		}
+	}
+
+	if err := writeProxyHeader(ioutil.Discard, "v3", nil, nil); err == nil {
+		t.Error("no error writing an unsupported version")
+	}
+}
+
+// connections without a valid header can't be read from, and report the addresses they were accepted with
+func TestProxyProtocolConn(t *testing.T) {
+	var client, server = net.Pipe()
+	defer client.Close()
+	go func() { _, _ = client.Write([]byte("GET / HTTP/1.1\r\n\r\n")) }()
+
+	var conn = &proxyProtocolConn{Conn: server, reader: bufio.NewReader(server)}
+	if _, err := conn.Read(make([]byte, 16)); err == nil || conn.Err() == nil {
+		t.Fatal("connection without a PROXY protocol header was read from")
+	}
+	if conn.RemoteAddr() != server.RemoteAddr() || conn.LocalAddr() != server.LocalAddr() {
+		t.Fatalf("got %v -> %v, want the connection's own addresses", conn.RemoteAddr(), conn.LocalAddr())
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"sync"
+)
+
+// ----------
+// This file contains the quarantine of suspicious tunnels: while quarantined, a tunnel's traffic is paused, new
+// visitors are turned away (HTTP visitors see a hold page), until an admin releases or terminates it
+// ----------
+
+// errQuarantined is returned when opening a channel to the client of a quarantined tunnel
+var errQuarantined = errors.New("tunnel is quarantined")
+
+// quarantine tracks whether a tunnel is quarantined, and pauses its traffic while it is
+type quarantine struct {
+	mu     sync.Mutex
+	cond   *sync.Cond // signalled when the tunnel is released or closed
+	held   bool
+	reason string
+	closed bool
+}
+
+// newQuarantine returns a new quarantine for a tunnel, which isn't held
+func newQuarantine() *quarantine {
+	var q = &quarantine{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Hold quarantines the tunnel for [reason]. It returns false if it's already quarantined.
+func (q *quarantine) Hold(reason string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.held || q.closed {
+		return false
+	}
+	q.held, q.reason = true, reason
+	return true
+}
+
+// Release lets the tunnel's traffic flow again. It returns false if it isn't quarantined.
+func (q *quarantine) Release() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.held {
+		return false
+	}
+	q.held, q.reason = false, ""
+	q.cond.Broadcast()
+	return true
+}
+
+// Close wakes up any paused traffic, which then fails; called once the tunnel is closed
+func (q *quarantine) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// Held returns true (along with why) if the tunnel is quarantined
+func (q *quarantine) Held() (bool, string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.held, q.reason
+}
+
+// wait blocks while the tunnel is quarantined, or until [channel] is closed. It returns an error if either
+// the tunnel or [channel] was closed meanwhile.
+func (q *quarantine) wait(channel *quarantinedChannel) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.held && !q.closed && !channel.closed {
+		q.cond.Wait()
+	}
+
+	if q.held && (q.closed || channel.closed) {
+		return errQuarantined
+	}
+	return nil
+}
+
+// gate wraps [newChannel] so that no channels are opened while the tunnel is quarantined, and the traffic through
+// channels it opens is paused while it is
+func (q *quarantine) gate(newChannel newChannelFn) newChannelFn {
+	return func(host, port string) (gossh.Channel, <-chan *gossh.Request, error) {
+		if held, _ := q.Held(); held {
+			return nil, nil, errQuarantined
+		}
+
+		channel, requests, err := newChannel(host, port)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &quarantinedChannel{Channel: channel, q: q}, requests, nil
+	}
+}
+
+// quarantinedChannel is a gossh.Channel whose traffic is paused while its tunnel is quarantined
+type quarantinedChannel struct {
+	gossh.Channel
+	q      *quarantine
+	closed bool // guarded by q.mu
+}
+
+func (c *quarantinedChannel) Read(b []byte) (n int, err error) {
+	if n, err = c.Channel.Read(b); n > 0 {
+		if qerr := c.q.wait(c); qerr != nil {
+			return 0, qerr
+		}
+	}
+	return n, err
+}
+
+func (c *quarantinedChannel) Write(b []byte) (int, error) {
+	if err := c.q.wait(c); err != nil {
+		return 0, err
+	}
+	return c.Channel.Write(b)
+}
+
+// Close closes the channel, failing its paused traffic (if any)
+func (c *quarantinedChannel) Close() error {
+	c.q.mu.Lock()
+	c.closed = true
+	c.q.cond.Broadcast()
+	c.q.mu.Unlock()
+	return c.Channel.Close()
+}
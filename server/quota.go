@@ -0,0 +1,630 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ----------
+// This file contains the quotas which limit what each key (by fingerprint) can use of the server. Transfer caps
+// (per day and per month, UTC) are enforced as configured once exceeded: the key's tunnels are suspended (their
+// connections closed, and new ones refused) or throttled, until the cap resets. Clients are notified as they near a
+// cap, and once they exceed it. The bytes each key transferred are persisted (if Config.UsageFile is set), and handed
+// over to the new instance on a graceful restart, so that caps hold across restarts.
+// ----------
+
+// what happens to the traffic of a key once it exceeds a transfer cap (see Quota.OverCap)
+const (
+	OverCapSuspend  = "suspend"
+	OverCapThrottle = "throttle"
+)
+
+const (
+	// bandwidth (in bytes per second) of keys throttled for exceeding a transfer cap, unless configured
+	defaultOverCapRate = 64 * 1024
+
+	// fraction of a transfer cap after which clients are warned they're nearing it
+	capWarningThreshold = 0.8
+
+	// how often usage is persisted to Config.UsageFile (it's persisted on shutdown as well)
+	usageSaveInterval = time.Minute
+)
+
+// Quota limits the resources used by a key. Zero values mean unlimited.
+type Quota struct {
+	// maximum number of tunnels open at the same time
+	MaxTunnels int `json:"max_tunnels,omitempty"`
+
+	// maximum number of public connections served at the same time, across all tunnels
+	MaxConnections int `json:"max_connections,omitempty"`
+
+	// maximum bytes transferred (in both directions) per day / month (UTC)
+	MaxBytesPerDay   int64 `json:"max_bytes_per_day,omitempty"`
+	MaxBytesPerMonth int64 `json:"max_bytes_per_month,omitempty"`
+
+	// what happens once a transfer cap is exceeded: suspend (the default) or throttle, to OverCapRate bytes per
+	// second (64 KiB if unset)
+	OverCap     string `json:"over_cap,omitempty"`
+	OverCapRate int64  `json:"over_cap_rate,omitempty"`
+}
+
+// isZero returns true if the quota doesn't limit anything
+func (quota Quota) isZero() bool {
+	return quota.MaxTunnels == 0 && quota.MaxConnections == 0 && quota.MaxBytesPerDay == 0 && quota.MaxBytesPerMonth == 0
+}
+
+// throttles returns true if traffic is throttled, rather than suspended, once a transfer cap is exceeded
+func (quota Quota) throttles() bool { return quota.OverCap == OverCapThrottle }
+
+// validate returns an error if the quota is invalid
+func (quota Quota) validate() error {
+	if quota.OverCap != "" && quota.OverCap != OverCapSuspend && quota.OverCap != OverCapThrottle {
+		return errors.Errorf("invalid over_cap %q: must be %s or %s", quota.OverCap, OverCapSuspend, OverCapThrottle)
+	}
+	if quota.OverCapRate < 0 {
+		return errors.Errorf("invalid over_cap_rate %d: must be positive", quota.OverCapRate)
+	}
+	return nil
+}
+
+// validateQuotas returns an error if Config.Quota, or any of Config.Quotas, is invalid
+func (config *Config) validateQuotas() error {
+	if err := config.Quota.validate(); err != nil {
+		return errors.Wrap(err, "invalid quota")
+	}
+	for fingerprint, quota := range config.Quotas {
+		if err := quota.validate(); err != nil {
+			return errors.Wrapf(err, "invalid quota of %s", fingerprint)
+		}
+	}
+	return nil
+}
+
+// usage tracks the resources currently used by a key
+type usage struct {
+	tunnels     int
+	connections int
+	bytes       int64
+	day         string // day (UTC) bytes are counted for
+	monthBytes  int64
+	month       string // month (UTC) monthBytes are counted for
+
+	// transfer caps the client's been notified of nearing (capWarned) or exceeding (capExceeded), for the current
+	// day / month
+	capWarned, capExceeded map[string]bool
+}
+
+// publishedUsage is the usage of a key on a node of the cluster (see cluster.go)
+type publishedUsage struct {
+	Tunnels     int    `json:"tunnels,omitempty"`
+	Connections int    `json:"connections,omitempty"`
+	Bytes       int64  `json:"bytes,omitempty"`
+	Day         string `json:"day,omitempty"`
+	MonthBytes  int64  `json:"month_bytes,omitempty"`
+	Month       string `json:"month,omitempty"`
+}
+
+// KeyUsage is the bytes a key transferred on a day and in a month (UTC), persisted to Config.UsageFile, and handed
+// over to a new instance of the server taking over from this one (see Server.HandOverUsage)
+type KeyUsage struct {
+	Fingerprint string `json:"fingerprint"`
+	Bytes       int64  `json:"bytes,omitempty"`
+	Day         string `json:"day,omitempty"`
+	MonthBytes  int64  `json:"month_bytes,omitempty"`
+	Month       string `json:"month,omitempty"`
+}
+
+// transferCap is a cap on the bytes a key transfers over a period (see Quota)
+type transferCap struct {
+	period string // "day" or "month"
+	max    int64
+	used   int64
+	resets time.Time
+}
+
+// exceeded returns true if the cap is set, and exceeded
+func (c transferCap) exceeded() bool { return c.max > 0 && c.used >= c.max }
+
+// String describes the cap, for the user (eg. "9.0 MiB of 10.0 MiB transferred this month, resets 2026-11-01T00:00:00Z")
+func (c transferCap) String() string {
+	var this = map[string]string{"day": "today", "month": "this month"}[c.period]
+	return fmt.Sprintf("%s of %s transferred %s, resets %s", formatBytes(c.used), formatBytes(c.max), this, c.resets.Format(time.RFC3339))
+}
+
+// capsOf returns the transfer caps of [quota], with [u] used of them as of [now]
+func capsOf(quota Quota, u usage, now time.Time) []transferCap {
+	var day = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return []transferCap{
+		{period: "day", max: quota.MaxBytesPerDay, used: u.bytes, resets: day.AddDate(0, 0, 1)},
+		{period: "month", max: quota.MaxBytesPerMonth, used: u.monthBytes, resets: day.AddDate(0, 1, 1-day.Day())},
+	}
+}
+
+// quotas tracks usage of each key, and enforces their quotas
+type quotas struct {
+	defaults  Quota
+	overrides map[string]Quota // by fingerprint
+
+	mu       sync.Mutex
+	usage    map[string]*usage                 // by fingerprint; "" for unauthenticated clients
+	others   map[string]publishedUsage         // by fingerprint, on the other nodes of the cluster (if any)
+	channels map[string]map[*quotaChannel]bool // open channels of each key (by fingerprint)
+	limiters map[string]*bandwidthLimiter      // of keys throttled for exceeding a transfer cap (by fingerprint)
+
+	path  string // file usage is persisted to; empty if it isn't (or no longer is, once handed over)
+	dirty bool   // set when bytes were transferred since usage was last persisted
+
+	// serializes writes to path
+	saving sync.Mutex
+
+	// notifies the clients of the key with fingerprint of a transfer cap they're nearing or have exceeded (if set)
+	notify func(fingerprint, msg string, args ...field)
+}
+
+// newQuotas returns a new quotas enforcing [defaults] for every key, except ones in [overrides]
+func newQuotas(defaults Quota, overrides map[string]Quota) *quotas {
+	return &quotas{defaults: defaults, overrides: overrides, usage: make(map[string]*usage),
+		channels: make(map[string]map[*quotaChannel]bool), limiters: make(map[string]*bandwidthLimiter)}
+}
+
+// load restores usage persisted to the JSON file at [path], and persists it there from now on (see persist).
+// A missing file is treated as empty.
+func (q *quotas) load(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to read usage")
+	}
+
+	var persisted []KeyUsage
+	if len(content) > 0 {
+		if err = json.Unmarshal(content, &persisted); err != nil {
+			return errors.Wrap(err, "failed to parse usage")
+		}
+	}
+
+	q.restore(persisted)
+	q.mu.Lock()
+	q.path = path
+	q.mu.Unlock()
+	return nil
+}
+
+// restore restores usage of keys from [persisted], for the current day and month. Where a key already has usage of
+// its own, the larger of the two counts.
+func (q *quotas) restore(persisted []KeyUsage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, p := range persisted {
+		var u = q.usageFor(p.Fingerprint)
+		if p.Day == u.day && p.Bytes > u.bytes {
+			u.bytes, q.dirty = p.Bytes, true
+		}
+		if p.Month == u.month && p.MonthBytes > u.monthBytes {
+			u.monthBytes, q.dirty = p.MonthBytes, true
+		}
+	}
+}
+
+// snapshot returns the bytes every key transferred today and this month. Must be called with lock held.
+func (q *quotas) snapshot() []KeyUsage {
+	var snapshot = make([]KeyUsage, 0, len(q.usage))
+	for fingerprint := range q.usage {
+		var u = q.usageFor(fingerprint)
+		if u.bytes > 0 || u.monthBytes > 0 {
+			snapshot = append(snapshot, KeyUsage{Fingerprint: fingerprint, Bytes: u.bytes, Day: u.day, MonthBytes: u.monthBytes, Month: u.month})
+		}
+	}
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].Fingerprint < snapshot[j].Fingerprint })
+	return snapshot
+}
+
+// save persists usage to its file, if it's changed since it was last persisted
+func (q *quotas) save() error {
+	q.saving.Lock()
+	defer q.saving.Unlock()
+
+	q.mu.Lock()
+	if q.path == "" || !q.dirty {
+		q.mu.Unlock()
+		return nil
+	}
+	var path, snapshot = q.path, q.snapshot()
+	q.dirty = false
+	q.mu.Unlock()
+
+	content, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal usage")
+	}
+	if err = writeFileAtomic(path, content); err != nil {
+		q.mu.Lock()
+		q.dirty = true
+		q.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// persist persists usage every usageSaveInterval, until [stop] is closed (it's persisted once more as the server
+// stops; see Server.Shutdown and Server.Close)
+func (q *quotas) persist(stop <-chan struct{}) {
+	var ticker = time.NewTicker(usageSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := q.save(); err != nil {
+				log.Printf("failed to persist quota usage: %s", err.Error())
+			}
+		}
+	}
+}
+
+// handOver returns the bytes every key transferred today and this month, and stops persisting usage, as the
+// instance it's handed over to persists it from now on
+func (q *quotas) handOver() []KeyUsage {
+	q.saving.Lock()
+	defer q.saving.Unlock()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.path = ""
+	return q.snapshot()
+}
+
+// HandOverUsage returns the bytes every key transferred today and this month, to hand them over to a new instance of
+// the server taking over from this one (see Server.TakeOverUsage) before shutting down. This instance no longer
+// persists usage (see Config.UsageFile) from then on, so as not to overwrite what the new one persists.
+func (srv *Server) HandOverUsage() []KeyUsage { return srv.quotas.handOver() }
+
+// TakeOverUsage restores [usage] handed over by the instance of the server this one takes over from, so that keys'
+// transfer caps hold across the restart
+func (srv *Server) TakeOverUsage(usage []KeyUsage) { srv.quotas.restore(usage) }
+
+// enabled returns true if any quota is configured
+func (q *quotas) enabled() bool {
+	return !q.defaults.isZero() || len(q.overrides) > 0
+}
+
+// quotaFor returns the quota of the key with [fingerprint]
+func (q *quotas) quotaFor(fingerprint string) Quota {
+	if quota, ok := q.overrides[fingerprint]; ok {
+		return quota
+	}
+	return q.defaults
+}
+
+// usageFor returns usage of the key with [fingerprint], resetting the daily counters if the day has changed.
+// Must be called with lock held.
+func (q *quotas) usageFor(fingerprint string) *usage {
+	var u, ok = q.usage[fingerprint]
+	if !ok {
+		u = &usage{}
+		q.usage[fingerprint] = u
+	}
+
+	var now = time.Now().UTC()
+	if today := now.Format("2006-01-02"); u.day != today {
+		u.day, u.bytes = today, 0
+		u.capWarned, u.capExceeded = resetCaps(u.capWarned, "day"), resetCaps(u.capExceeded, "day")
+	}
+	if month := now.Format("2006-01"); u.month != month {
+		u.month, u.monthBytes = month, 0
+		u.capWarned, u.capExceeded = resetCaps(u.capWarned, "month"), resetCaps(u.capExceeded, "month")
+	}
+	return u
+}
+
+// resetCaps returns [caps] without [period], for a new one
+func resetCaps(caps map[string]bool, period string) map[string]bool {
+	if caps == nil {
+		return make(map[string]bool)
+	}
+	delete(caps, period)
+	return caps
+}
+
+// totalFor returns usage of the key with [fingerprint] on all nodes of the cluster (just this one, unless clustered).
+// Must be called with lock held.
+func (q *quotas) totalFor(fingerprint string) usage {
+	var total = *q.usageFor(fingerprint)
+	if other, ok := q.others[fingerprint]; ok {
+		total.tunnels += other.Tunnels
+		total.connections += other.Connections
+		if other.Day == total.day {
+			total.bytes += other.Bytes
+		}
+		if other.Month == total.month {
+			total.monthBytes += other.MonthBytes
+		}
+	}
+	return total
+}
+
+// local returns usage of every key on this node, to be published to the cluster
+func (q *quotas) local() map[string]publishedUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var published = make(map[string]publishedUsage)
+	for fingerprint := range q.usage {
+		var u = q.usageFor(fingerprint)
+		if u.tunnels > 0 || u.connections > 0 || u.bytes > 0 || u.monthBytes > 0 {
+			published[fingerprint] = publishedUsage{Tunnels: u.tunnels, Connections: u.connections, Bytes: u.bytes, Day: u.day,
+				MonthBytes: u.monthBytes, Month: u.month}
+		}
+	}
+	return published
+}
+
+// setOthers sets usage of every key on the other nodes of the cluster
+func (q *quotas) setOthers(others map[string]publishedUsage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.others = others
+}
+
+// AcquireTunnel accounts for a new tunnel by the key with [fingerprint], unless it would exceed its quota
+func (q *quotas) AcquireTunnel(fingerprint string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var quota, u = q.quotaFor(fingerprint), q.totalFor(fingerprint)
+	if quota.MaxTunnels > 0 && u.tunnels >= quota.MaxTunnels {
+		return errors.Errorf("quota exceeded: at most %d tunnels allowed at the same time", quota.MaxTunnels)
+	}
+	q.usageFor(fingerprint).tunnels++
+	return nil
+}
+
+// ReleaseTunnel accounts for a tunnel by the key with [fingerprint] being closed
+func (q *quotas) ReleaseTunnel(fingerprint string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.usageFor(fingerprint).tunnels--
+}
+
+// AcquireConnection accounts for a new public connection to a tunnel of the key with [fingerprint],
+// unless it would exceed its quota
+func (q *quotas) AcquireConnection(fingerprint string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var quota, u = q.quotaFor(fingerprint), q.totalFor(fingerprint)
+	if quota.MaxConnections > 0 && u.connections >= quota.MaxConnections {
+		return errors.Errorf("quota exceeded: at most %d connections allowed at the same time", quota.MaxConnections)
+	}
+
+	if !quota.throttles() {
+		for _, c := range capsOf(quota, u, time.Now().UTC()) {
+			if c.exceeded() {
+				return errors.Errorf("quota exceeded: %s", c)
+			}
+		}
+	}
+
+	q.usageFor(fingerprint).connections++
+	return nil
+}
+
+// ReleaseConnection accounts for a public connection to a tunnel of the key with [fingerprint] being closed
+func (q *quotas) ReleaseConnection(fingerprint string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.usageFor(fingerprint).connections--
+}
+
+// AddBytes accounts for [n] bytes transferred through a tunnel of the key with [fingerprint], enforcing its transfer
+// caps. It returns the limiter the key's traffic is throttled with, if it's exceeded a cap (and isn't suspended).
+func (q *quotas) AddBytes(fingerprint string, n int64) *bandwidthLimiter {
+	q.mu.Lock()
+	var own = q.usageFor(fingerprint)
+	own.bytes += n
+	own.monthBytes += n
+	q.dirty = q.dirty || n > 0
+
+	var quota = q.quotaFor(fingerprint)
+	if quota.MaxBytesPerDay <= 0 && quota.MaxBytesPerMonth <= 0 {
+		q.mu.Unlock()
+		return nil
+	}
+
+	var exceeded *transferCap
+	var notify []string
+	for _, c := range capsOf(quota, q.totalFor(fingerprint), time.Now().UTC()) {
+		var c = c
+		switch {
+		case c.max <= 0:
+		case c.exceeded():
+			if exceeded == nil {
+				exceeded = &c
+			}
+			if !own.capExceeded[c.period] {
+				own.capExceeded[c.period], own.capWarned[c.period] = true, true
+				notify = append(notify, c.period)
+			}
+		case float64(c.used) >= capWarningThreshold*float64(c.max) && !own.capWarned[c.period]:
+			own.capWarned[c.period] = true
+			notify = append(notify, c.period)
+		}
+	}
+
+	// keys are throttled for as long as they've exceeded a cap, or suspended: their connections are closed
+	var limiter *bandwidthLimiter
+	var suspended []*quotaChannel
+	if exceeded == nil {
+		delete(q.limiters, fingerprint)
+	} else if quota.throttles() {
+		if limiter = q.limiters[fingerprint]; limiter == nil {
+			var rate = quota.OverCapRate
+			if rate <= 0 {
+				rate = defaultOverCapRate
+			}
+			limiter = newBandwidthLimiter(rate)
+			q.limiters[fingerprint] = limiter
+		}
+	} else {
+		for channel := range q.channels[fingerprint] {
+			suspended = append(suspended, channel)
+		}
+	}
+	q.mu.Unlock()
+
+	for _, period := range notify {
+		q.notifyCap(fingerprint, quota, period)
+	}
+	for _, channel := range suspended {
+		atomic.StoreInt32(&channel.suspended, 1)
+		_ = channel.Close()
+	}
+	return limiter
+}
+
+// notifyCap notifies the clients of the key with [fingerprint] that they're nearing or have exceeded the transfer cap
+// of [quota] for [period]
+func (q *quotas) notifyCap(fingerprint string, quota Quota, period string) {
+	if q.notify == nil {
+		return
+	}
+
+	q.mu.Lock()
+	var caps = capsOf(quota, q.totalFor(fingerprint), time.Now().UTC())
+	q.mu.Unlock()
+
+	for _, c := range caps {
+		if c.period != period {
+			continue
+		}
+
+		var args = []field{kv("period", c.period), kv("used", c.used), kv("max", c.max), kv("resets", c.resets.Format(time.RFC3339))}
+		if !c.exceeded() {
+			var msg = fmt.Sprintf("quota: %s left of the %s transfer cap (%s)", formatBytes(c.max-c.used), c.period, c)
+			q.notify(fingerprint, msg, append(args, kv("type", "quota.warning"))...)
+		} else if quota.throttles() {
+			var msg = fmt.Sprintf("quota: %s transfer cap exceeded; tunnels are throttled until it resets (%s)", c.period, c)
+			q.notify(fingerprint, msg, append(args, kv("type", "quota.exceeded"), kv("action", OverCapThrottle))...)
+		} else {
+			var msg = fmt.Sprintf("quota: %s transfer cap exceeded; tunnels are suspended until it resets (%s)", c.period, c)
+			q.notify(fingerprint, msg, append(args, kv("type", "quota.exceeded"), kv("action", OverCapSuspend))...)
+		}
+	}
+}
+
+// Describe returns a human-readable description of the usage and quota of the key with [fingerprint]
+func (q *quotas) Describe(fingerprint string) string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var quota, u = q.quotaFor(fingerprint), q.totalFor(fingerprint)
+	var limit = func(n int64, max int64, format func(int64) string) string {
+		if max <= 0 {
+			return format(n) + " (unlimited)"
+		}
+		return format(n) + " of " + format(max)
+	}
+
+	var count = func(n int64) string { return fmt.Sprintf("%d", n) }
+	return strings.Join([]string{
+		"tunnels: " + limit(int64(u.tunnels), int64(quota.MaxTunnels), count),
+		"connections: " + limit(int64(u.connections), int64(quota.MaxConnections), count),
+		"transferred today: " + limit(u.bytes, quota.MaxBytesPerDay, formatBytes),
+		"transferred this month: " + limit(u.monthBytes, quota.MaxBytesPerMonth, formatBytes),
+	}, ", ")
+}
+
+// formatBytes formats [n] bytes in human-readable units (eg. 1.5 MiB)
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	var div, exp = int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// limited wraps [newChannel] so that channels it opens (each serving a public connection) are accounted for
+// in the quota of the key with [fingerprint]. Opening a channel fails if it would exceed the quota.
+func (q *quotas) limited(fingerprint string, newChannel newChannelFn) newChannelFn {
+	return func(host, port string) (gossh.Channel, <-chan *gossh.Request, error) {
+		if err := q.AcquireConnection(fingerprint); err != nil {
+			return nil, nil, err
+		}
+
+		channel, requests, err := newChannel(host, port)
+		if err != nil {
+			q.ReleaseConnection(fingerprint)
+			return nil, nil, err
+		}
+
+		var c = &quotaChannel{Channel: channel, quotas: q, fingerprint: fingerprint}
+		q.mu.Lock()
+		if q.channels[fingerprint] == nil {
+			q.channels[fingerprint] = make(map[*quotaChannel]bool)
+		}
+		q.channels[fingerprint][c] = true
+		q.mu.Unlock()
+		return c, requests, nil
+	}
+}
+
+// errSuspended is returned by the channels of keys suspended for exceeding a transfer cap
+var errSuspended = errors.New("suspended: transfer cap exceeded")
+
+// quotaChannel is a gossh.Channel which accounts for its traffic in the quota of the key with fingerprint
+type quotaChannel struct {
+	gossh.Channel
+	quotas      *quotas
+	fingerprint string
+	once        sync.Once
+	suspended   int32 // set (atomically) once the key is suspended; what's left of the traffic is dropped
+}
+
+func (c *quotaChannel) Read(b []byte) (n int, err error) {
+	if atomic.LoadInt32(&c.suspended) == 1 {
+		return 0, errSuspended
+	}
+	n, err = c.Channel.Read(b)
+	c.quotas.AddBytes(c.fingerprint, int64(n)).wait(n)
+	return n, err
+}
+
+func (c *quotaChannel) Write(b []byte) (n int, err error) {
+	if atomic.LoadInt32(&c.suspended) == 1 {
+		return 0, errSuspended
+	}
+	n, err = c.Channel.Write(b)
+	c.quotas.AddBytes(c.fingerprint, int64(n)).wait(n)
+	return n, err
+}
+
+func (c *quotaChannel) Close() error {
+	c.once.Do(func() {
+		c.quotas.mu.Lock()
+		delete(c.quotas.channels[c.fingerprint], c)
+		if len(c.quotas.channels[c.fingerprint]) == 0 {
+			delete(c.quotas.channels, c.fingerprint)
+		}
+		c.quotas.mu.Unlock()
+		c.quotas.ReleaseConnection(c.fingerprint)
+	})
+	return c.Channel.Close()
+}
@@ -0,0 +1,119 @@
+package server_test
+
+import (
+	"github.com/riyaz-ali/shhh/internal/harness"
+	"github.com/riyaz-ali/shhh/server"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// transfer cap of the key in TestQuotaUsageSurvivesRestart, which a single visitor exceeds
+const testDailyCap = 1024
+
+// startCapped starts a server letting [key] in, with a daily transfer cap of testDailyCap, and its usage persisted to
+// [usageFile] (unless empty)
+func startCapped(t *testing.T, key gossh.Signer, dir, usageFile string) *harness.Server {
+	var config = server.DefaultConfig()
+	config.AuthorizedKeys = filepath.Join(dir, "authorized_keys")
+	config.UsageFile = usageFile
+	config.Quota.MaxBytesPerDay = testDailyCap
+	if err := ioutil.WriteFile(config.AuthorizedKeys, gossh.MarshalAuthorizedKey(key.PublicKey()), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := harness.Start(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+// visit opens a tunnel to an echo server as [key], and returns how many of [n] bytes a visitor got back through it
+func visit(t *testing.T, srv *harness.Server, key gossh.Signer, n int) int {
+	client, err := srv.DialKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ln, err := client.Listen("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go echo(ln)
+
+	visitor, err := net.DialTimeout("tcp", srv.TunnelAddr(ln.Port), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+
+	go func() { _, _ = visitor.Write(make([]byte, n)) }()
+	_ = visitor.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got, _ := io.ReadFull(visitor, make([]byte, n))
+	return got
+}
+
+func TestQuotaUsageSurvivesRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shhh-quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := harness.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the cap is exceeded (and the visitor cut off) on the first instance, as on one without a usage file
+	var first = startCapped(t, key, dir, filepath.Join(dir, "usage.json"))
+	if got := visit(t, first, key, 4*testDailyCap); got == 4*testDailyCap {
+		t.Fatal("visitor wasn't cut off once the cap was exceeded")
+	}
+	if err = first.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var fresh = startCapped(t, key, dir, "")
+	if got := visit(t, fresh, key, 8); got != 8 {
+		t.Fatalf("visitor got %d of 8 bytes back without a usage file", got)
+	}
+	_ = fresh.Close()
+
+	t.Run("usage file", func(t *testing.T) {
+		var restarted = startCapped(t, key, dir, filepath.Join(dir, "usage.json"))
+		defer restarted.Close()
+
+		if got := visit(t, restarted, key, 8); got != 0 {
+			t.Fatalf("visitor got %d bytes back once restarted, although the cap was exceeded", got)
+		}
+	})
+
+	t.Run("handed over", func(t *testing.T) {
+		var old = startCapped(t, key, dir, filepath.Join(dir, "old.json"))
+		_ = visit(t, old, key, 4*testDailyCap)
+		var usage = old.HandOverUsage()
+		if err := old.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "old.json")); !os.IsNotExist(err) {
+			t.Fatalf("usage was persisted once handed over (err: %v)", err)
+		}
+
+		var taking = startCapped(t, key, dir, "")
+		defer taking.Close()
+		taking.TakeOverUsage(usage)
+
+		if got := visit(t, taking, key, 8); got != 0 {
+			t.Fatalf("visitor got %d bytes back once usage was handed over, although the cap was exceeded", got)
+		}
+	})
+}
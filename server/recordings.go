@@ -0,0 +1,300 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains the session recordings: each connection's message stream (its tunnels opening and closing,
+// and everything else the server tells the client) written to a file of its own in Config.RecordingsDir, for later
+// audit. Recordings are plain logs, or asciicast files (see https://docs.asciinema.org/manual/asciicast/v2/) to
+// replay them as the client saw them. Old recordings are pruned by age and by the total size of the directory.
+// ----------
+
+// formats of recordings
+const (
+	recordingLog       = "log"
+	recordingAsciicast = "asciicast"
+)
+
+// extensions of the files of recordings, by format
+var recordingExtensions = map[string]string{recordingLog: ".log", recordingAsciicast: ".cast"}
+
+// how often recordings are pruned, at most
+const recordingsPruneInterval = time.Minute
+
+// RecordingInfo describes a session recording
+type RecordingInfo struct {
+	ID       string    `json:"id"`
+	Format   string    `json:"format"`
+	Modified time.Time `json:"modified"`
+	Size     int64     `json:"size"`
+	Active   bool      `json:"active,omitempty"` // the session is still going
+}
+
+// recordings is the directory sessions are recorded to. A nil *recordings records nothing.
+type recordings struct {
+	dir       string
+	format    string
+	retention time.Duration // recordings older than this are pruned (0 to keep them)
+	maxSize   int64         // the oldest recordings are pruned past this total size (0 for no limit)
+
+	mu     sync.Mutex
+	active map[string]struct{} // IDs of recordings being written
+	pruned time.Time
+}
+
+// newRecordings returns the recordings as configured, or nil if sessions aren't recorded
+func newRecordings(config *Config) (*recordings, error) {
+	if config.RecordingsDir == "" {
+		return nil, nil
+	}
+
+	var rs = &recordings{dir: config.RecordingsDir, format: config.RecordingFormat, retention: config.RecordingRetention,
+		maxSize: int64(config.RecordingsMaxSize) << 20, active: make(map[string]struct{})}
+	switch rs.format {
+	case "":
+		rs.format = recordingLog
+	case recordingLog, recordingAsciicast:
+	default:
+		return nil, errors.Errorf("unknown recording format %q (log or asciicast)", rs.format)
+	}
+
+	if err := os.MkdirAll(rs.dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create recordings directory")
+	}
+	rs.prune()
+	return rs, nil
+}
+
+// start returns the recording of [conn], from [client], which ends with the connection. Its file is only created
+// once there's something to record, so that connections which never authenticate (eg. scanners) leave nothing.
+func (rs *recordings) start(conn *connection, client net.Addr) *recording {
+	if rs == nil {
+		return nil
+	}
+
+	var r = &recording{store: rs, conn: conn, client: client.String(), started: time.Now()}
+	r.id = r.started.UTC().Format("20060102T150405Z") + "-" + randomHex(4)
+
+	conn.group.Go(func(ctx context.Context) error {
+		<-ctx.Done()
+		r.end()
+		return nil
+	})
+	return r
+}
+
+// list returns the recordings in the directory, newest first
+func (rs *recordings) list() ([]RecordingInfo, error) {
+	files, err := ioutil.ReadDir(rs.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list recordings")
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	var infos []RecordingInfo
+	for _, file := range files {
+		var ext, format = filepath.Ext(file.Name()), ""
+		for f, e := range recordingExtensions {
+			if e == ext {
+				format = f
+			}
+		}
+		if format == "" || file.IsDir() {
+			continue
+		}
+
+		var id = strings.TrimSuffix(file.Name(), ext)
+		var _, active = rs.active[id]
+		infos = append(infos, RecordingInfo{ID: id, Format: format, Modified: file.ModTime().UTC(), Size: file.Size(), Active: active})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID > infos[j].ID })
+	return infos, nil
+}
+
+// prune removes recordings older than the retention period, then the oldest ones until they fit in the maximum
+// size. Recordings still being written are kept.
+func (rs *recordings) prune() {
+	infos, err := rs.list()
+	if err != nil {
+		log.Printf("failed to prune recordings: %s", err.Error())
+		return
+	}
+
+	var total int64
+	for _, info := range infos {
+		if info.Active {
+			total += info.Size
+			continue
+		}
+
+		var expired = rs.retention > 0 && time.Since(info.Modified) > rs.retention
+		if expired || (rs.maxSize > 0 && total+info.Size > rs.maxSize) {
+			if err = os.Remove(rs.path(info)); err != nil {
+				log.Printf("failed to prune recording %s: %s", info.ID, err.Error())
+			}
+			continue
+		}
+		total += info.Size
+	}
+
+	rs.mu.Lock()
+	rs.pruned = time.Now()
+	rs.mu.Unlock()
+}
+
+// path returns the path of the file of the recording described by [info]
+func (rs *recordings) path(info RecordingInfo) string {
+	return filepath.Join(rs.dir, info.ID+recordingExtensions[info.Format])
+}
+
+// Recordings lists the session recordings (see Config.RecordingsDir), newest first
+func (srv *Server) Recordings() ([]RecordingInfo, error) {
+	if srv.recordings == nil {
+		return nil, errors.New("sessions aren't recorded")
+	}
+	return srv.recordings.list()
+}
+
+// OpenRecording opens the session recording with [id], for reading
+func (srv *Server) OpenRecording(id string) (*os.File, RecordingInfo, error) {
+	infos, err := srv.Recordings()
+	if err != nil {
+		return nil, RecordingInfo{}, err
+	}
+
+	for _, info := range infos {
+		if info.ID == id {
+			file, err := os.Open(srv.recordings.path(info))
+			return file, info, errors.Wrap(err, "failed to open recording")
+		}
+	}
+	return nil, RecordingInfo{}, errors.Errorf("no such recording %q", id)
+}
+
+// recording is the recording of a connection. A nil *recording records nothing.
+type recording struct {
+	store   *recordings
+	conn    *connection
+	id      string
+	client  string
+	started time.Time
+
+	mu     sync.Mutex
+	file   *os.File // nil until there's something to record
+	failed bool     // set if the file couldn't be written, so it isn't retried for every message
+	ended  bool
+}
+
+// record writes [text], a message the client was sent, to the recording
+func (r *recording) record(text string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ended || r.failed {
+		return
+	}
+
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			log.Printf("failed to record session %s: %s", r.id, err.Error())
+			r.failed = true
+			return
+		}
+	}
+	r.write(text)
+}
+
+// write writes [text] to the recording's file. It must be called with the lock held.
+func (r *recording) write(text string) {
+	var now = time.Now()
+	var line string
+	if r.store.format == recordingAsciicast {
+		var event, _ = json.Marshal([]interface{}{now.Sub(r.started).Seconds(), "o", "server: " + text + "\r\n"})
+		line = string(event) + "\n"
+	} else {
+		line = now.UTC().Format(time.RFC3339) + " " + text + "\n"
+	}
+
+	if _, err := r.file.WriteString(line); err != nil {
+		log.Printf("failed to record session %s: %s", r.id, err.Error())
+		r.failed = true
+	}
+}
+
+// open creates the recording's file, and writes its header. It must be called with the lock held.
+func (r *recording) open() error {
+	var info = RecordingInfo{ID: r.id, Format: r.store.format}
+	file, err := os.OpenFile(r.store.path(info), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	var fingerprint = Fingerprint(r.conn.ctx)
+	var header string
+	if r.store.format == recordingAsciicast {
+		var title = fmt.Sprintf("shhh session %s (%s from %s)", r.id, fingerprint, r.client)
+		var content, _ = json.Marshal(map[string]interface{}{"version": 2, "width": 80, "height": 24, "timestamp": r.started.Unix(), "title": title})
+		header = string(content) + "\n"
+	} else {
+		header = fmt.Sprintf("# session %s\n# client: %s\n# fingerprint: %s\n# started: %s\n", r.id, r.client, fingerprint, r.started.UTC().Format(time.RFC3339))
+	}
+
+	if _, err = file.WriteString(header); err != nil {
+		_ = file.Close()
+		return err
+	}
+	r.file = file
+
+	var rs = r.store
+	rs.mu.Lock()
+	rs.active[r.id] = struct{}{}
+	var due = time.Since(rs.pruned) > recordingsPruneInterval
+	rs.mu.Unlock()
+	if due {
+		go rs.prune()
+	}
+	return nil
+}
+
+// end records the end of the connection (if anything was recorded), and closes the recording
+func (r *recording) end() {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ended = true
+	if r.file == nil {
+		return // there was nothing to record
+	}
+
+	if !r.failed {
+		r.write(fmt.Sprintf("connection closed after %s", time.Since(r.started).Round(time.Second)))
+	}
+	if err := r.file.Close(); err != nil {
+		log.Printf("failed to record session %s: %s", r.id, err.Error())
+	}
+	r.store.mu.Lock()
+	delete(r.store.active, r.id)
+	r.store.mu.Unlock()
+}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains a minimal Redis client, speaking just enough of RESP (see https://redis.io/docs/reference/protocol-spec/)
+// for the cluster's coordination (see cluster.go): commands are sent one at a time, over a single connection which
+// is re-established after it fails.
+// ----------
+
+// how long a Redis command may take
+const redisTimeout = 5 * time.Second
+
+// redisError is an error reply from Redis
+type redisError string
+
+func (err redisError) Error() string { return "redis: " + string(err) }
+
+// redisClient is a connection to a Redis server
+type redisClient struct {
+	addr     string
+	tls      *tls.Config // nil unless connecting with rediss://
+	username string
+	password string
+	db       int
+
+	mu   sync.Mutex
+	conn net.Conn // nil until connected, and after the connection failed
+	r    *bufio.Reader
+}
+
+// newRedisClient returns a client of the Redis server at [rawURL] (redis://[user:password@]host:port[/db], or
+// rediss:// for TLS). It doesn't connect until it's first used.
+func newRedisClient(rawURL string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+		return nil, errors.Errorf("invalid redis URL %q", rawURL)
+	}
+
+	var client = &redisClient{addr: u.Host}
+	if u.Port() == "" {
+		client.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.Scheme == "rediss" {
+		client.tls = &tls.Config{ServerName: u.Hostname()}
+	}
+	if u.User != nil {
+		client.password, _ = u.User.Password()
+		if client.username = u.User.Username(); client.password == "" {
+			client.username, client.password = "", client.username // redis://password@host
+		}
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if client.db, err = strconv.Atoi(db); err != nil {
+			return nil, errors.Errorf("invalid redis database %q", db)
+		}
+	}
+	return client, nil
+}
+
+// do sends the command made of [args], and returns its reply: a string, an int64, nil, or a []interface{} of these
+func (client *redisClient) do(args ...string) (interface{}, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.conn == nil {
+		if err := client.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := client.roundTrip(args)
+	if _, ok := err.(redisError); err != nil && !ok { // the connection can't be trusted anymore
+		_ = client.conn.Close()
+		client.conn = nil
+	}
+	return reply, err
+}
+
+// connect connects (and authenticates) to the server. It must be called with the lock held.
+func (client *redisClient) connect() error {
+	var dialer = &net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	var err error
+	if client.tls != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", client.addr, client.tls)
+	} else {
+		conn, err = dialer.Dial("tcp", client.addr)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to redis")
+	}
+	client.conn, client.r = conn, bufio.NewReader(conn)
+
+	var setup [][]string
+	if client.password != "" && client.username != "" {
+		setup = append(setup, []string{"AUTH", client.username, client.password})
+	} else if client.password != "" {
+		setup = append(setup, []string{"AUTH", client.password})
+	}
+	if client.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(client.db)})
+	}
+
+	for _, args := range setup {
+		if _, err = client.roundTrip(args); err != nil {
+			_ = conn.Close()
+			client.conn = nil
+			return errors.Wrap(err, "failed to connect to redis")
+		}
+	}
+	return nil
+}
+
+// roundTrip sends a command and reads its reply. It must be called with the lock held.
+func (client *redisClient) roundTrip(args []string) (interface{}, error) {
+	_ = client.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(client.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(client.r)
+}
+
+// readRedisReply reads a reply from [r]
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if line = strings.TrimSuffix(line, "\r\n"); line == "" {
+		return nil, errors.New("redis: malformed reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err // a nil reply, unless malformed
+		}
+		var content = make([]byte, n+2)
+		if _, err = io.ReadFull(r, content); err != nil {
+			return nil, err
+		}
+		return string(content[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		var items = make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRedisReply(r); err != nil && !isRedisError(err) {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, errors.Errorf("redis: unexpected reply %q", line)
+}
+
+// isRedisError returns true if [err] is an error reply (rather than a failure to talk to the server)
+func isRedisError(err error) bool {
+	_, ok := err.(redisError)
+	return ok
+}
+
+// redisString returns [reply] as a string (empty if it's nil)
+func redisString(reply interface{}) string {
+	switch v := reply.(type) {
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	}
+	return ""
+}
+
+// redisStrings returns [reply], an array, as strings
+func redisStrings(reply interface{}) []string {
+	var items, _ = reply.([]interface{})
+	var strs = make([]string, len(items))
+	for i := range items {
+		strs[i] = redisString(items[i])
+	}
+	return strs
+}
+
+// scan returns the keys matching [pattern] (see SCAN)
+func (client *redisClient) scan(pattern string) ([]string, error) {
+	var keys []string
+	for cursor := "0"; ; {
+		reply, err := client.do("SCAN", cursor, "MATCH", pattern, "COUNT", "100")
+		if err != nil {
+			return nil, err
+		}
+
+		var parts, _ = reply.([]interface{})
+		if len(parts) != 2 {
+			return nil, errors.New("redis: malformed SCAN reply")
+		}
+		keys = append(keys, redisStrings(parts[1])...)
+		if cursor = redisString(parts[0]); cursor == "0" {
+			return keys, nil
+		}
+	}
+}
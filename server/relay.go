@@ -0,0 +1,469 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains the relaying of public connections between the nodes of a cluster (see cluster.go), so that
+// any node can accept traffic for any tunnel: a node which doesn't hold the tunnel a connection is for passes it on
+// to the one that does, over an internal link authenticated with TLS client certificates on both ends.
+//
+// A relayed connection starts with a line naming the endpoint it's for (eg. http:myapp, tls:myapp or tcp:4000), the
+// visitor's address, and for HTTP the scheme the visitor used; the rest of it is the visitor's traffic. HTTP requests
+// are relayed one at a time (as by a reverse proxy), TLS and TCP connections as they are. For TCP, nodes listen on
+// the ports of tunnels held by other nodes.
+// ----------
+
+// ErrClusterRelayClosed is returned by Server.ServeClusterRelay after Shutdown or Close
+var ErrClusterRelayClosed = errors.New("cluster relay closed")
+
+// time nodes have to set up a relayed connection (ie. finish the TLS handshake, and send the header line)
+const relayHandshakeTimeout = 10 * time.Second
+
+// clusterRelay accepts connections relayed by other nodes, and relays connections to them. A nil *clusterRelay
+// relays nothing.
+type clusterRelay struct {
+	server *tls.Config // of the relay listener, which requires client certificates
+	client *tls.Config // of connections to other nodes
+	addr   string      // advertised to other nodes (see Config.ClusterRelayAddr)
+
+	// listens on a port (on the bind address) for visitors of a TCP tunnel held by another node
+	listen func(port uint32) (net.Listener, error)
+
+	// handles a connection relayed for an endpoint of this node
+	handle func(endpoint string, conn *relayedConn)
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	ports     map[uint32]*followedPort
+	closed    bool
+}
+
+// followedPort is the port of a TCP tunnel held by another node, which this node listens on as well
+type followedPort struct {
+	ln   net.Listener
+	node *ClusterNode // guarded by the relay's mu
+}
+
+// newClusterRelay returns the relay as configured, or nil if nodes don't relay connections
+func newClusterRelay(config *Config) (*clusterRelay, error) {
+	if config.ClusterRelayAddr == "" {
+		return nil, nil
+	}
+	if config.ClusterRelayCert == "" || config.ClusterRelayKey == "" || config.ClusterRelayCA == "" {
+		return nil, errors.New("cluster relay needs a certificate, a key and a CA (set cluster relay cert, key and ca)")
+	}
+
+	cert, err := tls.LoadX509KeyPair(config.ClusterRelayCert, config.ClusterRelayKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load cluster relay certificate")
+	}
+
+	content, err := ioutil.ReadFile(config.ClusterRelayCA)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read cluster relay ca")
+	}
+	var pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, errors.Errorf("no certificates found in %s", config.ClusterRelayCA)
+	}
+
+	var relay = &clusterRelay{
+		server: &tls.Config{Certificates: []tls.Certificate{cert}, ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert, MinVersion: tls.VersionTLS12},
+		client: &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool, MinVersion: tls.VersionTLS12},
+		addr:   config.ClusterRelayAddr,
+		listen: func(port uint32) (net.Listener, error) {
+			host, err := interfaceAddr(config, config.BindAddr)
+			if err != nil {
+				return nil, err
+			}
+			return tcpListen(config, host, port)
+		},
+		ports: make(map[uint32]*followedPort),
+	}
+
+	// a wildcard relay address is advertised with the host of the node's address
+	if host, port, err := net.SplitHostPort(relay.addr); err == nil && (host == "" || net.ParseIP(host).IsUnspecified()) {
+		if host, _, err = net.SplitHostPort(config.ClusterAddr); err != nil {
+			return nil, errors.New("cluster relay address needs a host, unless the cluster address has one")
+		}
+		relay.addr = net.JoinHostPort(host, port)
+	}
+	return relay, nil
+}
+
+// advertised returns the address other nodes relay connections to (empty if the relay is disabled)
+func (relay *clusterRelay) advertised() string {
+	if relay == nil {
+		return ""
+	}
+	return relay.addr
+}
+
+// dial opens a connection to [node], relayed for [endpoint], on behalf of [visitor] (who used [scheme], for HTTP)
+func (relay *clusterRelay) dial(ctx context.Context, node *ClusterNode, endpoint string, visitor net.Addr, scheme string) (net.Conn, error) {
+	if relay == nil || node.Relay == "" {
+		return nil, errors.Errorf("node %s doesn't relay connections", node.ID)
+	}
+
+	host, _, err := net.SplitHostPort(node.Relay)
+	if err != nil {
+		return nil, errors.Errorf("invalid relay address %q of node %s", node.Relay, node.ID)
+	}
+	var config = relay.client.Clone()
+	config.ServerName = host
+
+	var dialer = &net.Dialer{Timeout: relayHandshakeTimeout}
+	raw, err := dialer.DialContext(ctx, "tcp", node.Relay)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to relay to node %s", node.ID)
+	}
+
+	var conn = tls.Client(raw, config)
+	_ = conn.SetDeadline(time.Now().Add(relayHandshakeTimeout))
+	if _, err = fmt.Fprintf(conn, "%s %s %s\n", endpoint, visitor.String(), scheme); err != nil {
+		_ = conn.Close()
+		return nil, errors.Wrapf(err, "failed to relay to node %s", node.ID)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// serve accepts connections relayed by other nodes on [ln], until the relay is closed
+func (relay *clusterRelay) serve(ln net.Listener) error {
+	relay.mu.Lock()
+	if relay.closed {
+		relay.mu.Unlock()
+		_ = ln.Close()
+		return ErrClusterRelayClosed
+	}
+	relay.listeners = append(relay.listeners, ln)
+	relay.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			relay.mu.Lock()
+			var closed = relay.closed
+			relay.mu.Unlock()
+			if closed {
+				return ErrClusterRelayClosed
+			}
+
+			if oe, ok := err.(*net.OpError); ok && (oe.Timeout() || oe.Temporary()) {
+				continue
+			}
+			return errors.Wrap(err, "failed to accept new connection")
+		}
+
+		go relay.accept(conn)
+	}
+}
+
+// accept authenticates the node relaying [conn], reads its header line, and hands it over
+func (relay *clusterRelay) accept(conn net.Conn) {
+	var tc = tls.Server(conn, relay.server)
+	_ = tc.SetDeadline(time.Now().Add(relayHandshakeTimeout))
+
+	var r = bufio.NewReader(tc)
+	line, err := r.ReadString('\n')
+	var fields = strings.Fields(line)
+	if err != nil || len(fields) < 2 {
+		if err == nil {
+			err = errors.New("malformed header")
+		}
+		log.Printf("rejected relayed connection from %s: %s", conn.RemoteAddr().String(), err.Error())
+		_ = tc.Close()
+		return
+	}
+	_ = tc.SetDeadline(time.Time{})
+
+	visitor, err := net.ResolveTCPAddr("tcp", fields[1])
+	if err != nil {
+		_ = tc.Close()
+		return
+	}
+
+	var relayed = &relayedConn{Conn: tc, r: r, visitor: visitor}
+	if len(fields) > 2 {
+		relayed.scheme = fields[2]
+	}
+	relay.handle(fields[0], relayed)
+}
+
+// forward relays [conn], a visitor's connection for [endpoint], to [node]
+func (relay *clusterRelay) forward(conn net.Conn, node *ClusterNode, endpoint string) {
+	upstream, err := relay.dial(context.Background(), node, endpoint, conn.RemoteAddr(), "")
+	if err != nil {
+		log.Printf("failed to relay connection from %s: %s", conn.RemoteAddr().String(), err.Error())
+		_ = conn.Close()
+		return
+	}
+
+	var done = make(chan struct{})
+	go func() {
+		_, _ = io.Copy(upstream, conn)
+		closeWrite(upstream)
+		close(done)
+	}()
+	_, _ = io.Copy(conn, upstream)
+	closeWrite(conn)
+	<-done
+	_ = conn.Close()
+	_ = upstream.Close()
+}
+
+// follow listens on [ports], the TCP ports of tunnels held by other nodes (which visitors are relayed to), and stops
+// listening on the ports which aren't listed anymore
+func (relay *clusterRelay) follow(ports map[uint32]*ClusterNode) {
+	if relay == nil {
+		return
+	}
+
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+
+	for port, followed := range relay.ports {
+		if _, ok := ports[port]; !ok || relay.closed {
+			_ = followed.ln.Close()
+			delete(relay.ports, port)
+		}
+	}
+	if relay.closed {
+		return
+	}
+
+	for port, node := range ports {
+		if followed, ok := relay.ports[port]; ok {
+			followed.node = node
+			continue
+		}
+
+		ln, err := relay.listen(port)
+		if err != nil {
+			continue // eg. the port is in use on this host
+		}
+		var followed = &followedPort{ln: ln, node: node}
+		relay.ports[port] = followed
+		go relay.acceptFollowed(port, followed)
+	}
+}
+
+// acceptFollowed relays the connections accepted on [port], held by another node, until it's not followed anymore
+func (relay *clusterRelay) acceptFollowed(port uint32, followed *followedPort) {
+	var endpoint = "tcp:" + strconv.Itoa(int(port))
+	for {
+		conn, err := followed.ln.Accept()
+		if err != nil {
+			relay.mu.Lock()
+			var current = relay.ports[port] == followed
+			relay.mu.Unlock()
+			if oe, ok := err.(*net.OpError); current && ok && (oe.Timeout() || oe.Temporary()) {
+				continue
+			}
+			return
+		}
+
+		relay.mu.Lock()
+		var node = followed.node
+		relay.mu.Unlock()
+		go relay.forward(conn, node, endpoint)
+	}
+}
+
+// handler returns a handler relaying HTTP requests for [endpoint] to [node]
+func (relay *clusterRelay) handler(node *ClusterNode, endpoint string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var scheme = "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+
+		var visitor, err = net.ResolveTCPAddr("tcp", r.RemoteAddr)
+		if err != nil {
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+			return
+		}
+
+		var proxy = &httputil.ReverseProxy{
+			Director: func(req *http.Request) { req.URL.Scheme, req.URL.Host = "http", req.Host },
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return relay.dial(ctx, node, endpoint, visitor, scheme)
+				},
+				DisableKeepAlives: true, // each connection is relayed on behalf of a visitor
+			},
+		}
+		proxy.ServeHTTP(w, r)
+	})
+}
+
+// close stops accepting relayed connections, and listening on the ports of other nodes; connections being relayed
+// carry on
+func (relay *clusterRelay) close() {
+	if relay == nil {
+		return
+	}
+
+	relay.mu.Lock()
+	relay.closed = true
+	for _, ln := range relay.listeners {
+		_ = ln.Close()
+	}
+	relay.mu.Unlock()
+	relay.follow(nil)
+}
+
+// relayedConn is a connection relayed by another node, on behalf of the visitor at [visitor]
+type relayedConn struct {
+	net.Conn
+	r       io.Reader
+	visitor net.Addr
+	scheme  string // the visitor used, for HTTP
+}
+
+func (conn *relayedConn) Read(b []byte) (int, error) { return conn.r.Read(b) }
+func (conn *relayedConn) RemoteAddr() net.Addr       { return conn.visitor }
+
+// closeWrite closes the writing half of [conn] if it supports it (ie. TCP and TLS connections), or all of it
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+		return
+	}
+	_ = conn.Close()
+}
+
+// relayedHTTP serves the HTTP requests relayed by other nodes as the HTTP edge would, over connections accepted
+// from the relay (rather than from a listener)
+type relayedHTTP struct {
+	server *http.Server
+	conns  chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+}
+
+// context key marking requests visitors made over HTTPS (on the node which relayed them)
+type relayedHTTPSKey struct{}
+
+// newRelayedHTTP returns a new relayedHTTP serving requests with [handler]
+func newRelayedHTTP(handler http.Handler) *relayedHTTP {
+	var rh = &relayedHTTP{conns: make(chan net.Conn), done: make(chan struct{})}
+	rh.server = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if secure, _ := r.Context().Value(relayedHTTPSKey{}).(bool); secure {
+				r.TLS = &tls.ConnectionState{HandshakeComplete: true, ServerName: r.Host}
+			}
+			handler.ServeHTTP(w, r)
+		}),
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			if rc, ok := conn.(*relayedConn); ok && rc.scheme == "https" {
+				ctx = context.WithValue(ctx, relayedHTTPSKey{}, true)
+			}
+			return ctx
+		},
+	}
+	go func() { _ = rh.server.Serve(rh) }()
+	return rh
+}
+
+// serve serves the requests on [conn]
+func (rh *relayedHTTP) serve(conn net.Conn) {
+	select {
+	case rh.conns <- conn:
+	case <-rh.done:
+		_ = conn.Close()
+	}
+}
+
+// Accept implements net.Listener, for the http.Server
+func (rh *relayedHTTP) Accept() (net.Conn, error) {
+	select {
+	case conn := <-rh.conns:
+		return conn, nil
+	case <-rh.done:
+		return nil, ErrClusterRelayClosed
+	}
+}
+
+// Close implements net.Listener, for the http.Server
+func (rh *relayedHTTP) Close() error {
+	rh.once.Do(func() { close(rh.done) })
+	return nil
+}
+
+// Addr implements net.Listener, for the http.Server
+func (rh *relayedHTTP) Addr() net.Addr { return &net.TCPAddr{} }
+
+// close stops serving requests, closing idle connections; requests being served carry on
+func (rh *relayedHTTP) close() {
+	if rh == nil {
+		return
+	}
+	_ = rh.server.Shutdown(context.Background())
+}
+
+// relayed handles [conn], relayed by another node for [endpoint] of this node
+func (srv *Server) relayed(endpoint string, conn *relayedConn) {
+	var parts = strings.SplitN(endpoint, ":", 2)
+	if len(parts) != 2 {
+		_ = conn.Close()
+		return
+	}
+
+	switch parts[0] {
+	case "http":
+		if srv.router == nil {
+			break
+		}
+		srv.relayedHTTP.serve(conn)
+		return
+
+	case "tls":
+		if srv.sni == nil {
+			break
+		}
+		srv.sni.handle(conn)
+		return
+
+	case "tcp":
+		if endpoint := srv.balancers.byPort(parts[1]); endpoint != nil {
+			forwardConnection(conn, endpoint.notify, endpoint.newChannel, endpoint.options, srv.forwarded)
+			return
+		}
+	}
+	_ = conn.Close()
+}
+
+// closeRelay stops accepting relayed connections, and relaying connections to other nodes
+func (srv *Server) closeRelay() {
+	if srv.cluster != nil {
+		srv.cluster.relay.close()
+	}
+	srv.relayedHTTP.close()
+}
+
+// ServeClusterRelay accepts connections relayed by other nodes of the cluster on [ln] (see Config.ClusterRelayAddr).
+// It always returns a non-nil error; after Shutdown or Close, the returned error is ErrClusterRelayClosed.
+func (srv *Server) ServeClusterRelay(ln net.Listener) error {
+	if srv.cluster == nil || srv.cluster.relay == nil {
+		return errors.New("cluster relay is not enabled")
+	}
+	return srv.cluster.relay.serve(ln)
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains the live reloading of the authorized_keys file and of the users section of the config file
+// (see watch.go): keys added to the file are allowed right away, and the connections of keys removed from it can be
+// closed (see Config.TerminateRemovedKeys).
+// ----------
+
+// liveConns is the registry of the ssh connections open on the server
+type liveConns struct {
+	mu    sync.Mutex
+	conns map[*connection]net.Conn
+}
+
+func newLiveConns() *liveConns { return &liveConns{conns: make(map[*connection]net.Conn)} }
+
+// add registers [conn] (over [nc]) until it goes away
+func (lc *liveConns) add(conn *connection, nc net.Conn) {
+	lc.mu.Lock()
+	lc.conns[conn] = nc
+	lc.mu.Unlock()
+
+	conn.group.Go(func(ctx context.Context) error {
+		<-ctx.Done()
+		lc.mu.Lock()
+		delete(lc.conns, conn)
+		lc.mu.Unlock()
+		return nil
+	})
+}
+
+// close closes the connection of [conn]
+func (lc *liveConns) close(conn *connection) {
+	lc.mu.Lock()
+	var nc = lc.conns[conn]
+	lc.mu.Unlock()
+
+	if nc != nil {
+		_ = nc.Close()
+	}
+}
+
+// of returns the connections which authenticated with any of [fingerprints]
+func (lc *liveConns) of(fingerprints []string) map[*connection]net.Conn {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	var conns = make(map[*connection]net.Conn)
+	for conn, nc := range lc.conns {
+		if fp := Fingerprint(conn.ctx); fp != "" && contains(fingerprints, fp) {
+			conns[conn] = nc
+		}
+	}
+	return conns
+}
+
+// reloadAuthorizedKeys re-reads the authorized_keys file, and closes the connections of the keys removed from it if
+// Config.TerminateRemovedKeys is set
+func (srv *Server) reloadAuthorizedKeys() {
+	removed, err := srv.keys.Reload()
+	if err != nil {
+		log.Printf("failed to reload %s: %s", srv.config.AuthorizedKeys, err.Error())
+		return
+	}
+	log.Printf("reloaded %s (%d keys removed)", srv.config.AuthorizedKeys, len(removed))
+
+	if !srv.config.TerminateRemovedKeys || len(removed) == 0 {
+		return
+	}
+
+	var conns = srv.conns.of(removed)
+	for conn := range conns {
+		conn.Notify("your key is no longer authorized; closing connection", kv("type", "key.removed"))
+	}
+	time.Sleep(100 * time.Millisecond) // give the sessions a moment to flush the message
+
+	for conn, nc := range conns {
+		log.Printf("closing connection of %s, as its key was removed", Fingerprint(conn.ctx))
+		_ = nc.Close()
+	}
+}
+
+// WatchConfig applies changes to the users section (Users and PermissionProfiles) of the config file at [path]
+// live, until the server shuts down. Other changes require a restart. Invalid versions of the file are ignored.
+func (srv *Server) WatchConfig(path string) {
+	go watchFile(path, srv.shutdown, func() {
+		config, err := LoadConfig(path)
+		if err == nil {
+			err = srv.profiles.update(config)
+		}
+
+		if err != nil {
+			log.Printf("failed to reload users from %s: %s", path, err.Error())
+			return
+		}
+		log.Printf("reloaded users from %s (%d users)", path, len(config.Users))
+	})
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bufio"
+	"github.com/pkg/errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ----------
+// This file contains IP reputation feeds: third-party blocklists (eg. Spamhaus DROP, or AbuseIPDB exports) whose
+// networks are denied from connecting to tunnels. Feeds are loaded on start, and refreshed in the background once stale.
+// ----------
+
+// maximum size of a feed we're willing to read
+const maxReputationFeedSize = 32 << 20
+
+// ReputationFeed is a blocklist of IP addresses / networks
+type ReputationFeed struct {
+	// name of the feed, used in logs and metrics (eg. "spamhaus-drop")
+	Name string `json:"name"`
+
+	// URL (or path of a local file) of the list. Each line holds an address or CIDR, optionally followed by
+	// other fields (separated by whitespace, commas or semicolons); comments start with ";" or "#".
+	URL string `json:"url"`
+}
+
+// reputationFeeds denies visitors listed in any of its feeds. A nil *reputationFeeds denies nothing.
+type reputationFeeds struct {
+	feeds   []ReputationFeed
+	client  *http.Client
+	refresh time.Duration
+
+	mu         sync.RWMutex
+	lists      map[string]*reputationList // by feed name
+	fetched    time.Time
+	refreshing int32 // set while a refresh is in progress
+}
+
+// reputationList is the content of a feed: single addresses are kept in a set, and networks in a list
+type reputationList struct {
+	addrs    map[string]struct{}
+	networks ipNetworks
+}
+
+// newReputationFeeds returns a new reputationFeeds using [feeds], which are loaded right away and refreshed every
+// [refresh]. It returns nil if there are no feeds.
+func newReputationFeeds(feeds []ReputationFeed, refresh time.Duration) (*reputationFeeds, error) {
+	if len(feeds) == 0 {
+		return nil, nil
+	}
+
+	var names = make(map[string]bool)
+	for _, feed := range feeds {
+		if feed.Name == "" || feed.URL == "" {
+			return nil, errors.New("reputation feeds need a name and url")
+		}
+		if names[feed.Name] {
+			return nil, errors.Errorf("duplicate reputation feed %q", feed.Name)
+		}
+		names[feed.Name] = true
+	}
+
+	var rep = &reputationFeeds{
+		feeds:   feeds,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		refresh: refresh,
+		lists:   make(map[string]*reputationList),
+	}
+	rep.refreshAll()
+	return rep, nil
+}
+
+// listedIn returns the name of the first feed listing the visitor at [addr], or an empty string if there's none
+func (rep *reputationFeeds) listedIn(addr net.Addr) string {
+	var ip = addrIP(addr)
+	if rep == nil || ip == nil {
+		return ""
+	}
+
+	rep.mu.RLock()
+	defer rep.mu.RUnlock()
+
+	if rep.refresh > 0 && time.Since(rep.fetched) > rep.refresh && atomic.CompareAndSwapInt32(&rep.refreshing, 0, 1) {
+		go rep.refreshAll()
+	}
+
+	for _, feed := range rep.feeds {
+		if list, ok := rep.lists[feed.Name]; ok && list.contains(ip) {
+			return feed.Name
+		}
+	}
+	return ""
+}
+
+// refreshAll re-loads every feed. If a feed fails to load, its previous list remains in effect.
+func (rep *reputationFeeds) refreshAll() {
+	defer atomic.StoreInt32(&rep.refreshing, 0)
+
+	for _, feed := range rep.feeds {
+		list, err := rep.load(feed.URL)
+		if err != nil {
+			log.Printf("failed to refresh reputation feed %s: %s", feed.Name, err.Error())
+			continue
+		}
+
+		rep.mu.Lock()
+		rep.lists[feed.Name] = list
+		rep.mu.Unlock()
+	}
+
+	rep.mu.Lock()
+	rep.fetched = time.Now()
+	rep.mu.Unlock()
+}
+
+// load reads the list at [source], a URL or the path of a local file. Unparseable lines are skipped.
+func (rep *reputationFeeds) load(source string) (*reputationList, error) {
+	var r io.Reader
+	if strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://") {
+		resp, err := rep.client.Get(source)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to fetch feed")
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.Errorf("failed to fetch feed: %s", resp.Status)
+		}
+		r = resp.Body
+	} else {
+		file, err := os.Open(source)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read feed")
+		}
+		defer file.Close()
+		r = file
+	}
+
+	var list = &reputationList{addrs: make(map[string]struct{})}
+	var scanner = bufio.NewScanner(io.LimitReader(r, maxReputationFeedSize))
+	for scanner.Scan() {
+		var line = scanner.Text()
+		if i := strings.IndexAny(line, ";#"); i >= 0 {
+			line = line[:i]
+		}
+
+		var fields = strings.FieldsFunc(line, func(c rune) bool { return c == ' ' || c == '\t' || c == ',' })
+		if len(fields) == 0 {
+			continue
+		}
+
+		if ip := net.ParseIP(fields[0]); ip != nil {
+			list.addrs[ip.String()] = struct{}{}
+		} else if _, network, err := net.ParseCIDR(fields[0]); err == nil {
+			list.networks = append(list.networks, network)
+		}
+	}
+
+	return list, errors.Wrap(scanner.Err(), "failed to read feed")
+}
+
+// contains returns true if [ip] is listed
+func (list *reputationList) contains(ip net.IP) bool {
+	if _, ok := list.addrs[ip.String()]; ok {
+		return true
+	}
+	return list.networks.contains(ip)
+}
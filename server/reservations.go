@@ -0,0 +1,199 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// ----------
+// This file contains the reservation store, which tracks HTTP tunnel names and TCP ports
+// reserved for a given key (identified by its fingerprint). Reservations are persisted as JSON.
+// ----------
+
+// reservations tracks names and ports reserved for keys, persisted to a JSON file
+type reservations struct {
+	path string
+
+	// shares the reservations changed (names and ports, by owner) with the other nodes of the cluster; nil unless
+	// clustered (see cluster.go)
+	published func(names map[string]string, ports map[uint32]string) error
+
+	mu    sync.RWMutex
+	Names map[string]string `json:"names"` // HTTP tunnel name => owner's key fingerprint
+	Ports map[uint32]string `json:"ports"` // TCP port => owner's key fingerprint
+}
+
+// loadReservations loads the reservations from the JSON file at [path]. A missing file is treated as empty.
+func loadReservations(path string) (*reservations, error) {
+	var store = &reservations{path: path, Names: make(map[string]string), Ports: make(map[uint32]string)}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to read reservations")
+	}
+
+	if err = json.Unmarshal(content, store); err != nil {
+		return nil, errors.Wrap(err, "failed to parse reservations")
+	}
+
+	if store.Names == nil {
+		store.Names = make(map[string]string)
+	}
+	if store.Ports == nil {
+		store.Ports = make(map[uint32]string)
+	}
+
+	return store, nil
+}
+
+// NameOwner returns fingerprint of the key that has reserved HTTP tunnel [name] (or empty if not reserved).
+// It is safe to call on a nil store, in which case nothing is reserved.
+func (store *reservations) NameOwner(name string) string {
+	if store == nil {
+		return ""
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return store.Names[name]
+}
+
+// PortOwner returns fingerprint of the key that has reserved TCP [port] (or empty if not reserved).
+// It is safe to call on a nil store, in which case nothing is reserved.
+func (store *reservations) PortOwner(port uint32) string {
+	if store == nil {
+		return ""
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return store.Ports[port]
+}
+
+// Transfer atomically transfers the reservation identified by [target] (an HTTP tunnel name or a TCP port)
+// to the key with fingerprint [to]. Unless [admin] is set, [from] must be the current owner of the reservation.
+// Any active tunnel using the reservation is left untouched.
+func (store *reservations) Transfer(target, from, to string, admin bool) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	// helpers to read / update the reservation identified by target
+	var get func() string
+	var set func(owner string)
+	if port, err := strconv.ParseUint(target, 10, 32); err == nil {
+		get = func() string { return store.Ports[uint32(port)] }
+		set = func(owner string) { store.Ports[uint32(port)] = owner }
+	} else {
+		get = func() string { return store.Names[target] }
+		set = func(owner string) { store.Names[target] = owner }
+	}
+
+	var owner = get()
+	if owner == "" {
+		return errors.Errorf("%q is not reserved", target)
+	}
+
+	if !admin && owner != from {
+		return errors.Errorf("%q is not reserved by you", target)
+	}
+
+	set(to)
+	if err := store.publish([]string{target}, to); err != nil {
+		set(owner)
+		return err
+	}
+	if err := store.save(); err != nil {
+		set(owner) // rollback so in-memory state stays consistent with what's on disk
+		return err
+	}
+
+	return nil
+}
+
+// TransferAll atomically transfers all reservations owned by the key with fingerprint [from] to [to]
+func (store *reservations) TransferAll(from, to string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var names, targets []string
+	var ports []uint32
+	for name, owner := range store.Names {
+		if owner == from {
+			names, targets = append(names, name), append(targets, name)
+			store.Names[name] = to
+		}
+	}
+
+	for port, owner := range store.Ports {
+		if owner == from {
+			ports, targets = append(ports, port), append(targets, strconv.Itoa(int(port)))
+			store.Ports[port] = to
+		}
+	}
+
+	var err = store.publish(targets, to)
+	if err == nil {
+		err = store.save()
+	}
+
+	if err != nil {
+		// rollback so in-memory state stays consistent with what's on disk
+		for _, name := range names {
+			store.Names[name] = from
+		}
+		for _, port := range ports {
+			store.Ports[port] = from
+		}
+		return err
+	}
+
+	return nil
+}
+
+// publish shares the reservations of [targets] (HTTP tunnel names or TCP ports), now owned by [owner], with the
+// other nodes of the cluster (if any)
+func (store *reservations) publish(targets []string, owner string) error {
+	if store.published == nil || len(targets) == 0 {
+		return nil
+	}
+
+	var names, ports = make(map[string]string), make(map[uint32]string)
+	for _, target := range targets {
+		if port, err := strconv.ParseUint(target, 10, 32); err == nil {
+			ports[uint32(port)] = owner
+		} else {
+			names[target] = owner
+		}
+	}
+	return store.published(names, ports)
+}
+
+// replace replaces the reservations with the ones shared by the cluster: [names] and [ports] (as strings), by owner.
+// They aren't persisted, as the file only seeds the cluster's.
+func (store *reservations) replace(names, ports map[string]string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.Names = names
+	store.Ports = make(map[uint32]string, len(ports))
+	for port, owner := range ports {
+		if p, err := strconv.ParseUint(port, 10, 32); err == nil {
+			store.Ports[uint32(p)] = owner
+		}
+	}
+}
+
+// save persists the reservations to disk. Must be called with lock held.
+func (store *reservations) save() error {
+	content, err := json.MarshalIndent(store, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal reservations")
+	}
+	return writeFileAtomic(store.path, content)
+}
@@ -0,0 +1,792 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ----------
+// This file contains the parser of the scripting language hooks are written in (see hooks.go): a subset of Starlark,
+// the dialect of Python used to configure Bazel. Scripts define functions (def) with if / elif / else, for loops over
+// lists, dicts and range(), return, break / continue and pass; and assignments (=, += and -=) of names and items.
+// Expressions are None, booleans, ints and strings, lists and dicts (and list comprehensions), attributes, indexing
+// and slicing, calls with positional and keyword arguments, arithmetic, comparisons, in / not in, and / or / not, and
+// conditional expressions. There are no floats, no while loops, no recursion, no lambdas, no load() and no classes.
+// See script_eval.go for their evaluation.
+//
+// It isn't go.starlark.net, to keep the server's dependencies to its ssh libraries (and pkg/errors): hooks are short
+// policies which need little of the language, and in this subset each call is bounded in time and depth (there's no
+// recursion, nor while loops), so that a hook can't hang or crash the server.
+// ----------
+
+// maximum nesting (of brackets, unary operators and blocks) in a script, so that parsing it is bounded in depth
+const scriptMaxNesting = 100
+
+// kinds of scriptToken
+const (
+	tokEOF = iota
+	tokNewline
+	tokIndent
+	tokDedent
+	tokName
+	tokInt
+	tokString
+	tokOp
+)
+
+// scriptKeywords can't be used as names
+var scriptKeywords = map[string]bool{
+	"and": true, "break": true, "continue": true, "def": true, "elif": true, "else": true, "for": true, "if": true,
+	"in": true, "not": true, "or": true, "pass": true, "return": true, "None": true, "True": true, "False": true,
+	"lambda": true, "load": true, "while": true, "class": true, "import": true, "global": true,
+}
+
+// scriptOps are the operators and punctuation of the language, longest first
+var scriptOps = []string{"//", "==", "!=", "<=", ">=", "+=", "-=", "+", "-", "*", "/", "%", "<", ">", "=", "(", ")",
+	"[", "]", "{", "}", ",", ":", "."}
+
+// scriptToken is a token of a script
+type scriptToken struct {
+	kind  int
+	text  string      // of names and operators
+	value interface{} // of ints (int64) and strings
+	line  int
+}
+
+// scriptError is an error at a line of a script
+type scriptError struct {
+	file string
+	line int
+	msg  string
+}
+
+func (e *scriptError) Error() string { return fmt.Sprintf("%s:%d: %s", e.file, e.line, e.msg) }
+
+// tokenizeScript splits the script [src] (from [file]) into tokens, with the indentation of lines as indent / dedent
+// tokens
+func tokenizeScript(file, src string) ([]scriptToken, error) {
+	var tokens []scriptToken
+	var indents = []int{0}
+	var depth = 0 // of brackets; newlines and indentation don't count inside them
+	var line = 1
+	var atLineStart = true
+
+	var fail = func(format string, args ...interface{}) ([]scriptToken, error) {
+		return nil, &scriptError{file: file, line: line, msg: fmt.Sprintf(format, args...)}
+	}
+
+	for i := 0; i < len(src); {
+		if atLineStart && depth == 0 {
+			var col = 0
+			var j = i
+			for ; j < len(src) && (src[j] == ' ' || src[j] == '\t'); j++ {
+				if src[j] == '\t' {
+					col += 8 - col%8
+				} else {
+					col++
+				}
+			}
+
+			// blank lines and comments don't count
+			if j == len(src) || src[j] == '\n' || src[j] == '#' || src[j] == '\r' {
+				for i = j; i < len(src) && src[i] != '\n'; i++ {
+				}
+				if i < len(src) {
+					line, i = line+1, i+1
+				}
+				continue
+			}
+
+			atLineStart, i = false, j
+			if col > indents[len(indents)-1] {
+				indents = append(indents, col)
+				tokens = append(tokens, scriptToken{kind: tokIndent, line: line})
+			}
+			for col < indents[len(indents)-1] {
+				indents = indents[:len(indents)-1]
+				tokens = append(tokens, scriptToken{kind: tokDedent, line: line})
+			}
+			if col != indents[len(indents)-1] {
+				return fail("unindent does not match any outer indentation level")
+			}
+		}
+
+		var c = src[i]
+		switch {
+		case c == '\n':
+			if depth == 0 && !atLineStart {
+				tokens = append(tokens, scriptToken{kind: tokNewline, line: line})
+				atLineStart = true
+			}
+			line, i = line+1, i+1
+
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+
+		case c == '\\' && i+1 < len(src) && src[i+1] == '\n':
+			line, i = line+1, i+2
+
+		case c == '#':
+			for ; i < len(src) && src[i] != '\n'; i++ {
+			}
+
+		case c == '_' || isLetter(c):
+			var j = i
+			for ; j < len(src) && (src[j] == '_' || isLetter(src[j]) || isDigit(src[j])); j++ {
+			}
+			tokens = append(tokens, scriptToken{kind: tokName, text: src[i:j], line: line})
+			i = j
+
+		case isDigit(c):
+			var j = i
+			for ; j < len(src) && (isDigit(src[j]) || isLetter(src[j]) || src[j] == '_'); j++ {
+			}
+			n, err := strconv.ParseInt(strings.Replace(src[i:j], "_", "", -1), 0, 64)
+			if err != nil {
+				return fail("invalid int %q", src[i:j])
+			}
+			tokens = append(tokens, scriptToken{kind: tokInt, value: n, line: line})
+			i = j
+
+		case c == '"' || c == '\'':
+			s, n, lines, err := scanScriptString(src[i:])
+			if err != nil {
+				return fail("%s", err.Error())
+			}
+			tokens = append(tokens, scriptToken{kind: tokString, value: s, line: line})
+			line, i = line+lines, i+n
+
+		default:
+			var op string
+			for _, candidate := range scriptOps {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return fail("unexpected character %q", c)
+			}
+
+			switch op {
+			case "(", "[", "{":
+				depth++
+			case ")", "]", "}":
+				if depth--; depth < 0 {
+					return fail("unexpected %q", op)
+				}
+			}
+			tokens = append(tokens, scriptToken{kind: tokOp, text: op, line: line})
+			i += len(op)
+		}
+	}
+
+	if depth > 0 {
+		return fail("unexpected end of file (unclosed bracket)")
+	}
+	if !atLineStart {
+		tokens = append(tokens, scriptToken{kind: tokNewline, line: line})
+	}
+	for len(indents) > 1 {
+		indents = indents[:len(indents)-1]
+		tokens = append(tokens, scriptToken{kind: tokDedent, line: line})
+	}
+	return append(tokens, scriptToken{kind: tokEOF, line: line}), nil
+}
+
+// scanScriptString scans the string literal (quoted with ' or ", or tripled) [src] starts with, returning its value,
+// its length and the number of newlines in it
+func scanScriptString(src string) (value string, n int, lines int, err error) {
+	var quote = src[:1]
+	if strings.HasPrefix(src, strings.Repeat(quote, 3)) {
+		quote = strings.Repeat(quote, 3)
+	}
+
+	var b strings.Builder
+	for i := len(quote); i < len(src); {
+		switch c := src[i]; {
+		case strings.HasPrefix(src[i:], quote):
+			return b.String(), i + len(quote), lines, nil
+
+		case c == '\n' && len(quote) == 1:
+			return "", 0, 0, fmt.Errorf("unterminated string")
+
+		case c == '\\' && i+1 < len(src):
+			var escaped = map[byte]string{'n': "\n", 't': "\t", 'r': "\r", '\\': "\\", '\'': "'", '"': "\"", '0': "\x00", '\n': ""}
+			if s, ok := escaped[src[i+1]]; ok {
+				if src[i+1] == '\n' {
+					lines++
+				}
+				b.WriteString(s)
+			} else {
+				b.WriteByte('\\')
+				b.WriteByte(src[i+1])
+			}
+			i += 2
+
+		default:
+			if c == '\n' {
+				lines++
+			}
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return "", 0, 0, fmt.Errorf("unterminated string")
+}
+
+func isLetter(c byte) bool { return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') }
+func isDigit(c byte) bool  { return c >= '0' && c <= '9' }
+
+// nodes of the syntax tree of scripts (see scriptParser)
+type (
+	identExpr struct {
+		name string
+		line int
+	}
+
+	literalExpr struct{ value interface{} }
+
+	listExpr struct{ elems []interface{} }
+
+	dictExpr struct{ keys, values []interface{} }
+
+	// [elem for vars in iter if cond]
+	comprehensionExpr struct {
+		elem, iter, cond interface{}
+		vars             []string
+		line             int
+	}
+
+	unaryExpr struct {
+		op   string
+		x    interface{}
+		line int
+	}
+
+	binaryExpr struct {
+		op   string
+		x, y interface{}
+		line int
+	}
+
+	// then if cond else otherwise
+	condExpr struct{ cond, then, otherwise interface{} }
+
+	dotExpr struct {
+		x    interface{}
+		name string
+		line int
+	}
+
+	indexExpr struct {
+		x, index interface{}
+		line     int
+	}
+
+	sliceExpr struct {
+		x, lo, hi interface{} // lo and hi may be nil
+		line      int
+	}
+
+	callExpr struct {
+		fn     interface{}
+		args   []interface{}
+		kwargs []keywordArg
+		line   int
+	}
+
+	keywordArg struct {
+		name  string
+		value interface{}
+	}
+
+	exprStmt struct{ x interface{} }
+
+	assignStmt struct {
+		target interface{} // identExpr or indexExpr
+		op     string      // =, += or -=
+		value  interface{}
+		line   int
+	}
+
+	ifStmt struct {
+		cond            interface{}
+		body, otherwise []interface{}
+		line            int
+	}
+
+	forStmt struct {
+		vars []string
+		iter interface{}
+		body []interface{}
+		line int
+	}
+
+	defStmt struct {
+		name   string
+		params []scriptParam
+		body   []interface{}
+		line   int
+	}
+
+	scriptParam struct {
+		name string
+		def  interface{} // default value, nil if none
+	}
+
+	returnStmt struct {
+		x    interface{} // nil to return None
+		line int
+	}
+
+	// pass, break or continue
+	branchStmt struct {
+		keyword string
+		line    int
+	}
+)
+
+// scriptParser parses the tokens of a script into statements, by recursive descent
+type scriptParser struct {
+	file   string
+	tokens []scriptToken
+	pos    int
+	depth  int // of nesting, see nest
+}
+
+// parseScript parses the script [src] (from [file]) into statements
+func parseScript(file, src string) (stmts []interface{}, err error) {
+	tokens, err := tokenizeScript(file, src)
+	if err != nil {
+		return nil, err
+	}
+
+	var p = &scriptParser{file: file, tokens: tokens}
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(*scriptError); ok {
+				stmts, err = nil, e
+				return
+			}
+			panic(r)
+		}
+	}()
+
+	for p.peek().kind != tokEOF {
+		stmts = append(stmts, p.statement()...)
+	}
+	return stmts, nil
+}
+
+func (p *scriptParser) peek() scriptToken { return p.tokens[p.pos] }
+
+func (p *scriptParser) next() scriptToken {
+	var t = p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// fail aborts parsing with an error at the current token (recovered by parseScript)
+func (p *scriptParser) fail(format string, args ...interface{}) {
+	panic(&scriptError{file: p.file, line: p.peek().line, msg: fmt.Sprintf(format, args...)})
+}
+
+// nest enters a nested construct, failing if it's nested too deeply; the returned func leaves it
+func (p *scriptParser) nest() func() {
+	if p.depth++; p.depth > scriptMaxNesting {
+		p.fail("too deeply nested (over %d levels)", scriptMaxNesting)
+	}
+	return func() { p.depth-- }
+}
+
+// is returns true if the current token is the operator or keyword [text]
+func (p *scriptParser) is(text string) bool {
+	var t = p.peek()
+	return (t.kind == tokOp || t.kind == tokName) && t.text == text
+}
+
+// accept consumes the current token if it's the operator or keyword [text]
+func (p *scriptParser) accept(text string) bool {
+	if p.is(text) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+// expect consumes the operator or keyword [text], failing if it isn't next
+func (p *scriptParser) expect(text string) scriptToken {
+	if !p.is(text) {
+		p.fail("expected %q, found %s", text, describeToken(p.peek()))
+	}
+	return p.next()
+}
+
+// name consumes a name (that isn't a keyword)
+func (p *scriptParser) name() string {
+	var t = p.peek()
+	if t.kind != tokName || scriptKeywords[t.text] {
+		p.fail("expected a name, found %s", describeToken(t))
+	}
+	return p.next().text
+}
+
+// statement parses a statement; a line of simple statements separated by ; isn't supported
+func (p *scriptParser) statement() []interface{} {
+	defer p.nest()()
+	var t = p.peek()
+	switch {
+	case p.is("def"):
+		return []interface{}{p.def()}
+	case p.is("if"):
+		p.next()
+		return []interface{}{p.ifRest(t.line)}
+	case p.is("for"):
+		p.next()
+		var vars = p.names()
+		p.expect("in")
+		var iter = p.expression()
+		p.expect(":")
+		return []interface{}{&forStmt{vars: vars, iter: iter, body: p.suite(), line: t.line}}
+	case t.kind == tokIndent:
+		p.fail("unexpected indentation")
+	}
+
+	var stmt = p.simpleStatement()
+	if p.peek().kind != tokNewline {
+		p.fail("expected end of line, found %s", describeToken(p.peek()))
+	}
+	p.next()
+	return []interface{}{stmt}
+}
+
+func (p *scriptParser) def() interface{} {
+	var line = p.expect("def").line
+	var name = p.name()
+	var params []scriptParam
+
+	p.expect("(")
+	for !p.is(")") {
+		var param = scriptParam{name: p.name()}
+		if p.accept("=") {
+			param.def = p.expression()
+		} else if len(params) > 0 && params[len(params)-1].def != nil {
+			p.fail("parameter %s without a default follows one with a default", param.name)
+		}
+		params = append(params, param)
+		if !p.accept(",") {
+			break
+		}
+	}
+	p.expect(")")
+	p.expect(":")
+	return &defStmt{name: name, params: params, body: p.suite(), line: line}
+}
+
+// ifRest parses an if (or elif) statement, after its keyword
+func (p *scriptParser) ifRest(line int) interface{} {
+	var stmt = &ifStmt{cond: p.expression(), line: line}
+	p.expect(":")
+	stmt.body = p.suite()
+
+	if t := p.peek(); p.accept("elif") {
+		stmt.otherwise = []interface{}{p.ifRest(t.line)}
+	} else if p.accept("else") {
+		p.expect(":")
+		stmt.otherwise = p.suite()
+	}
+	return stmt
+}
+
+// suite parses the body of a compound statement: an indented block, or a simple statement on the same line
+func (p *scriptParser) suite() []interface{} {
+	if p.peek().kind != tokNewline {
+		var stmt = p.simpleStatement()
+		if p.peek().kind != tokNewline {
+			p.fail("expected end of line, found %s", describeToken(p.peek()))
+		}
+		p.next()
+		return []interface{}{stmt}
+	}
+
+	p.next()
+	if p.peek().kind != tokIndent {
+		p.fail("expected an indented block")
+	}
+	p.next()
+
+	var stmts []interface{}
+	for p.peek().kind != tokDedent && p.peek().kind != tokEOF {
+		stmts = append(stmts, p.statement()...)
+	}
+	p.next()
+	return stmts
+}
+
+func (p *scriptParser) simpleStatement() interface{} {
+	var t = p.peek()
+	switch {
+	case p.accept("return"):
+		if p.peek().kind == tokNewline {
+			return &returnStmt{line: t.line}
+		}
+		return &returnStmt{x: p.expression(), line: t.line}
+	case p.accept("pass"), p.accept("break"), p.accept("continue"):
+		return &branchStmt{keyword: t.text, line: t.line}
+	}
+
+	var x = p.expression()
+	for _, op := range []string{"=", "+=", "-="} {
+		if p.accept(op) {
+			switch x.(type) {
+			case *identExpr, *indexExpr:
+			default:
+				p.fail("can't assign to this expression")
+			}
+			return &assignStmt{target: x, op: op, value: p.expression(), line: t.line}
+		}
+	}
+	return &exprStmt{x: x}
+}
+
+// names parses a comma-separated list of names (eg. the variables of a for loop)
+func (p *scriptParser) names() []string {
+	var names = []string{p.name()}
+	for p.accept(",") {
+		names = append(names, p.name())
+	}
+	return names
+}
+
+// expression parses a conditional expression (or anything of higher precedence)
+func (p *scriptParser) expression() interface{} {
+	defer p.nest()()
+	var x = p.or()
+	if p.accept("if") {
+		var cond = p.or()
+		p.expect("else")
+		return &condExpr{cond: cond, then: x, otherwise: p.expression()}
+	}
+	return x
+}
+
+func (p *scriptParser) or() interface{} {
+	var x = p.and()
+	for t := p.peek(); p.accept("or"); t = p.peek() {
+		x = &binaryExpr{op: "or", x: x, y: p.and(), line: t.line}
+	}
+	return x
+}
+
+func (p *scriptParser) and() interface{} {
+	var x = p.not()
+	for t := p.peek(); p.accept("and"); t = p.peek() {
+		x = &binaryExpr{op: "and", x: x, y: p.not(), line: t.line}
+	}
+	return x
+}
+
+func (p *scriptParser) not() interface{} {
+	if t := p.peek(); p.accept("not") {
+		defer p.nest()()
+		return &unaryExpr{op: "not", x: p.not(), line: t.line}
+	}
+	return p.comparison()
+}
+
+// comparison parses a comparison; like in Starlark, they don't chain
+func (p *scriptParser) comparison() interface{} {
+	var x = p.arithmetic()
+	var t = p.peek()
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">", "in"} {
+		if p.accept(op) {
+			return &binaryExpr{op: op, x: x, y: p.arithmetic(), line: t.line}
+		}
+	}
+	if p.is("not") && p.tokens[p.pos+1].kind == tokName && p.tokens[p.pos+1].text == "in" {
+		p.next()
+		p.next()
+		return &binaryExpr{op: "not in", x: x, y: p.arithmetic(), line: t.line}
+	}
+	return x
+}
+
+func (p *scriptParser) arithmetic() interface{} {
+	var x = p.term()
+	for t := p.peek(); p.is("+") || p.is("-"); t = p.peek() {
+		p.next()
+		x = &binaryExpr{op: t.text, x: x, y: p.term(), line: t.line}
+	}
+	return x
+}
+
+func (p *scriptParser) term() interface{} {
+	var x = p.unary()
+	for t := p.peek(); p.is("*") || p.is("/") || p.is("//") || p.is("%"); t = p.peek() {
+		p.next()
+		x = &binaryExpr{op: t.text, x: x, y: p.unary(), line: t.line}
+	}
+	return x
+}
+
+func (p *scriptParser) unary() interface{} {
+	if t := p.peek(); p.accept("-") || p.accept("+") {
+		defer p.nest()()
+		return &unaryExpr{op: t.text, x: p.unary(), line: t.line}
+	}
+	return p.primary()
+}
+
+// primary parses an operand, followed by any attributes, indexes, slices and calls
+func (p *scriptParser) primary() interface{} {
+	var x = p.operand()
+	for {
+		var t = p.peek()
+		switch {
+		case p.accept("."):
+			x = &dotExpr{x: x, name: p.name(), line: t.line}
+
+		case p.accept("["):
+			var lo, hi interface{}
+			if !p.is(":") {
+				lo = p.expression()
+			}
+			if p.accept(":") {
+				if !p.is("]") {
+					hi = p.expression()
+				}
+				p.expect("]")
+				x = &sliceExpr{x: x, lo: lo, hi: hi, line: t.line}
+				continue
+			}
+			p.expect("]")
+			x = &indexExpr{x: x, index: lo, line: t.line}
+
+		case p.accept("("):
+			var call = &callExpr{fn: x, line: t.line}
+			for !p.is(")") {
+				if p.peek().kind == tokName && p.tokens[p.pos+1].kind == tokOp && p.tokens[p.pos+1].text == "=" {
+					var name = p.name()
+					p.next()
+					call.kwargs = append(call.kwargs, keywordArg{name: name, value: p.expression()})
+				} else if len(call.kwargs) > 0 {
+					p.fail("positional argument follows keyword argument")
+				} else {
+					call.args = append(call.args, p.expression())
+				}
+				if !p.accept(",") {
+					break
+				}
+			}
+			p.expect(")")
+			x = call
+
+		default:
+			return x
+		}
+	}
+}
+
+func (p *scriptParser) operand() interface{} {
+	var t = p.peek()
+	switch {
+	case t.kind == tokInt:
+		p.next()
+		return &literalExpr{value: t.value}
+
+	case t.kind == tokString:
+		// adjacent strings are concatenated
+		var s = p.next().value.(string)
+		for p.peek().kind == tokString {
+			s += p.next().value.(string)
+		}
+		return &literalExpr{value: s}
+
+	case p.accept("None"):
+		return &literalExpr{value: nil}
+	case p.accept("True"):
+		return &literalExpr{value: true}
+	case p.accept("False"):
+		return &literalExpr{value: false}
+
+	case p.accept("("):
+		var x = p.expression()
+		if p.is(",") { // tuples are lists
+			var elems = []interface{}{x}
+			for p.accept(",") && !p.is(")") {
+				elems = append(elems, p.expression())
+			}
+			x = &listExpr{elems: elems}
+		}
+		p.expect(")")
+		return x
+
+	case p.accept("["):
+		if p.accept("]") {
+			return &listExpr{}
+		}
+
+		var first = p.expression()
+		if t := p.peek(); p.accept("for") {
+			var comp = &comprehensionExpr{elem: first, vars: p.names(), line: t.line}
+			p.expect("in")
+			comp.iter = p.or()
+			if p.accept("if") {
+				comp.cond = p.or()
+			}
+			p.expect("]")
+			return comp
+		}
+
+		var list = &listExpr{elems: []interface{}{first}}
+		for p.accept(",") && !p.is("]") {
+			list.elems = append(list.elems, p.expression())
+		}
+		p.expect("]")
+		return list
+
+	case p.accept("{"):
+		var dict = &dictExpr{}
+		for !p.is("}") {
+			dict.keys = append(dict.keys, p.expression())
+			p.expect(":")
+			dict.values = append(dict.values, p.expression())
+			if !p.accept(",") {
+				break
+			}
+		}
+		p.expect("}")
+		return dict
+
+	case t.kind == tokName && !scriptKeywords[t.text]:
+		p.next()
+		return &identExpr{name: t.text, line: t.line}
+	}
+
+	p.fail("unexpected %s", describeToken(t))
+	return nil
+}
+
+// describeToken describes [t] for errors
+func describeToken(t scriptToken) string {
+	switch t.kind {
+	case tokEOF:
+		return "end of file"
+	case tokNewline:
+		return "end of line"
+	case tokIndent:
+		return "indentation"
+	case tokDedent:
+		return "unindent"
+	case tokInt:
+		return fmt.Sprintf("%d", t.value)
+	case tokString:
+		return strconv.Quote(t.value.(string))
+	default:
+		return strconv.Quote(t.text)
+	}
+}
@@ -0,0 +1,1283 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ----------
+// This file contains the evaluation of scripts (see script.go). Values are None (nil), booleans, ints (int64),
+// strings, lists (*scriptList), dicts (*scriptDict), functions, and structs (*scriptStruct) whose attributes are
+// read-only. Like in Starlark, whatever a script's top level defines is frozen once it has run, so that functions
+// can be called concurrently (eg. by hooks) without changing the module's state; and each call is limited in the
+// number of steps it takes, so that a runaway loop can't hang the server, and in the depth of the expressions (and
+// calls) it evaluates, so that a long chain of them can't exhaust its stack.
+// ----------
+
+const (
+	// maximum number of statements (and loop iterations) executed by a call into a script, or by its top level
+	scriptMaxSteps = 100000
+
+	// maximum length of lists built by range(), and by repeating strings
+	scriptMaxLength = 100000
+
+	// maximum depth of the expressions (and calls) being evaluated by a call, eg. of 1 + 1 + ... + 1
+	scriptMaxDepth = 1000
+)
+
+// scriptList is a list (or tuple) of values
+type scriptList struct {
+	elems  []interface{}
+	frozen bool
+}
+
+// scriptDict is a dict of values, which keeps its keys in insertion order
+type scriptDict struct {
+	keys   []interface{}
+	values map[interface{}]interface{}
+	frozen bool
+}
+
+// scriptStruct is a value with named, read-only attributes (eg. the details of a request passed to a hook)
+type scriptStruct struct {
+	name   string
+	fields map[string]interface{}
+}
+
+// scriptFunction is a function defined by a script
+type scriptFunction struct {
+	def      *defStmt
+	defaults []interface{}
+	env      *scriptEnv // the function was defined in
+}
+
+// scriptBuiltin is a function (or method) implemented by the server
+type scriptBuiltin struct {
+	name string
+	fn   func(args []interface{}, kwargs []keywordValue) (interface{}, error)
+}
+
+// keywordValue is a keyword argument of a call
+type keywordValue struct {
+	name  string
+	value interface{}
+}
+
+// scriptEnv holds the variables of a module, or of a call
+type scriptEnv struct {
+	vars   map[string]interface{}
+	parent *scriptEnv
+}
+
+// scriptThread is the state of the execution of a module, or of a call into it
+type scriptThread struct {
+	file  string
+	steps int
+	depth int               // of expressions being evaluated
+	line  int               // of the last step, where a panic of the interpreter is reported (see recover)
+	stack []*scriptFunction // calls in progress, to reject recursion
+}
+
+// scriptModule is a script which has run; its globals are frozen
+type scriptModule struct {
+	file    string
+	globals *scriptEnv
+}
+
+// control flow resulting from the execution of statements
+const (
+	flowNext = iota
+	flowReturn
+	flowBreak
+	flowContinue
+)
+
+// loadScript parses and runs the script [src] (from [file]), returning the module it defines
+func loadScript(file, src string) (*scriptModule, error) {
+	stmts, err := parseScript(file, src)
+	if err != nil {
+		return nil, err
+	}
+
+	var module = &scriptModule{file: file, globals: &scriptEnv{vars: make(map[string]interface{})}}
+	var th = &scriptThread{file: file}
+	flow, err := th.run(stmts, module.globals)
+	if err != nil {
+		return nil, err
+	} else if flow != flowNext {
+		return nil, &scriptError{file: file, line: 1, msg: "return, break and continue must be inside a function (or loop)"}
+	}
+
+	for _, v := range module.globals.vars {
+		freezeScriptValue(v)
+	}
+	return module, nil
+}
+
+// function returns the function [name] defined by the module, or nil if there's none
+func (module *scriptModule) function(name string) *scriptFunction {
+	fn, _ := module.globals.vars[name].(*scriptFunction)
+	return fn
+}
+
+// call calls [fn] with [args]
+func (module *scriptModule) call(fn *scriptFunction, args ...interface{}) (_ interface{}, err error) {
+	var th = &scriptThread{file: module.file, line: fn.def.line}
+	defer th.recover(&err)
+	return th.call(fn, args, nil, fn.def.line)
+}
+
+// run executes the top-level statements [stmts] of a module in [env], returning the resulting control flow
+func (th *scriptThread) run(stmts []interface{}, env *scriptEnv) (flow int, err error) {
+	defer th.recover(&err)
+	flow, _, err = th.exec(stmts, env)
+	return flow, err
+}
+
+// recover returns a panic of the interpreter (ie. a bug of it, which a script ran into) as an error in [err], so that
+// a script can't take the server down. It must be deferred.
+func (th *scriptThread) recover(err *error) {
+	if r := recover(); r != nil {
+		log.Printf("hooks: %s:%d: panic: %v\n%s", th.file, th.line, r, debug.Stack())
+		*err = th.errorf(th.line, "internal error: %v", r)
+	}
+}
+
+// freezeScriptValue makes [v] (and what it contains) immutable
+func freezeScriptValue(v interface{}) {
+	switch v := v.(type) {
+	case *scriptList:
+		if !v.frozen {
+			v.frozen = true
+			for _, elem := range v.elems {
+				freezeScriptValue(elem)
+			}
+		}
+	case *scriptDict:
+		if !v.frozen {
+			v.frozen = true
+			for _, value := range v.values {
+				freezeScriptValue(value)
+			}
+		}
+	case *scriptFunction:
+		for _, def := range v.defaults {
+			freezeScriptValue(def)
+		}
+	}
+}
+
+// errorf returns an error at [line]
+func (th *scriptThread) errorf(line int, format string, args ...interface{}) error {
+	return &scriptError{file: th.file, line: line, msg: fmt.Sprintf(format, args...)}
+}
+
+// at positions [err] at [line], unless it's positioned already
+func (th *scriptThread) at(line int, err error) error {
+	if _, ok := err.(*scriptError); ok || err == nil {
+		return err
+	}
+	return &scriptError{file: th.file, line: line, msg: err.Error()}
+}
+
+// step accounts for a step of execution at [line]
+func (th *scriptThread) step(line int) error {
+	th.line = line
+	if th.steps++; th.steps > scriptMaxSteps {
+		return th.errorf(line, "too many steps (over %d)", scriptMaxSteps)
+	}
+	return nil
+}
+
+// exec executes [stmts] in [env]
+func (th *scriptThread) exec(stmts []interface{}, env *scriptEnv) (int, interface{}, error) {
+	for _, stmt := range stmts {
+		var flow, value, err = th.execOne(stmt, env)
+		if err != nil || flow != flowNext {
+			return flow, value, err
+		}
+	}
+	return flowNext, nil, nil
+}
+
+func (th *scriptThread) execOne(stmt interface{}, env *scriptEnv) (int, interface{}, error) {
+	switch stmt := stmt.(type) {
+	case *exprStmt:
+		_, err := th.eval(stmt.x, env)
+		return flowNext, nil, err
+
+	case *assignStmt:
+		if err := th.step(stmt.line); err != nil {
+			return flowNext, nil, err
+		}
+		return flowNext, nil, th.assign(stmt, env)
+
+	case *ifStmt:
+		if err := th.step(stmt.line); err != nil {
+			return flowNext, nil, err
+		}
+		cond, err := th.eval(stmt.cond, env)
+		if err != nil {
+			return flowNext, nil, err
+		}
+		if scriptTruth(cond) {
+			return th.exec(stmt.body, env)
+		}
+		return th.exec(stmt.otherwise, env)
+
+	case *forStmt:
+		iter, err := th.eval(stmt.iter, env)
+		if err != nil {
+			return flowNext, nil, err
+		}
+		elems, err := scriptIterate(iter)
+		if err != nil {
+			return flowNext, nil, th.at(stmt.line, err)
+		}
+
+		for _, elem := range elems {
+			if err = th.step(stmt.line); err != nil {
+				return flowNext, nil, err
+			}
+			if err = th.bind(stmt.vars, elem, env, stmt.line); err != nil {
+				return flowNext, nil, err
+			}
+
+			flow, value, err := th.exec(stmt.body, env)
+			if err != nil || flow == flowReturn {
+				return flow, value, err
+			} else if flow == flowBreak {
+				break
+			}
+		}
+		return flowNext, nil, nil
+
+	case *defStmt:
+		var fn = &scriptFunction{def: stmt, env: env}
+		for _, param := range stmt.params {
+			var def interface{}
+			if param.def != nil {
+				var err error
+				if def, err = th.eval(param.def, env); err != nil {
+					return flowNext, nil, err
+				}
+			}
+			fn.defaults = append(fn.defaults, def)
+		}
+		env.vars[stmt.name] = fn
+		return flowNext, nil, nil
+
+	case *returnStmt:
+		if stmt.x == nil {
+			return flowReturn, nil, nil
+		}
+		value, err := th.eval(stmt.x, env)
+		return flowReturn, value, err
+
+	case *branchStmt:
+		switch stmt.keyword {
+		case "break":
+			return flowBreak, nil, nil
+		case "continue":
+			return flowContinue, nil, nil
+		}
+		return flowNext, nil, nil
+	}
+	return flowNext, nil, fmt.Errorf("unknown statement %T", stmt)
+}
+
+// assign executes the assignment [stmt]
+func (th *scriptThread) assign(stmt *assignStmt, env *scriptEnv) error {
+	value, err := th.eval(stmt.value, env)
+	if err != nil {
+		return err
+	}
+
+	if stmt.op != "=" {
+		current, err := th.eval(stmt.target, env)
+		if err != nil {
+			return err
+		}
+		if value, err = scriptBinary(strings.TrimSuffix(stmt.op, "="), current, value); err != nil {
+			return th.at(stmt.line, err)
+		}
+	}
+
+	switch target := stmt.target.(type) {
+	case *identExpr:
+		env.vars[target.name] = value
+		return nil
+	case *indexExpr:
+		x, err := th.eval(target.x, env)
+		if err != nil {
+			return err
+		}
+		index, err := th.eval(target.index, env)
+		if err != nil {
+			return err
+		}
+		return th.at(stmt.line, scriptSetIndex(x, index, value))
+	}
+	return th.errorf(stmt.line, "can't assign to this expression")
+}
+
+// bind assigns [value] to [vars] in [env], unpacking it if there are several
+func (th *scriptThread) bind(vars []string, value interface{}, env *scriptEnv, line int) error {
+	if len(vars) == 1 {
+		env.vars[vars[0]] = value
+		return nil
+	}
+
+	var list, ok = value.(*scriptList)
+	if !ok || len(list.elems) != len(vars) {
+		return th.errorf(line, "can't unpack %s into %d variables", scriptType(value), len(vars))
+	}
+	for i, name := range vars {
+		env.vars[name] = list.elems[i]
+	}
+	return nil
+}
+
+// eval evaluates the expression [x] in [env]
+func (th *scriptThread) eval(x interface{}, env *scriptEnv) (interface{}, error) {
+	if th.depth++; th.depth > scriptMaxDepth {
+		return nil, th.errorf(th.line, "too deeply nested (over %d levels)", scriptMaxDepth)
+	}
+	defer func() { th.depth-- }()
+
+	switch x := x.(type) {
+	case *literalExpr:
+		return x.value, nil
+
+	case *identExpr:
+		for e := env; e != nil; e = e.parent {
+			if v, ok := e.vars[x.name]; ok {
+				return v, nil
+			}
+		}
+		if b, ok := scriptBuiltins[x.name]; ok {
+			return b, nil
+		}
+		return nil, th.errorf(x.line, "undefined: %s", x.name)
+
+	case *listExpr:
+		var list = &scriptList{}
+		for _, elem := range x.elems {
+			v, err := th.eval(elem, env)
+			if err != nil {
+				return nil, err
+			}
+			list.elems = append(list.elems, v)
+		}
+		return list, nil
+
+	case *dictExpr:
+		var dict = newScriptDict()
+		for i := range x.keys {
+			k, err := th.eval(x.keys[i], env)
+			if err != nil {
+				return nil, err
+			}
+			v, err := th.eval(x.values[i], env)
+			if err != nil {
+				return nil, err
+			}
+			if err = dict.set(k, v); err != nil {
+				return nil, err
+			}
+		}
+		return dict, nil
+
+	case *comprehensionExpr:
+		iter, err := th.eval(x.iter, env)
+		if err != nil {
+			return nil, err
+		}
+		elems, err := scriptIterate(iter)
+		if err != nil {
+			return nil, th.at(x.line, err)
+		}
+
+		var list = &scriptList{}
+		var inner = &scriptEnv{vars: make(map[string]interface{}), parent: env}
+		for _, elem := range elems {
+			if err = th.step(x.line); err != nil {
+				return nil, err
+			}
+			if err = th.bind(x.vars, elem, inner, x.line); err != nil {
+				return nil, err
+			}
+			if x.cond != nil {
+				cond, err := th.eval(x.cond, inner)
+				if err != nil {
+					return nil, err
+				} else if !scriptTruth(cond) {
+					continue
+				}
+			}
+			v, err := th.eval(x.elem, inner)
+			if err != nil {
+				return nil, err
+			}
+			list.elems = append(list.elems, v)
+		}
+		return list, nil
+
+	case *unaryExpr:
+		v, err := th.eval(x.x, env)
+		if err != nil {
+			return nil, err
+		}
+		switch x.op {
+		case "not":
+			return !scriptTruth(v), nil
+		case "-", "+":
+			n, ok := v.(int64)
+			if !ok {
+				return nil, th.errorf(x.line, "unary %s on %s", x.op, scriptType(v))
+			}
+			if x.op == "-" {
+				n = -n
+			}
+			return n, nil
+		}
+
+	case *binaryExpr:
+		a, err := th.eval(x.x, env)
+		if err != nil {
+			return nil, err
+		}
+
+		// and / or short-circuit, and evaluate to one of their operands
+		switch x.op {
+		case "and":
+			if !scriptTruth(a) {
+				return a, nil
+			}
+			return th.eval(x.y, env)
+		case "or":
+			if scriptTruth(a) {
+				return a, nil
+			}
+			return th.eval(x.y, env)
+		}
+
+		b, err := th.eval(x.y, env)
+		if err != nil {
+			return nil, err
+		}
+		v, err := scriptBinary(x.op, a, b)
+		return v, th.at(x.line, err)
+
+	case *condExpr:
+		cond, err := th.eval(x.cond, env)
+		if err != nil {
+			return nil, err
+		}
+		if scriptTruth(cond) {
+			return th.eval(x.then, env)
+		}
+		return th.eval(x.otherwise, env)
+
+	case *dotExpr:
+		v, err := th.eval(x.x, env)
+		if err != nil {
+			return nil, err
+		}
+		attr, err := scriptAttr(v, x.name)
+		return attr, th.at(x.line, err)
+
+	case *indexExpr:
+		v, err := th.eval(x.x, env)
+		if err != nil {
+			return nil, err
+		}
+		index, err := th.eval(x.index, env)
+		if err != nil {
+			return nil, err
+		}
+		elem, err := scriptIndex(v, index)
+		return elem, th.at(x.line, err)
+
+	case *sliceExpr:
+		v, err := th.eval(x.x, env)
+		if err != nil {
+			return nil, err
+		}
+		var bounds [2]interface{}
+		for i, bound := range []interface{}{x.lo, x.hi} {
+			if bound != nil {
+				if bounds[i], err = th.eval(bound, env); err != nil {
+					return nil, err
+				}
+			}
+		}
+		slice, err := scriptSlice(v, bounds[0], bounds[1])
+		return slice, th.at(x.line, err)
+
+	case *callExpr:
+		fn, err := th.eval(x.fn, env)
+		if err != nil {
+			return nil, err
+		}
+
+		var args = make([]interface{}, 0, len(x.args))
+		for _, arg := range x.args {
+			v, err := th.eval(arg, env)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, v)
+		}
+
+		var kwargs = make([]keywordValue, 0, len(x.kwargs))
+		for _, kwarg := range x.kwargs {
+			v, err := th.eval(kwarg.value, env)
+			if err != nil {
+				return nil, err
+			}
+			kwargs = append(kwargs, keywordValue{name: kwarg.name, value: v})
+		}
+		return th.call(fn, args, kwargs, x.line)
+	}
+	return nil, fmt.Errorf("unknown expression %T", x)
+}
+
+// call calls [fn] with [args] and [kwargs], at [line]
+func (th *scriptThread) call(fn interface{}, args []interface{}, kwargs []keywordValue, line int) (interface{}, error) {
+	switch fn := fn.(type) {
+	case *scriptBuiltin:
+		v, err := fn.fn(args, kwargs)
+		if err != nil {
+			return nil, th.at(line, fmt.Errorf("%s: %s", fn.name, err.Error()))
+		}
+		return v, nil
+
+	case *scriptFunction:
+		for _, active := range th.stack {
+			if active == fn {
+				return nil, th.errorf(line, "%s: recursion isn't allowed", fn.def.name)
+			}
+		}
+
+		var params = fn.def.params
+		if len(args) > len(params) {
+			return nil, th.errorf(line, "%s: takes %d arguments, got %d", fn.def.name, len(params), len(args))
+		}
+
+		var env = &scriptEnv{vars: make(map[string]interface{}, len(params)), parent: fn.env}
+		for i, arg := range args {
+			env.vars[params[i].name] = arg
+		}
+		for _, kwarg := range kwargs {
+			var known = false
+			for _, param := range params {
+				known = known || param.name == kwarg.name
+			}
+			if _, set := env.vars[kwarg.name]; !known || set {
+				return nil, th.errorf(line, "%s: unexpected (or repeated) argument %s", fn.def.name, kwarg.name)
+			}
+			env.vars[kwarg.name] = kwarg.value
+		}
+		for i, param := range params {
+			if _, set := env.vars[param.name]; !set {
+				if param.def == nil {
+					return nil, th.errorf(line, "%s: missing argument %s", fn.def.name, param.name)
+				}
+				env.vars[param.name] = fn.defaults[i]
+			}
+		}
+
+		th.stack = append(th.stack, fn)
+		defer func() { th.stack = th.stack[:len(th.stack)-1] }()
+
+		_, value, err := th.exec(fn.def.body, env)
+		return value, err
+	}
+	return nil, th.errorf(line, "%s is not callable", scriptType(fn))
+}
+
+func newScriptDict() *scriptDict { return &scriptDict{values: make(map[interface{}]interface{})} }
+
+// set sets [key] of the dict to [value]
+func (dict *scriptDict) set(key, value interface{}) error {
+	if dict.frozen {
+		return fmt.Errorf("can't change a frozen dict")
+	}
+	switch key.(type) {
+	case nil, bool, int64, string:
+	default:
+		return fmt.Errorf("%s can't be a dict key", scriptType(key))
+	}
+
+	if _, exists := dict.values[key]; !exists {
+		dict.keys = append(dict.keys, key)
+	}
+	dict.values[key] = value
+	return nil
+}
+
+// scriptType returns the name of the type of [v], as shown in errors
+func scriptType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "None"
+	case bool:
+		return "bool"
+	case int64:
+		return "int"
+	case string:
+		return "string"
+	case *scriptList:
+		return "list"
+	case *scriptDict:
+		return "dict"
+	case *scriptStruct:
+		return v.name
+	case *scriptFunction, *scriptBuiltin:
+		return "function"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// scriptTruth returns the truth value of [v]
+func scriptTruth(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case int64:
+		return v != 0
+	case string:
+		return v != ""
+	case *scriptList:
+		return len(v.elems) > 0
+	case *scriptDict:
+		return len(v.keys) > 0
+	}
+	return true
+}
+
+// scriptString returns [v] as str() does: strings as they are, other values as they're written in scripts
+func scriptString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return scriptRepr(v)
+}
+
+// scriptRepr returns [v] as it's written in scripts
+func scriptRepr(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "None"
+	case bool:
+		if v {
+			return "True"
+		}
+		return "False"
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case string:
+		return strconv.Quote(v)
+	case *scriptList:
+		var elems = make([]string, len(v.elems))
+		for i, elem := range v.elems {
+			elems[i] = scriptRepr(elem)
+		}
+		return "[" + strings.Join(elems, ", ") + "]"
+	case *scriptDict:
+		var items = make([]string, len(v.keys))
+		for i, key := range v.keys {
+			items[i] = scriptRepr(key) + ": " + scriptRepr(v.values[key])
+		}
+		return "{" + strings.Join(items, ", ") + "}"
+	case *scriptStruct:
+		var names = make([]string, 0, len(v.fields))
+		for name := range v.fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for i, name := range names {
+			names[i] = name + " = " + scriptRepr(v.fields[name])
+		}
+		return v.name + "(" + strings.Join(names, ", ") + ")"
+	case *scriptFunction:
+		return "<function " + v.def.name + ">"
+	case *scriptBuiltin:
+		return "<built-in function " + v.name + ">"
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// scriptEqual returns true if [a] and [b] are equal (lists and dicts by their contents)
+func scriptEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case *scriptList:
+		b, ok := b.(*scriptList)
+		if !ok || len(a.elems) != len(b.elems) {
+			return false
+		}
+		for i := range a.elems {
+			if !scriptEqual(a.elems[i], b.elems[i]) {
+				return false
+			}
+		}
+		return true
+	case *scriptDict:
+		b, ok := b.(*scriptDict)
+		if !ok || len(a.keys) != len(b.keys) {
+			return false
+		}
+		for _, key := range a.keys {
+			if v, ok := b.values[key]; !ok || !scriptEqual(a.values[key], v) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+// scriptBinary applies the binary operator [op] to [a] and [b]
+func scriptBinary(op string, a, b interface{}) (interface{}, error) {
+	switch op {
+	case "==":
+		return scriptEqual(a, b), nil
+	case "!=":
+		return !scriptEqual(a, b), nil
+	case "in", "not in":
+		var found bool
+		switch b := b.(type) {
+		case string:
+			s, ok := a.(string)
+			if !ok {
+				return nil, fmt.Errorf("'in <string>' requires a string, not %s", scriptType(a))
+			}
+			found = strings.Contains(b, s)
+		case *scriptList:
+			for _, elem := range b.elems {
+				found = found || scriptEqual(a, elem)
+			}
+		case *scriptDict:
+			switch a.(type) {
+			case nil, bool, int64, string:
+				_, found = b.values[a]
+			}
+		default:
+			return nil, fmt.Errorf("'in' on %s", scriptType(b))
+		}
+		return found != (op == "not in"), nil
+	}
+
+	switch a := a.(type) {
+	case int64:
+		if b, ok := b.(int64); ok {
+			switch op {
+			case "+":
+				return a + b, nil
+			case "-":
+				return a - b, nil
+			case "*":
+				return a * b, nil
+			case "//", "%":
+				if b == 0 {
+					return nil, fmt.Errorf("division by zero")
+				}
+				// like Python, the quotient is floored, and the remainder has the sign of the divisor
+				var q, r = a / b, a % b
+				if r != 0 && (r < 0) != (b < 0) {
+					q, r = q-1, r+b
+				}
+				if op == "//" {
+					return q, nil
+				}
+				return r, nil
+			case "/":
+				return nil, fmt.Errorf("floats aren't supported (use //)")
+			case "<":
+				return a < b, nil
+			case "<=":
+				return a <= b, nil
+			case ">":
+				return a > b, nil
+			case ">=":
+				return a >= b, nil
+			}
+		}
+	case string:
+		switch b := b.(type) {
+		case string:
+			switch op {
+			case "+":
+				return a + b, nil
+			case "<":
+				return a < b, nil
+			case "<=":
+				return a <= b, nil
+			case ">":
+				return a > b, nil
+			case ">=":
+				return a >= b, nil
+			}
+		case int64:
+			if op == "*" {
+				if b < 0 {
+					b = 0
+				}
+				if len(a) > 0 && b > scriptMaxLength/int64(len(a)) { // ie. len(a)*b > scriptMaxLength, without overflowing
+					return nil, fmt.Errorf("string too long")
+				}
+				return strings.Repeat(a, int(b)), nil
+			}
+		}
+	case *scriptList:
+		if b, ok := b.(*scriptList); ok && op == "+" {
+			var elems = append(append(make([]interface{}, 0, len(a.elems)+len(b.elems)), a.elems...), b.elems...)
+			return &scriptList{elems: elems}, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported operation: %s %s %s", scriptType(a), op, scriptType(b))
+}
+
+// scriptIterate returns the elements of [v], as iterated by for loops: the elements of lists, the keys of dicts
+func scriptIterate(v interface{}) ([]interface{}, error) {
+	switch v := v.(type) {
+	case *scriptList:
+		return append([]interface{}(nil), v.elems...), nil // so that the loop can change the list
+	case *scriptDict:
+		return append([]interface{}(nil), v.keys...), nil
+	}
+	return nil, fmt.Errorf("%s is not iterable", scriptType(v))
+}
+
+// scriptIndex returns the element of [v] at [index]
+func scriptIndex(v, index interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case *scriptDict:
+		elem, ok := v.values[index]
+		if !ok {
+			return nil, fmt.Errorf("key %s not in dict", scriptRepr(index))
+		}
+		return elem, nil
+	case *scriptList, string:
+		var n = scriptLen(v)
+		i, ok := index.(int64)
+		if !ok {
+			return nil, fmt.Errorf("%s index must be an int, not %s", scriptType(v), scriptType(index))
+		}
+		if i < 0 {
+			i += int64(n)
+		}
+		if i < 0 || i >= int64(n) {
+			return nil, fmt.Errorf("index %d out of range", index)
+		}
+		if s, ok := v.(string); ok {
+			return s[i : i+1], nil
+		}
+		return v.(*scriptList).elems[i], nil
+	}
+	return nil, fmt.Errorf("%s can't be indexed", scriptType(v))
+}
+
+// scriptSetIndex sets the element of [v] at [index] to [value]
+func scriptSetIndex(v, index, value interface{}) error {
+	switch v := v.(type) {
+	case *scriptDict:
+		return v.set(index, value)
+	case *scriptList:
+		if v.frozen {
+			return fmt.Errorf("can't change a frozen list")
+		}
+		i, ok := index.(int64)
+		if !ok {
+			return fmt.Errorf("list index must be an int, not %s", scriptType(index))
+		}
+		if i < 0 {
+			i += int64(len(v.elems))
+		}
+		if i < 0 || i >= int64(len(v.elems)) {
+			return fmt.Errorf("index %d out of range", index)
+		}
+		v.elems[i] = value
+		return nil
+	}
+	return fmt.Errorf("%s items can't be assigned", scriptType(v))
+}
+
+// scriptSlice returns the elements of [v] from [lo] to [hi] (either may be nil)
+func scriptSlice(v, lo, hi interface{}) (interface{}, error) {
+	var n = int64(scriptLen(v))
+	if n < 0 {
+		return nil, fmt.Errorf("%s can't be sliced", scriptType(v))
+	}
+
+	var bounds = [2]int64{0, n}
+	for i, bound := range []interface{}{lo, hi} {
+		if bound == nil {
+			continue
+		}
+		b, ok := bound.(int64)
+		if !ok {
+			return nil, fmt.Errorf("slice bounds must be ints, not %s", scriptType(bound))
+		}
+		if b < 0 {
+			b += n
+		}
+		if b < 0 {
+			b = 0
+		} else if b > n {
+			b = n
+		}
+		bounds[i] = b
+	}
+	if bounds[1] < bounds[0] {
+		bounds[1] = bounds[0]
+	}
+
+	if s, ok := v.(string); ok {
+		return s[bounds[0]:bounds[1]], nil
+	}
+	return &scriptList{elems: append([]interface{}(nil), v.(*scriptList).elems[bounds[0]:bounds[1]]...)}, nil
+}
+
+// scriptLen returns the length of [v], or -1 if it has none
+func scriptLen(v interface{}) int {
+	switch v := v.(type) {
+	case string:
+		return len(v)
+	case *scriptList:
+		return len(v.elems)
+	case *scriptDict:
+		return len(v.keys)
+	}
+	return -1
+}
+
+// scriptAttr returns the attribute [name] of [v]: a field of structs, or a method of strings, lists and dicts
+func scriptAttr(v interface{}, name string) (interface{}, error) {
+	var method func(args []interface{}) (interface{}, error)
+
+	switch v := v.(type) {
+	case *scriptStruct:
+		if field, ok := v.fields[name]; ok {
+			return field, nil
+		}
+
+	case string:
+		var strArg = func(args []interface{}, i int) (string, error) {
+			if i >= len(args) {
+				return "", fmt.Errorf("missing argument")
+			}
+			s, ok := args[i].(string)
+			if !ok {
+				return "", fmt.Errorf("want string, got %s", scriptType(args[i]))
+			}
+			return s, nil
+		}
+
+		switch name {
+		case "lower", "upper", "strip":
+			var fn = map[string]func(string) string{"lower": strings.ToLower, "upper": strings.ToUpper, "strip": strings.TrimSpace}[name]
+			method = func(args []interface{}) (interface{}, error) { return fn(v), nil }
+		case "startswith", "endswith", "removeprefix", "removesuffix", "find":
+			method = func(args []interface{}) (interface{}, error) {
+				s, err := strArg(args, 0)
+				if err != nil {
+					return nil, err
+				}
+				switch name {
+				case "startswith":
+					return strings.HasPrefix(v, s), nil
+				case "endswith":
+					return strings.HasSuffix(v, s), nil
+				case "removeprefix":
+					return strings.TrimPrefix(v, s), nil
+				case "removesuffix":
+					return strings.TrimSuffix(v, s), nil
+				}
+				return int64(strings.Index(v, s)), nil
+			}
+		case "split":
+			method = func(args []interface{}) (interface{}, error) {
+				var parts []string
+				if len(args) == 0 {
+					parts = strings.Fields(v)
+				} else if sep, err := strArg(args, 0); err != nil {
+					return nil, err
+				} else if sep == "" {
+					return nil, fmt.Errorf("empty separator")
+				} else {
+					parts = strings.Split(v, sep)
+				}
+				var list = &scriptList{}
+				for _, part := range parts {
+					list.elems = append(list.elems, part)
+				}
+				return list, nil
+			}
+		case "replace":
+			method = func(args []interface{}) (interface{}, error) {
+				old, err := strArg(args, 0)
+				if err != nil {
+					return nil, err
+				}
+				new, err := strArg(args, 1)
+				if err != nil {
+					return nil, err
+				}
+				return strings.Replace(v, old, new, -1), nil
+			}
+		case "join":
+			method = func(args []interface{}) (interface{}, error) {
+				if len(args) != 1 {
+					return nil, fmt.Errorf("want 1 argument")
+				}
+				elems, err := scriptIterate(args[0])
+				if err != nil {
+					return nil, err
+				}
+				var parts = make([]string, len(elems))
+				for i := range elems {
+					if parts[i], err = strArg(elems, i); err != nil {
+						return nil, err
+					}
+				}
+				return strings.Join(parts, v), nil
+			}
+		}
+
+	case *scriptList:
+		switch name {
+		case "append", "extend":
+			method = func(args []interface{}) (interface{}, error) {
+				if v.frozen {
+					return nil, fmt.Errorf("can't change a frozen list")
+				}
+				if len(args) != 1 {
+					return nil, fmt.Errorf("want 1 argument")
+				}
+				if name == "append" {
+					v.elems = append(v.elems, args[0])
+					return nil, nil
+				}
+				elems, err := scriptIterate(args[0])
+				if err != nil {
+					return nil, err
+				}
+				v.elems = append(v.elems, elems...)
+				return nil, nil
+			}
+		}
+
+	case *scriptDict:
+		switch name {
+		case "get":
+			method = func(args []interface{}) (interface{}, error) {
+				if len(args) < 1 || len(args) > 2 {
+					return nil, fmt.Errorf("want 1 or 2 arguments")
+				}
+				if value, ok := v.values[args[0]]; ok {
+					return value, nil
+				} else if len(args) == 2 {
+					return args[1], nil
+				}
+				return nil, nil
+			}
+		case "keys", "values", "items":
+			method = func(args []interface{}) (interface{}, error) {
+				var list = &scriptList{}
+				for _, key := range v.keys {
+					switch name {
+					case "keys":
+						list.elems = append(list.elems, key)
+					case "values":
+						list.elems = append(list.elems, v.values[key])
+					default:
+						list.elems = append(list.elems, &scriptList{elems: []interface{}{key, v.values[key]}})
+					}
+				}
+				return list, nil
+			}
+		}
+	}
+
+	if method == nil {
+		return nil, fmt.Errorf("%s has no attribute %s", scriptType(v), name)
+	}
+	return &scriptBuiltin{name: name, fn: func(args []interface{}, kwargs []keywordValue) (interface{}, error) {
+		if len(kwargs) > 0 {
+			return nil, fmt.Errorf("unexpected keyword argument %s", kwargs[0].name)
+		}
+		return method(args)
+	}}, nil
+}
+
+// scriptBuiltins are the functions predeclared for scripts
+var scriptBuiltins map[string]*scriptBuiltin
+
+func init() {
+	var positional = func(name string, fn func(args []interface{}) (interface{}, error)) *scriptBuiltin {
+		return &scriptBuiltin{name: name, fn: func(args []interface{}, kwargs []keywordValue) (interface{}, error) {
+			if len(kwargs) > 0 {
+				return nil, fmt.Errorf("unexpected keyword argument %s", kwargs[0].name)
+			}
+			return fn(args)
+		}}
+	}
+
+	var twoStrings = func(args []interface{}) (string, string, error) {
+		if len(args) != 2 {
+			return "", "", fmt.Errorf("want 2 arguments")
+		}
+		a, ok1 := args[0].(string)
+		b, ok2 := args[1].(string)
+		if !ok1 || !ok2 {
+			return "", "", fmt.Errorf("want strings, got %s and %s", scriptType(args[0]), scriptType(args[1]))
+		}
+		return a, b, nil
+	}
+
+	scriptBuiltins = map[string]*scriptBuiltin{
+		"len": positional("len", func(args []interface{}) (interface{}, error) {
+			if len(args) != 1 || scriptLen(args[0]) < 0 {
+				return nil, fmt.Errorf("want a string, list or dict")
+			}
+			return int64(scriptLen(args[0])), nil
+		}),
+		"str": positional("str", func(args []interface{}) (interface{}, error) {
+			if len(args) != 1 {
+				return nil, fmt.Errorf("want 1 argument")
+			}
+			return scriptString(args[0]), nil
+		}),
+		"repr": positional("repr", func(args []interface{}) (interface{}, error) {
+			if len(args) != 1 {
+				return nil, fmt.Errorf("want 1 argument")
+			}
+			return scriptRepr(args[0]), nil
+		}),
+		"bool": positional("bool", func(args []interface{}) (interface{}, error) {
+			if len(args) != 1 {
+				return nil, fmt.Errorf("want 1 argument")
+			}
+			return scriptTruth(args[0]), nil
+		}),
+		"int": positional("int", func(args []interface{}) (interface{}, error) {
+			if len(args) != 1 {
+				return nil, fmt.Errorf("want 1 argument")
+			}
+			switch v := args[0].(type) {
+			case int64:
+				return v, nil
+			case bool:
+				if v {
+					return int64(1), nil
+				}
+				return int64(0), nil
+			case string:
+				n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid int %q", v)
+				}
+				return n, nil
+			}
+			return nil, fmt.Errorf("can't convert %s to int", scriptType(args[0]))
+		}),
+		"range": positional("range", func(args []interface{}) (interface{}, error) {
+			var bounds []int64
+			for _, arg := range args {
+				n, ok := arg.(int64)
+				if !ok {
+					return nil, fmt.Errorf("want ints, got %s", scriptType(arg))
+				}
+				bounds = append(bounds, n)
+			}
+
+			var start, stop int64
+			switch len(bounds) {
+			case 1:
+				stop = bounds[0]
+			case 2:
+				start, stop = bounds[0], bounds[1]
+			default:
+				return nil, fmt.Errorf("want 1 or 2 arguments")
+			}
+			if stop > start && uint64(stop-start) > scriptMaxLength { // stop-start may overflow int64, but not uint64
+				return nil, fmt.Errorf("range too long")
+			}
+
+			var list = &scriptList{}
+			for i := start; i < stop; i++ {
+				list.elems = append(list.elems, i)
+			}
+			return list, nil
+		}),
+		"sorted": positional("sorted", func(args []interface{}) (interface{}, error) {
+			if len(args) != 1 {
+				return nil, fmt.Errorf("want 1 argument")
+			}
+			elems, err := scriptIterate(args[0])
+			if err != nil {
+				return nil, err
+			}
+			sort.SliceStable(elems, func(i, j int) bool {
+				less, err2 := scriptBinary("<", elems[i], elems[j])
+				if err2 != nil && err == nil {
+					err = err2
+				}
+				return less == true
+			})
+			return &scriptList{elems: elems}, err
+		}),
+		"print": {name: "print", fn: func(args []interface{}, kwargs []keywordValue) (interface{}, error) {
+			var parts = make([]string, len(args))
+			for i, arg := range args {
+				parts[i] = scriptString(arg)
+			}
+			log.Printf("hooks: %s", strings.Join(parts, " "))
+			return nil, nil
+		}},
+		"fail": positional("fail", func(args []interface{}) (interface{}, error) {
+			var parts = make([]string, len(args))
+			for i, arg := range args {
+				parts[i] = scriptString(arg)
+			}
+			return nil, fmt.Errorf("%s", strings.Join(parts, " "))
+		}),
+
+		// match(pattern, s) returns True if [s] matches the glob [pattern] (eg. "*.example.com")
+		"match": positional("match", func(args []interface{}) (interface{}, error) {
+			pattern, s, err := twoStrings(args)
+			if err != nil {
+				return nil, err
+			}
+			ok, err := path.Match(pattern, s)
+			return ok, err
+		}),
+
+		// in_network(ip, cidr) returns True if the address [ip] (eg. the client's) is in the network [cidr]
+		"in_network": positional("in_network", func(args []interface{}) (interface{}, error) {
+			addr, cidr, err := twoStrings(args)
+			if err != nil {
+				return nil, err
+			}
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, err
+			}
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				addr = host
+			}
+			var ip = net.ParseIP(addr)
+			return ip != nil && network.Contains(ip), nil
+		}),
+	}
+}
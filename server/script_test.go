@@ -0,0 +1,141 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// callScript loads [src] and returns what its function f returns
+func callScript(t *testing.T, src string, args ...interface{}) (interface{}, error) {
+	module, err := loadScript("test.py", src)
+	if err != nil {
+		return nil, err
+	}
+	var fn = module.function("f")
+	if fn == nil {
+		t.Fatalf("script doesn't define f:\n%s", src)
+	}
+	return module.call(fn, args...)
+}
+
+func TestScriptEval(t *testing.T) {
+	for _, test := range []struct {
+		src  string
+		want string // repr of the result
+	}{
+		{"def f():\n    return 1 + 2 * 3 - 7 // 2 % 2\n", "6"},
+		{"def f():\n    return 'ab' * 3 + 'c'\n", `"abababc"`},
+		{"def f():\n    return 'ab' * -1\n", `""`},
+		{"def f():\n    return [x * 2 for x in range(4) if x != 2]\n", "[0, 2, 6]"},
+		{"def f():\n    d = {'a': 1}\n    d['b'] = 2\n    return sorted(d) + [len(d), 'a' in d]\n", `["a", "b", 2, True]`},
+		{"def f(n=3):\n    total = 0\n    for i in range(10):\n        if i == n:\n            break\n        total += i\n    return total\n", "3"},
+		{"def f():\n    return range(5, 2)\n", "[]"},
+		{"def f():\n    return 'shhh'[1:3] if match('s*', 'shhh') else None\n", `"hh"`},
+		{"def f():\n    return in_network('10.1.2.3', '10.0.0.0/8') and not in_network('192.168.0.1', '10.0.0.0/8')\n", "True"},
+	} {
+		got, err := callScript(t, test.src)
+		if err != nil {
+			t.Errorf("%q: %v", test.src, err)
+			continue
+		}
+		if repr := scriptRepr(got); repr != test.want {
+			t.Errorf("%q: got %s, want %s", test.src, repr, test.want)
+		}
+	}
+}
+
+func TestScriptParseErrors(t *testing.T) {
+	for _, test := range []struct {
+		src  string
+		want string // in the error
+	}{
+		{"def f(x y):\n    pass\n", "test.py:1:"},
+		{"def f():\n    return 'unterminated\n", "test.py:2: unterminated string"},
+		{"def f():\nreturn 1\n", "test.py:2:"},
+		{"def f():\n    while True:\n        pass\n", "test.py:2:"},
+		{"x = (1,\n", "test.py:"},
+		{"return 1\n", "inside a function"},
+	} {
+		_, err := loadScript("test.py", test.src)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: got %v, want an error with %q", test.src, err, test.want)
+		}
+	}
+}
+
+func TestScriptEvalErrors(t *testing.T) {
+	for _, test := range []struct {
+		src  string
+		want string // in the error
+	}{
+		{"def f():\n    return 1 + 'a'\n", "test.py:2:"},
+		{"def f():\n    return [1][5]\n", "test.py:2:"},
+		{"def f():\n    return {'a': 1}['b']\n", "test.py:2:"},
+		{"def f():\n    return undefined\n", "test.py:2:"},
+		{"def f():\n    fail('nope')\n", "nope"},
+		{"def f():\n    return f()\n", "recursion isn't allowed"},
+		{"X = [1]\ndef f():\n    X.append(2)\n", "test.py:3:"}, // globals are frozen
+	} {
+		if _, err := callScript(t, test.src); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: got %v, want an error with %q", test.src, err, test.want)
+		}
+	}
+}
+
+func TestScriptLimits(t *testing.T) {
+	for _, test := range []struct {
+		src  string
+		want string // in the error
+	}{
+		// steps, at the top level and in calls
+		{"for i in range(100000):\n    for j in range(100000):\n        pass\n", "too many steps"},
+		{"def f():\n    for i in range(100000):\n        for j in range(100000):\n            pass\n", "too many steps"},
+
+		// lengths, including those whose computation would overflow int64
+		{"def f():\n    return 'x' * 200000\n", "string too long"},
+		{"def f():\n    return 'ab' * 9223372036854775807\n", "string too long"},
+		{"def f():\n    return 'ab' * 4611686018427387904\n", "string too long"},
+		{"def f():\n    return range(200000)\n", "range too long"},
+		{"def f():\n    return range(-9223372036854775807, 9223372036854775807)\n", "range too long"},
+		{"def f():\n    return range(-2, 9223372036854775807)\n", "range too long"},
+
+		// depth, of the source and of what's evaluated
+		{"def f():\n    return " + strings.Repeat("(", 1000) + "1" + strings.Repeat(")", 1000) + "\n", "too deeply nested"},
+		{"def f():\n    return " + strings.Repeat("-", 100000) + "1\n", "too deeply nested"},
+		{"def f():\n    return " + strings.Repeat("not ", 100000) + "True\n", "too deeply nested"},
+		{"def f():\n    return 1" + strings.Repeat(" + 1", 100000) + "\n", "too deeply nested"},
+	} {
+		if _, err := callScript(t, test.src); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: got %v, want an error with %q", test.src, err, test.want)
+		}
+	}
+
+	// steps are counted per call
+	module, err := loadScript("test.py", "def f():\n    for i in range(60000):\n        pass\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err = module.call(module.function("f")); err != nil {
+			t.Fatalf("call %d: %v", i+1, err)
+		}
+	}
+}
+
+func TestScriptPanicRecovered(t *testing.T) {
+	module, err := loadScript("test.py", "def f(g):\n    return g()\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buggy = &scriptBuiltin{name: "buggy", fn: func([]interface{}, []keywordValue) (interface{}, error) {
+		var list []int
+		return list[1], nil
+	}}
+	_, err = module.call(module.function("f"), buggy)
+	var scriptErr *scriptError
+	if !errors.As(err, &scriptErr) || !strings.Contains(err.Error(), "internal error") {
+		t.Fatalf("got %v, want an internal error", err)
+	}
+}
@@ -0,0 +1,663 @@
+package server
+
+import (
+	"context"
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// ----------
+// The file defines the Server type which runs/manages the ssh server and the HTTP edge
+// ----------
+
+// Server is a shhh tunneling server. It accepts ssh connections from clients, handles their port forwarding
+// requests and exposes forwarded ports publicly, either as raw TCP ports or via the HTTP edge.
+type Server struct {
+	config *Config
+	ssh    *ssh.Server
+
+	// routes HTTP requests to tunnels; nil if the HTTP edge is disabled
+	router *httpRouter
+	http   *http.Server
+
+	// routes TLS connections to tunnels based on their server name; nil if the TLS edge is disabled
+	sni *sniRouter
+
+	// unwraps ssh connections carried in TLS or WebSocket; nil if disabled
+	wrapped *sshOverTLS
+
+	// policies of the additional ssh listeners, by name
+	listeners map[string]*sshListener
+
+	// tracks names and ports reserved for keys; nil if reservations are disabled
+	store *reservations
+
+	// custom domains verified by keys for their HTTP tunnels; nil if disabled
+	domains *customDomains
+
+	// keys allowed to connect; nil unless authenticating using Config.AuthorizedKeys
+	keys *AuthorizedKeysFile
+
+	// ssh connections open on the server
+	conns *liveConns
+
+	// fingerprints of keys with administrative privileges
+	admins map[string]struct{}
+
+	// assigns stable ports to clients requesting a random one; nil if disabled
+	stablePorts *stablePorts
+
+	// endpoints held for disconnected clients, in case they reconnect; nil if disabled
+	grace *graceHolds
+
+	// protects the ssh listener from brute-force attempts; nil if disabled
+	guard *sshGuard
+
+	// slows down repeat offenders, and logs what they try; nil if disabled
+	tarpit *tarpit
+
+	// limits the connections which haven't authenticated yet; nil if disabled
+	startups *startupLimiter
+
+	// logs authentication failures and policy denials; nil if disabled
+	authLog *authLog
+
+	// records security-relevant events; nil if disabled
+	audit *auditLog
+
+	// records the message streams of sessions; nil if disabled
+	recordings *recordings
+
+	// traces tunnels to an OpenTelemetry collector; nil if disabled
+	tracer *tracer
+
+	// tracks usage of each key, and enforces their quotas
+	quotas *quotas
+
+	// shares endpoints, reservations and quota usage with other nodes; nil if running as a single node
+	cluster *cluster
+
+	// registers tunnels in Consul / etcd; nil if disabled
+	registry *serviceRegistry
+
+	// exposes tunnels as Kubernetes Services; nil if disabled
+	kubernetes *kubernetesController
+
+	// serves HTTP requests relayed by other nodes; nil if nodes don't relay connections
+	relayedHTTP *relayedHTTP
+
+	// notified of tunnel lifecycle events
+	webhooks []*webhook
+
+	// operator's hooks deciding on clients and visitors; nil if there are none
+	hooks *scriptHooks
+
+	// carries tunnel lifecycle and security events to notifiers; nil if there are none
+	bus *eventBus
+
+	// message of the day shown to clients when their session opens; nil if there's none
+	motd *template.Template
+
+	// server's metrics, exposed via MetricsHandler
+	metrics *metrics
+
+	// exports the usage of each key periodically; nil if usage isn't exported
+	usage *usageExporter
+
+	// connections being forwarded through tunnels
+	forwarded *forwardedConns
+
+	// tunnels open on the server
+	tunnels *openTunnels
+
+	// HTTP and TCP endpoints open on the server, which clients may share (see balancer.go)
+	balancers *balancedEndpoints
+
+	// names clients claimed for their tunnels (see aliases.go)
+	aliases *tunnelAliases
+
+	// clients waiting for ports which were taken when they asked for them (see port_queue.go)
+	portQueues *portQueues
+
+	// users allowed to authenticate with a password; nil if disabled
+	passwords *passwordFile
+	ldap      *ldapDirectory
+	tokens    *apiTokens
+	profiles  *userProfiles
+
+	// pluggable components
+	authenticator Authenticator
+	banner        BannerHandler
+	portPolicy    PortPolicy
+	authorizer    Authorizer
+	notifier      Notifier
+	fallback      http.Handler
+	eventHandlers []func(TunnelEvent)
+	middleware    middlewareChain
+	usageSink     UsageSink
+	sshOptions    []ssh.Option
+
+	// closed when the server begins shutting down
+	shutdown chan struct{}
+	once     sync.Once
+}
+
+// New returns a new Server configured using [config], with defaults for handling
+// port forwarding and additional secure defaults. Optional components can be plugged in using [options].
+func New(config *Config, options ...Option) (_ *Server, err error) {
+	var srv = &Server{
+		config:     config,
+		admins:     make(map[string]struct{}),
+		metrics:    newMetrics(),
+		tunnels:    newOpenTunnels(),
+		balancers:  newBalancedEndpoints(),
+		aliases:    newTunnelAliases(),
+		portQueues: newPortQueues(),
+		conns:      newLiveConns(),
+		portPolicy: DefaultPortPolicy,
+		shutdown:   make(chan struct{}),
+	}
+
+	for _, opt := range options {
+		if err = opt(srv); err != nil {
+			return nil, err
+		}
+	}
+
+	var plugins middlewareChain
+	if plugins, err = loadMiddlewarePlugins(config.MiddlewarePlugins); err != nil {
+		return nil, err
+	}
+	srv.middleware = append(srv.middleware, plugins...)
+
+	if config.ReservationsFile != "" {
+		if srv.store, err = loadReservations(config.ReservationsFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.DomainsFile != "" {
+		if srv.domains, err = loadCustomDomains(config.DomainsFile); err != nil {
+			return nil, err
+		}
+	}
+
+	srv.grace = newGraceHolds(config.ReconnectGrace)
+
+	if config.HTTPAddr != "" {
+		var reserved = func(name string) bool { return srv.store.NameOwner(name) != "" || srv.grace.NameHolder(name) != "" }
+		if srv.router, err = newHTTPRouter(config, reserved); err != nil {
+			return nil, err
+		}
+		srv.router.middleware = srv.middleware
+
+		if srv.fallback != nil {
+			srv.router.honeypot = srv.fallback
+		}
+	}
+	srv.http = &http.Server{Handler: srv.router}
+	if config.HTTP2 {
+		if err = enableCleartextHTTP2(srv.http); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, fp := range config.AdminKeys {
+		srv.admins[fp] = struct{}{}
+	}
+
+	if srv.stablePorts, err = newStablePorts(config.StablePorts); err != nil {
+		return nil, err
+	}
+
+	var sources sourceFilter
+	if sources, err = newSourceFilter(config.AllowedSources, config.DeniedSources); err != nil {
+		return nil, err
+	}
+	var geoip *geoIPPolicy
+	if geoip, err = newGeoIPPolicy(config.GeoIPDatabase, config.AllowedCountries, config.DeniedCountries); err != nil {
+		return nil, err
+	}
+	var reputation *reputationFeeds
+	if reputation, err = newReputationFeeds(config.ReputationFeeds, config.ReputationRefresh); err != nil {
+		return nil, err
+	}
+	srv.forwarded = newForwardedConns(srv.metrics, config.AccessLog, sources, geoip, reputation, tunnelBanner(config.TunnelBanner),
+		config.ConnectionSetupTimeout, config.StallTimeoutIn, config.StallTimeoutOut)
+
+	if config.TLSAddr != "" {
+		if srv.sni, err = newSNIRouter(config, srv.forwarded); err != nil {
+			return nil, err
+		}
+	}
+
+	if srv.guard, err = newSSHGuard(config); err != nil {
+		return nil, err
+	}
+
+	if srv.startups, err = newStartupLimiter(config.MaxStartups); err != nil {
+		return nil, err
+	}
+
+	if srv.tarpit, err = newTarpit(config); err != nil {
+		return nil, err
+	}
+
+	if srv.authLog, err = newAuthLog(config.AuthLog, config.AuthLogFile); err != nil {
+		return nil, err
+	}
+
+	if srv.audit, err = newAuditLog(config); err != nil {
+		return nil, err
+	}
+
+	if srv.hooks, err = newScriptHooks(config.Hooks); err != nil {
+		return nil, err
+	}
+	srv.forwarded.hooks, srv.forwarded.middleware = srv.hooks, srv.middleware
+
+	if srv.bus, err = newEventBus(config); err != nil {
+		return nil, err
+	} else if srv.bus != nil {
+		srv.audit.published = srv.bus.publishSecurity
+	}
+
+	if srv.recordings, err = newRecordings(config); err != nil {
+		return nil, err
+	}
+
+	if srv.tracer, err = newTracer(config); err != nil {
+		return nil, err
+	}
+
+	if srv.usage, err = newUsageExporter(config, srv.usageSink, srv.tunnels.list); err != nil {
+		return nil, err
+	}
+
+	if srv.motd, err = loadMOTD(config.MOTDFile); err != nil {
+		return nil, err
+	}
+
+	if srv.banner == nil && config.BannerFile != "" {
+		if srv.banner, err = fileBanner(config.BannerFile); err != nil {
+			return nil, err
+		}
+	}
+
+	srv.quotas = newQuotas(config.Quota, config.Quotas)
+	srv.quotas.notify = srv.notifyKey
+	if config.UsageFile != "" {
+		if err = srv.quotas.load(config.UsageFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if srv.cluster, err = newCluster(config, srv.store, srv.quotas); err != nil {
+		return nil, err
+	}
+
+	// requests for tunnels held by other nodes are relayed to them, or turned away for the load balancer to route
+	// them there
+	if srv.cluster != nil && srv.router != nil {
+		srv.router.elsewhere = func(name string) *ClusterNode { return srv.cluster.elsewhere("http:" + name) }
+	}
+	if srv.cluster != nil && srv.cluster.relay != nil {
+		var relay = srv.cluster.relay
+		relay.handle = srv.relayed
+		if srv.router != nil {
+			srv.relayedHTTP = newRelayedHTTP(srv.router)
+			srv.router.relay = func(node *ClusterNode, name string) http.Handler { return relay.handler(node, "http:"+name) }
+		}
+		if srv.sni != nil {
+			srv.sni.relay = func(name string, conn net.Conn) bool {
+				var node = srv.cluster.elsewhere("tls:" + name)
+				if node == nil || node.Relay == "" {
+					return false
+				}
+				relay.forward(conn, node, "tls:"+name)
+				return true
+			}
+		}
+	}
+
+	for i := range config.Webhooks {
+		srv.webhooks = append(srv.webhooks, newWebhook(&config.Webhooks[i]))
+	}
+
+	if srv.registry, err = newServiceRegistry(config); err != nil {
+		return nil, err
+	}
+
+	var lookup = func(address string) *openTunnel {
+		tunnel, _ := srv.tunnels.get(address)
+		return tunnel
+	}
+	if srv.kubernetes, err = newKubernetesController(config, lookup); err != nil {
+		return nil, err
+	}
+
+	if srv.ldap, err = newLDAPDirectory(config); err != nil {
+		return nil, err
+	}
+
+	if srv.authenticator == nil && (config.AuthorizedKeys != "" || len(config.ForgeUsers) > 0 || config.CertificateAuthorities != "" || config.VaultAddr != "" || srv.ldap != nil) {
+		var authenticators anyAuthenticator
+		if config.AuthorizedKeys != "" {
+			if srv.keys, err = AuthorizedKeys(config.AuthorizedKeys); err != nil {
+				return nil, err
+			}
+			authenticators = append(authenticators, srv.keys)
+		}
+
+		if len(config.ForgeUsers) > 0 {
+			var forge Authenticator
+			if forge, err = ForgeKeys(config.ForgeUsers, config.ForgeRefresh); err != nil {
+				return nil, err
+			}
+			authenticators = append(authenticators, forge)
+		}
+
+		if config.CertificateAuthorities != "" {
+			var ca Authenticator
+			if ca, err = CertificateAuthorities(config.CertificateAuthorities, config.PrincipalPermissions); err != nil {
+				return nil, err
+			}
+			authenticators = append(authenticators, ca)
+		}
+
+		if config.VaultAddr != "" {
+			var vault Authenticator
+			if vault, err = VaultCA(config.VaultAddr, config.VaultSSHMount, config.VaultExtensions, config.VaultRefresh); err != nil {
+				return nil, err
+			}
+			authenticators = append(authenticators, vault)
+		}
+
+		if srv.ldap != nil {
+			authenticators = append(authenticators, srv.ldap)
+		}
+
+		srv.authenticator = authenticators
+	}
+
+	if srv.passwords, err = loadPasswordFile(config.PasswordFile); err != nil {
+		return nil, err
+	}
+
+	if config.AdminAddr != "" && config.AdminToken == "" {
+		return nil, errors.New("the admin API requires a token")
+	}
+
+	if err = config.validateIPVersion(); err != nil {
+		return nil, err
+	}
+
+	if err = config.validateTags(); err != nil {
+		return nil, err
+	}
+
+	if err = config.validateQuotas(); err != nil {
+		return nil, err
+	}
+
+	if err = config.validateGatewayPorts(); err != nil {
+		return nil, err
+	}
+
+	if srv.listeners, err = newSSHListeners(config); err != nil {
+		return nil, err
+	}
+
+	srv.tokens = newAPITokens(config)
+
+	if srv.profiles, err = newUserProfiles(config); err != nil {
+		return nil, err
+	}
+
+	if config.RequireAuthentication && srv.authenticator == nil && srv.passwords == nil && srv.tokens == nil {
+		return nil, errors.New("authentication is required; configure authorized keys, a password file, API tokens (or an Authenticator)")
+	}
+
+	if srv.authorizer == nil {
+		switch {
+		case config.AuthorizationRules != "" && config.AuthorizationWebhook != "":
+			return nil, errors.New("authorization rules and webhook can't be used together")
+		case config.AuthorizationRules != "":
+			if srv.authorizer, err = FileAuthorizer(config.AuthorizationRules); err != nil {
+				return nil, err
+			}
+		case config.AuthorizationWebhook != "":
+			srv.authorizer = WebhookAuthorizer(config.AuthorizationWebhook)
+		}
+	}
+
+	if err = validateServerVersion(config.ServerVersion); err != nil {
+		return nil, err
+	}
+
+	var algorithms *gossh.Config
+	if algorithms, err = algorithmPolicy(config); err != nil {
+		return nil, err
+	}
+
+	srv.ssh = &ssh.Server{
+		Addr:         config.Addr,
+		Handler:      messageForwardingHandler(srv),
+		PtyCallback:  allowPty(),
+		ConnCallback: connectionWrapper(srv),
+		IdleTimeout:  config.IdleTimeout,
+		RequestHandlers: map[string]ssh.RequestHandler{
+			tcpipForwardRequest: tcpipForwardRequestHandler(srv),
+			UDPForwardRequest:   tcpipForwardRequestHandler(srv),
+		},
+	}
+
+	if srv.banner != nil {
+		srv.ssh.ServerConfigCallback = bannerConfig(srv.banner)
+	}
+
+	// listeners may accept keys of their own, or clients which don't authenticate at all
+	if len(srv.listeners) > 0 {
+		srv.ssh.ServerConfigCallback = listenersConfig(srv, srv.ssh.ServerConfigCallback)
+	}
+
+	switch config.ServerVersion {
+	case "":
+	case randomServerVersion:
+		srv.ssh.ServerConfigCallback = versionConfig(srv.ssh.ServerConfigCallback)
+	default:
+		srv.ssh.Version = config.ServerVersion
+	}
+
+	if srv.tarpit != nil {
+		srv.ssh.ServerConfigCallback = tarpitConfig(srv.tarpit, srv.ssh.ServerConfigCallback)
+	}
+
+	// what's done once clients have authenticated (see handshake.go)
+	srv.ssh.ServerConfigCallback = authConfig(srv, srv.ssh.ServerConfigCallback)
+
+	// clients may only negotiate the algorithms the operator allows
+	if algorithms != nil {
+		srv.ssh.ServerConfigCallback = algorithmsConfig(algorithms, srv.ssh.ServerConfigCallback)
+	}
+
+	if srv.authenticator != nil || srv.tokens != nil || len(srv.listeners) > 0 {
+		srv.ssh.PublicKeyHandler = recordAcceptedKeys(srv.audit.authenticate(srv.authLog.authenticate(srv.tarpit.authenticate(srv.authenticate))))
+	}
+
+	if srv.passwords != nil || (srv.ldap != nil && srv.ldap.passwords) {
+		srv.ssh.PasswordHandler = passwordHandler(srv)
+		srv.ssh.KeyboardInteractiveHandler = keyboardInteractiveHandler(srv)
+	}
+
+	for _, opt := range srv.sshOptions {
+		if err = srv.ssh.SetOption(opt); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.SSHTLSAddr != "" || config.SSHTLSHost != "" {
+		if srv.wrapped, err = newSSHOverTLS(config, srv.ssh.HandleConn); err != nil {
+			return nil, err
+		}
+
+		// the TLS edge passes connections for the ssh host on, so that both can share port 443
+		if config.SSHTLSHost != "" && srv.sni != nil {
+			srv.sni.sshHost, srv.sni.ssh = strings.ToLower(config.SSHTLSHost), srv.wrapped.accept
+		}
+	}
+
+	// changes to the hooks' script apply right away
+	if srv.hooks != nil {
+		go watchFile(config.Hooks, srv.shutdown, srv.hooks.reload)
+	}
+
+	// keys added to (or removed from) the authorized_keys file apply right away
+	if srv.keys != nil {
+		go watchFile(config.AuthorizedKeys, srv.shutdown, srv.reloadAuthorizedKeys)
+	}
+
+	if srv.cluster != nil {
+		go srv.cluster.run(srv.shutdown)
+	}
+
+	if srv.registry != nil {
+		go srv.registry.run(srv.shutdown)
+	}
+
+	if srv.kubernetes != nil {
+		go srv.kubernetes.run(srv.shutdown)
+	}
+
+	if config.UsageFile != "" {
+		go srv.quotas.persist(srv.shutdown)
+	}
+
+	return srv, nil
+}
+
+// Serve accepts incoming ssh connections on [ln]. It always returns a non-nil error;
+// after Shutdown or Close, the returned error is ssh.ErrServerClosed.
+func (srv *Server) Serve(ln net.Listener) error {
+	return srv.ssh.Serve(withProxyProtocol(ln, srv.config.SSHProxyProtocol))
+}
+
+// ServeHTTPEdge accepts incoming HTTP requests on [ln] and routes them to tunnels based on the Host header.
+// It always returns a non-nil error; after Shutdown or Close, the returned error is http.ErrServerClosed.
+func (srv *Server) ServeHTTPEdge(ln net.Listener) error {
+	if srv.router == nil {
+		return errors.New("http edge is not enabled")
+	}
+	return srv.http.Serve(withProxyProtocol(ln, srv.config.HTTPProxyProtocol))
+}
+
+// ServeTLSEdge accepts incoming TLS connections on [ln] and forwards them, without terminating them, to tunnels
+// based on the server name (SNI) in their ClientHello. It always returns a non-nil error; after Shutdown or Close,
+// the returned error is ErrTLSEdgeClosed.
+func (srv *Server) ServeTLSEdge(ln net.Listener) error {
+	if srv.sni == nil {
+		return errors.New("tls edge is not enabled")
+	}
+	return srv.sni.serve(withProxyProtocol(ln, srv.config.TLSProxyProtocol))
+}
+
+// ServeSSHOverTLS accepts incoming ssh connections wrapped in TLS, or in a WebSocket (over TLS, unless no
+// certificate is configured), on [ln]. It always returns a non-nil error; after Shutdown or Close, the returned
+// error is ErrSSHOverTLSClosed.
+func (srv *Server) ServeSSHOverTLS(ln net.Listener) error {
+	if srv.wrapped == nil {
+		return errors.New("ssh over tls is not enabled")
+	}
+	return srv.wrapped.serve(ln)
+}
+
+// HTTPHandler returns the http.Handler of the HTTP edge, which routes requests to tunnels based on the Host header
+// (or nil if the edge is disabled). Embedders can use it to serve the edge as part of their own server (eg. under
+// a mux with their own pages at the apex domain) instead of ServeHTTPEdge; it should then be shut down along with Server.
+func (srv *Server) HTTPHandler() http.Handler {
+	if srv.router == nil {
+		return nil
+	}
+	return srv.router
+}
+
+// MetricsHandler returns an http.Handler which serves the server's metrics (number of tunnels, connections,
+// bytes transferred etc.) in the Prometheus text format
+func (srv *Server) MetricsHandler() http.Handler { return srv.metrics }
+
+// Shutdown gracefully shuts down the server. It stops accepting new ssh connections and new connections on
+// forwarded ports, notifies connected clients and waits for in-flight connections to finish. Once [ctx] is done,
+// all remaining connections are closed forcibly, and quota usage is persisted (see Config.UsageFile). Pending webhook
+// deliveries (and spans, usage, and the removal of tunnels from the service registry and Kubernetes) are given until
+// [ctx] is done as well.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.once.Do(func() { close(srv.shutdown) })
+	srv.sni.close()
+	srv.wrapped.close()
+	srv.closeRelay()
+
+	var httpErr = make(chan error, 1)
+	go func() { httpErr <- srv.http.Shutdown(ctx) }()
+
+	if err := srv.ssh.Shutdown(ctx); err != nil {
+		_ = srv.Close()
+		return err
+	}
+
+	if err := <-httpErr; err != nil {
+		return err
+	}
+
+	if err := srv.quotas.save(); err != nil {
+		return errors.Wrap(err, "failed to persist quota usage")
+	}
+
+	for _, hook := range srv.webhooks {
+		if err := hook.Flush(ctx); err != nil {
+			return errors.Wrap(err, "failed to deliver pending webhooks")
+		}
+	}
+
+	if err := srv.bus.Flush(ctx); err != nil {
+		return errors.Wrap(err, "failed to deliver pending notifications")
+	}
+
+	if err := srv.tracer.Flush(ctx); err != nil {
+		return errors.Wrap(err, "failed to export pending spans")
+	}
+
+	if err := srv.usage.Flush(ctx); err != nil {
+		return errors.Wrap(err, "failed to export usage")
+	}
+
+	if err := srv.registry.Flush(ctx); err != nil {
+		return errors.Wrap(err, "failed to deregister tunnels")
+	}
+
+	if err := srv.kubernetes.Flush(ctx); err != nil {
+		return errors.Wrap(err, "failed to delete kubernetes services of tunnels")
+	}
+	return nil
+}
+
+// Close immediately closes all listeners and connections, and persists quota usage (see Config.UsageFile)
+func (srv *Server) Close() error {
+	srv.once.Do(func() { close(srv.shutdown) })
+	_ = srv.http.Close()
+	srv.sni.close()
+	srv.wrapped.close()
+	srv.closeRelay()
+	srv.forwarded.closeAll()
+	var err = srv.ssh.Close()
+	srv.forwarded.wait() // so that connections we've closed are reported
+	if saveErr := srv.quotas.save(); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	return err
+}
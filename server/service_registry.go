@@ -0,0 +1,280 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------
+// This file contains the registration of tunnels in a service registry (Consul or etcd, see Config.ServiceRegistry):
+// each active tunnel is registered as an instance of a service (named after the tunnel) at its public address, and
+// deregistered once it closes, so that existing service discovery and health checking stacks see tunneled services.
+// Registrations are kept alive by the server (with TTL checks in Consul, and a lease in etcd), so that they expire
+// if it goes away without deregistering them.
+// ----------
+
+const (
+	// maximum number of events waiting to be applied to the registry; newer events are dropped once full
+	registryQueueSize = 256
+
+	// how often registrations are kept alive, and how long they outlive the server
+	registryHeartbeat = 10 * time.Second
+	registryTTL       = 3 * registryHeartbeat
+)
+
+// registeredService is a tunnel, as registered in the service registry
+type registeredService struct {
+	ID          string
+	Name        string
+	Address     string // public host of the tunnel
+	Port        int
+	Protocol    string // http, tls, tcp or udp
+	Fingerprint string
+	Tunnel      string // public address of the tunnel (see TunnelEvent.Address)
+	Tags        []string
+}
+
+// registryBackend is a service registry tunnels are registered in
+type registryBackend interface {
+	register(service *registeredService) error
+	deregister(service *registeredService) error
+
+	// heartbeat keeps [services] registered (eg. re-registering those the registry lost)
+	heartbeat(services []*registeredService) error
+}
+
+// serviceRegistry applies tunnel lifecycle events to a registryBackend, in the background and in order. A nil
+// *serviceRegistry registers nothing.
+type serviceRegistry struct {
+	backend registryBackend
+	url     string // of the registry, for logs
+	tags    []string
+
+	queue    chan TunnelEvent
+	services map[string]*registeredService // by tunnel address; only used by run
+	done     chan struct{}                 // closed once the registrations are removed (see run)
+}
+
+// newServiceRegistry returns the service registry as configured, or nil if tunnels aren't registered
+func newServiceRegistry(config *Config) (*serviceRegistry, error) {
+	if config.ServiceRegistry == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(config.ServiceRegistry)
+	if err != nil || u.Host == "" {
+		return nil, errors.Errorf("invalid service registry %q", config.ServiceRegistry)
+	}
+
+	var scheme = "http"
+	var kind = u.Scheme
+	if strings.HasSuffix(kind, "+https") {
+		scheme, kind = "https", strings.TrimSuffix(kind, "+https")
+	}
+	var base = scheme + "://" + u.Host
+
+	var backend registryBackend
+	switch kind {
+	case "consul":
+		var token = ""
+		if u.User != nil {
+			token = u.User.Username()
+		}
+		backend = newConsulRegistry(base, token)
+	case "etcd":
+		var prefix = config.ServiceRegistryPrefix
+		if prefix == "" {
+			prefix = "/shhh/services/"
+		}
+		backend = newEtcdRegistry(base, prefix)
+	default:
+		return nil, errors.Errorf("unknown service registry %q (consul:// or etcd://)", u.Scheme)
+	}
+
+	return &serviceRegistry{backend: backend, url: base, tags: config.ServiceTags, queue: make(chan TunnelEvent, registryQueueSize),
+		services: make(map[string]*registeredService), done: make(chan struct{})}, nil
+}
+
+// send queues [event] to be applied to the registry. It never blocks.
+func (registry *serviceRegistry) send(event TunnelEvent) {
+	if registry == nil || (event.Type != TunnelOpened && event.Type != TunnelClosed) {
+		return
+	}
+
+	select {
+	case registry.queue <- event:
+	default:
+		log.Printf("service registry %s: queue is full; dropped %s event", registry.url, event.Type)
+	}
+}
+
+// run applies queued events, and keeps registrations alive, until [stop] is closed. It then deregisters all
+// tunnels (as the server is shutting down).
+func (registry *serviceRegistry) run(stop <-chan struct{}) {
+	defer close(registry.done)
+
+	var ticker = time.NewTicker(registryHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			for _, service := range registry.services {
+				if err := registry.backend.deregister(service); err != nil {
+					log.Printf("service registry %s: failed to deregister %s: %s", registry.url, service.Tunnel, err.Error())
+				}
+			}
+			return
+
+		case event := <-registry.queue:
+			registry.apply(event)
+
+		case <-ticker.C:
+			var services = make([]*registeredService, 0, len(registry.services))
+			for _, service := range registry.services {
+				services = append(services, service)
+			}
+			if err := registry.backend.heartbeat(services); err != nil {
+				log.Printf("service registry %s: failed to keep registrations alive: %s", registry.url, err.Error())
+			}
+		}
+	}
+}
+
+// apply registers the tunnel of [event] if it opened, or deregisters it if it closed
+func (registry *serviceRegistry) apply(event TunnelEvent) {
+	if event.Type == TunnelClosed {
+		if service, ok := registry.services[event.Address]; ok {
+			delete(registry.services, event.Address)
+			if err := registry.backend.deregister(service); err != nil {
+				log.Printf("service registry %s: failed to deregister %s: %s", registry.url, event.Address, err.Error())
+			}
+		}
+		return
+	}
+
+	var service, err = describeService(event, registry.tags)
+	if err != nil {
+		log.Printf("service registry %s: not registering %s: %s", registry.url, event.Address, err.Error())
+		return
+	}
+
+	// it's registered either way, so that failed registrations are retried by heartbeats
+	registry.services[event.Address] = service
+	if err = registry.backend.register(service); err != nil {
+		log.Printf("service registry %s: failed to register %s: %s", registry.url, event.Address, err.Error())
+	}
+}
+
+// Flush waits until the registrations are removed once the server is shutting down, or [ctx] is done
+func (registry *serviceRegistry) Flush(ctx context.Context) error {
+	if registry == nil {
+		return nil
+	}
+
+	select {
+	case <-registry.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// describeService returns the service instance the tunnel of [event] is registered as, with [tags] besides its own
+func describeService(event TunnelEvent, tags []string) (*registeredService, error) {
+	var service = &registeredService{ID: "shhh-" + randomHex(8), Fingerprint: event.Fingerprint, Tunnel: event.Address}
+
+	// members of balanced endpoints are listed as <address>#<id>; they're instances of the same service
+	var address = event.Address
+	if i := strings.LastIndex(address, "#"); i >= 0 {
+		address = address[:i]
+	}
+
+	switch {
+	case strings.HasPrefix(address, "http://"):
+		service.Protocol, service.Address, service.Port = "http", strings.TrimPrefix(address, "http://"), 80
+	case strings.HasPrefix(address, "tls://"):
+		service.Protocol, service.Address, service.Port = "tls", strings.TrimPrefix(address, "tls://"), 443
+	default:
+		service.Protocol = "tcp"
+		if strings.HasPrefix(address, "udp://") {
+			service.Protocol, address = "udp", strings.TrimPrefix(address, "udp://")
+		}
+
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, errors.Errorf("unrecognised address %q", event.Address)
+		}
+		service.Address = host
+		if service.Port, err = strconv.Atoi(port); err != nil {
+			return nil, errors.Errorf("unrecognised address %q", event.Address)
+		}
+	}
+
+	// services are named after the tunnel's name, or its sub-domain, or its port
+	switch name := event.Name; {
+	case name != "":
+		if i := strings.LastIndex(name, "#"); i >= 0 {
+			name = name[:i]
+		}
+		service.Name = name
+	case service.Protocol == "http" || service.Protocol == "tls":
+		service.Name = strings.SplitN(service.Address, ".", 2)[0]
+	default:
+		service.Name = service.Protocol + "-" + strconv.Itoa(service.Port)
+	}
+
+	service.Tags = append([]string{"shhh", service.Protocol}, tags...)
+	if service.Fingerprint != "" {
+		service.Tags = append(service.Tags, "fingerprint="+service.Fingerprint)
+	}
+	return service, nil
+}
+
+// registryCall sends [body] (as JSON, unless nil) to [endpoint] with [method] and [header], and decodes the response
+// into [out] (unless nil). Responses other than 2xx are returned as errors, along with their status code.
+func registryCall(client *http.Client, method, endpoint string, header http.Header, body, out interface{}) (int, error) {
+	var content []byte
+	if body != nil {
+		var err error
+		if content, err = json.Marshal(body); err != nil {
+			return 0, err
+		}
+	}
+
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(content))
+	if err != nil {
+		return 0, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, errors.Errorf("%s %s: %s: %s", method, req.URL.Path, resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	if out != nil {
+		if err = json.Unmarshal(respBody, out); err != nil {
+			return resp.StatusCode, errors.Wrap(err, "malformed response")
+		}
+	}
+	return resp.StatusCode, nil
+}
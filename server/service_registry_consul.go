@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ----------
+// This file contains the Consul backend of the service registry, which registers tunnels as services with the local
+// Consul agent (see https://developer.hashicorp.com/consul/api-docs/agent/service), each with a TTL check the server
+// passes for as long as the tunnel is open
+// ----------
+
+// consulRegistry registers tunnels with a Consul agent
+type consulRegistry struct {
+	base   string
+	header http.Header
+	client *http.Client
+}
+
+// newConsulRegistry returns a registry of the Consul agent at [base], authenticating with [token] (if set)
+func newConsulRegistry(base, token string) *consulRegistry {
+	var registry = &consulRegistry{base: base, header: make(http.Header), client: &http.Client{Timeout: 10 * time.Second}}
+	if token != "" {
+		registry.header.Set("X-Consul-Token", token)
+	}
+	return registry
+}
+
+func (registry *consulRegistry) register(service *registeredService) error {
+	var body = map[string]interface{}{
+		"ID":      service.ID,
+		"Name":    service.Name,
+		"Address": service.Address,
+		"Port":    service.Port,
+		"Tags":    service.Tags,
+		"Meta":    map[string]string{"fingerprint": service.Fingerprint, "tunnel": service.Tunnel, "protocol": service.Protocol},
+		"Check": map[string]interface{}{
+			"CheckID": "service:" + service.ID,
+			"Name":    "shhh tunnel",
+			"TTL":     registryTTL.String(),
+			"Status":  "passing",
+
+			// in case the server goes away without deregistering it (1m is the least Consul allows)
+			"DeregisterCriticalServiceAfter": "1m",
+		},
+	}
+	_, err := registryCall(registry.client, http.MethodPut, registry.base+"/v1/agent/service/register", registry.header, body, nil)
+	return err
+}
+
+func (registry *consulRegistry) deregister(service *registeredService) error {
+	_, err := registryCall(registry.client, http.MethodPut, registry.base+"/v1/agent/service/deregister/"+url.PathEscape(service.ID), registry.header, nil, nil)
+	return err
+}
+
+func (registry *consulRegistry) heartbeat(services []*registeredService) error {
+	var failed error
+	for _, service := range services {
+		var endpoint = registry.base + "/v1/agent/check/pass/" + url.PathEscape("service:"+service.ID)
+		status, err := registryCall(registry.client, http.MethodPut, endpoint, registry.header, nil, nil)
+		if status == http.StatusNotFound || (err != nil && status == http.StatusInternalServerError) {
+			err = registry.register(service) // the agent lost it (eg. it restarted, or the check expired)
+		}
+		if err != nil {
+			failed = err
+		}
+	}
+	return failed
+}
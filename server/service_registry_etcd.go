@@ -0,0 +1,110 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"net/http"
+	"time"
+)
+
+// ----------
+// This file contains the etcd backend of the service registry, which puts each tunnel under a key of its own (as
+// <prefix><service>/<id>, with a JSON description of the instance) through etcd's v3 JSON gateway (see
+// https://etcd.io/docs/v3.5/dev-guide/api_grpc_gateway/). The keys are attached to a lease the server keeps alive.
+// ----------
+
+// etcdRegistry registers tunnels in etcd
+type etcdRegistry struct {
+	base   string
+	prefix string
+	client *http.Client
+
+	lease string // ID of the lease keys are attached to; empty until granted (and after it's lost)
+}
+
+// newEtcdRegistry returns a registry putting tunnels under [prefix] in the etcd cluster at [base]
+func newEtcdRegistry(base, prefix string) *etcdRegistry {
+	return &etcdRegistry{base: base, prefix: prefix, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// etcdInstance is the value tunnels are registered with
+type etcdInstance struct {
+	Name        string   `json:"name"`
+	Address     string   `json:"address"`
+	Port        int      `json:"port"`
+	Protocol    string   `json:"protocol"`
+	Fingerprint string   `json:"fingerprint,omitempty"`
+	Tunnel      string   `json:"tunnel"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+// key returns the key of [service]
+func (registry *etcdRegistry) key(service *registeredService) string {
+	return base64.StdEncoding.EncodeToString([]byte(registry.prefix + service.Name + "/" + service.ID))
+}
+
+// grant grants the lease keys are attached to, unless it's been granted already
+func (registry *etcdRegistry) grant() error {
+	if registry.lease != "" {
+		return nil
+	}
+
+	var resp struct {
+		ID string `json:"ID"`
+	}
+	var body = map[string]interface{}{"TTL": int(registryTTL.Seconds())}
+	if _, err := registryCall(registry.client, http.MethodPost, registry.base+"/v3/lease/grant", nil, body, &resp); err != nil {
+		return err
+	}
+	if resp.ID == "" {
+		return errors.New("etcd granted no lease")
+	}
+	registry.lease = resp.ID
+	return nil
+}
+
+func (registry *etcdRegistry) register(service *registeredService) error {
+	if err := registry.grant(); err != nil {
+		return err
+	}
+
+	var value, _ = json.Marshal(etcdInstance{Name: service.Name, Address: service.Address, Port: service.Port, Protocol: service.Protocol,
+		Fingerprint: service.Fingerprint, Tunnel: service.Tunnel, Tags: service.Tags})
+	var body = map[string]string{"key": registry.key(service), "value": base64.StdEncoding.EncodeToString(value), "lease": registry.lease}
+	_, err := registryCall(registry.client, http.MethodPost, registry.base+"/v3/kv/put", nil, body, nil)
+	return err
+}
+
+func (registry *etcdRegistry) deregister(service *registeredService) error {
+	var body = map[string]string{"key": registry.key(service)}
+	_, err := registryCall(registry.client, http.MethodPost, registry.base+"/v3/kv/deleterange", nil, body, nil)
+	return err
+}
+
+func (registry *etcdRegistry) heartbeat(services []*registeredService) error {
+	if registry.lease != "" {
+		var resp struct {
+			Result struct {
+				TTL string `json:"TTL"`
+			} `json:"result"`
+		}
+		var body = map[string]string{"ID": registry.lease}
+		if _, err := registryCall(registry.client, http.MethodPost, registry.base+"/v3/lease/keepalive", nil, body, &resp); err != nil {
+			return err
+		}
+		if resp.Result.TTL != "" && resp.Result.TTL != "0" {
+			return nil
+		}
+		registry.lease = "" // it expired (eg. as etcd was unreachable for a while), along with its keys
+	}
+
+	// put the keys again, under a new lease
+	var failed error
+	for _, service := range services {
+		if err := registry.register(service); err != nil {
+			failed = err
+		}
+	}
+	return failed
+}
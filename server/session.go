@@ -0,0 +1,365 @@
+package server
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ----------
+// This file contains types and handlers that track client connections and their sessions,
+// which are used to display messages on the client terminal and run server-side commands
+// ----------
+
+const (
+	// key name for tracking *connection in ssh.Context
+	connectionContextKey = "shhh-connection"
+
+	// number of messages buffered for a client; messages are dropped if the client isn't reading them (eg. ssh -N)
+	messageBufferSize = 64
+)
+
+// connection tracks the state of a client's ssh connection
+type connection struct {
+	ctx      ssh.Context
+	notifier Notifier
+
+	// messages to be displayed on the client terminal
+	messages chan message
+
+	// client-specified options
+	options *sessionOptions
+
+	// number of successful tcpip-forward requests
+	forwards int32
+
+	// number of tunnels named after the client's --name (see aliases.go)
+	named int32
+
+	mu        sync.Mutex
+	tunnels   int           // number of active tunnels
+	endpoints []string      // public addresses of active tunnels
+	done      chan struct{} // closed once the connection has no more tunnels; ends the session
+	closed    bool
+
+	// runs the connection's background work (eg. its tunnels), until the connection goes away
+	group *group
+
+	// records the messages sent to the client; nil unless sessions are recorded
+	recording *recording
+}
+
+// connectionFromContext returns the *connection stored in [ctx]
+func connectionFromContext(ctx ssh.Context) (*connection, bool) {
+	conn, ok := ctx.Value(connectionContextKey).(*connection)
+	return conn, ok
+}
+
+// Notify sends [msg] (described by [fields], for JSON output) to be displayed on the client terminal. It never blocks;
+// if the client isn't reading messages (eg. no session is open) the message is dropped.
+func (conn *connection) Notify(msg string, fields ...field) {
+	if conn.notifier != nil {
+		conn.notifier.Notify(conn.ctx, msg)
+	}
+	conn.recording.record(msg)
+
+	select {
+	case conn.messages <- message{time: time.Now(), text: msg, fields: fields}:
+	default:
+	}
+}
+
+// tunnelStarted records that a new tunnel, exposed at [address], is active on this connection
+func (conn *connection) tunnelStarted(address string) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.tunnels++
+	conn.endpoints = append(conn.endpoints, address)
+	atomic.AddInt32(&conn.forwards, 1)
+}
+
+// tunnelDone records that the tunnel at [address] has closed; the session is ended once there are no more active tunnels
+func (conn *connection) tunnelDone(address string) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.tunnels--
+	for i, endpoint := range conn.endpoints {
+		if endpoint == address {
+			conn.endpoints = append(conn.endpoints[:i], conn.endpoints[i+1:]...)
+			break
+		}
+	}
+	conn.endIfIdleLocked()
+}
+
+// Endpoints returns the public addresses of the active tunnels on this connection
+func (conn *connection) Endpoints() []string {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return append([]string(nil), conn.endpoints...)
+}
+
+// idle returns true if there are no active tunnels on this connection
+func (conn *connection) idle() bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.tunnels == 0
+}
+
+// endIfIdle ends the session if there are no active tunnels on this connection
+func (conn *connection) endIfIdle() {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.endIfIdleLocked()
+}
+
+func (conn *connection) endIfIdleLocked() {
+	if conn.tunnels == 0 && !conn.closed {
+		conn.closed = true
+		close(conn.done)
+	}
+}
+
+// allowPty returns a ssh.PtyCallback that allows PTY allocation requests. There's no shell to run on them; a PTY
+// is only used to show the terminal UI (see --tui) or messages, and is otherwise harmless.
+func allowPty() ssh.PtyCallback {
+	return func(ctx ssh.Context, pty ssh.Pty) bool {
+		return true
+	}
+}
+
+// connectionWrapper returns a new ssh.ConnCallback which attaches a new *connection to every new
+// SSH connection. It's later used to send messages to be displayed on the client terminal and track
+// client-specified options.
+//
+// Connections from IPs banned by (or over the rate limit of) the server's sshGuard are closed right away.
+// If Config.ForwardTimeout is non-zero, connections that haven't requested any port forwarding within
+// that duration are terminated (eg. bots looking for a shell).
+func connectionWrapper(srv *Server) ssh.ConnCallback {
+	var forwardTimeout = srv.config.ForwardTimeout
+	return func(ctx ssh.Context, nc net.Conn) net.Conn {
+		if reason := srv.guard.allowHandshake(nc.RemoteAddr()); reason != "" {
+			srv.authFailure(reason, nc.RemoteAddr(), "")
+			return nil // banned, or over the rate limit
+		}
+
+		if pc, ok := nc.(*policyConn); ok {
+			ctx.SetValue(listenerContextKey, pc.policy)
+		}
+
+		var admitted = srv.startups.admit(ctx, nc)
+		if admitted == nil {
+			srv.authFailure(authMaxStartups, nc.RemoteAddr(), "")
+			return nil // too many connections haven't authenticated yet
+		}
+		nc = admitted
+
+		var conn = &connection{
+			ctx:      ctx,
+			notifier: srv.notifier,
+			messages: make(chan message, messageBufferSize),
+			options:  newSessionOptions(),
+			done:     make(chan struct{}),
+			group:    newGroup(ctx),
+		}
+		ctx.SetValue(connectionContextKey, conn)
+		srv.conns.add(conn, nc)
+
+		// clients which go away without authenticating are recorded as they do
+		var hs, addr = handshakeFromContext(ctx), nc.RemoteAddr()
+		conn.group.Go(func(ctx context.Context) error {
+			<-ctx.Done()
+			srv.handshakeFailed(addr, hs)
+			return nil
+		})
+		conn.recording = srv.recordings.start(conn, nc.RemoteAddr())
+
+		// a public preview of the connection's tunnels (see preview.go) ends with it
+		conn.group.Go(func(ctx context.Context) error {
+			<-ctx.Done()
+			conn.options.preview.end()
+			return nil
+		})
+
+		if forwardTimeout > 0 {
+			conn.group.Go(func(ctx context.Context) error {
+				var timer = time.NewTimer(forwardTimeout)
+				defer timer.Stop()
+
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-timer.C:
+				}
+
+				if atomic.LoadInt32(&conn.forwards) > 0 {
+					return nil
+				}
+
+				// try letting the client know (if they have a session open) before closing the connection
+				conn.Notify(fmt.Sprintf("no port forwarding requested within %s; closing connection", forwardTimeout), kv("type", "timeout"))
+				time.Sleep(100 * time.Millisecond) // give the session a moment to flush the message
+				_ = nc.Close()
+				return nil
+			})
+		}
+
+		// repeat offenders are slowed down
+		return srv.tarpit.wrap(ctx, nc)
+	}
+}
+
+// messageForwardingHandler returns an ssh.Handler which parses session options from the exec command,
+// reads messages for the connection and writes them to the client session's stderr (or stdout, if asked to),
+// following the server's MOTD (if any). If the exec command names one of the server's commands, it is run
+// instead and the session exits.
+func messageForwardingHandler(srv *Server) ssh.Handler {
+	var commands = commands(srv)
+	return func(s ssh.Session) {
+		var ctx = s.Context().(ssh.Context)
+
+		conn, ok := connectionFromContext(ctx)
+		if !ok {
+			_, _ = io.WriteString(s, "internal server error\n")
+			_ = s.Exit(1)
+			return
+		}
+
+		// options are set by the connection's first session; later ones (eg. ssh -S <control socket> host public 10m)
+		// only run commands, and mustn't reset them
+		var options = conn.options
+		if options.isParsed() {
+			options = newSessionOptions()
+		}
+
+		// a client reconnecting with just --name regains the options its tunnels were last opened with
+		var command = s.Command()
+		if options == conn.options {
+			command = srv.aliases.recall(Fingerprint(ctx), command)
+		}
+
+		args, err := options.Parse(command, s.Environ(), s.Stderr())
+		if err == flag.ErrHelp {
+			_ = s.Exit(0)
+			return
+		} else if err != nil {
+			_, _ = io.WriteString(s.Stderr(), fmt.Sprintf("server: %s\n", err.Error()))
+			_ = s.Exit(2)
+			return
+		}
+
+		if name := options.Name(); name != "" {
+			if err = srv.aliases.claim(name, Fingerprint(ctx)); err != nil {
+				_, _ = io.WriteString(s.Stderr(), fmt.Sprintf("server: %s\n", err.Error()))
+				_ = s.Exit(2)
+				return
+			}
+
+			if options == conn.options && len(args) == 0 {
+				srv.aliases.rememberOptions(name, Fingerprint(ctx), command)
+			}
+		}
+
+		if len(options.Access().logins) > 0 && (srv.router == nil || srv.router.oidc == nil) {
+			_, _ = io.WriteString(s.Stderr(), "server: --login isn't available; the server has no identity provider configured\n")
+			_ = s.Exit(2)
+			return
+		}
+
+		if len(args) > 0 {
+			var cmd, ok = commands[args[0]]
+			if !ok {
+				_, _ = io.WriteString(s.Stderr(), fmt.Sprintf("server: unknown command %q\n", args[0]))
+				_ = s.Exit(2)
+				return
+			}
+
+			if err = cmd(ctx, args[1:], s); err != nil {
+				_, _ = io.WriteString(s.Stderr(), fmt.Sprintf("server: %s\n", err.Error()))
+				_ = s.Exit(1)
+				return
+			}
+
+			_ = s.Exit(0)
+			return
+		}
+
+		// with a PTY (eg. ssh -t), the client's terminal is in raw mode: Ctrl-C / Ctrl-D arrive as input, and
+		// window changes have to be consumed
+		var quit = make(chan struct{})
+		pty, winch, isPty := s.Pty()
+		if isPty {
+			go watchInput(s, quit, conn.options.TUI())
+		}
+
+		if conn.options.TUI() {
+			if !isPty {
+				_, _ = io.WriteString(s.Stderr(), "server: --tui needs a terminal; connect with ssh -t\n")
+				_ = s.Exit(2)
+				return
+			}
+
+			runTerminalUI(s, conn, pty.Window, winch, quit)
+			return
+		}
+
+		// messages go to stderr (ssh extended data), so that they don't mix with anything the client reads off stdout
+		var out io.Writer = s.Stderr()
+		if conn.options.MessagesToStdout() {
+			out = s
+		}
+
+		if isPty { // lines need CRLF in raw mode
+			out = crlfWriter{out}
+			go func() {
+				for range winch {
+				}
+			}()
+		}
+
+		// scripts can ask for messages as JSON lines
+		var jsonOutput = conn.options.JSON() || hasEnv(s.Environ(), outputEnv, "json")
+		var format = message.String
+		if jsonOutput {
+			format = message.JSON
+		}
+
+		// with --quiet, routine messages are dropped
+		var quiet = conn.options.Quiet()
+		var write = func(msg message) {
+			if !quiet || !routineMessages[msg.kind()] {
+				_, _ = io.WriteString(out, format(msg))
+			}
+		}
+
+		if text := motd(srv, conn); text != "" && !jsonOutput {
+			_, _ = io.WriteString(out, text)
+		}
+
+		for {
+			select {
+			case msg := <-conn.messages:
+				write(msg)
+			case <-quit:
+				return
+			case <-ctx.Done():
+				return
+			case <-conn.done:
+				for { // flush whatever is left before closing the session
+					select {
+					case msg := <-conn.messages:
+						write(msg)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,550 @@
+package server
+
+import (
+	"flag"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains types and helpers to parse and track client-specified options
+// passed as the session's exec command (eg. ssh -R 0:localhost:3000 host -- --proxy-protocol v2)
+// ----------
+
+// how long tunnels that depend on session options (eg. --subdomain) wait for them to be parsed
+const optionsSettleTime = 500 * time.Millisecond
+
+// sessionOptions holds the client-specified options for an ssh connection
+type sessionOptions struct {
+	mu sync.RWMutex
+
+	// closed once options have been parsed from the session's exec command
+	parsed     chan struct{}
+	parsedOnce sync.Once
+	settled    bool // set once awaitParsed gave up waiting
+
+	// name the client's tunnels are known by (see aliases.go)
+	name string
+
+	// name requested for HTTP tunnels which didn't name one in their bind address
+	subdomain string
+
+	// maximum number of connections each TCP tunnel serves at the same time (0 for unlimited)
+	maxConns int
+
+	// if set, routine messages (accepted connections, HTTP requests and stats) aren't sent to the client
+	quiet bool
+
+	// if set, the client is shown a live table of connections (over a PTY) instead of messages
+	tui bool
+
+	// version of PROXY protocol header to prepend on each forwarded channel (empty to disable)
+	proxyProtocol string
+
+	// response headers of HTTP tunnels to remove, and to set (overriding the local service's)
+	removeHeaders []string
+	setHeaders    http.Header
+
+	// number of channels HTTP tunnels keep open ahead of time
+	poolSize int
+
+	// if set, the client is also notified when (and why) each forwarded connection ends
+	verbose bool
+
+	// if set, messages are written to the session's stdout instead of stderr
+	messagesToStdout bool
+
+	// visitors allowed to connect to the client's tunnels
+	sources sourceFilter
+
+	// lifts sources for a while (see publicCommand)
+	preview publicPreview
+
+	// if set, visitors of the client's TCP tunnels are sent the operator's banner first
+	banner bool
+
+	// if set, messages are written as JSON lines (see message.JSON)
+	json bool
+
+	// visitors allowed to visit the client's HTTP tunnels
+	access tunnelAccess
+
+	// how connections are spread across the clients sharing an endpoint (empty if the client doesn't share them)
+	balance string
+
+	// Kubernetes namespace the client's tunnels are exposed in, as Services (see kubernetes.go); empty if they aren't
+	kubernetes string
+
+	// channels each tunnel may be opening at once (0 for the server's limit), and how long further connections wait
+	// for one of them to complete (unless pendingWaitSet is false, for the server's default)
+	maxPending     int
+	pendingWait    time.Duration
+	pendingWaitSet bool
+
+	// if set, requests for a specific port that's taken wait for it to free up (see port_queue.go)
+	waitForPort bool
+
+	// how long the client's tunnels stay open (0 until they're closed, or the server's limit); see ttl.go
+	ttl time.Duration
+
+	// labels of the client's tunnels (see tags.go): its own (with --tag), the operator's for its key, and those
+	// attached by the operator's hooks
+	clientTags, configTags, tags map[string]string
+}
+
+// response headers which identify the local service's stack, removed with -hide-server
+var identifyingHeaders = []string{"Server", "X-Powered-By", "X-AspNet-Version", "X-AspNetMvc-Version"}
+
+// newSessionOptions returns new, empty sessionOptions
+func newSessionOptions() *sessionOptions { return &sessionOptions{parsed: make(chan struct{})} }
+
+// awaitParsed waits up to [timeout] for the options to be parsed, since the session (with its exec command) is usually
+// opened alongside the client's tunnels. For clients without a session (eg. ssh -N), it only waits the first time;
+// later calls return right away.
+func (opts *sessionOptions) awaitParsed(timeout time.Duration) {
+	opts.mu.RLock()
+	var settled = opts.settled
+	opts.mu.RUnlock()
+	if settled {
+		return
+	}
+
+	select {
+	case <-opts.parsed:
+	case <-time.After(timeout):
+		opts.mu.Lock()
+		opts.settled = true
+		opts.mu.Unlock()
+	}
+}
+
+// WaitForPort returns true if the client asked to wait for specific ports that are taken, rather than fail
+func (opts *sessionOptions) WaitForPort() bool {
+	opts.mu.RLock()
+	defer opts.mu.RUnlock()
+	return opts.waitForPort
+}
+
+// TTL returns how long the client asked its tunnels to stay open for (0 for as long as it wants)
+func (opts *sessionOptions) TTL() time.Duration {
+	opts.mu.RLock()
+	defer opts.mu.RUnlock()
+	return opts.ttl
+}
+
+// Name returns the name the client asked its tunnels to be known by
+func (opts *sessionOptions) Name() string {
+	opts.mu.RLock()
+	defer opts.mu.RUnlock()
+	return opts.name
+}
+
+// Subdomain returns the name the client requested for HTTP tunnels that didn't name one
+func (opts *sessionOptions) Subdomain() string {
+	opts.mu.RLock()
+	defer opts.mu.RUnlock()
+	return opts.subdomain
+}
+
+// MaxConns returns the maximum number of connections each of the client's TCP tunnels serves at the same time
+func (opts *sessionOptions) MaxConns() int {
+	opts.mu.RLock()
+	defer opts.mu.RUnlock()
+	return opts.maxConns
+}
+
+// MaxPending returns the number of channels each of the client's tunnels may be opening at once (0 for the server's
+// limit)
+func (opts *sessionOptions) MaxPending() int {
+	opts.mu.RLock()
+	defer opts.mu.RUnlock()
+	return opts.maxPending
+}
+
+// PendingWait returns how long connections wait for a channel of the client's tunnels to complete opening, once as
+// many as allowed are; ok is false if the client left it to the server
+func (opts *sessionOptions) PendingWait() (d time.Duration, ok bool) {
+	opts.mu.RLock()
+	defer opts.mu.RUnlock()
+	return opts.pendingWait, opts.pendingWaitSet
+}
+
+// Quiet returns true if the client asked not to be sent routine messages (see routineMessages)
+func (opts *sessionOptions) Quiet() bool {
+	opts.mu.RLock()
+	defer opts.mu.RUnlock()
+	return opts.quiet
+}
+
+// ProxyProtocol returns the PROXY protocol version requested by the client
+func (opts *sessionOptions) ProxyProtocol() string {
+	opts.mu.RLock()
+	defer opts.mu.RUnlock()
+	return opts.proxyProtocol
+}
+
+// PoolSize returns the number of channels the client asked HTTP tunnels to keep open ahead of time
+func (opts *sessionOptions) PoolSize() int {
+	opts.mu.RLock()
+	defer opts.mu.RUnlock()
+	return opts.poolSize
+}
+
+// Verbose returns true if the client asked to be notified when each forwarded connection ends (with --verbose, or
+// implicitly with --tui, as the terminal UI shows them)
+func (opts *sessionOptions) Verbose() bool {
+	opts.mu.RLock()
+	defer opts.mu.RUnlock()
+	return opts.verbose || opts.tui
+}
+
+// TUI returns true if the client asked for the terminal UI in place of messages
+func (opts *sessionOptions) TUI() bool {
+	opts.mu.RLock()
+	defer opts.mu.RUnlock()
+	return opts.tui
+}
+
+// MessagesToStdout returns true if the client asked for messages on the session's stdout (rather than stderr)
+func (opts *sessionOptions) MessagesToStdout() bool {
+	opts.mu.RLock()
+	defer opts.mu.RUnlock()
+	return opts.messagesToStdout
+}
+
+// Sources returns the filter of visitors the client allows to connect to its tunnels
+func (opts *sessionOptions) Sources() sourceFilter {
+	opts.mu.RLock()
+	defer opts.mu.RUnlock()
+	return opts.sources
+}
+
+// Public returns true if the client's tunnels are open to anyone for now, regardless of Sources (see publicCommand)
+func (opts *sessionOptions) Public() bool { return opts.preview.active() }
+
+// Tags returns the tags of the client's tunnels: its own, overridden by the operator's, overridden by hooks'
+func (opts *sessionOptions) Tags() map[string]string {
+	opts.mu.RLock()
+	defer opts.mu.RUnlock()
+
+	var tags = make(map[string]string, len(opts.clientTags)+len(opts.configTags)+len(opts.tags))
+	for _, of := range []map[string]string{opts.clientTags, opts.configTags, opts.tags} {
+		for k, v := range of {
+			tags[k] = v
+		}
+	}
+	return tags
+}
+
+// setConfigTags sets the operator's [tags] for the client's key (see Config.Tags)
+func (opts *sessionOptions) setConfigTags(tags map[string]string) {
+	opts.mu.Lock()
+	defer opts.mu.Unlock()
+	opts.configTags = tags
+}
+
+// addTags attaches [tags] (from hooks) to the client, overriding those it has already with the same keys
+func (opts *sessionOptions) addTags(tags map[string]string) {
+	if len(tags) == 0 {
+		return
+	}
+
+	opts.mu.Lock()
+	defer opts.mu.Unlock()
+	if opts.tags == nil {
+		opts.tags = make(map[string]string, len(tags))
+	}
+	for k, v := range tags {
+		opts.tags[k] = v
+	}
+}
+
+// isParsed returns true if options have already been parsed from a session's exec command
+func (opts *sessionOptions) isParsed() bool {
+	select {
+	case <-opts.parsed:
+		return true
+	default:
+		return false
+	}
+}
+
+// JSON returns true if the client asked for messages as JSON lines
+func (opts *sessionOptions) JSON() bool {
+	opts.mu.RLock()
+	defer opts.mu.RUnlock()
+	return opts.json
+}
+
+// Banner returns true if the client asked for visitors of its TCP tunnels to be sent the operator's banner
+func (opts *sessionOptions) Banner() bool {
+	opts.mu.RLock()
+	defer opts.mu.RUnlock()
+	return opts.banner
+}
+
+// Balance returns how the client asked for connections to be spread across the clients sharing its HTTP and TCP
+// endpoints, or an empty string if it didn't ask to share them
+func (opts *sessionOptions) Balance() string {
+	if opts == nil {
+		return ""
+	}
+
+	opts.mu.RLock()
+	defer opts.mu.RUnlock()
+	return opts.balance
+}
+
+// Kubernetes returns the Kubernetes namespace the client asked its tunnels to be exposed in (empty if none)
+func (opts *sessionOptions) Kubernetes() string {
+	if opts == nil {
+		return ""
+	}
+
+	opts.mu.RLock()
+	defer opts.mu.RUnlock()
+	return opts.kubernetes
+}
+
+// Access returns who may visit the client's HTTP tunnels (anyone, if there are no options)
+func (opts *sessionOptions) Access() tunnelAccess {
+	if opts == nil {
+		return tunnelAccess{}
+	}
+
+	opts.mu.RLock()
+	defer opts.mu.RUnlock()
+	return opts.access
+}
+
+// RewriteResponseHeaders applies the client's header rewrites to the response [header] of an HTTP tunnel
+func (opts *sessionOptions) RewriteResponseHeaders(header http.Header) {
+	opts.mu.RLock()
+	defer opts.mu.RUnlock()
+
+	for _, name := range opts.removeHeaders {
+		header.Del(name)
+	}
+
+	for name, values := range opts.setHeaders {
+		header[name] = values
+	}
+}
+
+// prefix of environment variables (eg. ssh -o SetEnv=SHHH_SUBDOMAIN=myapp) which set options, for clients that can't
+// pass them in the exec command
+const envOptionPrefix = "SHHH_"
+
+// Parse parses the given command line [args] and updates the options. Options can also be set by environment
+// variables in [environ] (eg. SHHH_MAX_CONNS=10 for --max-conns 10), which the command line overrides. It returns
+// the remaining non-flag arguments (if any), which name a command to run. Invalid options are reported with an error
+// meant for the client; if the client asked for --help, the list of options is written to [output] and flag.ErrHelp
+// is returned.
+func (opts *sessionOptions) Parse(args, environ []string, output io.Writer) ([]string, error) {
+	var fs = flag.NewFlagSet("shhh", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard) // errors are returned to the client, along with a hint to use --help
+	fs.Usage = func() {}
+
+	var proxyProtocol = fs.String("proxy-protocol", "", "prepend PROXY protocol header (v1 or v2) on each forwarded connection")
+	var name = fs.String("name", "", "name the tunnels are known by (eg. in the admin API and metrics); reconnecting with just --name regains their ports and options")
+	var subdomain = fs.String("subdomain", "", "name of HTTP tunnels that don't name one in their bind address (eg. -R 80:localhost:3000)")
+	var maxConns = fs.Int("max-conns", 0, "maximum number of connections each TCP tunnel serves at the same time (0 for unlimited)")
+	var maxPending = fs.Int("max-pending", 0, "maximum number of channels each tunnel opens with the client at once; further connections wait for one of them (0 for the server's limit)")
+	var pendingWait = fs.String("pending-wait", "", "how long connections wait once --max-pending channels are being opened, before they're rejected (eg. 2s, or 0 to reject them right away)")
+	var hideServer = fs.Bool("hide-server", false, "remove headers identifying the local service (Server, X-Powered-By etc.) from HTTP responses")
+	var poolSize = fs.Int("pool", 0, "number of channels HTTP tunnels keep open ahead of time, to serve bursts of requests faster")
+	var verbose = fs.Bool("verbose", false, "notify when (and why) each forwarded connection ends")
+	var quiet = fs.Bool("quiet", false, "don't notify of accepted connections, HTTP requests and stats")
+	var tui = fs.Bool("tui", false, "show a live table of connections instead of messages (needs a terminal; use ssh -t)")
+	var banner = fs.Bool("banner", false, "send the server's banner to visitors of TCP tunnels before forwarding their traffic")
+	var jsonOutput = fs.Bool("json", false, "write messages from the server as JSON lines, for scripts to parse")
+	var waitForPort = fs.Bool("wait-for-port", false, "if a port asked for is taken, wait in line for it to free up rather than fail")
+	var ttl = fs.String("ttl", "", "close the tunnels once they've been open this long (eg. 2h), with a warning ahead of it")
+	var balance = fs.String("balance", "", "share HTTP and TCP endpoints with other clients using the same key, spreading connections across them (round-robin or least-conns)")
+	var kubernetes = fs.String("kubernetes", "", "expose the tunnels as Services in this Kubernetes namespace (if the server allows it)")
+	var messages = fs.String("messages", "stderr", "where to write messages from the server (stdout or stderr)")
+	var allowSources, denySources stringsFlag
+	fs.Var(&allowSources, "allow-source", "only allow visitors from this CIDR to connect (can be repeated)")
+	fs.Var(&denySources, "deny-source", "deny visitors from this CIDR from connecting (can be repeated)")
+	fs.Var(&allowSources, "allow-cidr", "same as --allow-source")
+	fs.Var(&denySources, "deny-cidr", "same as --deny-source")
+	var basicAuth, logins stringsFlag
+	fs.Var(&basicAuth, "basic-auth", "require visitors of HTTP tunnels to give these credentials, as user:password (can be repeated)")
+	fs.Var(&logins, "login", "require visitors of HTTP tunnels to log in with the server's identity provider as this email, @domain or * (can be repeated)")
+	var removeHeaders, setHeaders stringsFlag
+	var tags stringsFlag
+	fs.Var(&tags, "tag", "attach a key=value tag to the tunnels, reported in the server's events, metrics and admin API (can be repeated)")
+	fs.Var(&removeHeaders, "remove-header", "remove the named header from HTTP responses (can be repeated)")
+	fs.Var(&setHeaders, "set-header", "set a header (as \"Name: value\") on HTTP responses (can be repeated)")
+
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		_, _ = io.WriteString(output, "usage: ssh -R <bind>:<host>:<port> <server> -- [options] [command]\n\noptions:\n")
+		fs.SetOutput(output)
+		fs.PrintDefaults()
+		return nil, err
+	} else if err != nil {
+		return nil, errors.Errorf("%s (use --help to list the available options)", strings.Replace(err.Error(), "flag provided but not defined", "unknown option", 1))
+	}
+
+	// options set on the command line (by any of their names, for those with aliases, eg. --allow-cidr)
+	var set = make(map[flag.Value]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Value] = true })
+
+	for _, pair := range environ {
+		var parts = strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], envOptionPrefix) || parts[0] == outputEnv {
+			continue
+		}
+
+		var name = strings.Replace(strings.ToLower(strings.TrimPrefix(parts[0], envOptionPrefix)), "_", "-", -1)
+		if fs.Lookup(name) == nil {
+			return nil, errors.Errorf("unknown option --%s (set by %s; use --help to list the available options)", name, parts[0])
+		}
+
+		// the command line overrides the environment, rather than adding to it (as it would, for repeatable options)
+		if set[fs.Lookup(name).Value] {
+			continue
+		}
+
+		if err := fs.Set(name, parts[1]); err != nil {
+			return nil, errors.Errorf("invalid value %q for %s: %s", parts[1], parts[0], err.Error())
+		}
+	}
+
+	if !isValidProxyProtocolVersion(*proxyProtocol) {
+		return nil, errors.Errorf("invalid value %q for --proxy-protocol: must be one of v1 or v2", *proxyProtocol)
+	}
+
+	if *subdomain = strings.ToLower(*subdomain); *subdomain != "" && !tunnelNamePattern.MatchString(*subdomain) {
+		return nil, errors.Errorf("invalid value %q for --subdomain: must be a valid DNS label (letters, digits and hyphens)", *subdomain)
+	}
+
+	if *name = strings.ToLower(*name); *name != "" && !tunnelNamePattern.MatchString(*name) {
+		return nil, errors.Errorf("invalid value %q for --name: must be a valid DNS label (letters, digits and hyphens)", *name)
+	}
+
+	if *maxConns < 0 {
+		return nil, errors.Errorf("invalid value %d for --max-conns: must not be negative", *maxConns)
+	}
+
+	if *maxPending < 0 {
+		return nil, errors.Errorf("invalid value %d for --max-pending: must not be negative", *maxPending)
+	}
+
+	var wait time.Duration
+	if *pendingWait != "" {
+		var err error
+		if wait, err = time.ParseDuration(*pendingWait); err != nil || wait < 0 {
+			return nil, errors.Errorf("invalid value %q for --pending-wait: must be a duration (eg. 2s)", *pendingWait)
+		}
+	}
+
+	var lifetime time.Duration
+	if *ttl != "" {
+		var err error
+		if lifetime, err = time.ParseDuration(*ttl); err != nil || lifetime <= 0 {
+			return nil, errors.Errorf("invalid value %q for --ttl: must be a positive duration (eg. 2h)", *ttl)
+		}
+	}
+
+	if *messages != "stdout" && *messages != "stderr" {
+		return nil, errors.Errorf("invalid value %q for --messages: must be one of stdout or stderr", *messages)
+	}
+
+	if *balance != "" && *balance != balanceRoundRobin && *balance != balanceLeastConns {
+		return nil, errors.Errorf("invalid value %q for --balance: must be one of round-robin or least-conns", *balance)
+	}
+
+	if *kubernetes = strings.ToLower(*kubernetes); *kubernetes != "" && !tunnelNamePattern.MatchString(*kubernetes) {
+		return nil, errors.Errorf("invalid value %q for --kubernetes: must be a valid namespace (letters, digits and hyphens)", *kubernetes)
+	}
+
+	if *quiet && *verbose {
+		return nil, errors.New("--quiet and --verbose can't be used together")
+	}
+
+	sources, err := newSourceFilter(allowSources, denySources)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid value for --allow-source / --deny-source")
+	}
+
+	if err = parseCredentials(basicAuth); err != nil {
+		return nil, err
+	}
+
+	if err = parseLogins(logins); err != nil {
+		return nil, err
+	}
+
+	if *poolSize < 0 {
+		return nil, errors.Errorf("invalid value %d for --pool: must not be negative", *poolSize)
+	}
+
+	if *hideServer {
+		removeHeaders = append(removeHeaders, identifyingHeaders...)
+	}
+
+	if len(tags) > maxTags {
+		return nil, errors.Errorf("invalid value for --tag: at most %d tags are allowed", maxTags)
+	}
+	var clientTags = make(map[string]string, len(tags))
+	for _, tag := range tags {
+		key, value, err := parseTag(tag)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid value for --tag")
+		}
+		clientTags[key] = value
+	}
+
+	var headers = make(http.Header)
+	for _, h := range setHeaders {
+		var parts = strings.SplitN(h, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, errors.Errorf("invalid value %q for --set-header: must be of the form \"Name: value\"", h)
+		}
+		headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	opts.mu.Lock()
+	defer opts.mu.Unlock()
+	opts.proxyProtocol = *proxyProtocol
+	opts.subdomain = *subdomain
+	opts.name = *name
+	opts.maxConns = *maxConns
+	opts.removeHeaders = removeHeaders
+	opts.setHeaders = headers
+	opts.poolSize = *poolSize
+	opts.verbose = *verbose
+	opts.quiet = *quiet
+	opts.tui = *tui
+	opts.banner = *banner
+	opts.json = *jsonOutput
+	opts.messagesToStdout = *messages == "stdout"
+	opts.sources = sources
+	opts.access = tunnelAccess{credentials: basicAuth, logins: logins}
+	opts.balance = *balance
+	opts.kubernetes = *kubernetes
+	opts.clientTags = clientTags
+	opts.maxPending = *maxPending
+	opts.pendingWait, opts.pendingWaitSet = wait, *pendingWait != ""
+	opts.ttl = lifetime
+	opts.waitForPort = *waitForPort
+	opts.parsedOnce.Do(func() { close(opts.parsed) })
+
+	return fs.Args(), nil
+}
+
+// stringsFlag is a flag.Value that collects values of a repeated flag
+type stringsFlag []string
+
+func (list *stringsFlag) String() string { return strings.Join(*list, ",") }
+
+func (list *stringsFlag) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestSessionOptionsCommandLineOverridesEnvironment(t *testing.T) {
+	var visitor = func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234} }
+
+	t.Run("repeatable", func(t *testing.T) {
+		var opts = newSessionOptions()
+		var environ = []string{"SHHH_ALLOW_CIDR=10.0.0.0/8", "SHHH_TAG=env=yes", "SHHH_SET_HEADER=X-From: env"}
+		var args = []string{"--allow-cidr", "192.168.0.0/16", "--tag", "cli=yes", "--set-header", "X-From: cli"}
+		if _, err := opts.Parse(args, environ, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+
+		if sources := opts.Sources(); sources.permits(visitor("10.1.2.3")) || !sources.permits(visitor("192.168.1.1")) {
+			t.Errorf("visitors allowed by the environment, rather than by the command line only")
+		}
+		if tags := opts.Tags(); !reflect.DeepEqual(tags, map[string]string{"cli": "yes"}) {
+			t.Errorf("got tags %v, want those of the command line only", tags)
+		}
+		if got := opts.setHeaders.Get("X-From"); len(opts.setHeaders["X-From"]) != 1 || got != "cli" {
+			t.Errorf("got headers %v, want those of the command line only", opts.setHeaders)
+		}
+	})
+
+	// an option set by an alias on the command line isn't added to by the environment either
+	t.Run("alias", func(t *testing.T) {
+		var opts = newSessionOptions()
+		if _, err := opts.Parse([]string{"--allow-source", "192.168.0.0/16"}, []string{"SHHH_ALLOW_CIDR=10.0.0.0/8"}, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+		if opts.Sources().permits(visitor("10.1.2.3")) {
+			t.Errorf("visitors allowed by the environment, rather than by the command line only")
+		}
+	})
+
+	// options the command line doesn't set are still set by the environment
+	t.Run("environment only", func(t *testing.T) {
+		var opts = newSessionOptions()
+		if _, err := opts.Parse([]string{"--tag", "cli=yes"}, []string{"SHHH_ALLOW_CIDR=10.0.0.0/8", "SHHH_MAX_CONNS=3"}, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+		if !opts.Sources().permits(visitor("10.1.2.3")) || opts.Sources().permits(visitor("192.168.1.1")) || opts.MaxConns() != 3 {
+			t.Errorf("options set by the environment weren't applied")
+		}
+	})
+}
@@ -0,0 +1,288 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ----------
+// This file contains types and methods for the TLS edge, which routes incoming TLS connections to tunnels based on
+// the server name (SNI) in their ClientHello, without terminating them; the client's local service holds the
+// certificate, so traffic stays encrypted end-to-end (eg. ssh -R myapp:443:localhost:8443 exposes myapp.<domain>:443)
+// ----------
+
+// port requested by clients (in tcpip-forward) to create a TLS tunnel
+const tlsPort = 443
+
+// time visitors have to send their ClientHello before they're disconnected
+const clientHelloTimeout = 10 * time.Second
+
+// ErrTLSEdgeClosed is returned by Server.ServeTLSEdge after Shutdown or Close
+var ErrTLSEdgeClosed = errors.New("tls edge closed")
+
+// errHelloRead aborts the handshake once the ClientHello has been read
+var errHelloRead = errors.New("client hello read")
+
+// sniTunnel represents a tunnel registered with the TLS edge
+type sniTunnel struct {
+	host       string
+	notify     notifyFn
+	newChannel newChannelFn
+	options    *sessionOptions
+
+	// number of connections being forwarded, limited by --max-conns
+	conns int32
+
+	// tracks in-flight connections
+	active sync.WaitGroup
+}
+
+// sniRouter routes incoming TLS connections to registered tunnels based on the server name in their ClientHello
+type sniRouter struct {
+	domain string
+
+	// hostnames matching any of these patterns can't be registered
+	denied []string
+
+	// connections being forwarded through tunnels
+	forwarded *forwardedConns
+
+	// applies the operator's TCP options to visitors' connections
+	tune func(net.Listener) net.Listener
+
+	// connections for sshHost (if set) are passed on to ssh, as ssh connections wrapped in TLS
+	sshHost string
+	ssh     func(net.Conn)
+
+	// relays connections for the name to the node of the cluster serving its tunnel, if another one does; returns
+	// false if it doesn't (or nodes don't relay connections)
+	relay func(name string, conn net.Conn) bool
+
+	mu        sync.RWMutex
+	tunnels   map[string]*sniTunnel
+	listeners []net.Listener
+	closed    bool
+}
+
+// newSNIRouter returns a new sniRouter serving tunnels as sub-domains of the configured domain, whose connections
+// are tracked in [forwarded]
+func newSNIRouter(config *Config, forwarded *forwardedConns) (*sniRouter, error) {
+	var router = &sniRouter{
+		domain:    strings.ToLower(config.Domain),
+		denied:    config.DeniedHosts,
+		forwarded: forwarded,
+		tune:      func(ln net.Listener) net.Listener { return tuneListener(config, ln) },
+		tunnels:   make(map[string]*sniTunnel),
+	}
+
+	for _, pattern := range router.denied {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid denied host pattern %q", pattern)
+		}
+	}
+
+	return router, nil
+}
+
+// Register registers a new tunnel using [name], reachable at <name>.<domain>. Unlike HTTP tunnels, a name is
+// required, as it must match the certificate of the client's local service.
+func (router *sniRouter) Register(name string, newChannel newChannelFn, notify notifyFn, options *sessionOptions) (*sniTunnel, error) {
+	if name = strings.ToLower(name); name == "" {
+		return nil, errors.New("TLS tunnels need a name matching your certificate (eg. -R myapp:443:localhost:8443)")
+	}
+
+	if !tunnelNamePattern.MatchString(name) {
+		return nil, errors.Errorf("invalid name %q: must be a valid DNS label", name)
+	}
+
+	var host = name + "." + router.domain
+	if router.isDenied(host) {
+		return nil, errors.Errorf("name %q is not allowed", name)
+	}
+
+	router.mu.Lock()
+	defer router.mu.Unlock()
+
+	if _, exists := router.tunnels[host]; exists {
+		return nil, errors.Errorf("name %q is already in use", name)
+	}
+
+	var tunnel = &sniTunnel{host: host, notify: notify, newChannel: newChannel, options: options}
+	router.tunnels[host] = tunnel
+	return tunnel, nil
+}
+
+// Deregister removes the [tunnel] from the router; no new connections are routed to it afterwards
+func (router *sniRouter) Deregister(tunnel *sniTunnel) {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+
+	if router.tunnels[tunnel.host] == tunnel {
+		delete(router.tunnels, tunnel.host)
+	}
+}
+
+// isDenied returns true if [host] matches any of the denied host patterns
+func (router *sniRouter) isDenied(host string) bool {
+	for _, pattern := range router.denied {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the tunnel registered for [host] (if any), taking care of the in-flight connection accounting
+func (router *sniRouter) lookup(host string) *sniTunnel {
+	router.mu.RLock()
+	defer router.mu.RUnlock()
+
+	var tunnel, ok = router.tunnels[host]
+	if ok {
+		tunnel.active.Add(1)
+	}
+	return tunnel
+}
+
+// serve accepts incoming TLS connections on [ln] and forwards them to tunnels, until the router is closed
+func (router *sniRouter) serve(ln net.Listener) error {
+	router.mu.Lock()
+	if router.closed {
+		router.mu.Unlock()
+		_ = ln.Close()
+		return ErrTLSEdgeClosed
+	}
+	ln = router.tune(ln)
+	router.listeners = append(router.listeners, ln)
+	router.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			router.mu.RLock()
+			var closed = router.closed
+			router.mu.RUnlock()
+			if closed {
+				return ErrTLSEdgeClosed
+			}
+
+			if oe, ok := err.(*net.OpError); ok && (oe.Timeout() || oe.Temporary()) {
+				continue
+			}
+			return errors.Wrap(err, "failed to accept new connection")
+		}
+
+		go router.handle(conn)
+	}
+}
+
+// handle reads the ClientHello of [conn], and forwards it (including the ClientHello) to the tunnel it names, or to
+// ssh for the ssh host. Connections without a server name, or for a name without a tunnel, are closed.
+func (router *sniRouter) handle(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	name, hello, err := readServerName(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil || router.isDenied(name) {
+		_ = conn.Close()
+		return
+	}
+
+	if router.sshHost != "" && name == router.sshHost {
+		router.ssh(&peekedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(hello), conn)})
+		return
+	}
+
+	var tunnel = router.lookup(name)
+	if tunnel == nil {
+		var relayed = false
+		if short := strings.TrimSuffix(name, "."+router.domain); short != name && router.relay != nil {
+			relayed = router.relay(short, &peekedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(hello), conn)})
+		}
+		if !relayed {
+			_ = conn.Close()
+		}
+		return
+	}
+	defer tunnel.active.Done()
+
+	if max := maxConns(tunnel.options); max > 0 && atomic.LoadInt32(&tunnel.conns) >= int32(max) {
+		router.forwarded.metrics.connectionDenied("max_conns")
+		if tunnel.options.Verbose() {
+			tunnel.notify(fmt.Sprintf("denied connection from %s: over the limit of %d connections", conn.RemoteAddr().String(), max),
+				kv("type", "connection.denied"), kv("visitor", conn.RemoteAddr().String()), kv("reason", "max_conns"))
+		}
+		_ = conn.Close()
+		return
+	}
+
+	atomic.AddInt32(&tunnel.conns, 1)
+	defer atomic.AddInt32(&tunnel.conns, -1)
+	forwardConnection(&peekedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(hello), conn)},
+		tunnel.notify, tunnel.newChannel, tunnel.options, router.forwarded)
+}
+
+// close stops accepting new connections on all listeners; connections being forwarded carry on
+func (router *sniRouter) close() {
+	if router == nil {
+		return
+	}
+
+	router.mu.Lock()
+	defer router.mu.Unlock()
+
+	router.closed = true
+	for _, ln := range router.listeners {
+		_ = ln.Close()
+	}
+}
+
+// readServerName reads the ClientHello from [conn], and returns the server name (SNI) it asks for along with the
+// bytes read, which must be passed on ahead of the rest of the connection. The handshake is aborted as soon as the
+// ClientHello is parsed; nothing is written to [conn].
+func readServerName(conn net.Conn) (string, []byte, error) {
+	var hello bytes.Buffer
+	var name string
+
+	var config = &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = info.ServerName
+			return nil, errHelloRead
+		},
+	}
+
+	var err = tls.Server(&peekedConn{Conn: conn, r: io.TeeReader(conn, &hello), readOnly: true}, config).Handshake()
+	if err != errHelloRead && name == "" {
+		return "", nil, errors.Wrap(err, "failed to read client hello")
+	}
+
+	if name == "" {
+		return "", nil, errors.New("client hello has no server name")
+	}
+	return strings.ToLower(name), hello.Bytes(), nil
+}
+
+// peekedConn is a net.Conn whose reads come from r (eg. bytes already read from the connection, followed by the rest
+// of it). If readOnly is set, writes fail.
+type peekedConn struct {
+	net.Conn
+	r        io.Reader
+	readOnly bool
+}
+
+func (conn *peekedConn) Read(b []byte) (int, error) { return conn.r.Read(b) }
+
+func (conn *peekedConn) Write(b []byte) (int, error) {
+	if conn.readOnly {
+		return 0, io.ErrClosedPipe
+	}
+	return conn.Conn.Write(b)
+}
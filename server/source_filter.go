@@ -0,0 +1,44 @@
+package server
+
+import (
+	"net"
+)
+
+// ----------
+// This file contains the filter deciding which visitors (by source address) may connect to a tunnel's public listener
+// ----------
+
+// sourceFilter allows or denies visitors based on their source address
+type sourceFilter struct {
+	allow ipNetworks // if non-empty, only visitors from these networks are allowed
+	deny  ipNetworks // visitors from these networks are denied, even if they're allowed above
+}
+
+// newSourceFilter returns a new sourceFilter using the given [allow] and [deny] CIDRs
+func newSourceFilter(allow, deny []string) (filter sourceFilter, err error) {
+	if filter.allow, err = parseIPNetworks(allow); err != nil {
+		return filter, err
+	}
+
+	if filter.deny, err = parseIPNetworks(deny); err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
+
+// restricts returns true if the filter denies anyone at all
+func (filter sourceFilter) restricts() bool { return len(filter.allow) > 0 || len(filter.deny) > 0 }
+
+// permits returns true if visitors from [addr] are allowed. Visitors over a unix socket (without an IP address)
+// are always allowed.
+func (filter sourceFilter) permits(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+
+	if filter.deny.contains(tcp.IP) {
+		return false
+	}
+	return len(filter.allow) == 0 || filter.allow.contains(tcp.IP)
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains the brute-force protection of the ssh listener: handshakes are rate limited per source IP,
+// and IPs whose connections repeatedly fail to authenticate are banned for a while. Failures are counted per
+// connection (see Server.handshakeFailed), not per key offered: clients try all the keys they have, and may only ask
+// whether one would be accepted. A successful login clears the count.
+// ----------
+
+// window over which handshakes are counted (see Config.SSHRateLimit)
+const sshGuardWindow = time.Minute
+
+// sshGuard tracks handshakes and authentication failures per source IP. A nil *sshGuard allows everything.
+type sshGuard struct {
+	rateLimit   int           // maximum handshakes per IP per window (0 for unlimited)
+	maxFailures int           // failed connections after which an IP is banned (0 to never ban)
+	banFor      time.Duration // how long IPs are banned
+	exempt      ipNetworks    // IPs which are never limited or banned
+
+	mu        sync.Mutex
+	clients   map[string]*sshGuardState
+	lastPrune time.Time
+}
+
+// sshGuardState is the state tracked for a single IP
+type sshGuardState struct {
+	windowStart time.Time
+	handshakes  int
+	failures    int
+	bannedUntil time.Time
+}
+
+// newSSHGuard returns a new sshGuard as configured in [config], or nil if neither rate limiting nor bans are enabled
+func newSSHGuard(config *Config) (*sshGuard, error) {
+	if config.SSHRateLimit <= 0 && config.MaxAuthFailures <= 0 {
+		return nil, nil
+	}
+
+	exempt, err := parseIPNetworks(config.SSHGuardExempt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sshGuard{
+		rateLimit:   config.SSHRateLimit,
+		maxFailures: config.MaxAuthFailures,
+		banFor:      config.BanDuration,
+		exempt:      exempt,
+		clients:     make(map[string]*sshGuardState),
+	}, nil
+}
+
+// allowHandshake records a new connection from [addr], and returns why it's rejected (authBanned or
+// authRateLimited), or an empty string if it's allowed
+func (guard *sshGuard) allowHandshake(addr net.Addr) string {
+	var ip = addrIP(addr)
+	if guard == nil || ip == nil || guard.exempt.contains(ip) {
+		return ""
+	}
+
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+
+	var now = time.Now()
+	var state = guard.state(ip.String(), now)
+	if now.Before(state.bannedUntil) {
+		return authBanned
+	}
+
+	if now.Sub(state.windowStart) >= sshGuardWindow {
+		state.windowStart, state.handshakes = now, 0
+	}
+
+	if state.handshakes++; guard.rateLimit > 0 && state.handshakes > guard.rateLimit {
+		return authRateLimited
+	}
+	return ""
+}
+
+// authFailed records that a connection from [addr] failed to authenticate, banning it if it has failed too many times
+func (guard *sshGuard) authFailed(addr net.Addr) {
+	var ip = addrIP(addr)
+	if guard == nil || guard.maxFailures <= 0 || ip == nil || guard.exempt.contains(ip) {
+		return
+	}
+
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+
+	var now = time.Now()
+	var state = guard.state(ip.String(), now)
+	if state.failures++; state.failures >= guard.maxFailures {
+		state.failures, state.bannedUntil = 0, now.Add(guard.banFor)
+		log.Printf("banned %s for %s after %d authentication failures", ip, guard.banFor, guard.maxFailures)
+	}
+}
+
+// authenticated records that a client authenticated from [addr], which clears its failures
+func (guard *sshGuard) authenticated(addr net.Addr) {
+	var ip = addrIP(addr)
+	if guard == nil || ip == nil {
+		return
+	}
+
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+	if state, ok := guard.clients[ip.String()]; ok {
+		state.failures = 0
+	}
+}
+
+// state returns the state of [ip], creating it if needed; must be called with guard.mu held.
+// States of IPs which aren't banned and haven't been seen in a while are forgotten every now and then.
+func (guard *sshGuard) state(ip string, now time.Time) *sshGuardState {
+	if now.Sub(guard.lastPrune) >= sshGuardWindow {
+		for key, state := range guard.clients {
+			if now.Sub(state.windowStart) >= sshGuardWindow && now.After(state.bannedUntil) {
+				delete(guard.clients, key)
+			}
+		}
+		guard.lastPrune = now
+	}
+
+	state, ok := guard.clients[ip]
+	if !ok {
+		state = &sshGuardState{windowStart: now}
+		guard.clients[ip] = state
+	}
+	return state
+}
+
+// addrIP returns the IP of [addr], or nil if it doesn't have one
+func addrIP(addr net.Addr) net.IP {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	return nil
+}
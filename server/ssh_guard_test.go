@@ -0,0 +1,74 @@
+package server_test
+
+import (
+	"github.com/riyaz-ali/shhh/internal/harness"
+	"github.com/riyaz-ali/shhh/server"
+	gossh "golang.org/x/crypto/ssh"
+	"testing"
+	"time"
+)
+
+// dialKeys connects to [srv] with [keys], tried in turn as ssh does with those of an agent, and returns whether
+// the client was let in. It gives the server a moment to record the connection's failure, if it failed.
+func dialKeys(srv *harness.Server, keys ...gossh.Signer) bool {
+	client, err := gossh.Dial("tcp", srv.Addr, &gossh.ClientConfig{
+		User:            "harness",
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(keys...)},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		time.Sleep(100 * time.Millisecond)
+		return false
+	}
+	_ = client.Close()
+	return true
+}
+
+// startGuarded starts a server banning IPs after [maxFailures]
+func startGuarded(t *testing.T, maxFailures int) *harness.Server {
+	var config = server.DefaultConfig()
+	config.MaxAuthFailures, config.BanDuration = maxFailures, time.Minute
+	srv, err := harness.Start(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func TestGuardCountsFailedConnections(t *testing.T) {
+	var srv = startGuarded(t, 2)
+	defer srv.Close()
+
+	// keys offered before the right one aren't failures
+	if !dialKeys(srv, mustKey(t), mustKey(t), mustKey(t), srv.Key) {
+		t.Fatal("client with the right key among others was denied")
+	}
+	if !dialKeys(srv, srv.Key) {
+		t.Fatal("client was banned after offering keys before the right one")
+	}
+
+	// connections which fail are
+	for i := 0; i < 2; i++ {
+		if dialKeys(srv, mustKey(t)) {
+			t.Fatal("unknown key was let in")
+		}
+	}
+	if dialKeys(srv, srv.Key) {
+		t.Fatal("client wasn't banned after 2 failed connections")
+	}
+}
+
+func TestGuardClearsFailuresOnLogin(t *testing.T) {
+	var srv = startGuarded(t, 2)
+	defer srv.Close()
+
+	for i := 0; i < 3; i++ {
+		if dialKeys(srv, mustKey(t)) {
+			t.Fatal("unknown key was let in")
+		}
+		if !dialKeys(srv, srv.Key) {
+			t.Fatalf("client was banned after a failure, with logins in between (attempt %d)", i+1)
+		}
+	}
+}
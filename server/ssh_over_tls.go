@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains the listener for ssh connections wrapped in TLS, or in a WebSocket (over TLS), for clients
+// behind proxies / firewalls which only let HTTPS through (eg. shhh connect -server wss://example.com). Without a
+// certificate, connections aren't expected to be TLS, for use behind a reverse proxy which terminates it.
+// ----------
+
+// time clients have to finish the TLS and WebSocket handshakes before they're disconnected
+const wrapHandshakeTimeout = 10 * time.Second
+
+// ErrSSHOverTLSClosed is returned by Server.ServeSSHOverTLS after Shutdown or Close
+var ErrSSHOverTLSClosed = errors.New("ssh over tls listener closed")
+
+// sshOverTLS unwraps incoming ssh connections, and hands them over to the ssh server
+type sshOverTLS struct {
+	tls    *tls.Config // nil if connections aren't TLS
+	handle func(net.Conn)
+
+	mu        sync.RWMutex
+	listeners []net.Listener
+	closed    bool
+}
+
+// newSSHOverTLS returns a new sshOverTLS using the configured certificate (if any), which passes unwrapped
+// connections to [handle]
+func newSSHOverTLS(config *Config, handle func(net.Conn)) (*sshOverTLS, error) {
+	var wrapped = &sshOverTLS{handle: handle}
+	if config.SSHTLSCert == "" && config.SSHTLSKey == "" {
+		if config.SSHTLSHost != "" {
+			return nil, errors.New("ssh tls host needs a certificate (set ssh tls cert and key)")
+		}
+		return wrapped, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(config.SSHTLSCert, config.SSHTLSKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load ssh tls certificate")
+	}
+	wrapped.tls = &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"http/1.1"}}
+	return wrapped, nil
+}
+
+// serve accepts incoming connections on [ln] and hands them over to the ssh server, until closed
+func (wrapped *sshOverTLS) serve(ln net.Listener) error {
+	wrapped.mu.Lock()
+	if wrapped.closed {
+		wrapped.mu.Unlock()
+		_ = ln.Close()
+		return ErrSSHOverTLSClosed
+	}
+	wrapped.listeners = append(wrapped.listeners, ln)
+	wrapped.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			wrapped.mu.RLock()
+			var closed = wrapped.closed
+			wrapped.mu.RUnlock()
+			if closed {
+				return ErrSSHOverTLSClosed
+			}
+
+			if oe, ok := err.(*net.OpError); ok && (oe.Timeout() || oe.Temporary()) {
+				continue
+			}
+			return errors.Wrap(err, "failed to accept new connection")
+		}
+
+		go wrapped.accept(conn)
+	}
+}
+
+// accept terminates the TLS of [conn] (if configured) and hands the ssh connection it carries, either directly or
+// in a WebSocket, over to the ssh server
+func (wrapped *sshOverTLS) accept(conn net.Conn) {
+	if wrapped.tls != nil {
+		conn = tls.Server(conn, wrapped.tls)
+	}
+	wrapped.unwrap(conn)
+}
+
+// unwrap hands the ssh connection carried by [conn] (either directly, or in a WebSocket) over to the ssh server
+func (wrapped *sshOverTLS) unwrap(conn net.Conn) {
+	wrapped.mu.RLock()
+	var closed = wrapped.closed
+	wrapped.mu.RUnlock()
+	if closed {
+		_ = conn.Close()
+		return
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(wrapHandshakeTimeout))
+	var r = bufio.NewReader(conn)
+	prefix, err := r.Peek(4)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	// ssh clients send their version first (eg. openssl s_client as a ProxyCommand)
+	if string(prefix) == "SSH-" {
+		_ = conn.SetDeadline(time.Time{})
+		wrapped.handle(&peekedConn{Conn: conn, r: r})
+		return
+	}
+
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	if !isWebSocketUpgrade(req) {
+		var body = "This is a shhh server; ssh connections are accepted here over WebSocket.\n"
+		_, _ = fmt.Fprintf(conn, "HTTP/1.1 426 Upgrade Required\r\nUpgrade: websocket\r\nConnection: close\r\n"+
+			"Content-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		_ = conn.Close()
+		return
+	}
+
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", WebSocketAccept(req.Header.Get("Sec-WebSocket-Key")))
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	wrapped.handle(NewWebSocketConn(conn, r, false))
+}
+
+// close stops accepting new connections on all listeners; ssh connections are closed along with the ssh server
+func (wrapped *sshOverTLS) close() {
+	if wrapped == nil {
+		return
+	}
+
+	wrapped.mu.Lock()
+	defer wrapped.mu.Unlock()
+
+	wrapped.closed = true
+	for _, ln := range wrapped.listeners {
+		_ = ln.Close()
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// ----------
+// This file contains helpers to assign stable ports to clients requesting a random one. The port is derived
+// from the key's fingerprint, so that a client gets the same port every time without the server persisting anything.
+// ----------
+
+// number of ports tried (starting at the one derived from the fingerprint) before falling back to a random port
+const stablePortAttempts = 16
+
+// stablePorts assigns ports in the range [low, high] based on the key's fingerprint
+type stablePorts struct {
+	low, high uint32
+}
+
+// newStablePorts returns stablePorts for the given range (eg. "20000-29999"), or nil if [spec] is empty
+func newStablePorts(spec string) (*stablePorts, error) {
+	if spec == "" {
+		return nil, nil
+	}
+
+	low, high, err := parsePortRange(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &stablePorts{low: low, high: high}, nil
+}
+
+// candidates returns the ports to try, in order, for the key with [fingerprint]. The first port is derived from
+// a hash of the fingerprint; the following ones (used in case of a collision) are the next ports in the range.
+func (sp *stablePorts) candidates(fingerprint string) []uint32 {
+	var size = sp.high - sp.low + 1
+	var sum = sha256.Sum256([]byte(fingerprint))
+	var start = uint32(binary.BigEndian.Uint64(sum[:8]) % uint64(size))
+
+	var n = uint32(stablePortAttempts)
+	if size < n {
+		n = size
+	}
+
+	var ports = make([]uint32, n)
+	for i := range ports {
+		ports[i] = sp.low + (start+uint32(i))%size
+	}
+	return ports
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// ----------
+// This file contains the stall detection of forwarded connections: a connection through which no bytes move in a
+// direction for longer than the operator allows (see Config.StallTimeoutIn and Config.StallTimeoutOut) is closed,
+// so that dead connections don't pin listener slots and goroutines.
+// ----------
+
+// stallWatch watches the traffic of a forwarded connection in both directions. A nil *stallWatch never fires.
+type stallWatch struct {
+	// when bytes last moved from the visitor to the client (in) and back (out), in Unix nanoseconds; first, to be
+	// 64-bit aligned for atomic operations
+	lastIn, lastOut int64
+
+	inTimeout, outTimeout time.Duration // 0 to never consider that direction stalled
+
+	visitorDone int32 // set once the visitor is done sending (see finishedIn), so that it's waiting, not stalled
+
+	stalled atomic.Value // description of the stalled direction, once it fired
+}
+
+// watchStalls returns a stallWatch with the given timeouts, or nil if neither is set
+func watchStalls(inTimeout, outTimeout time.Duration) *stallWatch {
+	if inTimeout <= 0 && outTimeout <= 0 {
+		return nil
+	}
+
+	var now = time.Now().UnixNano()
+	return &stallWatch{lastIn: now, lastOut: now, inTimeout: inTimeout, outTimeout: outTimeout}
+}
+
+// reader wraps [r] (reading from the visitor if [fromVisitor] is set, or from the client otherwise) to record when
+// bytes last moved in its direction
+func (sw *stallWatch) reader(r io.Reader, fromVisitor bool) io.Reader {
+	if sw == nil {
+		return r
+	}
+
+	var last = &sw.lastOut
+	if fromVisitor {
+		last = &sw.lastIn
+	}
+	return &activityReader{Reader: r, last: last}
+}
+
+// finishedIn records that the visitor is done sending (ie. it half-closed its connection)
+func (sw *stallWatch) finishedIn() {
+	if sw != nil {
+		atomic.StoreInt32(&sw.visitorDone, 1)
+	}
+}
+
+// run checks for stalls until [ctx] is done; once a direction stalls, it closes [ends] and returns
+func (sw *stallWatch) run(ctx context.Context, ends ...io.Closer) {
+	if sw == nil {
+		return
+	}
+
+	var ticker = time.NewTicker(sw.interval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if stalled := sw.check(now); stalled != "" {
+				sw.stalled.Store(stalled)
+				for _, end := range ends {
+					_ = end.Close()
+				}
+				return
+			}
+		}
+	}
+}
+
+// interval returns how often to check for stalls: a quarter of the shorter timeout, but at least every second
+func (sw *stallWatch) interval() time.Duration {
+	var shortest = sw.inTimeout
+	if shortest <= 0 || (sw.outTimeout > 0 && sw.outTimeout < shortest) {
+		shortest = sw.outTimeout
+	}
+
+	if shortest /= 4; shortest < time.Second {
+		shortest = time.Second
+	}
+	return shortest
+}
+
+// check returns a description of the stalled direction as of [now], if any
+func (sw *stallWatch) check(now time.Time) string {
+	if idle := now.Sub(time.Unix(0, atomic.LoadInt64(&sw.lastIn))); sw.inTimeout > 0 && idle >= sw.inTimeout && atomic.LoadInt32(&sw.visitorDone) == 0 {
+		return fmt.Sprintf("no traffic from the visitor within %s", sw.inTimeout)
+	}
+	if idle := now.Sub(time.Unix(0, atomic.LoadInt64(&sw.lastOut))); sw.outTimeout > 0 && idle >= sw.outTimeout {
+		return fmt.Sprintf("no traffic from the client within %s", sw.outTimeout)
+	}
+	return ""
+}
+
+// stalledDirection returns a description of the direction which stalled, or "" if none did
+func (sw *stallWatch) stalledDirection() string {
+	if sw == nil {
+		return ""
+	}
+	stalled, _ := sw.stalled.Load().(string)
+	return stalled
+}
+
+// activityReader is an io.Reader recording when it last read any bytes
+type activityReader struct {
+	io.Reader
+	last *int64
+}
+
+func (r *activityReader) Read(b []byte) (n int, err error) {
+	if n, err = r.Reader.Read(b); n > 0 {
+		atomic.StoreInt64(r.last, time.Now().UnixNano())
+	}
+	return n, err
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ----------
+// This file contains the limit on ssh connections which haven't authenticated yet, in the spirit of OpenSSH's
+// MaxStartups: past a threshold, new connections are dropped with a probability growing with their number, until
+// all are dropped. A flood of connections which never get through the handshake can't exhaust file descriptors.
+// ----------
+
+// startupContextKey is the key under which the *startupConn of a connection is stored
+const startupContextKey = "shhh-startup"
+
+// startupLimiter limits the connections which haven't authenticated yet. A nil *startupLimiter admits everything.
+type startupLimiter struct {
+	start, rate, full int // see Config.MaxStartups
+
+	mu       sync.Mutex
+	startups int
+}
+
+// newStartupLimiter returns a new startupLimiter as per [spec] (see Config.MaxStartups), or nil if it's empty
+func newStartupLimiter(spec string) (*startupLimiter, error) {
+	if spec == "" {
+		return nil, nil
+	}
+
+	var parts = strings.Split(spec, ":")
+	var values = make([]int, len(parts))
+	for i, part := range parts {
+		var err error
+		if values[i], err = strconv.Atoi(part); err != nil || values[i] <= 0 {
+			return nil, errors.Errorf("invalid max startups %q: want start[:rate:full]", spec)
+		}
+	}
+
+	switch {
+	case len(values) == 1:
+		return &startupLimiter{start: values[0], rate: 100, full: values[0]}, nil
+	case len(values) == 3 && values[1] <= 100 && values[0] <= values[2]:
+		return &startupLimiter{start: values[0], rate: values[1], full: values[2]}, nil
+	}
+	return nil, errors.Errorf("invalid max startups %q: want start[:rate:full], with rate <= 100 and start <= full", spec)
+}
+
+// admit returns [nc] holding a slot until it authenticates or is closed (see startupDone), or nil if it's dropped
+func (sl *startupLimiter) admit(ctx ssh.Context, nc net.Conn) net.Conn {
+	if sl == nil {
+		return nc
+	}
+
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	if sl.startups >= sl.full {
+		return nil
+	}
+
+	if sl.startups >= sl.start {
+		// the probability of dropping grows linearly from rate% at start, to 100% at full
+		var p = sl.rate
+		if sl.full > sl.start {
+			p += (100 - sl.rate) * (sl.startups - sl.start) / (sl.full - sl.start)
+		}
+		if randomInt(100) < p {
+			return nil
+		}
+	}
+
+	sl.startups++
+	var sc = &startupConn{Conn: nc, limiter: sl}
+	ctx.SetValue(startupContextKey, sc)
+	return sc
+}
+
+// done releases a slot
+func (sl *startupLimiter) done() {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	sl.startups--
+}
+
+// startupDone releases the slot of the connection with [ctx] (if it holds one), as it's authenticated (see
+// Server.authenticated). Keys accepted along the way don't count: the client may only have asked whether they would be.
+func startupDone(ctx ssh.Context) {
+	if sc, ok := ctx.Value(startupContextKey).(*startupConn); ok {
+		sc.release()
+	}
+}
+
+// startupConn is a net.Conn holding a slot of a startupLimiter, until it's released or the connection is closed
+type startupConn struct {
+	net.Conn
+	limiter *startupLimiter
+	once    sync.Once
+}
+
+func (c *startupConn) release() { c.once.Do(c.limiter.done) }
+
+func (c *startupConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
@@ -0,0 +1,67 @@
+package server_test
+
+import (
+	"github.com/riyaz-ali/shhh/internal/harness"
+	"github.com/riyaz-ali/shhh/server"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"testing"
+	"time"
+)
+
+// stalledKey is a key which blocks clients when they sign with it, until [release] is closed
+type stalledKey struct {
+	gossh.Signer
+	signing chan struct{} // closed once a client signs with it
+	release chan struct{}
+}
+
+func (k *stalledKey) Sign(rand io.Reader, data []byte) (*gossh.Signature, error) {
+	close(k.signing)
+	<-k.release
+	return k.Signer.Sign(rand, data)
+}
+
+func TestStartupSlotHeldUntilAuthenticated(t *testing.T) {
+	var config = server.DefaultConfig()
+	config.MaxStartups = "1"
+	srv, err := harness.Start(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	// a client whose key was accepted, but which hasn't signed with it yet, still holds its slot
+	var stalled = &stalledKey{Signer: srv.Key, signing: make(chan struct{}), release: make(chan struct{})}
+	var dialed = make(chan error, 1)
+	go func() {
+		client, err := srv.DialKey(stalled)
+		if err == nil {
+			_ = client.Close()
+		}
+		dialed <- err
+	}()
+
+	select {
+	case <-stalled.signing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client never got to sign")
+	}
+
+	if client, err := srv.Dial(); err == nil {
+		_ = client.Close()
+		t.Fatal("client was let in past max startups, as another's key was accepted but it hadn't authenticated")
+	}
+
+	// once it authenticates, its slot is free
+	close(stalled.release)
+	if err = <-dialed; err != nil {
+		t.Fatalf("stalled client was denied: %v", err)
+	}
+
+	client, err := srv.Dial()
+	if err != nil {
+		t.Fatalf("client was denied once the slot was released: %v", err)
+	}
+	_ = client.Close()
+}
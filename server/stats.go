@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	gossh "golang.org/x/crypto/ssh"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ----------
+// This file contains helpers to account for the traffic through tunnels, and report it to clients and metrics
+// ----------
+
+// tunnelStats tracks the traffic through a tunnel. Counters are updated atomically.
+type tunnelStats struct {
+	connections int64 // number of channels opened to the client
+	bytesIn     int64 // bytes sent by visitors to the client
+	bytesOut    int64 // bytes sent by the client to visitors
+	rtt         int64 // round-trip time to the client, as last measured (in nanoseconds; 0 until measured, see monitorFlow)
+	throughput  int64 // bytes per second through the fastest channel, as last measured
+
+	started    time.Time // when the tunnel was opened
+	lastActive int64     // when a channel was last opened, or traffic last went through one (in Unix nanoseconds)
+
+	open *openChannels // channels open to the client, whose throughput is measured one by one (see monitorFlow)
+}
+
+// openChannels is the set of channels open to the client of a tunnel. A nil *openChannels is always empty.
+type openChannels struct {
+	mu       sync.Mutex
+	channels map[*countingChannel]struct{}
+}
+
+// newTunnelStats returns a new tunnelStats for a tunnel opened now
+func newTunnelStats() *tunnelStats {
+	var now = time.Now()
+	return &tunnelStats{started: now, lastActive: now.UnixNano(), open: &openChannels{channels: make(map[*countingChannel]struct{})}}
+}
+
+// add records that [channel] was opened
+func (open *openChannels) add(channel *countingChannel) {
+	if open == nil {
+		return
+	}
+	open.mu.Lock()
+	defer open.mu.Unlock()
+	open.channels[channel] = struct{}{}
+}
+
+// remove records that [channel] was closed
+func (open *openChannels) remove(channel *countingChannel) {
+	if open == nil {
+		return
+	}
+	open.mu.Lock()
+	defer open.mu.Unlock()
+	delete(open.channels, channel)
+}
+
+// list returns the channels open
+func (open *openChannels) list() []*countingChannel {
+	if open == nil {
+		return nil
+	}
+	open.mu.Lock()
+	defer open.mu.Unlock()
+
+	var list = make([]*countingChannel, 0, len(open.channels))
+	for channel := range open.channels {
+		list = append(list, channel)
+	}
+	return list
+}
+
+// active records activity through the tunnel
+func (stats *tunnelStats) active() { atomic.StoreInt64(&stats.lastActive, time.Now().UnixNano()) }
+
+// idle returns the time since the tunnel last opened a channel, or had traffic through one
+func (stats *tunnelStats) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&stats.lastActive)))
+}
+
+// snapshot returns a copy of the counters
+func (stats *tunnelStats) snapshot() tunnelStats {
+	return tunnelStats{
+		connections: atomic.LoadInt64(&stats.connections),
+		bytesIn:     atomic.LoadInt64(&stats.bytesIn),
+		bytesOut:    atomic.LoadInt64(&stats.bytesOut),
+		rtt:         atomic.LoadInt64(&stats.rtt),
+		throughput:  atomic.LoadInt64(&stats.throughput),
+		started:     stats.started,
+	}
+}
+
+// uptime returns the time since the tunnel was opened
+func (stats *tunnelStats) uptime() time.Duration { return time.Since(stats.started) }
+
+// String describes the traffic through the tunnel so far (eg. "12 connections, 5.0 KiB in, 79.1 KiB out, up 5m0s")
+func (stats *tunnelStats) String() string {
+	var s = stats.snapshot()
+	return fmt.Sprintf("%d connections, %s in, %s out, up %s",
+		s.connections, formatBytes(s.bytesIn), formatBytes(s.bytesOut), stats.uptime().Round(time.Second))
+}
+
+// counting wraps [newChannel] so that the traffic through channels it opens is accounted for in [stats]
+func (stats *tunnelStats) counting(newChannel newChannelFn) newChannelFn {
+	return func(host, port string) (gossh.Channel, <-chan *gossh.Request, error) {
+		channel, requests, err := newChannel(host, port)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		atomic.AddInt64(&stats.connections, 1)
+		stats.active()
+		var counting = &countingChannel{Channel: channel, stats: stats}
+		stats.open.add(counting)
+		return counting, requests, nil
+	}
+}
+
+// reap closes the tunnel at [address] with [terminate] once it's been idle (see idle) for [timeout], unless [ctx] is
+// done first, and tells its client why with [notify]. Unlike the ssh connection's idle timeout (see
+// Config.IdleTimeout), which keepalives defeat, only visitors keep a tunnel from being reaped.
+func (stats *tunnelStats) reap(ctx context.Context, address string, timeout time.Duration, notify notifyFn, terminate func()) {
+	for {
+		var timer = time.NewTimer(timeout - stats.idle())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if idle := stats.idle(); idle >= timeout {
+			notify(fmt.Sprintf("tunnel %s closed after %s without any connections", address, idle.Round(time.Second)),
+				kv("type", "tunnel.reaped"), kv("address", address), kv("idle_seconds", int64(idle.Seconds())))
+			terminate()
+			return
+		}
+	}
+}
+
+// report pushes the traffic through the tunnel at [address] to [metrics] (labelled with [label]), and a stats line
+// to the client using [notify], every [interval] until [ctx] is done
+func (stats *tunnelStats) report(ctx context.Context, address, label string, metrics *metrics, notify notifyFn, interval time.Duration) {
+	var ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			metrics.observe(label, stats)
+			var s = stats.snapshot()
+			notify("stats: "+stats.String(), kv("type", "stats"), kv("address", address), kv("connections", s.connections),
+				kv("bytes_in", s.bytesIn), kv("bytes_out", s.bytesOut), kv("uptime_seconds", int64(stats.uptime().Seconds())))
+		}
+	}
+}
+
+// countingChannel is a gossh.Channel which accounts for the bytes read from / written to it, in its tunnel's stats
+// and its own
+type countingChannel struct {
+	bytes int64 // read from / written to the channel; first, to be 64-bit aligned for atomic operations
+
+	gossh.Channel
+	stats *tunnelStats
+}
+
+func (c *countingChannel) Read(b []byte) (n int, err error) {
+	n, err = c.Channel.Read(b)
+	if n > 0 {
+		atomic.AddInt64(&c.stats.bytesOut, int64(n))
+		atomic.AddInt64(&c.bytes, int64(n))
+		c.stats.active()
+	}
+	return n, err
+}
+
+func (c *countingChannel) Write(b []byte) (n int, err error) {
+	n, err = c.Channel.Write(b)
+	if n > 0 {
+		atomic.AddInt64(&c.stats.bytesIn, int64(n))
+		atomic.AddInt64(&c.bytes, int64(n))
+		c.stats.active()
+	}
+	return n, err
+}
+
+func (c *countingChannel) Close() error {
+	c.stats.open.remove(c)
+	return c.Channel.Close()
+}
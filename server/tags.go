@@ -0,0 +1,96 @@
+package server
+
+import (
+	"github.com/pkg/errors"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ----------
+// This file contains the tags of tunnels: key=value labels attached by clients (with --tag), by the operator for
+// their keys (see Config.Tags) and by hooks (see hooks.go), eg. for cost attribution in multi-team deployments.
+// Tags are reported in tunnel events (webhooks, notifiers, the audit log), metrics and the admin API, which can
+// filter tunnels by them. Where the same key is set more than once, the operator's tags win over the client's, and
+// hooks' win over both.
+// ----------
+
+const (
+	// maximum number of tags of a tunnel
+	maxTags = 16
+
+	// maximum length of tags' values
+	maxTagValueLength = 256
+)
+
+// valid tag keys, which can also be used as metric label values and in the audit log as-is
+var tagKeyPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.-]{0,62}$`)
+
+// parseTag parses the tag [tag], given as key=value
+func parseTag(tag string) (key, value string, err error) {
+	var parts = strings.SplitN(tag, "=", 2)
+	if len(parts) != 2 {
+		return "", "", errors.Errorf("invalid tag %q: must be of the form key=value", tag)
+	}
+	return parts[0], parts[1], validateTag(parts[0], parts[1])
+}
+
+// validateTag returns an error if [key]=[value] isn't a valid tag
+func validateTag(key, value string) error {
+	if !tagKeyPattern.MatchString(key) {
+		return errors.Errorf("invalid tag key %q: must be letters, digits, '_', '.' and '-' (starting with a letter or '_')", key)
+	}
+	if len(value) > maxTagValueLength {
+		return errors.Errorf("invalid value of tag %s: must be at most %d bytes long", key, maxTagValueLength)
+	}
+	return nil
+}
+
+// validateTags returns an error if Config.Tags has an invalid tag, or too many of them for a key
+func (config *Config) validateTags() error {
+	for fingerprint, tags := range config.Tags {
+		if len(tags) > maxTags {
+			return errors.Errorf("invalid tags of %s: at most %d are allowed", fingerprint, maxTags)
+		}
+		for key, value := range tags {
+			if err := validateTag(key, value); err != nil {
+				return errors.Wrapf(err, "invalid tags of %s", fingerprint)
+			}
+		}
+	}
+	return nil
+}
+
+// tagsFor returns the tags the operator attached to tunnels of the key with [fingerprint]: those of "*", overridden
+// by those of the key itself
+func (config *Config) tagsFor(fingerprint string) map[string]string {
+	var tags = make(map[string]string)
+	for _, of := range []string{"*", fingerprint} {
+		for key, value := range config.Tags[of] {
+			tags[key] = value
+		}
+	}
+	return tags
+}
+
+// formatTags returns [tags] as key=value pairs, sorted by key and separated by commas
+func formatTags(tags map[string]string) string {
+	var pairs = make([]string, 0, len(tags))
+	for key, value := range tags {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// matchTags returns true if [tags] have all the [filters], each of which is either key=value or just a key (to
+// match tags with that key, whatever their value)
+func matchTags(tags map[string]string, filters []string) bool {
+	for _, filter := range filters {
+		var parts = strings.SplitN(filter, "=", 2)
+		if value, ok := tags[parts[0]]; !ok || (len(parts) == 2 && value != parts[1]) {
+			return false
+		}
+	}
+	return true
+}
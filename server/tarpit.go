@@ -0,0 +1,270 @@
+package server
+
+import (
+	"context"
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains the tarpit: ssh clients from IPs which repeatedly failed to authenticate, and never
+// authenticated with a known key, wait a while for the server's version, and for the answer to each attempt to
+// authenticate. Their attempts (usernames, keys and passwords, which are accepted only to be logged) are logged
+// for threat intelligence. Every line looks like:
+//
+//   2006/01/02 15:04:05 shhh tarpit: ip=203.0.113.7 port=51234 user="root" key=- password="hunter2"
+//
+// key is "-" for attempts with a password, and password is "" for attempts with a key. The passwords of users who may
+// exist (those of the password file, or any user when an LDAP directory is configured) are logged as "[redacted]".
+// ----------
+
+// tarpitContextKey marks the context of a tarpitted connection
+const tarpitContextKey = "shhh-tarpit"
+
+// logged in place of passwords that must not be logged
+const tarpitRedacted = "[redacted]"
+
+// how long IPs are remembered for, since their last failure
+const tarpitMemory = 24 * time.Hour
+
+// tarpit tracks authentication failures per source IP, and slows down the repeat offenders. A nil *tarpit slows
+// nothing down.
+type tarpit struct {
+	threshold int           // authentication failures after which an IP is tarpitted
+	delay     time.Duration // how long the server's version, and the answer to each attempt, are held back
+	exempt    ipNetworks    // IPs which are never tarpitted
+	logger    *log.Logger
+
+	mu        sync.Mutex
+	failures  map[string]*tarpitState
+	known     map[string]time.Time // IPs which a known key authenticated from, when it last did
+	lastPrune time.Time
+}
+
+// tarpitState is the state tracked for a single IP
+type tarpitState struct {
+	failures int
+	lastSeen time.Time
+}
+
+// newTarpit returns a new tarpit as configured in [config], or nil if it's disabled
+func newTarpit(config *Config) (*tarpit, error) {
+	if !config.Tarpit {
+		return nil, nil
+	}
+
+	exempt, err := parseIPNetworks(config.SSHGuardExempt)
+	if err != nil {
+		return nil, err
+	}
+
+	var logger = log.New(log.Writer(), "", log.LstdFlags)
+	if config.TarpitLog != "" {
+		file, err := os.OpenFile(config.TarpitLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open tarpit log")
+		}
+		logger = log.New(file, "", log.LstdFlags)
+	}
+
+	var threshold = config.TarpitThreshold
+	if threshold <= 0 {
+		threshold = 1
+	}
+
+	return &tarpit{
+		threshold: threshold,
+		delay:     config.TarpitDelay,
+		exempt:    exempt,
+		logger:    logger,
+		failures:  make(map[string]*tarpitState),
+		known:     make(map[string]time.Time),
+	}, nil
+}
+
+// wrap returns [nc], slowed down if it's from a repeat offender (in which case [ctx] is marked as tarpitted)
+func (tp *tarpit) wrap(ctx ssh.Context, nc net.Conn) net.Conn {
+	if tp == nil || !tp.offender(nc.RemoteAddr()) {
+		return nc
+	}
+
+	ctx.SetValue(tarpitContextKey, true)
+	return &tarpitConn{Conn: nc, delay: tp.delay, closed: make(chan struct{})}
+}
+
+// offender returns true if [addr] failed to authenticate at least threshold times (without a known key
+// authenticating from it since)
+func (tp *tarpit) offender(addr net.Addr) bool {
+	var ip = addrIP(addr)
+	if ip == nil || tp.exempt.contains(ip) {
+		return false
+	}
+
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	state, ok := tp.failures[ip.String()]
+	return ok && state.failures >= tp.threshold
+}
+
+// authenticate wraps [handler] to count its failures, holding back the answer to tarpitted clients. IPs which a
+// known key authenticates from are never tarpitted, but that's only known once the client signs with it (see
+// Server.authenticated): accepting a key here may be the answer to a query.
+func (tp *tarpit) authenticate(handler ssh.PublicKeyHandler) ssh.PublicKeyHandler {
+	if tp == nil {
+		return handler
+	}
+
+	return func(ctx ssh.Context, key ssh.PublicKey) bool {
+		if handler(ctx, key) {
+			return true
+		}
+
+		tp.failed(ctx.RemoteAddr())
+		if tarpitted(ctx) {
+			tp.attempt(ctx, ctx.RemoteAddr(), ctx.User(), gossh.FingerprintSHA256(key), "")
+		}
+		return false
+	}
+}
+
+// passwordCallback returns a gossh password callback for tarpitted clients, which logs the passwords they try,
+// and rejects them all
+func (tp *tarpit) passwordCallback(ctx ssh.Context) func(gossh.ConnMetadata, []byte) (*gossh.Permissions, error) {
+	return func(meta gossh.ConnMetadata, password []byte) (*gossh.Permissions, error) {
+		tp.failed(meta.RemoteAddr())
+		tp.attempt(ctx, meta.RemoteAddr(), meta.User(), "", string(password))
+		return nil, errors.New("permission denied")
+	}
+}
+
+// attempt logs an attempt of a tarpitted client at [addr] to authenticate as [user] with the key with [fingerprint]
+// or [password] (either may be empty), and holds back its answer until [ctx] is done
+func (tp *tarpit) attempt(ctx context.Context, addr net.Addr, user, fingerprint, password string) {
+	var ip, port = "-", "0"
+	if host, p, err := net.SplitHostPort(addr.String()); err == nil {
+		ip, port = host, p
+	}
+	if fingerprint == "" {
+		fingerprint = "-"
+	}
+
+	tp.logger.Printf("shhh tarpit: ip=%s port=%s user=%q key=%s password=%q", ip, port, user, fingerprint, password)
+
+	select {
+	case <-time.After(tp.delay):
+	case <-ctx.Done():
+	}
+}
+
+// failed records an authentication failure from [addr]
+func (tp *tarpit) failed(addr net.Addr) {
+	var ip = addrIP(addr)
+	if tp == nil || ip == nil {
+		return
+	}
+
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	var now = time.Now()
+	tp.prune(now)
+	if _, known := tp.known[ip.String()]; known {
+		return
+	}
+
+	state, ok := tp.failures[ip.String()]
+	if !ok {
+		state = &tarpitState{}
+		tp.failures[ip.String()] = state
+	}
+	state.failures, state.lastSeen = state.failures+1, now
+}
+
+// authenticated records that a known key authenticated from [addr], which is never tarpitted from then on
+func (tp *tarpit) authenticated(addr net.Addr) {
+	var ip = addrIP(addr)
+	if tp == nil || ip == nil {
+		return
+	}
+
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	delete(tp.failures, ip.String())
+	tp.known[ip.String()] = time.Now()
+}
+
+// prune forgets IPs which haven't been seen for tarpitMemory, every now and then; must be called with tp.mu held
+func (tp *tarpit) prune(now time.Time) {
+	if now.Sub(tp.lastPrune) < time.Hour {
+		return
+	}
+
+	for ip, state := range tp.failures {
+		if now.Sub(state.lastSeen) >= tarpitMemory {
+			delete(tp.failures, ip)
+		}
+	}
+	for ip, seen := range tp.known {
+		if now.Sub(seen) >= tarpitMemory {
+			delete(tp.known, ip)
+		}
+	}
+	tp.lastPrune = now
+}
+
+// tarpitConfig returns an ssh.ServerConfigCallback letting tarpitted clients try passwords (see
+// tarpit.passwordCallback), on top of [next] (if set)
+func tarpitConfig(tp *tarpit, next ssh.ServerConfigCallback) ssh.ServerConfigCallback {
+	return func(ctx ssh.Context) *gossh.ServerConfig {
+		var config = &gossh.ServerConfig{}
+		if next != nil {
+			config = next(ctx)
+		}
+		if tarpitted(ctx) {
+			config.PasswordCallback = tp.passwordCallback(ctx)
+		}
+		return config
+	}
+}
+
+// tarpitted returns true if the connection with [ctx] is tarpitted
+func tarpitted(ctx ssh.Context) bool {
+	tarpitted, _ := ctx.Value(tarpitContextKey).(bool)
+	return tarpitted
+}
+
+// tarpitConn is a net.Conn which holds back the server's first write (ie. its version)
+type tarpitConn struct {
+	net.Conn
+	delay time.Duration
+
+	once   sync.Once
+	closed chan struct{}
+	held   bool
+}
+
+func (c *tarpitConn) Write(b []byte) (int, error) {
+	if !c.held {
+		c.held = true // writes happen on a single goroutine until the version exchange is done
+
+		var timer = time.NewTimer(c.delay)
+		select {
+		case <-timer.C:
+		case <-c.closed:
+			timer.Stop()
+			return 0, errors.New("use of closed connection")
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *tarpitConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,415 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ----------
+// This file contains the tracing of tunnels with OpenTelemetry spans: a trace per tunnel, made of the handling of
+// its forwarding request, and the opening of / copying over each channel it forwards a connection through. Spans are
+// exported in batches to an OTLP/HTTP collector (as JSON, see https://opentelemetry.io/docs/specs/otlp/).
+// ----------
+
+const (
+	// spans queued for export; newer spans are dropped once full
+	traceQueueSize = 2048
+
+	// spans are exported once this many are queued, or every traceExportInterval
+	traceBatchSize      = 512
+	traceExportInterval = 5 * time.Second
+
+	// identifies the server's spans
+	traceServiceName = "shhh"
+	traceScopeName   = "github.com/riyaz-ali/shhh/server"
+)
+
+// kinds of spans (see OTLP's Span.SpanKind)
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// span is an OpenTelemetry span. A nil *span is a span which isn't sampled; all its methods are no-ops.
+type span struct {
+	tracer *tracer
+
+	traceID, spanID, parentID string
+	name                      string
+	kind                      int
+	start, end                time.Time
+
+	mu         sync.Mutex
+	attributes map[string]interface{}
+	err        string // status message, if the span failed
+	ended      bool
+}
+
+// tracer starts spans and exports them to a collector. A nil *tracer starts no spans.
+type tracer struct {
+	endpoint string  // collector's traces endpoint
+	ratio    float64 // fraction of traces sampled
+	client   *http.Client
+
+	queue   chan *span
+	flushes chan chan struct{}
+}
+
+// newTracer returns a new tracer exporting spans to the collector at [config].OTLPEndpoint, or nil if tracing is
+// disabled
+func newTracer(config *Config) (*tracer, error) {
+	if config.OTLPEndpoint == "" {
+		return nil, nil
+	}
+
+	if !strings.HasPrefix(config.OTLPEndpoint, "http://") && !strings.HasPrefix(config.OTLPEndpoint, "https://") {
+		return nil, errors.Errorf("invalid OTLP endpoint %q: must be an http:// or https:// URL", config.OTLPEndpoint)
+	}
+
+	var ratio = config.TraceSampleRatio
+	if ratio <= 0 || ratio > 1 {
+		ratio = 1
+	}
+
+	var t = &tracer{
+		endpoint: strings.TrimSuffix(config.OTLPEndpoint, "/") + "/v1/traces",
+		ratio:    ratio,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan *span, traceQueueSize),
+		flushes:  make(chan chan struct{}),
+	}
+	go t.run()
+	return t, nil
+}
+
+// trace starts the root span of a new trace, unless the tracer is disabled or the trace isn't sampled
+func (t *tracer) trace(name string, kind int) *span {
+	if t == nil || !t.sampled() {
+		return nil
+	}
+	return t.newSpan(randomHex(16), "", name, kind)
+}
+
+// sampled decides whether to sample a new trace
+func (t *tracer) sampled() bool {
+	if t.ratio >= 1 {
+		return true
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(1<<30))
+	return err == nil && float64(n.Int64()) < t.ratio*(1<<30)
+}
+
+func (t *tracer) newSpan(traceID, parentID, name string, kind int) *span {
+	return &span{tracer: t, traceID: traceID, spanID: randomHex(8), parentID: parentID, name: name, kind: kind,
+		start: time.Now(), attributes: make(map[string]interface{})}
+}
+
+// child starts a span of the same trace, as a child of [s]
+func (s *span) child(name string, kind int) *span {
+	if s == nil {
+		return nil
+	}
+	return s.tracer.newSpan(s.traceID, s.spanID, name, kind)
+}
+
+// set sets the attribute [key] of the span to [value] (a string, bool, int, int64 or float64)
+func (s *span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+// fail marks the span as failed, with [msg] as its status message
+func (s *span) fail(msg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = msg
+}
+
+// finish ends the span and queues it for export. Only the first call has any effect.
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended, s.end = true, time.Now()
+	s.mu.Unlock()
+
+	select {
+	case s.tracer.queue <- s:
+	default: // the collector can't keep up; losing a span is better than holding up a tunnel
+	}
+}
+
+// tracing wraps [newChannel] so that the opening of each channel, and the copying over it until it's closed, are
+// traced as children of [s]
+func (s *span) tracing(newChannel newChannelFn) newChannelFn {
+	if s == nil {
+		return newChannel
+	}
+
+	return func(host, port string) (gossh.Channel, <-chan *gossh.Request, error) {
+		var open = s.child("ssh.open_channel", spanKindClient)
+		open.set("net.peer.ip", host)
+		open.set("net.peer.port", port)
+		defer open.finish()
+
+		channel, requests, err := newChannel(host, port)
+		if err != nil {
+			open.fail(err.Error())
+			return nil, nil, err
+		}
+
+		var copying = s.child("copy", spanKindInternal)
+		copying.set("net.peer.ip", host)
+		copying.set("net.peer.port", port)
+		return &tracedChannel{Channel: channel, span: copying}, requests, nil
+	}
+}
+
+// tracedChannel is a gossh.Channel whose traffic is traced by [span], until it's closed
+type tracedChannel struct {
+	bytesIn, bytesOut int64 // first, to be 64-bit aligned for atomic operations
+
+	gossh.Channel
+	span *span
+}
+
+func (c *tracedChannel) Read(b []byte) (n int, err error) {
+	n, err = c.Channel.Read(b)
+	atomic.AddInt64(&c.bytesOut, int64(n))
+	if err != nil && err != io.EOF {
+		c.span.fail(fmt.Sprintf("failed to read from client: %s", err))
+	}
+	return n, err
+}
+
+func (c *tracedChannel) Write(b []byte) (n int, err error) {
+	n, err = c.Channel.Write(b)
+	atomic.AddInt64(&c.bytesIn, int64(n))
+	if err != nil {
+		c.span.fail(fmt.Sprintf("failed to write to client: %s", err))
+	}
+	return n, err
+}
+
+func (c *tracedChannel) Close() error {
+	c.span.set("shhh.bytes_in", atomic.LoadInt64(&c.bytesIn))
+	c.span.set("shhh.bytes_out", atomic.LoadInt64(&c.bytesOut))
+	c.span.finish()
+	return c.Channel.Close()
+}
+
+// Flush waits until the spans queued so far are exported (or given up on), or [ctx] is done
+func (t *tracer) Flush(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+
+	var done = make(chan struct{})
+	select {
+	case t.flushes <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run exports queued spans in batches for as long as the process runs
+func (t *tracer) run() {
+	var ticker = time.NewTicker(traceExportInterval)
+	defer ticker.Stop()
+
+	var batch []*span
+	var export = func() {
+		if len(batch) > 0 {
+			if err := t.export(batch); err != nil {
+				log.Printf("tracing: dropped %d spans: %s", len(batch), err.Error())
+			}
+			batch = nil
+		}
+	}
+
+	for {
+		select {
+		case s := <-t.queue:
+			if batch = append(batch, s); len(batch) >= traceBatchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case done := <-t.flushes:
+			for queued := len(t.queue); queued > 0; queued-- {
+				batch = append(batch, <-t.queue)
+			}
+			export()
+			close(done)
+		}
+	}
+}
+
+// export POSTs [spans] to the collector once
+func (t *tracer) export(spans []*span) error {
+	var otlpSpans = make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		otlpSpans = append(otlpSpans, s.otlp())
+	}
+
+	var request = otlpTracesRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{{Key: "service.name", Value: otlpValue{StringValue: strPtr(traceServiceName)}}}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: traceScopeName},
+			Spans: otlpSpans,
+		}},
+	}}}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal spans")
+	}
+
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to export spans")
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("collector responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// otlp returns the span as per OTLP's JSON encoding
+func (s *span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var o = otlpSpan{
+		TraceID: s.traceID, SpanID: s.spanID, ParentSpanID: s.parentID, Name: s.name, Kind: s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+
+	for key, value := range s.attributes {
+		var v otlpValue
+		switch value := value.(type) {
+		case string:
+			v.StringValue = strPtr(value)
+		case bool:
+			v.BoolValue = &value
+		case int:
+			v.IntValue = strconv.Itoa(value)
+		case int64:
+			v.IntValue = strconv.FormatInt(value, 10)
+		case float64:
+			v.DoubleValue = &value
+		default:
+			v.StringValue = strPtr(fmt.Sprint(value))
+		}
+		o.Attributes = append(o.Attributes, otlpKeyValue{Key: key, Value: v})
+	}
+
+	if s.err != "" {
+		o.Status = &otlpStatus{Code: 2, Message: s.err} // STATUS_CODE_ERROR
+	}
+	return o
+}
+
+// types of OTLP's JSON encoding of an ExportTraceServiceRequest
+type (
+	otlpTracesRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            *otlpStatus    `json:"status,omitempty"`
+	}
+
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+
+	otlpValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		IntValue    string   `json:"intValue,omitempty"` // int64s are encoded as strings
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// randomHex returns [n] random bytes, hex-encoded
+func randomHex(n int) string {
+	var b = make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func strPtr(s string) *string { return &s }
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ----------
+// This file contains helpers to restore the address of visitors when the HTTP edge runs behind proxies / CDNs
+// ----------
+
+// headers which carry the address of the visitor, as set by proxies / CDNs in front of the edge
+var forwardedHeaders = []string{"CF-Connecting-IP", "True-Client-IP", "X-Real-IP", "X-Forwarded-For", "Forwarded"}
+
+// restoreVisitorAddr rewrites [r] so that its RemoteAddr is the visitor's address. If the request came from a
+// trusted proxy, the visitor is taken from CF-Connecting-IP, or else is the right-most untrusted address in
+// X-Forwarded-For. Forwarded headers from anyone else are spoofable, and are removed. Either way, X-Real-IP is
+// set to the visitor's address, and X-Forwarded-For only retains the hops before the visitor.
+func (proxies ipNetworks) restoreVisitorAddr(r *http.Request) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	var peer = net.ParseIP(host)
+	var visitor = peer
+	var chain []string
+	if peer != nil && proxies.contains(peer) {
+		for _, values := range r.Header["X-Forwarded-For"] {
+			for _, hop := range strings.Split(values, ",") {
+				chain = append(chain, strings.TrimSpace(hop))
+			}
+		}
+
+		var idx = -1
+		if cf := net.ParseIP(strings.TrimSpace(r.Header.Get("CF-Connecting-IP"))); cf != nil {
+			visitor = cf
+			for i := len(chain) - 1; i >= 0; i-- {
+				if ip := net.ParseIP(chain[i]); ip != nil && ip.Equal(cf) {
+					idx = i
+					break
+				}
+			}
+		} else {
+			for i := len(chain) - 1; i >= 0; i-- {
+				var ip = net.ParseIP(chain[i])
+				if ip == nil {
+					break // malformed; don't trust anything beyond this point
+				}
+
+				visitor, idx = ip, i
+				if !proxies.contains(ip) {
+					break
+				}
+			}
+		}
+
+		if idx >= 0 {
+			chain = chain[:idx]
+		} else {
+			chain = nil
+		}
+	}
+
+	for _, header := range forwardedHeaders {
+		r.Header.Del(header)
+	}
+
+	if visitor == nil { // not an IP address (eg. unix sockets); leave as is
+		return
+	}
+
+	if len(chain) > 0 {
+		r.Header.Set("X-Forwarded-For", strings.Join(chain, ", "))
+	}
+	r.Header.Set("X-Real-IP", visitor.String())
+
+	if !visitor.Equal(peer) {
+		r.RemoteAddr = net.JoinHostPort(visitor.String(), "0") // the visitor's port isn't known
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ----------
+// This file contains the expiry of tunnels: clients can limit how long their tunnels stay open (with --ttl), and
+// the operator can cap it for everyone (see Config.MaxTunnelTTL), so that forgotten tunnels don't linger. Clients
+// are warned ahead of their tunnels' expiry; the tunnels are then closed.
+// ----------
+
+// how long before a tunnel expires its client is warned; only those up to half the tunnel's TTL apply
+var ttlWarnings = []time.Duration{10 * time.Minute, time.Minute, 10 * time.Second}
+
+// tunnelTTL returns the TTL of a tunnel whose client asked for [requested], with the operator allowing at most [max]
+// (either being 0 for unlimited); 0 if the tunnel doesn't expire
+func tunnelTTL(requested, max time.Duration) time.Duration {
+	if max > 0 && (requested <= 0 || requested > max) {
+		return max
+	}
+	return requested
+}
+
+// expire closes the tunnel at [address], opened at [started], with [terminate] once its [ttl] has passed (unless
+// [ctx] is done first), warning its client with [notify] ahead of it
+func expire(ctx context.Context, address string, started time.Time, ttl time.Duration, notify notifyFn, terminate func()) {
+	var expires = started.Add(ttl)
+	for _, warning := range ttlWarnings {
+		if warning > ttl/2 {
+			continue
+		}
+
+		var timer = time.NewTimer(time.Until(expires.Add(-warning)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		notify(fmt.Sprintf("tunnel %s expires in %s (at %s)", address, time.Until(expires).Round(time.Second), expires.UTC().Format(time.RFC3339)),
+			kv("type", "tunnel.expiring"), kv("address", address), kv("expires_at", expires.UTC()))
+	}
+
+	var timer = time.NewTimer(time.Until(expires))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return
+	case <-timer.C:
+	}
+
+	notify(fmt.Sprintf("tunnel %s expired after %s", address, ttl), kv("type", "tunnel.expired"), kv("address", address))
+	terminate()
+}
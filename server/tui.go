@@ -0,0 +1,234 @@
+package server
+
+import (
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	"io"
+	"strings"
+	"time"
+)
+
+// ----------
+// This file contains the terminal UI shown to clients that ask for it with --tui (over a PTY, eg. ssh -t): a live
+// table of the connections and requests served by their tunnels, in place of the stream of messages
+// ----------
+
+// number of connections / requests the terminal UI remembers
+const tuiHistory = 200
+
+// how often the terminal UI is redrawn if anything changed; it's redrawn every second regardless, to update
+// the duration of open connections
+const tuiRefreshInterval = 250 * time.Millisecond
+
+// ANSI escape sequences used by the terminal UI
+const (
+	ansiEnterScreen = "\x1b[?1049h\x1b[?25l" // switch to the alternate screen, and hide the cursor
+	ansiLeaveScreen = "\x1b[?25h\x1b[?1049l" // show the cursor, and switch back to the main screen
+	ansiHome        = "\x1b[H"               // move to the top left
+	ansiClearLine   = "\x1b[K"               // clear the rest of the line
+	ansiClearScreen = "\x1b[J"               // clear the rest of the screen
+	ansiBold        = "\x1b[1m"
+	ansiDim         = "\x1b[2m"
+	ansiReset       = "\x1b[0m"
+)
+
+// tuiRow is a connection (or HTTP request) shown in the terminal UI
+type tuiRow struct {
+	visitor string
+	country string
+	request string // method and path of HTTP requests, or "tcp"
+	status  string // "open", why the connection ended, or "denied"
+
+	started time.Time
+	ended   time.Time // zero while the connection is open
+
+	in, out int64
+}
+
+// duration returns how long the connection has been (or was) open
+func (row *tuiRow) duration() time.Duration {
+	if row.ended.IsZero() {
+		return time.Since(row.started)
+	}
+	return row.ended.Sub(row.started)
+}
+
+// terminalUI keeps the state shown to the client, built from the messages sent to it
+type terminalUI struct {
+	conn   *connection
+	window ssh.Window
+
+	rows []*tuiRow          // newest last
+	open map[string]*tuiRow // open connections, by the visitor's address
+
+	last string // the most recent message that isn't about a connection (eg. an error)
+}
+
+// consume updates the state with [msg]
+func (ui *terminalUI) consume(msg message) {
+	var visitor, _ = msg.value("visitor").(string)
+	switch msg.kind() {
+	case "connection.accepted":
+		var country, _ = msg.value("country").(string)
+		if socket, ok := msg.value("socket").(string); ok {
+			visitor = socket
+		}
+		var row = &tuiRow{visitor: visitor, country: country, request: "tcp", status: "open", started: msg.time}
+		ui.add(row)
+		ui.open[visitor] = row
+
+	case "connection.closed":
+		if row, ok := ui.open[visitor]; ok {
+			delete(ui.open, visitor)
+			row.ended = msg.time
+			row.status, _ = msg.value("reason").(string)
+			row.in, _ = msg.value("bytes_in").(int64)
+			row.out, _ = msg.value("bytes_out").(int64)
+		}
+
+	case "connection.denied", "connection.rejected":
+		var country, _ = msg.value("country").(string)
+		ui.add(&tuiRow{visitor: visitor, country: country, request: "tcp", status: "denied", started: msg.time, ended: msg.time})
+
+	case "request":
+		var method, _ = msg.value("method").(string)
+		var path, _ = msg.value("path").(string)
+		ui.add(&tuiRow{visitor: visitor, request: method + " " + path, status: "http", started: msg.time, ended: msg.time})
+
+	case "stats":
+		// the table already shows what stats would
+
+	default:
+		ui.last = msg.text
+	}
+}
+
+// add adds [row] to the table, forgetting the oldest rows over tuiHistory
+func (ui *terminalUI) add(row *tuiRow) {
+	if ui.rows = append(ui.rows, row); len(ui.rows) > tuiHistory {
+		var old = ui.rows[0]
+		if ui.open[old.visitor] == old {
+			delete(ui.open, old.visitor)
+		}
+		ui.rows = ui.rows[1:]
+	}
+}
+
+// render draws the terminal UI to [w], fitting it in the client's window
+func (ui *terminalUI) render(w io.Writer) {
+	var width, height = ui.window.Width, ui.window.Height
+	if width <= 0 {
+		width = 80
+	}
+	if height <= 0 {
+		height = 24
+	}
+
+	var lines []string
+	lines = append(lines, ansiBold+"shhh"+ansiReset+" "+strings.Join(ui.conn.Endpoints(), "  "))
+	lines = append(lines, ansiDim+fmt.Sprintf("%d open connections; press q to quit", len(ui.open))+ansiReset, "")
+	// the request column takes whatever room the others leave
+	var rw = width - 67
+	if rw < 10 {
+		rw = 10
+	}
+	var format = fmt.Sprintf("%%-22s %%-3s %%-%ds %%9s %%9s %%8s %%s", rw)
+	lines = append(lines, ansiBold+fit(fmt.Sprintf(format, "VISITOR", "CC", "REQUEST", "IN", "OUT", "DURATION", "STATUS"), width)+ansiReset)
+
+	var room = height - len(lines) - 2 // keep the last lines for the most recent message
+	for i := len(ui.rows) - 1; i >= 0 && room > 0; i, room = i-1, room-1 {
+		var row = ui.rows[i]
+		var in, out = "", ""
+		if !row.ended.IsZero() && row.status != "http" && row.status != "denied" {
+			in, out = formatBytes(row.in), formatBytes(row.out)
+		}
+
+		var line = fmt.Sprintf(format, fit(row.visitor, 22), row.country, fit(row.request, rw),
+			in, out, row.duration().Round(time.Second), row.status)
+		lines = append(lines, fit(line, width))
+	}
+
+	if ui.last != "" {
+		for len(lines) < height-1 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, ansiDim+fit(ui.last, width)+ansiReset)
+	}
+
+	// lines are overwritten in place (rather than clearing the screen first), so that redrawing doesn't flicker
+	_, _ = io.WriteString(w, ansiHome+strings.Join(lines, ansiClearLine+"\r\n")+ansiClearLine+ansiClearScreen)
+}
+
+// fit truncates [s] to [width] characters
+func fit(s string, width int) string {
+	if r := []rune(s); len(r) > width {
+		return string(r[:width])
+	}
+	return s
+}
+
+// runTerminalUI shows the terminal UI on session [s] (with a PTY whose window is [window], resized over [winch]),
+// until the client quits, [conn] has no more tunnels or goes away
+func runTerminalUI(s ssh.Session, conn *connection, window ssh.Window, winch <-chan ssh.Window, quit <-chan struct{}) {
+	var ui = &terminalUI{conn: conn, window: window, open: make(map[string]*tuiRow)}
+
+	_, _ = io.WriteString(s, ansiEnterScreen)
+	defer func() { _, _ = io.WriteString(s, ansiLeaveScreen) }()
+
+	var ticker = time.NewTicker(tuiRefreshInterval)
+	defer ticker.Stop()
+
+	ui.render(s)
+	var dirty, rendered = false, time.Now()
+	for {
+		select {
+		case msg := <-conn.messages:
+			ui.consume(msg)
+			dirty = true
+		case w, ok := <-winch:
+			if ok {
+				ui.window, dirty = w, true
+			}
+		case <-ticker.C:
+			if dirty || time.Since(rendered) >= time.Second {
+				ui.render(s)
+				dirty, rendered = false, time.Now()
+			}
+		case <-quit:
+			return
+		case <-conn.done:
+			return
+		case <-s.Context().Done():
+			return
+		}
+	}
+}
+
+// watchInput reads what the client types into a PTY (whose terminal is in raw mode, so Ctrl-C / Ctrl-D arrive as
+// input rather than as signals) and closes [quit] once it's either of those, or q if [q] is set
+func watchInput(r io.Reader, quit chan<- struct{}, q bool) {
+	var buf = make([]byte, 64)
+	for {
+		n, err := r.Read(buf)
+		for _, c := range buf[:n] {
+			if c == 0x03 || c == 0x04 || (q && (c == 'q' || c == 'Q')) {
+				close(quit)
+				return
+			}
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// crlfWriter writes to a PTY, whose terminal (in raw mode) needs lines terminated by CRLF
+type crlfWriter struct{ io.Writer }
+
+func (w crlfWriter) Write(b []byte) (int, error) {
+	if _, err := w.Writer.Write([]byte(strings.Replace(string(b), "\n", "\r\n", -1))); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
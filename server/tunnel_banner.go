@@ -0,0 +1,35 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// ----------
+// This file contains helpers to send a banner (eg. a legal notice) to visitors of raw TCP tunnels, before their
+// traffic is forwarded (see Config.TunnelBanner and the --banner session option)
+// ----------
+
+// how long writing the banner to a visitor may take
+const tunnelBannerTimeout = 10 * time.Second
+
+// tunnelBanner returns [text] with every line terminated by CRLF, or nil if [text] is empty. As such, it's also
+// accepted ahead of the version line of an ssh server (see RFC 4253 § 4.2), as long as no line starts with "SSH-".
+func tunnelBanner(text string) []byte {
+	if text == "" {
+		return nil
+	}
+
+	text = strings.TrimSuffix(strings.Replace(text, "\r\n", "\n", -1), "\n")
+	return []byte(strings.Replace(text, "\n", "\r\n", -1) + "\r\n")
+}
+
+// writeBanner writes [banner] to the visitor's [conn]
+func writeBanner(conn net.Conn, banner []byte) error {
+	_ = conn.SetWriteDeadline(time.Now().Add(tunnelBannerTimeout))
+	defer func() { _ = conn.SetWriteDeadline(time.Time{}) }()
+
+	_, err := conn.Write(banner)
+	return err
+}
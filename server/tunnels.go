@@ -0,0 +1,278 @@
+package server
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains the registry of open tunnels, through which an admin (or an abuse system, via the admin API)
+// can quarantine, release or terminate a tunnel
+// ----------
+
+// openTunnel is a tunnel open on the server
+type openTunnel struct {
+	address     string
+	name        string // empty unless the client named it (with --name)
+	fingerprint string
+	client      string
+
+	stats      *tunnelStats
+	quarantine *quarantine
+	mirror     *tunnelMirror            // nil if the tunnel's traffic can't be mirrored
+	options    *sessionOptions          // of the client's connection
+	http       *httpTunnel              // nil unless it's an HTTP tunnel
+	notify     notifyFn                 // sends a message to the client
+	terminate  func()                   // closes the tunnel
+	event      func(string) TunnelEvent // returns a new event of the given type for the tunnel
+	hold       func(g *graceHolds)      // holds the tunnel's endpoint for its client in g (see Server.Endpoints)
+	tags       map[string]string        // see tags.go
+	ttl        time.Duration            // after which the tunnel expires (see ttl.go); 0 if it doesn't
+}
+
+// openTunnels is the registry of open tunnels, keyed by their public address
+type openTunnels struct {
+	mu      sync.Mutex
+	tunnels map[string]*openTunnel
+}
+
+// newOpenTunnels returns a new, empty openTunnels
+func newOpenTunnels() *openTunnels { return &openTunnels{tunnels: make(map[string]*openTunnel)} }
+
+func (ot *openTunnels) add(tunnel *openTunnel) {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+	ot.tunnels[tunnel.address] = tunnel
+}
+
+func (ot *openTunnels) remove(tunnel *openTunnel) {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+	if ot.tunnels[tunnel.address] == tunnel {
+		delete(ot.tunnels, tunnel.address)
+	}
+}
+
+// get returns the tunnel at [address] (or named [address]), or an error if there's none
+func (ot *openTunnels) get(address string) (*openTunnel, error) {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+	if tunnel, ok := ot.tunnels[address]; ok {
+		return tunnel, nil
+	}
+
+	for _, tunnel := range ot.tunnels {
+		if tunnel.name != "" && tunnel.name == address {
+			return tunnel, nil
+		}
+	}
+	return nil, errors.Errorf("no tunnel open at %q", address)
+}
+
+// onPort returns the tunnel listening on [port] of [protocol] ("TCP" or "UDP"), or nil if there's none
+func (ot *openTunnels) onPort(protocol string, port uint32) *openTunnel {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+
+	for address, tunnel := range ot.tunnels {
+		var udp = strings.HasPrefix(address, "udp://")
+		if udp != (protocol == "UDP") {
+			continue
+		}
+		if _, p, err := net.SplitHostPort(strings.TrimPrefix(address, "udp://")); err == nil && p == strconv.Itoa(int(port)) {
+			return tunnel
+		}
+	}
+	return nil
+}
+
+// list returns all open tunnels, ordered by address
+func (ot *openTunnels) list() []*openTunnel {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+
+	var tunnels = make([]*openTunnel, 0, len(ot.tunnels))
+	for _, tunnel := range ot.tunnels {
+		tunnels = append(tunnels, tunnel)
+	}
+	sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].address < tunnels[j].address })
+	return tunnels
+}
+
+// TunnelInfo describes an open tunnel
+type TunnelInfo struct {
+	Address     string `json:"address"`
+	Name        string `json:"name,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Client      string `json:"client"`
+
+	Connections   int64 `json:"connections"`
+	BytesIn       int64 `json:"bytes_in"`
+	BytesOut      int64 `json:"bytes_out"`
+	UptimeSeconds int64 `json:"uptime_seconds"`
+
+	// flow control of the tunnel's connections, measured with Config.FlowControlInterval (zero until measured): each
+	// connection is an ssh channel, whose window caps its throughput at WindowLimit
+	ChannelWindow int64 `json:"channel_window"`
+	RTTMillis     int64 `json:"rtt_ms,omitempty"`
+	WindowLimit   int64 `json:"window_limit,omitempty"`       // bytes per second
+	Throughput    int64 `json:"channel_throughput,omitempty"` // bytes per second through the fastest connection
+
+	Quarantined bool   `json:"quarantined,omitempty"`
+	Reason      string `json:"reason,omitempty"` // why the tunnel is quarantined
+
+	Mirrored string `json:"mirrored,omitempty"` // where the tunnel's traffic is mirrored to (see Server.Mirror)
+
+	Tags map[string]string `json:"tags,omitempty"` // see Config.Tags
+
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // when the tunnel expires, if it does (see Config.MaxTunnelTTL)
+}
+
+// label returns what the tunnel is known by (eg. in logs and metrics): its name if the client named it, or its
+// public address otherwise
+func (tunnel *openTunnel) label() string {
+	if tunnel.name != "" {
+		return tunnel.name
+	}
+	return tunnel.address
+}
+
+// info describes the tunnel
+func (tunnel *openTunnel) info() TunnelInfo {
+	var s = tunnel.stats.snapshot()
+	var held, reason = tunnel.quarantine.Held()
+	var expires *time.Time
+	if tunnel.ttl > 0 {
+		var t = tunnel.stats.started.Add(tunnel.ttl).UTC()
+		expires = &t
+	}
+	return TunnelInfo{
+		Address:       tunnel.address,
+		Name:          tunnel.name,
+		Fingerprint:   tunnel.fingerprint,
+		Client:        tunnel.client,
+		Connections:   s.connections,
+		BytesIn:       s.bytesIn,
+		BytesOut:      s.bytesOut,
+		UptimeSeconds: int64(tunnel.stats.uptime().Seconds()),
+		ChannelWindow: sshChannelWindow,
+		RTTMillis:     time.Duration(s.rtt).Milliseconds(),
+		WindowLimit:   int64(windowLimit(time.Duration(s.rtt))),
+		Throughput:    s.throughput,
+		Quarantined:   held,
+		Reason:        reason,
+		Mirrored:      tunnel.mirror.describe(),
+		Tags:          tunnel.tags,
+		ExpiresAt:     expires,
+	}
+}
+
+// Tunnels returns the tunnels currently open on the server
+func (srv *Server) Tunnels() []TunnelInfo {
+	var infos []TunnelInfo
+	for _, tunnel := range srv.tunnels.list() {
+		infos = append(infos, tunnel.info())
+	}
+	return infos
+}
+
+// notifyKey sends [msg] (with [fields]) to the clients of the key with [fingerprint] which have tunnels open, once
+// to each connection
+func (srv *Server) notifyKey(fingerprint, msg string, fields ...field) {
+	var notified = make(map[*sessionOptions]bool)
+	for _, tunnel := range srv.tunnels.list() {
+		if tunnel.fingerprint == fingerprint && !notified[tunnel.options] {
+			notified[tunnel.options] = true
+			tunnel.notify(msg, fields...)
+		}
+	}
+}
+
+// Quarantine pauses the traffic of the tunnel at [address] (or named [address]) for [reason] (eg. as it's suspected of abuse) until it's
+// released or terminated. New visitors are turned away meanwhile; those of HTTP tunnels see a hold page.
+func (srv *Server) Quarantine(address, reason string) error {
+	tunnel, err := srv.tunnels.get(address)
+	if err != nil {
+		return err
+	}
+
+	if !tunnel.quarantine.Hold(reason) {
+		return errors.Errorf("tunnel %s is already quarantined", address)
+	}
+
+	log.Printf("quarantined tunnel %s: %s", tunnel.label(), reason)
+	tunnel.notify(fmt.Sprintf("tunnel %s quarantined by an administrator (%s); its traffic is paused", tunnel.address, reason),
+		kv("type", "tunnel.quarantined"), kv("address", tunnel.address), kv("reason", reason))
+
+	var e = tunnel.event(TunnelQuarantined)
+	e.Reason = reason
+	srv.emit(e)
+	return nil
+}
+
+// Release lets the traffic of the quarantined tunnel at [address] flow again
+func (srv *Server) Release(address string) error {
+	tunnel, err := srv.tunnels.get(address)
+	if err != nil {
+		return err
+	}
+
+	if !tunnel.quarantine.Release() {
+		return errors.Errorf("tunnel %s is not quarantined", address)
+	}
+
+	log.Printf("released tunnel %s from quarantine", tunnel.label())
+	tunnel.notify(fmt.Sprintf("tunnel %s released from quarantine", tunnel.address), kv("type", "tunnel.released"), kv("address", tunnel.address))
+	srv.emit(tunnel.event(TunnelReleased))
+	return nil
+}
+
+// Requests returns the requests to the HTTP tunnel at [address] captured by its inspector (see
+// Config.InspectRequests), newest first
+func (srv *Server) Requests(address string) ([]CapturedRequest, error) {
+	tunnel, err := srv.tunnels.get(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if tunnel.http == nil {
+		return nil, errors.Errorf("tunnel %s isn't an HTTP tunnel", address)
+	}
+	return tunnel.http.inspector.Requests(), nil
+}
+
+// Replay sends the captured request with [id] to the HTTP tunnel at [address] again, and returns it along with
+// the new response. Replayed requests carry an X-Shhh-Replay header with [id].
+func (srv *Server) Replay(address string, id int64) (CapturedRequest, error) {
+	tunnel, err := srv.tunnels.get(address)
+	if err != nil {
+		return CapturedRequest{}, err
+	}
+
+	if tunnel.http == nil {
+		return CapturedRequest{}, errors.Errorf("tunnel %s isn't an HTTP tunnel", address)
+	}
+
+	log.Printf("replaying request %d to tunnel %s", id, tunnel.label())
+	return tunnel.http.replay(id)
+}
+
+// Terminate closes the tunnel at [address]; any of its paused traffic is dropped
+func (srv *Server) Terminate(address string) error {
+	tunnel, err := srv.tunnels.get(address)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("terminated tunnel %s", tunnel.label())
+	tunnel.notify(fmt.Sprintf("tunnel %s terminated by an administrator", tunnel.address), kv("type", "tunnel.terminated"), kv("address", tunnel.address))
+	tunnel.terminate()
+	return nil
+}
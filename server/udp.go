@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains the UDP tunnels, an extension of ssh port forwarding: clients (eg. shhh udp) send a
+// "udp-forward@shhh" request (with the same payload as tcpip-forward) to have a public UDP port bound. Datagrams from
+// each visitor's address make up a flow, carried over its own "forwarded-udp@shhh" channel (with the same payload as
+// forwarded-tcpip); each datagram is prefixed with its length, as a 16-bit big-endian integer.
+// ----------
+
+const (
+	// SSH request type to have a public UDP port bound and forwarded
+	UDPForwardRequest = "udp-forward@shhh"
+
+	// SSH channel type opened for each flow of datagrams on a forwarded UDP port
+	UDPForwardChannel = "forwarded-udp@shhh"
+)
+
+// largest datagram carried through UDP tunnels
+const maxDatagramSize = 65535
+
+// flows without datagrams in either direction for this long are closed
+const udpFlowIdleTimeout = 2 * time.Minute
+
+// number of datagrams queued for a flow (eg. while its channel is opened) before further ones are dropped
+const udpFlowQueue = 64
+
+// WriteDatagram writes [b] to [w] as a single length-prefixed datagram
+func WriteDatagram(w io.Writer, b []byte) error {
+	if len(b) > maxDatagramSize {
+		return errors.Errorf("datagram of %d bytes is too large", len(b))
+	}
+
+	var frame = make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadDatagram reads a single length-prefixed datagram from [r] into [buf] (which must have room for
+// maxDatagramSize bytes), and returns its length
+func ReadDatagram(r io.Reader, buf []byte) (int, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+
+	var n = int(binary.BigEndian.Uint16(header[:]))
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// udpListen returns a public UDP socket for a tunnel, bound to the given [host] and [port] (on the configured IP
+// versions)
+func udpListen(config *Config, host string, port uint32) (net.PacketConn, error) {
+	var network, addr = config.listenNetwork("udp", host)
+	return net.ListenPacket(network, net.JoinHostPort(addr, strconv.Itoa(int(port))))
+}
+
+// udpFlow is the flow of datagrams from (and back to) a single visitor
+type udpFlow struct {
+	visitor net.Addr
+	queue   chan []byte   // datagrams from the visitor, waiting to be written to the channel
+	done    chan struct{} // closed once the flow is closed
+}
+
+// udpForwardHandler forwards datagrams received on [pc] over channels opened using [newChannel] (one for each
+// visitor), and writes datagrams read from those channels back to the respective visitor, until [ctx] is done.
+// Visitors are admitted (per the operator's and the client's [options]) as in tcpipForwardConnectionHandler.
+func udpForwardHandler(ctx context.Context, pc net.PacketConn, notify notifyFn, newChannel newChannelFn,
+	options *sessionOptions, forwarded *forwardedConns) error {
+
+	var g = newGroup(ctx)
+	g.Go(func(ctx context.Context) error {
+		<-ctx.Done()
+		_ = pc.Close()
+		return nil
+	})
+
+	var mu sync.Mutex
+	var flows = make(map[string]*udpFlow)
+
+	g.Go(func(ctx context.Context) error {
+		var buf = make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				if oe, ok := err.(*net.OpError); ok && (oe.Timeout() || oe.Temporary()) {
+					continue
+				}
+				return errors.Wrap(err, "failed to read datagram")
+			}
+
+			mu.Lock()
+			var flow, ok = flows[addr.String()]
+			if !ok {
+				if _, admitted := forwarded.admit(udpVisitor(addr), pc.LocalAddr(), options); !admitted {
+					mu.Unlock()
+					continue
+				}
+
+				flow = &udpFlow{visitor: addr, queue: make(chan []byte, udpFlowQueue), done: make(chan struct{})}
+				flows[addr.String()] = flow
+				g.Go(func(ctx context.Context) error {
+					forwardFlow(ctx, pc, flow, notify, newChannel, options)
+					mu.Lock()
+					delete(flows, flow.visitor.String())
+					mu.Unlock()
+					return nil
+				})
+			}
+			mu.Unlock()
+
+			var datagram = make([]byte, n)
+			copy(datagram, buf[:n])
+			select {
+			case flow.queue <- datagram:
+			case <-flow.done:
+			default: // the flow is backed up; drop the datagram, as the network would
+			}
+		}
+	})
+
+	return g.Wait()
+}
+
+// forwardFlow opens a channel for [flow] and forwards its datagrams in both directions, until it's idle for
+// udpFlowIdleTimeout or [ctx] is done
+func forwardFlow(ctx context.Context, pc net.PacketConn, flow *udpFlow, notify notifyFn, newChannel newChannelFn, options *sessionOptions) {
+	defer close(flow.done)
+
+	var host, port, _ = net.SplitHostPort(flow.visitor.String())
+	channel, requests, err := newChannel(host, port)
+	if err != nil {
+		if err != errQuarantined {
+			notify(fmt.Sprintf("error occurred while processing: %s", err.Error()), kv("type", "error"), kv("error", err.Error()))
+		}
+		return
+	}
+	go gossh.DiscardRequests(requests)
+
+	// the flow's goroutines are done once it returns: closing the channel ends the reading of replies
+	var g = newGroup(ctx)
+	defer func() {
+		_ = channel.Close()
+		_ = g.Wait()
+	}()
+
+	notify(fmt.Sprintf("accepted UDP flow from %s", flow.visitor.String()),
+		kv("type", "connection.accepted"), kv("visitor", flow.visitor.String()), kv("protocol", "udp"))
+	var started = time.Now()
+
+	// datagrams from the client go back to the visitor
+	var activity = make(chan struct{}, 1)
+	var replies = make(chan struct{})
+	g.Go(func(context.Context) error {
+		defer close(replies)
+		var buf = make([]byte, maxDatagramSize)
+		for {
+			n, err := ReadDatagram(channel, buf)
+			if err != nil {
+				return nil
+			}
+
+			_, _ = pc.WriteTo(buf[:n], flow.visitor)
+			select {
+			case activity <- struct{}{}:
+			default:
+			}
+		}
+	})
+
+	var idle = time.NewTimer(udpFlowIdleTimeout)
+	defer idle.Stop()
+
+	var reason string
+loop:
+	for {
+		select {
+		case datagram := <-flow.queue:
+			if WriteDatagram(channel, datagram) != nil {
+				reason = "closed by the client"
+				break loop
+			}
+			idle.Reset(udpFlowIdleTimeout)
+		case <-activity:
+			idle.Reset(udpFlowIdleTimeout)
+		case <-replies:
+			reason = "closed by the client"
+			break loop
+		case <-idle.C:
+			reason = "idle"
+			break loop
+		case <-ctx.Done():
+			reason = "tunnel closed"
+			break loop
+		}
+	}
+
+	if options != nil && options.Verbose() {
+		notify(fmt.Sprintf("UDP flow from %s ended (%s) after %s", flow.visitor.String(), reason, time.Since(started).Round(time.Millisecond)),
+			kv("type", "connection.closed"), kv("visitor", flow.visitor.String()), kv("reason", reason),
+			kv("duration_ms", time.Since(started).Milliseconds()))
+	}
+}
+
+// udpVisitor returns the address of a UDP visitor as a TCP address, which is what visitor policies (sources,
+// countries and reputation) look at
+func udpVisitor(addr net.Addr) net.Addr {
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		return &net.TCPAddr{IP: udp.IP, Port: udp.Port, Zone: udp.Zone}
+	}
+	return addr
+}
@@ -0,0 +1,87 @@
+package server_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/riyaz-ali/shhh/internal/harness"
+	"github.com/riyaz-ali/shhh/server"
+	gossh "golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// freeUDPRange returns the first of [n] consecutive UDP ports which are free on loopback
+func freeUDPRange(t *testing.T, n int) int {
+	for low := 41000; low < 60000; low += n {
+		var free = true
+		for port := low; port < low+n && free; port++ {
+			pc, err := net.ListenPacket("udp", "127.0.0.1:"+strconv.Itoa(port))
+			if free = err == nil; free {
+				_ = pc.Close()
+			}
+		}
+		if free {
+			return low
+		}
+	}
+	t.Fatal("no free range of UDP ports")
+	return 0
+}
+
+// random UDP ports are picked among those the key may bind, as TCP ones are
+func TestUDPRandomPortSkipsReservedPorts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shhh-udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// every port of the profile's range is reserved for another key, but the last one
+	var low = freeUDPRange(t, 4)
+	var ports = map[string]string{}
+	for port := low; port < low+3; port++ {
+		ports[strconv.Itoa(port)] = "SHA256:someone-else"
+	}
+	content, _ := json.Marshal(map[string]interface{}{"ports": ports})
+	var reservations = filepath.Join(dir, "reservations.json")
+	if err = ioutil.WriteFile(reservations, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var config = server.DefaultConfig()
+	config.ReservationsFile = reservations
+	config.PermissionProfiles = map[string]server.PermissionProfile{"ranged": {Ports: []string{fmt.Sprintf("%d-%d", low, low+3)}}}
+	config.Users = map[string]string{"*": "ranged"}
+	srv, err := harness.Start(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	client, err := srv.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var payload = struct {
+		BindAddr string
+		BindPort uint32
+	}{"", 0}
+	ok, reply, err := client.SendRequest(server.UDPForwardRequest, true, gossh.Marshal(&payload))
+	if err != nil || !ok {
+		t.Fatalf("server refused to forward a random UDP port: %s (err: %v)", reply, err)
+	}
+
+	var response struct{ BindPort uint32 }
+	if err = gossh.Unmarshal(reply, &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.BindPort != uint32(low+3) {
+		t.Fatalf("got port %d, want %d (the only one of %d-%d which isn't reserved for another key)", response.BindPort, low+3, low, low+3)
+	}
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains the export of usage records: every Config.UsageInterval, the usage of each key (by fingerprint,
+// and the tags of its tunnels, see tags.go) over the period is sent to a sink, for platform teams to do chargeback or
+// enforce monthly caps with. Usage is the time tunnels were open (in tunnel-hours), the connections they served and
+// the bytes they transferred. Sinks are a file (of JSON lines), an HTTP endpoint (POSTed a JSON array), a Kafka topic
+// (see usage_kafka.go), or a UsageSink plugged in by embedders (see WithUsageSink). Records which fail to export
+// are retried with the next ones.
+// ----------
+
+const (
+	// how often usage is exported, unless configured
+	defaultUsageInterval = time.Hour
+
+	// maximum number of records kept for retrying failed exports; the oldest are dropped beyond it
+	usageMaxPending = 10000
+)
+
+// UsageRecord is the usage of a key's tunnels (with the same tags) on a node over a period
+type UsageRecord struct {
+	Fingerprint string            `json:"fingerprint"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Node        string            `json:"node,omitempty"` // the server's hostname, or its cluster node ID
+
+	// the period, from Start (inclusive) to End (exclusive)
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	// number of tunnels open during the period, and the time they were open for
+	Tunnels     int     `json:"tunnels"`
+	TunnelHours float64 `json:"tunnel_hours"`
+
+	// traffic through the tunnels during the period
+	Connections int64 `json:"connections"`
+	BytesIn     int64 `json:"bytes_in"`
+	BytesOut    int64 `json:"bytes_out"`
+}
+
+// UsageSink receives usage records (see WithUsageSink). Export is called from a single goroutine; if it returns an
+// error, the records are passed again (along with newer ones) the next time.
+type UsageSink interface {
+	Export(records []UsageRecord) error
+}
+
+// usageExporter accounts for the usage of tunnels, and exports it to its sink periodically. A nil *usageExporter
+// accounts for nothing.
+type usageExporter struct {
+	sink     UsageSink
+	name     string // of the sink, for logs
+	node     string
+	interval time.Duration
+	tunnels  func() []*openTunnel // open tunnels of the server
+
+	mu       sync.Mutex
+	since    time.Time               // start of the current period
+	usage    map[string]*UsageRecord // of the current period, by fingerprint and tags (see usageKey)
+	reported map[*tunnelStats]tunnelStats
+
+	flushes chan chan struct{}
+}
+
+// newUsageExporter returns the exporter of usage to [sink] (if not nil), or to the sink at [config].UsageExport,
+// accounting for [tunnels]. It returns nil if usage isn't exported.
+func newUsageExporter(config *Config, sink UsageSink, tunnels func() []*openTunnel) (*usageExporter, error) {
+	var name = "plugged-in sink"
+	if sink == nil {
+		if config.UsageExport == "" {
+			return nil, nil
+		}
+
+		var err error
+		if sink, err = openUsageSink(config.UsageExport); err != nil {
+			return nil, err
+		}
+		name = config.UsageExport
+	}
+
+	var node = config.ClusterNode
+	if node == "" {
+		node, _ = os.Hostname()
+	}
+
+	var interval = config.UsageInterval
+	if interval <= 0 {
+		interval = defaultUsageInterval
+	}
+
+	var e = &usageExporter{sink: sink, name: name, node: node, interval: interval, tunnels: tunnels, since: time.Now().UTC(),
+		usage: make(map[string]*UsageRecord), reported: make(map[*tunnelStats]tunnelStats), flushes: make(chan chan struct{})}
+	go e.run()
+	return e, nil
+}
+
+// openUsageSink returns the sink at [target]: a kafka://broker:port/topic, an http(s):// endpoint, or a file
+func openUsageSink(target string) (UsageSink, error) {
+	switch {
+	case strings.HasPrefix(target, "kafka://"):
+		return newKafkaUsageSink(target)
+	case strings.HasPrefix(target, "http://"), strings.HasPrefix(target, "https://"):
+		if _, err := url.Parse(target); err != nil {
+			return nil, errors.Wrapf(err, "invalid usage export endpoint %q", target)
+		}
+		return &httpUsageSink{endpoint: target, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	default:
+		var path = strings.TrimPrefix(target, "file://")
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open usage export file")
+		}
+		_ = f.Close()
+		return &fileUsageSink{path: path}, nil
+	}
+}
+
+// usageKey returns the key the usage of the tunnels of [fingerprint] with [tags] is accounted under
+func usageKey(fingerprint string, tags map[string]string) string {
+	return fingerprint + " " + formatTags(tags)
+}
+
+// account adds the usage of the tunnel of [fingerprint] with [tags] and [stats] since it was last accounted for (or
+// opened) until [now]. Must be called with lock held.
+func (e *usageExporter) account(fingerprint string, tags map[string]string, stats *tunnelStats, now time.Time) {
+	var key = usageKey(fingerprint, tags)
+	var record, ok = e.usage[key]
+	if !ok {
+		record = &UsageRecord{Fingerprint: fingerprint, Tags: tags, Node: e.node}
+		e.usage[key] = record
+	}
+
+	var current, last = stats.snapshot(), e.reported[stats]
+	var from = e.since
+	if stats.started.After(from) {
+		from = stats.started
+	}
+
+	record.Tunnels++
+	record.TunnelHours += now.Sub(from).Hours()
+	record.Connections += current.connections - last.connections
+	record.BytesIn += current.bytesIn - last.bytesIn
+	record.BytesOut += current.bytesOut - last.bytesOut
+	e.reported[stats] = current
+}
+
+// closed accounts for the final usage of the tunnel of [fingerprint] with [tags] and [stats], which has been closed
+// (and removed from the server's open tunnels)
+func (e *usageExporter) closed(fingerprint string, tags map[string]string, stats *tunnelStats) {
+	if e == nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.account(fingerprint, tags, stats, time.Now().UTC())
+	delete(e.reported, stats)
+}
+
+// collect returns the records of the period ending now, and starts the next one
+func (e *usageExporter) collect() []UsageRecord {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// tunnels are listed with the lock held, so that those closing meanwhile are accounted for either here or by
+	// closed (once this returns), but not both
+	var now = time.Now().UTC()
+	for _, tunnel := range e.tunnels() {
+		e.account(tunnel.fingerprint, tunnel.tags, tunnel.stats, now)
+	}
+
+	var records = make([]UsageRecord, 0, len(e.usage))
+	for _, record := range e.usage {
+		record.Start, record.End = e.since, now
+		records = append(records, *record)
+	}
+	e.since, e.usage = now, make(map[string]*UsageRecord)
+	return records
+}
+
+// Flush exports the usage so far (of the period cut short), or gives up once [ctx] is done
+func (e *usageExporter) Flush(ctx context.Context) error {
+	if e == nil {
+		return nil
+	}
+
+	var done = make(chan struct{})
+	select {
+	case e.flushes <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run exports usage every interval (and when flushed) for as long as the process runs
+func (e *usageExporter) run() {
+	var ticker = time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	var pending []UsageRecord
+	var export = func() {
+		if pending = append(pending, e.collect()...); len(pending) == 0 {
+			return
+		}
+
+		if err := e.sink.Export(pending); err != nil {
+			log.Printf("usage export %s: failed to export %d records (will retry): %s", e.name, len(pending), err.Error())
+			if dropped := len(pending) - usageMaxPending; dropped > 0 {
+				log.Printf("usage export %s: dropped %d records", e.name, dropped)
+				pending = pending[dropped:]
+			}
+			return
+		}
+		pending = nil
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			export()
+		case done := <-e.flushes:
+			export()
+			close(done)
+		}
+	}
+}
+
+// fileUsageSink appends records to a file, as JSON lines
+type fileUsageSink struct {
+	path string
+}
+
+func (sink *fileUsageSink) Export(records []UsageRecord) error {
+	var buf bytes.Buffer
+	var encoder = json.NewEncoder(&buf)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return errors.Wrap(err, "failed to marshal usage")
+		}
+	}
+
+	f, err := os.OpenFile(sink.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to open usage export file")
+	}
+	if _, err = f.Write(buf.Bytes()); err != nil {
+		_ = f.Close()
+		return errors.Wrap(err, "failed to write usage")
+	}
+	return f.Close()
+}
+
+// httpUsageSink POSTs records to an HTTP endpoint, as a JSON array
+type httpUsageSink struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (sink *httpUsageSink) Export(records []UsageRecord) error {
+	body, err := json.Marshal(records)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal usage")
+	}
+
+	resp, err := sink.client.Post(sink.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to post usage")
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("endpoint responded with %s", resp.Status)
+	}
+	return nil
+}
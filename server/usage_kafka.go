@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------
+// This file contains the Kafka sink of usage records (see usage_export.go): a minimal producer, speaking just enough
+// of Kafka's protocol (see https://kafka.apache.org/protocol) to send a batch of records to a partition of a topic
+// (with Produce v3, supported since Kafka 0.11). Each record is a UsageRecord as JSON, keyed by its fingerprint.
+// The broker given must lead the partition; there's no discovery of the cluster's metadata.
+// ----------
+
+const (
+	// Kafka API keys and versions used
+	kafkaProduceKey     = 0
+	kafkaProduceVersion = 3
+
+	// how long brokers have to acknowledge a batch
+	kafkaTimeout = 10 * time.Second
+)
+
+// kafkaUsageSink produces records to a partition of a Kafka topic
+type kafkaUsageSink struct {
+	broker    string
+	topic     string
+	partition int32
+
+	correlation int32
+}
+
+// newKafkaUsageSink returns the sink at [target], as kafka://broker:port/topic[?partition=n]
+func newKafkaUsageSink(target string) (*kafkaUsageSink, error) {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return nil, errors.Errorf("invalid Kafka usage sink %q: must be kafka://broker:port/topic", target)
+	}
+
+	var sink = &kafkaUsageSink{broker: withDefaultPort(u.Host, "9092"), topic: strings.Trim(u.Path, "/")}
+	if p := u.Query().Get("partition"); p != "" {
+		partition, err := strconv.ParseInt(p, 10, 32)
+		if err != nil || partition < 0 {
+			return nil, errors.Errorf("invalid partition %q of Kafka usage sink", p)
+		}
+		sink.partition = int32(partition)
+	}
+	return sink, nil
+}
+
+func (sink *kafkaUsageSink) Export(records []UsageRecord) error {
+	batch, err := kafkaRecordBatch(records)
+	if err != nil {
+		return err
+	}
+
+	sink.correlation++
+	var request kafkaBuffer
+	request.int16(kafkaProduceKey)
+	request.int16(kafkaProduceVersion)
+	request.int32(sink.correlation)
+	request.string("shhh")
+	request.int16(-1) // no transactional ID
+	request.int16(-1) // acknowledged by all in-sync replicas
+	request.int32(int32(kafkaTimeout / time.Millisecond))
+	request.int32(1)
+	request.string(sink.topic)
+	request.int32(1)
+	request.int32(sink.partition)
+	request.bytes(batch)
+
+	conn, err := net.DialTimeout("tcp", sink.broker, kafkaTimeout)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to Kafka")
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * kafkaTimeout))
+
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(request.Len()))
+	if _, err = conn.Write(append(size[:], request.Bytes()...)); err != nil {
+		return errors.Wrap(err, "failed to send records to Kafka")
+	}
+
+	if _, err = io.ReadFull(conn, size[:]); err != nil {
+		return errors.Wrap(err, "failed to read Kafka's response")
+	}
+	var response = make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err = io.ReadFull(conn, response); err != nil {
+		return errors.Wrap(err, "failed to read Kafka's response")
+	}
+	return sink.check(response)
+}
+
+// check returns an error unless the Produce [response] acknowledges the records
+func (sink *kafkaUsageSink) check(response []byte) error {
+	var r = kafkaReader{b: response}
+	if correlation := r.int32(); correlation != sink.correlation {
+		return errors.Errorf("unexpected response from Kafka (to request %d, not %d)", correlation, sink.correlation)
+	}
+
+	for topics := r.int32(); topics > 0 && r.err == nil; topics-- {
+		r.string()
+		for partitions := r.int32(); partitions > 0 && r.err == nil; partitions-- {
+			r.int32()
+			if code := r.int16(); code != 0 {
+				return errors.Errorf("Kafka refused the records with error code %d (see https://kafka.apache.org/protocol#protocol_error_codes)", code)
+			}
+			r.int64() // base offset
+			r.int64() // log append time
+		}
+	}
+
+	if r.err != nil {
+		return errors.New("malformed response from Kafka")
+	}
+	return nil
+}
+
+// kafkaRecordBatch returns [records] as a batch (of Kafka's v2 message format)
+func kafkaRecordBatch(records []UsageRecord) ([]byte, error) {
+	var now = time.Now().UnixNano() / int64(time.Millisecond)
+
+	var body kafkaBuffer
+	body.int16(0) // attributes: no compression
+	body.int32(int32(len(records) - 1))
+	body.int64(now)
+	body.int64(now)
+	body.int64(-1) // producer ID
+	body.int16(-1) // producer epoch
+	body.int32(-1) // base sequence
+	body.int32(int32(len(records)))
+	for i, record := range records {
+		value, err := json.Marshal(record)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal usage")
+		}
+
+		var r kafkaBuffer
+		r.int8(0)   // attributes
+		r.varint(0) // timestamp delta
+		r.varint(int64(i))
+		r.varint(int64(len(record.Fingerprint)))
+		r.WriteString(record.Fingerprint)
+		r.varint(int64(len(value)))
+		r.Write(value)
+		r.varint(0) // headers
+
+		body.varint(int64(r.Len()))
+		body.Write(r.Bytes())
+	}
+
+	var batch kafkaBuffer
+	batch.int64(0) // base offset
+	batch.int32(int32(4 + 1 + 4 + body.Len()))
+	batch.int32(-1) // partition leader epoch
+	batch.int8(2)   // magic
+	batch.int32(int32(crc32.Checksum(body.Bytes(), crc32.MakeTable(crc32.Castagnoli))))
+	batch.Write(body.Bytes())
+	return batch.Bytes(), nil
+}
+
+// kafkaBuffer encodes Kafka's protocol primitives
+type kafkaBuffer struct{ bytes.Buffer }
+
+func (b *kafkaBuffer) int8(v int8) { b.WriteByte(byte(v)) }
+
+func (b *kafkaBuffer) int16(v int16) { _ = binary.Write(b, binary.BigEndian, v) }
+
+func (b *kafkaBuffer) int32(v int32) { _ = binary.Write(b, binary.BigEndian, v) }
+
+func (b *kafkaBuffer) int64(v int64) { _ = binary.Write(b, binary.BigEndian, v) }
+
+func (b *kafkaBuffer) string(s string) {
+	b.int16(int16(len(s)))
+	b.WriteString(s)
+}
+
+func (b *kafkaBuffer) bytes(p []byte) {
+	b.int32(int32(len(p)))
+	b.Write(p)
+}
+
+// varint writes [v] zigzag-encoded, as in record batches
+func (b *kafkaBuffer) varint(v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutVarint(buf[:], v)])
+}
+
+// kafkaReader decodes Kafka's protocol primitives, recording the first error (and returning zero values after it)
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil || len(r.b) < n {
+		r.err = io.ErrUnexpectedEOF
+		return make([]byte, n)
+	}
+	var p = r.b[:n]
+	r.b = r.b[n:]
+	return p
+}
+
+func (r *kafkaReader) int16() int16 { return int16(binary.BigEndian.Uint16(r.next(2))) }
+
+func (r *kafkaReader) int32() int32 { return int32(binary.BigEndian.Uint32(r.next(4))) }
+
+func (r *kafkaReader) int64() int64 { return int64(binary.BigEndian.Uint64(r.next(8))) }
+
+func (r *kafkaReader) string() string {
+	var n = int(r.int16())
+	if n < 0 {
+		return ""
+	}
+	return string(r.next(n))
+}
@@ -0,0 +1,337 @@
+package server
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains the permission profiles of users: declarative sets of what a key (see Config.Users) may forward,
+// and how much. The forwarding request handler consults the user's profile on every request.
+// ----------
+
+// kinds of tunnels a profile may allow (see PermissionProfile.Forwarding)
+const (
+	forwardHTTP = "http"
+	forwardTLS  = "tls"
+	forwardTCP  = "tcp"
+	forwardUDP  = "udp"
+	forwardUnix = "unix"
+)
+
+// PermissionProfile declares what the users it's assigned to (see Config.Users) may do. Zero values allow everything.
+type PermissionProfile struct {
+	// ports (eg. "8080") or inclusive port ranges (eg. "8000-8100") TCP and UDP tunnels may bind; random ports are
+	// picked in these ranges
+	Ports []string `json:"ports,omitempty"`
+
+	// patterns (see path.Match, eg. "ci-*") of the names HTTP and TLS tunnels may use; users must then ask for a name
+	Subdomains []string `json:"subdomains,omitempty"`
+
+	// kinds of tunnels allowed: http, tls, tcp, udp, and unix (the unix sockets exposing TCP tunnels; see
+	// Config.UnixSocketDir)
+	Forwarding []string `json:"forwarding,omitempty"`
+
+	// maximum number of tunnels open at the same time
+	MaxTunnels int `json:"max_tunnels,omitempty"`
+
+	// bytes per second (in both directions) through all of a user's tunnels
+	BandwidthLimit int64 `json:"bandwidth_limit,omitempty"`
+}
+
+// userProfile is a PermissionProfile in use
+type userProfile struct {
+	PermissionProfile
+	name  string
+	ports []stablePorts // parsed Ports
+}
+
+// userProfiles assigns permission profiles to keys, and tracks their use. A nil *userProfiles assigns none.
+type userProfiles struct {
+	mu       sync.Mutex
+	users    map[string]*userProfile      // by fingerprint
+	fallback *userProfile                 // of keys not in users; nil if they aren't restricted
+	tunnels  map[string]int               // open tunnels, by fingerprint
+	limiters map[string]*bandwidthLimiter // by fingerprint, while they have tunnels open
+}
+
+// newUserProfiles returns the userProfiles assigning [config].PermissionProfiles to [config].Users. It assigns none
+// if there are no users, until they're updated (see userProfiles.update).
+func newUserProfiles(config *Config) (*userProfiles, error) {
+	var up = &userProfiles{tunnels: make(map[string]int), limiters: make(map[string]*bandwidthLimiter)}
+	if err := up.update(config); err != nil {
+		return nil, err
+	}
+	return up, nil
+}
+
+// update assigns [config].PermissionProfiles to [config].Users instead, eg. after the config file changed. Tunnels
+// already open are left open; the bandwidth limits of their users change right away.
+func (up *userProfiles) update(config *Config) error {
+	var profiles = make(map[string]*userProfile)
+	for name, p := range config.PermissionProfiles {
+		var profile = &userProfile{PermissionProfile: p, name: name}
+		for _, r := range p.Ports {
+			low, high, err := parsePortRange(r)
+			if err != nil {
+				return errors.Wrapf(err, "invalid permission profile %q", name)
+			}
+			profile.ports = append(profile.ports, stablePorts{low: low, high: high})
+		}
+
+		for _, pattern := range p.Subdomains {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Errorf("invalid permission profile %q: invalid subdomain pattern %q", name, pattern)
+			}
+		}
+
+		for _, kind := range p.Forwarding {
+			if !contains([]string{forwardHTTP, forwardTLS, forwardTCP, forwardUDP, forwardUnix}, kind) {
+				return errors.Errorf("invalid permission profile %q: unknown kind of forwarding %q", name, kind)
+			}
+		}
+		profiles[name] = profile
+	}
+
+	var users, fallback = make(map[string]*userProfile), (*userProfile)(nil)
+	for fingerprint, name := range config.Users {
+		profile, ok := profiles[name]
+		if !ok {
+			return errors.Errorf("user %s has unknown permission profile %q", fingerprint, name)
+		}
+
+		if fingerprint == "*" {
+			fallback = profile
+		} else {
+			users[fingerprint] = profile
+		}
+	}
+
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	up.users, up.fallback = users, fallback
+	for fingerprint, limiter := range up.limiters {
+		if profile := up.profileOf(fingerprint); profile != nil && profile.BandwidthLimit > 0 {
+			limiter.setRate(profile.BandwidthLimit)
+		} else {
+			delete(up.limiters, fingerprint) // its channels keep the old limit
+		}
+	}
+	return nil
+}
+
+// of returns the profile of the key with [fingerprint], or nil if it isn't restricted
+func (up *userProfiles) of(fingerprint string) *userProfile {
+	if up == nil {
+		return nil
+	}
+
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return up.profileOf(fingerprint)
+}
+
+// profileOf is of, with the lock held
+func (up *userProfiles) profileOf(fingerprint string) *userProfile {
+	if profile, ok := up.users[fingerprint]; ok {
+		return profile
+	}
+	return up.fallback
+}
+
+// allows returns an error unless the profile allows the [kind] of tunnel
+func (p *userProfile) allows(kind string) error {
+	if p == nil || len(p.Forwarding) == 0 || contains(p.Forwarding, kind) {
+		return nil
+	}
+	return errors.Errorf("%s tunnels are not allowed (profile %q)", strings.ToUpper(kind), p.name)
+}
+
+// allowsPort returns true if the profile allows binding [port] (0 requests a random one)
+func (p *userProfile) allowsPort(port uint32) bool {
+	if p == nil || len(p.ports) == 0 || port == 0 {
+		return true
+	}
+	for _, r := range p.ports {
+		if port >= r.low && port <= r.high {
+			return true
+		}
+	}
+	return false
+}
+
+// restrictsPorts returns true if random ports are to be picked in the profile's ranges
+func (p *userProfile) restrictsPorts() bool { return p != nil && len(p.ports) > 0 }
+
+// candidates returns the ports to try, in order, for a random port in the profile's ranges
+func (p *userProfile) candidates(fingerprint string) []uint32 {
+	var ports []uint32
+	for i := range p.ports {
+		ports = append(ports, p.ports[i].candidates(fingerprint)...)
+	}
+	return ports
+}
+
+// allowsName returns an error unless the profile allows an HTTP / TLS tunnel to use [name] (empty for a random one)
+func (p *userProfile) allowsName(name string) error {
+	if p == nil || len(p.Subdomains) == 0 {
+		return nil
+	}
+
+	if name == "" {
+		return errors.Errorf("ask for a name (with --subdomain) matching %s (profile %q)", strings.Join(p.Subdomains, ", "), p.name)
+	}
+
+	for _, pattern := range p.Subdomains {
+		if ok, _ := path.Match(pattern, name); ok {
+			return nil
+		}
+	}
+	return errors.Errorf("name %q is not allowed (profile %q)", name, p.name)
+}
+
+// acquireTunnel accounts for a new tunnel by the key with [fingerprint], unless it would exceed what its profile
+// allows. It returns the key's bandwidth limiter (nil if unlimited).
+func (up *userProfiles) acquireTunnel(fingerprint string) (*bandwidthLimiter, error) {
+	if up == nil {
+		return nil, nil
+	}
+
+	// tunnels are counted even if the key isn't restricted (yet), in case its profile changes
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	var profile = up.profileOf(fingerprint)
+	if profile != nil && profile.MaxTunnels > 0 && up.tunnels[fingerprint] >= profile.MaxTunnels {
+		return nil, errors.Errorf("at most %d tunnels allowed at the same time (profile %q)", profile.MaxTunnels, profile.name)
+	}
+	up.tunnels[fingerprint]++
+
+	if profile == nil || profile.BandwidthLimit <= 0 {
+		return nil, nil
+	}
+	var limiter, ok = up.limiters[fingerprint]
+	if !ok {
+		limiter = newBandwidthLimiter(profile.BandwidthLimit)
+		up.limiters[fingerprint] = limiter
+	}
+	return limiter, nil
+}
+
+// releaseTunnel accounts for a tunnel by the key with [fingerprint] being closed
+func (up *userProfiles) releaseTunnel(fingerprint string) {
+	if up == nil {
+		return
+	}
+
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if up.tunnels[fingerprint]--; up.tunnels[fingerprint] <= 0 {
+		delete(up.tunnels, fingerprint)
+		delete(up.limiters, fingerprint)
+	}
+}
+
+// bandwidthLimiter is a token bucket, shared by all the channels of a user's tunnels. A nil *bandwidthLimiter
+// doesn't limit anything.
+type bandwidthLimiter struct {
+	rate float64 // bytes per second; also the size of the bucket
+
+	mu     sync.Mutex
+	tokens float64 // negative while transfers wait for tokens
+	last   time.Time
+}
+
+func newBandwidthLimiter(rate int64) *bandwidthLimiter {
+	return &bandwidthLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// setRate changes the limiter's rate to [rate] bytes per second
+func (l *bandwidthLimiter) setRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = float64(rate)
+}
+
+// wait takes [n] tokens from the bucket, waiting until they've been refilled if it's run dry
+func (l *bandwidthLimiter) wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	var now = time.Now()
+	if l.tokens += now.Sub(l.last).Seconds() * l.rate; l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// throttled wraps [newChannel] so that the traffic over channels it opens is limited to the limiter's rate
+func (l *bandwidthLimiter) throttled(newChannel newChannelFn) newChannelFn {
+	if l == nil {
+		return newChannel
+	}
+
+	return func(host, port string) (gossh.Channel, <-chan *gossh.Request, error) {
+		channel, requests, err := newChannel(host, port)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &throttledChannel{Channel: channel, limiter: l}, requests, nil
+	}
+}
+
+// throttledChannel is a gossh.Channel whose traffic is limited by a bandwidthLimiter
+type throttledChannel struct {
+	gossh.Channel
+	limiter *bandwidthLimiter
+}
+
+func (c *throttledChannel) Read(b []byte) (n int, err error) {
+	n, err = c.Channel.Read(b)
+	c.limiter.wait(n)
+	return n, err
+}
+
+func (c *throttledChannel) Write(b []byte) (n int, err error) {
+	c.limiter.wait(len(b))
+	return c.Channel.Write(b)
+}
+
+// String describes the profile, for the user
+func (p *userProfile) String() string {
+	var parts []string
+	if len(p.Forwarding) > 0 {
+		parts = append(parts, "forwarding: "+strings.Join(p.Forwarding, ", "))
+	}
+	if len(p.Ports) > 0 {
+		parts = append(parts, "ports: "+strings.Join(p.Ports, ", "))
+	}
+	if len(p.Subdomains) > 0 {
+		parts = append(parts, "names: "+strings.Join(p.Subdomains, ", "))
+	}
+	if p.MaxTunnels > 0 {
+		parts = append(parts, fmt.Sprintf("tunnels: %d", p.MaxTunnels))
+	}
+	if p.BandwidthLimit > 0 {
+		parts = append(parts, "bandwidth: "+formatBytes(p.BandwidthLimit)+"/s")
+	}
+	if parts == nil {
+		parts = []string{"unrestricted"}
+	}
+	return fmt.Sprintf("%s (%s)", p.name, strings.Join(parts, "; "))
+}
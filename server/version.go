@@ -0,0 +1,68 @@
+package server
+
+import (
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// ----------
+// This file contains the version the server advertises to ssh clients (see Config.ServerVersion): the library's
+// default ("SSH-2.0-Go"), one of the operator's choosing, or one picked at random for each connection so that
+// scanners can't tell deployments apart by it.
+// ----------
+
+// randomServerVersion is the value of Config.ServerVersion picking a version at random for each connection
+const randomServerVersion = "random"
+
+// versions advertised by common ssh servers, which a random one is picked from
+var serverVersions = []string{
+	"OpenSSH_7.4",
+	"OpenSSH_8.0",
+	"OpenSSH_8.2p1 Ubuntu-4ubuntu0.11",
+	"OpenSSH_8.4p1 Debian-5+deb11u3",
+	"OpenSSH_8.7",
+	"OpenSSH_8.9p1 Ubuntu-3ubuntu0.10",
+	"OpenSSH_9.2p1 Debian-2+deb12u3",
+	"OpenSSH_9.6p1 Ubuntu-3ubuntu13.5",
+	"OpenSSH_9.9",
+	"dropbear_2022.83",
+}
+
+// validateServerVersion checks that [version] fits in an ssh identification string (see RFC 4253, section 4.2):
+// printable US-ASCII, with the software version (up to the first space) free of dashes
+func validateServerVersion(version string) error {
+	if version == "" || version == randomServerVersion {
+		return nil
+	}
+
+	if len(version) > 255-len("SSH-2.0-\r\n") {
+		return errors.Errorf("invalid server version %q: too long", version)
+	}
+
+	var comments = false
+	for _, c := range version {
+		switch {
+		case c < 0x20 || c > 0x7e:
+			return errors.Errorf("invalid server version %q: must be printable US-ASCII", version)
+		case c == ' ':
+			comments = true
+		case c == '-' && !comments:
+			return errors.Errorf("invalid server version %q: the software version can't contain dashes", version)
+		}
+	}
+	return nil
+}
+
+// versionConfig returns an ssh.ServerConfigCallback advertising a random version from serverVersions to each
+// client, on top of [next] (if set)
+func versionConfig(next ssh.ServerConfigCallback) ssh.ServerConfigCallback {
+	return func(ctx ssh.Context) *gossh.ServerConfig {
+		var config = &gossh.ServerConfig{}
+		if next != nil {
+			config = next(ctx)
+		}
+		config.ServerVersion = "SSH-2.0-" + serverVersions[randomInt(len(serverVersions))]
+		return config
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// ----------
+// This file contains a helper watching files for changes, so that they're applied live. Where the platform can
+// tell (see watch_linux.go), changes are noticed right away; they're also polled for, in case it can't.
+// ----------
+
+// how often watched files are checked for changes
+const watchPollInterval = 2 * time.Second
+
+// how long a changed file must stay the same before its changes apply, so that half-written versions don't
+const watchSettleTime = 250 * time.Millisecond
+
+// fileState is what tells a file's versions apart
+type fileState struct {
+	modTime time.Time
+	size    int64
+	missing bool
+}
+
+func statFile(path string) fileState {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileState{missing: true}
+	}
+	return fileState{modTime: info.ModTime(), size: info.Size()}
+}
+
+// watchFile calls [changed] whenever the file at [path] changes (including being replaced, eg. by an editor), until
+// [stop] is closed. Changes are applied once the file exists again if it's removed.
+func watchFile(path string, stop <-chan struct{}, changed func()) {
+	events, err := fileEvents(path, stop)
+	if err != nil {
+		log.Printf("failed to watch %s, polling it instead: %s", path, err.Error())
+	}
+
+	var ticker = time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+
+	for last := statFile(path); ; {
+		select {
+		case <-stop:
+			return
+		case <-events:
+		case <-ticker.C:
+		}
+
+		var state = statFile(path)
+		if state == last || state.missing {
+			continue
+		}
+
+		time.Sleep(watchSettleTime)
+		if statFile(path) == state {
+			last = state
+			changed()
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// ----------
+// On Linux, watched files are noticed to change right away, using inotify
+// ----------
+
+// fileEvents returns a channel receiving a value whenever something in the directory of [path] changes, until [stop]
+// is closed. The directory is watched (rather than the file) so that the file being replaced is noticed too.
+func fileEvents(path string, stop <-chan struct{}) (<-chan struct{}, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	// files are only noticed once they've been written (or moved into place), rather than while they are
+	const mask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO
+	if _, err = syscall.InotifyAddWatch(fd, filepath.Dir(path), mask); err != nil {
+		_ = syscall.Close(fd)
+		return nil, os.NewSyscallError("inotify_add_watch", err)
+	}
+
+	// as it's non-blocking, reads are handled by the runtime's poller, and closing the file interrupts them
+	var file = os.NewFile(uintptr(fd), "inotify")
+	go func() {
+		<-stop
+		_ = file.Close()
+	}()
+
+	var events = make(chan struct{}, 1)
+	go func() {
+		var buf = make([]byte, 4096)
+		for {
+			if _, err := file.Read(buf); err != nil {
+				return
+			}
+
+			select {
+			case events <- struct{}{}:
+			default: // a change is already pending
+			}
+		}
+	}()
+	return events, nil
+}
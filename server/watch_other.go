@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+// ----------
+// Elsewhere than on Linux, watched files are only polled for changes
+// ----------
+
+// fileEvents returns no events; changes are noticed by polling
+func fileEvents(string, <-chan struct{}) (<-chan struct{}, error) { return nil, nil }
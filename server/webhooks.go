@@ -0,0 +1,159 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ----------
+// This file contains the webhooks which are notified of tunnel lifecycle events
+// ----------
+
+const (
+	// maximum number of undelivered events per webhook; newer events are dropped once full
+	webhookQueueSize = 256
+
+	// delivery attempts per event, with exponential backoff in between
+	webhookAttempts       = 5
+	webhookInitialBackoff = 1 * time.Second
+	webhookMaxBackoff     = 30 * time.Second
+
+	// header carrying the HMAC-SHA256 signature of the body (as sha256=<hex>), if the webhook has a secret
+	webhookSignatureHeader = "X-Shhh-Signature"
+)
+
+// WebhookConfig configures a webhook which receives tunnel lifecycle events (see TunnelEvent) as JSON POST requests
+type WebhookConfig struct {
+	URL string `json:"url"`
+
+	// if set, each request is signed using HMAC-SHA256 with the secret as key
+	Secret string `json:"secret,omitempty"`
+
+	// types of events to deliver (empty for all)
+	Events []string `json:"events,omitempty"`
+}
+
+// webhook delivers events to a WebhookConfig in the background, in order, retrying failed deliveries
+type webhook struct {
+	config *WebhookConfig
+	client *http.Client
+
+	queue   chan TunnelEvent
+	pending sync.WaitGroup // events queued but not yet delivered (or given up on)
+}
+
+// newWebhook returns a new webhook for [config] and starts delivering events to it
+func newWebhook(config *WebhookConfig) *webhook {
+	var hook = &webhook{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan TunnelEvent, webhookQueueSize),
+	}
+	go hook.run()
+	return hook
+}
+
+// Send queues the [event] for delivery, unless the webhook isn't interested in it. It never blocks.
+func (hook *webhook) Send(event TunnelEvent) {
+	if len(hook.config.Events) > 0 && !contains(hook.config.Events, event.Type) {
+		return
+	}
+
+	hook.pending.Add(1)
+	select {
+	case hook.queue <- event:
+	default:
+		hook.pending.Done()
+		log.Printf("webhook %s: queue is full; dropped %s event", hook.config.URL, event.Type)
+	}
+}
+
+// Flush waits until all queued events are delivered (or given up on), or [ctx] is done
+func (hook *webhook) Flush(ctx context.Context) error {
+	var done = make(chan struct{})
+	go func() {
+		hook.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run delivers queued events for as long as the process runs
+func (hook *webhook) run() {
+	for event := range hook.queue {
+		var backoff = webhookInitialBackoff
+		for attempt := 1; ; attempt++ {
+			var err = hook.deliver(event)
+			if err == nil {
+				break
+			}
+
+			if attempt == webhookAttempts {
+				log.Printf("webhook %s: giving up on %s event after %d attempts: %s", hook.config.URL, event.Type, attempt, err.Error())
+				break
+			}
+
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > webhookMaxBackoff {
+				backoff = webhookMaxBackoff
+			}
+		}
+		hook.pending.Done()
+	}
+}
+
+// deliver POSTs the [event] to the webhook once
+func (hook *webhook) deliver(event TunnelEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal event")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, hook.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "invalid webhook url")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if hook.config.Secret != "" {
+		var mac = hmac.New(sha256.New, []byte(hook.config.Secret))
+		_, _ = mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := hook.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("unexpected response: %s", resp.Status)
+	}
+	return nil
+}
+
+// contains returns true if [list] contains [s]
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ----------
+// This file contains a minimal WebSocket (RFC 6455) implementation, just enough to carry a byte stream (eg. an ssh
+// connection) over binary messages, for clients whose network only lets HTTP(S) through
+// ----------
+
+// GUID the Sec-WebSocket-Accept header is derived with (see RFC 6455 § 1.3)
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// largest control frame payload (see RFC 6455 § 5.5)
+const maxControlPayload = 125
+
+// WebSocketAccept returns the Sec-WebSocket-Accept header value for the Sec-WebSocket-Key [key]
+func WebSocketAccept(key string) string {
+	var sum = sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// NewWebSocketKey returns a random Sec-WebSocket-Key header value, for clients to open a WebSocket with
+func NewWebSocketKey() string {
+	var key = make([]byte, 16)
+	_, _ = rand.Read(key)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// isWebSocketUpgrade returns true if [r] asks to open a WebSocket
+func isWebSocketUpgrade(r *http.Request) bool {
+	return r.Method == http.MethodGet && strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		headerContains(r.Header, "Connection", "upgrade") && r.Header.Get("Sec-WebSocket-Key") != ""
+}
+
+// headerContains returns true if the comma-separated values of the [name] header in [h] include [token] (ignoring case)
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h[http.CanonicalHeaderKey(name)] {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// webSocketConn is a net.Conn carried over the binary messages of a WebSocket, once its handshake is done
+type webSocketConn struct {
+	net.Conn
+	r      *bufio.Reader
+	client bool // clients mask the frames they send, servers don't
+
+	remaining int64   // bytes left in the frame being read
+	mask      [4]byte // of the frame being read
+	masked    bool
+	offset    int // of the next byte in the frame being read, for unmasking
+
+	wmu    sync.Mutex // writes come from Write and from the reader (answering pings and close frames)
+	closed bool       // a close frame was sent
+}
+
+// NewWebSocketConn returns a net.Conn reading and writing binary WebSocket messages on [conn], whose handshake is
+// done and whose buffered data is in [r]. [client] is set if this end opened the WebSocket.
+func NewWebSocketConn(conn net.Conn, r *bufio.Reader, client bool) net.Conn {
+	return &webSocketConn{Conn: conn, r: r, client: client}
+}
+
+func (ws *webSocketConn) Read(b []byte) (int, error) {
+	for ws.remaining == 0 {
+		if err := ws.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	if int64(len(b)) > ws.remaining {
+		b = b[:ws.remaining]
+	}
+	n, err := ws.r.Read(b)
+	if ws.masked {
+		for i := 0; i < n; i++ {
+			b[i] ^= ws.mask[(ws.offset+i)%4]
+		}
+	}
+	ws.offset += n
+	ws.remaining -= int64(n)
+	return n, err
+}
+
+// nextFrame reads the header of the next data frame, handling any control frames before it
+func (ws *webSocketConn) nextFrame() error {
+	var header [2]byte
+	if _, err := io.ReadFull(ws.r, header[:]); err != nil {
+		return err
+	}
+
+	var opcode = header[0] & 0x0f
+	var length = int64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.r, ext[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.r, ext[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]) & (1<<63 - 1))
+	}
+
+	ws.masked, ws.offset = header[1]&0x80 != 0, 0
+	if ws.masked {
+		if _, err := io.ReadFull(ws.r, ws.mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case opContinuation, opText, opBinary:
+		ws.remaining = length
+		return nil
+	}
+
+	// control frames are read whole
+	if length > maxControlPayload {
+		return errors.New("websocket: control frame too large")
+	}
+	var payload = make([]byte, length)
+	if _, err := io.ReadFull(ws.r, payload); err != nil {
+		return err
+	}
+	if ws.masked {
+		for i := range payload {
+			payload[i] ^= ws.mask[i%4]
+		}
+	}
+
+	switch opcode {
+	case opPing:
+		return ws.writeFrame(opPong, payload)
+	case opClose:
+		_ = ws.writeFrame(opClose, nil)
+		return io.EOF
+	}
+	return nil // unsolicited pongs (and unknown opcodes) are ignored
+}
+
+func (ws *webSocketConn) Write(b []byte) (int, error) {
+	if err := ws.writeFrame(opBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeFrame writes a single (final) frame of [opcode] carrying [payload]
+func (ws *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+
+	if ws.closed {
+		return io.ErrClosedPipe
+	}
+	if opcode == opClose {
+		ws.closed = true
+	}
+
+	var frame = make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+
+	var maskBit byte
+	if ws.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, maskBit|126, byte(n>>8), byte(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = append(frame, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(frame[len(frame)-8:], uint64(n))
+	}
+
+	if !ws.client {
+		frame = append(frame, payload...)
+	} else {
+		var mask [4]byte
+		_, _ = rand.Read(mask[:])
+		frame = append(frame, mask[:]...)
+		for i, c := range payload {
+			frame = append(frame, c^mask[i%4])
+		}
+	}
+
+	_, err := ws.Conn.Write(frame)
+	return err
+}
+
+// Close sends a close frame (unless one was sent already) and closes the underlying connection
+func (ws *webSocketConn) Close() error {
+	_ = ws.writeFrame(opClose, nil)
+	return ws.Conn.Close()
+}
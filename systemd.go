@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"net"
+	"os"
+)
+
+// ----------
+// This file contains helpers to integrate with systemd: socket activation (see sd_listen_fds(3) and
+// systemd_listeners.go; not on Windows) and service state notifications (see sd_notify(3)). Both are no-ops when not
+// running under systemd.
+// ----------
+
+const (
+	// first file descriptor passed by systemd (SD_LISTEN_FDS_START)
+	systemdListenFdsStart = 3
+
+	// names of the activated sockets (FileDescriptorName= in the socket unit) we recognise
+	systemdSSHSocketName     = "ssh"
+	systemdHTTPSocketName    = "http"
+	systemdTLSSocketName     = "tls"     // matched by name only
+	systemdSSHTLSSocketName  = "ssh-tls" // matched by name only
+	systemdMetricsSocketName = "metrics" // matched by name only
+	systemdAdminSocketName   = "admin"   // matched by name only
+	systemdDebugSocketName   = "debug"   // matched by name only
+	systemdRelaySocketName   = "relay"   // matched by name only
+
+	// prefix of the names of sockets for additional ssh listeners (followed by the listener's name); matched by name only
+	systemdListenerSocketPrefix = "ssh-"
+)
+
+// sdNotify sends the given [state] (eg. READY=1) to the service manager. It is a no-op if NOTIFY_SOCKET is not set.
+func sdNotify(state string) error {
+	var socket = os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	if socket[0] == '@' { // abstract namespace socket
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to notify socket")
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return errors.Wrap(err, "failed to notify service manager")
+}
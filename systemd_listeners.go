@@ -0,0 +1,69 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"github.com/pkg/errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ----------
+// Socket activation (see sd_listen_fds(3)), and the handing over of listeners on restart (see restart.go), pass
+// listeners as inherited file descriptors, which Windows doesn't support
+// ----------
+
+// systemdListeners returns the listeners passed by systemd via socket activation, keyed by their purpose
+// ([systemdSSHSocketName], [systemdHTTPSocketName], [systemdTLSSocketName], [systemdSSHTLSSocketName], [systemdMetricsSocketName], [systemdAdminSocketName], [systemdDebugSocketName] or [systemdRelaySocketName], or [systemdListenerSocketPrefix] followed by a listener's name). Sockets are matched by FileDescriptorName=
+// if set, or by their position otherwise (ssh first, then http). Returns an empty map if not socket activated.
+// If [inherited] is set, the sockets were handed over by a previous instance (see restart) and LISTEN_PID isn't checked.
+func systemdListeners(inherited bool) (map[string]net.Listener, error) {
+	var listeners = make(map[string]net.Listener)
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if !inherited && (err != nil || pid != os.Getpid()) {
+		return listeners, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return listeners, nil
+	}
+
+	var names = strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// don't let the variables leak into child processes
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	var positional = []string{systemdSSHSocketName, systemdHTTPSocketName}
+	for i := 0; i < count; i++ {
+		var fd = systemdListenFdsStart + i
+		syscall.CloseOnExec(fd)
+
+		var name string
+		if i < len(names) && (names[i] == systemdSSHSocketName || names[i] == systemdHTTPSocketName || names[i] == systemdTLSSocketName || names[i] == systemdSSHTLSSocketName || names[i] == systemdMetricsSocketName || names[i] == systemdAdminSocketName || names[i] == systemdDebugSocketName || names[i] == systemdRelaySocketName ||
+			strings.HasPrefix(names[i], systemdListenerSocketPrefix)) {
+			name = names[i]
+		} else if i < len(positional) {
+			name = positional[i]
+		} else {
+			continue
+		}
+
+		var file = os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(file)
+		_ = file.Close() // FileListener dup()s the descriptor
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to use activated socket %q", name)
+		}
+		listeners[name] = ln
+	}
+
+	return listeners, nil
+}
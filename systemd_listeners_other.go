@@ -0,0 +1,18 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"net"
+)
+
+// ----------
+// Windows doesn't pass listeners as inherited file descriptors, so there's neither socket activation nor the handing
+// over of listeners on restart there
+// ----------
+
+// systemdListeners always returns an empty map, as if not socket activated
+func systemdListeners(_ bool) (map[string]net.Listener, error) {
+	return make(map[string]net.Listener), nil
+}
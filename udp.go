@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/shhh/server"
+	gossh "golang.org/x/crypto/ssh"
+	"log"
+	"net"
+	"sync"
+)
+
+// ----------
+// This file implements the udp command, a companion to ssh -R for UDP: it asks the server to forward a public UDP
+// port (see server.UDPForwardRequest) and relays the datagrams of each visitor to a local UDP service
+// ----------
+
+// udpCommand implements the "udp" command
+func udpCommand(args []string) error {
+	var flags = flag.NewFlagSet("udp", flag.ExitOnError)
+	var opts clientOptions
+	opts.register(flags)
+	var specs forwardSpecs
+	flags.Var(&specs, "R", "forward a public UDP port to a local one, as [bind_address:]port:host:hostport (can be repeated)")
+	_ = flags.Parse(args)
+
+	if len(specs) == 0 {
+		return errors.New("nothing to forward; use -R [bind_address:]port:host:hostport")
+	}
+
+	client, err := opts.dial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	forwarder, err := forwardUDP(client, specs)
+	if err != nil {
+		return err
+	}
+
+	for port, target := range forwarder.targets {
+		fmt.Printf("forwarding udp://%s -> %s\n", net.JoinHostPort(opts.host(), fmt.Sprint(port)), target)
+	}
+
+	return client.Wait()
+}
+
+// udpForwarder relays the flows of a client's UDP tunnels to their local targets
+type udpForwarder struct {
+	mu      sync.RWMutex
+	targets map[uint32]string // local target, by the public port
+	ports   []uint32          // public port assigned for each of the specs, in order
+}
+
+// forwardUDP asks the server on [client] to forward each of [specs], and relays the flows it opens. If the server
+// refuses one, the forwarder is returned with the error, and has the ports of the specs forwarded before it.
+func forwardUDP(client *gossh.Client, specs []forwardSpec) (*udpForwarder, error) {
+	var forwarder = &udpForwarder{targets: make(map[uint32]string)}
+
+	// channels for flows may arrive as soon as a port is bound, so they're handled before requesting any
+	var channels = client.HandleChannelOpen(server.UDPForwardChannel)
+	if channels == nil {
+		return nil, errors.New("udp forwarding is already set up on this connection")
+	}
+	go func() {
+		for ch := range channels {
+			go forwarder.relay(ch)
+		}
+	}()
+
+	for _, spec := range specs {
+		var payload = struct {
+			BindAddr string
+			BindPort uint32
+		}{spec.bindAddr, spec.bindPort}
+
+		ok, reply, err := client.SendRequest(server.UDPForwardRequest, true, gossh.Marshal(&payload))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to request udp forwarding")
+		}
+		if !ok {
+			return forwarder, errors.Errorf("server refused to forward udp port %d: %s", spec.bindPort, string(reply))
+		}
+
+		var port = spec.bindPort
+		var response struct{ BindPort uint32 }
+		if gossh.Unmarshal(reply, &response) == nil && response.BindPort != 0 {
+			port = response.BindPort
+		}
+
+		forwarder.mu.Lock()
+		forwarder.targets[port] = spec.target
+		forwarder.ports = append(forwarder.ports, port)
+		forwarder.mu.Unlock()
+	}
+
+	return forwarder, nil
+}
+
+// relay accepts the flow on [ch] and relays its datagrams to (and back from) its local target
+func (forwarder *udpForwarder) relay(ch gossh.NewChannel) {
+	var payload struct {
+		DestAddr   string
+		DestPort   uint32
+		OriginAddr string
+		OriginPort uint32
+	}
+	if err := gossh.Unmarshal(ch.ExtraData(), &payload); err != nil {
+		_ = ch.Reject(gossh.ConnectionFailed, "malformed request")
+		return
+	}
+
+	forwarder.mu.RLock()
+	var target, ok = forwarder.targets[payload.DestPort]
+	forwarder.mu.RUnlock()
+	if !ok {
+		_ = ch.Reject(gossh.Prohibited, "port isn't forwarded")
+		return
+	}
+
+	local, err := net.Dial("udp", target)
+	if err != nil {
+		_ = ch.Reject(gossh.ConnectionFailed, err.Error())
+		return
+	}
+	defer local.Close()
+
+	channel, requests, err := ch.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	go gossh.DiscardRequests(requests)
+
+	// replies from the local service go back over the channel, until it's closed
+	go func() {
+		var buf = make([]byte, 65535)
+		for {
+			n, err := local.Read(buf)
+			if err != nil {
+				return
+			}
+			if server.WriteDatagram(channel, buf[:n]) != nil {
+				return
+			}
+		}
+	}()
+
+	var buf = make([]byte, 65535)
+	for {
+		n, err := server.ReadDatagram(channel, buf)
+		if err != nil {
+			return
+		}
+		if _, err = local.Write(buf[:n]); err != nil {
+			log.Printf("udp: failed to relay datagram from %s:%d to %s: %s", payload.OriginAddr, payload.OriginPort, target, err.Error())
+		}
+	}
+}
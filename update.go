@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------
+// This file implements the self-update command, which replaces the executable with the latest signed release
+// and (optionally) asks the running server to restart gracefully into it (see restart)
+// ----------
+
+// set at build time using -ldflags "-X main.version=... -X main.releaseManifest=... -X main.releaseKey=..."
+var (
+	// version of this build
+	version = "dev"
+
+	// URL of the release manifest to check for updates
+	releaseManifest = ""
+
+	// base64 encoded ed25519 public key which signs releases
+	releaseKey = ""
+)
+
+// maximum size of a release binary we're willing to download
+const maxReleaseSize = 256 << 20
+
+// manifest describes the latest release. It is signed by the release key; the (base64 encoded) signature
+// is published alongside it, at the manifest's URL suffixed with ".sig"
+type manifest struct {
+	Version string `json:"version"`
+
+	// time after which the manifest is no longer valid, so that an older (signed) manifest can't be replayed to keep
+	// servers from updating; release pipelines re-sign the manifest of the latest release before it expires
+	Expires time.Time `json:"expires"`
+
+	// binaries for each supported platform, keyed by GOOS/GOARCH (eg. linux/amd64)
+	Binaries map[string]struct {
+		URL       string `json:"url"`       // relative to the manifest's URL
+		Signature string `json:"signature"` // base64 encoded ed25519 signature of the binary
+	} `json:"binaries"`
+}
+
+// selfUpdate implements the "self-update" command
+func selfUpdate(args []string) error {
+	var flags = flag.NewFlagSet("self-update", flag.ExitOnError)
+	var manifestURL = flags.String("manifest", releaseManifest, "URL of the release manifest")
+	var key = flags.String("release-key", releaseKey, "base64 encoded ed25519 public key which signs releases")
+	var pid = flags.Int("pid", 0, "pid of the running server to gracefully restart once updated")
+	var force = flags.Bool("force", false, "update even if the manifest has expired, or its release isn't newer than the running version")
+	_ = flags.Parse(args)
+
+	if *manifestURL == "" || *key == "" {
+		return errors.New("release manifest and key must be specified")
+	}
+
+	// fail before replacing the executable, rather than after
+	if *pid != 0 && restartSignal == nil {
+		return errors.New("-pid: graceful restarts aren't supported on this platform")
+	}
+
+	publicKey, err := base64.StdEncoding.DecodeString(*key)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return errors.New("invalid release key")
+	}
+
+	var client = &http.Client{Timeout: 5 * time.Minute}
+
+	base, err := url.Parse(*manifestURL)
+	if err != nil {
+		return errors.Wrap(err, "invalid manifest url")
+	}
+
+	signature, err := fetch(client, base.String()+".sig")
+	if err != nil {
+		return err
+	}
+
+	var m manifest
+	content, err := fetchSigned(client, base, strings.TrimSpace(string(signature)), publicKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to verify release manifest")
+	}
+
+	if err = json.Unmarshal(content, &m); err != nil {
+		return errors.Wrap(err, "failed to parse release manifest")
+	}
+
+	if !*force {
+		if newer, err := m.check(version, time.Now()); err != nil {
+			return err
+		} else if !newer {
+			fmt.Printf("already running the latest version (%s)\n", version)
+			return nil
+		}
+	}
+
+	var platform = runtime.GOOS + "/" + runtime.GOARCH
+	binary, ok := m.Binaries[platform]
+	if !ok {
+		return errors.Errorf("release %s has no binary for %s", m.Version, platform)
+	}
+
+	ref, err := base.Parse(binary.URL)
+	if err != nil {
+		return errors.Wrap(err, "invalid binary url")
+	}
+
+	if content, err = fetchSigned(client, ref, binary.Signature, publicKey); err != nil {
+		return errors.Wrap(err, "failed to verify release binary")
+	}
+
+	if err = replaceExecutable(content); err != nil {
+		return err
+	}
+	fmt.Printf("updated from %s to %s\n", version, m.Version)
+
+	if *pid != 0 {
+		if err = signalRestart(*pid); err != nil {
+			return err
+		}
+		fmt.Printf("asked server (pid %d) to restart\n", *pid)
+	}
+
+	return nil
+}
+
+// check returns true if the release of the manifest is newer than the [running] version, and an error if the manifest
+// has expired (as of [now]), or its release is older than the running version (as a replayed manifest would be).
+// Development builds (whose version isn't a release's) update to any release.
+func (m manifest) check(running string, now time.Time) (bool, error) {
+	if m.Expires.IsZero() {
+		return false, errors.New("release manifest has no expiry")
+	}
+	if now.After(m.Expires) {
+		return false, errors.Errorf("release manifest expired on %s", m.Expires.Format(time.RFC3339))
+	}
+
+	release, ok := parseVersion(m.Version)
+	if !ok {
+		return false, errors.Errorf("invalid release version %q", m.Version)
+	}
+	current, ok := parseVersion(running)
+	if !ok {
+		return true, nil
+	}
+
+	var c = compareVersions(release, current)
+	if c < 0 {
+		return false, errors.Errorf("release %s is older than the running version (%s); refusing to downgrade", m.Version, running)
+	}
+	return c > 0, nil
+}
+
+// parsedVersion is a version of the form [v]major.minor.patch[-prerelease], eg. v1.2.3 or 1.2.0-rc.1
+type parsedVersion struct {
+	numbers    [3]int
+	prerelease string
+}
+
+// parseVersion parses [v], returning false if it isn't a release's version (eg. "dev")
+func parseVersion(v string) (parsedVersion, bool) {
+	var parsed parsedVersion
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		if v[i] == '-' {
+			parsed.prerelease = strings.SplitN(v[i+1:], "+", 2)[0]
+		}
+		v = v[:i]
+	}
+
+	var parts = strings.Split(v, ".")
+	if len(parts) > 3 {
+		return parsedVersion{}, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return parsedVersion{}, false
+		}
+		parsed.numbers[i] = n
+	}
+	return parsed, true
+}
+
+// compareVersions returns -1, 0 or 1 as [a] is older than, the same as, or newer than [b]. A prerelease is older than
+// its release; prereleases compare by their identifiers, numerically where both are numbers (as in semver).
+func compareVersions(a, b parsedVersion) int {
+	for i := range a.numbers {
+		if a.numbers[i] != b.numbers[i] {
+			return sign(a.numbers[i] - b.numbers[i])
+		}
+	}
+
+	switch {
+	case a.prerelease == b.prerelease:
+		return 0
+	case a.prerelease == "":
+		return 1
+	case b.prerelease == "":
+		return -1
+	}
+
+	var as, bs = strings.Split(a.prerelease, "."), strings.Split(b.prerelease, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aErr := strconv.Atoi(as[i])
+		bn, bErr := strconv.Atoi(bs[i])
+		switch {
+		case aErr == nil && bErr == nil:
+			if an != bn {
+				return sign(an - bn)
+			}
+		case aErr == nil: // numeric identifiers are older than alphanumeric ones
+			return -1
+		case bErr == nil:
+			return 1
+		case as[i] != bs[i]:
+			return sign(strings.Compare(as[i], bs[i]))
+		}
+	}
+	return sign(len(as) - len(bs))
+}
+
+// sign returns -1, 0 or 1 as [n] is negative, zero or positive
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// fetchSigned downloads [ref] and verifies it against the base64 encoded [signature] using [key].
+// The content is only returned if the signature is valid.
+func fetchSigned(client *http.Client, ref *url.URL, signature string, key ed25519.PublicKey) ([]byte, error) {
+	content, err := fetch(client, ref.String())
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || !ed25519.Verify(key, content, sig) {
+		return nil, errors.Errorf("invalid signature for %s", ref)
+	}
+
+	return content, nil
+}
+
+// fetch downloads the content at [u]
+func fetch(client *http.Client, u string) ([]byte, error) {
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to download %s", u)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to download %s: %s", u, resp.Status)
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxReleaseSize))
+	return content, errors.Wrapf(err, "failed to download %s", u)
+}
+
+// replaceExecutable atomically replaces the running executable with [content]
+func replaceExecutable(content []byte) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "failed to locate executable")
+	}
+
+	if executable, err = filepath.EvalSymlinks(executable); err != nil {
+		return errors.Wrap(err, "failed to locate executable")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(executable), "."+filepath.Base(executable)+"-*")
+	if err != nil {
+		return errors.Wrap(err, "failed to write update")
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if _, err = tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		return errors.Wrap(err, "failed to write update")
+	}
+
+	if err = tmp.Close(); err != nil {
+		return errors.Wrap(err, "failed to write update")
+	}
+
+	if err = os.Chmod(tmp.Name(), 0755); err != nil {
+		return errors.Wrap(err, "failed to write update")
+	}
+
+	return errors.Wrap(os.Rename(tmp.Name(), executable), "failed to replace executable")
+}
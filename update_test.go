@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompareVersions(t *testing.T) {
+	for _, test := range []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"v1.2.3", "1.2.3", 0},
+		{"1.2", "1.2.0", 0},
+		{"1.10.0", "1.9.9", 1},
+		{"1.2.3", "2.0.0", -1},
+		{"1.2.3-rc.1", "1.2.3", -1},
+		{"1.2.3-rc.2", "1.2.3-rc.10", -1},
+		{"1.2.3-rc.1", "1.2.3-beta", 1},
+		{"1.2.3-1", "1.2.3-alpha", -1},
+		{"1.2.3-rc", "1.2.3-rc.1", -1},
+		{"1.2.3+build.5", "1.2.3", 0},
+	} {
+		a, aOk := parseVersion(test.a)
+		b, bOk := parseVersion(test.b)
+		if !aOk || !bOk {
+			t.Errorf("failed to parse %q or %q", test.a, test.b)
+			continue
+		}
+		if got := compareVersions(a, b); got != test.want {
+			t.Errorf("compare(%q, %q): got %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+
+	for _, v := range []string{"dev", "", "1.x.0", "1.2.3.4", "1..2"} {
+		if _, ok := parseVersion(v); ok {
+			t.Errorf("%q parsed as a release's version", v)
+		}
+	}
+}
+
+func TestManifestCheck(t *testing.T) {
+	var now = time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	var valid = now.Add(24 * time.Hour)
+
+	for _, test := range []struct {
+		name     string
+		manifest manifest
+		running  string
+		newer    bool
+		err      string // in the error, if any
+	}{
+		{"newer", manifest{Version: "1.3.0", Expires: valid}, "1.2.0", true, ""},
+		{"same", manifest{Version: "1.2.0", Expires: valid}, "v1.2.0", false, ""},
+		{"development build", manifest{Version: "1.0.0", Expires: valid}, "dev", true, ""},
+		{"replayed", manifest{Version: "1.1.0", Expires: valid}, "1.2.0", false, "refusing to downgrade"},
+		{"expired", manifest{Version: "1.3.0", Expires: now.Add(-time.Second)}, "1.2.0", false, "expired"},
+		{"without expiry", manifest{Version: "1.3.0"}, "1.2.0", false, "no expiry"},
+		{"invalid version", manifest{Version: "latest", Expires: valid}, "1.2.0", false, "invalid release version"},
+	} {
+		newer, err := test.manifest.check(test.running, now)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got %v, want an error with %q", test.name, err, test.err)
+			}
+		} else if err != nil || newer != test.newer {
+			t.Errorf("%s: got %v (err: %v), want %v", test.name, newer, err, test.newer)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/shhh/server"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ----------
+// This file contains the dialers for servers given as URLs (-server tls://host, wss://host/path or ws://host/path),
+// whose ssh connections are wrapped in TLS or a WebSocket to get through proxies / firewalls which only let
+// HTTP(S) through. Wrapped connections go through the proxy set in HTTPS_PROXY (or HTTP_PROXY, for ws://), if any.
+// ----------
+
+// dialWrapped connects to the server at [u] (with a tls, wss or ws scheme) within [timeout], and returns the
+// connection carrying ssh along with the address it was made to
+func dialWrapped(u *url.URL, timeout time.Duration, insecure bool) (net.Conn, string, error) {
+	var secure bool
+	switch u.Scheme {
+	case "tls", "wss":
+		secure = true
+	case "ws":
+	default:
+		return nil, "", errors.Errorf("unsupported server scheme %q: must be one of tls, wss or ws", u.Scheme)
+	}
+
+	var addr = u.Host
+	if u.Port() == "" {
+		var port = "443"
+		if !secure {
+			port = "80"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	var deadline = time.Now().Add(timeout)
+	conn, err := dialProxied(addr, secure, deadline)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to connect to %s", addr)
+	}
+	_ = conn.SetDeadline(deadline)
+
+	if secure {
+		var tlsConn = tls.Client(conn, &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: insecure, NextProtos: []string{"http/1.1"}})
+		if err = tlsConn.Handshake(); err != nil {
+			_ = conn.Close()
+			return nil, "", errors.Wrapf(err, "failed to connect to %s", addr)
+		}
+		conn = tlsConn
+	}
+
+	if u.Scheme != "tls" {
+		if conn, err = openWebSocket(conn, u); err != nil {
+			_ = conn.Close()
+			return nil, "", errors.Wrapf(err, "failed to connect to %s", addr)
+		}
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	return conn, addr, nil
+}
+
+// openWebSocket opens a WebSocket to [u] on [conn], and returns the connection carried over it
+func openWebSocket(conn net.Conn, u *url.URL) (net.Conn, error) {
+	var path = u.RequestURI()
+	var key = server.NewWebSocketKey()
+
+	_, err := fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", path, u.Host, key)
+	if err != nil {
+		return conn, err
+	}
+
+	var r = bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		return conn, errors.Wrap(err, "failed to open websocket")
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return conn, errors.Errorf("failed to open websocket: server responded with %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != server.WebSocketAccept(key) {
+		return conn, errors.New("failed to open websocket: invalid Sec-WebSocket-Accept")
+	}
+	return server.NewWebSocketConn(conn, r, true), nil
+}
+
+// dialProxied connects to [addr], through the proxy from the environment (if any) for https ([secure]) or http
+func dialProxied(addr string, secure bool, deadline time.Time) (net.Conn, error) {
+	var scheme = "http"
+	if secure {
+		scheme = "https"
+	}
+
+	proxy, err := http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: scheme, Host: addr}})
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid proxy")
+	}
+
+	var dialer = &net.Dialer{Deadline: deadline}
+	if proxy == nil {
+		return dialer.Dial("tcp", addr)
+	}
+
+	var proxyAddr = proxy.Host
+	if proxy.Port() == "" {
+		var port = "80"
+		if proxy.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), port)
+	}
+
+	conn, err := dialer.Dial("tcp", proxyAddr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to proxy %s", proxyAddr)
+	}
+	_ = conn.SetDeadline(deadline)
+
+	if proxy.Scheme == "https" {
+		var tlsConn = tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+		if err = tlsConn.Handshake(); err != nil {
+			_ = conn.Close()
+			return nil, errors.Wrapf(err, "failed to connect to proxy %s", proxyAddr)
+		}
+		conn = tlsConn
+	}
+
+	var header strings.Builder
+	fmt.Fprintf(&header, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if proxy.User != nil {
+		var password, _ = proxy.User.Password()
+		var credentials = base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		fmt.Fprintf(&header, "Proxy-Authorization: Basic %s\r\n", credentials)
+	}
+	header.WriteString("\r\n")
+
+	if _, err = conn.Write([]byte(header.String())); err != nil {
+		_ = conn.Close()
+		return nil, errors.Wrap(err, "failed to connect through proxy")
+	}
+
+	// the proxy doesn't send anything past its response until we do, so nothing's lost with the reader
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		_ = conn.Close()
+		return nil, errors.Wrap(err, "failed to connect through proxy")
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, errors.Errorf("proxy refused to connect: %s", resp.Status)
+	}
+	return conn, nil
+}